@@ -1,13 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/k/iRegistro/internal/application/auth"
+	"github.com/k/iRegistro/internal/application/communication"
+	"github.com/k/iRegistro/internal/application/jobs"
 	"github.com/k/iRegistro/internal/config"
+	"github.com/k/iRegistro/internal/infrastructure/backplane"
 	"github.com/k/iRegistro/internal/infrastructure/logger"
+	"github.com/k/iRegistro/internal/infrastructure/mail"
+	"github.com/k/iRegistro/internal/infrastructure/meeting"
 	"github.com/k/iRegistro/internal/infrastructure/persistence"
+	"github.com/k/iRegistro/internal/infrastructure/scanner"
+	"github.com/k/iRegistro/internal/infrastructure/sms"
+	"github.com/k/iRegistro/internal/infrastructure/webpush"
 	httpPresentation "github.com/k/iRegistro/internal/presentation/http"
 	"github.com/k/iRegistro/internal/presentation/http/handlers"
 	"github.com/k/iRegistro/internal/presentation/ws"
@@ -43,25 +57,113 @@ func main() {
 	// 4. Setup Dependencies
 	userRepo := persistence.NewUserRepository(db)
 	authRepo := persistence.NewAuthRepository(db)
+	webAuthn, err := auth.NewWebAuthn(cfg.WebAuthn.RPID, cfg.WebAuthn.RPDisplayName, cfg.WebAuthn.Origins())
+	if err != nil {
+		l.Fatal("Invalid WebAuthn configuration", zap.Error(err))
+	}
+	mfaService := auth.NewMFAService(userRepo, persistence.NewMFARepository(db), persistence.NewAdminRepository(db), webAuthn)
 	authService := auth.NewAuthService(
 		userRepo,
 		authRepo,
+		mfaService,
 		cfg.Auth.JWTSecret,
 		cfg.Auth.AccessDuration,
 		cfg.Auth.RefreshDuration,
 	)
-	authHandler := handlers.NewAuthHandler(authService)
+	mailer, err := mail.New(cfg.Mail, cfg.SMTP, l)
+	if err != nil {
+		l.Fatal("Invalid mail configuration", zap.Error(err))
+	}
+	resetService := auth.NewPasswordResetService(userRepo, authRepo, mailer, cfg.Frontend.URL+"/reset-password")
+	authHandler := handlers.NewAuthHandler(authService, mfaService, resetService)
 
 	// WebSocket
 	hub := ws.NewHub()
+	switch cfg.WebSocket.Backplane {
+	case "postgres":
+		bp, err := backplane.NewPostgres(db, persistence.DSN(cfg.Database), cfg.WebSocket.Channel)
+		if err != nil {
+			l.Fatal("Failed to set up the WebSocket backplane", zap.Error(err))
+		}
+		hub.SetBackplane(bp)
+	case "none":
+		l.Info("WebSocket backplane disabled: events only reach clients of this node")
+	default:
+		l.Fatal("Unknown WebSocket backplane", zap.String("backplane", cfg.WebSocket.Backplane))
+	}
 	go hub.Run()
-	wsHandler := ws.NewHandler(hub, cfg.Auth.JWTSecret)
+	wsHandler := ws.NewHandler(hub, cfg.Auth.JWTSecret, persistence.NewAcademicRepository(db))
+
+	// Notification channels
+	emailTemplates, err := communication.NewEmailTemplates(cfg.Frontend.URL)
+	if err != nil {
+		l.Fatal("Failed to load email templates", zap.Error(err))
+	}
+	senders := []communication.Sender{
+		communication.NewEmailSender(mailer, emailTemplates),
+		// Each school configures its own gateway in the "sms" setting
+		communication.NewSMSSender(persistence.NewCommunicationRepository(db), persistence.NewAdminRepository(db), sms.NewProvider),
+	}
+	if cfg.WebPush.PrivateKey != "" {
+		pusher, err := webpush.New(cfg.WebPush, nil)
+		if err != nil {
+			l.Fatal("Invalid Web Push configuration", zap.Error(err))
+		}
+		senders = append(senders, communication.NewPushSender(persistence.NewCommunicationRepository(db), pusher, cfg.Frontend.URL))
+	} else {
+		l.Info("Web Push disabled: WEBPUSH_PRIVATE_KEY not set")
+	}
+
+	virusScanner, err := scanner.New(cfg.Attachments)
+	if err != nil {
+		l.Fatal("Invalid attachments configuration", zap.Error(err))
+	}
+	attachments := communication.AttachmentPolicy{MaxSize: cfg.Attachments.MaxSize, Scanner: virusScanner}
+
+	meetingLinks, err := meeting.New(cfg.Meetings)
+	if err != nil {
+		l.Fatal("Invalid meetings configuration", zap.Error(err))
+	}
+
+	// Background jobs, shared with the other replicas through the jobs table
+	jobScheduler := jobs.NewScheduler(persistence.NewJobRepository(db), jobs.Options{
+		Concurrency:  cfg.Jobs.Concurrency,
+		PollInterval: cfg.Jobs.PollInterval,
+		Lease:        cfg.Jobs.Lease,
+		Retention:    cfg.Jobs.Retention,
+	}, l)
 
 	// 5. Setup Router
-	r := httpPresentation.NewRouter(authHandler, wsHandler, db, hub, l, cfg.Auth.JWTSecret)
+	r := httpPresentation.NewRouter(authHandler, wsHandler, db, hub, l, cfg.Auth.JWTSecret, senders, attachments, meetingLinks, jobScheduler, resetService)
+
+	// 6. Start Server and jobs, until SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	jobsDone := make(chan struct{})
+	go func() {
+		jobScheduler.Run(ctx)
+		close(jobsDone)
+	}()
 
-	// 6. Start Server
-	if err := r.Run(":" + cfg.Server.Port); err != nil {
-		l.Fatal("Failed to start server", zap.Error(err))
+	srv := &http.Server{Addr: ":" + cfg.Server.Port, Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			l.Fatal("Failed to start server", zap.Error(err))
+		}
+	}()
+
+	<-ctx.Done()
+	l.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		l.Error("Failed to shut down the server", zap.Error(err))
+	}
+	// Running jobs finish, or are taken again by another replica once their
+	// lease expires
+	select {
+	case <-jobsDone:
+	case <-shutdownCtx.Done():
+		l.Warn("Stopped before the running jobs finished")
 	}
 }
@@ -26,14 +26,28 @@ func main() {
 
 	logger.Info("Running migrations...")
 	if err := db.AutoMigrate(
-		&domain.User{}, &domain.Session{}, &domain.RefreshToken{},
+		&domain.User{}, &domain.Session{}, &domain.RefreshToken{}, &domain.AuthAuditLog{},
+		&domain.PendingIdentity{},
+		&domain.SAMLRequest{},
+		&domain.SAMLAssertionUse{},
+		&domain.WebAuthnCredential{},
+		&domain.RecoveryCode{},
+		&domain.WebAuthnCeremony{},
+		&domain.PasswordResetToken{},
 		// Communication
-		&domain.Notification{}, &domain.NotificationPreference{},
-		&domain.Conversation{}, &domain.Message{},
+		&domain.Notification{}, &domain.NotificationPreference{}, &domain.NotificationSettings{},
+		&domain.NotificationDelivery{}, &domain.DeliveryAttempt{}, &domain.PushSubscription{},
+		&domain.SMSUsage{}, &domain.AbsenceAlert{},
+		&domain.Conversation{}, &domain.Message{}, &domain.ConversationRead{},
+		&domain.Announcement{}, &domain.AnnouncementRecipient{},
+		&domain.Attachment{},
 		&domain.ColloquiumSlot{}, &domain.ColloquiumBooking{},
+		&domain.MeetingDay{}, &domain.MeetingDayTeacher{},
+		&domain.CalendarToken{}, &domain.Homework{}, &domain.SchoolEvent{},
+		&domain.Job{},
 		// Admin
 		&domain.AuditLog{}, &domain.SchoolSettings{},
-		&domain.UserImport{}, &domain.DataExport{},
+		&domain.UserImport{}, &domain.DataExport{}, &domain.SchoolOnboarding{},
 	); err != nil {
 		logger.Fatal("Failed to migrate database", zap.Error(err))
 	}
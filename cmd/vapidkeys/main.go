@@ -0,0 +1,19 @@
+// Command vapidkeys generates a VAPID key pair for Web Push, printed as the
+// environment variables the API reads.
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/k/iRegistro/internal/infrastructure/webpush"
+)
+
+func main() {
+	public, private, err := webpush.GenerateKeys()
+	if err != nil {
+		log.Fatalf("Failed to generate VAPID keys: %v", err)
+	}
+	fmt.Printf("WEBPUSH_PUBLIC_KEY=%s\n", public)
+	fmt.Printf("WEBPUSH_PRIVATE_KEY=%s\n", private)
+}
@@ -1,6 +1,8 @@
 package academic
 
 import (
+	"context"
+
 	"github.com/k/iRegistro/internal/domain"
 )
 
@@ -50,8 +52,8 @@ func (s *AcademicService) CreateClass(class *domain.Class) error {
 	return s.repo.CreateClass(class)
 }
 
-func (s *AcademicService) GetClassByID(id uint) (*domain.Class, error) {
-	return s.repo.GetClassByID(id)
+func (s *AcademicService) GetClassByID(ctx context.Context, id uint) (*domain.Class, error) {
+	return s.repo.GetClassByID(ctx, id)
 }
 
 func (s *AcademicService) GetClassesBySchoolID(schoolID uint) ([]domain.Class, error) {
@@ -64,16 +66,16 @@ func (s *AcademicService) CreateStudent(student *domain.Student) error {
 	return s.repo.CreateStudent(student)
 }
 
-func (s *AcademicService) GetStudentByID(id uint) (*domain.Student, error) {
-	return s.repo.GetStudentByID(id)
+func (s *AcademicService) GetStudentByID(ctx context.Context, id uint) (*domain.Student, error) {
+	return s.repo.GetStudentByID(ctx, id)
 }
 
 func (s *AcademicService) EnrollStudent(enrollment *domain.ClassEnrollment) error {
 	return s.repo.EnrollStudent(enrollment)
 }
 
-func (s *AcademicService) GetStudentsByClassID(classID uint, year string) ([]domain.Student, error) {
-	return s.repo.GetStudentsByClassID(classID, year)
+func (s *AcademicService) GetStudentsByClassID(ctx context.Context, classID uint, year string) ([]domain.Student, error) {
+	return s.repo.GetStudentsByClassID(ctx, classID, year)
 }
 
 // --- Subject ---
@@ -82,8 +84,8 @@ func (s *AcademicService) CreateSubject(subject *domain.Subject) error {
 	return s.repo.CreateSubject(subject)
 }
 
-func (s *AcademicService) GetSubjectByID(id uint) (*domain.Subject, error) {
-	return s.repo.GetSubjectByID(id)
+func (s *AcademicService) GetSubjectByID(ctx context.Context, id uint) (*domain.Subject, error) {
+	return s.repo.GetSubjectByID(ctx, id)
 }
 
 func (s *AcademicService) GetSubjectsBySchool(schoolID uint) ([]domain.Subject, error) {
@@ -1,6 +1,7 @@
 package academic
 
 import (
+	"context"
 	// Imported but only used if needed
 	"testing"
 	"time"
@@ -45,7 +46,7 @@ func (m *MockAcademicRepository) CreateClass(class *domain.Class) error {
 	return args.Error(0)
 }
 
-func (m *MockAcademicRepository) GetClassByID(classID uint) (*domain.Class, error) {
+func (m *MockAcademicRepository) GetClassByID(ctx context.Context, classID uint) (*domain.Class, error) {
 	args := m.Called(classID)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -71,19 +72,19 @@ func (m *MockAcademicRepository) GetClassesBySchoolID(schoolID uint) ([]domain.C
 func (m *MockAcademicRepository) CreateStudent(student *domain.Student) error {
 	return nil
 }
-func (m *MockAcademicRepository) GetStudentByID(id uint) (*domain.Student, error) {
+func (m *MockAcademicRepository) GetStudentByID(ctx context.Context, id uint) (*domain.Student, error) {
 	return nil, nil
 }
 func (m *MockAcademicRepository) EnrollStudent(enrollment *domain.ClassEnrollment) error {
 	return nil
 }
-func (m *MockAcademicRepository) GetStudentsByClassID(classID uint, year string) ([]domain.Student, error) {
+func (m *MockAcademicRepository) GetStudentsByClassID(ctx context.Context, classID uint, year string) ([]domain.Student, error) {
 	return nil, nil
 }
 func (m *MockAcademicRepository) CreateSubject(subject *domain.Subject) error {
 	return nil
 }
-func (m *MockAcademicRepository) GetSubjectByID(id uint) (*domain.Subject, error) {
+func (m *MockAcademicRepository) GetSubjectByID(ctx context.Context, id uint) (*domain.Subject, error) {
 	return nil, nil
 }
 func (m *MockAcademicRepository) AssignSubjectToClass(assignment *domain.ClassSubjectAssignment) error {
@@ -113,6 +114,9 @@ func (m *MockAcademicRepository) GetAbsencesByStudentID(studentID uint, year str
 func (m *MockAcademicRepository) GetAbsencesByClassID(classID uint, date time.Time) ([]domain.Absence, error) {
 	return nil, nil
 }
+func (m *MockAcademicRepository) GetAbsencesBySchoolID(schoolID uint, date time.Time) ([]domain.Absence, error) {
+	return nil, nil
+}
 func (m *MockAcademicRepository) UpdateAbsence(absence *domain.Absence) error {
 	return nil
 }
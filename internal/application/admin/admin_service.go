@@ -1,6 +1,8 @@
 package admin
 
 import (
+	"github.com/k/iRegistro/internal/application/auth"
+	"github.com/k/iRegistro/internal/application/communication"
 	"github.com/k/iRegistro/internal/domain"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -16,30 +18,56 @@ func NewAdminService(repo domain.AdminRepository, userRepo domain.UserRepository
 	return &AdminService{repo: repo, userRepo: userRepo, schoolRepo: schoolRepo, audit: audit}
 }
 
-func (s *AdminService) CreateSchool(data map[string]interface{}) (*domain.School, error) {
-	// Simple validation and creation
-	school := &domain.School{
-		Name:           data["name"].(string),
-		Address:        data["address"].(string),
-		City:           data["city"].(string),
-		Region:         data["region"].(string),
-		Code:           data["code"].(string),
-		PrincipalEmail: data["principalEmail"].(string),
+// CreateSchool creates a bare school. New schools are usually created with
+// the OnboardingService instead, which also sets them up.
+func (s *AdminService) CreateSchool(input SchoolInput) (*domain.School, error) {
+	school, err := input.school()
+	if err != nil {
+		return nil, err
 	}
-
 	if err := s.schoolRepo.CreateSchool(school); err != nil {
 		return nil, err
 	}
-
 	return school, nil
 }
 
+// GetSchoolSettings returns the settings of a school, without the
+// credentials of its SMS gateway.
 func (s *AdminService) GetSchoolSettings(schoolID uint) ([]domain.SchoolSettings, error) {
-	// Validate access?
-	return s.repo.GetSchoolSettings(schoolID)
+	settings, err := s.repo.GetSchoolSettings(schoolID)
+	if err != nil {
+		return nil, err
+	}
+	redacted := make([]domain.SchoolSettings, len(settings))
+	for i, setting := range settings {
+		if setting.Key == communication.SMSSettingsKey {
+			setting.Value = communication.RedactSMSSettings(setting.Value)
+		}
+		redacted[i] = setting
+	}
+	return redacted, nil
 }
 
+// UpdateSchoolSetting saves a setting of a school. The SMS gateway
+// credentials sent back redacted keep their stored value.
 func (s *AdminService) UpdateSchoolSetting(schoolID, userID uint, key string, value map[string]interface{}) error {
+	if key == communication.SMSSettingsKey {
+		settings, err := s.repo.GetSchoolSettings(schoolID)
+		if err != nil {
+			return err
+		}
+		var stored domain.JSONMap
+		for _, setting := range settings {
+			if setting.Key == key {
+				stored = setting.Value
+			}
+		}
+		value = communication.RestoreSMSSecrets(value, stored)
+	}
+	if err := validateSetting(key, value); err != nil {
+		return err
+	}
+
 	setting := &domain.SchoolSettings{
 		SchoolID: schoolID,
 		Key:      key,
@@ -50,10 +78,28 @@ func (s *AdminService) UpdateSchoolSetting(schoolID, userID uint, key string, va
 		return err
 	}
 
-	s.audit.LogAction(&schoolID, userID, "UPDATE_SETTING", "SETTINGS", key, "", map[string]interface{}{"key": key, "value": value})
+	logged := value
+	if key == communication.SMSSettingsKey {
+		logged = communication.RedactSMSSettings(value)
+	}
+	s.audit.LogAction(&schoolID, userID, "UPDATE_SETTING", "SETTINGS", key, "", map[string]interface{}{"key": key, "value": logged})
 	return nil
 }
 
+// validateSetting checks the value of the settings read by the services.
+func validateSetting(key string, value domain.JSONMap) error {
+	var err error
+	switch key {
+	case auth.SecuritySettingsKey:
+		_, err = auth.ParseSecondFactorPolicy(value)
+	case communication.ChannelsSettingsKey:
+		_, err = communication.ParseChannelPolicy(value)
+	case communication.SMSSettingsKey:
+		_, err = communication.ParseSMSSettings(value)
+	}
+	return err
+}
+
 func (s *AdminService) GetUsers(schoolID uint) ([]domain.User, error) {
 	return s.userRepo.FindAll(schoolID)
 }
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/k/iRegistro/internal/application/communication"
 	"github.com/k/iRegistro/internal/domain"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -100,17 +101,19 @@ func (m *MockAcademicRepository) CreateClass(class *domain.Class) error { return
 func (m *MockAcademicRepository) GetClassesBySchoolID(schoolID uint) ([]domain.Class, error) {
 	return nil, nil
 }
-func (m *MockAcademicRepository) GetClassByID(id uint) (*domain.Class, error) { return nil, nil }
+func (m *MockAcademicRepository) GetClassByID(ctx context.Context, id uint) (*domain.Class, error) {
+	return nil, nil
+}
 func (m *MockAcademicRepository) CreateStudent(student *domain.Student) error { return nil }
-func (m *MockAcademicRepository) GetStudentByID(id uint) (*domain.Student, error) {
+func (m *MockAcademicRepository) GetStudentByID(ctx context.Context, id uint) (*domain.Student, error) {
 	return nil, nil
 }
 func (m *MockAcademicRepository) EnrollStudent(enrollment *domain.ClassEnrollment) error { return nil }
-func (m *MockAcademicRepository) GetStudentsByClassID(classID uint, year string) ([]domain.Student, error) {
+func (m *MockAcademicRepository) GetStudentsByClassID(ctx context.Context, classID uint, year string) ([]domain.Student, error) {
 	return nil, nil
 }
 func (m *MockAcademicRepository) CreateSubject(subject *domain.Subject) error { return nil }
-func (m *MockAcademicRepository) GetSubjectByID(id uint) (*domain.Subject, error) {
+func (m *MockAcademicRepository) GetSubjectByID(ctx context.Context, id uint) (*domain.Subject, error) {
 	return nil, nil
 }
 func (m *MockAcademicRepository) AssignSubjectToClass(assignment *domain.ClassSubjectAssignment) error {
@@ -146,6 +149,9 @@ func (m *MockAcademicRepository) GetAbsencesByStudentID(studentID uint, year str
 func (m *MockAcademicRepository) GetAbsencesByClassID(classID uint, date time.Time) ([]domain.Absence, error) {
 	return nil, nil
 }
+func (m *MockAcademicRepository) GetAbsencesBySchoolID(schoolID uint, date time.Time) ([]domain.Absence, error) {
+	return nil, nil
+}
 func (m *MockAcademicRepository) UpdateAbsence(absence *domain.Absence) error { return nil }
 
 type MockAdminRepository struct {
@@ -169,6 +175,11 @@ func (m *MockAdminRepository) GetSchoolSettings(schoolID uint) ([]domain.SchoolS
 	return args.Get(0).([]domain.SchoolSettings), args.Error(1)
 }
 
+func (m *MockAdminRepository) GetSchoolSettingsByKey(key string) ([]domain.SchoolSettings, error) {
+	args := m.Called(key)
+	return args.Get(0).([]domain.SchoolSettings), args.Error(1)
+}
+
 func (m *MockAdminRepository) UpsertSchoolSetting(setting *domain.SchoolSettings) error {
 	args := m.Called(setting)
 	return args.Error(0)
@@ -212,6 +223,11 @@ func (m *MockAdminRepository) UpdateDataExport(exp *domain.DataExport) error {
 	return args.Error(0)
 }
 
+func (m *MockAdminRepository) GetExpiredDataExports(before time.Time) ([]domain.DataExport, error) {
+	args := m.Called(before)
+	return args.Get(0).([]domain.DataExport), args.Error(1)
+}
+
 // --- Tests ---
 
 func TestAdminService_GetUsers(t *testing.T) {
@@ -315,3 +331,26 @@ func TestAdminService_UpdateSchoolSetting(t *testing.T) {
 	assert.NoError(t, err)
 	mockAdminRepo.AssertExpectations(t)
 }
+
+func TestAdminService_SMSSettingsSecrets(t *testing.T) {
+	mockAdminRepo := new(MockAdminRepository)
+	service := NewAdminService(mockAdminRepo, new(MockUserRepository), nil, NewAuditService(mockAdminRepo))
+
+	stored := domain.JSONMap{"provider": "http", "url": "https://sms.example.com/send", "sender": "Scuola", "api_key": "secret"}
+	mockAdminRepo.On("GetSchoolSettings", uint(1)).Return([]domain.SchoolSettings{{SchoolID: 1, Key: communication.SMSSettingsKey, Value: stored}}, nil)
+
+	settings, err := service.GetSchoolSettings(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "***", settings[0].Value["api_key"])
+
+	// Saved back from the settings page, with a new sender
+	value := communication.RedactSMSSettings(stored)
+	value["sender"] = "Liceo"
+	mockAdminRepo.On("UpsertSchoolSetting", mock.MatchedBy(func(s *domain.SchoolSettings) bool {
+		return s.Value["api_key"] == "secret" && s.Value["sender"] == "Liceo"
+	})).Return(nil)
+	mockAdminRepo.On("CreateAuditLog", mock.Anything).Return(nil)
+
+	assert.NoError(t, service.UpdateSchoolSetting(1, 100, communication.SMSSettingsKey, value))
+	mockAdminRepo.AssertExpectations(t)
+}
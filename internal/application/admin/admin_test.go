@@ -26,6 +26,10 @@ func (m *MockAdminRepo) GetSchoolSettings(schoolID uint) ([]domain.SchoolSetting
 	args := m.Called(schoolID)
 	return args.Get(0).([]domain.SchoolSettings), args.Error(1)
 }
+func (m *MockAdminRepo) GetSchoolSettingsByKey(key string) ([]domain.SchoolSettings, error) {
+	args := m.Called(key)
+	return args.Get(0).([]domain.SchoolSettings), args.Error(1)
+}
 func (m *MockAdminRepo) UpsertSchoolSetting(setting *domain.SchoolSettings) error {
 	return m.Called(setting).Error(0)
 }
@@ -53,6 +57,10 @@ func (m *MockAdminRepo) GetDataExport(id uint) (*domain.DataExport, error) {
 func (m *MockAdminRepo) UpdateDataExport(exp *domain.DataExport) error {
 	return m.Called(exp).Error(0)
 }
+func (m *MockAdminRepo) GetExpiredDataExports(before time.Time) ([]domain.DataExport, error) {
+	args := m.Called(before)
+	return args.Get(0).([]domain.DataExport), args.Error(1)
+}
 
 type MockUserRepo struct {
 	mock.Mock
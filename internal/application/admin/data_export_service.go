@@ -1,54 +1,554 @@
 package admin
 
 import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/k/iRegistro/internal/application/sidi"
 	"github.com/k/iRegistro/internal/domain"
 )
 
+// DataExportJob is the type of the jobs generating data exports; their
+// payload holds the export_id.
+const DataExportJob = "admin.data_export"
+
+// Formats of the data exports.
+const (
+	ExportCSV  = "CSV"  // A ZIP archive of a CSV file per section
+	ExportJSON = "JSON" // A JSON object of an array per section
+	ExportSIDI = "SIDI" // A ZIP archive of the SIDI flow files of a school year
+)
+
+// sidiExportFlows are the flows of a SIDI export, in the order they are sent.
+var sidiExportFlows = []string{sidi.FlowEnrollment, sidi.FlowFrequency, sidi.FlowOutcome}
+
+// exportRetention is how long a generated export can be downloaded.
+const exportRetention = 24 * time.Hour
+
+var (
+	ErrInvalidExport  = errors.New("invalid export")
+	ErrExportNotFound = errors.New("export not found")
+	ErrExportNotReady = errors.New("export not ready")
+	ErrExportExpired  = errors.New("export expired")
+	// ErrExportNotAllowed is returned to the users who cannot export the
+	// records of the school.
+	ErrExportNotAllowed = errors.New("export not allowed")
+)
+
+// flowBuilder builds the SIDI flow files of a school, implemented by
+// sidi.SIDIService.
+type flowBuilder interface {
+	BuildFlow(schoolID uint, flow, year string) (*sidi.Flow, error)
+}
+
+// jobQueue enqueues background jobs, implemented by jobs.Scheduler.
+type jobQueue interface {
+	Enqueue(jobType string, payload domain.JSONMap, key string) (*domain.Job, error)
+}
+
+// DataExportService exports every record of a school in the background.
+// The files are written to dir and can be downloaded by the user who
+// requested them until they expire.
 type DataExportService struct {
-	repo domain.AdminRepository
+	repo    domain.AdminRepository
+	records domain.ExportRepository
+	flows   flowBuilder
+	queue   jobQueue
+	dir     string
 }
 
-func NewDataExportService(repo domain.AdminRepository) *DataExportService {
-	return &DataExportService{repo: repo}
+func NewDataExportService(repo domain.AdminRepository, records domain.ExportRepository, flows flowBuilder, queue jobQueue, dir string) *DataExportService {
+	return &DataExportService{repo: repo, records: records, flows: flows, queue: queue, dir: dir}
 }
 
-func (s *DataExportService) RequestExport(schoolID, userID uint, format string) (uint, error) {
+// RequestExport queues the export of the school for a user of role, which
+// must be able to read all its records. year is the school year of a SIDI
+// export, the current one when empty; the other formats hold every year.
+func (s *DataExportService) RequestExport(schoolID, userID uint, role domain.Role, format, year string) (uint, error) {
+	if !canExport(role) {
+		return 0, ErrExportNotAllowed
+	}
+	format = strings.ToUpper(format)
+	if format == "" {
+		format = ExportCSV
+	}
+	switch format {
+	case ExportCSV, ExportJSON:
+		if year != "" {
+			return 0, fmt.Errorf("%w: a year only applies to %s exports", ErrInvalidExport, ExportSIDI)
+		}
+	case ExportSIDI:
+		if year == "" {
+			year = sidi.CurrentYear(time.Now())
+		}
+		if err := sidi.ValidateYear(year); err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrInvalidExport, err)
+		}
+	default:
+		return 0, fmt.Errorf("%w: format must be %s, %s or %s", ErrInvalidExport, ExportCSV, ExportJSON, ExportSIDI)
+	}
+
 	exp := &domain.DataExport{
-		SchoolID:    schoolID,
-		RequestedBy: userID,
-		ExportType:  format,
-		Status:      "PENDING",
-		CreatedAt:   time.Now(),
-		ExpiryDate:  time.Now().Add(24 * time.Hour), // 24h retention
+		SchoolID:     schoolID,
+		RequestedBy:  userID,
+		ExportType:   format,
+		AcademicYear: year,
+		Status:       domain.ExportPending,
+		CreatedAt:    time.Now(),
+		ExpiryDate:   time.Now().Add(exportRetention),
 	}
 
 	if err := s.repo.CreateDataExport(exp); err != nil {
 		return 0, err
 	}
 
-	// Trigger generation async
-	go s.generateExport(exp)
+	// Generated by the job scheduler
+	key := fmt.Sprintf("%s:%d", DataExportJob, exp.ID)
+	if _, err := s.queue.Enqueue(DataExportJob, domain.JSONMap{"export_id": exp.ID}, key); err != nil {
+		return 0, err
+	}
 
 	return exp.ID, nil
 }
 
-func (s *DataExportService) generateExport(exp *domain.DataExport) {
-	// Stub generation logic
-	// 1. Fetch all data for school (Users, Classes, etc.)
-	// 2. Serialize to CSV/JSON
-	// 3. Write to temp file
+func canExport(role domain.Role) bool {
+	return role == domain.RoleAdmin || role == domain.RolePrincipal || role == domain.RoleSuperAdmin
+}
+
+// GetExport returns an export with its progress, only to the user who
+// requested it.
+func (s *DataExportService) GetExport(schoolID, userID, id uint) (*domain.DataExport, error) {
+	exp, err := s.repo.GetDataExport(id)
+	if err != nil {
+		return nil, err
+	}
+	if exp == nil || exp.SchoolID != schoolID || exp.RequestedBy != userID {
+		return nil, ErrExportNotFound
+	}
+	return exp, nil
+}
+
+// Download returns an export whose file can be sent, and the name to send
+// it as.
+func (s *DataExportService) Download(schoolID, userID, id uint, now time.Time) (*domain.DataExport, string, error) {
+	exp, err := s.GetExport(schoolID, userID, id)
+	if err != nil {
+		return nil, "", err
+	}
+	if exp.Status == domain.ExportExpired || now.After(exp.ExpiryDate) {
+		return nil, "", ErrExportExpired
+	}
+	if exp.Status != domain.ExportReady {
+		return nil, "", fmt.Errorf("%w: the export is %s", ErrExportNotReady, exp.Status)
+	}
+	if exp.ExportType == ExportSIDI {
+		return exp, fmt.Sprintf("school-%d-sidi-%s.zip", exp.SchoolID, exp.AcademicYear), nil
+	}
+	ext := ".zip"
+	if exp.ExportType == ExportJSON {
+		ext = ".json"
+	}
+	return exp, fmt.Sprintf("school-%d-export-%s%s", exp.SchoolID, exp.CreatedAt.Format("2006-01-02"), ext), nil
+}
+
+// GenerateExport writes the file of the export id, run by DataExportJob.
+// The progress is saved after each section; a failed attempt is marked
+// FAILED until the job retries it.
+func (s *DataExportService) GenerateExport(id uint) error {
+	exp, err := s.repo.GetDataExport(id)
+	if err != nil {
+		return err
+	}
+	if exp == nil || exp.Status == domain.ExportReady || exp.Status == domain.ExportExpired {
+		return nil // A retry after it was saved
+	}
+
+	exp.Status, exp.Progress, exp.Records, exp.Error = domain.ExportProcessing, 0, 0, ""
+	if err := s.repo.UpdateDataExport(exp); err != nil {
+		return err
+	}
+	if err := s.generate(exp); err != nil {
+		exp.Status, exp.Error = domain.ExportFailed, truncate(err.Error(), 255)
+		if uerr := s.repo.UpdateDataExport(exp); uerr != nil {
+			return uerr
+		}
+		return err
+	}
+
+	now := time.Now()
+	exp.Status, exp.Progress, exp.CompletedAt = domain.ExportReady, 100, &now
+	return s.repo.UpdateDataExport(exp)
+}
+
+// generate streams the export into a temporary file of dir, renamed once
+// complete.
+func (s *DataExportService) generate(exp *domain.DataExport) error {
+	if err := os.MkdirAll(s.dir, 0o750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, fmt.Sprintf("export_%d_*.part", exp.ID))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Once renamed, a no-op
+	defer tmp.Close()
+
+	buf := bufio.NewWriter(tmp)
+	ext := ".zip"
+	if exp.ExportType == ExportJSON {
+		ext = ".json"
+	}
+	if exp.ExportType == ExportSIDI {
+		err = s.writeFlows(buf, exp)
+	} else {
+		err = s.writeSections(buf, exp)
+	}
+	if err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, fmt.Sprintf("export_%d_%d%s", exp.SchoolID, exp.ID, ext))
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if exp.FilePath != "" && exp.FilePath != path {
+		os.Remove(exp.FilePath)
+	}
+	exp.FilePath, exp.Size = path, info.Size()
+	return nil
+}
+
+// writeSections writes the records of the school, section by section.
+func (s *DataExportService) writeSections(out io.Writer, exp *domain.DataExport) error {
+	var w exportWriter
+	if exp.ExportType == ExportJSON {
+		w = newJSONExportWriter(out, exp)
+	} else {
+		w = newCSVExportWriter(out)
+	}
+
+	sections := exportSections()
+	for i, section := range sections {
+		if err := w.begin(section.name, section.columns); err != nil {
+			return err
+		}
+		n, err := section.write(s.records, exp.SchoolID, w.write)
+		if err != nil {
+			return fmt.Errorf("%s: %w", section.name, err)
+		}
+		if err := w.end(); err != nil {
+			return err
+		}
+		exp.Records += n
+		exp.Progress = (i + 1) * 100 / (len(sections) + 1) // The last step is saving the file
+		if err := s.repo.UpdateDataExport(exp); err != nil {
+			return err
+		}
+	}
+	return w.close()
+}
+
+// writeFlows writes a ZIP archive of the SIDI flow files of the school year,
+// with skipped.csv listing the students left out of them.
+func (s *DataExportService) writeFlows(out io.Writer, exp *domain.DataExport) error {
+	zw := zip.NewWriter(out)
+	var skipped [][]string
+	for i, name := range sidiExportFlows {
+		flow, err := s.flows.BuildFlow(exp.SchoolID, name, exp.AcademicYear)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		f, err := zw.Create(flow.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(flow.Data); err != nil {
+			return err
+		}
+		for _, p := range flow.Skipped {
+			skipped = append(skipped, []string{name, strconv.FormatUint(uint64(p.StudentID), 10), p.Student, p.Field, p.Message})
+		}
+		exp.Records += flow.Records
+		exp.Progress = (i + 1) * 100 / (len(sidiExportFlows) + 1)
+		if err := s.repo.UpdateDataExport(exp); err != nil {
+			return err
+		}
+	}
+
+	f, err := zw.Create("skipped.csv")
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"flow", "student_id", "student", "field", "message"})
+	w.WriteAll(skipped)
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// PurgeExpired deletes the files of the exports expired at now, which stay
+// listed as EXPIRED. It returns the number of exports purged.
+func (s *DataExportService) PurgeExpired(now time.Time) (int, error) {
+	exports, err := s.repo.GetExpiredDataExports(now)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for i := range exports {
+		exp := &exports[i]
+		if exp.FilePath != "" {
+			if err := os.Remove(exp.FilePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return purged, err
+			}
+		}
+		exp.FilePath = ""
+		exp.Status = domain.ExportExpired
+		if err := s.repo.UpdateDataExport(exp); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// exportSection is a kind of record of the export, written as a CSV file or
+// a JSON array.
+type exportSection struct {
+	name    string
+	columns []string
+	// write emits the records of the school, their values in the order of
+	// the columns, and returns how many it emitted.
+	write func(records domain.ExportRepository, schoolID uint, emit func(values []interface{}) error) (int, error)
+}
+
+// section returns the exportSection of the records read by each, one row per
+// record as returned by row.
+func section[T any](name string, columns []string, each func(domain.ExportRepository, uint, func([]T) error) error, row func(*T) []interface{}) exportSection {
+	return exportSection{name: name, columns: columns, write: func(records domain.ExportRepository, schoolID uint, emit func([]interface{}) error) (int, error) {
+		n := 0
+		err := each(records, schoolID, func(batch []T) error {
+			for i := range batch {
+				if err := emit(row(&batch[i])); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		})
+		return n, err
+	}}
+}
+
+// exportSections lists what a school export holds. Secrets, such as the
+// password hashes, and the content of the documents are left out.
+func exportSections() []exportSection {
+	return []exportSection{
+		section("users", []string{"id", "email", "role", "status", "first_name", "last_name", "tax_code", "phone", "locale", "created_at"},
+			domain.ExportRepository.ExportUsers, func(u *domain.User) []interface{} {
+				return []interface{}{u.ID, u.Email, u.Role, u.Status, u.FirstName, u.LastName, u.TaxCode, u.Phone, u.Locale, u.CreatedAt}
+			}),
+		section("students", []string{"id", "first_name", "last_name", "tax_code", "date_of_birth", "place_of_birth", "gender", "citizenship", "user_id", "parent_1_id", "parent_2_id"},
+			domain.ExportRepository.ExportStudents, func(st *domain.Student) []interface{} {
+				return []interface{}{st.ID, st.FirstName, st.LastName, st.TaxCode, exportDate(st.DateOfBirth), st.PlaceOfBirth, st.Gender, st.Citizenship, st.UserID, st.Parent1ID, st.Parent2ID}
+			}),
+		section("classes", []string{"id", "grade", "section", "academic_year", "campus_id", "curriculum_id", "room", "coordinator_id"},
+			domain.ExportRepository.ExportClasses, func(c *domain.Class) []interface{} {
+				return []interface{}{c.ID, c.Grade, c.Section, c.Year, c.CampusID, c.CurriculumID, c.Room, c.CoordinatorID}
+			}),
+		section("subjects", []string{"id", "code", "name", "hours_per_week"},
+			domain.ExportRepository.ExportSubjects, func(sub *domain.Subject) []interface{} {
+				return []interface{}{sub.ID, sub.Code, sub.Name, sub.HoursPerWeek}
+			}),
+		section("enrollments", []string{"id", "student_id", "class_id", "year", "status", "enrollment_date"},
+			domain.ExportRepository.ExportEnrollments, func(e *domain.ClassEnrollment) []interface{} {
+				return []interface{}{e.ID, e.StudentID, e.ClassID, e.Year, e.Status, exportDate(e.EnrollmentDate)}
+			}),
+		section("marks", []string{"id", "student_id", "class_id", "subject_id", "teacher_id", "date", "value", "weight", "type", "is_justified", "justification"},
+			domain.ExportRepository.ExportMarks, func(m *domain.Mark) []interface{} {
+				return []interface{}{m.ID, m.StudentID, m.ClassID, m.SubjectID, m.TeacherID, exportDate(m.Date), m.Value, m.Weight, m.Type, m.IsJustified, m.Justification}
+			}),
+		section("absences", []string{"id", "student_id", "class_id", "date", "hour", "type", "is_justified", "justified_date", "note"},
+			domain.ExportRepository.ExportAbsences, func(a *domain.Absence) []interface{} {
+				var justified interface{}
+				if a.JustifiedDate != nil {
+					justified = exportDate(*a.JustifiedDate)
+				}
+				return []interface{}{a.ID, a.StudentID, a.ClassID, exportDate(a.Date), a.Hour, a.Type, a.IsJustified, justified, a.Note}
+			}),
+		section("documents", []string{"id", "type", "title", "status", "academic_year", "student_id", "class_id", "created_by", "created_at"},
+			domain.ExportRepository.ExportDocuments, func(d *domain.Document) []interface{} {
+				return []interface{}{d.ID, d.Type, d.Title, d.Status, d.AcademicYear, d.StudentID, d.ClassID, d.CreatedBy, d.CreatedAt}
+			}),
+	}
+}
+
+// exportDate is a day without time, empty when zero.
+type exportDate time.Time
+
+func (d exportDate) String() string {
+	if time.Time(d).IsZero() {
+		return ""
+	}
+	return time.Time(d).Format("2006-01-02")
+}
+
+func (d exportDate) MarshalJSON() ([]byte, error) {
+	if time.Time(d).IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(d.String())
+}
+
+// exportWriter writes the sections of an export one after the other.
+type exportWriter interface {
+	begin(name string, columns []string) error
+	write(values []interface{}) error
+	end() error
+	close() error
+}
+
+type csvExportWriter struct {
+	zw  *zip.Writer
+	csv *csv.Writer
+}
+
+func newCSVExportWriter(w io.Writer) *csvExportWriter {
+	return &csvExportWriter{zw: zip.NewWriter(w)}
+}
+
+func (w *csvExportWriter) begin(name string, columns []string) error {
+	f, err := w.zw.Create(name + ".csv")
+	if err != nil {
+		return err
+	}
+	w.csv = csv.NewWriter(f)
+	return w.csv.Write(columns)
+}
+
+func (w *csvExportWriter) write(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		record[i] = csvCell(v)
+	}
+	return w.csv.Write(record)
+}
 
-	// Mocking success
-	data := map[string]string{"sample": "data"}
-	file, _ := os.CreateTemp("", "export_*.json")
-	defer file.Close()
-	json.NewEncoder(file).Encode(data)
+func (w *csvExportWriter) end() error {
+	w.csv.Flush()
+	return w.csv.Error()
+}
 
-	exp.FilePath = file.Name()
-	exp.Status = "READY"
-	s.repo.UpdateDataExport(exp)
+func (w *csvExportWriter) close() error {
+	return w.zw.Close()
+}
+
+// csvCell formats a value of an export row; nil pointers are empty cells.
+func csvCell(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case *string:
+		if v == nil {
+			return ""
+		}
+		return *v
+	case *uint:
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatUint(uint64(*v), 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return fmt.Sprint(v)
+}
+
+// jsonExportWriter writes an object with the school and an array of objects
+// per section, one record at a time.
+type jsonExportWriter struct {
+	w       io.Writer
+	exp     *domain.DataExport
+	columns []string
+	started bool // The object was opened
+	first   bool // No record in the current section yet
+}
+
+func newJSONExportWriter(w io.Writer, exp *domain.DataExport) *jsonExportWriter {
+	return &jsonExportWriter{w: w, exp: exp}
+}
+
+func (w *jsonExportWriter) begin(name string, columns []string) error {
+	prefix := ","
+	if !w.started {
+		header, err := json.Marshal(map[string]interface{}{"school_id": w.exp.SchoolID, "generated_at": time.Now().UTC()})
+		if err != nil {
+			return err
+		}
+		prefix = string(header[:len(header)-1]) + ","
+		w.started = true
+	}
+	key, _ := json.Marshal(name)
+	w.columns, w.first = columns, true
+	_, err := fmt.Fprintf(w.w, "%s\n%s:[", prefix, key)
+	return err
+}
+
+func (w *jsonExportWriter) write(values []interface{}) error {
+	record := make(map[string]interface{}, len(values))
+	for i, v := range values {
+		record[w.columns[i]] = v
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	sep := ",\n"
+	if w.first {
+		sep, w.first = "\n", false
+	}
+	_, err = io.WriteString(w.w, sep+string(b))
+	return err
+}
+
+func (w *jsonExportWriter) end() error {
+	_, err := io.WriteString(w.w, "]")
+	return err
+}
+
+func (w *jsonExportWriter) close() error {
+	_, err := io.WriteString(w.w, "\n}\n")
+	return err
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
 }
@@ -0,0 +1,287 @@
+package admin
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/k/iRegistro/internal/application/sidi"
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// exportAdminRepo stores the exports of a test and the progress saved.
+type exportAdminRepo struct {
+	MockAdminRepository
+	exports  []*domain.DataExport
+	progress []int
+}
+
+func (r *exportAdminRepo) CreateDataExport(exp *domain.DataExport) error {
+	exp.ID = uint(len(r.exports) + 1)
+	r.exports = append(r.exports, exp)
+	return nil
+}
+
+func (r *exportAdminRepo) GetDataExport(id uint) (*domain.DataExport, error) {
+	for _, exp := range r.exports {
+		if exp.ID == id {
+			return exp, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *exportAdminRepo) UpdateDataExport(exp *domain.DataExport) error {
+	r.progress = append(r.progress, exp.Progress)
+	return nil
+}
+
+func (r *exportAdminRepo) GetExpiredDataExports(before time.Time) ([]domain.DataExport, error) {
+	var expired []domain.DataExport
+	for _, exp := range r.exports {
+		if exp.ExpiryDate.Before(before) && exp.Status != domain.ExportExpired {
+			expired = append(expired, *exp)
+		}
+	}
+	return expired, nil
+}
+
+// memoryRecords holds the records of school 1, in batches of two.
+type memoryRecords struct {
+	fail bool // Reading the marks fails
+}
+
+func batches[T any](records []T, fn func([]T) error) error {
+	for i := 0; i < len(records); i += 2 {
+		if err := fn(records[i:min(i+2, len(records))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryRecords) ExportUsers(schoolID uint, fn func([]domain.User) error) error {
+	tc := "RSSMRA85T10A562S"
+	return batches([]domain.User{
+		{ID: 1, Email: "preside@example.it", Role: domain.RolePrincipal, PasswordHash: "secret-hash", TaxCode: &tc},
+		{ID: 2, Email: "prof@example.it", Role: domain.RoleTeacher, FirstName: "Anna", LastName: "Rossi, jr"},
+		{ID: 3, Email: "mamma@example.it", Role: domain.RoleParent},
+	}, fn)
+}
+
+func (m *memoryRecords) ExportStudents(schoolID uint, fn func([]domain.Student) error) error {
+	parent := uint(3)
+	return batches([]domain.Student{
+		{ID: 1, FirstName: "Giulia", LastName: "Bianchi", DateOfBirth: time.Date(2011, 2, 1, 0, 0, 0, 0, time.UTC), Parent1ID: &parent},
+	}, fn)
+}
+
+func (m *memoryRecords) ExportClasses(schoolID uint, fn func([]domain.Class) error) error {
+	return batches([]domain.Class{{ID: 1, Grade: 3, Section: "A", Year: "2025-26"}}, fn)
+}
+
+func (m *memoryRecords) ExportSubjects(schoolID uint, fn func([]domain.Subject) error) error {
+	return batches([]domain.Subject{{ID: 1, Code: "MAT", Name: "Matematica"}}, fn)
+}
+
+func (m *memoryRecords) ExportEnrollments(schoolID uint, fn func([]domain.ClassEnrollment) error) error {
+	return batches([]domain.ClassEnrollment{{ID: 1, StudentID: 1, ClassID: 1, Status: domain.EnrollmentActive}}, fn)
+}
+
+func (m *memoryRecords) ExportMarks(schoolID uint, fn func([]domain.Mark) error) error {
+	if m.fail {
+		return errors.New("connection reset")
+	}
+	return batches([]domain.Mark{{ID: 1, StudentID: 1, ClassID: 1, SubjectID: 1, Value: 7.5, Weight: 1}}, fn)
+}
+
+func (m *memoryRecords) ExportAbsences(schoolID uint, fn func([]domain.Absence) error) error {
+	return batches([]domain.Absence{}, fn)
+}
+
+func (m *memoryRecords) ExportDocuments(schoolID uint, fn func([]domain.Document) error) error {
+	return batches([]domain.Document{{ID: 1, Title: "Pagella"}}, fn)
+}
+
+func TestDataExportCSV(t *testing.T) {
+	repo := &exportAdminRepo{}
+	queue := &memorySchool{}
+	service := NewDataExportService(repo, &memoryRecords{}, nil, queue, t.TempDir())
+
+	_, err := service.RequestExport(1, 8, domain.RoleParent, "csv", "")
+	assert.ErrorIs(t, err, ErrExportNotAllowed)
+	_, err = service.RequestExport(1, 7, domain.RoleAdmin, "xml", "")
+	assert.ErrorIs(t, err, ErrInvalidExport)
+	_, err = service.RequestExport(1, 7, domain.RoleAdmin, "csv", "2025-26")
+	assert.ErrorIs(t, err, ErrInvalidExport, "every year is exported")
+	id, err := service.RequestExport(1, 7, domain.RoleAdmin, "csv", "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"admin.data_export:1"}, queue.jobs)
+
+	_, _, err = service.Download(1, 7, id, time.Now())
+	assert.ErrorIs(t, err, ErrExportNotReady)
+
+	require.NoError(t, service.GenerateExport(id))
+	exp := repo.exports[0]
+	assert.Equal(t, domain.ExportReady, exp.Status)
+	assert.Equal(t, 9, exp.Records)
+	assert.Equal(t, []int{0, 11, 22, 33, 44, 55, 66, 77, 88, 100}, repo.progress, "saved after each section")
+
+	// Only the user who asked for it
+	_, _, err = service.Download(1, 8, id, time.Now())
+	assert.ErrorIs(t, err, ErrExportNotFound)
+	_, _, err = service.Download(2, 7, id, time.Now())
+	assert.ErrorIs(t, err, ErrExportNotFound)
+	_, _, err = service.Download(1, 7, id, exp.ExpiryDate.Add(time.Second))
+	assert.ErrorIs(t, err, ErrExportExpired)
+	exp, name, err := service.Download(1, 7, id, time.Now())
+	require.NoError(t, err)
+	assert.Regexp(t, `^school-1-export-\d{4}-\d{2}-\d{2}\.zip$`, name)
+
+	data, err := os.ReadFile(exp.FilePath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), exp.Size)
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	files := map[string][][]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		rows, err := csv.NewReader(rc).ReadAll()
+		require.NoError(t, err)
+		rc.Close()
+		files[f.Name] = rows
+	}
+	assert.Len(t, files, 8)
+	assert.Equal(t, []string{"1", "preside@example.it", "Principal", "", "", "", "RSSMRA85T10A562S", "", "", "0001-01-01T00:00:00Z"}, files["users.csv"][1])
+	assert.Equal(t, "Rossi, jr", files["users.csv"][2][5])
+	assert.NotContains(t, string(data), "secret-hash")
+	assert.Equal(t, []string{"1", "Giulia", "Bianchi", "", "2011-02-01", "", "", "", "", "3", ""}, files["students.csv"][1])
+	assert.Equal(t, "7.5", files["marks.csv"][1][6])
+	assert.Len(t, files["absences.csv"], 1, "the header only")
+
+	// Purged once expired, the file included
+	n, err := service.PurgeExpired(exp.ExpiryDate.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = os.Stat(exp.FilePath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDataExportJSON(t *testing.T) {
+	repo := &exportAdminRepo{}
+	records := &memoryRecords{fail: true}
+	dir := t.TempDir()
+	service := NewDataExportService(repo, records, nil, &memorySchool{}, dir)
+	id, err := service.RequestExport(1, 7, domain.RolePrincipal, "json", "")
+	require.NoError(t, err)
+
+	// A failed attempt leaves no file behind and is retried
+	assert.Error(t, service.GenerateExport(id))
+	exp := repo.exports[0]
+	assert.Equal(t, domain.ExportFailed, exp.Status)
+	assert.Contains(t, exp.Error, "marks: connection reset")
+	entries, _ := os.ReadDir(dir)
+	assert.Empty(t, entries)
+
+	records.fail = false
+	require.NoError(t, service.GenerateExport(id))
+	assert.Equal(t, domain.ExportReady, exp.Status)
+	assert.Empty(t, exp.Error)
+	_, name, err := service.Download(1, 7, id, time.Now())
+	require.NoError(t, err)
+	assert.Regexp(t, `\.json$`, name)
+
+	f, err := os.Open(exp.FilePath)
+	require.NoError(t, err)
+	defer f.Close()
+	var doc struct {
+		SchoolID uint                     `json:"school_id"`
+		Users    []map[string]interface{} `json:"users"`
+		Students []map[string]interface{} `json:"students"`
+		Absences []map[string]interface{} `json:"absences"`
+		Marks    []map[string]interface{} `json:"marks"`
+	}
+	body, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(body, &doc), string(body))
+	assert.Equal(t, uint(1), doc.SchoolID)
+	require.Len(t, doc.Users, 3)
+	assert.Equal(t, "RSSMRA85T10A562S", doc.Users[0]["tax_code"])
+	assert.Nil(t, doc.Users[1]["tax_code"])
+	assert.Equal(t, "2011-02-01", doc.Students[0]["date_of_birth"])
+	assert.Equal(t, 7.5, doc.Marks[0]["value"])
+	assert.NotNil(t, doc.Absences)
+	assert.Empty(t, doc.Absences)
+
+	// Retries after it was saved do nothing
+	require.NoError(t, service.GenerateExport(id))
+}
+
+// memoryFlows builds flow files of a line per student, the outcome of one
+// of them missing.
+type memoryFlows struct {
+	years []string
+}
+
+func (f *memoryFlows) BuildFlow(schoolID uint, flow, year string) (*sidi.Flow, error) {
+	f.years = append(f.years, year)
+	result := &sidi.Flow{Name: "RMIC81500X_" + flow + ".txt", Data: []byte(flow + "\r\n" + flow + "\r\n"), Records: 2}
+	if flow == sidi.FlowOutcome {
+		result.Records = 1
+		result.Skipped = []sidi.Problem{{StudentID: 4, Student: "Bianchi Giulia", FieldError: sidi.FieldError{Field: "outcome", Message: "no outcome recorded"}}}
+	}
+	return result, nil
+}
+
+func TestDataExportSIDI(t *testing.T) {
+	repo := &exportAdminRepo{}
+	flows := &memoryFlows{}
+	service := NewDataExportService(repo, &memoryRecords{}, flows, &memorySchool{}, t.TempDir())
+
+	_, err := service.RequestExport(1, 7, domain.RoleAdmin, "sidi", "2025-27")
+	assert.ErrorIs(t, err, ErrInvalidExport)
+	id, err := service.RequestExport(1, 7, domain.RoleAdmin, "sidi", "")
+	require.NoError(t, err)
+	assert.Equal(t, sidi.CurrentYear(time.Now()), repo.exports[0].AcademicYear, "the current year by default")
+	id, err = service.RequestExport(1, 7, domain.RoleAdmin, "sidi", "2024-25")
+	require.NoError(t, err)
+
+	require.NoError(t, service.GenerateExport(id))
+	exp := repo.exports[1]
+	assert.Equal(t, domain.ExportReady, exp.Status)
+	assert.Equal(t, []string{"2024-25", "2024-25", "2024-25"}, flows.years)
+	assert.Equal(t, 5, exp.Records)
+	assert.Equal(t, []int{0, 25, 50, 75, 100}, repo.progress, "saved after each flow")
+	_, name, err := service.Download(1, 7, id, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, "school-1-sidi-2024-25.zip", name)
+
+	data, err := os.ReadFile(exp.FilePath)
+	require.NoError(t, err)
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		body, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		rc.Close()
+		files[f.Name] = string(body)
+	}
+	assert.Equal(t, map[string]string{
+		"RMIC81500X_ISC.txt": "ISC\r\nISC\r\n",
+		"RMIC81500X_FRQ.txt": "FRQ\r\nFRQ\r\n",
+		"RMIC81500X_ESI.txt": "ESI\r\nESI\r\n",
+		"skipped.csv":        "flow,student_id,student,field,message\nESI,4,Bianchi Giulia,outcome,no outcome recorded\n",
+	}, files)
+}
@@ -0,0 +1,207 @@
+package admin
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Formats of the user import files.
+const (
+	FormatCSV  = "csv"
+	FormatXLSX = "xlsx"
+)
+
+// readSheet returns the rows of an import file, the header first. CSV files
+// may be separated by commas, semicolons (as saved by Excel in Italy) or
+// tabs; of XLSX workbooks the first sheet is read.
+func readSheet(format string, data []byte) ([][]string, error) {
+	switch format {
+	case FormatCSV:
+		return readCSV(data)
+	case FormatXLSX:
+		return readXLSX(data)
+	}
+	return nil, fmt.Errorf("unsupported format %q", format)
+}
+
+func readCSV(data []byte) ([][]string, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")) // BOM
+	header, _, _ := bytes.Cut(data, []byte("\n"))
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comma = ','
+	best := bytes.Count(header, []byte(","))
+	for _, sep := range []rune{';', '\t'} {
+		if n := bytes.Count(header, []byte(string(sep))); n > best {
+			r.Comma, best = sep, n
+		}
+	}
+	r.FieldsPerRecord = -1 // Rows are checked by the importer
+	r.LazyQuotes = true
+	r.TrimLeadingSpace = true
+	return r.ReadAll()
+}
+
+// The parts of SpreadsheetML read.
+type (
+	xlsxWorkbook struct {
+		Sheets []struct {
+			RID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	xlsxRelationships struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	xlsxSharedStrings struct {
+		Items []xlsxText `xml:"si"`
+	}
+	// xlsxText is plain (t) or rich text (runs of r/t).
+	xlsxText struct {
+		T    string `xml:"t"`
+		Runs []struct {
+			T string `xml:"t"`
+		} `xml:"r"`
+	}
+	xlsxSheet struct {
+		Rows []struct {
+			Num   int `xml:"r,attr"` // 1-based, blank rows are omitted
+			Cells []struct {
+				Ref    string   `xml:"r,attr"`
+				Type   string   `xml:"t,attr"`
+				Value  string   `xml:"v"`
+				Inline xlsxText `xml:"is"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+)
+
+func (t xlsxText) String() string {
+	if len(t.Runs) == 0 {
+		return t.T
+	}
+	var b strings.Builder
+	for _, r := range t.Runs {
+		b.WriteString(r.T)
+	}
+	return b.String()
+}
+
+func readXLSX(data []byte) ([][]string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("not an xlsx file: %w", err)
+	}
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	decode := func(name string, v interface{}) error {
+		f, ok := files[name]
+		if !ok {
+			return fmt.Errorf("%s: %w", name, errXLSXPartMissing)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		// Workbooks are small; the limit stops zip bombs
+		return xml.NewDecoder(io.LimitReader(rc, maxImportSize*20)).Decode(v)
+	}
+
+	sheetPath := "xl/worksheets/sheet1.xml"
+	var wb xlsxWorkbook
+	var rels xlsxRelationships
+	if decode("xl/workbook.xml", &wb) == nil && len(wb.Sheets) > 0 && decode("xl/_rels/workbook.xml.rels", &rels) == nil {
+		for _, rel := range rels.Relationships {
+			if rel.ID == wb.Sheets[0].RID {
+				if strings.HasPrefix(rel.Target, "/") {
+					sheetPath = strings.TrimPrefix(rel.Target, "/")
+				} else {
+					sheetPath = path.Join("xl", rel.Target)
+				}
+			}
+		}
+	}
+
+	var shared xlsxSharedStrings
+	if err := decode("xl/sharedStrings.xml", &shared); err != nil && !errors.Is(err, errXLSXPartMissing) {
+		return nil, err
+	}
+	var sheet xlsxSheet
+	if err := decode(sheetPath, &sheet); err != nil {
+		return nil, err
+	}
+
+	rows := make([][]string, 0, len(sheet.Rows))
+	for _, r := range sheet.Rows {
+		if r.Num > maxImportRows+1 {
+			return nil, fmt.Errorf("more than %d rows", maxImportRows)
+		}
+		for r.Num > len(rows)+1 {
+			rows = append(rows, nil)
+		}
+		var row []string
+		for i, c := range r.Cells {
+			col := i
+			if c.Ref != "" {
+				if col, err = columnIndex(c.Ref); err != nil {
+					return nil, err
+				}
+			}
+			var v string
+			switch c.Type {
+			case "s":
+				n, err := strconv.Atoi(c.Value)
+				if err != nil || n < 0 || n >= len(shared.Items) {
+					return nil, fmt.Errorf("cell %s: bad shared string", c.Ref)
+				}
+				v = shared.Items[n].String()
+			case "inlineStr":
+				v = c.Inline.String()
+			default: // Numbers, booleans, formula results
+				v = c.Value
+			}
+			for len(row) <= col {
+				row = append(row, "")
+			}
+			row[col] = v
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+var errXLSXPartMissing = errors.New("missing from the workbook")
+
+// maxXLSXColumns is the number of columns of a worksheet, A to XFD.
+const maxXLSXColumns = 16384
+
+// columnIndex returns the 0-based column of a cell reference, e.g. 27 for
+// AB3, failing for references outside the columns of a worksheet.
+func columnIndex(ref string) (int, error) {
+	col := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		col = col*26 + int(r-'A'+1)
+		if col > maxXLSXColumns {
+			break
+		}
+	}
+	if col < 1 || col > maxXLSXColumns {
+		return 0, fmt.Errorf("cell %s: bad reference", ref)
+	}
+	return col - 1, nil
+}
@@ -0,0 +1,418 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"go.uber.org/zap"
+)
+
+// Names of the onboarding steps, in the order they run.
+const (
+	StepSchool      = "school"
+	StepCampuses    = "campuses"
+	StepCurriculum  = "curriculum"
+	StepSubjects    = "subjects"
+	StepAccounts    = "accounts"
+	StepSettings    = "settings"
+	StepInvitations = "invitations" // After the rest is saved
+)
+
+const (
+	defaultCampusName  = "Sede principale"
+	maxOnboardingsPage = 100
+	// stepRolledBack marks the steps of a failed onboarding that had run.
+	stepRolledBack = "ROLLED_BACK"
+)
+
+var (
+	ErrInvalidSchool      = errors.New("invalid school")
+	ErrSchoolCodeTaken    = errors.New("school code already in use")
+	ErrOnboardingNotFound = errors.New("onboarding not found")
+)
+
+// schoolCodePattern matches a codice meccanografico: the province and the
+// school type, then eight letters or digits.
+var schoolCodePattern = regexp.MustCompile(`^[A-Z]{2}[A-Z0-9]{8}$`)
+
+// SchoolInput is the registry data of a new school.
+type SchoolInput struct {
+	Name           string `json:"name"`
+	Code           string `json:"code"` // Codice meccanografico
+	Address        string `json:"address"`
+	City           string `json:"city"`
+	Region         string `json:"region"`
+	VatID          string `json:"vatId"`
+	PrincipalEmail string `json:"principalEmail"`
+}
+
+// school returns the School of the input, normalized, or why it is invalid.
+func (in SchoolInput) school() (*domain.School, error) {
+	school := &domain.School{
+		Name:           strings.TrimSpace(in.Name),
+		Code:           strings.ToUpper(strings.TrimSpace(in.Code)),
+		Address:        strings.TrimSpace(in.Address),
+		City:           strings.TrimSpace(in.City),
+		Region:         strings.TrimSpace(in.Region),
+		VatID:          strings.TrimSpace(in.VatID),
+		PrincipalEmail: strings.ToLower(strings.TrimSpace(in.PrincipalEmail)),
+	}
+	switch {
+	case school.Name == "":
+		return nil, fmt.Errorf("%w: name is required", ErrInvalidSchool)
+	case !schoolCodePattern.MatchString(school.Code):
+		return nil, fmt.Errorf("%w: code must be a 10 character codice meccanografico", ErrInvalidSchool)
+	case school.PrincipalEmail != "" && !validEmail(school.PrincipalEmail):
+		return nil, fmt.Errorf("%w: invalid principal email %q", ErrInvalidSchool, in.PrincipalEmail)
+	}
+	return school, nil
+}
+
+type CampusInput struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// StaffInput is an account created for a new school, invited by email.
+type StaffInput struct {
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Email     string `json:"email"`
+	TaxCode   string `json:"taxCode"`
+}
+
+// OnboardingRequest describes a new school for the onboarding wizard.
+type OnboardingRequest struct {
+	School SchoolInput `json:"school"`
+	// Campuses default to a main campus at the address of the school.
+	Campuses  []CampusInput `json:"campuses"`
+	Template  string        `json:"template"` // Code of a SchoolTemplate
+	Principal StaffInput    `json:"principal"`
+	Secretary StaffInput    `json:"secretary"`
+	// Settings replace the default settings of the same key.
+	Settings map[string]domain.JSONMap `json:"settings"`
+}
+
+type onboardingUsers interface {
+	FindByEmail(email string) (*domain.User, error)
+}
+
+// OnboardingService creates new schools with everything they need to
+// start: campuses, a curriculum from a template with its subjects, the
+// principal and secretary accounts and the default settings. All of it is
+// saved in one transaction, and the result of each step is recorded.
+type OnboardingService struct {
+	repo    domain.OnboardingRepository
+	users   onboardingUsers
+	invites inviter
+	audit   *AuditService
+	logger  *zap.Logger
+	now     func() time.Time
+}
+
+func NewOnboardingService(repo domain.OnboardingRepository, users onboardingUsers, invites inviter, audit *AuditService, logger *zap.Logger) *OnboardingService {
+	return &OnboardingService{repo: repo, users: users, invites: invites, audit: audit, logger: logger, now: time.Now}
+}
+
+// onboardingPlan is a validated request: the records to create.
+type onboardingPlan struct {
+	school   *domain.School
+	template SchoolTemplate
+	campuses []domain.Campus
+	staff    []*domain.User
+	settings map[string]domain.JSONMap
+}
+
+// Onboard creates the school of req. Invalid requests return
+// ErrInvalidSchool or ErrSchoolCodeTaken and are not recorded; otherwise
+// the onboarding is recorded with its steps, also when saving fails and
+// nothing is created.
+func (s *OnboardingService) Onboard(ctx context.Context, userID uint, req OnboardingRequest) (*domain.SchoolOnboarding, error) {
+	plan, err := s.plan(req)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &domain.SchoolOnboarding{SchoolCode: plan.school.Code, Template: plan.template.Code, CreatedBy: userID}
+	err = s.repo.Onboard(func(store domain.OnboardingStore) error {
+		record.Steps = nil
+		if err := s.create(store, plan, record); err != nil {
+			return err
+		}
+		now := s.now()
+		record.Status = domain.OnboardingCompleted
+		record.SchoolID = &plan.school.ID
+		record.CompletedAt = &now
+		return store.CreateOnboarding(record)
+	})
+	if err != nil {
+		// Nothing was saved: record why, outside of the transaction
+		record.ID = 0
+		record.SchoolID = nil
+		record.CompletedAt = nil
+		record.Status = domain.OnboardingFailed
+		record.Error = truncate(err.Error(), 255)
+		for i := range record.Steps {
+			if record.Steps[i].Status == domain.StepDone {
+				record.Steps[i].Status = stepRolledBack
+				record.Steps[i].IDs = nil
+			}
+		}
+		if saveErr := s.repo.CreateOnboarding(record); saveErr != nil {
+			s.logger.Error("Failed to record failed onboarding", zap.String("school_code", record.SchoolCode), zap.Error(saveErr))
+		}
+		return record, err
+	}
+
+	s.invite(ctx, plan.staff, record)
+	if err := s.repo.UpdateOnboarding(record); err != nil {
+		s.logger.Warn("Failed to record onboarding invitations", zap.Uint("onboarding_id", record.ID), zap.Error(err))
+	}
+	s.audit.LogAction(record.SchoolID, userID, "ONBOARD_SCHOOL", "SCHOOL", strconv.FormatUint(uint64(plan.school.ID), 10), "",
+		domain.JSONMap{"code": plan.school.Code, "template": plan.template.Code, "onboarding_id": record.ID})
+	return record, nil
+}
+
+// plan validates req into the records to create.
+func (s *OnboardingService) plan(req OnboardingRequest) (*onboardingPlan, error) {
+	school, err := req.School.school()
+	if err != nil {
+		return nil, err
+	}
+	template, ok := findTemplate(req.Template)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown template %q", ErrInvalidSchool, req.Template)
+	}
+	taken, err := s.repo.SchoolCodeExists(school.Code)
+	if err != nil {
+		return nil, err
+	}
+	if taken {
+		return nil, fmt.Errorf("%w: %s", ErrSchoolCodeTaken, school.Code)
+	}
+	plan := &onboardingPlan{school: school, template: template}
+
+	for i, c := range req.Campuses {
+		name := strings.TrimSpace(c.Name)
+		if name == "" {
+			return nil, fmt.Errorf("%w: campus %d has no name", ErrInvalidSchool, i+1)
+		}
+		plan.campuses = append(plan.campuses, domain.Campus{Name: name, Address: strings.TrimSpace(c.Address)})
+	}
+	if len(plan.campuses) == 0 {
+		plan.campuses = []domain.Campus{{Name: defaultCampusName, Address: school.Address}}
+	}
+
+	for _, account := range []struct {
+		role  domain.Role
+		input StaffInput
+	}{{domain.RolePrincipal, req.Principal}, {domain.RoleSecretary, req.Secretary}} {
+		user, err := s.account(account.role, account.input)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range plan.staff {
+			if other.Email == user.Email {
+				return nil, fmt.Errorf("%w: the principal and the secretary need their own email", ErrInvalidSchool)
+			}
+		}
+		plan.staff = append(plan.staff, user)
+	}
+	if school.PrincipalEmail == "" {
+		school.PrincipalEmail = plan.staff[0].Email
+	}
+
+	plan.settings = defaultSettings(template)
+	for key, value := range req.Settings {
+		if err := validateSetting(key, value); err != nil {
+			return nil, fmt.Errorf("%w: setting %s: %v", ErrInvalidSchool, key, err)
+		}
+		plan.settings[key] = value
+	}
+	return plan, nil
+}
+
+// account validates a staff account, whose email must not be in use.
+func (s *OnboardingService) account(role domain.Role, in StaffInput) (*domain.User, error) {
+	email := strings.ToLower(strings.TrimSpace(in.Email))
+	user := &domain.User{
+		Email:        email,
+		Role:         role,
+		Status:       "active",
+		FirstName:    strings.TrimSpace(in.FirstName),
+		LastName:     strings.TrimSpace(in.LastName),
+		PasswordHash: invitedPasswordHash,
+	}
+	switch {
+	case user.FirstName == "" || user.LastName == "":
+		return nil, fmt.Errorf("%w: the %s needs a first and last name", ErrInvalidSchool, strings.ToLower(string(role)))
+	case !validEmail(email):
+		return nil, fmt.Errorf("%w: invalid %s email %q", ErrInvalidSchool, strings.ToLower(string(role)), in.Email)
+	}
+	if tc := strings.ToUpper(strings.TrimSpace(in.TaxCode)); tc != "" {
+		if !validTaxCode(tc) {
+			return nil, fmt.Errorf("%w: invalid %s tax code %q", ErrInvalidSchool, strings.ToLower(string(role)), in.TaxCode)
+		}
+		user.TaxCode = &tc
+	}
+	existing, err := s.users.FindByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("%w: %s is already in use", ErrInvalidSchool, email)
+	}
+	return user, nil
+}
+
+// create runs the steps of the onboarding in store, recording each.
+func (s *OnboardingService) create(store domain.OnboardingStore, plan *onboardingPlan, record *domain.SchoolOnboarding) error {
+	school := plan.school
+	steps := []struct {
+		name string
+		run  func(step *domain.OnboardingStep) error
+	}{
+		{StepSchool, func(step *domain.OnboardingStep) error {
+			if err := store.CreateSchool(school); err != nil {
+				return err
+			}
+			step.IDs, step.Detail = []uint{school.ID}, school.Name
+			return nil
+		}},
+		{StepCampuses, func(step *domain.OnboardingStep) error {
+			names := make([]string, len(plan.campuses))
+			for i := range plan.campuses {
+				campus := &plan.campuses[i]
+				campus.SchoolID = school.ID
+				if err := store.CreateCampus(campus); err != nil {
+					return err
+				}
+				step.IDs = append(step.IDs, campus.ID)
+				names[i] = campus.Name
+			}
+			step.Detail = strings.Join(names, ", ")
+			return nil
+		}},
+		{StepCurriculum, func(step *domain.OnboardingStep) error {
+			curriculum := &domain.Curriculum{
+				SchoolID:    school.ID,
+				Name:        plan.template.Name,
+				Code:        plan.template.Code,
+				Description: plan.template.Description,
+			}
+			if err := store.CreateCurriculum(curriculum); err != nil {
+				return err
+			}
+			step.IDs, step.Detail = []uint{curriculum.ID}, curriculum.Name
+			return nil
+		}},
+		{StepSubjects, func(step *domain.OnboardingStep) error {
+			hours := 0
+			for _, t := range plan.template.Subjects {
+				subject := &domain.Subject{SchoolID: school.ID, Code: t.Code, Name: t.Name, HoursPerWeek: t.HoursPerWeek}
+				if err := store.CreateSubject(subject); err != nil {
+					return err
+				}
+				step.IDs = append(step.IDs, subject.ID)
+				hours += t.HoursPerWeek
+			}
+			step.Detail = fmt.Sprintf("%d subjects, %d hours per week", len(step.IDs), hours)
+			return nil
+		}},
+		{StepAccounts, func(step *domain.OnboardingStep) error {
+			emails := make([]string, len(plan.staff))
+			for i, user := range plan.staff {
+				user.SchoolID = school.ID
+				if err := store.CreateUser(user); err != nil {
+					return err
+				}
+				step.IDs = append(step.IDs, user.ID)
+				emails[i] = user.Email
+			}
+			step.Detail = strings.Join(emails, ", ")
+			return nil
+		}},
+		{StepSettings, func(step *domain.OnboardingStep) error {
+			keys := make([]string, 0, len(plan.settings))
+			for key := range plan.settings {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				setting := &domain.SchoolSettings{SchoolID: school.ID, Key: key, Value: plan.settings[key]}
+				if err := store.UpsertSchoolSetting(setting); err != nil {
+					return err
+				}
+				step.IDs = append(step.IDs, setting.ID)
+			}
+			step.Detail = strings.Join(keys, ", ")
+			return nil
+		}},
+	}
+
+	for _, st := range steps {
+		record.Steps = append(record.Steps, domain.OnboardingStep{Name: st.name})
+		step := &record.Steps[len(record.Steps)-1]
+		if err := st.run(step); err != nil {
+			step.Status, step.IDs, step.Detail = domain.StepFailed, nil, err.Error()
+			return fmt.Errorf("%s: %w", st.name, err)
+		}
+		step.Status = domain.StepDone
+	}
+	return nil
+}
+
+// invite sends the invitations of the new accounts, once saved. Those that
+// fail are left in the step: the users can still reset their password.
+func (s *OnboardingService) invite(ctx context.Context, staff []*domain.User, record *domain.SchoolOnboarding) {
+	step := domain.OnboardingStep{Name: StepInvitations, Status: domain.StepDone}
+	var failed []string
+	for _, user := range staff {
+		if err := s.invites.Invite(ctx, user); err != nil {
+			s.logger.Warn("Failed to invite school staff", zap.Uint("user_id", user.ID), zap.Error(err))
+			failed = append(failed, user.Email)
+			continue
+		}
+		step.IDs = append(step.IDs, user.ID)
+	}
+	if len(failed) > 0 {
+		step.Status = domain.StepFailed
+		step.Detail = "not sent to " + strings.Join(failed, ", ")
+	}
+	record.Steps = append(record.Steps, step)
+}
+
+func (s *OnboardingService) GetOnboarding(id uint) (*domain.SchoolOnboarding, error) {
+	o, err := s.repo.GetOnboarding(id)
+	if err != nil {
+		return nil, err
+	}
+	if o == nil {
+		return nil, ErrOnboardingNotFound
+	}
+	return o, nil
+}
+
+// GetOnboardings returns the onboardings, the latest first.
+func (s *OnboardingService) GetOnboardings(limit, offset int) ([]domain.SchoolOnboarding, error) {
+	if limit <= 0 || limit > maxOnboardingsPage {
+		limit = maxOnboardingsPage
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return s.repo.GetOnboardings(limit, offset)
+}
+
+func validEmail(address string) bool {
+	parsed, err := mail.ParseAddress(address)
+	return err == nil && parsed.Address == address
+}
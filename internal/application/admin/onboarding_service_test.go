@@ -0,0 +1,298 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/k/iRegistro/internal/application/auth"
+	"github.com/k/iRegistro/internal/application/communication"
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// memoryOnboarding saves the records of the committed onboardings: those of
+// a failed transaction are dropped.
+type memoryOnboarding struct {
+	codes       []string
+	committed   []interface{}
+	onboardings []*domain.SchoolOnboarding
+	failOn      string // Type of the record that cannot be saved
+	nextID      uint
+}
+
+// onboardingTx stages the records of a transaction.
+type onboardingTx struct {
+	repo    *memoryOnboarding
+	records []interface{}
+}
+
+func (r *memoryOnboarding) Onboard(fn func(store domain.OnboardingStore) error) error {
+	tx := &onboardingTx{repo: r}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	r.committed = append(r.committed, tx.records...)
+	return nil
+}
+
+func (r *memoryOnboarding) id() uint {
+	r.nextID++
+	return r.nextID
+}
+
+func (tx *onboardingTx) save(kind string, record interface{}, id *uint) error {
+	if tx.repo.failOn == kind {
+		return errors.New("duplicate key value")
+	}
+	*id = tx.repo.id()
+	tx.records = append(tx.records, record)
+	return nil
+}
+
+func (tx *onboardingTx) CreateSchool(s *domain.School) error { return tx.save("school", s, &s.ID) }
+func (tx *onboardingTx) CreateCampus(c *domain.Campus) error { return tx.save("campus", c, &c.ID) }
+func (tx *onboardingTx) CreateCurriculum(c *domain.Curriculum) error {
+	return tx.save("curriculum", c, &c.ID)
+}
+func (tx *onboardingTx) CreateSubject(s *domain.Subject) error { return tx.save("subject", s, &s.ID) }
+func (tx *onboardingTx) CreateUser(u *domain.User) error       { return tx.save("user", u, &u.ID) }
+func (tx *onboardingTx) UpsertSchoolSetting(s *domain.SchoolSettings) error {
+	return tx.save("setting", s, &s.ID)
+}
+func (tx *onboardingTx) CreateOnboarding(o *domain.SchoolOnboarding) error {
+	return tx.repo.CreateOnboarding(o)
+}
+
+func (r *memoryOnboarding) CreateSchool(s *domain.School) error         { return nil }
+func (r *memoryOnboarding) CreateCampus(c *domain.Campus) error         { return nil }
+func (r *memoryOnboarding) CreateCurriculum(c *domain.Curriculum) error { return nil }
+func (r *memoryOnboarding) CreateSubject(s *domain.Subject) error       { return nil }
+func (r *memoryOnboarding) CreateUser(u *domain.User) error             { return nil }
+func (r *memoryOnboarding) UpsertSchoolSetting(s *domain.SchoolSettings) error {
+	return nil
+}
+
+func (r *memoryOnboarding) CreateOnboarding(o *domain.SchoolOnboarding) error {
+	o.ID = r.id()
+	r.onboardings = append(r.onboardings, o)
+	return nil
+}
+
+func (r *memoryOnboarding) UpdateOnboarding(o *domain.SchoolOnboarding) error { return nil }
+
+func (r *memoryOnboarding) GetOnboarding(id uint) (*domain.SchoolOnboarding, error) {
+	for _, o := range r.onboardings {
+		if o.ID == id {
+			return o, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *memoryOnboarding) GetOnboardings(limit, offset int) ([]domain.SchoolOnboarding, error) {
+	var list []domain.SchoolOnboarding
+	for _, o := range r.onboardings {
+		list = append(list, *o)
+	}
+	return list, nil
+}
+
+func (r *memoryOnboarding) SchoolCodeExists(code string) (bool, error) {
+	for _, c := range r.codes {
+		if c == code {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// committedRecords returns the saved records of type T.
+func committedRecords[T any](r *memoryOnboarding) []*T {
+	var found []*T
+	for _, rec := range r.committed {
+		if t, ok := rec.(*T); ok {
+			found = append(found, t)
+		}
+	}
+	return found
+}
+
+// refusingInviter fails to send the invitations to one address.
+type refusingInviter struct {
+	memorySchool
+	refuse string
+}
+
+func (r *refusingInviter) Invite(ctx context.Context, user *domain.User) error {
+	if user.Email == r.refuse {
+		return errors.New("mailbox unavailable")
+	}
+	return r.memorySchool.Invite(ctx, user)
+}
+
+func onboardingRequest() OnboardingRequest {
+	return OnboardingRequest{
+		School:    SchoolInput{Name: "Liceo Galileo Galilei", Code: "rmps12000x", Address: "Via Roma 1", City: "Roma", Region: "Lazio"},
+		Template:  "liceo_scientifico",
+		Principal: StaffInput{FirstName: "Maria", LastName: "Verdi", Email: "Preside@Galilei.edu.it", TaxCode: "RSSMRA85T10A562S"},
+		Secretary: StaffInput{FirstName: "Luca", LastName: "Neri", Email: "segreteria@galilei.edu.it"},
+	}
+}
+
+func newTestOnboarding(repo *memoryOnboarding, users onboardingUsers, invites inviter) *OnboardingService {
+	adminRepo := new(MockAdminRepository)
+	adminRepo.On("CreateAuditLog", mock.Anything).Return(nil)
+	return NewOnboardingService(repo, users, invites, NewAuditService(adminRepo), zap.NewNop())
+}
+
+func TestTemplates(t *testing.T) {
+	for _, tmpl := range Templates() {
+		assert.NotEmpty(t, tmpl.Subjects, tmpl.Code)
+		codes := map[string]bool{}
+		for _, s := range tmpl.Subjects {
+			assert.False(t, codes[s.Code], "%s: %s repeated", tmpl.Code, s.Code)
+			codes[s.Code] = true
+		}
+		// The default settings are valid
+		for key, value := range defaultSettings(tmpl) {
+			assert.NoError(t, validateSetting(key, value), key)
+		}
+		policy, err := auth.ParseSecondFactorPolicy(defaultSettings(tmpl)[auth.SecuritySettingsKey])
+		require.NoError(t, err)
+		assert.Len(t, policy.RequiredRoles, 3)
+	}
+	_, ok := findTemplate("primaria")
+	assert.True(t, ok)
+}
+
+func TestOnboardSchool(t *testing.T) {
+	repo := &memoryOnboarding{}
+	users := &memorySchool{}
+	service := newTestOnboarding(repo, users, users)
+
+	req := onboardingRequest()
+	req.Settings = map[string]domain.JSONMap{communication.ChannelsSettingsKey: {"enabled": []interface{}{"EMAIL"}}}
+	o, err := service.Onboard(context.Background(), 1, req)
+	require.NoError(t, err)
+	assert.Equal(t, domain.OnboardingCompleted, o.Status)
+	assert.Equal(t, "RMPS12000X", o.SchoolCode)
+	require.NotNil(t, o.SchoolID)
+	require.NotNil(t, o.CompletedAt)
+
+	names := make([]string, len(o.Steps))
+	for i, step := range o.Steps {
+		names[i] = step.Name
+		assert.Equal(t, domain.StepDone, step.Status, step.Name)
+	}
+	assert.Equal(t, []string{StepSchool, StepCampuses, StepCurriculum, StepSubjects, StepAccounts, StepSettings, StepInvitations}, names)
+	assert.Equal(t, []uint{*o.SchoolID}, o.Steps[0].IDs)
+	assert.Equal(t, defaultCampusName, o.Steps[1].Detail)
+	assert.Equal(t, "10 subjects, 27 hours per week", o.Steps[3].Detail)
+	assert.Equal(t, "preside@galilei.edu.it, segreteria@galilei.edu.it", o.Steps[4].Detail)
+
+	school := repo.committed[0].(*domain.School)
+	assert.Equal(t, "preside@galilei.edu.it", school.PrincipalEmail)
+	campus := repo.committed[1].(*domain.Campus)
+	assert.Equal(t, school.ID, campus.SchoolID)
+	assert.Equal(t, "Via Roma 1", campus.Address)
+	subjects := committedRecords[domain.Subject](repo)
+	require.Len(t, subjects, 10)
+	assert.Equal(t, 5, subjects[4].HoursPerWeek)
+
+	accounts := committedRecords[domain.User](repo)
+	require.Len(t, accounts, 2)
+	principal := accounts[0]
+	assert.Equal(t, domain.RolePrincipal, principal.Role)
+	assert.Equal(t, school.ID, principal.SchoolID)
+	assert.Equal(t, invitedPasswordHash, principal.PasswordHash)
+	assert.Equal(t, "RSSMRA85T10A562S", *principal.TaxCode)
+	assert.Equal(t, []string{"preside@galilei.edu.it", "segreteria@galilei.edu.it"}, users.invited)
+
+	settings := map[string]domain.JSONMap{}
+	for _, s := range committedRecords[domain.SchoolSettings](repo) {
+		settings[s.Key] = s.Value
+	}
+	assert.Len(t, settings, 3)
+	assert.Equal(t, []interface{}{"EMAIL"}, settings[communication.ChannelsSettingsKey]["enabled"], "overridden")
+	assert.Len(t, settings["timetable"]["hours"], 6)
+
+	got, err := service.GetOnboarding(o.ID)
+	require.NoError(t, err)
+	assert.Equal(t, o, got)
+	_, err = service.GetOnboarding(99)
+	assert.ErrorIs(t, err, ErrOnboardingNotFound)
+}
+
+func TestOnboardSchoolInvalid(t *testing.T) {
+	repo := &memoryOnboarding{codes: []string{"RMPS12000X"}}
+	users := &memorySchool{users: []*domain.User{{ID: 5, Email: "taken@example.it"}}}
+	service := newTestOnboarding(repo, users, users)
+
+	cases := map[string]func(r *OnboardingRequest){
+		"code in use":     func(r *OnboardingRequest) {},
+		"bad code":        func(r *OnboardingRequest) { r.School.Code = "RM12" },
+		"no name":         func(r *OnboardingRequest) { r.School.Name = " " },
+		"template":        func(r *OnboardingRequest) { r.Template = "liceo_classico" },
+		"principal email": func(r *OnboardingRequest) { r.Principal.Email = "preside" },
+		"email in use":    func(r *OnboardingRequest) { r.Secretary.Email = "taken@example.it" },
+		"same email":      func(r *OnboardingRequest) { r.Secretary.Email = r.Principal.Email },
+		"no secretary":    func(r *OnboardingRequest) { r.Secretary = StaffInput{} },
+		"tax code":        func(r *OnboardingRequest) { r.Principal.TaxCode = "RSSMRA85T10A562X" },
+		"campus":          func(r *OnboardingRequest) { r.Campuses = []CampusInput{{Address: "Via Po 2"}} },
+		"setting": func(r *OnboardingRequest) {
+			r.Settings = map[string]domain.JSONMap{auth.SecuritySettingsKey: {"require_second_factor": "Admin"}}
+		},
+	}
+	for name, change := range cases {
+		req := onboardingRequest()
+		if name != "code in use" {
+			req.School.Code = "MIIS00900T"
+		}
+		change(&req)
+		o, err := service.Onboard(context.Background(), 1, req)
+		assert.Nil(t, o, name)
+		if name == "code in use" {
+			assert.ErrorIs(t, err, ErrSchoolCodeTaken)
+			continue
+		}
+		assert.ErrorIs(t, err, ErrInvalidSchool, name)
+	}
+	assert.Empty(t, repo.onboardings, "invalid requests are not recorded")
+	assert.Empty(t, repo.committed)
+}
+
+func TestOnboardSchoolRollback(t *testing.T) {
+	repo := &memoryOnboarding{failOn: "user"}
+	users := &memorySchool{}
+	service := newTestOnboarding(repo, users, users)
+
+	o, err := service.Onboard(context.Background(), 1, onboardingRequest())
+	require.Error(t, err)
+	require.NotNil(t, o)
+	assert.Empty(t, repo.committed, "nothing saved")
+	assert.Empty(t, users.invited)
+	assert.Equal(t, domain.OnboardingFailed, o.Status)
+	assert.Nil(t, o.SchoolID)
+	assert.Contains(t, o.Error, "accounts: duplicate key value")
+	require.Len(t, o.Steps, 5)
+	assert.Equal(t, stepRolledBack, o.Steps[0].Status)
+	assert.Nil(t, o.Steps[0].IDs)
+	assert.Equal(t, domain.StepFailed, o.Steps[4].Status)
+	assert.Equal(t, []*domain.SchoolOnboarding{o}, repo.onboardings, "recorded")
+
+	// Invitations that fail do not undo the school
+	repo = &memoryOnboarding{}
+	invites := &refusingInviter{refuse: "segreteria@galilei.edu.it"}
+	service = newTestOnboarding(repo, users, invites)
+	o, err = service.Onboard(context.Background(), 1, onboardingRequest())
+	require.NoError(t, err)
+	assert.Equal(t, domain.OnboardingCompleted, o.Status)
+	last := o.Steps[len(o.Steps)-1]
+	assert.Equal(t, domain.StepFailed, last.Status)
+	assert.Len(t, last.IDs, 1)
+	assert.Equal(t, "not sent to segreteria@galilei.edu.it", last.Detail)
+}
@@ -0,0 +1,131 @@
+package admin
+
+import (
+	"github.com/k/iRegistro/internal/application/auth"
+	"github.com/k/iRegistro/internal/application/calendar"
+	"github.com/k/iRegistro/internal/application/communication"
+	"github.com/k/iRegistro/internal/domain"
+)
+
+// SchoolTemplate bootstraps the curriculum of a new school: its subjects
+// with the weekly hours of the first year and the times of the lesson hours.
+type SchoolTemplate struct {
+	Code        string            `json:"code"`
+	Name        string            `json:"name"` // Of the curriculum
+	Description string            `json:"description"`
+	Subjects    []TemplateSubject `json:"subjects"`
+	// Hours are the start and end times of the lesson hours, saved as the
+	// timetable setting of the school.
+	Hours [][2]string `json:"hours"`
+}
+
+type TemplateSubject struct {
+	Code         string `json:"code"`
+	Name         string `json:"name"`
+	HoursPerWeek int    `json:"hours_per_week"`
+}
+
+// schoolTemplates are the curricula available to new schools, following
+// the national timetables (quadri orari) of the first year.
+var schoolTemplates = []SchoolTemplate{
+	{
+		Code:        "liceo_scientifico",
+		Name:        "Liceo Scientifico",
+		Description: "Liceo scientifico, ordinamento",
+		Subjects: []TemplateSubject{
+			{"ITA", "Lingua e letteratura italiana", 4},
+			{"LAT", "Lingua e cultura latina", 3},
+			{"ING", "Lingua e cultura straniera (Inglese)", 3},
+			{"STG", "Storia e geografia", 3},
+			{"MAT", "Matematica", 5},
+			{"FIS", "Fisica", 2},
+			{"SCI", "Scienze naturali", 2},
+			{"DIS", "Disegno e storia dell'arte", 2},
+			{"SMS", "Scienze motorie e sportive", 2},
+			{"IRC", "Religione cattolica o attività alternative", 1},
+		},
+		Hours: [][2]string{
+			{"08:00", "09:00"}, {"09:00", "10:00"}, {"10:00", "11:00"},
+			{"11:00", "12:00"}, {"12:00", "13:00"}, {"13:00", "14:00"},
+		},
+	},
+	{
+		Code:        "itis_informatica",
+		Name:        "ITIS Informatica e Telecomunicazioni",
+		Description: "Istituto tecnico, settore tecnologico, primo biennio",
+		Subjects: []TemplateSubject{
+			{"ITA", "Lingua e letteratura italiana", 4},
+			{"ING", "Lingua inglese", 3},
+			{"STO", "Storia", 2},
+			{"GEO", "Geografia", 1},
+			{"MAT", "Matematica", 4},
+			{"DIR", "Diritto ed economia", 2},
+			{"STB", "Scienze integrate (Scienze della Terra e Biologia)", 2},
+			{"FIS", "Scienze integrate (Fisica)", 3},
+			{"CHI", "Scienze integrate (Chimica)", 3},
+			{"TTR", "Tecnologie e tecniche di rappresentazione grafica", 3},
+			{"TIN", "Tecnologie informatiche", 3},
+			{"SMS", "Scienze motorie e sportive", 2},
+			{"IRC", "Religione cattolica o attività alternative", 1},
+		},
+		Hours: [][2]string{
+			{"08:00", "09:00"}, {"09:00", "10:00"}, {"10:00", "11:00"},
+			{"11:00", "12:00"}, {"12:00", "13:00"}, {"13:00", "14:00"},
+		},
+	},
+	{
+		Code:        "primaria",
+		Name:        "Scuola Primaria",
+		Description: "Scuola primaria, tempo ordinario a 27 ore",
+		Subjects: []TemplateSubject{
+			{"ITA", "Italiano", 7},
+			{"MAT", "Matematica", 6},
+			{"ING", "Inglese", 1},
+			{"STO", "Storia", 2},
+			{"GEO", "Geografia", 2},
+			{"SCI", "Scienze", 2},
+			{"TEC", "Tecnologia", 1},
+			{"MUS", "Musica", 1},
+			{"ART", "Arte e immagine", 1},
+			{"EDF", "Educazione fisica", 2},
+			{"IRC", "Religione cattolica o attività alternative", 2},
+		},
+		Hours: [][2]string{
+			{"08:30", "09:30"}, {"09:30", "10:30"}, {"10:30", "11:30"},
+			{"11:30", "12:30"}, {"12:30", "13:30"},
+		},
+	},
+}
+
+// Templates returns the curricula available to new schools.
+func Templates() []SchoolTemplate {
+	return schoolTemplates
+}
+
+func findTemplate(code string) (SchoolTemplate, bool) {
+	for _, t := range schoolTemplates {
+		if t.Code == code {
+			return t, true
+		}
+	}
+	return SchoolTemplate{}, false
+}
+
+// defaultSettings are the settings of a new school, before the overrides
+// of the onboarding request.
+func defaultSettings(t SchoolTemplate) map[string]domain.JSONMap {
+	hours := make([]interface{}, len(t.Hours))
+	for i, h := range t.Hours {
+		hours[i] = map[string]interface{}{"start": h[0], "end": h[1]}
+	}
+	return map[string]domain.JSONMap{
+		calendar.TimetableSettingsKey: {"hours": hours},
+		// Staff see the data of the whole school
+		auth.SecuritySettingsKey: {"require_second_factor": []interface{}{
+			string(domain.RoleAdmin), string(domain.RolePrincipal), string(domain.RoleSecretary),
+		}},
+		communication.ChannelsSettingsKey: {"enabled": []interface{}{
+			string(domain.ChannelEmail), string(domain.ChannelPush),
+		}},
+	}
+}
@@ -1,111 +1,897 @@
 package admin
 
 import (
-	"encoding/csv"
-	"io"
-	"os"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/mail"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/k/iRegistro/internal/domain"
 	"go.uber.org/zap"
 )
 
+// Types of the jobs of a user import; their payload holds the import_id.
+const (
+	UserImportValidateJob = "admin.user_import_validate"
+	UserImportJob         = "admin.user_import"
+)
+
+const (
+	maxImportSize = 5 << 20
+	maxImportRows = 5000
+	// invitedPasswordHash is not a bcrypt hash, so no password matches it:
+	// imported users choose theirs from the invitation email.
+	invitedPasswordHash = "!invited"
+)
+
+var (
+	ErrInvalidImport  = errors.New("invalid import")
+	ErrImportNotFound = errors.New("import not found")
+	ErrImportState    = errors.New("import not waiting for confirmation")
+)
+
+// Fields of the imported rows, the targets of the column mapping.
+const (
+	fieldFirstName  = "first_name"
+	fieldLastName   = "last_name"
+	fieldEmail      = "email"
+	fieldTaxCode    = "tax_code"
+	fieldRole       = "role"
+	fieldClass      = "class"
+	fieldBirthDate  = "birth_date"
+	fieldBirthPlace = "birth_place"
+	fieldGender     = "gender"
+	fieldPhone      = "phone"
+	fieldGuardian1  = "guardian1_email"
+	fieldGuardian2  = "guardian2_email"
+	fieldIgnored    = "" // Mapped columns not imported
+)
+
+// Actions of the preview rows.
+const (
+	importActionNew  = "create"
+	importActionEdit = "update"
+	importActionSkip = "skip"
+)
+
+// columnAliases are the headers recognised without a mapping, in English and
+// Italian, as normalized by normalizeHeader.
+var columnAliases = map[string]string{
+	"first name": fieldFirstName, "firstname": fieldFirstName, "name": fieldFirstName, "nome": fieldFirstName,
+	"last name": fieldLastName, "lastname": fieldLastName, "surname": fieldLastName, "cognome": fieldLastName,
+	"email": fieldEmail, "e mail": fieldEmail, "mail": fieldEmail,
+	"tax code": fieldTaxCode, "codice fiscale": fieldTaxCode, "cf": fieldTaxCode,
+	"role": fieldRole, "ruolo": fieldRole,
+	"class": fieldClass, "classe": fieldClass,
+	"birth date": fieldBirthDate, "date of birth": fieldBirthDate, "data di nascita": fieldBirthDate,
+	"birth place": fieldBirthPlace, "place of birth": fieldBirthPlace, "luogo di nascita": fieldBirthPlace,
+	"gender": fieldGender, "sex": fieldGender, "sesso": fieldGender,
+	"phone": fieldPhone, "mobile": fieldPhone, "telefono": fieldPhone, "cellulare": fieldPhone,
+	"guardian1 email": fieldGuardian1, "guardian email": fieldGuardian1, "email genitore": fieldGuardian1, "email genitore 1": fieldGuardian1,
+	"guardian2 email": fieldGuardian2, "email genitore 2": fieldGuardian2,
+}
+
+var importFields = map[string]bool{
+	fieldFirstName: true, fieldLastName: true, fieldEmail: true, fieldTaxCode: true, fieldRole: true, fieldClass: true,
+	fieldBirthDate: true, fieldBirthPlace: true, fieldGender: true, fieldPhone: true, fieldGuardian1: true, fieldGuardian2: true,
+	fieldIgnored: true,
+}
+
+// importRoles are the roles of the role column; rows without one are
+// students. Admins and principals are not imported.
+var importRoles = map[string]domain.Role{
+	"student": domain.RoleStudent, "studente": domain.RoleStudent, "alunno": domain.RoleStudent,
+	"teacher": domain.RoleTeacher, "docente": domain.RoleTeacher, "insegnante": domain.RoleTeacher,
+	"parent": domain.RoleParent, "genitore": domain.RoleParent,
+	"secretary": domain.RoleSecretary, "segreteria": domain.RoleSecretary,
+}
+
+// taxCodePattern matches a codice fiscale, digits possibly replaced by
+// letters (omocodia).
+var taxCodePattern = regexp.MustCompile(`^[A-Z]{6}[0-9LMNPQRSTUV]{2}[A-Z][0-9LMNPQRSTUV]{2}[A-Z][0-9LMNPQRSTUV]{3}[A-Z]$`)
+
+// importUsers finds and saves the user accounts of an import.
+type importUsers interface {
+	FindByEmail(email string) (*domain.User, error)
+	FindByID(id uint) (*domain.User, error)
+	Create(user *domain.User) error
+	Update(user *domain.User) error
+}
+
+// importIdentities finds the users of a tax code, in any school.
+type importIdentities interface {
+	FindUsersByTaxCode(taxCode string) ([]domain.User, error)
+}
+
+// importDirectory finds and saves the students and classes of an import.
+type importDirectory interface {
+	GetClassesBySchoolID(schoolID uint) ([]domain.Class, error)
+	GetStudentByTaxCode(taxCode string) (*domain.Student, error)
+	CreateStudent(student *domain.Student) error
+	UpdateStudent(student *domain.Student) error
+	GetStudentClassIDs(studentID uint) ([]uint, error)
+	EnrollStudent(enrollment *domain.ClassEnrollment) error
+}
+
+type importFiles interface {
+	Save(filename string, data []byte) (string, error)
+	Get(filename string) ([]byte, error)
+}
+
+// inviter emails new users a link to choose their password.
+type inviter interface {
+	Invite(ctx context.Context, user *domain.User) error
+}
+
+// UserImportService imports students, staff and parents from CSV or XLSX
+// files. An upload is validated in the background into a preview of what
+// each row does; once confirmed, the rows are upserted by tax code and the
+// new users invited by email.
 type UserImportService struct {
-	repo     domain.AdminRepository
-	userRepo domain.UserRepository
-	logger   *zap.Logger
+	repo       domain.AdminRepository
+	users      importUsers
+	identities importIdentities
+	directory  importDirectory
+	files      importFiles
+	queue      jobQueue
+	invites    inviter
+	logger     *zap.Logger
+}
+
+func NewUserImportService(repo domain.AdminRepository, users importUsers, identities importIdentities, directory importDirectory, files importFiles, queue jobQueue, invites inviter, logger *zap.Logger) *UserImportService {
+	return &UserImportService{repo: repo, users: users, identities: identities, directory: directory, files: files, queue: queue, invites: invites, logger: logger}
 }
 
-func NewUserImportService(repo domain.AdminRepository, userRepo domain.UserRepository, logger *zap.Logger) *UserImportService {
-	return &UserImportService{repo: repo, userRepo: userRepo, logger: logger}
+// MaxSize is the largest import file accepted.
+func (s *UserImportService) MaxSize() int64 {
+	return maxImportSize
 }
 
-func (s *UserImportService) ProcessImport(importID uint) {
-	// 1. Fetch Import Record
-	imp, err := s.repo.GetUserImport(importID)
+// Upload stores an import file and enqueues its validation. mapping maps
+// column headers to fields, overriding the recognised headers; a field of ""
+// ignores the column.
+func (s *UserImportService) Upload(schoolID, userID uint, fileName string, data []byte, mapping map[string]string) (*domain.UserImport, error) {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	format := strings.TrimPrefix(ext, ".")
+	if format != FormatCSV && format != FormatXLSX {
+		return nil, fmt.Errorf("%w: only .csv and .xlsx files are supported", ErrInvalidImport)
+	}
+	if len(data) == 0 || len(data) > maxImportSize {
+		return nil, fmt.Errorf("%w: the file must be between 1 byte and %d MB", ErrInvalidImport, maxImportSize>>20)
+	}
+	stored := make(domain.JSONMap, len(mapping))
+	for header, field := range mapping {
+		if !importFields[field] {
+			return nil, fmt.Errorf("%w: unknown field %q for column %q, expected one of %s", ErrInvalidImport, field, header, strings.Join(importFieldNames(), ", "))
+		}
+		stored[normalizeHeader(header)] = field
+	}
+
+	name, err := randomName()
+	if err != nil {
+		return nil, err
+	}
+	path, err := s.files.Save(fmt.Sprintf("imports/%d/%s%s", schoolID, name, ext), data)
 	if err != nil {
-		s.logger.Error("Import process failed: fetch record", zap.Error(err))
-		return
+		return nil, err
+	}
+	imp := &domain.UserImport{
+		SchoolID:       schoolID,
+		CreatedBy:      userID,
+		FileName:       filepath.Base(fileName),
+		ImportFilePath: path,
+		Format:         format,
+		Mapping:        stored,
+		Status:         domain.ImportValidating,
+		CreatedAt:      time.Now(),
 	}
+	if err := s.repo.CreateUserImport(imp); err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s:%d", UserImportValidateJob, imp.ID)
+	if _, err := s.queue.Enqueue(UserImportValidateJob, domain.JSONMap{"import_id": imp.ID}, key); err != nil {
+		return nil, err
+	}
+	return imp, nil
+}
 
-	imp.Status = "PROCESSING"
-	s.repo.UpdateUserImport(imp)
+// GetImport returns an import of the school, with its preview once
+// validated.
+func (s *UserImportService) GetImport(schoolID, id uint) (*domain.UserImport, error) {
+	imp, err := s.repo.GetUserImport(id)
+	if err != nil {
+		return nil, err
+	}
+	if imp == nil || imp.SchoolID != schoolID {
+		return nil, ErrImportNotFound
+	}
+	return imp, nil
+}
 
-	// 2. Open File
-	// Assuming file is local. In prod, might download from S3.
-	f, err := os.Open(imp.ImportFilePath)
+// Validate builds the preview of an import, run by UserImportValidateJob.
+// Files that cannot be read fail the import.
+func (s *UserImportService) Validate(id uint) error {
+	imp, err := s.repo.GetUserImport(id)
 	if err != nil {
-		s.failImport(imp, "File open error: "+err.Error())
-		return
+		return err
+	}
+	if imp == nil || imp.Status != domain.ImportValidating {
+		return nil // A retry after it was saved
 	}
-	defer f.Close()
 
-	reader := csv.NewReader(f)
-	// Skip header
-	_, _ = reader.Read()
+	plans, err := s.plan(imp)
+	var fatal *importFileError
+	if errors.As(err, &fatal) {
+		return s.fail(imp, fatal.Error())
+	}
+	if err != nil {
+		return err
+	}
+
+	imp.Preview = make(domain.UserImportRows, len(plans))
+	imp.ErrorDetails = domain.JSONMap{}
+	for i, p := range plans {
+		imp.Preview[i] = p.row
+		if len(p.row.Errors) > 0 {
+			imp.ErrorDetails[strconv.Itoa(p.row.Row)] = p.row.Errors
+		}
+	}
+	imp.TotalUsers = len(plans)
+	imp.FailedUsers = len(imp.ErrorDetails)
+	imp.Status = domain.ImportValidated
+	return s.repo.UpdateUserImport(imp)
+}
 
-	successCount := 0
-	failCount := 0
-	errors := make(map[string]interface{})
+// Confirm imports the rows of a validated import in the background.
+func (s *UserImportService) Confirm(schoolID, userID, id uint) (*domain.UserImport, error) {
+	imp, err := s.GetImport(schoolID, id)
+	if err != nil {
+		return nil, err
+	}
+	if imp.Status != domain.ImportValidated {
+		return nil, fmt.Errorf("%w: the import is %s", ErrImportState, imp.Status)
+	}
+	now := time.Now()
+	imp.Status = domain.ImportProcessing
+	imp.ConfirmedAt = &now
+	if err := s.repo.UpdateUserImport(imp); err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s:%d", UserImportJob, imp.ID)
+	if _, err := s.queue.Enqueue(UserImportJob, domain.JSONMap{"import_id": imp.ID}, key); err != nil {
+		return nil, err
+	}
+	s.logger.Info("User import confirmed", zap.Uint("import_id", imp.ID), zap.Uint("user_id", userID))
+	return imp, nil
+}
 
-	// 3. Iterate
-	rowNum := 1
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
+// ProcessImport imports the rows of a confirmed import, run by
+// UserImportJob. The rows are validated again, as the school may have
+// changed since the preview; rows failing are reported and skipped.
+func (s *UserImportService) ProcessImport(ctx context.Context, id uint) error {
+	imp, err := s.repo.GetUserImport(id)
+	if err != nil {
+		return err
+	}
+	if imp == nil || imp.Status != domain.ImportProcessing {
+		return nil
+	}
+
+	plans, err := s.plan(imp)
+	var fatal *importFileError
+	if errors.As(err, &fatal) {
+		return s.fail(imp, fatal.Error())
+	}
+	if err != nil {
+		return err
+	}
+
+	imp.Preview = make(domain.UserImportRows, 0, len(plans))
+	imp.ErrorDetails = domain.JSONMap{}
+	imp.ImportedUsers, imp.UpdatedUsers, imp.FailedUsers = 0, 0, 0
+	for _, p := range plans {
+		if len(p.row.Errors) == 0 {
+			if err := s.apply(ctx, imp.SchoolID, p); err != nil {
+				p.row.Errors = append(p.row.Errors, err.Error())
+			}
 		}
-		rowNum++
+		switch {
+		case len(p.row.Errors) > 0:
+			p.row.Action = importActionSkip
+			imp.ErrorDetails[strconv.Itoa(p.row.Row)] = p.row.Errors
+			imp.FailedUsers++
+		case p.row.Action == importActionNew:
+			imp.ImportedUsers++
+		default:
+			imp.UpdatedUsers++
+		}
+		imp.Preview = append(imp.Preview, p.row)
+	}
+
+	now := time.Now()
+	imp.TotalUsers = len(plans)
+	imp.ImportedAt = &now
+	imp.Status = domain.ImportCompleted
+	if imp.FailedUsers > 0 {
+		imp.Status = domain.ImportCompletedWithErrors
+	}
+	s.logger.Info("User import completed", zap.Uint("import_id", imp.ID),
+		zap.Int("created", imp.ImportedUsers), zap.Int("updated", imp.UpdatedUsers), zap.Int("failed", imp.FailedUsers))
+	return s.repo.UpdateUserImport(imp)
+}
+
+func (s *UserImportService) fail(imp *domain.UserImport, msg string) error {
+	imp.Status = domain.ImportFailed
+	imp.ErrorDetails = domain.JSONMap{"fatal_error": msg}
+	return s.repo.UpdateUserImport(imp)
+}
+
+// importFileError is why a file cannot be imported at all.
+type importFileError struct{ msg string }
+
+func (e *importFileError) Error() string { return e.msg }
+
+// rowPlan is a validated row and the records it updates.
+type rowPlan struct {
+	row     domain.UserImportRow
+	values  map[string]string
+	class   *domain.Class
+	student *domain.Student // Existing, for students
+	user    *domain.User    // Existing, for staff and parents
+}
+
+// plan reads the file of imp and validates its rows.
+func (s *UserImportService) plan(imp *domain.UserImport) ([]*rowPlan, error) {
+	data, err := s.files.Get(imp.ImportFilePath)
+	if err != nil {
+		return nil, err
+	}
+	sheet, err := readSheet(imp.Format, data)
+	if err != nil {
+		return nil, &importFileError{fmt.Sprintf("the file cannot be read: %v", err)}
+	}
+	if len(sheet) < 2 {
+		return nil, &importFileError{"the file has no rows"}
+	}
+	if len(sheet) > maxImportRows+1 {
+		return nil, &importFileError{fmt.Sprintf("the file has more than %d rows", maxImportRows)}
+	}
+	columns, err := mapColumns(sheet[0], imp.Mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	classes, err := s.directory.GetClassesBySchoolID(imp.SchoolID)
+	if err != nil {
+		return nil, err
+	}
+	v := &rowValidator{
+		s:        s,
+		schoolID: imp.SchoolID,
+		classes:  classesByName(classes),
+		taxCodes: map[string]int{},
+		emails:   map[string]emailUse{},
+	}
+	var plans []*rowPlan
+	for i, record := range sheet[1:] {
+		values := make(map[string]string, len(columns))
+		blank := true
+		for col, field := range columns {
+			if col < len(record) {
+				if value := strings.TrimSpace(record[col]); value != "" {
+					values[field], blank = value, false
+				}
+			}
+		}
+		if blank {
+			continue
+		}
+		p, err := v.check(i+2, values)
 		if err != nil {
-			failCount++
-			errors[strconv.Itoa(rowNum)] = "CSV Parse error"
+			return nil, err
+		}
+		plans = append(plans, p)
+	}
+	return plans, nil
+}
+
+// mapColumns returns the field of each column of header, the mapping
+// taking precedence over the recognised headers.
+func mapColumns(header []string, mapping domain.JSONMap) (map[int]string, error) {
+	columns := map[int]string{}
+	seen := map[string]string{}
+	for i, h := range header {
+		name := normalizeHeader(h)
+		field, ok := columnAliases[name]
+		if mapped, found := mapping[name]; found {
+			field, _ = mapped.(string)
+			ok = true
+		}
+		if !ok || field == fieldIgnored {
 			continue
 		}
+		if other, dup := seen[field]; dup {
+			return nil, &importFileError{fmt.Sprintf("columns %q and %q are both %s", other, h, field)}
+		}
+		seen[field] = h
+		columns[i] = field
+	}
+	for _, required := range []string{fieldFirstName, fieldLastName} {
+		if _, ok := seen[required]; !ok {
+			return nil, &importFileError{fmt.Sprintf("no column is mapped to %s", required)}
+		}
+	}
+	return columns, nil
+}
+
+// normalizeHeader lowercases a header and turns separators into spaces, so
+// that "Codice_Fiscale" matches "codice fiscale".
+func normalizeHeader(h string) string {
+	h = strings.ToLower(strings.TrimSpace(h))
+	h = strings.NewReplacer("_", " ", "-", " ", ".", " ").Replace(h)
+	return strings.Join(strings.Fields(h), " ")
+}
+
+// classesByName indexes the classes by name, e.g. 3A, keeping the latest
+// academic year of each.
+func classesByName(classes []domain.Class) map[string]*domain.Class {
+	byName := make(map[string]*domain.Class, len(classes))
+	for i := range classes {
+		c := &classes[i]
+		name := normalizeClass(fmt.Sprintf("%d%s", c.Grade, c.Section))
+		if prev, ok := byName[name]; !ok || c.Year > prev.Year {
+			byName[name] = c
+		}
+	}
+	return byName
+}
+
+func normalizeClass(name string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "ª", "", "°", "", "^", "").Replace(name))
+}
+
+// rowValidator checks the rows of a file against the school and the rows
+// before them.
+type rowValidator struct {
+	s        *UserImportService
+	schoolID uint
+	classes  map[string]*domain.Class
+	taxCodes map[string]int // Row of each tax code
+	emails   map[string]emailUse
+}
+
+// emailUse is the first row of an email address.
+type emailUse struct {
+	row      int
+	role     domain.Role
+	guardian bool
+}
+
+// check validates a row. Errors are those of the lookups; the problems of
+// the row are in its Errors.
+func (v *rowValidator) check(num int, values map[string]string) (*rowPlan, error) {
+	p := &rowPlan{values: values, row: domain.UserImportRow{
+		Row:   num,
+		Role:  domain.RoleStudent,
+		Name:  strings.TrimSpace(values[fieldFirstName] + " " + values[fieldLastName]),
+		Class: values[fieldClass],
+	}}
+	invalid := func(format string, args ...interface{}) {
+		p.row.Errors = append(p.row.Errors, fmt.Sprintf(format, args...))
+	}
+
+	if r := values[fieldRole]; r != "" {
+		role, ok := importRoles[strings.ToLower(r)]
+		if !ok {
+			invalid("unknown role %q", r)
+		}
+		p.row.Role = role
+	}
+	if values[fieldFirstName] == "" || values[fieldLastName] == "" {
+		invalid("first and last name are required")
+	}
+	if tc := strings.ToUpper(strings.ReplaceAll(values[fieldTaxCode], " ", "")); tc != "" {
+		values[fieldTaxCode] = tc
+		p.row.TaxCode = tc
+		if !validTaxCode(tc) {
+			invalid("invalid tax code %s", tc)
+		} else if prev, dup := v.taxCodes[tc]; dup {
+			invalid("tax code %s is already on row %d", tc, prev)
+		} else {
+			v.taxCodes[tc] = num
+		}
+	}
+	if d := values[fieldBirthDate]; d != "" {
+		if _, ok := parseBirthDate(d); !ok {
+			invalid("invalid birth date %q", d)
+		}
+	}
+	if g := values[fieldGender]; g != "" && parseGender(g) == "" {
+		invalid("invalid gender %q", g)
+	}
+
+	if email := values[fieldEmail]; email != "" && p.row.Role != "" {
+		values[fieldEmail] = v.email(email, num, p.row.Role, false, invalid)
+		p.row.Email = values[fieldEmail]
+	}
+
+	var err error
+	switch p.row.Role {
+	case domain.RoleStudent:
+		err = v.checkStudent(p, invalid)
+	case "":
+	default:
+		err = v.checkUser(p, invalid)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.row.Errors) > 0 {
+		p.row.Action = importActionSkip
+	} else if p.student != nil || p.user != nil {
+		p.row.Action = importActionEdit
+	} else {
+		p.row.Action = importActionNew
+	}
+	return p, nil
+}
+
+// email normalizes an email address, reporting invalid ones and those of
+// another row: guardians may be repeated, as siblings share them, but not be
+// the account of a student or of staff.
+func (v *rowValidator) email(address string, num int, role domain.Role, guardian bool, invalid func(string, ...interface{})) string {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address {
+		invalid("invalid email %q", address)
+		return address
+	}
+	address = strings.ToLower(address)
+	use := emailUse{row: num, role: role, guardian: guardian}
+	prev, seen := v.emails[address]
+	switch {
+	case !seen:
+		v.emails[address] = use
+	case prev.row == num:
+	case !prev.guardian && !guardian:
+		invalid("email %s is already on row %d", address, prev.row)
+	case prev.role != domain.RoleParent || role != domain.RoleParent:
+		invalid("email %s is a guardian's and another account's, on row %d", address, prev.row)
+	case !guardian:
+		v.emails[address] = use // The parent's own row
+	}
+	return address
+}
+
+func (v *rowValidator) checkStudent(p *rowPlan, invalid func(string, ...interface{})) error {
+	values := p.values
+	if values[fieldTaxCode] == "" {
+		invalid("students need a tax code")
+	}
+	if values[fieldClass] == "" {
+		invalid("students need a class")
+	} else if p.class = v.classes[normalizeClass(values[fieldClass])]; p.class == nil {
+		invalid("unknown class %s", values[fieldClass])
+	}
+
+	if tc := values[fieldTaxCode]; tc != "" {
+		student, err := v.s.directory.GetStudentByTaxCode(tc)
+		if err != nil {
+			return err
+		}
+		if student != nil && student.SchoolID != v.schoolID {
+			invalid("tax code %s belongs to a student of another school", tc)
+		} else {
+			p.student = student
+		}
+	}
+	if email := values[fieldEmail]; email != "" {
+		user, err := v.s.users.FindByEmail(email)
+		if err != nil {
+			return err
+		}
+		if user != nil && (p.student == nil || p.student.UserID == nil || *p.student.UserID != user.ID) {
+			invalid("email %s already belongs to another account", email)
+		}
+	}
 
-		// CSV Format: [Email, Password, Role, SchoolID]
-		if len(record) < 3 {
-			failCount++
-			errors[strconv.Itoa(rowNum)] = "Invalid column count"
+	guardians := 0
+	for _, field := range []string{fieldGuardian1, fieldGuardian2} {
+		email := values[field]
+		if email == "" {
 			continue
 		}
+		guardians++
+		email = v.email(email, p.row.Row, domain.RoleParent, true, invalid)
+		values[field] = email
+		if email == values[fieldEmail] {
+			invalid("guardian email %s is the student's", email)
+			continue
+		}
+		user, err := v.s.users.FindByEmail(email)
+		if err != nil {
+			return err
+		}
+		if user != nil && (user.SchoolID != v.schoolID || user.Role != domain.RoleParent) {
+			invalid("guardian email %s belongs to another account", email)
+		}
+	}
+	if guardians == 2 && values[fieldGuardian1] == values[fieldGuardian2] {
+		invalid("the two guardians have the same email")
+	}
+	return nil
+}
 
-		email := record[0]
-		password := record[1]
-		role := record[2]
-		schoolID, _ := strconv.Atoi(record[3])
+// checkUser finds the account of a staff or parent row, by tax code or else
+// by email.
+func (v *rowValidator) checkUser(p *rowPlan, invalid func(string, ...interface{})) error {
+	values := p.values
+	email := values[fieldEmail]
+	if email == "" {
+		invalid("%s rows need an email", strings.ToLower(string(p.row.Role)))
+	}
+	if values[fieldClass] != "" || values[fieldGuardian1] != "" || values[fieldGuardian2] != "" {
+		invalid("class and guardians are only imported for students")
+	}
+
+	if tc := values[fieldTaxCode]; tc != "" {
+		users, err := v.s.identities.FindUsersByTaxCode(tc)
+		if err != nil {
+			return err
+		}
+		for i := range users {
+			if users[i].SchoolID == v.schoolID {
+				if p.user != nil {
+					invalid("tax code %s belongs to more than one account", tc)
+					return nil
+				}
+				p.user = &users[i]
+			}
+		}
+	}
+	if email != "" {
+		user, err := v.s.users.FindByEmail(email)
+		if err != nil {
+			return err
+		}
+		switch {
+		case user == nil:
+		case p.user != nil && user.ID != p.user.ID:
+			invalid("email %s already belongs to another account", email)
+		case user.SchoolID != v.schoolID:
+			invalid("email %s belongs to an account of another school", email)
+		default:
+			p.user = user
+		}
+	}
+	if p.user != nil && p.user.Role != p.row.Role {
+		invalid("the existing account is a %s, not a %s", p.user.Role, p.row.Role)
+	}
+	return nil
+}
 
-		// Create User
+// apply saves a valid row.
+func (s *UserImportService) apply(ctx context.Context, schoolID uint, p *rowPlan) error {
+	if p.row.Role == domain.RoleStudent {
+		return s.applyStudent(ctx, schoolID, p)
+	}
+
+	values := p.values
+	if p.user == nil {
 		user := &domain.User{
-			Email:        email,
-			PasswordHash: password, // Should hash in service/repo
-			Role:         domain.Role(role),
-			SchoolID:     uint(schoolID),
+			SchoolID:     schoolID,
+			Email:        values[fieldEmail],
+			Role:         p.row.Role,
+			Status:       "active",
+			FirstName:    values[fieldFirstName],
+			LastName:     values[fieldLastName],
+			Phone:        values[fieldPhone],
+			TaxCode:      optional(values[fieldTaxCode]),
+			PasswordHash: invitedPasswordHash,
+		}
+		if err := s.users.Create(user); err != nil {
+			return err
 		}
+		s.invite(ctx, user)
+		return nil
+	}
+
+	// Reloaded with the subjects, which Update replaces
+	user, err := s.users.FindByID(p.user.ID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("account %d was deleted", p.user.ID)
+	}
+	user.FirstName, user.LastName = values[fieldFirstName], values[fieldLastName]
+	if values[fieldPhone] != "" {
+		user.Phone = values[fieldPhone]
+	}
+	if values[fieldTaxCode] != "" {
+		user.TaxCode = optional(values[fieldTaxCode])
+	}
+	return s.users.Update(user)
+}
+
+func (s *UserImportService) applyStudent(ctx context.Context, schoolID uint, p *rowPlan) error {
+	values := p.values
+	student := p.student
+	if student == nil {
+		student = &domain.Student{SchoolID: schoolID}
+	}
+	student.FirstName, student.LastName = values[fieldFirstName], values[fieldLastName]
+	student.TaxCode = values[fieldTaxCode]
+	if d, ok := parseBirthDate(values[fieldBirthDate]); ok {
+		student.DateOfBirth = d
+	}
+	if values[fieldBirthPlace] != "" {
+		student.PlaceOfBirth = values[fieldBirthPlace]
+	}
+	if g := parseGender(values[fieldGender]); g != "" {
+		student.Gender = g
+	}
 
-		if err := s.userRepo.Create(user); err != nil {
-			failCount++
-			errors[strconv.Itoa(rowNum)] = err.Error()
+	for i, field := range []string{fieldGuardian1, fieldGuardian2} {
+		if values[field] == "" {
 			continue
 		}
-		successCount++
+		guardian, err := s.account(ctx, schoolID, values[field], domain.RoleParent, "", "")
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			student.Parent1ID = &guardian.ID
+		} else {
+			student.Parent2ID = &guardian.ID
+		}
+	}
+	if values[fieldEmail] != "" && student.UserID == nil {
+		user, err := s.account(ctx, schoolID, values[fieldEmail], domain.RoleStudent, student.FirstName, student.LastName)
+		if err != nil {
+			return err
+		}
+		student.UserID = &user.ID
 	}
 
-	// 4. Update Status
-	imp.ImportedUsers = successCount
-	imp.FailedUsers = failCount
-	imp.ErrorDetails = errors
-	imp.Status = "COMPLETED"
-	if failCount > 0 {
-		imp.Status = "COMPLETED_WITH_ERRORS"
+	if student.ID == 0 {
+		if err := s.directory.CreateStudent(student); err != nil {
+			return err
+		}
+	} else if err := s.directory.UpdateStudent(student); err != nil {
+		return err
 	}
-	imp.ImportedAt = time.Now()
 
-	s.repo.UpdateUserImport(imp)
+	classIDs, err := s.directory.GetStudentClassIDs(student.ID)
+	if err != nil {
+		return err
+	}
+	for _, id := range classIDs {
+		if id == p.class.ID {
+			return nil
+		}
+	}
+	return s.directory.EnrollStudent(&domain.ClassEnrollment{
+		StudentID:      student.ID,
+		ClassID:        p.class.ID,
+		Year:           p.class.Year,
+		Status:         domain.EnrollmentActive,
+		EnrollmentDate: time.Now(),
+	})
 }
 
-func (s *UserImportService) failImport(imp *domain.UserImport, msg string) {
-	imp.Status = "FAILED"
-	imp.ErrorDetails = map[string]interface{}{"fatal_error": msg}
-	s.repo.UpdateUserImport(imp)
+// account returns the user of email, creating and inviting it if missing.
+func (s *UserImportService) account(ctx context.Context, schoolID uint, email string, role domain.Role, firstName, lastName string) (*domain.User, error) {
+	user, err := s.users.FindByEmail(email)
+	if err != nil || user != nil {
+		return user, err
+	}
+	user = &domain.User{
+		SchoolID:     schoolID,
+		Email:        email,
+		Role:         role,
+		Status:       "active",
+		FirstName:    firstName,
+		LastName:     lastName,
+		PasswordHash: invitedPasswordHash,
+	}
+	if err := s.users.Create(user); err != nil {
+		return nil, err
+	}
+	s.invite(ctx, user)
+	return user, nil
+}
+
+// invite emails a new user; a failed invitation does not undo the import,
+// as the user can still reset the password.
+func (s *UserImportService) invite(ctx context.Context, user *domain.User) {
+	if err := s.invites.Invite(ctx, user); err != nil {
+		s.logger.Warn("Failed to invite imported user", zap.Uint("user_id", user.ID), zap.Error(err))
+	}
+}
+
+// validTaxCode checks the format and the check character of a codice
+// fiscale.
+func validTaxCode(tc string) bool {
+	if !taxCodePattern.MatchString(tc) {
+		return false
+	}
+	// Values of the characters in odd positions, by digit or letter
+	odd := [26]int{1, 0, 5, 7, 9, 13, 15, 17, 19, 21, 2, 4, 18, 20, 11, 3, 6, 8, 12, 14, 16, 10, 22, 25, 24, 23}
+	sum := 0
+	for i := 0; i < 15; i++ {
+		c := tc[i]
+		n := int(c - 'A')
+		if c >= '0' && c <= '9' {
+			n = int(c - '0')
+		}
+		if i%2 == 0 {
+			sum += odd[n]
+		} else {
+			sum += n
+		}
+	}
+	return tc[15] == byte('A'+sum%26)
+}
+
+// parseBirthDate reads Italian and ISO dates, and the date serial numbers of
+// spreadsheet cells.
+func parseBirthDate(s string) (time.Time, bool) {
+	if s == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range []string{"02/01/2006", "2/1/2006", "2006-01-02", "02-01-2006", "02.01.2006"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	if n, err := strconv.Atoi(s); err == nil && n > 0 && n < 100000 {
+		return time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC).AddDate(0, 0, n), true
+	}
+	return time.Time{}, false
+}
+
+func parseGender(s string) string {
+	switch strings.ToLower(s) {
+	case "m", "male", "maschio":
+		return "M"
+	case "f", "female", "femmina":
+		return "F"
+	}
+	return ""
+}
+
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func randomName() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// importFieldNames returns the fields columns can be mapped to.
+func importFieldNames() []string {
+	names := make([]string, 0, len(importFields))
+	for f := range importFields {
+		if f != fieldIgnored {
+			names = append(names, f)
+		}
+	}
+	sort.Strings(names)
+	return names
 }
@@ -0,0 +1,418 @@
+package admin
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// memorySchool holds the users, students and classes of an import test.
+type memorySchool struct {
+	users       []*domain.User
+	students    []*domain.Student
+	classes     []domain.Class
+	enrollments []domain.ClassEnrollment
+	files       map[string][]byte
+	jobs        []string
+	invited     []string
+}
+
+func (m *memorySchool) FindByEmail(email string) (*domain.User, error) {
+	for _, u := range m.users {
+		if u.Email == email {
+			user := *u
+			return &user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memorySchool) FindByID(id uint) (*domain.User, error) {
+	for _, u := range m.users {
+		if u.ID == id {
+			user := *u
+			return &user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memorySchool) Create(user *domain.User) error {
+	user.ID = uint(len(m.users) + 1)
+	stored := *user
+	m.users = append(m.users, &stored)
+	return nil
+}
+
+func (m *memorySchool) Update(user *domain.User) error {
+	for i, u := range m.users {
+		if u.ID == user.ID {
+			stored := *user
+			m.users[i] = &stored
+		}
+	}
+	return nil
+}
+
+func (m *memorySchool) FindUsersByTaxCode(taxCode string) ([]domain.User, error) {
+	var users []domain.User
+	for _, u := range m.users {
+		if u.TaxCode != nil && strings.EqualFold(*u.TaxCode, taxCode) {
+			users = append(users, *u)
+		}
+	}
+	return users, nil
+}
+
+func (m *memorySchool) GetClassesBySchoolID(schoolID uint) ([]domain.Class, error) {
+	var classes []domain.Class
+	for _, c := range m.classes {
+		if c.SchoolID == schoolID {
+			classes = append(classes, c)
+		}
+	}
+	return classes, nil
+}
+
+func (m *memorySchool) GetStudentByTaxCode(taxCode string) (*domain.Student, error) {
+	for _, s := range m.students {
+		if s.TaxCode == taxCode {
+			student := *s
+			return &student, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memorySchool) CreateStudent(student *domain.Student) error {
+	student.ID = uint(len(m.students) + 1)
+	stored := *student
+	m.students = append(m.students, &stored)
+	return nil
+}
+
+func (m *memorySchool) UpdateStudent(student *domain.Student) error {
+	for i, s := range m.students {
+		if s.ID == student.ID {
+			stored := *student
+			m.students[i] = &stored
+		}
+	}
+	return nil
+}
+
+func (m *memorySchool) GetStudentClassIDs(studentID uint) ([]uint, error) {
+	var ids []uint
+	for _, e := range m.enrollments {
+		if e.StudentID == studentID && e.Status == domain.EnrollmentActive {
+			ids = append(ids, e.ClassID)
+		}
+	}
+	return ids, nil
+}
+
+func (m *memorySchool) EnrollStudent(enrollment *domain.ClassEnrollment) error {
+	m.enrollments = append(m.enrollments, *enrollment)
+	return nil
+}
+
+func (m *memorySchool) Save(filename string, data []byte) (string, error) {
+	m.files["/uploads/"+filename] = data
+	return "/uploads/" + filename, nil
+}
+
+func (m *memorySchool) Get(filename string) ([]byte, error) {
+	data, ok := m.files[filename]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", filename)
+	}
+	return data, nil
+}
+
+func (m *memorySchool) Enqueue(jobType string, payload domain.JSONMap, key string) (*domain.Job, error) {
+	m.jobs = append(m.jobs, key)
+	return &domain.Job{Type: jobType, Payload: payload}, nil
+}
+
+func (m *memorySchool) Invite(ctx context.Context, user *domain.User) error {
+	m.invited = append(m.invited, user.Email)
+	return nil
+}
+
+func (m *memorySchool) student(taxCode string) *domain.Student {
+	s, _ := m.GetStudentByTaxCode(taxCode)
+	return s
+}
+
+// importAdminRepo stores the import of a test, whose ID is always 1.
+type importAdminRepo struct {
+	MockAdminRepository
+	imp *domain.UserImport
+}
+
+func (r *importAdminRepo) CreateUserImport(imp *domain.UserImport) error {
+	imp.ID = 1
+	r.imp = imp
+	return nil
+}
+
+func (r *importAdminRepo) GetUserImport(id uint) (*domain.UserImport, error) {
+	if r.imp == nil || r.imp.ID != id {
+		return nil, nil
+	}
+	return r.imp, nil
+}
+
+func (r *importAdminRepo) UpdateUserImport(imp *domain.UserImport) error {
+	return nil
+}
+
+func newImportTest() (*memorySchool, **domain.UserImport, *UserImportService) {
+	school := &memorySchool{files: map[string][]byte{}}
+	repo := &importAdminRepo{}
+	service := NewUserImportService(repo, school, school, school, school, school, school, zap.NewNop())
+	return school, &repo.imp, service
+}
+
+// withCheck completes the first 15 characters of a tax code with its check
+// character.
+func withCheck(tc string) string {
+	for c := 'A'; c <= 'Z'; c++ {
+		if validTaxCode(tc + string(c)) {
+			return tc + string(c)
+		}
+	}
+	panic("invalid tax code " + tc)
+}
+
+func TestValidTaxCode(t *testing.T) {
+	assert.True(t, validTaxCode("RSSMRA85T10A562S"))
+	assert.True(t, validTaxCode(withCheck("RSSMRA85T10A56N"))) // Omocodia
+	assert.False(t, validTaxCode("RSSMRA85T10A562A"), "wrong check character")
+	assert.False(t, validTaxCode("RSSMRA85T10A56"))
+	assert.False(t, validTaxCode("1SSMRA85T10A562S"))
+}
+
+func TestUserImport(t *testing.T) {
+	school, imp, service := newImportTest()
+	school.classes = []domain.Class{
+		{ID: 1, SchoolID: 1, Grade: 3, Section: "A", Year: "2024-25"},
+		{ID: 2, SchoolID: 1, Grade: 3, Section: "A", Year: "2025-26"},
+		{ID: 3, SchoolID: 1, Grade: 2, Section: "B", Year: "2025-26"},
+		{ID: 4, SchoolID: 2, Grade: 5, Section: "Z", Year: "2025-26"},
+	}
+	require.NoError(t, school.Create(&domain.User{SchoolID: 1, Email: "mamma@example.it", Role: domain.RoleParent}))
+	require.NoError(t, school.Create(&domain.User{SchoolID: 2, Email: "altro@example.it", Role: domain.RoleTeacher}))
+	existing := withCheck("VRDLGU10A01H501")
+	require.NoError(t, school.CreateStudent(&domain.Student{SchoolID: 1, FirstName: "Luigi", LastName: "Verde", TaxCode: existing}))
+	require.NoError(t, school.EnrollStudent(&domain.ClassEnrollment{StudentID: 1, ClassID: 3, Status: domain.EnrollmentActive}))
+
+	first, sibling := withCheck("BNCGLI11B41F205"), withCheck("BNCMRC13C01F205")
+	csv := "\ufeffNome;Cognome;Codice Fiscale;Classe;Email genitore 1;Email genitore 2;Ruolo;E-mail;Data di nascita\n" +
+		"Giulia;Bianchi;" + strings.ToLower(first) + ";3A;mamma@example.it;papa@example.it;;;01/02/2011\n" +
+		"Luigi;Verdi;" + existing + ";3 A;;;studente;;\n" +
+		"Marco;Bianchi;" + sibling + ";3A;papa@example.it;;;;\n" +
+		"Anna;Rossi;;;;;Docente;prof@example.it;\n" +
+		"Bad;Row;RSSMRA85T10A562A;5Z;;;;;31/02/2011\n" +
+		"Other;School;;;;;teacher;altro@example.it;\n" +
+		";;;;;;;;\n" +
+		"Carla;Neri;" + withCheck("NRECRL12D41F205") + ";3A;prof@example.it;;;;\n"
+
+	_, err := service.Upload(1, 9, "students.txt", []byte(csv), nil)
+	assert.ErrorIs(t, err, ErrInvalidImport)
+	_, err = service.Upload(1, 9, "students.csv", []byte(csv), map[string]string{"Nome": "nickname"})
+	assert.ErrorIs(t, err, ErrInvalidImport)
+
+	uploaded, err := service.Upload(1, 9, "students.csv", []byte(csv), nil)
+	require.NoError(t, err)
+	assert.Equal(t, domain.ImportValidating, uploaded.Status)
+	assert.Equal(t, []string{"admin.user_import_validate:1"}, school.jobs)
+	_, err = service.Confirm(1, 9, 1)
+	assert.ErrorIs(t, err, ErrImportState, "not validated yet")
+
+	require.NoError(t, service.Validate(1))
+	assert.Equal(t, domain.ImportValidated, (*imp).Status)
+	preview := (*imp).Preview
+	require.Len(t, preview, 7, "blank rows are skipped")
+	actions := make([]string, len(preview))
+	for i, row := range preview {
+		actions[i] = fmt.Sprintf("%d %s %s", row.Row, row.Action, row.Role)
+	}
+	assert.Equal(t, []string{
+		"2 create Student", "3 update Student", "4 create Student", "5 create Teacher",
+		"6 skip Student", "7 skip Teacher", "9 skip Student",
+	}, actions)
+	assert.Equal(t, first, preview[0].TaxCode)
+	assert.Len(t, preview[4].Errors, 3, "tax code, class and birth date")
+	assert.Contains(t, preview[5].Errors[0], "another school")
+	assert.Contains(t, preview[6].Errors[0], "prof@example.it")
+	assert.Equal(t, 3, (*imp).FailedUsers)
+	assert.Contains(t, (*imp).ErrorDetails, "6")
+	assert.Empty(t, school.students[1:], "nothing is saved before the confirmation")
+
+	_, err = service.Confirm(2, 9, 1)
+	assert.ErrorIs(t, err, ErrImportNotFound, "of another school")
+	_, err = service.Confirm(1, 9, 1)
+	require.NoError(t, err)
+	_, err = service.Confirm(1, 9, 1)
+	assert.ErrorIs(t, err, ErrImportState)
+	assert.Equal(t, "admin.user_import:1", school.jobs[1])
+
+	require.NoError(t, service.ProcessImport(context.Background(), 1))
+	assert.Equal(t, domain.ImportCompletedWithErrors, (*imp).Status)
+	assert.Equal(t, 3, (*imp).ImportedUsers)
+	assert.Equal(t, 1, (*imp).UpdatedUsers)
+	assert.Equal(t, 3, (*imp).FailedUsers)
+	assert.NotNil(t, (*imp).ImportedAt)
+	assert.ElementsMatch(t, []string{"papa@example.it", "prof@example.it"}, school.invited)
+
+	mamma, _ := school.FindByEmail("mamma@example.it")
+	papa, _ := school.FindByEmail("papa@example.it")
+	require.NotNil(t, papa)
+	assert.Equal(t, domain.RoleParent, papa.Role)
+	assert.Equal(t, invitedPasswordHash, papa.PasswordHash)
+	giulia := school.student(first)
+	require.NotNil(t, giulia)
+	assert.Equal(t, mamma.ID, *giulia.Parent1ID)
+	assert.Equal(t, papa.ID, *giulia.Parent2ID)
+	assert.Equal(t, "2011-02-01", giulia.DateOfBirth.Format("2006-01-02"))
+	assert.Equal(t, papa.ID, *school.student(sibling).Parent1ID, "siblings share guardians")
+	assert.Equal(t, "Verdi", school.student(existing).LastName)
+
+	ids, _ := school.GetStudentClassIDs(school.student(existing).ID)
+	assert.Equal(t, []uint{3, 2}, ids, "enrolled in the latest 3A")
+	ids, _ = school.GetStudentClassIDs(giulia.ID)
+	assert.Equal(t, []uint{2}, ids)
+
+	// A retried job does not import twice
+	require.NoError(t, service.ProcessImport(context.Background(), 1))
+	assert.Len(t, school.students, 3)
+}
+
+// buildXLSX returns a workbook whose first sheet holds rows, the first row
+// in shared strings and the others inline; empty rows are left out.
+func buildXLSX(t *testing.T, rows [][]string) []byte {
+	var sheet, shared strings.Builder
+	for i, row := range rows {
+		if len(row) == 0 {
+			continue
+		}
+		fmt.Fprintf(&sheet, `<row r="%d">`, i+1)
+		for j, v := range row {
+			ref := fmt.Sprintf("%c%d", 'A'+j, i+1)
+			if v == "" {
+				continue
+			}
+			if i == 0 {
+				fmt.Fprintf(&shared, "<si><t>%s</t></si>", v)
+				fmt.Fprintf(&sheet, `<c r="%s" t="s"><v>%d</v></c>`, ref, j)
+			} else {
+				fmt.Fprintf(&sheet, `<c r="%s" t="inlineStr"><is><t>%s</t></is></c>`, ref, v)
+			}
+		}
+		sheet.WriteString("</row>")
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets><sheet name="Staff" sheetId="1" r:id="rId3"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId3" Target="worksheets/staff.xml"/></Relationships>`,
+		"xl/sharedStrings.xml": `<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` + shared.String() + `</sst>`,
+		"xl/worksheets/staff.xml": `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>` +
+			sheet.String() + `</sheetData></worksheet>`,
+	} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestUserImportXLSXMapping(t *testing.T) {
+	school, imp, service := newImportTest()
+	tc := withCheck("RSSNNA80A41H501")
+	require.NoError(t, school.Create(&domain.User{SchoolID: 1, Email: "anna.rossi@example.it", Role: domain.RoleTeacher, TaxCode: &tc,
+		Subjects: []domain.Subject{{ID: 4}}}))
+
+	data := buildXLSX(t, [][]string{
+		{"Given", "Family", "CF", "Mail", "Kind", "Notes"},
+		{},
+		{"Anna", "Rossi", tc, "anna.rossi@example.it", "teacher", "Part time"},
+		{"Paolo", "Gialli", "", "p.gialli@example.it", "segreteria"},
+	})
+	mapping := map[string]string{"Given": "first_name", "Family": "last_name", "CF": "tax_code", "Kind": "role", "Notes": ""}
+	_, err := service.Upload(1, 9, "Staff.XLSX", data, mapping)
+	require.NoError(t, err)
+	require.NoError(t, service.Validate(1))
+	require.Equal(t, domain.ImportValidated, (*imp).Status, (*imp).ErrorDetails)
+	require.Len(t, (*imp).Preview, 2)
+	assert.Equal(t, 3, (*imp).Preview[0].Row)
+	assert.Equal(t, "update", (*imp).Preview[0].Action, "matched by tax code")
+	assert.Equal(t, domain.RoleSecretary, (*imp).Preview[1].Role)
+	assert.Equal(t, "p.gialli@example.it", (*imp).Preview[1].Email, "Mail is a recognised header")
+
+	_, err = service.Confirm(1, 9, 1)
+	require.NoError(t, err)
+	require.NoError(t, service.ProcessImport(context.Background(), 1))
+	assert.Equal(t, domain.ImportCompleted, (*imp).Status)
+	anna, _ := school.FindByEmail("anna.rossi@example.it")
+	assert.Equal(t, "Anna", anna.FirstName)
+	assert.Len(t, anna.Subjects, 1, "subjects are kept")
+	assert.Equal(t, []string{"p.gialli@example.it"}, school.invited)
+}
+
+func TestUserImportUnreadable(t *testing.T) {
+	school, imp, service := newImportTest()
+	_, err := service.Upload(1, 9, "users.xlsx", []byte("not a workbook"), nil)
+	require.NoError(t, err)
+	require.NoError(t, service.Validate(1))
+	assert.Equal(t, domain.ImportFailed, (*imp).Status)
+	assert.Contains(t, (*imp).ErrorDetails["fatal_error"], "cannot be read")
+
+	school.files = map[string][]byte{}
+	_, err = service.Upload(1, 9, "users.csv", []byte("Email;Role\nx@example.it;teacher\n"), nil)
+	require.NoError(t, err)
+	require.NoError(t, service.Validate(1))
+	assert.Equal(t, domain.ImportFailed, (*imp).Status)
+	assert.Equal(t, "no column is mapped to first_name", (*imp).ErrorDetails["fatal_error"])
+}
+
+func TestReadXLSXCellRefs(t *testing.T) {
+	sheet := func(cells string) []byte {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		w, err := zw.Create("xl/worksheets/sheet1.xml")
+		require.NoError(t, err)
+		_, err = w.Write([]byte(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData><row r="1">` +
+			cells + `</row></sheetData></worksheet>`))
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		return buf.Bytes()
+	}
+
+	rows, err := readXLSX(sheet(`<c r="B1"><v>2</v></c><c r="XFD1"><v>last</v></c>`))
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Len(t, rows[0], 16384)
+	assert.Equal(t, "2", rows[0][1])
+	assert.Equal(t, "last", rows[0][16383])
+
+	// Crafted references must neither panic nor allocate huge rows
+	for _, ref := range []string{"a1", "1", "XFE1", "ZZZZZZZZ1"} {
+		_, err := readXLSX(sheet(`<c r="` + ref + `"><v>x</v></c>`))
+		assert.EqualError(t, err, "cell "+ref+": bad reference", ref)
+	}
+}
@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"go.uber.org/zap"
+)
+
+// LoginContext carries the request metadata recorded for each login attempt.
+type LoginContext struct {
+	IPAddress string
+	UserAgent string
+}
+
+// recordAuthAttempt writes an entry to auth_audit_logs. A failure to write the
+// audit entry is logged but never blocks the login itself.
+func recordAuthAttempt(repo domain.AuthRepository, userID *uint, method, provider string, lc LoginContext, reason string) {
+	entry := &domain.AuthAuditLog{
+		UserID:        userID,
+		AuthMethod:    method,
+		Provider:      provider,
+		IPAddress:     lc.IPAddress,
+		UserAgent:     lc.UserAgent,
+		Success:       reason == "",
+		FailureReason: reason,
+		CreatedAt:     time.Now(),
+	}
+	if err := repo.CreateAuthAuditLog(entry); err != nil {
+		zap.L().Warn("Failed to write auth audit log",
+			zap.String("method", method),
+			zap.String("provider", provider),
+			zap.Error(err))
+	}
+}
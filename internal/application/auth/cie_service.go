@@ -3,14 +3,15 @@ package auth
 import (
 	"context"
 	"errors"
-	"fmt"
-	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/k/iRegistro/internal/domain"
 	"golang.org/x/oauth2"
 )
 
+// CIEProvider is the provider name recorded for CIE logins (single national IdP).
+const CIEProvider = "CIE"
+
 var (
 	ErrCIETokenInvalid = errors.New("CIE token validation failed")
 	ErrCIEClaimMissing = errors.New("required CIE claim missing")
@@ -18,8 +19,9 @@ var (
 
 // CIEService handles CIE (Carta d'Identità Elettronica) authentication
 type CIEService struct {
-	userRepo     domain.UserRepository
-	jwtSecret    string
+	authRepo     domain.AuthRepository
+	tokens       *TokenService
+	links        *IdentityLinkService
 	oauth2Config *oauth2.Config
 	oidcVerifier *oidc.IDTokenVerifier
 }
@@ -37,10 +39,11 @@ type CIEClaims struct {
 	PlaceOfBirth string `json:"place_of_birth"`
 }
 
-func NewCIEService(userRepo domain.UserRepository, jwtSecret string, oauth2Config *oauth2.Config, verifier *oidc.IDTokenVerifier) *CIEService {
+func NewCIEService(authRepo domain.AuthRepository, tokens *TokenService, links *IdentityLinkService, oauth2Config *oauth2.Config, verifier *oidc.IDTokenVerifier) *CIEService {
 	return &CIEService{
-		userRepo:     userRepo,
-		jwtSecret:    jwtSecret,
+		authRepo:     authRepo,
+		tokens:       tokens,
+		links:        links,
 		oauth2Config: oauth2Config,
 		oidcVerifier: verifier,
 	}
@@ -80,49 +83,38 @@ func (s *CIEService) ValidateAndExtractClaims(ctx context.Context, rawIDToken st
 	return &claims, nil
 }
 
-// GetOrCreateUserByCIE finds or creates a user based on CIE claims
-func (s *CIEService) GetOrCreateUserByCIE(ctx context.Context, claims *CIEClaims, schoolID uint) (*domain.User, error) {
-	// Try to find user by external ID (CIE unique identifier)
-	externalID := "cie:" + claims.FiscalNumber
-	user, err := s.userRepo.GetByExternalID(ctx, externalID)
-
-	if err == nil {
-		// User exists, update last auth and CIE info
-		user.LastAuthAt = timePtr(time.Now())
-		user.CIESerialNumber = &claims.SerialNumber
-		if err := s.userRepo.Update(user); err != nil {
-			return nil, err
-		}
-		return user, nil
-	}
-
-	// User doesn't exist, create new one
-	user = &domain.User{
-		Email:           claims.Email,
-		SchoolID:        schoolID,
+// ResolveUserByCIE returns the user linked to the CIE identity. Identities
+// that cannot be matched yield an *IdentityPendingError.
+func (s *CIEService) ResolveUserByCIE(ctx context.Context, claims *CIEClaims, schoolID uint) (*domain.User, error) {
+	taxCode := normalizeTaxCode(claims.FiscalNumber)
+	return s.links.Resolve(ctx, FederatedIdentity{
+		AuthMethod:      domain.AuthMethodCIE,
+		ExternalID:      "cie:" + taxCode,
+		Provider:        CIEProvider,
+		TaxCode:         taxCode,
 		FirstName:       claims.GivenName,
 		LastName:        claims.FamilyName,
-		AuthMethod:      "cie",
-		CIESerialNumber: &claims.SerialNumber,
-		ExternalID:      &externalID,
-		LastAuthAt:      timePtr(time.Now()),
-		Role:            domain.RoleParent, // Default role
-		PasswordHash:    "",                // No password for CIE users
-		CreatedAt:       time.Now(),
-		UpdatedAt:       time.Now(),
-	}
+		Email:           claims.Email,
+		CIESerialNumber: claims.SerialNumber,
+	}, schoolID)
+}
 
-	if err := s.userRepo.Create(user); err != nil {
+// IssueTokens issues access and refresh tokens for an authenticated CIE user
+// and records the successful login in the audit log.
+func (s *CIEService) IssueTokens(user *domain.User, lc LoginContext) (*TokenPair, error) {
+	pair, err := s.tokens.IssueWithAssurance(user, Assurance{Method: domain.AuthMethodCIE}, lc.IPAddress, lc.UserAgent)
+	if err != nil {
+		recordAuthAttempt(s.authRepo, &user.ID, domain.AuthMethodCIE, CIEProvider, lc, "token issuance failed: "+err.Error())
 		return nil, err
 	}
 
-	return user, nil
+	recordAuthAttempt(s.authRepo, &user.ID, domain.AuthMethodCIE, CIEProvider, lc, "")
+	return pair, nil
 }
 
-// GenerateTokenForUser generates JWT token for authenticated CIE user
-func (s *CIEService) GenerateTokenForUser(user *domain.User) (string, error) {
-	// Simple JWT generation - in production use a proper token service
-	return fmt.Sprintf("jwt_token_user_%d_school_%d", user.ID, user.SchoolID), nil
+// RecordFailure stores a failed CIE login attempt in the audit log.
+func (s *CIEService) RecordFailure(lc LoginContext, reason string) {
+	recordAuthAttempt(s.authRepo, nil, domain.AuthMethodCIE, CIEProvider, lc, reason)
 }
 
 // GetAuthorizationURL generates OAuth2 authorization URL for CIE login
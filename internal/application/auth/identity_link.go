@@ -0,0 +1,348 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+)
+
+const identityLinkTokenTTL = 24 * time.Hour
+
+var (
+	ErrIdentityLinkRequired     = errors.New("an account with this email exists, log in to confirm the link")
+	ErrIdentityPendingApproval  = errors.New("identity is awaiting approval by the school secretary")
+	ErrIdentityLinkTokenInvalid = errors.New("identity link token invalid or expired")
+	ErrIdentityNotPending       = errors.New("identity is not awaiting approval")
+	ErrIdentityRoleNotAllowed   = errors.New("role cannot be assigned through identity approval")
+	ErrIdentityEmailRequired    = errors.New("email required to create the account")
+	ErrIdentityForbidden        = errors.New("identity belongs to another school")
+)
+
+// FederatedIdentity is the provider-independent view of a SPID or CIE login.
+type FederatedIdentity struct {
+	AuthMethod      string // domain.AuthMethodSPID, domain.AuthMethodCIE
+	ExternalID      string
+	Provider        string
+	TaxCode         string
+	FirstName       string
+	LastName        string
+	Email           string
+	CIESerialNumber string
+}
+
+// IdentityPendingError is returned when a federated identity cannot be logged in
+// yet. Pending is the queued record; ConfirmToken is only set when the owner of an
+// existing email account has to confirm the link and must be handed to them once.
+type IdentityPendingError struct {
+	Pending      *domain.PendingIdentity
+	ConfirmToken string
+	Err          error
+}
+
+func (e *IdentityPendingError) Error() string { return e.Err.Error() }
+func (e *IdentityPendingError) Unwrap() error { return e.Err }
+
+// ApprovalRequest is the secretary decision for a queued identity. Either link it
+// to an existing user of the school or create a new account with Role.
+type ApprovalRequest struct {
+	UserID *uint
+	Role   domain.Role
+	Email  string // Overrides the email asserted by the provider, if any
+}
+
+// Roles the secretary can grant when approving an identity. Staff with higher
+// privileges are pre-registered with their tax code instead.
+var approvableRoles = map[domain.Role]bool{
+	domain.RoleTeacher: true,
+	domain.RoleParent:  true,
+	domain.RoleStudent: true,
+}
+
+// IdentityLinkService resolves SPID/CIE identities to users. Identities are
+// matched by external ID, then by tax code against pre-registered users; an
+// existing email account must confirm the link, anything else is queued for the
+// school secretary. No account is ever created without a human decision.
+type IdentityLinkService struct {
+	userRepo     domain.UserRepository
+	identityRepo domain.IdentityRepository
+}
+
+func NewIdentityLinkService(userRepo domain.UserRepository, identityRepo domain.IdentityRepository) *IdentityLinkService {
+	return &IdentityLinkService{userRepo: userRepo, identityRepo: identityRepo}
+}
+
+// Resolve returns the user behind the identity, or an *IdentityPendingError.
+func (s *IdentityLinkService) Resolve(ctx context.Context, id FederatedIdentity, schoolID uint) (*domain.User, error) {
+	id.TaxCode = normalizeTaxCode(id.TaxCode)
+
+	user, err := s.userRepo.GetByExternalID(ctx, id.ExternalID)
+	if err != nil {
+		return nil, err
+	}
+	if user != nil {
+		return s.touch(user, id)
+	}
+
+	candidates, err := s.identityRepo.FindUsersByTaxCode(id.TaxCode)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 1 {
+		return s.link(&candidates[0], id)
+	}
+
+	// Ambiguous tax code matches go to the secretary as well
+	if len(candidates) == 0 && id.Email != "" {
+		existing, err := s.userRepo.FindByEmail(id.Email)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return nil, s.queueConfirmation(existing, id, schoolID)
+		}
+	}
+
+	return nil, s.queueApproval(id, schoolID)
+}
+
+// ConfirmLink links the identity to the logged-in user holding the token.
+func (s *IdentityLinkService) ConfirmLink(userID uint, token string) (*domain.User, error) {
+	pending, err := s.identityRepo.GetPendingIdentityByTokenHash(HashToken(token))
+	if err != nil || pending == nil {
+		return nil, ErrIdentityLinkTokenInvalid
+	}
+	if pending.Status != domain.IdentityAwaitingConfirmation ||
+		pending.MatchedUserID == nil || *pending.MatchedUserID != userID ||
+		pending.ConfirmTokenExp == nil || time.Now().After(*pending.ConfirmTokenExp) {
+		return nil, ErrIdentityLinkTokenInvalid
+	}
+
+	user, err := s.userRepo.FindByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrIdentityLinkTokenInvalid
+	}
+
+	if _, err := s.link(user, identityFromPending(pending)); err != nil {
+		return nil, err
+	}
+	return user, s.close(pending, domain.IdentityLinked, &user.ID, nil, "")
+}
+
+// ListPending returns the identities awaiting approval for a school.
+func (s *IdentityLinkService) ListPending(schoolID uint) ([]domain.PendingIdentity, error) {
+	return s.identityRepo.ListPendingIdentities(schoolID, domain.IdentityPendingApproval)
+}
+
+// Approve links a queued identity to an existing user of the school, or creates
+// the account with the role chosen by the secretary.
+func (s *IdentityLinkService) Approve(schoolID, pendingID, reviewerID uint, req ApprovalRequest) (*domain.User, error) {
+	pending, err := s.getReviewable(schoolID, pendingID)
+	if err != nil {
+		return nil, err
+	}
+	id := identityFromPending(pending)
+
+	var user *domain.User
+	if req.UserID != nil {
+		existing, err := s.userRepo.FindByID(*req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil || existing.SchoolID != schoolID {
+			return nil, ErrIdentityForbidden
+		}
+		if user, err = s.link(existing, id); err != nil {
+			return nil, err
+		}
+	} else {
+		if !approvableRoles[req.Role] {
+			return nil, ErrIdentityRoleNotAllowed
+		}
+		email := strings.TrimSpace(req.Email)
+		if email == "" {
+			email = pending.Email
+		}
+		if email == "" {
+			return nil, ErrIdentityEmailRequired
+		}
+
+		user = &domain.User{
+			Email:      email,
+			SchoolID:   schoolID,
+			FirstName:  pending.FirstName,
+			LastName:   pending.LastName,
+			Role:       req.Role,
+			AuthMethod: pending.AuthMethod,
+			ExternalID: &id.ExternalID,
+			CreatedAt:  time.Now(),
+			UpdatedAt:  time.Now(),
+		}
+		applyIdentity(user, id)
+		if err := s.userRepo.Create(user); err != nil {
+			return nil, err
+		}
+	}
+
+	return user, s.close(pending, domain.IdentityLinked, &user.ID, &reviewerID, "")
+}
+
+// Reject closes a queued identity without creating an account.
+func (s *IdentityLinkService) Reject(schoolID, pendingID, reviewerID uint, reason string) error {
+	pending, err := s.getReviewable(schoolID, pendingID)
+	if err != nil {
+		return err
+	}
+	return s.close(pending, domain.IdentityRejected, nil, &reviewerID, reason)
+}
+
+func (s *IdentityLinkService) getReviewable(schoolID, pendingID uint) (*domain.PendingIdentity, error) {
+	pending, err := s.identityRepo.GetPendingIdentityByID(pendingID)
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil || pending.Status != domain.IdentityPendingApproval {
+		return nil, ErrIdentityNotPending
+	}
+	if pending.SchoolID != schoolID {
+		return nil, ErrIdentityForbidden
+	}
+	return pending, nil
+}
+
+func (s *IdentityLinkService) touch(user *domain.User, id FederatedIdentity) (*domain.User, error) {
+	applyIdentity(user, id)
+	if err := s.userRepo.Update(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// link binds the identity to a user. A user keeps the first external ID it was
+// linked with; later logins through the other provider match by tax code.
+func (s *IdentityLinkService) link(user *domain.User, id FederatedIdentity) (*domain.User, error) {
+	if user.ExternalID == nil {
+		externalID := id.ExternalID
+		user.ExternalID = &externalID
+	}
+	if user.TaxCode == nil && id.TaxCode != "" {
+		taxCode := id.TaxCode
+		user.TaxCode = &taxCode
+	}
+	return s.touch(user, id)
+}
+
+func (s *IdentityLinkService) queueConfirmation(existing *domain.User, id FederatedIdentity, schoolID uint) error {
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return err
+	}
+	exp := time.Now().Add(identityLinkTokenTTL)
+
+	pending, err := s.upsertPending(id, schoolID, func(p *domain.PendingIdentity) {
+		p.Status = domain.IdentityAwaitingConfirmation
+		p.MatchedUserID = &existing.ID
+		p.ConfirmTokenHash = HashToken(token)
+		p.ConfirmTokenExp = &exp
+	})
+	if err != nil {
+		return err
+	}
+	return &IdentityPendingError{Pending: pending, ConfirmToken: token, Err: ErrIdentityLinkRequired}
+}
+
+func (s *IdentityLinkService) queueApproval(id FederatedIdentity, schoolID uint) error {
+	pending, err := s.upsertPending(id, schoolID, func(p *domain.PendingIdentity) {
+		p.Status = domain.IdentityPendingApproval
+		p.MatchedUserID = nil
+		p.ConfirmTokenHash = ""
+		p.ConfirmTokenExp = nil
+	})
+	if err != nil {
+		return err
+	}
+	return &IdentityPendingError{Pending: pending, Err: ErrIdentityPendingApproval}
+}
+
+// upsertPending reuses the open record of a repeated login so that the secretary
+// sees each person once.
+func (s *IdentityLinkService) upsertPending(id FederatedIdentity, schoolID uint, apply func(*domain.PendingIdentity)) (*domain.PendingIdentity, error) {
+	pending, err := s.identityRepo.GetOpenPendingIdentityByExternalID(id.ExternalID)
+	if err != nil {
+		return nil, err
+	}
+	isNew := pending == nil
+	if isNew {
+		pending = &domain.PendingIdentity{ExternalID: id.ExternalID}
+	}
+
+	pending.SchoolID = schoolID
+	pending.AuthMethod = id.AuthMethod
+	pending.Provider = id.Provider
+	pending.TaxCode = id.TaxCode
+	pending.FirstName = id.FirstName
+	pending.LastName = id.LastName
+	pending.Email = id.Email
+	pending.CIESerialNumber = id.CIESerialNumber
+	apply(pending)
+
+	if isNew {
+		err = s.identityRepo.CreatePendingIdentity(pending)
+	} else {
+		err = s.identityRepo.UpdatePendingIdentity(pending)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+func (s *IdentityLinkService) close(p *domain.PendingIdentity, status domain.IdentityStatus, linkedUserID, reviewerID *uint, reason string) error {
+	now := time.Now()
+	p.Status = status
+	p.LinkedUserID = linkedUserID
+	p.ReviewedBy = reviewerID
+	p.ReviewedAt = &now
+	p.RejectionReason = reason
+	p.ConfirmTokenHash = ""
+	p.ConfirmTokenExp = nil
+	return s.identityRepo.UpdatePendingIdentity(p)
+}
+
+func applyIdentity(user *domain.User, id FederatedIdentity) {
+	user.LastAuthAt = timePtr(time.Now())
+	switch id.AuthMethod {
+	case domain.AuthMethodSPID:
+		provider := id.Provider
+		user.SPIDProvider = &provider
+	case domain.AuthMethodCIE:
+		if id.CIESerialNumber != "" {
+			serial := id.CIESerialNumber
+			user.CIESerialNumber = &serial
+		}
+	}
+}
+
+func identityFromPending(p *domain.PendingIdentity) FederatedIdentity {
+	return FederatedIdentity{
+		AuthMethod:      p.AuthMethod,
+		ExternalID:      p.ExternalID,
+		Provider:        p.Provider,
+		TaxCode:         p.TaxCode,
+		FirstName:       p.FirstName,
+		LastName:        p.LastName,
+		Email:           p.Email,
+		CIESerialNumber: p.CIESerialNumber,
+	}
+}
+
+// normalizeTaxCode strips the "TINIT-" prefix SPID uses for fiscalNumber.
+func normalizeTaxCode(taxCode string) string {
+	taxCode = strings.ToUpper(strings.TrimSpace(taxCode))
+	return strings.TrimPrefix(taxCode, "TINIT-")
+}
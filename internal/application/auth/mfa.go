@@ -0,0 +1,288 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/pquerna/otp/totp"
+)
+
+// Second factor methods reported to the client when a login needs one.
+const (
+	SecondFactorTOTP         = "totp"
+	SecondFactorWebAuthn     = "webauthn"
+	SecondFactorRecoveryCode = "recovery_code"
+)
+
+// SecuritySettingsKey is the SchoolSettings key holding the second factor policy:
+//
+//	{"require_second_factor": ["Principal", "Secretary"]}
+const SecuritySettingsKey = "security"
+
+const (
+	recoveryCodeCount = 10
+	challengeTokenTTL = 5 * time.Minute
+)
+
+// Purposes of challenge tokens.
+const (
+	ChallengeSecondFactor = "second_factor" // Password verified, second factor pending
+	ChallengeEnrollment   = "enrollment"    // Password verified, school policy requires enrolling a second factor
+)
+
+var (
+	ErrSecondFactorRequired           = errors.New("second factor required")
+	ErrSecondFactorEnrollmentRequired = errors.New("second factor enrollment required")
+	ErrSecondFactorInvalid            = errors.New("invalid second factor")
+	ErrChallengeTokenInvalid          = errors.New("challenge token invalid or expired")
+	ErrSecurityPolicyInvalid          = errors.New("invalid security policy")
+)
+
+// SecondFactorChallenge is returned by Login when the password was correct but
+// the login cannot complete yet. Token is a short-lived challenge token: with
+// ErrSecondFactorRequired it is exchanged, together with one of Methods, for a
+// token pair; with ErrSecondFactorEnrollmentRequired it only allows enrolling
+// a second factor.
+type SecondFactorChallenge struct {
+	Token   string
+	Methods []string
+	Err     error
+}
+
+func (e *SecondFactorChallenge) Error() string { return e.Err.Error() }
+func (e *SecondFactorChallenge) Unwrap() error { return e.Err }
+
+// ChallengeClaims are the claims of a challenge token. Challenge tokens are
+// signed with a key derived from the JWT secret, so they are never accepted
+// where an access token is expected.
+type ChallengeClaims struct {
+	UserID   uint        `json:"user_id"`
+	SchoolID uint        `json:"school_id"`
+	Role     domain.Role `json:"role"`
+	Purpose  string      `json:"purpose"`
+	jwt.RegisteredClaims
+}
+
+func challengeKey(secret string) []byte {
+	return []byte("second-factor-challenge:" + secret)
+}
+
+func issueChallengeToken(user *domain.User, purpose, secret string) (string, error) {
+	claims := &ChallengeClaims{
+		UserID:   user.ID,
+		SchoolID: user.SchoolID,
+		Role:     user.Role,
+		Purpose:  purpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(challengeTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(challengeKey(secret))
+}
+
+// ParseChallengeToken validates a challenge token issued for the given purpose.
+func ParseChallengeToken(tokenString, purpose, secret string) (*ChallengeClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &ChallengeClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return challengeKey(secret), nil
+	})
+	if err != nil || !token.Valid {
+		return nil, ErrChallengeTokenInvalid
+	}
+	claims, ok := token.Claims.(*ChallengeClaims)
+	if !ok || claims.Purpose != purpose {
+		return nil, ErrChallengeTokenInvalid
+	}
+	return claims, nil
+}
+
+// SecondFactorPolicy is the per-school policy stored under SecuritySettingsKey.
+type SecondFactorPolicy struct {
+	RequiredRoles []domain.Role
+}
+
+func (p SecondFactorPolicy) Requires(role domain.Role) bool {
+	for _, r := range p.RequiredRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+var policyRoles = map[domain.Role]bool{
+	domain.RoleAdmin:     true,
+	domain.RolePrincipal: true,
+	domain.RoleSecretary: true,
+	domain.RoleTeacher:   true,
+	domain.RoleParent:    true,
+	domain.RoleStudent:   true,
+}
+
+// ParseSecondFactorPolicy reads the policy from a SchoolSettings value,
+// rejecting unknown roles.
+func ParseSecondFactorPolicy(value domain.JSONMap) (SecondFactorPolicy, error) {
+	var policy SecondFactorPolicy
+	raw, ok := value["require_second_factor"]
+	if !ok || raw == nil {
+		return policy, nil
+	}
+	var names []string
+	switch list := raw.(type) {
+	case []string:
+		names = list
+	case []interface{}:
+		for _, item := range list {
+			name, _ := item.(string)
+			names = append(names, name)
+		}
+	default:
+		return policy, fmt.Errorf("%w: require_second_factor must be a list of roles", ErrSecurityPolicyInvalid)
+	}
+	for _, name := range names {
+		role := domain.Role(name)
+		if !policyRoles[role] {
+			return policy, fmt.Errorf("%w: unknown role %q", ErrSecurityPolicyInvalid, name)
+		}
+		policy.RequiredRoles = append(policy.RequiredRoles, role)
+	}
+	return policy, nil
+}
+
+type schoolSettingsReader interface {
+	GetSchoolSettings(schoolID uint) ([]domain.SchoolSettings, error)
+}
+
+// MFAService manages second factors: TOTP, WebAuthn credentials (passkeys and
+// security keys) and recovery codes, and the school policy requiring them.
+type MFAService struct {
+	userRepo domain.UserRepository
+	repo     domain.MFARepository
+	settings schoolSettingsReader
+	webAuthn *webauthn.WebAuthn
+}
+
+func NewMFAService(userRepo domain.UserRepository, repo domain.MFARepository, settings schoolSettingsReader, wa *webauthn.WebAuthn) *MFAService {
+	return &MFAService{userRepo: userRepo, repo: repo, settings: settings, webAuthn: wa}
+}
+
+// Policy returns the second factor policy of a school. Schools without the
+// setting require nothing.
+func (s *MFAService) Policy(schoolID uint) (SecondFactorPolicy, error) {
+	if schoolID == 0 {
+		return SecondFactorPolicy{}, nil
+	}
+	settings, err := s.settings.GetSchoolSettings(schoolID)
+	if err != nil {
+		return SecondFactorPolicy{}, err
+	}
+	for _, setting := range settings {
+		if setting.Key == SecuritySettingsKey {
+			return ParseSecondFactorPolicy(setting.Value)
+		}
+	}
+	return SecondFactorPolicy{}, nil
+}
+
+// Methods lists the second factors the user has enrolled. Recovery codes are
+// only offered alongside another factor.
+func (s *MFAService) Methods(user *domain.User) ([]string, error) {
+	var methods []string
+	if user.TwoFAEnabled {
+		methods = append(methods, SecondFactorTOTP)
+	}
+	creds, err := s.repo.ListWebAuthnCredentials(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(creds) > 0 {
+		methods = append(methods, SecondFactorWebAuthn)
+	}
+	if len(methods) == 0 {
+		return nil, nil
+	}
+
+	codes, err := s.repo.CountUnusedRecoveryCodes(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if codes > 0 {
+		methods = append(methods, SecondFactorRecoveryCode)
+	}
+	return methods, nil
+}
+
+func (s *MFAService) VerifyTOTP(user *domain.User, code string) bool {
+	return user.TwoFAEnabled && user.TwoFASecret != "" && totp.Validate(code, user.TwoFASecret)
+}
+
+// UseRecoveryCode accepts each recovery code once.
+func (s *MFAService) UseRecoveryCode(user *domain.User, code string) error {
+	ok, err := s.repo.UseRecoveryCode(user.ID, HashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrSecondFactorInvalid
+	}
+	return nil
+}
+
+// GenerateRecoveryCodes replaces the user's recovery codes with a new set and
+// returns them in clear. They are not retrievable afterwards.
+func (s *MFAService) GenerateRecoveryCodes(userID uint) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	records := make([]domain.RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		records[i] = domain.RecoveryCode{
+			UserID:    userID,
+			CodeHash:  HashToken(normalizeRecoveryCode(code)),
+			CreatedAt: time.Now(),
+		}
+	}
+	if err := s.repo.ReplaceRecoveryCodes(userID, records); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// firstFactorEnabled issues recovery codes when the user enables their first
+// second factor. hadFactor is whether any factor was enrolled before.
+func (s *MFAService) firstFactorEnabled(userID uint, hadFactor bool) ([]string, error) {
+	if hadFactor {
+		return nil, nil
+	}
+	return s.GenerateRecoveryCodes(userID)
+}
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateRecoveryCode returns 10 base32 characters (50 bits) as "xxxxx-xxxxx".
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	s := strings.ToLower(recoveryEncoding.EncodeToString(b))[:10]
+	return s[:5] + "-" + s[5:], nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
@@ -0,0 +1,468 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testOrigin = "http://localhost:3000"
+
+// MockMFARepository for testing
+type MockMFARepository struct {
+	creds      []*domain.WebAuthnCredential
+	codes      []*domain.RecoveryCode
+	ceremonies map[string]*domain.WebAuthnCeremony
+}
+
+func NewMockMFARepository() *MockMFARepository {
+	return &MockMFARepository{ceremonies: make(map[string]*domain.WebAuthnCeremony)}
+}
+
+func (m *MockMFARepository) CreateWebAuthnCredential(cred *domain.WebAuthnCredential) error {
+	cred.ID = uint(len(m.creds) + 1)
+	m.creds = append(m.creds, cred)
+	return nil
+}
+
+func (m *MockMFARepository) ListWebAuthnCredentials(userID uint) ([]domain.WebAuthnCredential, error) {
+	var result []domain.WebAuthnCredential
+	for _, c := range m.creds {
+		if c.UserID == userID {
+			result = append(result, *c)
+		}
+	}
+	return result, nil
+}
+
+func (m *MockMFARepository) UpdateWebAuthnCredential(cred *domain.WebAuthnCredential) error {
+	for i, c := range m.creds {
+		if c.ID == cred.ID {
+			updated := *cred
+			m.creds[i] = &updated
+		}
+	}
+	return nil
+}
+
+func (m *MockMFARepository) DeleteWebAuthnCredential(userID, id uint) error {
+	for i, c := range m.creds {
+		if c.ID == id && c.UserID == userID {
+			m.creds = append(m.creds[:i], m.creds[i+1:]...)
+			return nil
+		}
+	}
+	return domain.ErrNotFound
+}
+
+func (m *MockMFARepository) ReplaceRecoveryCodes(userID uint, codes []domain.RecoveryCode) error {
+	var kept []*domain.RecoveryCode
+	for _, c := range m.codes {
+		if c.UserID != userID {
+			kept = append(kept, c)
+		}
+	}
+	for i := range codes {
+		kept = append(kept, &codes[i])
+	}
+	m.codes = kept
+	return nil
+}
+
+func (m *MockMFARepository) CountUnusedRecoveryCodes(userID uint) (int64, error) {
+	var n int64
+	for _, c := range m.codes {
+		if c.UserID == userID && c.UsedAt == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MockMFARepository) UseRecoveryCode(userID uint, codeHash string) (bool, error) {
+	for _, c := range m.codes {
+		if c.UserID == userID && c.CodeHash == codeHash && c.UsedAt == nil {
+			now := time.Now()
+			c.UsedAt = &now
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MockMFARepository) SaveCeremony(c *domain.WebAuthnCeremony) error {
+	m.ceremonies[c.ID] = c
+	return nil
+}
+
+func (m *MockMFARepository) ConsumeCeremony(id string) (*domain.WebAuthnCeremony, error) {
+	c, ok := m.ceremonies[id]
+	if !ok || time.Now().After(c.ExpiresAt) {
+		return nil, nil
+	}
+	delete(m.ceremonies, id)
+	return c, nil
+}
+
+type MockSchoolSettings struct {
+	settings map[uint][]domain.SchoolSettings
+}
+
+func (m *MockSchoolSettings) GetSchoolSettings(schoolID uint) ([]domain.SchoolSettings, error) {
+	return m.settings[schoolID], nil
+}
+
+func newTestMFAService(t *testing.T, users domain.UserRepository) (*MFAService, *MockMFARepository, *MockSchoolSettings) {
+	t.Helper()
+	wa, err := NewWebAuthn("localhost", "iRegistro", []string{testOrigin})
+	require.NoError(t, err)
+	repo := NewMockMFARepository()
+	settings := &MockSchoolSettings{settings: make(map[uint][]domain.SchoolSettings)}
+	return NewMFAService(users, repo, settings, wa), repo, settings
+}
+
+// virtualAuthenticator is a software platform authenticator producing "none"
+// attestations and ES256 assertions, like a phone or laptop passkey.
+type virtualAuthenticator struct {
+	key        *ecdsa.PrivateKey
+	credID     []byte
+	userHandle []byte
+	signCount  uint32
+}
+
+func newVirtualAuthenticator(t *testing.T) *virtualAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	credID := make([]byte, 16)
+	rand.Read(credID)
+	return &virtualAuthenticator{key: key, credID: credID}
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func clientData(t *testing.T, typ string, challenge []byte) []byte {
+	data, err := json.Marshal(map[string]interface{}{
+		"type":      typ,
+		"challenge": b64(challenge),
+		"origin":    testOrigin,
+	})
+	require.NoError(t, err)
+	return data
+}
+
+func (a *virtualAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpHash := sha256.Sum256([]byte("localhost"))
+	var buf bytes.Buffer
+	buf.Write(rpHash[:])
+	buf.WriteByte(flags)
+	binary.Write(&buf, binary.BigEndian, a.signCount)
+	buf.Write(attested)
+	return buf.Bytes()
+}
+
+// create answers navigator.credentials.create()
+func (a *virtualAuthenticator) create(t *testing.T, opts *WebAuthnOptions) []byte {
+	t.Helper()
+	creation := opts.PublicKey.(protocol.PublicKeyCredentialCreationOptions)
+	a.userHandle = []byte(creation.User.ID.(protocol.URLEncodedBase64))
+
+	coseKey, err := webauthncbor.Marshal(map[int]interface{}{
+		1: 2, 3: -7, -1: 1,
+		-2: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		-3: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	require.NoError(t, err)
+
+	var attested bytes.Buffer
+	attested.Write(make([]byte, 16)) // AAGUID
+	binary.Write(&attested, binary.BigEndian, uint16(len(a.credID)))
+	attested.Write(a.credID)
+	attested.Write(coseKey)
+
+	attObj, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(0x45, attested.Bytes()), // UP, UV, AT
+	})
+	require.NoError(t, err)
+
+	resp, err := json.Marshal(map[string]interface{}{
+		"id":    b64(a.credID),
+		"rawId": b64(a.credID),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    b64(clientData(t, "webauthn.create", creation.Challenge)),
+			"attestationObject": b64(attObj),
+			"transports":        []string{"internal"},
+		},
+	})
+	require.NoError(t, err)
+	return resp
+}
+
+// get answers navigator.credentials.get()
+func (a *virtualAuthenticator) get(t *testing.T, opts *WebAuthnOptions) []byte {
+	t.Helper()
+	request := opts.PublicKey.(protocol.PublicKeyCredentialRequestOptions)
+
+	a.signCount++
+	authData := a.authData(0x05, nil) // UP, UV
+	cd := clientData(t, "webauthn.get", request.Challenge)
+	cdHash := sha256.Sum256(cd)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), cdHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	require.NoError(t, err)
+
+	resp, err := json.Marshal(map[string]interface{}{
+		"id":    b64(a.credID),
+		"rawId": b64(a.credID),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    b64(cd),
+			"authenticatorData": b64(authData),
+			"signature":         b64(sig),
+			"userHandle":        b64(a.userHandle),
+		},
+	})
+	require.NoError(t, err)
+	return resp
+}
+
+func TestTOTPRecoveryCodes(t *testing.T) {
+	users := &MockUserRepository{users: make(map[string]*domain.User)}
+	mfa, mfaRepo, _ := newTestMFAService(t, users)
+	service := NewAuthService(users, &MockAuthRepository{}, mfa, "secret", 15*time.Minute, time.Hour)
+
+	hash, _ := HashPassword("password")
+	users.users["parent@example.com"] = &domain.User{ID: 3, Email: "parent@example.com", PasswordHash: hash, Role: domain.RoleParent, SchoolID: 1}
+
+	secret, _, err := service.Enable2FA(3)
+	require.NoError(t, err)
+	code, err := totp.GenerateCode(secret, time.Now())
+	require.NoError(t, err)
+
+	// Recovery codes are generated when 2FA is first enabled
+	codes, err := service.VerifyAndEnable2FA(3, code)
+	require.NoError(t, err)
+	require.Len(t, codes, 10)
+	for _, c := range mfaRepo.codes {
+		assert.NotContains(t, codes, c.CodeHash) // Stored hashed
+	}
+
+	_, _, err = service.Login("parent@example.com", "password", "", "127.0.0.1", "test-agent")
+	var challenge *SecondFactorChallenge
+	require.ErrorAs(t, err, &challenge)
+	assert.ErrorIs(t, err, ErrSecondFactorRequired)
+	assert.Equal(t, []string{SecondFactorTOTP, SecondFactorRecoveryCode}, challenge.Methods)
+
+	// The challenge token is not an access token
+	_, err = jwt.ParseWithClaims(challenge.Token, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return []byte("secret"), nil
+	})
+	assert.Error(t, err)
+
+	// Lost phone: a recovery code works once, in any format
+	_, pair, err := service.CompleteSecondFactor(challenge.Token, "", " "+codes[0]+" ", "127.0.0.1", "test-agent")
+	require.NoError(t, err)
+	assert.NotEmpty(t, pair.AccessToken)
+
+	_, _, err = service.CompleteSecondFactor(challenge.Token, "", codes[0], "127.0.0.1", "test-agent")
+	assert.ErrorIs(t, err, ErrSecondFactorInvalid)
+	assert.Equal(t, 1, users.users["parent@example.com"].FailedLogins)
+
+	// TOTP still works
+	code, _ = totp.GenerateCode(secret, time.Now())
+	_, _, err = service.CompleteSecondFactor(challenge.Token, code, "", "127.0.0.1", "test-agent")
+	assert.NoError(t, err)
+
+	// Regenerating invalidates the old codes
+	fresh, err := service.RegenerateRecoveryCodes(3)
+	require.NoError(t, err)
+	_, _, err = service.CompleteSecondFactor(challenge.Token, "", codes[1], "127.0.0.1", "test-agent")
+	assert.ErrorIs(t, err, ErrSecondFactorInvalid)
+	_, _, err = service.CompleteSecondFactor(challenge.Token, "", fresh[1], "127.0.0.1", "test-agent")
+	assert.NoError(t, err)
+}
+
+func TestSecondFactorPolicy(t *testing.T) {
+	users := &MockUserRepository{users: make(map[string]*domain.User)}
+	mfa, _, settings := newTestMFAService(t, users)
+	service := NewAuthService(users, &MockAuthRepository{}, mfa, "secret", 15*time.Minute, time.Hour)
+
+	settings.settings[1] = []domain.SchoolSettings{{
+		SchoolID: 1,
+		Key:      SecuritySettingsKey,
+		Value:    domain.JSONMap{"require_second_factor": []interface{}{"Principal", "Secretary"}},
+	}}
+
+	hash, _ := HashPassword("password")
+	users.users["preside@example.com"] = &domain.User{ID: 1, Email: "preside@example.com", PasswordHash: hash, Role: domain.RolePrincipal, SchoolID: 1}
+	users.users["prof@example.com"] = &domain.User{ID: 2, Email: "prof@example.com", PasswordHash: hash, Role: domain.RoleTeacher, SchoolID: 1}
+
+	// Principal without a second factor must enroll one first
+	_, pair, err := service.Login("preside@example.com", "password", "", "127.0.0.1", "test-agent")
+	assert.Nil(t, pair)
+	var challenge *SecondFactorChallenge
+	require.ErrorAs(t, err, &challenge)
+	assert.ErrorIs(t, err, ErrSecondFactorEnrollmentRequired)
+
+	claims, err := ParseChallengeToken(challenge.Token, ChallengeEnrollment, "secret")
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), claims.UserID)
+
+	// The enrollment token cannot complete a login
+	_, _, err = service.CompleteSecondFactor(challenge.Token, "", "whatever", "127.0.0.1", "test-agent")
+	assert.ErrorIs(t, err, ErrChallengeTokenInvalid)
+
+	// Teachers are not covered by the policy
+	_, pair, err = service.Login("prof@example.com", "password", "", "127.0.0.1", "test-agent")
+	require.NoError(t, err)
+	assert.NotEmpty(t, pair.AccessToken)
+
+	_, err = ParseSecondFactorPolicy(domain.JSONMap{"require_second_factor": []interface{}{"Janitor"}})
+	assert.ErrorIs(t, err, ErrSecurityPolicyInvalid)
+}
+
+func TestWebAuthn(t *testing.T) {
+	setup := func(t *testing.T, role domain.Role) (*AuthService, *MFAService, *MockMFARepository, *MockAuthRepository, *domain.User) {
+		users := &MockUserRepository{users: make(map[string]*domain.User)}
+		mfa, mfaRepo, _ := newTestMFAService(t, users)
+		authRepo := &MockAuthRepository{}
+		service := NewAuthService(users, authRepo, mfa, "secret", 15*time.Minute, time.Hour)
+		user := &domain.User{ID: 9, Email: "user@example.com", Role: role, SchoolID: 1, FirstName: "Maria", LastName: "Verdi"}
+		users.users[user.Email] = user
+		return service, mfa, mfaRepo, authRepo, user
+	}
+	register := func(t *testing.T, mfa *MFAService, userID uint, device *virtualAuthenticator) ([]string, error) {
+		opts, err := mfa.BeginRegistration(userID)
+		require.NoError(t, err)
+		_, codes, err := mfa.FinishRegistration(userID, opts.SessionID, "Laptop", device.create(t, opts))
+		return codes, err
+	}
+
+	t.Run("Multiple devices, recovery codes with the first", func(t *testing.T) {
+		_, mfa, mfaRepo, _, user := setup(t, domain.RoleParent)
+
+		codes, err := register(t, mfa, user.ID, newVirtualAuthenticator(t))
+		require.NoError(t, err)
+		assert.Len(t, codes, 10)
+
+		codes, err = register(t, mfa, user.ID, newVirtualAuthenticator(t))
+		require.NoError(t, err)
+		assert.Empty(t, codes)
+
+		creds, _ := mfa.ListCredentials(user.ID)
+		assert.Len(t, creds, 2)
+		assert.Equal(t, "Laptop", creds[0].Name)
+		assert.Equal(t, "internal", creds[0].Transports)
+
+		// Parents are asked for a discoverable credential but not forced
+		opts, err := mfa.BeginRegistration(user.ID)
+		require.NoError(t, err)
+		selection := opts.PublicKey.(protocol.PublicKeyCredentialCreationOptions).AuthenticatorSelection
+		assert.Equal(t, protocol.ResidentKeyRequirementPreferred, selection.ResidentKey)
+		assert.Len(t, opts.PublicKey.(protocol.PublicKeyCredentialCreationOptions).CredentialExcludeList, 2)
+
+		require.NoError(t, mfa.DeleteCredential(user.ID, mfaRepo.creds[0].ID))
+		assert.ErrorIs(t, mfa.DeleteCredential(99, mfaRepo.creds[0].ID), domain.ErrNotFound)
+	})
+
+	t.Run("Security key as second factor", func(t *testing.T) {
+		service, mfa, _, _, user := setup(t, domain.RoleParent)
+		hash, _ := HashPassword("password")
+		user.PasswordHash = hash
+		device := newVirtualAuthenticator(t)
+		_, err := register(t, mfa, user.ID, device)
+		require.NoError(t, err)
+
+		_, _, err = service.Login(user.Email, "password", "", "127.0.0.1", "test-agent")
+		var challenge *SecondFactorChallenge
+		require.ErrorAs(t, err, &challenge)
+		assert.Equal(t, []string{SecondFactorWebAuthn, SecondFactorRecoveryCode}, challenge.Methods)
+
+		opts, err := service.BeginSecondFactorWebAuthn(challenge.Token)
+		require.NoError(t, err)
+		response := device.get(t, opts)
+		_, pair, err := service.CompleteSecondFactorWebAuthn(challenge.Token, opts.SessionID, response, "127.0.0.1", "test-agent")
+		require.NoError(t, err)
+		assert.NotEmpty(t, pair.AccessToken)
+
+		// The ceremony is single use
+		_, _, err = service.CompleteSecondFactorWebAuthn(challenge.Token, opts.SessionID, response, "127.0.0.1", "test-agent")
+		assert.ErrorIs(t, err, ErrWebAuthnCeremonyInvalid)
+
+		// A parent cannot skip the password
+		opts, err = service.BeginPasskeyLogin()
+		require.NoError(t, err)
+		_, _, err = service.PasskeyLogin(opts.SessionID, device.get(t, opts), "127.0.0.1", "test-agent")
+		assert.ErrorIs(t, err, ErrPasskeyLoginNotAllowed)
+	})
+
+	t.Run("Passkey-only login for staff", func(t *testing.T) {
+		service, mfa, mfaRepo, authRepo, user := setup(t, domain.RoleSecretary)
+		device := newVirtualAuthenticator(t)
+
+		opts, err := mfa.BeginRegistration(user.ID)
+		require.NoError(t, err)
+		selection := opts.PublicKey.(protocol.PublicKeyCredentialCreationOptions).AuthenticatorSelection
+		assert.Equal(t, protocol.ResidentKeyRequirementRequired, selection.ResidentKey)
+		assert.Equal(t, protocol.VerificationRequired, selection.UserVerification)
+		_, _, err = mfa.FinishRegistration(user.ID, opts.SessionID, "", device.create(t, opts))
+		require.NoError(t, err)
+		assert.Equal(t, "Passkey", mfaRepo.creds[0].Name)
+
+		opts, err = service.BeginPasskeyLogin()
+		require.NoError(t, err)
+		loggedIn, pair, err := service.PasskeyLogin(opts.SessionID, device.get(t, opts), "127.0.0.1", "test-agent")
+		require.NoError(t, err)
+		assert.Equal(t, user.ID, loggedIn.ID)
+		assert.Equal(t, uint32(1), mfaRepo.creds[0].SignCount)
+		assert.NotNil(t, mfaRepo.creds[0].LastUsedAt)
+
+		parsed, err := jwt.ParseWithClaims(pair.AccessToken, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
+			return []byte("secret"), nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, domain.AuthMethodPasskey, parsed.Claims.(*CustomClaims).AuthMethod)
+
+		last := authRepo.auditLogs[len(authRepo.auditLogs)-1]
+		assert.True(t, last.Success)
+		assert.Equal(t, domain.AuthMethodPasskey, last.AuthMethod)
+
+		// A cloned authenticator replays an old counter
+		device.signCount = 0
+		opts, err = service.BeginPasskeyLogin()
+		require.NoError(t, err)
+		_, _, err = service.PasskeyLogin(opts.SessionID, device.get(t, opts), "127.0.0.1", "test-agent")
+		assert.ErrorIs(t, err, ErrSecondFactorInvalid)
+		assert.False(t, authRepo.auditLogs[len(authRepo.auditLogs)-1].Success)
+
+		// Assertions from an unknown key are rejected
+		opts, err = service.BeginPasskeyLogin()
+		require.NoError(t, err)
+		stranger := newVirtualAuthenticator(t)
+		stranger.credID, stranger.userHandle = device.credID, device.userHandle
+		_, _, err = service.PasskeyLogin(opts.SessionID, stranger.get(t, opts), "127.0.0.1", "test-agent")
+		assert.ErrorIs(t, err, ErrSecondFactorInvalid)
+	})
+}
+
+func newMFA(t *testing.T, users domain.UserRepository) *MFAService {
+	mfa, _, _ := newTestMFAService(t, users)
+	return mfa
+}
@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"go.uber.org/zap"
+)
+
+const (
+	resetTokenTTL = 30 * time.Minute
+	// resetRequestsPerHour caps the reset emails sent to one account, so the
+	// endpoint cannot be used to flood a mailbox.
+	resetRequestsPerHour = 3
+	resetSendTimeout     = 30 * time.Second
+	// inviteTokenTTL leaves the users created by imports a week to choose
+	// their password.
+	inviteTokenTTL = 7 * 24 * time.Hour
+)
+
+var ErrResetTokenInvalid = errors.New("invalid or expired reset token")
+
+// dummyVerifierHash is compared against when the selector is unknown, so that
+// an unknown token takes as long to reject as a wrong one.
+var dummyVerifierHash = HashToken("unknown-reset-token")
+
+// PasswordResetService issues single-use reset links by email and completes
+// the reset, revoking every session of the user.
+type PasswordResetService struct {
+	userRepo domain.UserRepository
+	authRepo domain.AuthRepository
+	mailer   domain.Mailer
+	resetURL string // Frontend page receiving the token, e.g. https://registro.example.it/reset-password
+}
+
+func NewPasswordResetService(u domain.UserRepository, a domain.AuthRepository, mailer domain.Mailer, resetURL string) *PasswordResetService {
+	return &PasswordResetService{userRepo: u, authRepo: a, mailer: mailer, resetURL: resetURL}
+}
+
+// RequestReset emails a reset link to the user. It returns nil when the email
+// is unknown or the account reached its hourly limit, so that callers cannot
+// tell whether an account exists. The email is sent in the background.
+func (s *PasswordResetService) RequestReset(email, ip string) error {
+	user, err := s.userRepo.FindByEmail(email)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return nil
+	}
+
+	recent, err := s.authRepo.CountPasswordResetTokens(user.ID, time.Now().Add(-time.Hour))
+	if err != nil {
+		return err
+	}
+	if recent >= resetRequestsPerHour {
+		zap.L().Warn("Password reset rate limited", zap.Uint("user_id", user.ID), zap.String("ip", ip))
+		return nil
+	}
+
+	token, err := s.issueToken(user, ip, resetTokenTTL)
+	if err != nil {
+		return err
+	}
+	go s.send(user, s.resetMessage(user, token))
+	return nil
+}
+
+// issueToken stores a new reset token of user and returns it.
+func (s *PasswordResetService) issueToken(user *domain.User, ip string, ttl time.Duration) (string, error) {
+	selector, verifier, err := generateResetToken()
+	if err != nil {
+		return "", err
+	}
+	if err := s.authRepo.CreatePasswordResetToken(&domain.PasswordResetToken{
+		UserID:       user.ID,
+		Selector:     selector,
+		VerifierHash: HashToken(verifier),
+		IPAddress:    ip,
+		ExpiresAt:    time.Now().Add(ttl),
+		CreatedAt:    time.Now(),
+	}); err != nil {
+		return "", err
+	}
+	return selector + "." + verifier, nil
+}
+
+// Invite emails a new user a link to choose the password, valid for a week.
+// Unlike RequestReset it is not rate limited and sends the email before
+// returning, for callers running in the background.
+func (s *PasswordResetService) Invite(ctx context.Context, user *domain.User) error {
+	token, err := s.issueToken(user, "", inviteTokenTTL)
+	if err != nil {
+		return err
+	}
+	return s.mailer.Send(ctx, s.inviteMessage(user, token))
+}
+
+// Reset sets a new password if token is a valid, unused token of the user
+// owning email, then revokes all the user's sessions.
+func (s *PasswordResetService) Reset(email, token, newPassword string) error {
+	selector, verifier, _ := strings.Cut(token, ".")
+
+	stored, err := s.authRepo.GetPasswordResetToken(selector)
+	if err != nil {
+		return err
+	}
+	expected := dummyVerifierHash
+	if stored != nil {
+		expected = stored.VerifierHash
+	}
+	match := subtle.ConstantTimeCompare([]byte(HashToken(verifier)), []byte(expected)) == 1
+	if stored == nil || !match || stored.UsedAt != nil || time.Now().After(stored.ExpiresAt) {
+		return ErrResetTokenInvalid
+	}
+
+	user, err := s.userRepo.FindByEmail(email)
+	if err != nil {
+		return err
+	}
+	if user == nil || user.ID != stored.UserID {
+		return ErrResetTokenInvalid
+	}
+
+	// Consume the token before changing the password, so that two concurrent
+	// requests cannot both succeed
+	ok, err := s.authRepo.UsePasswordResetToken(stored.ID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrResetTokenInvalid
+	}
+
+	hash, err := HashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = hash
+	user.FailedLogins = 0
+	user.LockedUntil = nil
+	if err := s.userRepo.Update(user); err != nil {
+		return err
+	}
+
+	return s.authRepo.RevokeUserSessions(user.ID)
+}
+
+func (s *PasswordResetService) resetMessage(user *domain.User, token string) domain.EmailMessage {
+	link := s.resetURL + "?" + url.Values{"token": {token}, "email": {user.Email}}.Encode()
+	greeting := "Hello"
+	if user.FirstName != "" {
+		greeting += " " + user.FirstName
+	}
+
+	return domain.EmailMessage{
+		To:      []string{user.Email},
+		Subject: "iRegistro - Password reset",
+		TextBody: fmt.Sprintf("%s,\n\n"+
+			"we received a request to reset the password of your iRegistro account.\n"+
+			"Open the link below within %d minutes to choose a new password:\n\n%s\n\n"+
+			"If you did not ask for a reset, ignore this email: your password will not change.\n",
+			greeting, int(resetTokenTTL.Minutes()), link),
+	}
+}
+
+func (s *PasswordResetService) inviteMessage(user *domain.User, token string) domain.EmailMessage {
+	link := s.resetURL + "?" + url.Values{"token": {token}, "email": {user.Email}}.Encode()
+	greeting := "Hello"
+	if user.FirstName != "" {
+		greeting += " " + user.FirstName
+	}
+
+	return domain.EmailMessage{
+		To:      []string{user.Email},
+		Subject: "iRegistro - Your account",
+		TextBody: fmt.Sprintf("%s,\n\n"+
+			"your school created an iRegistro account for %s.\n"+
+			"Open the link below within %d days to choose your password:\n\n%s\n\n"+
+			"Once the link expires, ask for a new one from the password reset page.\n",
+			greeting, user.Email, int(inviteTokenTTL.Hours()/24), link),
+	}
+}
+
+func (s *PasswordResetService) send(user *domain.User, msg domain.EmailMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), resetSendTimeout)
+	defer cancel()
+	if err := s.mailer.Send(ctx, msg); err != nil {
+		zap.L().Error("Failed to send password reset email", zap.Uint("user_id", user.ID), zap.Error(err))
+	}
+}
+
+// generateResetToken returns a 96 bit selector and a 256 bit verifier.
+func generateResetToken() (string, string, error) {
+	selector := make([]byte, 12)
+	if _, err := rand.Read(selector); err != nil {
+		return "", "", err
+	}
+	verifier, err := generateOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(selector), verifier, nil
+}
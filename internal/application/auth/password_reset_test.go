@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type MockMailer struct {
+	sent chan domain.EmailMessage
+}
+
+func (m *MockMailer) Send(ctx context.Context, msg domain.EmailMessage) error {
+	m.sent <- msg
+	return nil
+}
+
+// resetToken waits for the reset email and extracts the token from its link.
+func (m *MockMailer) resetToken(t *testing.T) string {
+	t.Helper()
+	select {
+	case msg := <-m.sent:
+		for _, field := range strings.Fields(msg.TextBody) {
+			if strings.HasPrefix(field, "https://registro.example.it/reset-password?") {
+				link, err := url.Parse(field)
+				require.NoError(t, err)
+				return link.Query().Get("token")
+			}
+		}
+		t.Fatalf("no reset link in %q", msg.TextBody)
+	case <-time.After(time.Second):
+		t.Fatal("reset email not sent")
+	}
+	return ""
+}
+
+func TestPasswordReset(t *testing.T) {
+	users := &MockUserRepository{users: make(map[string]*domain.User)}
+	authRepo := &MockAuthRepository{}
+	mailer := &MockMailer{sent: make(chan domain.EmailMessage, 10)}
+	service := NewPasswordResetService(users, authRepo, mailer, "https://registro.example.it/reset-password")
+	tokens := NewTokenService(authRepo, "secret", 15*time.Minute, time.Hour)
+
+	hash, _ := HashPassword("old_password")
+	user := &domain.User{ID: 1, Email: "reset@example.com", PasswordHash: hash, Role: domain.RoleParent, SchoolID: 1}
+	users.users[user.Email] = user
+	users.users["other@example.com"] = &domain.User{ID: 2, Email: "other@example.com", Role: domain.RoleParent, SchoolID: 1}
+
+	// Unknown emails look the same to the caller but send nothing
+	require.NoError(t, service.RequestReset("nobody@example.com", "127.0.0.1"))
+	assert.Empty(t, mailer.sent)
+
+	require.NoError(t, service.RequestReset(user.Email, "127.0.0.1"))
+	token := mailer.resetToken(t)
+	selector, verifier, ok := strings.Cut(token, ".")
+	require.True(t, ok)
+	assert.NotContains(t, token, user.Email)
+	assert.NotEqual(t, verifier, authRepo.resetTokens[0].VerifierHash) // Stored hashed
+
+	// A new request invalidates the previous link
+	require.NoError(t, service.RequestReset(user.Email, "127.0.0.1"))
+	assert.ErrorIs(t, service.Reset(user.Email, token, "new_password"), ErrResetTokenInvalid)
+	token = mailer.resetToken(t)
+	selector, _, _ = strings.Cut(token, ".")
+
+	assert.ErrorIs(t, service.Reset(user.Email, selector+".wrong", "new_password"), ErrResetTokenInvalid)
+	assert.ErrorIs(t, service.Reset(user.Email, "unknown."+verifier, "new_password"), ErrResetTokenInvalid)
+	assert.ErrorIs(t, service.Reset(user.Email, "", "new_password"), ErrResetTokenInvalid)
+	// Bound to the user who asked for it
+	assert.ErrorIs(t, service.Reset("other@example.com", token, "new_password"), ErrResetTokenInvalid)
+
+	pair, err := tokens.Issue(user, "127.0.0.1", "test-agent")
+	require.NoError(t, err)
+
+	require.NoError(t, service.Reset(user.Email, token, "new_password"))
+	assert.NoError(t, CheckPassword("new_password", user.PasswordHash))
+
+	// Every session was revoked
+	_, err = tokens.ValidateRefreshToken(pair.RefreshToken)
+	assert.ErrorIs(t, err, ErrRefreshTokenInvalid)
+	assert.Empty(t, authRepo.sessions)
+
+	// Single use
+	assert.ErrorIs(t, service.Reset(user.Email, token, "another_password"), ErrResetTokenInvalid)
+
+	// Hourly limit per account: the third request was the last one sent
+	require.NoError(t, service.RequestReset(user.Email, "127.0.0.1"))
+	mailer.resetToken(t)
+	require.NoError(t, service.RequestReset(user.Email, "127.0.0.1"))
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, mailer.sent)
+}
+
+func TestPasswordResetExpired(t *testing.T) {
+	users := &MockUserRepository{users: make(map[string]*domain.User)}
+	authRepo := &MockAuthRepository{}
+	mailer := &MockMailer{sent: make(chan domain.EmailMessage, 1)}
+	service := NewPasswordResetService(users, authRepo, mailer, "https://registro.example.it/reset-password")
+	users.users["reset@example.com"] = &domain.User{ID: 1, Email: "reset@example.com", Role: domain.RoleParent}
+
+	require.NoError(t, service.RequestReset("reset@example.com", "127.0.0.1"))
+	token := mailer.resetToken(t)
+	authRepo.resetTokens[0].ExpiresAt = time.Now().Add(-time.Second)
+
+	assert.ErrorIs(t, service.Reset("reset@example.com", token, "new_password"), ErrResetTokenInvalid)
+}
+
+func TestInvite(t *testing.T) {
+	users := &MockUserRepository{users: make(map[string]*domain.User)}
+	authRepo := &MockAuthRepository{}
+	mailer := &MockMailer{sent: make(chan domain.EmailMessage, 1)}
+	service := NewPasswordResetService(users, authRepo, mailer, "https://registro.example.it/reset-password")
+	user := &domain.User{ID: 1, Email: "new@example.com", FirstName: "Anna", PasswordHash: "!invited", Role: domain.RoleTeacher}
+	users.users[user.Email] = user
+
+	// Sent before returning
+	require.NoError(t, service.Invite(context.Background(), user))
+	require.Len(t, mailer.sent, 1)
+	token := mailer.resetToken(t)
+	assert.WithinDuration(t, time.Now().Add(inviteTokenTTL), authRepo.resetTokens[0].ExpiresAt, time.Minute)
+	assert.Error(t, CheckPassword("", user.PasswordHash), "no password before the invitation is accepted")
+
+	require.NoError(t, service.Reset(user.Email, token, "chosen_password"))
+	assert.NoError(t, CheckPassword("chosen_password", user.PasswordHash))
+}
@@ -1,19 +1,23 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/k/iRegistro/internal/domain"
 	"github.com/pquerna/otp/totp"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type CustomClaims struct {
-	UserID   uint        `json:"user_id"`
-	SchoolID uint        `json:"school_id"`
-	Role     domain.Role `json:"role"`
+	UserID     uint        `json:"user_id"`
+	SchoolID   uint        `json:"school_id"`
+	Role       domain.Role `json:"role"`
+	AuthMethod string      `json:"amr,omitempty"`
+	AuthLevel  SPIDLevel   `json:"acr,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -27,15 +31,22 @@ func CheckPassword(password, hash string) error {
 }
 
 func GenerateAccessToken(user *domain.User, secret string, duration time.Duration) (string, *CustomClaims, error) {
+	return generateAccessToken(user, Assurance{Method: domain.AuthMethodEmail}, secret, duration)
+}
+
+func generateAccessToken(user *domain.User, a Assurance, secret string, duration time.Duration) (string, *CustomClaims, error) {
 	expirationTime := time.Now().Add(duration)
 	claims := &CustomClaims{
-		UserID:   user.ID,
-		SchoolID: user.SchoolID,
-		Role:     user.Role,
+		UserID:     user.ID,
+		SchoolID:   user.SchoolID,
+		Role:       user.Role,
+		AuthMethod: a.Method,
+		AuthLevel:  a.Level,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Subject:   user.Email,
+			ID:        uuid.NewString(),
 		},
 	}
 
@@ -49,23 +60,29 @@ func GenerateAccessToken(user *domain.User, secret string, duration time.Duratio
 }
 
 type AuthService struct {
-	userRepo        domain.UserRepository
-	authRepo        domain.AuthRepository
-	jwtSecret       string
-	accessDuration  time.Duration
-	refreshDuration time.Duration
+	userRepo  domain.UserRepository
+	authRepo  domain.AuthRepository
+	mfa       *MFAService
+	tokens    *TokenService
+	jwtSecret string
 }
 
-func NewAuthService(u domain.UserRepository, a domain.AuthRepository, secret string, accessDur, refreshDur time.Duration) *AuthService {
+func NewAuthService(u domain.UserRepository, a domain.AuthRepository, mfa *MFAService, secret string, accessDur, refreshDur time.Duration) *AuthService {
 	return &AuthService{
-		userRepo:        u,
-		authRepo:        a,
-		jwtSecret:       secret,
-		accessDuration:  accessDur,
-		refreshDuration: refreshDur,
+		userRepo:  u,
+		authRepo:  a,
+		mfa:       mfa,
+		tokens:    NewTokenService(a, secret, accessDur, refreshDur),
+		jwtSecret: secret,
 	}
 }
 
+// Tokens returns the token service used by this AuthService, so federated
+// login flows (SPID, CIE) can issue tokens the same way.
+func (s *AuthService) Tokens() *TokenService {
+	return s.tokens
+}
+
 func (s *AuthService) Register(user *domain.User, password string) error {
 	hash, err := HashPassword(password)
 	if err != nil {
@@ -75,41 +92,167 @@ func (s *AuthService) Register(user *domain.User, password string) error {
 	return s.userRepo.Create(user)
 }
 
-func (s *AuthService) Login(email, password, otpCode, ip, userAgent string) (*domain.User, string, string, error) {
+// Login checks the password and, when the user has a second factor or the
+// school policy requires one, returns a *SecondFactorChallenge instead of
+// tokens. A TOTP code may still be passed directly as otpCode.
+func (s *AuthService) Login(email, password, otpCode, ip, userAgent string) (*domain.User, *TokenPair, error) {
 	user, err := s.userRepo.FindByEmail(email)
 	if err != nil {
-		return nil, "", "", err
+		return nil, nil, err
 	}
 	if user == nil {
-		return nil, "", "", domain.ErrInvalidCredentials
+		return nil, nil, domain.ErrInvalidCredentials
 	}
 
-	// Check Lockout
-	if user.LockedUntil != nil && time.Now().Before(*user.LockedUntil) {
-		return nil, "", "", fmt.Errorf("account locked until %s", user.LockedUntil.Format(time.RFC3339))
+	if err := checkLockout(user); err != nil {
+		return nil, nil, err
 	}
 
 	if err := CheckPassword(password, user.PasswordHash); err != nil {
-		// Increment Failed Attempts
-		user.FailedLogins++
-		if user.FailedLogins >= 5 {
-			lockTime := time.Now().Add(15 * time.Minute)
-			user.LockedUntil = &lockTime
-		}
-		s.userRepo.Update(user)
-		return nil, "", "", domain.ErrInvalidCredentials
+		s.registerFailedLogin(user)
+		return nil, nil, domain.ErrInvalidCredentials
 	}
 
 	// Check 2FA
-	if user.TwoFAEnabled {
+	methods, err := s.mfa.Methods(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(methods) > 0 {
 		if otpCode == "" {
-			return nil, "", "", fmt.Errorf("2fa required") // Should define proper error
+			return nil, nil, s.challenge(user, ChallengeSecondFactor, methods, ErrSecondFactorRequired)
+		}
+		if !s.mfa.VerifyTOTP(user, otpCode) {
+			s.registerFailedLogin(user)
+			return nil, nil, ErrSecondFactorInvalid
+		}
+	} else {
+		policy, err := s.mfa.Policy(user.SchoolID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if policy.Requires(user.Role) {
+			return nil, nil, s.challenge(user, ChallengeEnrollment, nil, ErrSecondFactorEnrollmentRequired)
+		}
+	}
+
+	return s.completeLogin(user, ip, userAgent)
+}
+
+// CompleteSecondFactor finishes a login started by Login with a TOTP code or,
+// if the authenticator is lost, a recovery code.
+func (s *AuthService) CompleteSecondFactor(challengeToken, otpCode, recoveryCode, ip, userAgent string) (*domain.User, *TokenPair, error) {
+	user, err := s.challengedUser(challengeToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case otpCode != "":
+		if !s.mfa.VerifyTOTP(user, otpCode) {
+			err = ErrSecondFactorInvalid
+		}
+	case recoveryCode != "":
+		err = s.mfa.UseRecoveryCode(user, recoveryCode)
+	default:
+		err = ErrSecondFactorInvalid
+	}
+	if err != nil {
+		if errors.Is(err, ErrSecondFactorInvalid) {
+			s.registerFailedLogin(user)
+		}
+		return nil, nil, err
+	}
+
+	return s.completeLogin(user, ip, userAgent)
+}
+
+// BeginSecondFactorWebAuthn returns the assertion options for a login started by Login.
+func (s *AuthService) BeginSecondFactorWebAuthn(challengeToken string) (*WebAuthnOptions, error) {
+	user, err := s.challengedUser(challengeToken)
+	if err != nil {
+		return nil, err
+	}
+	return s.mfa.BeginAssertion(user.ID)
+}
+
+// CompleteSecondFactorWebAuthn finishes a login with a security key or passkey.
+func (s *AuthService) CompleteSecondFactorWebAuthn(challengeToken, sessionID string, response []byte, ip, userAgent string) (*domain.User, *TokenPair, error) {
+	user, err := s.challengedUser(challengeToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.mfa.FinishAssertion(user.ID, sessionID, response); err != nil {
+		if errors.Is(err, ErrSecondFactorInvalid) {
+			s.registerFailedLogin(user)
 		}
-		if !totp.Validate(otpCode, user.TwoFASecret) {
-			return nil, "", "", fmt.Errorf("invalid 2fa code")
+		return nil, nil, err
+	}
+	return s.completeLogin(user, ip, userAgent)
+}
+
+// BeginPasskeyLogin starts a passwordless login.
+func (s *AuthService) BeginPasskeyLogin() (*WebAuthnOptions, error) {
+	return s.mfa.BeginPasskeyLogin()
+}
+
+// PasskeyLogin logs a staff member in with a passkey alone. The passkey is
+// verified with the device PIN or biometrics, so it satisfies the second
+// factor policy by itself.
+func (s *AuthService) PasskeyLogin(sessionID string, response []byte, ip, userAgent string) (*domain.User, *TokenPair, error) {
+	lc := LoginContext{IPAddress: ip, UserAgent: userAgent}
+
+	user, err := s.mfa.FinishPasskeyLogin(sessionID, response)
+	if err != nil {
+		var userID *uint
+		if user != nil {
+			userID = &user.ID
 		}
+		recordAuthAttempt(s.authRepo, userID, domain.AuthMethodPasskey, "", lc, err.Error())
+		return nil, nil, err
+	}
+	if err := checkLockout(user); err != nil {
+		recordAuthAttempt(s.authRepo, &user.ID, domain.AuthMethodPasskey, "", lc, "account locked")
+		return nil, nil, err
+	}
+
+	pair, err := s.tokens.IssueWithAssurance(user, Assurance{Method: domain.AuthMethodPasskey}, ip, userAgent)
+	if err != nil {
+		return nil, nil, err
 	}
+	recordAuthAttempt(s.authRepo, &user.ID, domain.AuthMethodPasskey, "", lc, "")
+	return user, pair, nil
+}
 
+func (s *AuthService) challenge(user *domain.User, purpose string, methods []string, reason error) error {
+	token, err := issueChallengeToken(user, purpose, s.jwtSecret)
+	if err != nil {
+		return err
+	}
+	return &SecondFactorChallenge{Token: token, Methods: methods, Err: reason}
+}
+
+// challengedUser returns the user of a second factor challenge token, if the
+// account is not locked meanwhile.
+func (s *AuthService) challengedUser(challengeToken string) (*domain.User, error) {
+	claims, err := ParseChallengeToken(challengeToken, ChallengeSecondFactor, s.jwtSecret)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.userRepo.FindByID(claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrChallengeTokenInvalid
+	}
+	if err := checkLockout(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *AuthService) completeLogin(user *domain.User, ip, userAgent string) (*domain.User, *TokenPair, error) {
 	// Reset Failed Attempts on success
 	if user.FailedLogins > 0 || user.LockedUntil != nil {
 		user.FailedLogins = 0
@@ -117,32 +260,58 @@ func (s *AuthService) Login(email, password, otpCode, ip, userAgent string) (*do
 		s.userRepo.Update(user)
 	}
 
-	// Generate Access Token
-	accessToken, _, err := GenerateAccessToken(user, s.jwtSecret, s.accessDuration)
+	pair, err := s.tokens.Issue(user, ip, userAgent)
 	if err != nil {
-		return nil, "", "", err
+		return nil, nil, err
+	}
+
+	return user, pair, nil
+}
+
+func checkLockout(user *domain.User) error {
+	if user.LockedUntil != nil && time.Now().Before(*user.LockedUntil) {
+		return fmt.Errorf("account locked until %s", user.LockedUntil.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// registerFailedLogin counts a wrong password or second factor; five in a row
+// lock the account for 15 minutes.
+func (s *AuthService) registerFailedLogin(user *domain.User) {
+	user.FailedLogins++
+	if user.FailedLogins >= 5 {
+		lockTime := time.Now().Add(15 * time.Minute)
+		user.LockedUntil = &lockTime
 	}
+	s.userRepo.Update(user)
+}
 
-	// Generate Refresh Token (simplified for now, usually a random string)
-	refreshToken, _, err := GenerateAccessToken(user, s.jwtSecret, s.refreshDuration)
-	// Ideally Refresh Token is opaque, but for simplicity reusing JWT or random hex
+// Refresh exchanges a valid refresh token for a new token pair. The presented
+// token is revoked (rotation), so each refresh token can be used only once.
+func (s *AuthService) Refresh(refreshToken, ip, userAgent string) (*domain.User, *TokenPair, error) {
+	stored, err := s.tokens.ValidateRefreshToken(refreshToken)
 	if err != nil {
-		return nil, "", "", err
+		return nil, nil, err
 	}
 
-	// Store Session
-	session := &domain.Session{
-		UserID:    user.ID,
-		TokenHash: accessToken, // Or hash of it
-		ExpiresAt: time.Now().Add(s.accessDuration),
-		IPAddress: ip,
-		UserAgent: userAgent,
+	user, err := s.userRepo.FindByID(stored.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user == nil {
+		return nil, nil, ErrRefreshTokenInvalid
 	}
-	if err := s.authRepo.CreateSession(session); err != nil {
-		return nil, "", "", err
+
+	if err := s.tokens.Revoke(refreshToken); err != nil {
+		return nil, nil, err
 	}
 
-	return user, accessToken, refreshToken, nil
+	// Keep the assurance of the original login across rotations
+	pair, err := s.tokens.IssueWithAssurance(user, assuranceOf(stored), ip, userAgent)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, pair, nil
 }
 
 // 2FA Methods
@@ -177,77 +346,54 @@ func (s *AuthService) Enable2FA(userID uint) (string, string, error) {
 	return key.Secret(), key.URL(), nil
 }
 
-func (s *AuthService) VerifyAndEnable2FA(userID uint, code string) error {
+// VerifyAndEnable2FA confirms the TOTP secret. If TOTP is the user's first
+// second factor, recovery codes are generated and returned once.
+func (s *AuthService) VerifyAndEnable2FA(userID uint, code string) ([]string, error) {
 	user, err := s.userRepo.FindByID(userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if user == nil {
-		return domain.ErrUserNotFound
+		return nil, domain.ErrUserNotFound
 	}
 
 	if !totp.Validate(code, user.TwoFASecret) {
-		return fmt.Errorf("invalid OTP code")
+		return nil, fmt.Errorf("invalid OTP code")
 	}
 
-	user.TwoFAEnabled = true
-	return s.userRepo.Update(user)
-}
-
-func (s *AuthService) Verify2FALogin(userID uint, code string) error {
-	user, err := s.userRepo.FindByID(userID)
+	methods, err := s.mfa.Methods(user)
 	if err != nil {
-		return err
-	}
-	if user == nil {
-		return domain.ErrUserNotFound
+		return nil, err
 	}
 
-	if !user.TwoFAEnabled {
-		return nil // Or error? Logic depends on flow.
-	}
-
-	if !totp.Validate(code, user.TwoFASecret) {
-		return fmt.Errorf("invalid OTP code")
+	user.TwoFAEnabled = true
+	if err := s.userRepo.Update(user); err != nil {
+		return nil, err
 	}
-	return nil
+	return s.mfa.firstFactorEnabled(user.ID, len(methods) > 0)
 }
 
-// Password Reset
-
-func (s *AuthService) RequestPasswordReset(email string) error {
-	user, err := s.userRepo.FindByEmail(email)
+// RegenerateRecoveryCodes invalidates the previous recovery codes.
+func (s *AuthService) RegenerateRecoveryCodes(userID uint) ([]string, error) {
+	user, err := s.userRepo.FindByID(userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if user == nil {
-		return nil // Return nil to avoid email enumeration
+		return nil, domain.ErrUserNotFound
 	}
-
-	// Generate Reset Token (Random string)
-	token := "mock-reset-token-" + email // In prod use crypto/rand
-
-	// Hash token
-	hash, err := HashPassword(token) // Reuse bcrypt helper
+	methods, err := s.mfa.Methods(user)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	user.ResetTokenHash = hash
-	expiration := time.Now().Add(15 * time.Minute)
-	user.ResetTokenExp = &expiration
-
-	if err := s.userRepo.Update(user); err != nil {
-		return err
+	if len(methods) == 0 {
+		return nil, ErrSecondFactorRequired
 	}
-
-	// Send Email (Mock)
-	fmt.Printf("SEND EMAIL TO %s: Reset Token: %s\n", email, token)
-	return nil
+	return s.mfa.GenerateRecoveryCodes(userID)
 }
 
-func (s *AuthService) ResetPassword(email, token, newPassword string) error {
-	user, err := s.userRepo.FindByEmail(email)
+func (s *AuthService) Verify2FALogin(userID uint, code string) error {
+	user, err := s.userRepo.FindByID(userID)
 	if err != nil {
 		return err
 	}
@@ -255,24 +401,14 @@ func (s *AuthService) ResetPassword(email, token, newPassword string) error {
 		return domain.ErrUserNotFound
 	}
 
-	if user.ResetTokenExp == nil || time.Now().After(*user.ResetTokenExp) {
-		return fmt.Errorf("token expired")
-	}
-
-	if err := CheckPassword(token, user.ResetTokenHash); err != nil {
-		return fmt.Errorf("invalid token")
+	if !user.TwoFAEnabled {
+		return nil // Or error? Logic depends on flow.
 	}
 
-	newHash, err := HashPassword(newPassword)
-	if err != nil {
-		return err
+	if !totp.Validate(code, user.TwoFASecret) {
+		return fmt.Errorf("invalid OTP code")
 	}
-
-	user.PasswordHash = newHash
-	user.ResetTokenHash = ""
-	user.ResetTokenExp = nil
-
-	return s.userRepo.Update(user)
+	return nil
 }
 
 func (s *AuthService) GetUserByID(id uint) (*domain.User, error) {
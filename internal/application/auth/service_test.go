@@ -78,15 +78,30 @@ func (m *MockUserRepository) FindByEmail(email string) (*domain.User, error) {
 	return m.users[email], nil
 }
 
-func (m *MockUserRepository) FindByID(id uint) (*domain.User, error) { return nil, nil }
-func (m *MockUserRepository) Update(user *domain.User) error         { return nil }
+func (m *MockUserRepository) FindByID(id uint) (*domain.User, error) {
+	for _, u := range m.users {
+		if u.ID == id {
+			return u, nil
+		}
+	}
+	return nil, nil
+}
+func (m *MockUserRepository) Update(user *domain.User) error { return nil }
 func (m *MockUserRepository) GetByExternalID(ctx context.Context, externalID string) (*domain.User, error) {
 	return nil, nil
 }
 func (m *MockUserRepository) FindAll(schoolID uint) ([]domain.User, error) { return nil, nil }
+func (m *MockUserRepository) Delete(id uint) error                         { return nil }
+func (m *MockUserRepository) CountAll() (int64, error)                     { return int64(len(m.users)), nil }
+func (m *MockUserRepository) CountBySchoolAndRole(schoolID uint, role domain.Role) (int64, error) {
+	return 0, nil
+}
 
 type MockAuthRepository struct {
-	sessions []*domain.Session
+	sessions      []*domain.Session
+	refreshTokens map[string]*domain.RefreshToken
+	auditLogs     []*domain.AuthAuditLog
+	resetTokens   []*domain.PasswordResetToken
 }
 
 func (m *MockAuthRepository) CreateSession(session *domain.Session) error {
@@ -94,17 +109,88 @@ func (m *MockAuthRepository) CreateSession(session *domain.Session) error {
 	return nil
 }
 
-func (m *MockAuthRepository) StoreRefreshToken(token *domain.RefreshToken) error { return nil }
-func (m *MockAuthRepository) RevokeRefreshToken(tokenHash string) error          { return nil }
+func (m *MockAuthRepository) StoreRefreshToken(token *domain.RefreshToken) error {
+	if m.refreshTokens == nil {
+		m.refreshTokens = make(map[string]*domain.RefreshToken)
+	}
+	m.refreshTokens[token.TokenHash] = token
+	return nil
+}
+func (m *MockAuthRepository) RevokeRefreshToken(tokenHash string) error {
+	if t, ok := m.refreshTokens[tokenHash]; ok {
+		now := time.Now()
+		t.RevokedAt = &now
+	}
+	return nil
+}
 func (m *MockAuthRepository) GetRefreshToken(tokenHash string) (*domain.RefreshToken, error) {
+	return m.refreshTokens[tokenHash], nil
+}
+func (m *MockAuthRepository) CreateAuthAuditLog(log *domain.AuthAuditLog) error {
+	m.auditLogs = append(m.auditLogs, log)
+	return nil
+}
+func (m *MockAuthRepository) RevokeUserSessions(userID uint) error {
+	now := time.Now()
+	for _, t := range m.refreshTokens {
+		if t.UserID == userID && t.RevokedAt == nil {
+			t.RevokedAt = &now
+		}
+	}
+	var kept []*domain.Session
+	for _, s := range m.sessions {
+		if s.UserID != userID {
+			kept = append(kept, s)
+		}
+	}
+	m.sessions = kept
+	return nil
+}
+func (m *MockAuthRepository) CreatePasswordResetToken(token *domain.PasswordResetToken) error {
+	now := time.Now()
+	for _, t := range m.resetTokens {
+		if t.UserID == token.UserID && t.UsedAt == nil {
+			t.UsedAt = &now
+		}
+	}
+	token.ID = uint(len(m.resetTokens) + 1)
+	m.resetTokens = append(m.resetTokens, token)
+	return nil
+}
+func (m *MockAuthRepository) GetPasswordResetToken(selector string) (*domain.PasswordResetToken, error) {
+	for _, t := range m.resetTokens {
+		if t.Selector == selector {
+			copy := *t
+			return &copy, nil
+		}
+	}
 	return nil, nil
 }
+func (m *MockAuthRepository) UsePasswordResetToken(id uint) (bool, error) {
+	for _, t := range m.resetTokens {
+		if t.ID == id && t.UsedAt == nil {
+			now := time.Now()
+			t.UsedAt = &now
+			return true, nil
+		}
+	}
+	return false, nil
+}
+func (m *MockAuthRepository) CountPasswordResetTokens(userID uint, since time.Time) (int64, error) {
+	var n int64
+	for _, t := range m.resetTokens {
+		if t.UserID == userID && !t.CreatedAt.Before(since) {
+			n++
+		}
+	}
+	return n, nil
+}
 
 // Service Tests
 func TestRegister(t *testing.T) {
 	mockUserRepo := &MockUserRepository{users: make(map[string]*domain.User)}
 	mockAuthRepo := &MockAuthRepository{}
-	service := NewAuthService(mockUserRepo, mockAuthRepo, "secret", 15*time.Minute, 7*24*time.Hour)
+	service := NewAuthService(mockUserRepo, mockAuthRepo, newMFA(t, mockUserRepo), "secret", 15*time.Minute, 7*24*time.Hour)
 
 	user := &domain.User{
 		Email:        "new@example.com",
@@ -124,7 +210,7 @@ func TestRegister(t *testing.T) {
 func TestLogin(t *testing.T) {
 	mockUserRepo := &MockUserRepository{users: make(map[string]*domain.User)}
 	mockAuthRepo := &MockAuthRepository{}
-	service := NewAuthService(mockUserRepo, mockAuthRepo, "secret", 15*time.Minute, 7*24*time.Hour)
+	service := NewAuthService(mockUserRepo, mockAuthRepo, newMFA(t, mockUserRepo), "secret", 15*time.Minute, 7*24*time.Hour)
 
 	// Setup User
 	hash, _ := HashPassword("password")
@@ -138,26 +224,59 @@ func TestLogin(t *testing.T) {
 	mockUserRepo.users[user.Email] = user
 
 	// Test Success
-	userWrapper, token, refToken, err := service.Login("login@example.com", "password", "", "127.0.0.1", "test-agent")
+	userWrapper, pair, err := service.Login("login@example.com", "password", "", "127.0.0.1", "test-agent")
 	assert.NoError(t, err)
 	assert.NotNil(t, userWrapper)
-	assert.NotEmpty(t, token)
-	assert.NotEmpty(t, refToken)
+	assert.NotEmpty(t, pair.AccessToken)
+	assert.NotEmpty(t, pair.RefreshToken)
+
+	// Session and refresh token are persisted hashed, never in clear
+	assert.Len(t, mockAuthRepo.sessions, 1)
+	assert.Equal(t, HashToken(pair.AccessToken), mockAuthRepo.sessions[0].TokenHash)
+	assert.Contains(t, mockAuthRepo.refreshTokens, HashToken(pair.RefreshToken))
 
 	// Test Wrong Password
-	_, _, _, err = service.Login("login@example.com", "wrong", "", "127.0.0.1", "test-agent")
+	_, _, err = service.Login("login@example.com", "wrong", "", "127.0.0.1", "test-agent")
 	assert.Error(t, err)
 	assert.Equal(t, "invalid credentials", err.Error())
 
 	// Test User Not Found
-	_, _, _, err = service.Login("unknown@example.com", "password", "", "127.0.0.1", "test-agent")
+	_, _, err = service.Login("unknown@example.com", "password", "", "127.0.0.1", "test-agent")
 	assert.Error(t, err)
 }
 
+func TestRefreshTokenRotation(t *testing.T) {
+	mockUserRepo := &MockUserRepository{users: make(map[string]*domain.User)}
+	mockAuthRepo := &MockAuthRepository{}
+	service := NewAuthService(mockUserRepo, mockAuthRepo, newMFA(t, mockUserRepo), "secret", 15*time.Minute, 7*24*time.Hour)
+
+	hash, _ := HashPassword("password")
+	mockUserRepo.users["refresh@example.com"] = &domain.User{
+		ID: 7, Email: "refresh@example.com", PasswordHash: hash, Role: domain.RoleParent, SchoolID: 1,
+	}
+
+	_, pair, err := service.Login("refresh@example.com", "password", "", "127.0.0.1", "test-agent")
+	assert.NoError(t, err)
+
+	// First refresh succeeds and returns a new pair
+	user, rotated, err := service.Refresh(pair.RefreshToken, "127.0.0.1", "test-agent")
+	assert.NoError(t, err)
+	assert.Equal(t, uint(7), user.ID)
+	assert.NotEqual(t, pair.RefreshToken, rotated.RefreshToken)
+
+	// The old refresh token has been revoked
+	_, _, err = service.Refresh(pair.RefreshToken, "127.0.0.1", "test-agent")
+	assert.ErrorIs(t, err, ErrRefreshTokenInvalid)
+
+	// Unknown tokens are rejected
+	_, _, err = service.Refresh("not-a-token", "127.0.0.1", "test-agent")
+	assert.ErrorIs(t, err, ErrRefreshTokenInvalid)
+}
+
 func TestAccountLockout(t *testing.T) {
 	mockUserRepo := &MockUserRepository{users: make(map[string]*domain.User)}
 	mockAuthRepo := &MockAuthRepository{}
-	service := NewAuthService(mockUserRepo, mockAuthRepo, "secret", 15*time.Minute, 7*24*time.Hour)
+	service := NewAuthService(mockUserRepo, mockAuthRepo, newMFA(t, mockUserRepo), "secret", 15*time.Minute, 7*24*time.Hour)
 
 	user := &domain.User{
 		ID:           1,
@@ -174,54 +293,12 @@ func TestAccountLockout(t *testing.T) {
 
 	// Fail 5 times
 	for i := 0; i < 5; i++ {
-		_, _, _, err := service.Login("lockout@example.com", "wrong", "", "127.0.0.1", "test-agent")
+		_, _, err := service.Login("lockout@example.com", "wrong", "", "127.0.0.1", "test-agent")
 		assert.Error(t, err)
 	}
 
 	// 6th attempt should be locked
-	_, _, _, err := service.Login("lockout@example.com", "wrong", "", "127.0.0.1", "test-agent")
+	_, _, err := service.Login("lockout@example.com", "wrong", "", "127.0.0.1", "test-agent")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "account locked")
 }
-
-func TestPasswordReset(t *testing.T) {
-	mockUserRepo := &MockUserRepository{users: make(map[string]*domain.User)}
-	mockAuthRepo := &MockAuthRepository{}
-	service := NewAuthService(mockUserRepo, mockAuthRepo, "secret", 15*time.Minute, 7*24*time.Hour)
-
-	user := &domain.User{
-		ID:       1,
-		Email:    "reset@example.com",
-		Role:     domain.RoleAdmin,
-		SchoolID: 1,
-	}
-	// Initial password
-	hash, _ := HashPassword("old_password")
-	user.PasswordHash = hash
-	mockUserRepo.users[user.Email] = user
-
-	// 1. Request Reset
-	err := service.RequestPasswordReset("reset@example.com")
-	assert.NoError(t, err)
-
-	updatedUser := mockUserRepo.users["reset@example.com"]
-	assert.NotEmpty(t, updatedUser.ResetTokenHash)
-	assert.NotNil(t, updatedUser.ResetTokenExp)
-
-	// 2. Reset with wrong token
-	err = service.ResetPassword("reset@example.com", "wrong_token", "new_password")
-	assert.Error(t, err)
-
-	// 3. Reset with correct token
-	// We mocked the token generation in service "mock-reset-token-" + email
-	correctToken := "mock-reset-token-reset@example.com"
-	err = service.ResetPassword("reset@example.com", correctToken, "new_password")
-	assert.NoError(t, err)
-
-	// 4. Verify new password
-	updatedUser = mockUserRepo.users["reset@example.com"]
-	err = CheckPassword("new_password", updatedUser.PasswordHash)
-	assert.NoError(t, err)
-	assert.Empty(t, updatedUser.ResetTokenHash)
-	assert.Nil(t, updatedUser.ResetTokenExp)
-}
@@ -0,0 +1,301 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/k/iRegistro/internal/domain"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// SPIDLevel is the SPID level of assurance (AgID "Regole tecniche", section 2).
+type SPIDLevel int
+
+const (
+	SpidL1 SPIDLevel = 1 // Username and password
+	SpidL2 SPIDLevel = 2 // Two factors (OTP, app)
+	SpidL3 SPIDLevel = 3 // Two factors with a hardware device
+)
+
+const spidLevelPrefix = "https://www.spid.gov.it/SpidL"
+
+// samlRequestTTL bounds how long the IdP may take to answer an AuthnRequest.
+const samlRequestTTL = 10 * time.Minute
+
+var (
+	ErrSPIDLevelInvalid      = errors.New("invalid SPID level")
+	ErrSPIDLevelInsufficient = errors.New("SPID level lower than requested")
+	ErrSAMLUnknownRequest    = errors.New("SAML response does not match a pending request")
+	ErrSAMLReplay            = errors.New("SAML assertion already used")
+	ErrSAMLBindingInvalid    = errors.New("unsupported SAML binding")
+)
+
+// ClassRef returns the AuthnContextClassRef URI for the level.
+func (l SPIDLevel) ClassRef() string {
+	return spidLevelPrefix + strconv.Itoa(int(l))
+}
+
+func (l SPIDLevel) Valid() bool {
+	return l >= SpidL1 && l <= SpidL3
+}
+
+// ParseSPIDLevel accepts "1".."3", "L2"/"SpidL2" or the full AuthnContextClassRef.
+func ParseSPIDLevel(s string) (SPIDLevel, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), spidLevelPrefix)
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "Spid"), "L")
+	n, err := strconv.Atoi(s)
+	if err != nil || !SPIDLevel(n).Valid() {
+		return 0, ErrSPIDLevelInvalid
+	}
+	return SPIDLevel(n), nil
+}
+
+// SPIDProviderConfig holds what is needed to build the SPID service provider.
+type SPIDProviderConfig struct {
+	EntityID       string
+	ACSURL         string
+	MetadataURL    string
+	CertificatePEM []byte
+	PrivateKeyPEM  []byte
+	IDPMetadata    *saml.EntityDescriptor
+}
+
+// NewSPIDServiceProvider builds a ServiceProvider that signs its AuthnRequests
+// with RSA-SHA256 and never accepts IdP-initiated responses, as SPID requires.
+func NewSPIDServiceProvider(cfg SPIDProviderConfig) (*saml.ServiceProvider, error) {
+	key, err := parseRSAPrivateKey(cfg.PrivateKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("SPID private key: %w", err)
+	}
+	block, _ := pem.Decode(cfg.CertificatePEM)
+	if block == nil {
+		return nil, errors.New("SPID certificate: no PEM data")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("SPID certificate: %w", err)
+	}
+
+	acsURL, err := url.Parse(cfg.ACSURL)
+	if err != nil {
+		return nil, err
+	}
+	metadataURL, err := url.Parse(cfg.MetadataURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &saml.ServiceProvider{
+		EntityID:          cfg.EntityID,
+		Key:               key,
+		Certificate:       cert,
+		AcsURL:            *acsURL,
+		MetadataURL:       *metadataURL,
+		IDPMetadata:       cfg.IDPMetadata,
+		AuthnNameIDFormat: saml.TransientNameIDFormat,
+		SignatureMethod:   dsig.RSASHA256SignatureMethod,
+		AllowIDPInitiated: false,
+	}, nil
+}
+
+func parseRSAPrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("SPID requires an RSA key")
+	}
+	return key, nil
+}
+
+// SPIDAuthnRequest is a signed AuthnRequest ready to be sent to the IdP, either
+// as a redirect URL (HTTP-Redirect binding) or as an auto-submitting form (HTTP-POST).
+type SPIDAuthnRequest struct {
+	ID          string
+	Binding     string
+	RedirectURL string
+	PostForm    []byte
+}
+
+// SPIDLogin is the outcome of a validated SPID response.
+type SPIDLogin struct {
+	Attributes  *SPIDAttributes
+	Level       SPIDLevel
+	SchoolID    uint
+	RedirectURI string
+}
+
+// BeginLogin creates and records a signed AuthnRequest asking for at least the
+// given SPID level. The request ID doubles as RelayState, so the callback can
+// find the request before validating the response against it.
+func (s *SPIDService) BeginLogin(schoolID uint, redirectURI string, level SPIDLevel, binding string) (*SPIDAuthnRequest, error) {
+	if !level.Valid() {
+		return nil, ErrSPIDLevelInvalid
+	}
+	if binding != saml.HTTPRedirectBinding && binding != saml.HTTPPostBinding {
+		return nil, ErrSAMLBindingInvalid
+	}
+
+	// Per-request copy: the requested context depends on the route
+	sp := *s.serviceProvider
+	sp.RequestedAuthnContext = &saml.RequestedAuthnContext{
+		Comparison:           "minimum",
+		AuthnContextClassRef: level.ClassRef(),
+	}
+	if level > SpidL1 {
+		// SPID mandates ForceAuthn above level 1
+		force := true
+		sp.ForceAuthn = &force
+	}
+
+	location := sp.GetSSOBindingLocation(binding)
+	if location == "" {
+		return nil, ErrSAMLBindingInvalid
+	}
+	req, err := sp.MakeAuthenticationRequest(location, binding, saml.HTTPPostBinding)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.requests.SaveRequest(&domain.SAMLRequest{
+		ID:          req.ID,
+		SchoolID:    schoolID,
+		RedirectURI: redirectURI,
+		Level:       int(level),
+		ExpiresAt:   time.Now().Add(samlRequestTTL),
+		CreatedAt:   time.Now(),
+	}); err != nil {
+		return nil, err
+	}
+
+	out := &SPIDAuthnRequest{ID: req.ID, Binding: binding}
+	if binding == saml.HTTPRedirectBinding {
+		u, err := req.Redirect(req.ID, &sp)
+		if err != nil {
+			return nil, err
+		}
+		out.RedirectURL = u.String()
+	} else {
+		out.PostForm = req.Post(req.ID)
+	}
+	return out, nil
+}
+
+// CompleteLogin validates a SPID response posted to the ACS: it must answer a
+// pending request (InResponseTo), carry an unused assertion ID and reach the
+// SPID level that was requested.
+func (s *SPIDService) CompleteLogin(r *http.Request) (*SPIDLogin, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	// Consumed up front: a request is burnt by the first response, valid or not
+	stored, err := s.requests.ConsumeRequest(r.PostForm.Get("RelayState"))
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		return nil, ErrSAMLUnknownRequest
+	}
+
+	assertion, err := s.serviceProvider.ParseResponse(r, []string{stored.ID})
+	if err != nil {
+		var ire *saml.InvalidResponseError
+		if errors.As(err, &ire) {
+			err = ire.PrivateErr
+		}
+		return nil, fmt.Errorf("%w: %v", ErrSAMLValidationFailed, err)
+	}
+
+	if err := s.checkReplay(assertion); err != nil {
+		return nil, err
+	}
+
+	level, err := verifyAuthnContext(assertion, SPIDLevel(stored.Level))
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := s.ValidateSAMLAssertion(r.Context(), assertion)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SPIDLogin{
+		Attributes:  attrs,
+		Level:       level,
+		SchoolID:    stored.SchoolID,
+		RedirectURI: stored.RedirectURI,
+	}, nil
+}
+
+// checkReplay records the assertion ID until the assertion expires.
+func (s *SPIDService) checkReplay(assertion *saml.Assertion) error {
+	if assertion.ID == "" {
+		return fmt.Errorf("%w: assertion without ID", ErrSAMLValidationFailed)
+	}
+
+	expires := time.Now().Add(samlRequestTTL)
+	if assertion.Conditions != nil && assertion.Conditions.NotOnOrAfter.After(expires) {
+		expires = assertion.Conditions.NotOnOrAfter
+	}
+	expires = expires.Add(saml.MaxClockSkew)
+
+	fresh, err := s.requests.MarkAssertionUsed(&domain.SAMLAssertionUse{
+		ID:        assertion.ID,
+		Issuer:    assertion.Issuer.Value,
+		ExpiresAt: expires,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrSAMLReplay
+	}
+	return nil
+}
+
+// verifyAuthnContext returns the level asserted by the IdP, which must be a
+// SPID level at least equal to the requested one.
+func verifyAuthnContext(assertion *saml.Assertion, requested SPIDLevel) (SPIDLevel, error) {
+	if len(assertion.AuthnStatements) == 0 || assertion.AuthnStatements[0].AuthnContext.AuthnContextClassRef == nil {
+		return 0, fmt.Errorf("%w: missing AuthnContextClassRef", ErrSAMLValidationFailed)
+	}
+	ref := assertion.AuthnStatements[0].AuthnContext.AuthnContextClassRef.Value
+	if !strings.HasPrefix(ref, spidLevelPrefix) {
+		return 0, fmt.Errorf("%w: unexpected AuthnContextClassRef %q", ErrSAMLValidationFailed, ref)
+	}
+	level, err := ParseSPIDLevel(ref)
+	if err != nil {
+		return 0, err
+	}
+	if level < requested {
+		return 0, ErrSPIDLevelInsufficient
+	}
+	return level, nil
+}
+
+// PurgeExpired removes expired requests and assertion IDs.
+func (s *SPIDService) PurgeExpired() error {
+	return s.requests.PurgeExpired(time.Now())
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/xml"
 	"errors"
-	"fmt"
 	"time"
 
 	"github.com/crewjam/saml"
@@ -18,8 +17,10 @@ var (
 
 // SPIDService handles SPID authentication
 type SPIDService struct {
-	userRepo        domain.UserRepository
-	jwtSecret       string
+	authRepo        domain.AuthRepository
+	requests        domain.SAMLRepository
+	tokens          *TokenService
+	links           *IdentityLinkService
 	serviceProvider *saml.ServiceProvider
 }
 
@@ -33,10 +34,12 @@ type SPIDAttributes struct {
 	Provider    string // Identity Provider name
 }
 
-func NewSPIDService(userRepo domain.UserRepository, jwtSecret string, sp *saml.ServiceProvider) *SPIDService {
+func NewSPIDService(authRepo domain.AuthRepository, requests domain.SAMLRepository, tokens *TokenService, links *IdentityLinkService, sp *saml.ServiceProvider) *SPIDService {
 	return &SPIDService{
-		userRepo:        userRepo,
-		jwtSecret:       jwtSecret,
+		authRepo:        authRepo,
+		requests:        requests,
+		tokens:          tokens,
+		links:           links,
 		serviceProvider: sp,
 	}
 }
@@ -91,62 +94,55 @@ func (s *SPIDService) ValidateSAMLAssertion(ctx context.Context, assertion *saml
 	return attrs, nil
 }
 
-// GetOrCreateUserBySPID finds or creates a user based on SPID attributes
-func (s *SPIDService) GetOrCreateUserBySPID(ctx context.Context, attrs *SPIDAttributes, schoolID uint) (*domain.User, error) {
-	// Try to find user by external ID (SPID unique identifier)
-	externalID := "spid:" + attrs.TaxCode
-	user, err := s.userRepo.GetByExternalID(ctx, externalID)
-
-	if err == nil {
-		// User exists, update last auth
-		user.LastAuthAt = timePtr(time.Now())
-		user.SPIDProvider = &attrs.Provider
-		if err := s.userRepo.Update(user); err != nil {
-			return nil, err
-		}
-		return user, nil
-	}
+// ResolveUserBySPID returns the user linked to the SPID identity. Identities
+// that cannot be matched yield an *IdentityPendingError.
+func (s *SPIDService) ResolveUserBySPID(ctx context.Context, attrs *SPIDAttributes, schoolID uint) (*domain.User, error) {
+	taxCode := normalizeTaxCode(attrs.TaxCode)
+	return s.links.Resolve(ctx, FederatedIdentity{
+		AuthMethod: domain.AuthMethodSPID,
+		ExternalID: "spid:" + taxCode,
+		Provider:   attrs.Provider,
+		TaxCode:    taxCode,
+		FirstName:  attrs.Name,
+		LastName:   attrs.FamilyName,
+		Email:      attrs.Email,
+	}, schoolID)
+}
 
-	// User doesn't exist, create new one
-	user = &domain.User{
-		Email:        attrs.Email,
-		SchoolID:     schoolID,
-		FirstName:    attrs.Name,
-		LastName:     attrs.FamilyName,
-		AuthMethod:   "spid",
-		SPIDProvider: &attrs.Provider,
-		ExternalID:   &externalID,
-		LastAuthAt:   timePtr(time.Now()),
-		Role:         domain.RoleParent, // Default role
-		PasswordHash: "",                // No password for SPID users
-		CreatedAt:    time.Now(),
-		UpdatedAt:    time.Now(),
+// IssueTokens issues access and refresh tokens for an authenticated SPID user,
+// carrying the asserted SPID level, and records the login in the audit log.
+func (s *SPIDService) IssueTokens(user *domain.User, level SPIDLevel, lc LoginContext) (*TokenPair, error) {
+	provider := ""
+	if user.SPIDProvider != nil {
+		provider = *user.SPIDProvider
 	}
 
-	if err := s.userRepo.Create(user); err != nil {
+	pair, err := s.tokens.IssueWithAssurance(user, Assurance{Method: domain.AuthMethodSPID, Level: level}, lc.IPAddress, lc.UserAgent)
+	if err != nil {
+		recordAuthAttempt(s.authRepo, &user.ID, domain.AuthMethodSPID, provider, lc, "token issuance failed: "+err.Error())
 		return nil, err
 	}
 
-	return user, nil
+	recordAuthAttempt(s.authRepo, &user.ID, domain.AuthMethodSPID, provider, lc, "")
+	return pair, nil
 }
 
-// GenerateTokenForUser generates JWT token for authenticated SPID user
-func (s *SPIDService) GenerateTokenForUser(user *domain.User) (string, error) {
-	// Simple JWT generation - in production use a proper token service
-	return fmt.Sprintf("jwt_token_user_%d_school_%d", user.ID, user.SchoolID), nil
+// RecordFailure stores a failed SPID login attempt in the audit log.
+func (s *SPIDService) RecordFailure(provider string, lc LoginContext, reason string) {
+	recordAuthAttempt(s.authRepo, nil, domain.AuthMethodSPID, provider, lc, reason)
 }
 
 // validateAssertion performs SAML assertion validation
 func (s *SPIDService) validateAssertion(assertion *saml.Assertion) error {
-	// Check assertion expiry
+	// Check assertion expiry, allowing the same clock skew as the SAML library
 	now := time.Now()
 
 	if assertion.Conditions != nil {
 		// NotBefore and NotOnOrAfter are time.Time, not pointers
-		if !assertion.Conditions.NotBefore.IsZero() && now.Before(assertion.Conditions.NotBefore) {
+		if !assertion.Conditions.NotBefore.IsZero() && now.Add(saml.MaxClockSkew).Before(assertion.Conditions.NotBefore) {
 			return errors.New("assertion not yet valid")
 		}
-		if !assertion.Conditions.NotOnOrAfter.IsZero() && now.After(assertion.Conditions.NotOnOrAfter) {
+		if !assertion.Conditions.NotOnOrAfter.IsZero() && now.Add(-saml.MaxClockSkew).After(assertion.Conditions.NotOnOrAfter) {
 			return errors.New("assertion expired")
 		}
 	}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token invalid or expired")
+)
+
+// TokenPair is the result of a successful authentication, whatever the method
+// (password, SPID or CIE).
+type TokenPair struct {
+	AccessToken      string
+	RefreshToken     string
+	AccessExpiresAt  time.Time
+	RefreshExpiresAt time.Time
+}
+
+// Assurance describes how a session was authenticated. It is embedded in the
+// access token and kept on the refresh token so that rotation preserves it.
+type Assurance struct {
+	Method string    // domain.AuthMethodEmail, AuthMethodSPID, AuthMethodCIE
+	Level  SPIDLevel // SPID level of the assertion, zero for other methods
+}
+
+// TokenService issues signed access tokens, opaque refresh tokens and the
+// matching Session records. It is shared by every login flow so that
+// AuthMiddleware can validate tokens regardless of how the user authenticated.
+type TokenService struct {
+	authRepo        domain.AuthRepository
+	jwtSecret       string
+	accessDuration  time.Duration
+	refreshDuration time.Duration
+}
+
+func NewTokenService(authRepo domain.AuthRepository, secret string, accessDur, refreshDur time.Duration) *TokenService {
+	return &TokenService{
+		authRepo:        authRepo,
+		jwtSecret:       secret,
+		accessDuration:  accessDur,
+		refreshDuration: refreshDur,
+	}
+}
+
+// Issue creates a new access/refresh token pair for a password login and records the session.
+func (s *TokenService) Issue(user *domain.User, ip, userAgent string) (*TokenPair, error) {
+	return s.IssueWithAssurance(user, Assurance{Method: domain.AuthMethodEmail}, ip, userAgent)
+}
+
+// IssueWithAssurance is Issue for logins whose method and level must be carried in the token.
+func (s *TokenService) IssueWithAssurance(user *domain.User, a Assurance, ip, userAgent string) (*TokenPair, error) {
+	accessToken, claims, err := generateAccessToken(user, a, s.jwtSecret, s.accessDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := generateOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	refreshExpiry := time.Now().Add(s.refreshDuration)
+
+	if err := s.authRepo.StoreRefreshToken(&domain.RefreshToken{
+		UserID:     user.ID,
+		TokenHash:  HashToken(refreshToken),
+		AuthMethod: a.Method,
+		AuthLevel:  int(a.Level),
+		ExpiresAt:  refreshExpiry,
+		CreatedAt:  time.Now(),
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := s.authRepo.CreateSession(&domain.Session{
+		UserID:    user.ID,
+		TokenHash: HashToken(accessToken),
+		ExpiresAt: claims.ExpiresAt.Time,
+		IPAddress: ip,
+		UserAgent: userAgent,
+	}); err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:      accessToken,
+		RefreshToken:     refreshToken,
+		AccessExpiresAt:  claims.ExpiresAt.Time,
+		RefreshExpiresAt: refreshExpiry,
+	}, nil
+}
+
+// ValidateRefreshToken returns the stored record for a refresh token if it is
+// neither revoked nor expired.
+func (s *TokenService) ValidateRefreshToken(refreshToken string) (*domain.RefreshToken, error) {
+	stored, err := s.authRepo.GetRefreshToken(HashToken(refreshToken))
+	if err != nil || stored == nil {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if stored.RevokedAt != nil || time.Now().After(stored.ExpiresAt) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	return stored, nil
+}
+
+// Revoke invalidates a refresh token so it cannot be used again.
+func (s *TokenService) Revoke(refreshToken string) error {
+	return s.authRepo.RevokeRefreshToken(HashToken(refreshToken))
+}
+
+// assuranceOf returns the assurance recorded on a refresh token. Tokens issued
+// before assurance was tracked count as password logins.
+func assuranceOf(t *domain.RefreshToken) Assurance {
+	if t.AuthMethod == "" {
+		return Assurance{Method: domain.AuthMethodEmail}
+	}
+	return Assurance{Method: t.AuthMethod, Level: SPIDLevel(t.AuthLevel)}
+}
+
+// HashToken returns the hex SHA-256 digest under which tokens are persisted.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,386 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/k/iRegistro/internal/domain"
+)
+
+// ceremonyTTL bounds how long the user may take to touch the authenticator.
+const ceremonyTTL = 5 * time.Minute
+
+var (
+	ErrWebAuthnNotConfigured   = errors.New("webauthn is not configured")
+	ErrWebAuthnCeremonyInvalid = errors.New("webauthn ceremony unknown or expired")
+	ErrWebAuthnRegistration    = errors.New("webauthn registration failed")
+	ErrPasskeyLoginNotAllowed  = errors.New("passwordless login is reserved to staff")
+)
+
+// passkeyRoles may log in with a passkey alone. Families keep password plus
+// second factor, since their devices are often shared.
+var passkeyRoles = map[domain.Role]bool{
+	domain.RoleSuperAdmin: true,
+	domain.RoleAdmin:      true,
+	domain.RolePrincipal:  true,
+	domain.RoleSecretary:  true,
+	domain.RoleTeacher:    true,
+}
+
+// NewWebAuthn builds the relying party configuration. rpID is the registrable
+// domain of the frontend (e.g. "registro.scuola.it"), origins its full origins.
+func NewWebAuthn(rpID, displayName string, origins []string) (*webauthn.WebAuthn, error) {
+	return webauthn.New(&webauthn.Config{
+		RPID:                  rpID,
+		RPDisplayName:         displayName,
+		RPOrigins:             origins,
+		AttestationPreference: protocol.PreferNoAttestation,
+	})
+}
+
+// WebAuthnOptions is what the browser passes to navigator.credentials; the
+// SessionID must be sent back with the authenticator response.
+type WebAuthnOptions struct {
+	SessionID string      `json:"session_id"`
+	PublicKey interface{} `json:"publicKey"`
+}
+
+// webAuthnUser adapts a domain user and its credentials to webauthn.User.
+type webAuthnUser struct {
+	user  *domain.User
+	creds []domain.WebAuthnCredential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte   { return webAuthnUserHandle(u.user.ID) }
+func (u *webAuthnUser) WebAuthnName() string { return u.user.Email }
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	if name := strings.TrimSpace(u.user.FirstName + " " + u.user.LastName); name != "" {
+		return name
+	}
+	return u.user.Email
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	out := make([]webauthn.Credential, len(u.creds))
+	for i, c := range u.creds {
+		var transports []protocol.AuthenticatorTransport
+		for _, t := range strings.Split(c.Transports, ",") {
+			if t != "" {
+				transports = append(transports, protocol.AuthenticatorTransport(t))
+			}
+		}
+		out[i] = webauthn.Credential{
+			ID:              c.CredentialID,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				UserPresent:    true,
+				BackupEligible: c.BackupEligible,
+				BackupState:    c.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{AAGUID: c.AAGUID, SignCount: c.SignCount},
+		}
+	}
+	return out
+}
+
+// webAuthnUserHandle is the user.id given to authenticators. It is returned as
+// userHandle by discoverable credentials, which is how passkey logins find the user.
+func webAuthnUserHandle(id uint) []byte {
+	return []byte(strconv.FormatUint(uint64(id), 10))
+}
+
+func (s *MFAService) loadWebAuthnUser(userID uint) (*webAuthnUser, error) {
+	user, err := s.userRepo.FindByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, domain.ErrUserNotFound
+	}
+	creds, err := s.repo.ListWebAuthnCredentials(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &webAuthnUser{user: user, creds: creds}, nil
+}
+
+func (s *MFAService) saveCeremony(userID *uint, purpose string, session *webauthn.SessionData) (string, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	if err := s.repo.SaveCeremony(&domain.WebAuthnCeremony{
+		ID:          session.Challenge,
+		UserID:      userID,
+		Purpose:     purpose,
+		SessionData: string(data),
+		ExpiresAt:   time.Now().Add(ceremonyTTL),
+		CreatedAt:   time.Now(),
+	}); err != nil {
+		return "", err
+	}
+	return session.Challenge, nil
+}
+
+// consumeCeremony returns the session data of a ceremony started for the same
+// purpose and user. The ceremony is deleted whatever the outcome.
+func (s *MFAService) consumeCeremony(id, purpose string, userID *uint) (*webauthn.SessionData, error) {
+	c, err := s.repo.ConsumeCeremony(id)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil || c.Purpose != purpose {
+		return nil, ErrWebAuthnCeremonyInvalid
+	}
+	if (c.UserID == nil) != (userID == nil) || (userID != nil && *c.UserID != *userID) {
+		return nil, ErrWebAuthnCeremonyInvalid
+	}
+
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(c.SessionData), &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// BeginRegistration starts registering a new authenticator. Staff get a
+// discoverable credential with user verification, usable for passwordless login.
+func (s *MFAService) BeginRegistration(userID uint) (*WebAuthnOptions, error) {
+	if s.webAuthn == nil {
+		return nil, ErrWebAuthnNotConfigured
+	}
+	u, err := s.loadWebAuthnUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	selection := protocol.AuthenticatorSelection{
+		ResidentKey:      protocol.ResidentKeyRequirementPreferred,
+		UserVerification: protocol.VerificationPreferred,
+	}
+	if passkeyRoles[u.user.Role] {
+		selection.ResidentKey = protocol.ResidentKeyRequirementRequired
+		selection.RequireResidentKey = protocol.ResidentKeyRequired()
+		selection.UserVerification = protocol.VerificationRequired
+	}
+
+	creation, session, err := s.webAuthn.BeginRegistration(u,
+		webauthn.WithAuthenticatorSelection(selection),
+		webauthn.WithExclusions(webauthn.Credentials(u.WebAuthnCredentials()).CredentialDescriptors()),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := s.saveCeremony(&userID, domain.CeremonyRegistration, session)
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnOptions{SessionID: id, PublicKey: creation.Response}, nil
+}
+
+// FinishRegistration verifies the attestation and stores the credential. If it
+// is the user's first second factor, recovery codes are generated and returned.
+func (s *MFAService) FinishRegistration(userID uint, sessionID, name string, response []byte) (*domain.WebAuthnCredential, []string, error) {
+	if s.webAuthn == nil {
+		return nil, nil, ErrWebAuthnNotConfigured
+	}
+	session, err := s.consumeCeremony(sessionID, domain.CeremonyRegistration, &userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	u, err := s.loadWebAuthnUser(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	methods, err := s.Methods(u.user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(response)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrWebAuthnRegistration, err)
+	}
+	cred, err := s.webAuthn.CreateCredential(u, *session, parsed)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrWebAuthnRegistration, err)
+	}
+
+	transports := make([]string, len(cred.Transport))
+	for i, t := range cred.Transport {
+		transports[i] = string(t)
+	}
+	if name = strings.TrimSpace(name); name == "" {
+		name = "Passkey"
+	}
+	stored := &domain.WebAuthnCredential{
+		UserID:          userID,
+		CredentialID:    cred.ID,
+		PublicKey:       cred.PublicKey,
+		AttestationType: cred.AttestationType,
+		AAGUID:          cred.Authenticator.AAGUID,
+		SignCount:       cred.Authenticator.SignCount,
+		Transports:      strings.Join(transports, ","),
+		BackupEligible:  cred.Flags.BackupEligible,
+		BackupState:     cred.Flags.BackupState,
+		Name:            name,
+		CreatedAt:       time.Now(),
+	}
+	if err := s.repo.CreateWebAuthnCredential(stored); err != nil {
+		return nil, nil, err
+	}
+
+	codes, err := s.firstFactorEnabled(userID, len(methods) > 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stored, codes, nil
+}
+
+// BeginAssertion asks for one of the user's registered authenticators as second factor.
+func (s *MFAService) BeginAssertion(userID uint) (*WebAuthnOptions, error) {
+	if s.webAuthn == nil {
+		return nil, ErrWebAuthnNotConfigured
+	}
+	u, err := s.loadWebAuthnUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.creds) == 0 {
+		return nil, ErrSecondFactorInvalid
+	}
+
+	assertion, session, err := s.webAuthn.BeginLogin(u)
+	if err != nil {
+		return nil, err
+	}
+	id, err := s.saveCeremony(&userID, domain.CeremonySecondFactor, session)
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnOptions{SessionID: id, PublicKey: assertion.Response}, nil
+}
+
+// FinishAssertion verifies the authenticator response for a second factor login.
+func (s *MFAService) FinishAssertion(userID uint, sessionID string, response []byte) error {
+	if s.webAuthn == nil {
+		return ErrWebAuthnNotConfigured
+	}
+	session, err := s.consumeCeremony(sessionID, domain.CeremonySecondFactor, &userID)
+	if err != nil {
+		return err
+	}
+	u, err := s.loadWebAuthnUser(userID)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(response)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSecondFactorInvalid, err)
+	}
+	cred, err := s.webAuthn.ValidateLogin(u, *session, parsed)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSecondFactorInvalid, err)
+	}
+	return s.credentialUsed(u, cred)
+}
+
+// BeginPasskeyLogin starts a passwordless login: the browser offers any
+// passkey registered for this site, and the response identifies the user.
+func (s *MFAService) BeginPasskeyLogin() (*WebAuthnOptions, error) {
+	if s.webAuthn == nil {
+		return nil, ErrWebAuthnNotConfigured
+	}
+	assertion, session, err := s.webAuthn.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := s.saveCeremony(nil, domain.CeremonyPasskeyLogin, session)
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnOptions{SessionID: id, PublicKey: assertion.Response}, nil
+}
+
+// FinishPasskeyLogin verifies a discoverable credential assertion made with
+// user verification and returns its owner.
+func (s *MFAService) FinishPasskeyLogin(sessionID string, response []byte) (*domain.User, error) {
+	if s.webAuthn == nil {
+		return nil, ErrWebAuthnNotConfigured
+	}
+	session, err := s.consumeCeremony(sessionID, domain.CeremonyPasskeyLogin, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(response)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSecondFactorInvalid, err)
+	}
+
+	var owner *webAuthnUser
+	cred, err := s.webAuthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		id, err := strconv.ParseUint(string(userHandle), 10, 64)
+		if err != nil {
+			return nil, ErrSecondFactorInvalid
+		}
+		owner, err = s.loadWebAuthnUser(uint(id))
+		if err != nil {
+			return nil, err
+		}
+		return owner, nil
+	}, *session, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSecondFactorInvalid, err)
+	}
+
+	if err := s.credentialUsed(owner, cred); err != nil {
+		return nil, err
+	}
+	if !passkeyRoles[owner.user.Role] {
+		return owner.user, ErrPasskeyLoginNotAllowed
+	}
+	return owner.user, nil
+}
+
+// credentialUsed records the new signature counter. A counter that did not
+// increase means the credential may have been cloned: the login is refused.
+func (s *MFAService) credentialUsed(u *webAuthnUser, cred *webauthn.Credential) error {
+	if cred.Authenticator.CloneWarning {
+		return fmt.Errorf("%w: signature counter did not increase", ErrSecondFactorInvalid)
+	}
+	for i := range u.creds {
+		stored := &u.creds[i]
+		if !bytes.Equal(stored.CredentialID, cred.ID) {
+			continue
+		}
+		now := time.Now()
+		stored.SignCount = cred.Authenticator.SignCount
+		stored.BackupState = cred.Flags.BackupState
+		stored.LastUsedAt = &now
+		return s.repo.UpdateWebAuthnCredential(stored)
+	}
+	return ErrSecondFactorInvalid
+}
+
+func (s *MFAService) ListCredentials(userID uint) ([]domain.WebAuthnCredential, error) {
+	return s.repo.ListWebAuthnCredentials(userID)
+}
+
+func (s *MFAService) DeleteCredential(userID, id uint) error {
+	return s.repo.DeleteWebAuthnCredential(userID, id)
+}
@@ -0,0 +1,634 @@
+package calendar
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"go.uber.org/zap"
+)
+
+// TimetableSettingsKey is the school setting with the times of the lesson
+// hours: {"hours": [{"start": "08:00", "end": "09:00"}, ...]}, the first
+// for hour 1. Without it hours last 60 minutes from 08:00.
+const TimetableSettingsKey = "timetable"
+
+const (
+	maxTokensPerUser = 10
+	// The feeds cover from a month ago to a year ahead
+	feedPast   = 30 * 24 * time.Hour
+	feedFuture = 365 * 24 * time.Hour
+)
+
+var (
+	ErrTokenNotFound    = errors.New("calendar token not found")
+	ErrTooManyTokens    = errors.New("too many calendar tokens")
+	ErrUnknownFeed      = errors.New("unknown calendar feed")
+	ErrNotAllowed       = errors.New("not allowed")
+	ErrInvalidHomework  = errors.New("invalid homework")
+	ErrInvalidEvent     = errors.New("invalid school event")
+	errInvalidTimetable = errors.New("invalid timetable setting")
+)
+
+// Feed is a kind of events in a calendar feed.
+type Feed string
+
+const (
+	FeedTimetable   Feed = "timetable"
+	FeedColloquiums Feed = "colloquiums"
+	FeedHomework    Feed = "homework"
+	FeedEvents      Feed = "events"
+)
+
+// AllFeeds are the kinds of events of a feed by default.
+var AllFeeds = []Feed{FeedTimetable, FeedColloquiums, FeedHomework, FeedEvents}
+
+// ParseFeeds parses a comma separated list of feeds; empty means AllFeeds.
+func ParseFeeds(s string) ([]Feed, error) {
+	if s == "" {
+		return AllFeeds, nil
+	}
+	var feeds []Feed
+	for _, part := range strings.Split(s, ",") {
+		f := Feed(strings.TrimSpace(part))
+		switch f {
+		case FeedTimetable, FeedColloquiums, FeedHomework, FeedEvents:
+			feeds = append(feeds, f)
+		default:
+			return nil, fmt.Errorf("%w: %q", ErrUnknownFeed, part)
+		}
+	}
+	return feeds, nil
+}
+
+type feedText struct {
+	calendar, colloquium, colloquiumWith, online, phone, homework string
+}
+
+var feedTexts = map[string]feedText{
+	"it": {"iRegistro - %s", "Colloquio", "Colloquio con %s", "Online", "Telefonico", "Compiti di %s: %s"},
+	"en": {"iRegistro - %s", "Colloquium", "Colloquium with %s", "Online", "By phone", "%s homework: %s"},
+}
+
+const defaultLocale = "it"
+
+type directory interface {
+	GetStudentsByParentID(parentID uint) ([]domain.Student, error)
+	GetStudentByUserID(userID uint) (*domain.Student, error)
+	GetStudentClassIDs(studentID uint) ([]uint, error)
+	GetAssignmentsByTeacherID(teacherID uint) ([]domain.ClassSubjectAssignment, error)
+	GetClassesBySchoolID(schoolID uint) ([]domain.Class, error)
+	GetSubjects(schoolID uint) ([]domain.Subject, error)
+}
+
+type settingsReader interface {
+	GetSchoolSettings(schoolID uint) ([]domain.SchoolSettings, error)
+}
+
+// HomeworkRequest assigns homework to a class.
+type HomeworkRequest struct {
+	ClassID     uint   `json:"class_id" binding:"required"`
+	SubjectID   uint   `json:"subject_id" binding:"required"`
+	Title       string `json:"title" binding:"required"`
+	Description string `json:"description"`
+	DueDate     string `json:"due_date" binding:"required"` // 2006-01-02
+}
+
+// EventRequest adds an event to the school calendar.
+type EventRequest struct {
+	ClassID     *uint     `json:"class_id"`
+	Title       string    `json:"title" binding:"required"`
+	Description string    `json:"description"`
+	Location    string    `json:"location"`
+	StartsAt    time.Time `json:"starts_at" binding:"required"`
+	EndsAt      time.Time `json:"ends_at" binding:"required"`
+	AllDay      bool      `json:"all_day"`
+}
+
+// CalendarService publishes iCalendar feeds of the timetable, colloquiums,
+// homework and school events of a user, read by calendar apps with a
+// secret token in the URL.
+type CalendarService struct {
+	repo      domain.CalendarRepository
+	users     domain.UserRepository
+	directory directory
+	settings  settingsReader
+}
+
+func NewCalendarService(repo domain.CalendarRepository, users domain.UserRepository, directory directory, settings settingsReader) *CalendarService {
+	return &CalendarService{repo: repo, users: users, directory: directory, settings: settings}
+}
+
+// --- Tokens ---
+
+// CreateToken creates a feed token for userID. The secret is returned only
+// here.
+func (s *CalendarService) CreateToken(userID uint, name string) (*domain.CalendarToken, string, error) {
+	tokens, err := s.repo.GetCalendarTokensByUserID(userID)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(tokens) >= maxTokensPerUser {
+		return nil, "", ErrTooManyTokens
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	token := &domain.CalendarToken{
+		UserID:    userID,
+		Name:      strings.TrimSpace(name),
+		TokenHash: hashToken(secret),
+		CreatedAt: time.Now(),
+	}
+	if err := s.repo.CreateCalendarToken(token); err != nil {
+		return nil, "", err
+	}
+	return token, secret, nil
+}
+
+// Tokens returns the active tokens of userID.
+func (s *CalendarService) Tokens(userID uint) ([]domain.CalendarToken, error) {
+	return s.repo.GetCalendarTokensByUserID(userID)
+}
+
+// RevokeToken disables a token of userID: its feed URL stops working.
+func (s *CalendarService) RevokeToken(userID, id uint) error {
+	ok, err := s.repo.RevokeCalendarToken(id, userID, time.Now())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// --- Feeds ---
+
+// audience is what a user sees of the school in their feed.
+type audience struct {
+	user     *domain.User
+	texts    feedText
+	classIDs []uint // Of the students, or taught
+	classes  map[uint]domain.Class
+	subjects map[uint]string
+}
+
+// Feed returns the name and the events of the feed of secret, limited to
+// feeds. Parents see the classes of the students they are guardian of.
+func (s *CalendarService) Feed(secret string, feeds []Feed, now time.Time) (string, []domain.CalendarEvent, error) {
+	token, err := s.repo.GetCalendarTokenByHash(hashToken(secret))
+	if err != nil {
+		return "", nil, err
+	}
+	if token == nil || token.RevokedAt != nil {
+		return "", nil, ErrTokenNotFound
+	}
+	user, err := s.users.FindByID(token.UserID)
+	if err != nil {
+		return "", nil, err
+	}
+	if user == nil {
+		return "", nil, ErrTokenNotFound
+	}
+	if err := s.repo.TouchCalendarToken(token.ID, now); err != nil {
+		zap.L().Warn("Failed to record calendar token use", zap.Uint("token_id", token.ID), zap.Error(err))
+	}
+
+	a, err := s.audience(user, now)
+	if err != nil {
+		return "", nil, err
+	}
+	from, to := now.Add(-feedPast), now.Add(feedFuture)
+	var events []domain.CalendarEvent
+	for _, f := range feeds {
+		var part []domain.CalendarEvent
+		switch f {
+		case FeedTimetable:
+			part, err = s.timetable(a, now)
+		case FeedColloquiums:
+			part, err = s.colloquiums(a, from, to)
+		case FeedHomework:
+			part, err = s.homework(a, from, to)
+		case FeedEvents:
+			part, err = s.schoolEvents(a, from, to)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		events = append(events, part...)
+	}
+	name := fmt.Sprintf(a.texts.calendar, fullName(user))
+	return name, events, nil
+}
+
+func (s *CalendarService) audience(user *domain.User, now time.Time) (*audience, error) {
+	a := &audience{user: user, texts: feedTexts[defaultLocale], classes: map[uint]domain.Class{}, subjects: map[uint]string{}}
+	if t, ok := feedTexts[user.Locale]; ok {
+		a.texts = t
+	}
+
+	var students []domain.Student
+	switch user.Role {
+	case domain.RoleParent:
+		children, err := s.directory.GetStudentsByParentID(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		students = children
+	case domain.RoleStudent:
+		student, err := s.directory.GetStudentByUserID(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if student != nil {
+			students = append(students, *student)
+		}
+	case domain.RoleTeacher:
+		assignments, err := s.directory.GetAssignmentsByTeacherID(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, as := range assignments {
+			if as.EndDate == nil || as.EndDate.After(now) {
+				a.classIDs = appendUnique(a.classIDs, as.ClassID)
+			}
+		}
+	}
+	for _, st := range students {
+		if st.SchoolID != user.SchoolID {
+			continue
+		}
+		ids, err := s.directory.GetStudentClassIDs(st.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			a.classIDs = appendUnique(a.classIDs, id)
+		}
+	}
+
+	classes, err := s.directory.GetClassesBySchoolID(user.SchoolID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range classes {
+		a.classes[c.ID] = c
+	}
+	if user.Role == domain.RolePrincipal || user.Role == domain.RoleAdmin || user.Role == domain.RoleSecretary {
+		// The events of every class
+		for _, c := range classes {
+			a.classIDs = appendUnique(a.classIDs, c.ID)
+		}
+	}
+	// Only the classes of the user's school
+	kept := a.classIDs[:0]
+	for _, id := range a.classIDs {
+		if _, ok := a.classes[id]; ok {
+			kept = append(kept, id)
+		}
+	}
+	a.classIDs = kept
+
+	subjects, err := s.directory.GetSubjects(user.SchoolID)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range subjects {
+		a.subjects[sub.ID] = sub.Name
+	}
+	return a, nil
+}
+
+// timetable repeats weekly the lessons of the teacher, or of the classes of
+// the students, for each timetable version still valid.
+func (s *CalendarService) timetable(a *audience, now time.Time) ([]domain.CalendarEvent, error) {
+	if a.user.Role != domain.RoleTeacher && len(a.classIDs) == 0 {
+		return nil, nil
+	}
+	schedules, err := s.repo.GetSchedules(a.user.SchoolID, now)
+	if err != nil {
+		return nil, err
+	}
+	hours, err := s.lessonHours(a.user.SchoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []domain.CalendarEvent
+	for _, sch := range schedules {
+		class, ok := a.classes[sch.ClassID]
+		if !ok {
+			continue
+		}
+		ownClass := containsUint(a.classIDs, sch.ClassID)
+		for _, item := range sch.Data.Items {
+			if a.user.Role == domain.RoleTeacher {
+				if item.TeacherID != a.user.ID {
+					continue
+				}
+			} else if !ownClass {
+				continue
+			}
+			start, end, ok := lessonTime(hours, item.Hour)
+			if !ok {
+				continue
+			}
+			first, ok := firstWeekday(sch.ValidFrom, item.Day)
+			if !ok {
+				continue
+			}
+			room := item.Room
+			if room == "" {
+				room = class.Room
+			}
+			ev := domain.CalendarEvent{
+				UID:      fmt.Sprintf("timetable-%d-%s-%d@iregistro", sch.ID, strings.ToLower(string(item.Day)), item.Hour),
+				Summary:  a.subjects[item.SubjectID] + " - " + className(class),
+				Location: room,
+				Start:    atClock(first, start),
+				End:      atClock(first, end),
+				Weekly:   true,
+			}
+			if sch.ValidTo != nil {
+				until := atClock(*sch.ValidTo, 24*60-1)
+				ev.Until = &until
+			}
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
+
+// colloquiums returns the booked colloquiums of a teacher or parent.
+func (s *CalendarService) colloquiums(a *audience, from, to time.Time) ([]domain.CalendarEvent, error) {
+	var events []domain.CalendarEvent
+	switch a.user.Role {
+	case domain.RoleTeacher:
+		slots, err := s.repo.GetTeacherColloquiums(a.user.ID, dateOf(from), dateOf(to))
+		if err != nil {
+			return nil, err
+		}
+		staff, err := usersByID(s.users, a.user.SchoolID)
+		if err != nil {
+			return nil, err
+		}
+		for i := range slots {
+			var parents []string
+			for _, b := range slots[i].Bookings {
+				if p, ok := staff[b.ParentID]; ok {
+					parents = append(parents, fullName(p))
+				}
+			}
+			summary := a.texts.colloquium
+			if len(parents) > 0 {
+				summary = fmt.Sprintf(a.texts.colloquiumWith, strings.Join(parents, ", "))
+			}
+			if ev, ok := colloquiumEvent(a, &slots[i], summary); ok {
+				events = append(events, ev)
+			}
+		}
+	case domain.RoleParent:
+		bookings, err := s.repo.GetParentColloquiums(a.user.ID, dateOf(from), dateOf(to))
+		if err != nil {
+			return nil, err
+		}
+		staff, err := usersByID(s.users, a.user.SchoolID)
+		if err != nil {
+			return nil, err
+		}
+		for i := range bookings {
+			summary := a.texts.colloquium
+			if t, ok := staff[bookings[i].Slot.TeacherID]; ok {
+				summary = fmt.Sprintf(a.texts.colloquiumWith, fullName(t))
+			}
+			if ev, ok := colloquiumEvent(a, &bookings[i].Slot, summary); ok {
+				events = append(events, ev)
+			}
+		}
+	}
+	return events, nil
+}
+
+func colloquiumEvent(a *audience, slot *domain.ColloquiumSlot, summary string) (domain.CalendarEvent, bool) {
+	start, err1 := parseClock(slot.StartTime)
+	end, err2 := parseClock(slot.EndTime)
+	if err1 != nil || err2 != nil {
+		return domain.CalendarEvent{}, false
+	}
+	ev := domain.CalendarEvent{
+		UID:     fmt.Sprintf("colloquium-%d@iregistro", slot.ID),
+		Summary: summary,
+		Start:   atClock(slot.Date, start),
+		End:     atClock(slot.Date, end),
+	}
+	switch slot.Mode {
+	case domain.ColloquiumOnline:
+		ev.Location = a.texts.online
+		ev.Description = slot.MeetingURL
+	case domain.ColloquiumPhone:
+		ev.Location = a.texts.phone
+	}
+	return ev, true
+}
+
+// homework returns the homework due by the classes, and for teachers the
+// homework they set.
+func (s *CalendarService) homework(a *audience, from, to time.Time) ([]domain.CalendarEvent, error) {
+	var teacherID uint
+	switch a.user.Role {
+	case domain.RoleTeacher:
+		teacherID = a.user.ID
+	case domain.RoleStudent, domain.RoleParent:
+		if len(a.classIDs) == 0 {
+			return nil, nil
+		}
+	default:
+		return nil, nil
+	}
+	homework, err := s.repo.GetHomework(a.classIDs, teacherID, dateOf(from), dateOf(to))
+	if err != nil {
+		return nil, err
+	}
+	events := make([]domain.CalendarEvent, 0, len(homework))
+	for _, h := range homework {
+		summary := fmt.Sprintf(a.texts.homework, a.subjects[h.SubjectID], h.Title)
+		if c, ok := a.classes[h.ClassID]; ok && a.user.Role != domain.RoleStudent {
+			summary += " - " + className(c)
+		}
+		events = append(events, domain.CalendarEvent{
+			UID:         fmt.Sprintf("homework-%d@iregistro", h.ID),
+			Summary:     summary,
+			Description: h.Description,
+			Start:       dateOf(h.DueDate),
+			End:         dateOf(h.DueDate).AddDate(0, 0, 1),
+			AllDay:      true,
+		})
+	}
+	return events, nil
+}
+
+func (s *CalendarService) schoolEvents(a *audience, from, to time.Time) ([]domain.CalendarEvent, error) {
+	list, err := s.repo.GetSchoolEvents(a.user.SchoolID, a.classIDs, from, to)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]domain.CalendarEvent, 0, len(list))
+	for _, e := range list {
+		ev := domain.CalendarEvent{
+			UID:         fmt.Sprintf("event-%d@iregistro", e.ID),
+			Summary:     e.Title,
+			Description: e.Description,
+			Location:    e.Location,
+			Start:       e.StartsAt,
+			End:         e.EndsAt,
+			AllDay:      e.AllDay,
+		}
+		if e.AllDay {
+			ev.Start = dateOf(e.StartsAt.In(schoolLocation))
+			ev.End = dateOf(e.EndsAt.In(schoolLocation)).AddDate(0, 0, 1)
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// --- Homework and events ---
+
+// AssignHomework records homework set by teacherID, who must teach the
+// subject in the class.
+func (s *CalendarService) AssignHomework(teacherID uint, req HomeworkRequest) (*domain.Homework, error) {
+	due, err := time.Parse("2006-01-02", req.DueDate)
+	if err != nil {
+		return nil, fmt.Errorf("%w: due date must be YYYY-MM-DD", ErrInvalidHomework)
+	}
+	if strings.TrimSpace(req.Title) == "" {
+		return nil, fmt.Errorf("%w: title required", ErrInvalidHomework)
+	}
+	assignments, err := s.directory.GetAssignmentsByTeacherID(teacherID)
+	if err != nil {
+		return nil, err
+	}
+	var schoolID uint
+	for _, as := range assignments {
+		if as.ClassID == req.ClassID && as.SubjectID == req.SubjectID && (as.EndDate == nil || as.EndDate.After(time.Now())) {
+			if as.Class != nil {
+				schoolID = as.Class.SchoolID
+			}
+			break
+		}
+	}
+	if schoolID == 0 {
+		return nil, ErrNotAllowed
+	}
+
+	homework := &domain.Homework{
+		SchoolID:    schoolID,
+		ClassID:     req.ClassID,
+		SubjectID:   req.SubjectID,
+		TeacherID:   teacherID,
+		Title:       strings.TrimSpace(req.Title),
+		Description: req.Description,
+		DueDate:     due,
+	}
+	if err := s.repo.CreateHomework(homework); err != nil {
+		return nil, err
+	}
+	return homework, nil
+}
+
+// CreateEvent adds an event to the calendar of the school of actorID, a
+// principal, admin or secretary.
+func (s *CalendarService) CreateEvent(actorID uint, req EventRequest) (*domain.SchoolEvent, error) {
+	actor, err := s.users.FindByID(actorID)
+	if err != nil {
+		return nil, err
+	}
+	if actor == nil || (actor.Role != domain.RolePrincipal && actor.Role != domain.RoleAdmin && actor.Role != domain.RoleSecretary) {
+		return nil, ErrNotAllowed
+	}
+	if strings.TrimSpace(req.Title) == "" {
+		return nil, fmt.Errorf("%w: title required", ErrInvalidEvent)
+	}
+	if req.EndsAt.Before(req.StartsAt) {
+		return nil, fmt.Errorf("%w: ends before it starts", ErrInvalidEvent)
+	}
+	if req.ClassID != nil {
+		classes, err := s.directory.GetClassesBySchoolID(actor.SchoolID)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, c := range classes {
+			found = found || c.ID == *req.ClassID
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: unknown class %d", ErrInvalidEvent, *req.ClassID)
+		}
+	}
+
+	event := &domain.SchoolEvent{
+		SchoolID:    actor.SchoolID,
+		ClassID:     req.ClassID,
+		Title:       strings.TrimSpace(req.Title),
+		Description: req.Description,
+		Location:    req.Location,
+		StartsAt:    req.StartsAt,
+		EndsAt:      req.EndsAt,
+		AllDay:      req.AllDay,
+		CreatedBy:   actorID,
+	}
+	if err := s.repo.CreateSchoolEvent(event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+func className(c domain.Class) string {
+	return fmt.Sprintf("%d%s", c.Grade, c.Section)
+}
+
+func fullName(u *domain.User) string {
+	return strings.TrimSpace(u.FirstName + " " + u.LastName)
+}
+
+func usersByID(users domain.UserRepository, schoolID uint) (map[uint]*domain.User, error) {
+	all, err := users.FindAll(schoolID)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]*domain.User, len(all))
+	for i := range all {
+		byID[all[i].ID] = &all[i]
+	}
+	return byID, nil
+}
+
+func containsUint(ids []uint, id uint) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func appendUnique(ids []uint, id uint) []uint {
+	if containsUint(ids, id) {
+		return ids
+	}
+	return append(ids, id)
+}
@@ -0,0 +1,359 @@
+package calendar
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type MockUserRepo struct {
+	users map[uint]*domain.User
+}
+
+func (m *MockUserRepo) Create(user *domain.User) error                 { return nil }
+func (m *MockUserRepo) FindByEmail(email string) (*domain.User, error) { return nil, nil }
+func (m *MockUserRepo) FindByID(id uint) (*domain.User, error)         { return m.users[id], nil }
+func (m *MockUserRepo) FindAll(schoolID uint) ([]domain.User, error) {
+	var users []domain.User
+	for _, u := range m.users {
+		if u.SchoolID == schoolID {
+			users = append(users, *u)
+		}
+	}
+	return users, nil
+}
+func (m *MockUserRepo) Delete(id uint) error                                  { return nil }
+func (m *MockUserRepo) Update(user *domain.User) error                        { return nil }
+func (m *MockUserRepo) CountAll() (int64, error)                              { return 0, nil }
+func (m *MockUserRepo) CountBySchoolAndRole(uint, domain.Role) (int64, error) { return 0, nil }
+func (m *MockUserRepo) GetByExternalID(ctx context.Context, externalID string) (*domain.User, error) {
+	return nil, nil
+}
+
+// memoryCalendar keeps the calendar data in memory, filtering as the
+// repository does.
+type memoryCalendar struct {
+	tokens      []domain.CalendarToken
+	homework    []domain.Homework
+	events      []domain.SchoolEvent
+	schedules   []domain.Schedule
+	slots       []domain.ColloquiumSlot
+	bookings    []domain.ColloquiumBooking
+	settings    []domain.SchoolSettings
+	students    []domain.Student
+	enrollments map[uint][]uint // Student -> classes
+	assignments []domain.ClassSubjectAssignment
+	classes     []domain.Class
+}
+
+func (m *memoryCalendar) CreateCalendarToken(token *domain.CalendarToken) error {
+	token.ID = uint(len(m.tokens) + 1)
+	m.tokens = append(m.tokens, *token)
+	return nil
+}
+func (m *memoryCalendar) GetCalendarTokenByHash(hash string) (*domain.CalendarToken, error) {
+	for i := range m.tokens {
+		if m.tokens[i].TokenHash == hash {
+			t := m.tokens[i]
+			return &t, nil
+		}
+	}
+	return nil, nil
+}
+func (m *memoryCalendar) GetCalendarTokensByUserID(userID uint) ([]domain.CalendarToken, error) {
+	var tokens []domain.CalendarToken
+	for _, t := range m.tokens {
+		if t.UserID == userID && t.RevokedAt == nil {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens, nil
+}
+func (m *memoryCalendar) RevokeCalendarToken(id, userID uint, at time.Time) (bool, error) {
+	for i := range m.tokens {
+		if t := &m.tokens[i]; t.ID == id && t.UserID == userID && t.RevokedAt == nil {
+			t.RevokedAt = &at
+			return true, nil
+		}
+	}
+	return false, nil
+}
+func (m *memoryCalendar) TouchCalendarToken(id uint, at time.Time) error { return nil }
+func (m *memoryCalendar) CreateHomework(h *domain.Homework) error {
+	h.ID = uint(len(m.homework) + 1)
+	m.homework = append(m.homework, *h)
+	return nil
+}
+func (m *memoryCalendar) GetHomework(classIDs []uint, teacherID uint, from, to time.Time) ([]domain.Homework, error) {
+	var found []domain.Homework
+	for _, h := range m.homework {
+		if (containsUint(classIDs, h.ClassID) || (teacherID != 0 && h.TeacherID == teacherID)) && !h.DueDate.Before(from) && !h.DueDate.After(to) {
+			found = append(found, h)
+		}
+	}
+	return found, nil
+}
+func (m *memoryCalendar) CreateSchoolEvent(e *domain.SchoolEvent) error {
+	e.ID = uint(len(m.events) + 1)
+	m.events = append(m.events, *e)
+	return nil
+}
+func (m *memoryCalendar) GetSchoolEvents(schoolID uint, classIDs []uint, from, to time.Time) ([]domain.SchoolEvent, error) {
+	var found []domain.SchoolEvent
+	for _, e := range m.events {
+		if e.SchoolID == schoolID && (e.ClassID == nil || containsUint(classIDs, *e.ClassID)) && !e.EndsAt.Before(from) && !e.StartsAt.After(to) {
+			found = append(found, e)
+		}
+	}
+	return found, nil
+}
+func (m *memoryCalendar) GetSchedules(schoolID uint, at time.Time) ([]domain.Schedule, error) {
+	return m.schedules, nil
+}
+func (m *memoryCalendar) GetTeacherColloquiums(teacherID uint, from, to time.Time) ([]domain.ColloquiumSlot, error) {
+	var found []domain.ColloquiumSlot
+	for _, s := range m.slots {
+		if s.TeacherID == teacherID && len(s.Bookings) > 0 {
+			found = append(found, s)
+		}
+	}
+	return found, nil
+}
+func (m *memoryCalendar) GetParentColloquiums(parentID uint, from, to time.Time) ([]domain.ColloquiumBooking, error) {
+	var found []domain.ColloquiumBooking
+	for _, b := range m.bookings {
+		if b.ParentID == parentID {
+			found = append(found, b)
+		}
+	}
+	return found, nil
+}
+
+// Directory and settings
+func (m *memoryCalendar) GetStudentsByParentID(parentID uint) ([]domain.Student, error) {
+	var found []domain.Student
+	for _, s := range m.students {
+		if (s.Parent1ID != nil && *s.Parent1ID == parentID) || (s.Parent2ID != nil && *s.Parent2ID == parentID) {
+			found = append(found, s)
+		}
+	}
+	return found, nil
+}
+func (m *memoryCalendar) GetStudentByUserID(userID uint) (*domain.Student, error) {
+	for i := range m.students {
+		if s := m.students[i]; s.UserID != nil && *s.UserID == userID {
+			return &s, nil
+		}
+	}
+	return nil, nil
+}
+func (m *memoryCalendar) GetStudentClassIDs(studentID uint) ([]uint, error) {
+	return m.enrollments[studentID], nil
+}
+func (m *memoryCalendar) GetAssignmentsByTeacherID(teacherID uint) ([]domain.ClassSubjectAssignment, error) {
+	var found []domain.ClassSubjectAssignment
+	for _, a := range m.assignments {
+		if a.TeacherID == teacherID {
+			found = append(found, a)
+		}
+	}
+	return found, nil
+}
+func (m *memoryCalendar) GetClassesBySchoolID(schoolID uint) ([]domain.Class, error) {
+	var found []domain.Class
+	for _, c := range m.classes {
+		if c.SchoolID == schoolID {
+			found = append(found, c)
+		}
+	}
+	return found, nil
+}
+func (m *memoryCalendar) GetSubjects(schoolID uint) ([]domain.Subject, error) {
+	return []domain.Subject{{ID: 1, Name: "Matematica"}, {ID: 2, Name: "Storia"}}, nil
+}
+func (m *memoryCalendar) GetSchoolSettings(schoolID uint) ([]domain.SchoolSettings, error) {
+	return m.settings, nil
+}
+
+func uintPtr(v uint) *uint { return &v }
+
+func newCalendarFixture() (*CalendarService, *memoryCalendar) {
+	users := &MockUserRepo{users: map[uint]*domain.User{
+		2:  {ID: 2, SchoolID: 7, Role: domain.RolePrincipal},
+		10: {ID: 10, SchoolID: 7, Role: domain.RoleTeacher, FirstName: "Maria", LastName: "Verdi"},
+		11: {ID: 11, SchoolID: 7, Role: domain.RoleTeacher},
+		20: {ID: 20, SchoolID: 7, Role: domain.RoleParent, FirstName: "Anna", LastName: "Rossi", Locale: "en"},
+		30: {ID: 30, SchoolID: 7, Role: domain.RoleStudent},
+	}}
+	class5 := domain.Class{ID: 5, SchoolID: 7, Grade: 3, Section: "A", Room: "Aula 12"}
+	validTo := time.Date(2027, 6, 10, 0, 0, 0, 0, time.UTC)
+	mem := &memoryCalendar{
+		classes: []domain.Class{class5, {ID: 6, SchoolID: 7, Grade: 4, Section: "B"}, {ID: 9, SchoolID: 8, Grade: 1, Section: "C"}},
+		students: []domain.Student{
+			{ID: 40, SchoolID: 7, FirstName: "Luca", Parent1ID: uintPtr(20), UserID: uintPtr(30)},
+			{ID: 41, SchoolID: 8, FirstName: "Elsewhere", Parent2ID: uintPtr(20)},
+		},
+		enrollments: map[uint][]uint{40: {5}, 41: {9}},
+		assignments: []domain.ClassSubjectAssignment{
+			{ClassID: 5, SubjectID: 1, TeacherID: 10, Class: &class5},
+			{ClassID: 6, SubjectID: 2, TeacherID: 10, EndDate: &time.Time{}}, // Ended
+		},
+		schedules: []domain.Schedule{{
+			ID: 3, ClassID: 5, ValidFrom: time.Date(2026, 9, 14, 0, 0, 0, 0, time.UTC), ValidTo: &validTo,
+			Data: domain.ScheduleData{Items: []domain.ScheduleItem{
+				{Day: domain.Wednesday, Hour: 2, SubjectID: 1, TeacherID: 10},
+				{Day: domain.Friday, Hour: 1, SubjectID: 2, TeacherID: 11, Room: "Lab"},
+			}},
+		}, {
+			ID: 4, ClassID: 6, ValidFrom: time.Date(2026, 9, 14, 0, 0, 0, 0, time.UTC),
+			Data: domain.ScheduleData{Items: []domain.ScheduleItem{{Day: domain.Monday, Hour: 1, SubjectID: 2, TeacherID: 11}}},
+		}},
+		settings: []domain.SchoolSettings{{SchoolID: 7, Key: TimetableSettingsKey, Value: domain.JSONMap{"hours": []interface{}{
+			map[string]interface{}{"start": "08:00", "end": "08:50"},
+			map[string]interface{}{"start": "08:50", "end": "09:40"},
+		}}}},
+	}
+	return NewCalendarService(mem, users, mem, mem), mem
+}
+
+func feedOf(t *testing.T, svc *CalendarService, userID uint, feeds []Feed, now time.Time) []domain.CalendarEvent {
+	_, secret, err := svc.CreateToken(userID, "phone")
+	require.NoError(t, err)
+	_, events, err := svc.Feed(secret, feeds, now)
+	require.NoError(t, err)
+	return events
+}
+
+func uids(events []domain.CalendarEvent) []string {
+	var ids []string
+	for _, e := range events {
+		ids = append(ids, e.UID)
+	}
+	return ids
+}
+
+func TestCalendarTokens(t *testing.T) {
+	svc, _ := newCalendarFixture()
+	now := time.Now()
+
+	token, secret, err := svc.CreateToken(10, " Phone ")
+	require.NoError(t, err)
+	assert.Equal(t, "Phone", token.Name)
+	assert.NotContains(t, token.TokenHash, secret)
+	name, _, err := svc.Feed(secret, AllFeeds, now)
+	require.NoError(t, err)
+	assert.Equal(t, "iRegistro - Maria Verdi", name)
+
+	assert.ErrorIs(t, svc.RevokeToken(11, token.ID), ErrTokenNotFound, "not their token")
+	require.NoError(t, svc.RevokeToken(10, token.ID))
+	_, _, err = svc.Feed(secret, AllFeeds, now)
+	assert.ErrorIs(t, err, ErrTokenNotFound, "revoked")
+	_, _, err = svc.Feed("guess", AllFeeds, now)
+	assert.ErrorIs(t, err, ErrTokenNotFound)
+
+	for i := 0; i < maxTokensPerUser; i++ {
+		_, _, err = svc.CreateToken(11, "")
+		require.NoError(t, err)
+	}
+	_, _, err = svc.CreateToken(11, "")
+	assert.ErrorIs(t, err, ErrTooManyTokens)
+
+	_, err = ParseFeeds("timetable, homework")
+	assert.NoError(t, err)
+	_, err = ParseFeeds("timetable,grades")
+	assert.ErrorIs(t, err, ErrUnknownFeed)
+}
+
+func TestTimetableFeed(t *testing.T) {
+	svc, _ := newCalendarFixture()
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, schoolLocation)
+
+	// The teacher sees their lessons, in any class
+	events := feedOf(t, svc, 10, []Feed{FeedTimetable}, now)
+	require.Len(t, events, 1)
+	lesson := events[0]
+	assert.Equal(t, "timetable-3-wednesday-2@iregistro", lesson.UID)
+	assert.Equal(t, "Matematica - 3A", lesson.Summary)
+	assert.Equal(t, "Aula 12", lesson.Location, "the class room by default")
+	assert.Equal(t, time.Date(2026, 9, 16, 8, 50, 0, 0, schoolLocation), lesson.Start, "first Wednesday from the start of validity")
+	assert.Equal(t, time.Date(2026, 9, 16, 9, 40, 0, 0, schoolLocation), lesson.End)
+	assert.True(t, lesson.Weekly)
+	require.NotNil(t, lesson.Until)
+	assert.Equal(t, time.Date(2027, 6, 10, 23, 59, 0, 0, schoolLocation), *lesson.Until)
+
+	// Students and their parents see the lessons of the class
+	assert.ElementsMatch(t, []string{"timetable-3-wednesday-2@iregistro", "timetable-3-friday-1@iregistro"}, uids(feedOf(t, svc, 30, []Feed{FeedTimetable}, now)))
+	assert.ElementsMatch(t, []string{"timetable-3-wednesday-2@iregistro", "timetable-3-friday-1@iregistro"}, uids(feedOf(t, svc, 20, []Feed{FeedTimetable}, now)))
+	assert.Len(t, feedOf(t, svc, 2, []Feed{FeedTimetable}, now), 3, "the principal sees every class")
+}
+
+func TestFeedHonoursGuardianship(t *testing.T) {
+	svc, mem := newCalendarFixture()
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, schoolLocation)
+	due := time.Date(2026, 10, 22, 0, 0, 0, 0, time.UTC)
+	mem.homework = []domain.Homework{
+		{ID: 1, ClassID: 5, SubjectID: 1, TeacherID: 10, Title: "Esercizi p. 12", DueDate: due},
+		{ID: 2, ClassID: 6, SubjectID: 2, TeacherID: 11, Title: "Capitolo 3", DueDate: due},
+		{ID: 3, ClassID: 9, SubjectID: 2, TeacherID: 12, Title: "Other school", DueDate: due},
+	}
+	mem.events = []domain.SchoolEvent{
+		{ID: 1, SchoolID: 7, Title: "Open day", StartsAt: now.AddDate(0, 0, 3), EndsAt: now.AddDate(0, 0, 3).Add(2 * time.Hour)},
+		{ID: 2, SchoolID: 7, ClassID: uintPtr(5), Title: "Gita", StartsAt: now.AddDate(0, 0, 10), EndsAt: now.AddDate(0, 0, 11), AllDay: true},
+		{ID: 3, SchoolID: 7, ClassID: uintPtr(6), Title: "Teatro", StartsAt: now, EndsAt: now.Add(time.Hour)},
+		{ID: 4, SchoolID: 8, Title: "Other school", StartsAt: now, EndsAt: now.Add(time.Hour)},
+	}
+	mem.bookings = []domain.ColloquiumBooking{{ID: 1, ParentID: 20, StudentID: 40, Status: domain.BookingConfirmed,
+		Slot: domain.ColloquiumSlot{ID: 8, TeacherID: 10, Date: time.Date(2026, 10, 27, 0, 0, 0, 0, time.UTC), StartTime: "16:00", EndTime: "16:15",
+			Mode: domain.ColloquiumOnline, MeetingURL: "https://meet.example.org/room"}}}
+	mem.slots = []domain.ColloquiumSlot{{ID: 8, TeacherID: 10, Date: time.Date(2026, 10, 27, 0, 0, 0, 0, time.UTC), StartTime: "16:00", EndTime: "16:15",
+		Bookings: []domain.ColloquiumBooking{{ID: 1, ParentID: 20}}}}
+
+	events := feedOf(t, svc, 20, []Feed{FeedColloquiums, FeedHomework, FeedEvents}, now)
+	assert.Equal(t, []string{"colloquium-8@iregistro", "homework-1@iregistro", "event-1@iregistro", "event-2@iregistro"}, uids(events),
+		"only the classes of their children at the school")
+	assert.Equal(t, "Colloquium with Maria Verdi", events[0].Summary, "in the parent's language")
+	assert.Equal(t, "https://meet.example.org/room", events[0].Description)
+	assert.Equal(t, time.Date(2026, 10, 27, 16, 0, 0, 0, schoolLocation), events[0].Start)
+	assert.Equal(t, "Matematica homework: Esercizi p. 12 - 3A", events[1].Summary)
+	assert.True(t, events[1].AllDay)
+	assert.Equal(t, due.AddDate(0, 0, 1), events[1].End)
+	assert.Equal(t, now.AddDate(0, 0, 12).Format("2006-01-02"), events[3].End.Format("2006-01-02"), "all-day events end the day after")
+
+	// The teacher: their colloquiums, the homework of their classes
+	events = feedOf(t, svc, 10, []Feed{FeedColloquiums, FeedHomework}, now)
+	assert.Equal(t, []string{"colloquium-8@iregistro", "homework-1@iregistro"}, uids(events))
+	assert.Equal(t, "Colloquio con Anna Rossi", events[0].Summary)
+
+	// The principal sees the events of every class
+	assert.Equal(t, []string{"event-1@iregistro", "event-2@iregistro", "event-3@iregistro"}, uids(feedOf(t, svc, 2, []Feed{FeedEvents}, now)))
+}
+
+func TestAssignHomeworkAndEvents(t *testing.T) {
+	svc, mem := newCalendarFixture()
+
+	homework, err := svc.AssignHomework(10, HomeworkRequest{ClassID: 5, SubjectID: 1, Title: "Esercizi", DueDate: "2026-10-22"})
+	require.NoError(t, err)
+	assert.Equal(t, uint(7), homework.SchoolID)
+	_, err = svc.AssignHomework(10, HomeworkRequest{ClassID: 5, SubjectID: 2, Title: "Esercizi", DueDate: "2026-10-22"})
+	assert.ErrorIs(t, err, ErrNotAllowed, "not their subject")
+	_, err = svc.AssignHomework(10, HomeworkRequest{ClassID: 6, SubjectID: 2, Title: "Esercizi", DueDate: "2026-10-22"})
+	assert.ErrorIs(t, err, ErrNotAllowed, "no longer their class")
+	_, err = svc.AssignHomework(10, HomeworkRequest{ClassID: 5, SubjectID: 1, Title: "Esercizi", DueDate: "22/10/2026"})
+	assert.ErrorIs(t, err, ErrInvalidHomework)
+	assert.Len(t, mem.homework, 1)
+
+	start := time.Date(2026, 12, 23, 0, 0, 0, 0, schoolLocation)
+	event, err := svc.CreateEvent(2, EventRequest{Title: "Vacanze", StartsAt: start, EndsAt: start.AddDate(0, 0, 14), AllDay: true})
+	require.NoError(t, err)
+	assert.Equal(t, uint(7), event.SchoolID)
+	_, err = svc.CreateEvent(10, EventRequest{Title: "Vacanze", StartsAt: start, EndsAt: start})
+	assert.ErrorIs(t, err, ErrNotAllowed)
+	_, err = svc.CreateEvent(2, EventRequest{Title: "Gita", ClassID: uintPtr(9), StartsAt: start, EndsAt: start})
+	assert.ErrorIs(t, err, ErrInvalidEvent, "class of another school")
+	_, err = svc.CreateEvent(2, EventRequest{Title: "Gita", StartsAt: start, EndsAt: start.Add(-time.Hour)})
+	assert.ErrorIs(t, err, ErrInvalidEvent)
+}
@@ -0,0 +1,107 @@
+package calendar
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+)
+
+// schoolLocation is the time zone of timetables and colloquiums.
+var schoolLocation = func() *time.Location {
+	loc, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}()
+
+var weekdays = map[domain.WeekDay]time.Weekday{
+	domain.Monday:    time.Monday,
+	domain.Tuesday:   time.Tuesday,
+	domain.Wednesday: time.Wednesday,
+	domain.Thursday:  time.Thursday,
+	domain.Friday:    time.Friday,
+	domain.Saturday:  time.Saturday,
+	domain.Sunday:    time.Sunday,
+}
+
+// lessonHour is the time of a lesson hour, in minutes since midnight.
+type lessonHour struct {
+	start, end int
+}
+
+// lessonHours returns the lesson hours of the school's timetable setting, or
+// nil to use the default ones.
+func (s *CalendarService) lessonHours(schoolID uint) ([]lessonHour, error) {
+	settings, err := s.settings.GetSchoolSettings(schoolID)
+	if err != nil {
+		return nil, err
+	}
+	for _, setting := range settings {
+		if setting.Key != TimetableSettingsKey {
+			continue
+		}
+		raw, _ := setting.Value["hours"].([]interface{})
+		hours := make([]lessonHour, 0, len(raw))
+		for i, h := range raw {
+			m, _ := h.(map[string]interface{})
+			start, _ := m["start"].(string)
+			end, _ := m["end"].(string)
+			from, err1 := parseClock(start)
+			to, err2 := parseClock(end)
+			if err1 != nil || err2 != nil || to <= from {
+				return nil, fmt.Errorf("%w: hour %d", errInvalidTimetable, i+1)
+			}
+			hours = append(hours, lessonHour{from, to})
+		}
+		return hours, nil
+	}
+	return nil, nil
+}
+
+// lessonTime returns the start and end of lesson hour n, from 1.
+func lessonTime(hours []lessonHour, n int) (int, int, bool) {
+	if n < 1 {
+		return 0, 0, false
+	}
+	if hours == nil {
+		start := 8*60 + (n-1)*60
+		return start, start + 60, start+60 <= 24*60
+	}
+	if n > len(hours) {
+		return 0, 0, false
+	}
+	return hours[n-1].start, hours[n-1].end, true
+}
+
+// firstWeekday returns the first day on or after from that is day.
+func firstWeekday(from time.Time, day domain.WeekDay) (time.Time, bool) {
+	wd, ok := weekdays[day]
+	if !ok {
+		return time.Time{}, false
+	}
+	d := dateOf(from)
+	return d.AddDate(0, 0, (int(wd)-int(d.Weekday())+7)%7), true
+}
+
+// dateOf returns the date of t at midnight UTC, as stored in date columns.
+func dateOf(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// atClock returns the given minutes since midnight on day's date, in school
+// time.
+func atClock(day time.Time, minutes int) time.Time {
+	y, m, d := day.Date()
+	return time.Date(y, m, d, minutes/60, minutes%60, 0, 0, schoolLocation)
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
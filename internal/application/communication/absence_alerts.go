@@ -0,0 +1,146 @@
+package communication
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/k/iRegistro/internal/tenant"
+	"go.uber.org/zap"
+)
+
+// absenceAlertWindow is how long after the alert time absences still trigger
+// an alert, covering registers filled in late. Later in the day the parents
+// are better served by the regular notifications.
+const absenceAlertWindow = 3 * time.Hour
+
+type absenceReader interface {
+	GetAbsencesBySchoolID(schoolID uint, date time.Time) ([]domain.Absence, error)
+	GetStudentByID(ctx context.Context, id uint) (*domain.Student, error)
+}
+
+type schoolSettingsFinder interface {
+	GetSchoolSettingsByKey(key string) ([]domain.SchoolSettings, error)
+}
+
+var absenceAlertTexts = map[string]struct{ title, body string }{
+	"it": {"Assenza", "%s %s risulta assente alla prima ora di oggi, %s. Se non ne eravate al corrente contattate la scuola."},
+	"en": {"Absence", "%s %s was absent at the first hour today, %s. If you were not aware of it, please contact the school."},
+}
+
+// AbsenceAlertService texts the parents of the students absent at the first
+// hour without prior notice, at the time each school configured in its SMS
+// settings.
+type AbsenceAlertService struct {
+	repo     domain.CommunicationRepository
+	academic absenceReader
+	settings schoolSettingsFinder
+	users    domain.UserRepository
+	notif    *NotificationService
+}
+
+func NewAbsenceAlertService(repo domain.CommunicationRepository, academic absenceReader, settings schoolSettingsFinder, users domain.UserRepository, notif *NotificationService) *AbsenceAlertService {
+	return &AbsenceAlertService{repo: repo, academic: academic, settings: settings, users: users, notif: notif}
+}
+
+// SendDue alerts the schools whose alert time has come, once per student and
+// day, acting on each school in turn. It returns the number of students the
+// parents were alerted of.
+func (s *AbsenceAlertService) SendDue(ctx context.Context, now time.Time) (int, error) {
+	settings, err := s.settings.GetSchoolSettingsByKey(SMSSettingsKey)
+	if err != nil {
+		return 0, err
+	}
+
+	local := now.In(schoolLocation)
+	sent := 0
+	for _, setting := range settings {
+		cfg, err := ParseSMSSettings(setting.Value)
+		if err != nil || !cfg.AbsenceAlerts {
+			continue
+		}
+		minutes, _ := parseClock(cfg.AbsenceAlertTime)
+		at := atClock(local, minutes)
+		if local.Before(at) || !local.Before(at.Add(absenceAlertWindow)) {
+			continue
+		}
+		n, err := s.alertSchool(tenant.School(ctx, setting.SchoolID), setting.SchoolID, local)
+		if err != nil {
+			zap.L().Error("Failed to send absence alerts", zap.Uint("school_id", setting.SchoolID), zap.Error(err))
+		}
+		sent += n
+	}
+	return sent, nil
+}
+
+func (s *AbsenceAlertService) alertSchool(ctx context.Context, schoolID uint, day time.Time) (int, error) {
+	absences, err := s.academic.GetAbsencesBySchoolID(schoolID, day)
+	if err != nil {
+		return 0, err
+	}
+
+	// Students who arrived late, or whose late entrance was authorised,
+	// are not missing
+	excused := make(map[uint]bool)
+	for _, a := range absences {
+		if a.Type == domain.AbsenceLate || a.Type == domain.AbsenceExcused {
+			excused[a.StudentID] = true
+		}
+	}
+
+	sent := 0
+	date := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	for _, a := range absences {
+		if a.Type != domain.AbsenceFull || a.Hour > 1 || a.IsJustified || excused[a.StudentID] {
+			continue
+		}
+		excused[a.StudentID] = true
+
+		student, err := s.academic.GetStudentByID(ctx, a.StudentID)
+		if err != nil || student == nil {
+			zap.L().Warn("Cannot alert absence, student not found", zap.Uint("student_id", a.StudentID), zap.Error(err))
+			continue
+		}
+		var parents []uint
+		for _, id := range []*uint{student.Parent1ID, student.Parent2ID} {
+			if id != nil && *id != 0 {
+				parents = append(parents, *id)
+			}
+		}
+		if len(parents) == 0 {
+			continue
+		}
+
+		created, err := s.repo.CreateAbsenceAlert(&domain.AbsenceAlert{SchoolID: schoolID, StudentID: student.ID, Date: date})
+		if err != nil {
+			return sent, err
+		}
+		if !created {
+			continue
+		}
+		for _, parentID := range parents {
+			s.alertParent(parentID, student, a, day)
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+func (s *AbsenceAlertService) alertParent(parentID uint, student *domain.Student, a domain.Absence, day time.Time) {
+	parent, err := s.users.FindByID(parentID)
+	if err != nil || parent == nil {
+		zap.L().Warn("Cannot alert absence, parent not found", zap.Uint("user_id", parentID), zap.Error(err))
+		return
+	}
+	text, ok := absenceAlertTexts[parent.Locale]
+	if !ok {
+		text = absenceAlertTexts[defaultLocale]
+	}
+	body := fmt.Sprintf(text.body, student.FirstName, student.LastName, day.Format("02/01/2006"))
+	data := domain.JSONMap{"student_id": student.ID, "absence_id": a.ID}
+
+	if err := s.notif.TriggerUrgentNotification(parentID, domain.NotifTypeAbsence, text.title, body, data, domain.ChannelSMS); err != nil {
+		zap.L().Warn("Failed to send absence alert", zap.Uint("user_id", parentID), zap.Uint("student_id", student.ID), zap.Error(err))
+	}
+}
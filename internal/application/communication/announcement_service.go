@@ -0,0 +1,294 @@
+package communication
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"go.uber.org/zap"
+)
+
+// announcementReminderInterval is the least time between two reminders of an
+// announcement, so that families are not flooded.
+const announcementReminderInterval = 12 * time.Hour
+
+var (
+	ErrAnnouncementNotFound = errors.New("announcement not found")
+	ErrInvalidAnnouncement  = errors.New("invalid announcement")
+	ErrReminderTooSoon      = errors.New("a reminder was sent recently")
+)
+
+var announcementReminderTitles = map[string]string{
+	"it": "Promemoria: %s",
+	"en": "Reminder: %s",
+}
+
+type announcementAudience interface {
+	GetClassIDsForUser(userID uint, role domain.Role) ([]uint, error)
+	GetAnnouncementAudience(schoolID uint, scope domain.AnnouncementScope, targetID uint, includeStudents bool) ([]uint, error)
+}
+
+// AnnouncementRequest is a new announcement.
+type AnnouncementRequest struct {
+	Scope           domain.AnnouncementScope `json:"scope" binding:"required"`
+	TargetID        uint                     `json:"target_id"`
+	Title           string                   `json:"title" binding:"required"`
+	Body            string                   `json:"body" binding:"required"`
+	AllowReplies    bool                     `json:"allow_replies"`
+	IncludeStudents bool                     `json:"include_students"`
+}
+
+// AnnouncementReader is a recipient in the read confirmation dashboard.
+type AnnouncementReader struct {
+	UserID     uint       `json:"user_id"`
+	Name       string     `json:"name"`
+	Role       string     `json:"role"`
+	ReadAt     *time.Time `json:"read_at,omitempty"`
+	RemindedAt *time.Time `json:"reminded_at,omitempty"`
+}
+
+// AnnouncementReadStatus lists who has and has not read an announcement.
+type AnnouncementReadStatus struct {
+	Announcement *domain.Announcement `json:"announcement"`
+	Read         []AnnouncementReader `json:"read"`
+	Unread       []AnnouncementReader `json:"unread"`
+}
+
+// AnnouncementService publishes announcements to the families of a class,
+// grade, campus or school and tracks their reading.
+type AnnouncementService struct {
+	repo     domain.CommunicationRepository
+	users    domain.UserRepository
+	audience announcementAudience
+	notif    *NotificationService
+}
+
+func NewAnnouncementService(repo domain.CommunicationRepository, users domain.UserRepository, audience announcementAudience, notif *NotificationService) *AnnouncementService {
+	return &AnnouncementService{repo: repo, users: users, audience: audience, notif: notif}
+}
+
+// Publish sends an announcement of authorID to the recipients resolved from
+// the enrollments of its scope. Teachers only address the classes they
+// teach; principals and administrators address any part of their school.
+func (s *AnnouncementService) Publish(authorID uint, req AnnouncementRequest) (*domain.Announcement, error) {
+	req.Title, req.Body = strings.TrimSpace(req.Title), strings.TrimSpace(req.Body)
+	if req.Title == "" || req.Body == "" {
+		return nil, fmt.Errorf("%w: title and body are required", ErrInvalidAnnouncement)
+	}
+	switch req.Scope {
+	case domain.ScopeClass, domain.ScopeCampus:
+		if req.TargetID == 0 {
+			return nil, fmt.Errorf("%w: %s announcements need a target_id", ErrInvalidAnnouncement, req.Scope)
+		}
+	case domain.ScopeGrade:
+		if req.TargetID < 1 || req.TargetID > 5 {
+			return nil, fmt.Errorf("%w: grade must be between 1 and 5", ErrInvalidAnnouncement)
+		}
+	case domain.ScopeSchool:
+		req.TargetID = 0
+	default:
+		return nil, fmt.Errorf("%w: unknown scope %q", ErrInvalidAnnouncement, req.Scope)
+	}
+
+	author, err := s.users.FindByID(authorID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkAuthor(author, req); err != nil {
+		return nil, err
+	}
+
+	recipients, err := s.audience.GetAnnouncementAudience(author.SchoolID, req.Scope, req.TargetID, req.IncludeStudents)
+	if err != nil {
+		return nil, err
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("%w: no recipients", ErrInvalidAnnouncement)
+	}
+
+	now := time.Now()
+	conv := &domain.Conversation{
+		SchoolID:       author.SchoolID,
+		CreatedBy:      authorID,
+		Type:           domain.ConvTypeClass,
+		Subject:        req.Title,
+		ParticipantIDs: append(domain.JSONUintArray{authorID}, recipients...),
+		ReadOnly:       !req.AllowReplies,
+		LastMessageAt:  now,
+		CreatedAt:      now,
+	}
+	if req.Scope == domain.ScopeClass {
+		conv.ClassID = &req.TargetID
+	}
+	msg := &domain.Message{SenderID: authorID, Body: req.Body, CreatedAt: now}
+	a := &domain.Announcement{
+		SchoolID:        author.SchoolID,
+		AuthorID:        authorID,
+		Scope:           req.Scope,
+		TargetID:        req.TargetID,
+		Title:           req.Title,
+		Body:            req.Body,
+		AllowReplies:    req.AllowReplies,
+		IncludeStudents: req.IncludeStudents,
+		RecipientCount:  len(recipients),
+		CreatedAt:       now,
+	}
+	if err := s.repo.CreateAnnouncement(a, conv, msg, recipients); err != nil {
+		return nil, err
+	}
+
+	for _, id := range recipients {
+		s.notify(a, id, a.Title)
+	}
+	return a, nil
+}
+
+func (s *AnnouncementService) checkAuthor(author *domain.User, req AnnouncementRequest) error {
+	if author == nil {
+		return policyError("unknown user")
+	}
+	switch author.Role {
+	case domain.RolePrincipal, domain.RoleAdmin:
+		return nil
+	case domain.RoleTeacher:
+		if req.Scope != domain.ScopeClass {
+			return policyError("teachers only address their classes")
+		}
+		classIDs, err := s.audience.GetClassIDsForUser(author.ID, author.Role)
+		if err != nil {
+			return err
+		}
+		if !containsUint(classIDs, req.TargetID) {
+			return policyError("teachers only address the classes they teach")
+		}
+		return nil
+	default:
+		return policyError("only teachers and principals publish announcements")
+	}
+}
+
+// GetUserAnnouncements returns the announcements userID wrote or received.
+func (s *AnnouncementService) GetUserAnnouncements(userID uint) ([]domain.Announcement, error) {
+	return s.repo.GetAnnouncementsByUserID(userID)
+}
+
+// MarkRead confirms that a recipient read the announcement.
+func (s *AnnouncementService) MarkRead(userID, id uint) error {
+	ok, err := s.repo.MarkAnnouncementRead(id, userID, time.Now())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrAnnouncementNotFound
+	}
+	return nil
+}
+
+// ReadStatus returns the read confirmation dashboard, for the author and the
+// principals and administrators of the school.
+func (s *AnnouncementService) ReadStatus(actorID, id uint) (*AnnouncementReadStatus, error) {
+	a, err := s.managedAnnouncement(actorID, id)
+	if err != nil {
+		return nil, err
+	}
+	recipients, err := s.repo.GetAnnouncementRecipients(id)
+	if err != nil {
+		return nil, err
+	}
+	users, err := s.schoolUsers(a.SchoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &AnnouncementReadStatus{Announcement: a, Read: []AnnouncementReader{}, Unread: []AnnouncementReader{}}
+	for _, r := range recipients {
+		reader := AnnouncementReader{UserID: r.UserID, ReadAt: r.ReadAt, RemindedAt: r.RemindedAt}
+		if u := users[r.UserID]; u != nil {
+			reader.Name = strings.TrimSpace(u.FirstName + " " + u.LastName)
+			reader.Role = string(u.Role)
+		}
+		if r.ReadAt != nil {
+			status.Read = append(status.Read, reader)
+		} else {
+			status.Unread = append(status.Unread, reader)
+		}
+	}
+	return status, nil
+}
+
+// RemindUnread notifies again the recipients who have not read the
+// announcement, at most once every announcementReminderInterval. It returns
+// the number of recipients reminded.
+func (s *AnnouncementService) RemindUnread(actorID, id uint, now time.Time) (int, error) {
+	a, err := s.managedAnnouncement(actorID, id)
+	if err != nil {
+		return 0, err
+	}
+	if a.LastReminderAt != nil && now.Sub(*a.LastReminderAt) < announcementReminderInterval {
+		return 0, ErrReminderTooSoon
+	}
+	recipients, err := s.repo.GetAnnouncementRecipients(id)
+	if err != nil {
+		return 0, err
+	}
+	users, err := s.schoolUsers(a.SchoolID)
+	if err != nil {
+		return 0, err
+	}
+
+	var unread []uint
+	for _, r := range recipients {
+		if r.ReadAt == nil {
+			unread = append(unread, r.UserID)
+		}
+	}
+	if err := s.repo.RecordAnnouncementReminder(id, unread, now); err != nil {
+		return 0, err
+	}
+	for _, userID := range unread {
+		format := announcementReminderTitles[defaultLocale]
+		if u := users[userID]; u != nil {
+			if f, ok := announcementReminderTitles[u.Locale]; ok {
+				format = f
+			}
+		}
+		s.notify(a, userID, fmt.Sprintf(format, a.Title))
+	}
+	return len(unread), nil
+}
+
+// managedAnnouncement returns the announcement if actorID may follow its
+// reading.
+func (s *AnnouncementService) managedAnnouncement(actorID, id uint) (*domain.Announcement, error) {
+	a, err := s.repo.GetAnnouncementByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return nil, ErrAnnouncementNotFound
+	}
+	if a.AuthorID == actorID {
+		return a, nil
+	}
+	actor, err := s.users.FindByID(actorID)
+	if err != nil {
+		return nil, err
+	}
+	if actor == nil || actor.SchoolID != a.SchoolID || (actor.Role != domain.RolePrincipal && actor.Role != domain.RoleAdmin) {
+		return nil, policyError("only the author and the principals follow the reading of an announcement")
+	}
+	return a, nil
+}
+
+func (s *AnnouncementService) schoolUsers(schoolID uint) (map[uint]*domain.User, error) {
+	return schoolUsersByID(s.users, schoolID)
+}
+
+func (s *AnnouncementService) notify(a *domain.Announcement, userID uint, title string) {
+	data := domain.JSONMap{"announcement_id": a.ID, "conversation_id": a.ConversationID}
+	if err := s.notif.TriggerNotification(userID, domain.NotifTypeAnnouncement, title, a.Body, data); err != nil {
+		zap.L().Error("Failed to notify announcement", zap.Uint("announcement_id", a.ID), zap.Uint("user_id", userID), zap.Error(err))
+	}
+}
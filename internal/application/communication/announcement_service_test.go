@@ -0,0 +1,118 @@
+package communication
+
+import (
+	"testing"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeAnnouncementAudience struct {
+	classes map[uint][]uint // Teacher -> classes
+}
+
+func (f *fakeAnnouncementAudience) GetClassIDsForUser(userID uint, role domain.Role) ([]uint, error) {
+	return f.classes[userID], nil
+}
+func (f *fakeAnnouncementAudience) GetAnnouncementAudience(schoolID uint, scope domain.AnnouncementScope, targetID uint, includeStudents bool) ([]uint, error) {
+	if scope == domain.ScopeClass && targetID == 10 {
+		return []uint{3, 4}, nil
+	}
+	if scope == domain.ScopeSchool {
+		return []uint{3, 4, 5}, nil
+	}
+	return nil, nil
+}
+
+func newAnnouncementService(repo *MockCommRepo) *AnnouncementService {
+	users := &MockUserRepo{users: map[uint]*domain.User{
+		1: {ID: 1, SchoolID: 7, Role: domain.RoleTeacher},
+		2: {ID: 2, SchoolID: 7, Role: domain.RolePrincipal},
+		3: {ID: 3, SchoolID: 7, Role: domain.RoleParent, FirstName: "Anna", LastName: "Rossi", Locale: "en"},
+		4: {ID: 4, SchoolID: 7, Role: domain.RoleParent, FirstName: "Luca", LastName: "Bianchi"},
+		5: {ID: 5, SchoolID: 7, Role: domain.RoleParent},
+	}}
+	audience := &fakeAnnouncementAudience{classes: map[uint][]uint{1: {10}}}
+	return NewAnnouncementService(repo, users, audience, NewNotificationService(repo, users, nil))
+}
+
+func TestPublishAnnouncement(t *testing.T) {
+	mockRepo := new(MockCommRepo)
+	svc := newAnnouncementService(mockRepo)
+	mockRepo.On("CreateAnnouncement", mock.Anything, mock.MatchedBy(func(c *domain.Conversation) bool {
+		return c.Type == domain.ConvTypeClass && c.ReadOnly && c.CreatedBy == 1 && *c.ClassID == 10 &&
+			assert.ObjectsAreEqual(domain.JSONUintArray{1, 3, 4}, c.ParticipantIDs)
+	}), mock.Anything, []uint{3, 4}).Return(nil)
+	mockRepo.On("GetPreferences", mock.Anything).Return(nil, nil)
+	mockRepo.On("CreateNotification", mock.MatchedBy(func(n *domain.Notification) bool {
+		return n.Type == domain.NotifTypeAnnouncement && n.Data["announcement_id"] == uint(1)
+	})).Return(nil).Twice()
+
+	a, err := svc.Publish(1, AnnouncementRequest{Scope: domain.ScopeClass, TargetID: 10, Title: "Gita", Body: "Domani gita a Roma"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, a.RecipientCount)
+	mockRepo.AssertExpectations(t)
+
+	tests := []struct {
+		name   string
+		author uint
+		req    AnnouncementRequest
+		err    error
+	}{
+		{"teachers address their classes only", 1, AnnouncementRequest{Scope: domain.ScopeClass, TargetID: 11, Title: "T", Body: "B"}, ErrMessagingNotAllowed},
+		{"teachers do not address the school", 1, AnnouncementRequest{Scope: domain.ScopeSchool, Title: "T", Body: "B"}, ErrMessagingNotAllowed},
+		{"parents do not publish", 3, AnnouncementRequest{Scope: domain.ScopeClass, TargetID: 10, Title: "T", Body: "B"}, ErrMessagingNotAllowed},
+		{"grades go from 1 to 5", 2, AnnouncementRequest{Scope: domain.ScopeGrade, TargetID: 6, Title: "T", Body: "B"}, ErrInvalidAnnouncement},
+		{"a body is required", 2, AnnouncementRequest{Scope: domain.ScopeSchool, Title: "T", Body: " "}, ErrInvalidAnnouncement},
+		{"someone must receive it", 2, AnnouncementRequest{Scope: domain.ScopeCampus, TargetID: 3, Title: "T", Body: "B"}, ErrInvalidAnnouncement},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := svc.Publish(tt.author, tt.req)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestAnnouncementReads(t *testing.T) {
+	mockRepo := new(MockCommRepo)
+	svc := newAnnouncementService(mockRepo)
+	now := time.Now()
+	read := now.Add(-time.Hour)
+	a := &domain.Announcement{ID: 1, SchoolID: 7, AuthorID: 1, Title: "Gita"}
+	mockRepo.On("GetAnnouncementByID", uint(1)).Return(a, nil)
+	mockRepo.On("GetAnnouncementRecipients", uint(1)).Return([]domain.AnnouncementRecipient{
+		{AnnouncementID: 1, UserID: 3, ReadAt: &read},
+		{AnnouncementID: 1, UserID: 4},
+	}, nil)
+	mockRepo.On("MarkAnnouncementRead", uint(1), uint(3)).Return(true, nil)
+	mockRepo.On("MarkAnnouncementRead", uint(1), uint(5)).Return(false, nil)
+
+	assert.NoError(t, svc.MarkRead(3, 1))
+	assert.ErrorIs(t, svc.MarkRead(5, 1), ErrAnnouncementNotFound, "not a recipient")
+
+	status, err := svc.ReadStatus(2, 1)
+	require.NoError(t, err, "principals follow every announcement of the school")
+	assert.Equal(t, []AnnouncementReader{{UserID: 3, Name: "Anna Rossi", Role: "Parent", ReadAt: &read}}, status.Read)
+	assert.Equal(t, []AnnouncementReader{{UserID: 4, Name: "Luca Bianchi", Role: "Parent"}}, status.Unread)
+	_, err = svc.ReadStatus(3, 1)
+	assert.ErrorIs(t, err, ErrMessagingNotAllowed)
+
+	// Reminders go to non-readers only, at most twice a day
+	mockRepo.On("RecordAnnouncementReminder", uint(1), []uint{4}).Return(nil)
+	mockRepo.On("GetPreferences", uint(4)).Return(nil, nil)
+	mockRepo.On("CreateNotification", mock.MatchedBy(func(n *domain.Notification) bool {
+		return n.UserID == 4 && n.Title == "Promemoria: Gita"
+	})).Return(nil).Once()
+	reminded, err := svc.RemindUnread(1, 1, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, reminded)
+	mockRepo.AssertExpectations(t)
+
+	a.LastReminderAt = &now
+	_, err = svc.RemindUnread(1, 1, now.Add(time.Hour))
+	assert.ErrorIs(t, err, ErrReminderTooSoon)
+}
@@ -0,0 +1,249 @@
+package communication
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/k/iRegistro/internal/domain"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxAttachmentsPerMessage bounds the files sent with a single message.
+	maxAttachmentsPerMessage = 10
+	defaultAttachmentMaxSize = 10 << 20
+)
+
+var (
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	ErrAttachmentTooLarge = errors.New("attachment too large")
+	ErrAttachmentType     = errors.New("file type not allowed")
+	ErrAttachmentInfected = errors.New("the file contains a virus")
+	// ErrScanUnavailable is returned when the scanner cannot be reached:
+	// files are never stored unscanned.
+	ErrScanUnavailable   = errors.New("virus scan unavailable")
+	ErrInvalidAttachment = errors.New("invalid attachment")
+)
+
+// attachmentTypes are the MIME types accepted, as sniffed from the content.
+var attachmentTypes = map[string]bool{
+	"application/pdf": true,
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"text/plain":      true,
+}
+
+// officeTypes are the documents sniffed as ZIP archives, recognised by
+// extension.
+var officeTypes = map[string]string{
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".odp":  "application/vnd.oasis.opendocument.presentation",
+}
+
+type fileStore interface {
+	Save(filename string, data []byte) (string, error)
+	Get(filename string) ([]byte, error)
+}
+
+// AttachmentPolicy limits uploads. MaxSize defaults to 10 MB; Scanner may be
+// nil to store files unscanned.
+type AttachmentPolicy struct {
+	MaxSize int64
+	Scanner domain.VirusScanner
+}
+
+type AttachmentService struct {
+	repo   domain.CommunicationRepository
+	files  fileStore
+	policy AttachmentPolicy
+}
+
+func NewAttachmentService(repo domain.CommunicationRepository, files fileStore, policy AttachmentPolicy) *AttachmentService {
+	if policy.MaxSize <= 0 {
+		policy.MaxSize = defaultAttachmentMaxSize
+	}
+	return &AttachmentService{repo: repo, files: files, policy: policy}
+}
+
+// MaxSize is the largest file accepted, in bytes.
+func (s *AttachmentService) MaxSize() int64 {
+	return s.policy.MaxSize
+}
+
+// Upload checks, scans and stores a file of uploaderID, to be sent with a
+// message. Files are stored by content hash.
+func (s *AttachmentService) Upload(ctx context.Context, uploaderID, schoolID uint, fileName string, data []byte) (*domain.Attachment, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: empty file", ErrInvalidAttachment)
+	}
+	if int64(len(data)) > s.policy.MaxSize {
+		return nil, ErrAttachmentTooLarge
+	}
+	fileName = cleanFileName(fileName)
+	mimeType, err := detectType(fileName, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.policy.Scanner != nil {
+		result, err := s.policy.Scanner.Scan(ctx, data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrScanUnavailable, err)
+		}
+		if result.Infected {
+			zap.L().Warn("Rejected infected attachment",
+				zap.Uint("uploader_id", uploaderID), zap.String("file_name", fileName), zap.String("signature", result.Signature))
+			return nil, ErrAttachmentInfected
+		}
+	}
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	storagePath, err := s.files.Save(path.Join("attachments", hash[:2], hash), data)
+	if err != nil {
+		return nil, err
+	}
+
+	att := &domain.Attachment{
+		SchoolID:    schoolID,
+		UploaderID:  uploaderID,
+		SHA256:      hash,
+		FileName:    fileName,
+		MimeType:    mimeType,
+		Size:        int64(len(data)),
+		StoragePath: storagePath,
+		CreatedAt:   time.Now(),
+	}
+	if err := s.repo.CreateAttachment(att); err != nil {
+		return nil, err
+	}
+	return att, nil
+}
+
+// Open returns an attachment and its content if userID may read it: the
+// uploader, or once sent a participant of the message's conversation.
+func (s *AttachmentService) Open(ctx context.Context, userID, id uint) (*domain.Attachment, []byte, error) {
+	att, err := s.repo.GetAttachmentByID(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if att == nil {
+		return nil, nil, ErrAttachmentNotFound
+	}
+	if att.UploaderID != userID {
+		if err := s.checkAccess(ctx, userID, att); err != nil {
+			return nil, nil, err
+		}
+	}
+	data, err := s.files.Get(att.StoragePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return att, data, nil
+}
+
+func (s *AttachmentService) checkAccess(ctx context.Context, userID uint, att *domain.Attachment) error {
+	if att.MessageID == nil {
+		// Not sent yet
+		return ErrAttachmentNotFound
+	}
+	msg, err := s.repo.GetMessageByID(*att.MessageID)
+	if err != nil {
+		return err
+	}
+	if msg == nil || msg.IsDeleted {
+		return ErrAttachmentNotFound
+	}
+	conv, err := s.repo.GetConversationByID(ctx, msg.ConversationID)
+	if err != nil {
+		return err
+	}
+	if conv == nil {
+		return ErrAttachmentNotFound
+	}
+	if !isParticipant(conv, userID) {
+		return ErrNotParticipant
+	}
+	return nil
+}
+
+// messageAttachments returns the attachments ids of senderID, which must be
+// not sent yet.
+func messageAttachments(repo domain.CommunicationRepository, senderID uint, ids []uint) ([]domain.Attachment, error) {
+	var unique []uint
+	for _, id := range ids {
+		if !containsUint(unique, id) {
+			unique = append(unique, id)
+		}
+	}
+	if len(unique) > maxAttachmentsPerMessage {
+		return nil, fmt.Errorf("%w: at most %d attachments per message", ErrInvalidAttachment, maxAttachmentsPerMessage)
+	}
+	atts, err := repo.GetAttachmentsByIDs(unique)
+	if err != nil {
+		return nil, err
+	}
+	if len(atts) != len(unique) {
+		return nil, ErrAttachmentNotFound
+	}
+	for _, a := range atts {
+		if a.UploaderID != senderID || a.MessageID != nil {
+			return nil, fmt.Errorf("%w: %d", ErrInvalidAttachment, a.ID)
+		}
+	}
+	return atts, nil
+}
+
+// detectType sniffs the MIME type of data, rejecting the types not allowed.
+func detectType(fileName string, data []byte) (string, error) {
+	sniffed, _, err := mime.ParseMediaType(http.DetectContentType(data))
+	if err != nil {
+		return "", ErrAttachmentType
+	}
+	if attachmentTypes[sniffed] {
+		return sniffed, nil
+	}
+	if sniffed == "application/zip" {
+		if t, ok := officeTypes[strings.ToLower(filepath.Ext(fileName))]; ok {
+			return t, nil
+		}
+	}
+	return "", ErrAttachmentType
+}
+
+// cleanFileName keeps the base name of an uploaded file, as sent by the
+// browser, without control characters.
+func cleanFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	for len(name) > 255 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	return name
+}
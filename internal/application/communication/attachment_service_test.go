@@ -0,0 +1,134 @@
+package communication
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryFiles map[string][]byte
+
+func (f memoryFiles) Save(filename string, data []byte) (string, error) {
+	f["/uploads/"+filename] = data
+	return "/uploads/" + filename, nil
+}
+func (f memoryFiles) Get(filename string) ([]byte, error) {
+	data, ok := f[filename]
+	if !ok {
+		return nil, errors.New("no such file")
+	}
+	return data, nil
+}
+
+type fakeScanner struct {
+	result *domain.ScanResult
+	err    error
+}
+
+func (s *fakeScanner) Scan(ctx context.Context, data []byte) (*domain.ScanResult, error) {
+	return s.result, s.err
+}
+
+var pdfContent = []byte("%PDF-1.4\n1 0 obj\n<<>>\nendobj\n")
+
+func TestUploadAttachment(t *testing.T) {
+	repo := new(MockCommRepo)
+	repo.On("CreateAttachment", mock.Anything).Return(nil)
+	files := memoryFiles{}
+	scanner := &fakeScanner{result: &domain.ScanResult{}}
+	svc := NewAttachmentService(repo, files, AttachmentPolicy{MaxSize: 1024, Scanner: scanner})
+
+	att, err := svc.Upload(context.Background(), 1, 7, `C:\Documenti\pagella.pdf`, pdfContent)
+	require.NoError(t, err)
+	assert.Equal(t, "pagella.pdf", att.FileName)
+	assert.Equal(t, "application/pdf", att.MimeType)
+	assert.Equal(t, uint(7), att.SchoolID)
+	assert.Len(t, att.SHA256, 64)
+	assert.Equal(t, "/uploads/attachments/"+att.SHA256[:2]+"/"+att.SHA256, att.StoragePath)
+	assert.Equal(t, pdfContent, files[att.StoragePath])
+
+	// Office documents are sniffed as ZIP archives
+	docx := append([]byte("PK\x03\x04"), make([]byte, 64)...)
+	att, err = svc.Upload(context.Background(), 1, 7, "verbale.docx", docx)
+	require.NoError(t, err)
+	assert.Contains(t, att.MimeType, "wordprocessingml")
+
+	_, err = svc.Upload(context.Background(), 1, 7, "archive.zip", docx)
+	assert.ErrorIs(t, err, ErrAttachmentType)
+	_, err = svc.Upload(context.Background(), 1, 7, "page.pdf", []byte("<html><script>alert(1)</script>"))
+	assert.ErrorIs(t, err, ErrAttachmentType, "the content decides the type, not the name")
+	_, err = svc.Upload(context.Background(), 1, 7, "big.pdf", append(pdfContent, make([]byte, 1024)...))
+	assert.ErrorIs(t, err, ErrAttachmentTooLarge)
+	_, err = svc.Upload(context.Background(), 1, 7, "empty.txt", nil)
+	assert.ErrorIs(t, err, ErrInvalidAttachment)
+
+	scanner.result = &domain.ScanResult{Infected: true, Signature: "Eicar-Test-Signature"}
+	_, err = svc.Upload(context.Background(), 1, 7, "virus.pdf", pdfContent)
+	assert.ErrorIs(t, err, ErrAttachmentInfected)
+
+	scanner.result, scanner.err = nil, errors.New("connection refused")
+	_, err = svc.Upload(context.Background(), 1, 7, "pagella.pdf", pdfContent)
+	assert.ErrorIs(t, err, ErrScanUnavailable, "files are not stored unscanned")
+	repo.AssertNumberOfCalls(t, "CreateAttachment", 2)
+}
+
+func TestOpenAttachment(t *testing.T) {
+	repo := new(MockCommRepo)
+	files := memoryFiles{"/uploads/attachments/ab/abc": pdfContent}
+	svc := NewAttachmentService(repo, files, AttachmentPolicy{})
+	msgID := uint(20)
+	repo.On("GetAttachmentByID", uint(1)).Return(&domain.Attachment{ID: 1, UploaderID: 1, StoragePath: "/uploads/attachments/ab/abc"}, nil)
+	repo.On("GetAttachmentByID", uint(2)).Return(&domain.Attachment{ID: 2, UploaderID: 1, MessageID: &msgID, StoragePath: "/uploads/attachments/ab/abc"}, nil)
+	repo.On("GetAttachmentByID", uint(3)).Return(nil, nil)
+	repo.On("GetMessageByID", msgID).Return(&domain.Message{ID: msgID, ConversationID: 5}, nil)
+	repo.On("GetConversationByID", uint(5)).Return(&domain.Conversation{ID: 5, ParticipantIDs: domain.JSONUintArray{1, 3}}, nil)
+
+	_, data, err := svc.Open(context.Background(), 1, 1)
+	require.NoError(t, err, "the uploader reads a file not sent yet")
+	assert.Equal(t, pdfContent, data)
+	_, _, err = svc.Open(context.Background(), 3, 1)
+	assert.ErrorIs(t, err, ErrAttachmentNotFound)
+
+	_, _, err = svc.Open(context.Background(), 3, 2)
+	assert.NoError(t, err, "participants read sent files")
+	_, _, err = svc.Open(context.Background(), 4, 2)
+	assert.ErrorIs(t, err, ErrNotParticipant)
+
+	_, _, err = svc.Open(context.Background(), 1, 3)
+	assert.ErrorIs(t, err, ErrAttachmentNotFound)
+}
+
+func TestSendMessageAttachments(t *testing.T) {
+	repo := new(MockCommRepo)
+	svc := newPolicyService(repo)
+	sent := uint(9)
+	repo.On("GetConversationByID", uint(1)).Return(&domain.Conversation{ID: 1, ParticipantIDs: domain.JSONUintArray{1, 3}}, nil)
+	repo.On("GetAttachmentsByIDs", []uint{1, 2}).Return([]domain.Attachment{
+		{ID: 1, UploaderID: 1, FileName: "a.pdf", MimeType: "application/pdf", Size: 10},
+		{ID: 2, UploaderID: 1, FileName: "b.png", MimeType: "image/png", Size: 20},
+	}, nil)
+	repo.On("GetAttachmentsByIDs", []uint{3}).Return([]domain.Attachment{{ID: 3, UploaderID: 3}}, nil)
+	repo.On("GetAttachmentsByIDs", []uint{4}).Return([]domain.Attachment{{ID: 4, UploaderID: 1, MessageID: &sent}}, nil)
+	repo.On("GetAttachmentsByIDs", []uint{5}).Return([]domain.Attachment{}, nil)
+	repo.On("CreateMessage", mock.Anything).Return(nil)
+	repo.On("LinkAttachments", uint(1), []uint{1, 2}).Return(nil)
+
+	msg, err := svc.SendMessage(context.Background(), 1, 1, "In allegato", []uint{1, 2, 1})
+	require.NoError(t, err)
+	require.Len(t, msg.Attachments, 2)
+	assert.Equal(t, "b.png", msg.Attachments[1]["file_name"])
+	repo.AssertCalled(t, "LinkAttachments", uint(1), []uint{1, 2})
+
+	_, err = svc.SendMessage(context.Background(), 1, 1, "", []uint{3})
+	assert.ErrorIs(t, err, ErrInvalidAttachment, "files of someone else")
+	_, err = svc.SendMessage(context.Background(), 1, 1, "", []uint{4})
+	assert.ErrorIs(t, err, ErrInvalidAttachment, "files already sent")
+	_, err = svc.SendMessage(context.Background(), 1, 1, "", []uint{5})
+	assert.ErrorIs(t, err, ErrAttachmentNotFound)
+	repo.AssertNumberOfCalls(t, "CreateMessage", 1)
+}
@@ -1,26 +1,129 @@
 package communication
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/k/iRegistro/internal/domain"
+	"go.uber.org/zap"
 )
 
+var (
+	ErrSlotNotFound    = errors.New("slot not found")
+	ErrBookingNotFound = errors.New("booking not found")
+	// ErrColloquiumNotAllowed is returned when a user manages a slot or
+	// booking that is not theirs.
+	ErrColloquiumNotAllowed = errors.New("not allowed to manage this colloquium")
+	ErrInvalidSlot          = errors.New("invalid colloquium slot")
+	// ErrColloquiumNotEnded is returned for feedback on a colloquium not
+	// held yet.
+	ErrColloquiumNotEnded = errors.New("colloquium not ended yet")
+	ErrInvalidFeedback    = errors.New("feedback rating must be between 1 and 5")
+)
+
+const (
+	// lateAfter is how long after the start of an online colloquium the
+	// parents are told that the teacher is late.
+	lateAfter = 5 * time.Minute
+	// checkInEarly is how long before the start the teacher may check in.
+	checkInEarly = 15 * time.Minute
+)
+
+type colloquiumEvent string
+
+const (
+	colloquiumBooked            colloquiumEvent = "booked"              // To the teacher
+	colloquiumCancelledByParent colloquiumEvent = "cancelled_by_parent" // To the teacher
+	colloquiumCancelled         colloquiumEvent = "cancelled"           // To the parent, by the teacher
+	colloquiumPromoted          colloquiumEvent = "promoted"            // To the parent, from the waiting list
+	colloquiumLate              colloquiumEvent = "late"                // To the parent, the teacher did not check in
+	colloquiumTeacherJoined     colloquiumEvent = "teacher_joined"      // To the parent, after a late notice
+	colloquiumNotesRequest      colloquiumEvent = "notes_request"       // To the teacher, after the slot
+	colloquiumFeedbackRequest   colloquiumEvent = "feedback_request"    // To the parent, after the slot
+	colloquiumReminder          colloquiumEvent = "reminder"            // To the parent, the day before
+)
+
+// colloquiumTexts take the date and time of the slot.
+var colloquiumTexts = map[string]map[colloquiumEvent]struct{ title, body string }{
+	"it": {
+		colloquiumBooked:            {"Nuova prenotazione", "Nuova prenotazione per il colloquio del %s alle %s."},
+		colloquiumCancelledByParent: {"Prenotazione annullata", "Una famiglia ha annullato il colloquio del %s alle %s."},
+		colloquiumCancelled:         {"Colloquio annullato", "Il docente ha annullato il colloquio del %s alle %s."},
+		colloquiumPromoted:          {"Colloquio confermato", "Si è liberato un posto: il colloquio del %s alle %s è confermato."},
+		colloquiumLate:              {"Docente in ritardo", "Il docente non è ancora collegato al colloquio del %s alle %s: attendi nella sala d'attesa."},
+		colloquiumTeacherJoined:     {"Docente collegato", "Il docente è collegato al colloquio del %s alle %s."},
+		colloquiumNotesRequest:      {"Note del colloquio", "Aggiungi le note dei colloqui del %s alle %s."},
+		colloquiumFeedbackRequest:   {"Com'è andato il colloquio?", "Lascia un giudizio sul colloquio del %s alle %s."},
+		colloquiumReminder:          {"Promemoria colloquio", "Domani hai un colloquio: %s alle %s."},
+	},
+	"en": {
+		colloquiumBooked:            {"New booking", "New booking for the colloquium of %s at %s."},
+		colloquiumCancelledByParent: {"Booking cancelled", "A family cancelled the colloquium of %s at %s."},
+		colloquiumCancelled:         {"Colloquium cancelled", "The teacher cancelled the colloquium of %s at %s."},
+		colloquiumPromoted:          {"Colloquium confirmed", "A place became free: the colloquium of %s at %s is confirmed."},
+		colloquiumLate:              {"Teacher running late", "The teacher has not joined the colloquium of %s at %s yet: please wait in the waiting room."},
+		colloquiumTeacherJoined:     {"Teacher joined", "The teacher joined the colloquium of %s at %s."},
+		colloquiumNotesRequest:      {"Colloquium notes", "Add your notes on the colloquiums of %s at %s."},
+		colloquiumFeedbackRequest:   {"How did the colloquium go?", "Rate the colloquium of %s at %s."},
+		colloquiumReminder:          {"Colloquium reminder", "You have a colloquium tomorrow: %s at %s."},
+	},
+}
+
+// WaitingRoom is the virtual waiting room of a colloquium slot, shown to its
+// teacher and to the parents booked.
+type WaitingRoom struct {
+	SlotID      uint                  `json:"slot_id"`
+	Mode        domain.ColloquiumMode `json:"mode"`
+	Date        time.Time             `json:"date"`
+	StartTime   string                `json:"start_time"`
+	EndTime     string                `json:"end_time"`
+	MeetingURL  string                `json:"meeting_url,omitempty"`
+	TeacherID   uint                  `json:"teacher_id"`
+	TeacherName string                `json:"teacher_name"`
+	CheckedIn   bool                  `json:"checked_in"`
+	CheckedInAt *time.Time            `json:"checked_in_at,omitempty"`
+	// Late is set once the teacher is lateAfter behind the start.
+	Late bool `json:"late"`
+}
+
 type ColloquiumService struct {
 	repo         domain.CommunicationRepository
+	users        domain.UserRepository
 	notifService *NotificationService
+	links        domain.MeetingLinkProvider
 }
 
-func NewColloquiumService(repo domain.CommunicationRepository, notif *NotificationService) *ColloquiumService {
-	return &ColloquiumService{repo: repo, notifService: notif}
+// NewColloquiumService creates the service. users gives the language of the
+// notifications; links creates the video meetings of online slots, which
+// cannot be created when it is nil.
+func NewColloquiumService(repo domain.CommunicationRepository, users domain.UserRepository, notif *NotificationService, links domain.MeetingLinkProvider) *ColloquiumService {
+	return &ColloquiumService{repo: repo, users: users, notifService: notif, links: links}
 }
 
-func (s *ColloquiumService) CreateSlot(teacherID uint, date time.Time, start, end string, maxParticipants int, cType domain.ColloquiumType) error {
+// CreateSlot opens a slot of teacherID. Online slots get their meeting link
+// here.
+func (s *ColloquiumService) CreateSlot(ctx context.Context, teacherID uint, date time.Time, start, end string, maxParticipants int, cType domain.ColloquiumType, mode domain.ColloquiumMode) (*domain.ColloquiumSlot, error) {
 	// Basic validation
 	if maxParticipants < 1 {
 		maxParticipants = 1
 	}
+	from, err := parseClock(start)
+	if err != nil {
+		return nil, fmt.Errorf("%w: start time %q", ErrInvalidSlot, start)
+	}
+	to, err := parseClock(end)
+	if err != nil || to <= from {
+		return nil, fmt.Errorf("%w: end time %q", ErrInvalidSlot, end)
+	}
+	switch mode {
+	case "":
+		mode = domain.ColloquiumInPerson
+	case domain.ColloquiumInPerson, domain.ColloquiumOnline, domain.ColloquiumPhone:
+	default:
+		return nil, fmt.Errorf("%w: mode %q", ErrInvalidSlot, mode)
+	}
 
 	slot := &domain.ColloquiumSlot{
 		TeacherID:       teacherID,
@@ -29,11 +132,23 @@ func (s *ColloquiumService) CreateSlot(teacherID uint, date time.Time, start, en
 		EndTime:         end,
 		MaxParticipants: maxParticipants,
 		Type:            cType,
+		Mode:            mode,
 		IsAvailable:     true,
 		CreatedAt:       time.Now(),
 	}
+	if mode == domain.ColloquiumOnline {
+		if s.links == nil {
+			return nil, fmt.Errorf("%w: online colloquiums are not enabled", ErrInvalidSlot)
+		}
+		if slot.MeetingURL, err = s.links.MeetingLink(ctx, slot); err != nil {
+			return nil, err
+		}
+	}
 
-	return s.repo.CreateColloquiumSlot(slot)
+	if err := s.repo.CreateColloquiumSlot(slot); err != nil {
+		return nil, err
+	}
+	return slot, nil
 }
 
 func (s *ColloquiumService) GetAvailableSlots(teacherID uint) ([]domain.ColloquiumSlot, error) {
@@ -43,55 +158,367 @@ func (s *ColloquiumService) GetAvailableSlots(teacherID uint) ([]domain.Colloqui
 	return s.repo.GetAvailableSlots(teacherID, today, nextMonth)
 }
 
-func (s *ColloquiumService) BookSlot(slotID, parentID, studentID uint, notes string) error {
-	// 1. Get Slot
+// BookSlot books a slot for parentID. When the slot is full the booking
+// joins its waiting list.
+func (s *ColloquiumService) BookSlot(slotID, parentID, studentID uint, notes string) (*domain.ColloquiumBooking, error) {
 	slot, err := s.repo.GetSlotByID(slotID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	// 2. Check if available
-	if !slot.IsAvailable {
-		return errors.New("slot is not available")
+	if slot == nil {
+		return nil, ErrSlotNotFound
 	}
-
-	// 3. Check Capacity
-	bookings, err := s.repo.GetBookingsBySlotID(slotID)
-	if err != nil {
-		return err
-	}
-
-	if len(bookings) >= slot.MaxParticipants {
-		return errors.New("slot is full")
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if !slot.IsAvailable || slot.Date.Before(today) {
+		return nil, domain.ErrSlotUnavailable
 	}
 
 	booking := &domain.ColloquiumBooking{
 		SlotID:      slotID,
 		ParentID:    parentID,
 		StudentID:   studentID,
-		BookedAt:    time.Now(),
+		BookedAt:    now,
 		NotesBefore: notes,
 	}
+	// The capacity is checked under a lock of the slot
+	if err := s.repo.BookSlot(booking); err != nil {
+		return nil, err
+	}
+
+	if booking.Status == domain.BookingConfirmed {
+		s.notify(slot.TeacherID, colloquiumBooked, slot, booking)
+	}
+	return booking, nil
+}
+
+// CancelBooking cancels a booking on behalf of its parent or of the teacher of
+// the slot. The first booking waiting for the slot takes its place.
+func (s *ColloquiumService) CancelBooking(ctx context.Context, actorID, bookingID uint) error {
+	booking, err := s.repo.GetBookingByID(ctx, bookingID)
+	if err != nil {
+		return err
+	}
+	if booking == nil {
+		return ErrBookingNotFound
+	}
+	slot := &booking.Slot
+	byParent := booking.ParentID == actorID
+	if !byParent && slot.TeacherID != actorID {
+		return ErrColloquiumNotAllowed
+	}
+	if booking.Status == domain.BookingCancelled {
+		return nil
+	}
 
-	if err := s.repo.CreateBooking(booking); err != nil {
+	promoted, err := s.repo.CancelBooking(bookingID, time.Now())
+	if err != nil {
 		return err
 	}
 
-	// 2. Notify Teacher (Optional: now we have teacherID from slot)
-	// s.notifService.TriggerNotification(slot.TeacherID, ...)
+	switch {
+	case !byParent:
+		s.notify(booking.ParentID, colloquiumCancelled, slot, booking)
+	case booking.Status == domain.BookingConfirmed:
+		s.notify(slot.TeacherID, colloquiumCancelledByParent, slot, booking)
+	}
+	if promoted != nil {
+		s.notify(promoted.ParentID, colloquiumPromoted, slot, promoted)
+	}
+	return nil
+}
 
+// CancelSlot withdraws a slot of teacherID, cancelling its bookings and
+// waiting list.
+func (s *ColloquiumService) CancelSlot(teacherID, slotID uint) error {
+	slot, err := s.repo.GetSlotByID(slotID)
+	if err != nil {
+		return err
+	}
+	if slot == nil {
+		return ErrSlotNotFound
+	}
+	if slot.TeacherID != teacherID {
+		return ErrColloquiumNotAllowed
+	}
+	cancelled, err := s.repo.CancelSlot(slotID, time.Now())
+	if err != nil {
+		return err
+	}
+	for i := range cancelled {
+		s.notify(cancelled[i].ParentID, colloquiumCancelled, slot, &cancelled[i])
+	}
 	return nil
 }
 
+// CheckIn records teacherID entering the waiting room of their slot, from
+// checkInEarly before its start until its end. Parents already told that the
+// teacher is late are told they joined.
+func (s *ColloquiumService) CheckIn(teacherID, slotID uint, now time.Time) (*WaitingRoom, error) {
+	slot, err := s.repo.GetSlotByID(slotID)
+	if err != nil {
+		return nil, err
+	}
+	if slot == nil {
+		return nil, ErrSlotNotFound
+	}
+	if slot.TeacherID != teacherID {
+		return nil, ErrColloquiumNotAllowed
+	}
+	start, end, err := slotTimes(slot)
+	if err != nil {
+		return nil, err
+	}
+	if !slot.IsAvailable || now.Before(start.Add(-checkInEarly)) || !now.Before(end) {
+		return nil, domain.ErrSlotUnavailable
+	}
+
+	if slot.CheckedInAt == nil {
+		if err := s.repo.CheckInSlot(slotID, now); err != nil {
+			return nil, err
+		}
+		slot.CheckedInAt = &now
+		if slot.LateSentAt != nil {
+			bookings, err := s.confirmedBookings(slotID)
+			if err != nil {
+				return nil, err
+			}
+			for i := range bookings {
+				s.notify(bookings[i].ParentID, colloquiumTeacherJoined, slot, &bookings[i])
+			}
+		}
+	}
+	return s.waitingRoom(slot, now)
+}
+
+// WaitingRoom returns the waiting room of a slot to its teacher or to a
+// parent with a confirmed booking.
+func (s *ColloquiumService) WaitingRoom(userID, slotID uint, now time.Time) (*WaitingRoom, error) {
+	slot, err := s.repo.GetSlotByID(slotID)
+	if err != nil {
+		return nil, err
+	}
+	if slot == nil {
+		return nil, ErrSlotNotFound
+	}
+	if slot.TeacherID != userID {
+		bookings, err := s.confirmedBookings(slotID)
+		if err != nil {
+			return nil, err
+		}
+		booked := false
+		for _, b := range bookings {
+			booked = booked || b.ParentID == userID
+		}
+		if !booked {
+			return nil, ErrColloquiumNotAllowed
+		}
+	}
+	return s.waitingRoom(slot, now)
+}
+
+func (s *ColloquiumService) waitingRoom(slot *domain.ColloquiumSlot, now time.Time) (*WaitingRoom, error) {
+	start, _, err := slotTimes(slot)
+	if err != nil {
+		return nil, err
+	}
+	room := &WaitingRoom{
+		SlotID:      slot.ID,
+		Mode:        slot.Mode,
+		Date:        slot.Date,
+		StartTime:   slot.StartTime,
+		EndTime:     slot.EndTime,
+		MeetingURL:  slot.MeetingURL,
+		TeacherID:   slot.TeacherID,
+		CheckedIn:   slot.CheckedInAt != nil,
+		CheckedInAt: slot.CheckedInAt,
+		Late:        slot.CheckedInAt == nil && !now.Before(start.Add(lateAfter)),
+	}
+	if teacher, err := s.users.FindByID(slot.TeacherID); err == nil && teacher != nil {
+		room.TeacherName = fullName(teacher)
+	}
+	return room, nil
+}
+
+func (s *ColloquiumService) confirmedBookings(slotID uint) ([]domain.ColloquiumBooking, error) {
+	bookings, err := s.repo.GetBookingsBySlotID(slotID)
+	if err != nil {
+		return nil, err
+	}
+	confirmed := bookings[:0]
+	for _, b := range bookings {
+		if b.Status == domain.BookingConfirmed {
+			confirmed = append(confirmed, b)
+		}
+	}
+	return confirmed, nil
+}
+
+// SendDue tells the parents of online slots when the teacher has not checked
+// in lateAfter the start, and once a slot ended asks its teacher for the
+// notes and its parents for feedback. It returns the number of slots
+// notified.
+func (s *ColloquiumService) SendDue(now time.Time) (int, error) {
+	y, m, d := now.In(schoolLocation).Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, time.UTC) // As stored in date columns
+	// Yesterday too, for the slots ending at midnight
+	slots, err := s.repo.GetFollowUpSlots(today.AddDate(0, 0, -1), today)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for i := range slots {
+		slot := &slots[i]
+		if len(slot.Bookings) == 0 {
+			continue
+		}
+		start, end, err := slotTimes(slot)
+		if err != nil {
+			zap.L().Warn("Skipping colloquium slot with invalid times", zap.Uint("slot_id", slot.ID), zap.Error(err))
+			continue
+		}
+
+		switch {
+		case !now.Before(end):
+			ok, err := s.repo.MarkSlotFollowUpSent(slot.ID, now)
+			if err != nil {
+				return sent, err
+			}
+			if !ok {
+				continue
+			}
+			s.notify(slot.TeacherID, colloquiumNotesRequest, slot, nil)
+			for j := range slot.Bookings {
+				s.notify(slot.Bookings[j].ParentID, colloquiumFeedbackRequest, slot, &slot.Bookings[j])
+			}
+			sent++
+		case slot.Mode == domain.ColloquiumOnline && slot.CheckedInAt == nil && slot.LateSentAt == nil && !now.Before(start.Add(lateAfter)):
+			ok, err := s.repo.MarkSlotLateSent(slot.ID, now)
+			if err != nil {
+				return sent, err
+			}
+			if !ok {
+				continue
+			}
+			for j := range slot.Bookings {
+				s.notify(slot.Bookings[j].ParentID, colloquiumLate, slot, &slot.Bookings[j])
+			}
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// SendReminders reminds the parents of their colloquiums of the day after
+// now. Each booking is reminded once, however many times it runs. It returns
+// the number of reminders sent.
+func (s *ColloquiumService) SendReminders(now time.Time) (int, error) {
+	y, m, d := now.In(schoolLocation).Date()
+	tomorrow := time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC) // As stored in date columns
+	bookings, err := s.repo.GetBookingsByDateRange(tomorrow, tomorrow.AddDate(0, 0, 1))
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for i := range bookings {
+		b := &bookings[i]
+		ok, err := s.repo.MarkBookingReminderSent(b.ID, now)
+		if err != nil {
+			return sent, err
+		}
+		if !ok {
+			continue
+		}
+		s.notify(b.ParentID, colloquiumReminder, &b.Slot, b)
+		sent++
+	}
+	return sent, nil
+}
+
+// slotTimes returns the start and end of a slot, in school time.
+func slotTimes(slot *domain.ColloquiumSlot) (time.Time, time.Time, error) {
+	start, err := parseClock(slot.StartTime)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	end, err := parseClock(slot.EndTime)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return atClock(slot.Date, start), atClock(slot.Date, end), nil
+}
+
+// notify tells userID about a booking, or about a slot when booking is nil,
+// in their language. Failures are logged: the booking change stands.
+func (s *ColloquiumService) notify(userID uint, event colloquiumEvent, slot *domain.ColloquiumSlot, booking *domain.ColloquiumBooking) {
+	texts := colloquiumTexts[defaultLocale]
+	if u, err := s.users.FindByID(userID); err == nil && u != nil {
+		if t, ok := colloquiumTexts[u.Locale]; ok {
+			texts = t
+		}
+	}
+	text := texts[event]
+	body := fmt.Sprintf(text.body, slot.Date.Format("02/01/2006"), slot.StartTime)
+	data := domain.JSONMap{"slot_id": slot.ID, "event": string(event)}
+	if booking != nil {
+		data["booking_id"] = booking.ID
+		data["status"] = string(booking.Status)
+	}
+	if err := s.notifService.TriggerNotification(userID, domain.NotifTypeColloquium, text.title, body, data); err != nil {
+		zap.L().Error("Failed to notify colloquium", zap.Uint("slot_id", slot.ID), zap.Uint("user_id", userID), zap.Error(err))
+	}
+}
+
 func (s *ColloquiumService) GetParentBookings(parentID uint) ([]domain.ColloquiumBooking, error) {
 	return s.repo.GetBookingsByParentID(parentID)
 }
 
-func (s *ColloquiumService) AddFeedback(bookingID uint, rating int, text string) error {
-	booking := &domain.ColloquiumBooking{
-		ID:             bookingID,
-		FeedbackRating: &rating,
-		FeedbackText:   text,
+// AddNotes saves the notes of teacherID after a colloquium of their slot.
+func (s *ColloquiumService) AddNotes(ctx context.Context, teacherID, bookingID uint, notes string) error {
+	booking, err := s.heldBooking(ctx, bookingID)
+	if err != nil {
+		return err
 	}
+	if booking.Slot.TeacherID != teacherID {
+		return ErrColloquiumNotAllowed
+	}
+	booking.NotesAfter = notes
 	return s.repo.UpdateBooking(booking)
 }
+
+// AddFeedback saves the rating, from 1 to 5, of the parent who booked a
+// colloquium once it ended.
+func (s *ColloquiumService) AddFeedback(ctx context.Context, parentID, bookingID uint, rating int, text string) error {
+	if rating < 1 || rating > 5 {
+		return ErrInvalidFeedback
+	}
+	booking, err := s.heldBooking(ctx, bookingID)
+	if err != nil {
+		return err
+	}
+	if booking.ParentID != parentID {
+		return ErrColloquiumNotAllowed
+	}
+	booking.FeedbackRating = &rating
+	booking.FeedbackText = text
+	return s.repo.UpdateBooking(booking)
+}
+
+// heldBooking returns a confirmed booking whose slot ended.
+func (s *ColloquiumService) heldBooking(ctx context.Context, bookingID uint) (*domain.ColloquiumBooking, error) {
+	booking, err := s.repo.GetBookingByID(ctx, bookingID)
+	if err != nil {
+		return nil, err
+	}
+	if booking == nil || booking.Status != domain.BookingConfirmed {
+		return nil, ErrBookingNotFound
+	}
+	_, end, err := slotTimes(&booking.Slot)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().Before(end) {
+		return nil, ErrColloquiumNotEnded
+	}
+	return booking, nil
+}
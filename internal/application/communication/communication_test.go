@@ -1,13 +1,14 @@
 package communication
 
 import (
+	"context"
 	"testing"
 	"time"
 
 	"github.com/k/iRegistro/internal/domain"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
-	"go.uber.org/zap"
+	"github.com/stretchr/testify/require"
 )
 
 // --- Mocks ---
@@ -28,6 +29,9 @@ func (m *MockCommRepo) GetNotificationsByUserID(userID uint, archived bool) ([]d
 func (m *MockCommRepo) MarkNotificationRead(id uint) error {
 	return m.Called(id).Error(0)
 }
+func (m *MockCommRepo) MarkNotificationDelivered(id, userID uint, at time.Time) error {
+	return m.Called(id, userID).Error(0)
+}
 func (m *MockCommRepo) ArchiveNotification(id uint) error {
 	return m.Called(id).Error(0)
 }
@@ -41,6 +45,80 @@ func (m *MockCommRepo) GetPreferences(userID uint) ([]domain.NotificationPrefere
 func (m *MockCommRepo) SavePreferences(prefs []domain.NotificationPreference) error {
 	return m.Called(prefs).Error(0)
 }
+func (m *MockCommRepo) GetNotificationSettings(userID uint) (*domain.NotificationSettings, error) {
+	args := m.Called(userID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*domain.NotificationSettings), args.Error(1)
+}
+func (m *MockCommRepo) SaveNotificationSettings(settings *domain.NotificationSettings) error {
+	return m.Called(settings).Error(0)
+}
+
+func (m *MockCommRepo) GetNotificationByID(id uint) (*domain.Notification, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*domain.Notification), args.Error(1)
+}
+
+// Deliveries
+func (m *MockCommRepo) CreateDelivery(d *domain.NotificationDelivery) error {
+	args := m.Called(d)
+	d.ID = 1
+	return args.Error(0)
+}
+func (m *MockCommRepo) UpdateDelivery(d *domain.NotificationDelivery) error {
+	return m.Called(d).Error(0)
+}
+func (m *MockCommRepo) CreateDeliveryAttempt(a *domain.DeliveryAttempt) error {
+	return m.Called(a).Error(0)
+}
+func (m *MockCommRepo) ClaimDueDeliveries(status domain.DeliveryStatus, now time.Time, lease time.Duration, limit int) ([]domain.NotificationDelivery, error) {
+	args := m.Called(status, now, lease, limit)
+	return args.Get(0).([]domain.NotificationDelivery), args.Error(1)
+}
+func (m *MockCommRepo) CountDeliveryIssues(schoolID uint, since time.Time) (int64, error) {
+	args := m.Called(schoolID, since)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+// Push subscriptions
+func (m *MockCommRepo) SavePushSubscription(sub *domain.PushSubscription) error {
+	return m.Called(sub).Error(0)
+}
+func (m *MockCommRepo) GetPushSubscriptions(userID uint) ([]domain.PushSubscription, error) {
+	args := m.Called(userID)
+	return args.Get(0).([]domain.PushSubscription), args.Error(1)
+}
+func (m *MockCommRepo) DeletePushSubscription(userID uint, endpoint string) error {
+	return m.Called(userID, endpoint).Error(0)
+}
+func (m *MockCommRepo) DeletePushSubscriptionByEndpoint(endpoint string) error {
+	return m.Called(endpoint).Error(0)
+}
+
+// SMS
+func (m *MockCommRepo) ReserveSMSSegments(schoolID uint, month string, segments, quota int) (bool, error) {
+	args := m.Called(schoolID, month, segments, quota)
+	return args.Bool(0), args.Error(1)
+}
+func (m *MockCommRepo) AddSMSUsage(schoolID uint, month string, messages, segments, costCents int) error {
+	return m.Called(schoolID, month, messages, segments, costCents).Error(0)
+}
+func (m *MockCommRepo) GetSMSUsage(schoolID uint, month string) (*domain.SMSUsage, error) {
+	args := m.Called(schoolID, month)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*domain.SMSUsage), args.Error(1)
+}
+func (m *MockCommRepo) CreateAbsenceAlert(alert *domain.AbsenceAlert) (bool, error) {
+	args := m.Called(alert)
+	return args.Bool(0), args.Error(1)
+}
 
 // Messaging
 func (m *MockCommRepo) CreateConversation(c *domain.Conversation) error {
@@ -53,7 +131,7 @@ func (m *MockCommRepo) GetConversationsByUserID(userID uint) ([]domain.Conversat
 	args := m.Called(userID)
 	return args.Get(0).([]domain.Conversation), args.Error(1)
 }
-func (m *MockCommRepo) GetConversationByID(id uint) (*domain.Conversation, error) {
+func (m *MockCommRepo) GetConversationByID(ctx context.Context, id uint) (*domain.Conversation, error) {
 	args := m.Called(id)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -72,6 +150,70 @@ func (m *MockCommRepo) GetMessagesByConversationID(convID uint, limit, offset in
 func (m *MockCommRepo) SoftDeleteMessage(id uint) error {
 	return m.Called(id).Error(0)
 }
+func (m *MockCommRepo) AddConversationParticipants(convID uint, userIDs []uint) error {
+	return m.Called(convID, userIDs).Error(0)
+}
+func (m *MockCommRepo) RemoveConversationParticipant(convID, userID uint) error {
+	return m.Called(convID, userID).Error(0)
+}
+func (m *MockCommRepo) GetMessageByID(id uint) (*domain.Message, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*domain.Message), args.Error(1)
+}
+func (m *MockCommRepo) SaveConversationRead(r *domain.ConversationRead) error {
+	return m.Called(r).Error(0)
+}
+
+// Attachments
+func (m *MockCommRepo) CreateAttachment(a *domain.Attachment) error {
+	a.ID = 1
+	return m.Called(a).Error(0)
+}
+func (m *MockCommRepo) GetAttachmentByID(id uint) (*domain.Attachment, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*domain.Attachment), args.Error(1)
+}
+func (m *MockCommRepo) GetAttachmentsByIDs(ids []uint) ([]domain.Attachment, error) {
+	args := m.Called(ids)
+	return args.Get(0).([]domain.Attachment), args.Error(1)
+}
+func (m *MockCommRepo) LinkAttachments(messageID uint, ids []uint) error {
+	return m.Called(messageID, ids).Error(0)
+}
+
+// Announcements
+func (m *MockCommRepo) CreateAnnouncement(a *domain.Announcement, conv *domain.Conversation, msg *domain.Message, recipients []uint) error {
+	a.ID, a.ConversationID = 1, 1
+	return m.Called(a, conv, msg, recipients).Error(0)
+}
+func (m *MockCommRepo) GetAnnouncementByID(id uint) (*domain.Announcement, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*domain.Announcement), args.Error(1)
+}
+func (m *MockCommRepo) GetAnnouncementsByUserID(userID uint) ([]domain.Announcement, error) {
+	args := m.Called(userID)
+	return args.Get(0).([]domain.Announcement), args.Error(1)
+}
+func (m *MockCommRepo) GetAnnouncementRecipients(announcementID uint) ([]domain.AnnouncementRecipient, error) {
+	args := m.Called(announcementID)
+	return args.Get(0).([]domain.AnnouncementRecipient), args.Error(1)
+}
+func (m *MockCommRepo) MarkAnnouncementRead(announcementID, userID uint, at time.Time) (bool, error) {
+	args := m.Called(announcementID, userID)
+	return args.Bool(0), args.Error(1)
+}
+func (m *MockCommRepo) RecordAnnouncementReminder(announcementID uint, userIDs []uint, at time.Time) error {
+	return m.Called(announcementID, userIDs).Error(0)
+}
 
 // Colloquiums
 func (m *MockCommRepo) CreateColloquiumSlot(slot *domain.ColloquiumSlot) error {
@@ -98,8 +240,65 @@ func (m *MockCommRepo) UpdateSlot(slot *domain.ColloquiumSlot) error {
 func (m *MockCommRepo) DeleteSlot(id uint) error {
 	return m.Called(id).Error(0)
 }
-func (m *MockCommRepo) CreateBooking(booking *domain.ColloquiumBooking) error {
-	return m.Called(booking).Error(0)
+func (m *MockCommRepo) BookSlot(booking *domain.ColloquiumBooking) error {
+	args := m.Called(booking)
+	if status, ok := args.Get(1).(domain.BookingStatus); ok {
+		booking.ID, booking.Status = 1, status
+	}
+	return args.Error(0)
+}
+func (m *MockCommRepo) GetBookingByID(ctx context.Context, id uint) (*domain.ColloquiumBooking, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*domain.ColloquiumBooking), args.Error(1)
+}
+func (m *MockCommRepo) CancelBooking(id uint, at time.Time) (*domain.ColloquiumBooking, error) {
+	args := m.Called(id, at)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*domain.ColloquiumBooking), args.Error(1)
+}
+func (m *MockCommRepo) CancelSlot(slotID uint, at time.Time) ([]domain.ColloquiumBooking, error) {
+	args := m.Called(slotID, at)
+	return args.Get(0).([]domain.ColloquiumBooking), args.Error(1)
+}
+func (m *MockCommRepo) CheckInSlot(slotID uint, at time.Time) error {
+	return m.Called(slotID, at).Error(0)
+}
+func (m *MockCommRepo) GetFollowUpSlots(from, to time.Time) ([]domain.ColloquiumSlot, error) {
+	args := m.Called(from, to)
+	return args.Get(0).([]domain.ColloquiumSlot), args.Error(1)
+}
+func (m *MockCommRepo) MarkSlotLateSent(slotID uint, at time.Time) (bool, error) {
+	args := m.Called(slotID, at)
+	return args.Bool(0), args.Error(1)
+}
+func (m *MockCommRepo) MarkSlotFollowUpSent(slotID uint, at time.Time) (bool, error) {
+	args := m.Called(slotID, at)
+	return args.Bool(0), args.Error(1)
+}
+
+// Meeting days
+func (m *MockCommRepo) CreateMeetingDay(day *domain.MeetingDay, slots []domain.ColloquiumSlot) error {
+	day.ID = 1
+	return m.Called(day, slots).Error(0)
+}
+func (m *MockCommRepo) GetMeetingDayByID(id uint) (*domain.MeetingDay, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*domain.MeetingDay), args.Error(1)
+}
+func (m *MockCommRepo) GetMeetingDaySlots(dayID uint) ([]domain.ColloquiumSlot, error) {
+	args := m.Called(dayID)
+	return args.Get(0).([]domain.ColloquiumSlot), args.Error(1)
+}
+func (m *MockCommRepo) BookSlots(bookings []*domain.ColloquiumBooking) error {
+	return m.Called(bookings).Error(0)
 }
 func (m *MockCommRepo) GetBookingsBySlotID(slotID uint) ([]domain.ColloquiumBooking, error) {
 	args := m.Called(slotID)
@@ -109,6 +308,11 @@ func (m *MockCommRepo) GetBookingsByParentID(parentID uint) ([]domain.Colloquium
 	args := m.Called(parentID)
 	return args.Get(0).([]domain.ColloquiumBooking), args.Error(1)
 }
+func (m *MockCommRepo) MarkBookingReminderSent(bookingID uint, at time.Time) (bool, error) {
+	args := m.Called(bookingID, at)
+	return args.Bool(0), args.Error(1)
+}
+
 func (m *MockCommRepo) GetBookingsByDateRange(from, to time.Time) ([]domain.ColloquiumBooking, error) {
 	args := m.Called(from, to)
 	return args.Get(0).([]domain.ColloquiumBooking), args.Error(1)
@@ -122,52 +326,44 @@ func (m *MockCommRepo) DeleteBooking(id uint) error {
 
 // --- Tests ---
 
-func TestScheduler(t *testing.T) {
+func TestColloquiumReminders(t *testing.T) {
 	mockRepo := new(MockCommRepo)
-	// mock notif service calls via repo mock?
-	// Scheduler calls s.notifService.TriggerNotification -> s.repo.GetPreferences + s.repo.CreateNotification
-	// This is integration-ish.
-	// We'll mock the repo calls that NotificationService makes.
-
-	// Creating real service with mock repo
-	notifSvc := NewNotificationService(mockRepo)
-	// But we need a Logger
-	logger := zap.NewNop()
-
-	sched := NewScheduler(mockRepo, notifSvc, logger)
-
-	// Expectations
-	// 1. GetBookingsByDateRange return 1 booking
-	mockRepo.On("GetBookingsByDateRange", mock.Anything, mock.Anything).Return([]domain.ColloquiumBooking{{ParentID: 10}}, nil)
-
-	// 2. TriggerNotification flow
-	// 2a. GetPreferences (called by TriggerNotification)
-	mockRepo.On("GetPreferences", uint(10)).Return([]domain.NotificationPreference{}, nil)
-	// 2b. CreateNotification
-	mockRepo.On("CreateNotification", mock.MatchedBy(func(n *domain.Notification) bool {
-		return n.UserID == 10 && n.Type == domain.NotifTypeSystem && n.Title == "Reminder"
-	})).Return(nil)
+	svc := newColloquiumService(mockRepo)
+	mockRepo.On("GetPreferences", mock.Anything).Return(nil, nil)
 
-	// Act
-	sched.SendReminders()
+	// Late in the evening, tomorrow is the 11th at school
+	now := time.Date(2026, 12, 10, 23, 30, 0, 0, schoolLocation)
+	tomorrow := time.Date(2026, 12, 11, 0, 0, 0, 0, time.UTC)
+	slot := domain.ColloquiumSlot{ID: 1, TeacherID: 5, Date: tomorrow, StartTime: "16:00", EndTime: "16:15"}
+	mockRepo.On("GetBookingsByDateRange", tomorrow, tomorrow.AddDate(0, 0, 1)).Return([]domain.ColloquiumBooking{
+		{ID: 1, ParentID: 100, Status: domain.BookingConfirmed, Slot: slot},
+		{ID: 2, ParentID: 101, Status: domain.BookingConfirmed, Slot: slot},
+	}, nil)
+	mockRepo.On("MarkBookingReminderSent", uint(1), now).Return(true, nil).Once()
+	// Reminded by an earlier run
+	mockRepo.On("MarkBookingReminderSent", uint(2), now).Return(false, nil).Once()
+	notified(mockRepo, 100, "Colloquium reminder")
 
-	// Assert
+	sent, err := svc.SendReminders(now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
 	mockRepo.AssertExpectations(t)
+	mockRepo.AssertNumberOfCalls(t, "CreateNotification", 1)
 }
 
 func TestTriggerNotification(t *testing.T) {
 	mockRepo := new(MockCommRepo)
-	svc := NewNotificationService(mockRepo)
+	svc := NewNotificationService(mockRepo, nil, nil)
 
-	// User has Preference for EMAIL (but defaults to InApp logic in service if only EMAIL provided but we force logic check)
-	// Service implementation: "if p.Type == notifType { channel = p.Channels[0] }"
+	// User has Preference for EMAIL, but no email sender is configured: the
+	// notification is only stored in-app
 	prefs := []domain.NotificationPreference{
 		{UserID: 1, Type: domain.NotifTypeGrade, Channels: domain.JSONStringArray{"EMAIL"}},
 	}
 
 	mockRepo.On("GetPreferences", uint(1)).Return(prefs, nil)
 	mockRepo.On("CreateNotification", mock.MatchedBy(func(n *domain.Notification) bool {
-		return n.UserID == 1 && n.Type == domain.NotifTypeGrade && n.Channel == domain.ChannelEmail
+		return n.UserID == 1 && n.Type == domain.NotifTypeGrade && n.Channel == domain.ChannelInApp
 	})).Return(nil)
 
 	err := svc.TriggerNotification(1, domain.NotifTypeGrade, "New Grade", "You got an A", nil)
@@ -177,55 +373,308 @@ func TestTriggerNotification(t *testing.T) {
 
 func TestMessagingFlow(t *testing.T) {
 	mockRepo := new(MockCommRepo)
-	svc := NewMessagingService(mockRepo)
+	users := &MockUserRepo{users: map[uint]*domain.User{
+		1: {ID: 1, SchoolID: 7, Role: domain.RoleTeacher},
+		2: {ID: 2, SchoolID: 7, Role: domain.RoleTeacher},
+	}}
+	svc := NewMessagingService(mockRepo, users, &fakeClasses{}, nil)
 
 	// Create Conversation
 	mockRepo.On("CreateConversation", mock.MatchedBy(func(c *domain.Conversation) bool {
-		return c.Subject == "Hello" && len(c.ParticipantIDs) == 2
+		return c.Subject == "Hello" && len(c.ParticipantIDs) == 2 && c.SchoolID == 7 && c.CreatedBy == 1
 	})).Return(nil)
 
-	id, err := svc.CreateConversation(1, []uint{2}, "Hello", false)
+	id, err := svc.CreateConversation(1, []uint{2}, "Hello", "")
 	assert.NoError(t, err)
 	assert.Equal(t, uint(1), id)
 
 	// Send Message
+	mockRepo.On("GetConversationByID", uint(1)).Return(&domain.Conversation{ID: 1, ParticipantIDs: domain.JSONUintArray{1, 2}}, nil)
 	mockRepo.On("CreateMessage", mock.MatchedBy(func(m *domain.Message) bool {
 		return m.ConversationID == 1 && m.Body == "Hi there"
 	})).Return(nil)
 
-	msg, err := svc.SendMessage(1, 1, "Hi there", nil)
+	msg, err := svc.SendMessage(context.Background(), 1, 1, "Hi there", nil)
 	assert.NoError(t, err)
 	assert.NotNil(t, msg)
 }
 
+type fakeRealtime struct {
+	notifications []*domain.Notification
+	messages      []*domain.Message
+	reads         []*domain.ConversationRead
+	removed       []uint
+}
+
+func (f *fakeRealtime) NotifyNotification(n *domain.Notification) {
+	f.notifications = append(f.notifications, n)
+}
+func (f *fakeRealtime) NotifyNewMessage(conv *domain.Conversation, msg *domain.Message) {
+	f.messages = append(f.messages, msg)
+}
+func (f *fakeRealtime) NotifyConversationRead(read *domain.ConversationRead) {
+	f.reads = append(f.reads, read)
+}
+func (f *fakeRealtime) NotifyParticipantRemoved(convID, userID uint) {
+	f.removed = append(f.removed, userID)
+}
+
+func TestMessagingRealtime(t *testing.T) {
+	mockRepo := new(MockCommRepo)
+	realtime := &fakeRealtime{}
+	svc := NewMessagingService(mockRepo, nil, nil, realtime)
+	conv := &domain.Conversation{ID: 1, ParticipantIDs: domain.JSONUintArray{1, 2}}
+	mockRepo.On("GetConversationByID", uint(1)).Return(conv, nil)
+	mockRepo.On("GetConversationByID", uint(9)).Return(nil, nil)
+	mockRepo.On("CreateMessage", mock.Anything).Return(nil)
+	mockRepo.On("SaveConversationRead", mock.MatchedBy(func(r *domain.ConversationRead) bool {
+		return r.UserID == 2 && r.LastReadMessageID == 1
+	})).Return(nil)
+	mockRepo.On("RemoveConversationParticipant", uint(1), uint(2)).Return(nil)
+
+	msg, err := svc.SendMessage(context.Background(), 1, 1, "Ciao", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []*domain.Message{msg}, realtime.messages)
+
+	assert.NoError(t, svc.MarkRead(context.Background(), 2, 1, msg.ID))
+	assert.Len(t, realtime.reads, 1)
+	assert.ErrorIs(t, svc.MarkRead(context.Background(), 3, 1, msg.ID), ErrNotParticipant)
+	ok, err := svc.CanAccessConversation(context.Background(), 1, 9)
+	assert.NoError(t, err)
+	assert.False(t, ok, "unknown conversation")
+
+	assert.NoError(t, svc.LeaveConversation(context.Background(), 2, 1))
+	assert.Equal(t, []uint{2}, realtime.removed, "unsubscribed on leaving")
+}
+
+func TestNotificationRealtime(t *testing.T) {
+	mockRepo := new(MockCommRepo)
+	realtime := &fakeRealtime{}
+	svc := NewNotificationService(mockRepo, nil, nil)
+	svc.SetRealtime(realtime)
+	mockRepo.On("GetPreferences", uint(1)).Return(nil, nil)
+	mockRepo.On("CreateNotification", mock.Anything).Return(nil)
+	mockRepo.On("MarkNotificationDelivered", uint(5), uint(1)).Return(nil)
+
+	assert.NoError(t, svc.TriggerNotification(1, domain.NotifTypeGrade, "Voto", "8", nil))
+	assert.Len(t, realtime.notifications, 1)
+	assert.NoError(t, svc.AckNotification(1, 5))
+	mockRepo.AssertExpectations(t)
+}
+
+func newColloquiumService(repo *MockCommRepo) *ColloquiumService {
+	users := &MockUserRepo{users: map[uint]*domain.User{
+		5:   {ID: 5, SchoolID: 7, Role: domain.RoleTeacher},
+		100: {ID: 100, SchoolID: 7, Role: domain.RoleParent, Locale: "en"},
+		101: {ID: 101, SchoolID: 7, Role: domain.RoleParent},
+	}}
+	return NewColloquiumService(repo, users, NewNotificationService(repo, users, nil), fakeMeetingLinks{})
+}
+
+type fakeMeetingLinks struct{}
+
+func (fakeMeetingLinks) MeetingLink(ctx context.Context, slot *domain.ColloquiumSlot) (string, error) {
+	return "https://meet.example.org/room", nil
+}
+
+// notified expects a colloquium notification to userID with title.
+func notified(repo *MockCommRepo, userID uint, title string) *mock.Call {
+	return repo.On("CreateNotification", mock.MatchedBy(func(n *domain.Notification) bool {
+		return n.UserID == userID && n.Type == domain.NotifTypeColloquium && n.Title == title
+	})).Return(nil).Once()
+}
+
 func TestBookColloquiumSlot(t *testing.T) {
 	mockRepo := new(MockCommRepo)
-	notifSvc := NewNotificationService(mockRepo) // Not strictly used unless we mock its internal calls, but ColloquiumService uses it.
-	// Actually ColloquiumService calls s.notifService... which is a struct.
-	// If we want to mock NotifService calls, we'd need an interface for NotifService or just let it run (it uses mockRepo anyway).
-	// Since NotifService uses repo, and ColloquiumService uses repo...
+	svc := newColloquiumService(mockRepo)
+	mockRepo.On("GetPreferences", mock.Anything).Return(nil, nil)
+
+	tomorrow := time.Now().AddDate(0, 0, 1)
+	mockRepo.On("GetSlotByID", uint(10)).Return(&domain.ColloquiumSlot{ID: 10, TeacherID: 5, Date: tomorrow, StartTime: "15:00", MaxParticipants: 1, IsAvailable: true}, nil)
+	mockRepo.On("GetSlotByID", uint(11)).Return(&domain.ColloquiumSlot{ID: 11, TeacherID: 5, Date: tomorrow.AddDate(0, 0, -3), IsAvailable: true}, nil)
+	mockRepo.On("GetSlotByID", uint(12)).Return(nil, nil)
 
-	svc := NewColloquiumService(mockRepo, notifSvc)
+	// Case 1: Success, the teacher is told
+	mockRepo.On("BookSlot", mock.Anything).Return(nil, domain.BookingConfirmed).Once()
+	notified(mockRepo, 5, "Nuova prenotazione")
+	booking, err := svc.BookSlot(10, 100, 200, "Notes")
+	require.NoError(t, err)
+	assert.Equal(t, domain.BookingConfirmed, booking.Status)
 
+	// Case 2: Full, the parent waits
+	mockRepo.On("BookSlot", mock.Anything).Return(nil, domain.BookingWaitlisted).Once()
+	booking, err = svc.BookSlot(10, 101, 201, "Late")
+	require.NoError(t, err)
+	assert.Equal(t, domain.BookingWaitlisted, booking.Status)
+
+	mockRepo.On("BookSlot", mock.Anything).Return(domain.ErrAlreadyBooked, nil).Once()
+	_, err = svc.BookSlot(10, 101, 201, "Again")
+	assert.ErrorIs(t, err, domain.ErrAlreadyBooked)
+
+	_, err = svc.BookSlot(11, 100, 200, "")
+	assert.ErrorIs(t, err, domain.ErrSlotUnavailable, "past slots")
+	_, err = svc.BookSlot(12, 100, 200, "")
+	assert.ErrorIs(t, err, ErrSlotNotFound)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestCancelColloquium(t *testing.T) {
+	mockRepo := new(MockCommRepo)
+	svc := newColloquiumService(mockRepo)
+	mockRepo.On("GetPreferences", mock.Anything).Return(nil, nil)
+
+	slot := domain.ColloquiumSlot{ID: 10, TeacherID: 5, Date: time.Now(), StartTime: "15:00", MaxParticipants: 1, IsAvailable: true}
+	mockRepo.On("GetBookingByID", uint(1)).Return(&domain.ColloquiumBooking{ID: 1, SlotID: 10, ParentID: 100, Status: domain.BookingConfirmed, Slot: slot}, nil)
+
+	// A parent cancels: the teacher is told and the waiting parent confirmed
+	mockRepo.On("CancelBooking", uint(1), mock.Anything).Return(&domain.ColloquiumBooking{ID: 2, ParentID: 101, Status: domain.BookingConfirmed}, nil).Once()
+	notified(mockRepo, 5, "Prenotazione annullata")
+	notified(mockRepo, 101, "Colloquio confermato")
+	require.NoError(t, svc.CancelBooking(context.Background(), 100, 1))
+
+	assert.ErrorIs(t, svc.CancelBooking(context.Background(), 101, 1), ErrColloquiumNotAllowed, "parents cancel their own bookings only")
+
+	// The teacher cancels a booking: the parent is told, in their language
+	mockRepo.On("CancelBooking", uint(1), mock.Anything).Return(nil, nil).Once()
+	notified(mockRepo, 100, "Colloquium cancelled")
+	require.NoError(t, svc.CancelBooking(context.Background(), 5, 1))
+
+	// The teacher withdraws the slot: everyone booked or waiting is told
+	mockRepo.On("GetSlotByID", uint(10)).Return(&slot, nil)
+	mockRepo.On("CancelSlot", uint(10), mock.Anything).Return([]domain.ColloquiumBooking{
+		{ID: 2, ParentID: 101, Status: domain.BookingConfirmed},
+		{ID: 3, ParentID: 100, Status: domain.BookingWaitlisted},
+	}, nil).Once()
+	notified(mockRepo, 101, "Colloquio annullato")
+	notified(mockRepo, 100, "Colloquium cancelled")
+	assert.ErrorIs(t, svc.CancelSlot(6, 10), ErrColloquiumNotAllowed)
+	require.NoError(t, svc.CancelSlot(5, 10))
+	mockRepo.AssertExpectations(t)
+}
+
+func TestCreateColloquiumSlot(t *testing.T) {
+	mockRepo := new(MockCommRepo)
+	svc := newColloquiumService(mockRepo)
+	ctx := context.Background()
+	date := time.Now().AddDate(0, 0, 7)
+	mockRepo.On("CreateColloquiumSlot", mock.Anything).Return(nil)
+
+	slot, err := svc.CreateSlot(ctx, 5, date, "15:00", "15:15", 1, domain.ColloquiumIndividual, domain.ColloquiumOnline)
+	require.NoError(t, err)
+	assert.Equal(t, "https://meet.example.org/room", slot.MeetingURL)
+
+	slot, err = svc.CreateSlot(ctx, 5, date, "15:00", "15:15", 1, domain.ColloquiumIndividual, "")
+	require.NoError(t, err)
+	assert.Equal(t, domain.ColloquiumInPerson, slot.Mode)
+	assert.Empty(t, slot.MeetingURL)
+
+	_, err = svc.CreateSlot(ctx, 5, date, "15:00", "15:15", 1, domain.ColloquiumIndividual, "VIDEO")
+	assert.ErrorIs(t, err, ErrInvalidSlot)
+	_, err = svc.CreateSlot(ctx, 5, date, "15:15", "15:00", 1, domain.ColloquiumIndividual, domain.ColloquiumPhone)
+	assert.ErrorIs(t, err, ErrInvalidSlot)
+
+	offline := NewColloquiumService(mockRepo, &MockUserRepo{}, nil, nil)
+	_, err = offline.CreateSlot(ctx, 5, date, "15:00", "15:15", 1, domain.ColloquiumIndividual, domain.ColloquiumOnline)
+	assert.ErrorIs(t, err, ErrInvalidSlot, "no meeting provider")
+	mockRepo.AssertNumberOfCalls(t, "CreateColloquiumSlot", 2)
+}
+
+func TestColloquiumWaitingRoom(t *testing.T) {
+	mockRepo := new(MockCommRepo)
+	svc := newColloquiumService(mockRepo)
+	mockRepo.On("GetPreferences", mock.Anything).Return(nil, nil)
+
+	lateSent := time.Date(2026, 12, 10, 16, 5, 0, 0, schoolLocation)
 	slot := &domain.ColloquiumSlot{
-		ID: 10, TeacherID: 5, MaxParticipants: 1, IsAvailable: true,
+		ID: 10, TeacherID: 5, Date: time.Date(2026, 12, 10, 0, 0, 0, 0, time.UTC), StartTime: "16:00", EndTime: "16:15",
+		Mode: domain.ColloquiumOnline, MeetingURL: "https://meet.example.org/room", IsAvailable: true, LateSentAt: &lateSent,
 	}
-
-	// Case 1: Success
 	mockRepo.On("GetSlotByID", uint(10)).Return(slot, nil)
-	// Empty bookings
-	mockRepo.On("GetBookingsBySlotID", uint(10)).Return([]domain.ColloquiumBooking{}, nil).Once()
-	mockRepo.On("CreateBooking", mock.Anything).Return(nil)
+	mockRepo.On("GetBookingsBySlotID", uint(10)).Return([]domain.ColloquiumBooking{
+		{ID: 1, SlotID: 10, ParentID: 100, Status: domain.BookingConfirmed},
+		{ID: 2, SlotID: 10, ParentID: 101, Status: domain.BookingWaitlisted},
+	}, nil)
+	now := time.Date(2026, 12, 10, 16, 7, 0, 0, schoolLocation)
 
-	err := svc.BookSlot(10, 100, 200, "Notes")
-	assert.NoError(t, err)
+	room, err := svc.WaitingRoom(100, 10, now)
+	require.NoError(t, err)
+	assert.Equal(t, "https://meet.example.org/room", room.MeetingURL)
+	assert.False(t, room.CheckedIn)
+	assert.True(t, room.Late)
+	_, err = svc.WaitingRoom(101, 10, now)
+	assert.ErrorIs(t, err, ErrColloquiumNotAllowed, "waiting list parents are not in the meeting")
 
-	// Case 2: Full
-	mockRepo.On("GetSlotByID", uint(10)).Return(slot, nil)
-	// Existing booking
-	mockRepo.On("GetBookingsBySlotID", uint(10)).Return([]domain.ColloquiumBooking{{ID: 99}}, nil)
+	_, err = svc.CheckIn(5, 10, now.Add(-time.Hour))
+	assert.ErrorIs(t, err, domain.ErrSlotUnavailable, "too early")
+	_, err = svc.CheckIn(6, 10, now)
+	assert.ErrorIs(t, err, ErrColloquiumNotAllowed)
+
+	// Late: the parents told so are told the teacher joined
+	mockRepo.On("CheckInSlot", uint(10), now).Return(nil).Once()
+	notified(mockRepo, 100, "Teacher joined")
+	room, err = svc.CheckIn(5, 10, now)
+	require.NoError(t, err)
+	assert.True(t, room.CheckedIn)
+	assert.False(t, room.Late)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestColloquiumFollowUps(t *testing.T) {
+	mockRepo := new(MockCommRepo)
+	svc := newColloquiumService(mockRepo)
+	mockRepo.On("GetPreferences", mock.Anything).Return(nil, nil)
+
+	day := time.Date(2026, 12, 10, 0, 0, 0, 0, time.UTC)
+	checkedIn := time.Date(2026, 12, 10, 15, 58, 0, 0, schoolLocation)
+	booking := func(id, parentID uint) domain.ColloquiumBooking {
+		return domain.ColloquiumBooking{ID: id, ParentID: parentID, Status: domain.BookingConfirmed}
+	}
+	slots := []domain.ColloquiumSlot{
+		// Online, the teacher did not check in
+		{ID: 1, TeacherID: 5, Date: day, StartTime: "16:00", EndTime: "16:15", Mode: domain.ColloquiumOnline, Bookings: []domain.ColloquiumBooking{booking(1, 100)}},
+		{ID: 2, TeacherID: 5, Date: day, StartTime: "16:00", EndTime: "16:15", Mode: domain.ColloquiumOnline, CheckedInAt: &checkedIn, Bookings: []domain.ColloquiumBooking{booking(2, 101)}},
+		// Ended
+		{ID: 3, TeacherID: 5, Date: day, StartTime: "15:00", EndTime: "15:30", Mode: domain.ColloquiumInPerson, Bookings: []domain.ColloquiumBooking{booking(3, 100), booking(4, 101)}},
+		{ID: 4, TeacherID: 5, Date: day, StartTime: "16:00", EndTime: "16:15", Mode: domain.ColloquiumOnline},
+		// Sent by another scheduler
+		{ID: 5, TeacherID: 5, Date: day, StartTime: "14:00", EndTime: "14:15", Bookings: []domain.ColloquiumBooking{booking(5, 101)}},
+	}
+	now := time.Date(2026, 12, 10, 16, 7, 0, 0, schoolLocation)
+	mockRepo.On("GetFollowUpSlots", day.AddDate(0, 0, -1), day).Return(slots, nil)
+	mockRepo.On("MarkSlotLateSent", uint(1), now).Return(true, nil).Once()
+	mockRepo.On("MarkSlotFollowUpSent", uint(3), now).Return(true, nil).Once()
+	mockRepo.On("MarkSlotFollowUpSent", uint(5), now).Return(false, nil).Once()
+	notified(mockRepo, 100, "Teacher running late")
+	notified(mockRepo, 5, "Note del colloquio")
+	notified(mockRepo, 100, "How did the colloquium go?")
+	notified(mockRepo, 101, "Com'è andato il colloquio?")
+
+	sent, err := svc.SendDue(now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, sent)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestColloquiumNotesAndFeedback(t *testing.T) {
+	mockRepo := new(MockCommRepo)
+	svc := newColloquiumService(mockRepo)
+
+	yesterday := time.Now().AddDate(0, 0, -1)
+	held := &domain.ColloquiumBooking{ID: 1, ParentID: 100, Status: domain.BookingConfirmed,
+		Slot: domain.ColloquiumSlot{ID: 10, TeacherID: 5, Date: yesterday, StartTime: "15:00", EndTime: "15:15"}}
+	mockRepo.On("GetBookingByID", uint(1)).Return(held, nil)
+	mockRepo.On("GetBookingByID", uint(2)).Return(&domain.ColloquiumBooking{ID: 2, ParentID: 100, Status: domain.BookingConfirmed,
+		Slot: domain.ColloquiumSlot{ID: 11, TeacherID: 5, Date: time.Now().AddDate(0, 0, 1), StartTime: "15:00", EndTime: "15:15"}}, nil)
+	mockRepo.On("UpdateBooking", mock.Anything).Return(nil)
+
+	require.NoError(t, svc.AddFeedback(context.Background(), 100, 1, 4, "Utile"))
+	assert.Equal(t, 4, *held.FeedbackRating)
+	require.NoError(t, svc.AddNotes(context.Background(), 5, 1, "Migliorare la concentrazione"))
+	assert.Equal(t, "Migliorare la concentrazione", held.NotesAfter)
 
-	errFull := svc.BookSlot(10, 101, 201, "Late")
-	assert.Error(t, errFull)
-	assert.Equal(t, "slot is full", errFull.Error())
+	assert.ErrorIs(t, svc.AddFeedback(context.Background(), 100, 1, 6, ""), ErrInvalidFeedback)
+	assert.ErrorIs(t, svc.AddFeedback(context.Background(), 101, 1, 3, ""), ErrColloquiumNotAllowed)
+	assert.ErrorIs(t, svc.AddNotes(context.Background(), 6, 1, ""), ErrColloquiumNotAllowed)
+	assert.ErrorIs(t, svc.AddFeedback(context.Background(), 100, 2, 3, ""), ErrColloquiumNotEnded)
+	mockRepo.AssertNumberOfCalls(t, "UpdateBooking", 2)
 }
@@ -0,0 +1,292 @@
+package communication
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"go.uber.org/zap"
+)
+
+const (
+	maxDeliveryAttempts = 5
+	deliveryRetryBase   = time.Minute
+	deliveryRetryMax    = 6 * time.Hour
+	// deliveryLease postpones a delivery while an attempt is running, so that
+	// the retry worker does not pick it up concurrently. If the process dies
+	// mid-attempt, the delivery is retried once the lease expires.
+	deliveryLease       = 5 * time.Minute
+	deliverySendTimeout = time.Minute
+	deliveryBatchSize   = 100
+)
+
+// Sender delivers notifications through an external channel (email, SMS, push).
+type Sender interface {
+	Channel() domain.NotificationChannel
+	// Recipient returns the user's address on this channel, or "" if the user
+	// cannot be reached through it.
+	Recipient(user *domain.User) string
+	Send(ctx context.Context, n *domain.Notification, user *domain.User, recipient string) error
+}
+
+// retryBackoff returns the wait after the given failed attempt: 1m, 4m, 16m,
+// 64m... capped at deliveryRetryMax.
+func retryBackoff(attempt int) time.Duration {
+	d := deliveryRetryBase
+	for i := 1; i < attempt && d < deliveryRetryMax; i++ {
+		d *= 4
+	}
+	if d > deliveryRetryMax {
+		d = deliveryRetryMax
+	}
+	return d
+}
+
+// fanOut records a delivery for each external channel the user chose for n's
+// type and their school has enabled. Deliveries are attempted right away in
+// the background, unless the user is in quiet hours (they wait for the end)
+// or bundles the type into the daily email digest.
+func (s *NotificationService) fanOut(n *domain.Notification, pref *domain.NotificationPreference) {
+	var channels []domain.NotificationChannel
+	for _, name := range pref.Channels {
+		channel := domain.NotificationChannel(name)
+		if _, ok := s.senders[channel]; ok && !containsChannel(channels, channel) {
+			channels = append(channels, channel)
+		}
+	}
+	if len(channels) == 0 {
+		return
+	}
+
+	user, err := s.users.FindByID(n.UserID)
+	if err != nil || user == nil {
+		zap.L().Warn("Cannot deliver notification, user not found",
+			zap.Uint("notification_id", n.ID), zap.Uint("user_id", n.UserID), zap.Error(err))
+		return
+	}
+	enabled, err := s.enabledChannels(user.SchoolID)
+	if err != nil {
+		zap.L().Error("Cannot deliver notification, school channels unavailable",
+			zap.Uint("notification_id", n.ID), zap.Uint("school_id", user.SchoolID), zap.Error(err))
+		return
+	}
+	settings, err := s.repo.GetNotificationSettings(user.ID)
+	if err != nil {
+		// Deliver anyway, ignoring quiet hours and digest time
+		zap.L().Warn("Failed to load notification settings", zap.Uint("user_id", user.ID), zap.Error(err))
+	}
+
+	now := time.Now()
+	for _, channel := range channels {
+		if !enabled[channel] {
+			continue
+		}
+		sender := s.senders[channel]
+		recipient := sender.Recipient(user)
+		if recipient == "" {
+			continue
+		}
+
+		d := &domain.NotificationDelivery{
+			NotificationID: n.ID,
+			UserID:         user.ID,
+			SchoolID:       user.SchoolID,
+			Channel:        channel,
+			Recipient:      recipient,
+			Status:         domain.DeliveryPending,
+		}
+		immediate := false
+		next := now.Add(deliveryLease)
+		if pref.Digest && channel == domain.ChannelEmail {
+			d.Status = domain.DeliveryDigest
+			next = nextDigest(settings, now)
+		} else if end, quiet := quietUntil(settings, now); quiet {
+			next = end
+		} else {
+			immediate = true
+		}
+		d.NextAttemptAt = &next
+
+		if err := s.repo.CreateDelivery(d); err != nil {
+			zap.L().Error("Failed to record notification delivery",
+				zap.Uint("notification_id", n.ID), zap.String("channel", string(channel)), zap.Error(err))
+			continue
+		}
+		if immediate {
+			go s.attempt(d, n, user, sender)
+		}
+	}
+}
+
+func containsChannel(list []domain.NotificationChannel, channel domain.NotificationChannel) bool {
+	for _, c := range list {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// attempt sends a delivery once and records the outcome in the delivery log.
+func (s *NotificationService) attempt(d *domain.NotificationDelivery, n *domain.Notification, user *domain.User, sender Sender) {
+	ctx, cancel := context.WithTimeout(context.Background(), deliverySendTimeout)
+	defer cancel()
+	err := sender.Send(ctx, n, user, d.Recipient)
+
+	settle(d, err, time.Now())
+	s.logAttempt(d)
+}
+
+// settle applies the outcome of a send to d. Transient failures keep the
+// status (pending or digest) and are retried after a backoff.
+func settle(d *domain.NotificationDelivery, err error, now time.Time) {
+	d.Attempts++
+	d.NextAttemptAt = nil
+	d.LastError = ""
+	switch {
+	case err == nil:
+		d.Status = domain.DeliverySent
+		d.SentAt = &now
+	case errors.Is(err, domain.ErrDeliveryRejected):
+		d.Status = domain.DeliveryBounced
+	case d.Attempts >= maxDeliveryAttempts:
+		d.Status = domain.DeliveryFailed
+	default:
+		next := now.Add(retryBackoff(d.Attempts))
+		d.NextAttemptAt = &next
+	}
+	if err != nil {
+		d.LastError = err.Error()
+	}
+}
+
+// fail gives up on a delivery that can no longer be sent.
+func (s *NotificationService) fail(d *domain.NotificationDelivery, reason string) {
+	d.Attempts++
+	d.Status = domain.DeliveryFailed
+	d.NextAttemptAt = nil
+	d.LastError = reason
+	s.logAttempt(d)
+}
+
+// postpone moves a delivery to the end of the user's quiet hours without
+// counting an attempt.
+func (s *NotificationService) postpone(d *domain.NotificationDelivery, until time.Time) {
+	d.NextAttemptAt = &until
+	if err := s.repo.UpdateDelivery(d); err != nil {
+		zap.L().Error("Failed to update delivery", zap.Uint("delivery_id", d.ID), zap.Error(err))
+	}
+}
+
+func (s *NotificationService) logAttempt(d *domain.NotificationDelivery) {
+	if err := s.repo.CreateDeliveryAttempt(&domain.DeliveryAttempt{
+		DeliveryID: d.ID,
+		Attempt:    d.Attempts,
+		Status:     d.Status,
+		Error:      d.LastError,
+		CreatedAt:  time.Now(),
+	}); err != nil {
+		zap.L().Error("Failed to write delivery log", zap.Uint("delivery_id", d.ID), zap.Error(err))
+	}
+	if err := s.repo.UpdateDelivery(d); err != nil {
+		zap.L().Error("Failed to update delivery", zap.Uint("delivery_id", d.ID), zap.Error(err))
+	}
+}
+
+// RetryDeliveries retries the pending deliveries whose backoff has elapsed.
+// It returns the number of deliveries attempted.
+func (s *NotificationService) RetryDeliveries() (int, error) {
+	due, err := s.repo.ClaimDueDeliveries(domain.DeliveryPending, time.Now(), deliveryLease, deliveryBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range due {
+		d := &due[i]
+		sender, ok := s.senders[d.Channel]
+		n, nErr := s.repo.GetNotificationByID(d.NotificationID)
+		user, uErr := s.users.FindByID(d.UserID)
+		if !ok || nErr != nil || uErr != nil || n == nil || user == nil {
+			// Nothing left to deliver (channel disabled, notification or user deleted)
+			s.fail(d, "notification, user or channel no longer available")
+			continue
+		}
+		settings, _ := s.repo.GetNotificationSettings(d.UserID)
+		if end, quiet := quietUntil(settings, time.Now()); quiet {
+			s.postpone(d, end)
+			continue
+		}
+		s.attempt(d, n, user, sender)
+	}
+	return len(due), nil
+}
+
+// SendDigests sends the daily digests that are due: a single email per user
+// listing all the notifications bundled since the previous one. It returns
+// the number of deliveries included.
+func (s *NotificationService) SendDigests() (int, error) {
+	due, err := s.repo.ClaimDueDeliveries(domain.DeliveryDigest, time.Now(), deliveryLease, deliveryBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var users []uint
+	byUser := make(map[uint][]*domain.NotificationDelivery)
+	for i := range due {
+		d := &due[i]
+		if _, ok := byUser[d.UserID]; !ok {
+			users = append(users, d.UserID)
+		}
+		byUser[d.UserID] = append(byUser[d.UserID], d)
+	}
+	for _, userID := range users {
+		s.sendDigest(userID, byUser[userID])
+	}
+	return len(due), nil
+}
+
+func (s *NotificationService) sendDigest(userID uint, deliveries []*domain.NotificationDelivery) {
+	sender, ok := s.senders[domain.ChannelEmail]
+	user, err := s.users.FindByID(userID)
+	if !ok || err != nil || user == nil {
+		for _, d := range deliveries {
+			s.fail(d, "user or channel no longer available")
+		}
+		return
+	}
+	settings, _ := s.repo.GetNotificationSettings(userID)
+	if end, quiet := quietUntil(settings, time.Now()); quiet {
+		for _, d := range deliveries {
+			s.postpone(d, end)
+		}
+		return
+	}
+
+	var lines []string
+	var included []*domain.NotificationDelivery
+	for _, d := range deliveries {
+		n, err := s.repo.GetNotificationByID(d.NotificationID)
+		if err != nil || n == nil {
+			s.fail(d, "notification no longer available")
+			continue
+		}
+		lines = append(lines, "- "+n.Title+": "+n.Body)
+		included = append(included, d)
+	}
+	if len(included) == 0 {
+		return
+	}
+
+	digest := &domain.Notification{UserID: userID, Type: digestType, Body: strings.Join(lines, "\n")}
+	ctx, cancel := context.WithTimeout(context.Background(), deliverySendTimeout)
+	defer cancel()
+	err = sender.Send(ctx, digest, user, included[0].Recipient)
+
+	now := time.Now()
+	for _, d := range included {
+		settle(d, err, now)
+		s.logAttempt(d)
+	}
+}
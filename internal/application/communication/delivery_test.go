@@ -0,0 +1,222 @@
+package communication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type MockUserRepo struct {
+	users map[uint]*domain.User
+}
+
+func (m *MockUserRepo) Create(user *domain.User) error                 { return nil }
+func (m *MockUserRepo) FindByEmail(email string) (*domain.User, error) { return nil, nil }
+func (m *MockUserRepo) FindByID(id uint) (*domain.User, error)         { return m.users[id], nil }
+func (m *MockUserRepo) FindAll(schoolID uint) ([]domain.User, error) {
+	var users []domain.User
+	for _, u := range m.users {
+		if u.SchoolID == schoolID {
+			users = append(users, *u)
+		}
+	}
+	return users, nil
+}
+func (m *MockUserRepo) Delete(id uint) error                                  { return nil }
+func (m *MockUserRepo) Update(user *domain.User) error                        { return nil }
+func (m *MockUserRepo) CountAll() (int64, error)                              { return 0, nil }
+func (m *MockUserRepo) CountBySchoolAndRole(uint, domain.Role) (int64, error) { return 0, nil }
+func (m *MockUserRepo) GetByExternalID(ctx context.Context, externalID string) (*domain.User, error) {
+	return nil, nil
+}
+
+type MockSchoolSettings struct {
+	settings []domain.SchoolSettings
+}
+
+func (m *MockSchoolSettings) GetSchoolSettings(schoolID uint) ([]domain.SchoolSettings, error) {
+	return m.settings, nil
+}
+func (m *MockSchoolSettings) GetSchoolSettingsByKey(key string) ([]domain.SchoolSettings, error) {
+	var found []domain.SchoolSettings
+	for _, setting := range m.settings {
+		if setting.Key == key {
+			found = append(found, setting)
+		}
+	}
+	return found, nil
+}
+
+// fakeSender returns the queued errors in order, then succeeds. It sends
+// emails unless channel is set.
+type fakeSender struct {
+	channel domain.NotificationChannel
+	errs    []error
+	sent    []string
+	last    *domain.Notification
+}
+
+func (f *fakeSender) Channel() domain.NotificationChannel {
+	if f.channel == "" {
+		return domain.ChannelEmail
+	}
+	return f.channel
+}
+func (f *fakeSender) Recipient(user *domain.User) string { return user.Email }
+func (f *fakeSender) Send(ctx context.Context, n *domain.Notification, user *domain.User, recipient string) error {
+	f.sent = append(f.sent, recipient)
+	f.last = n
+	if len(f.errs) == 0 {
+		return nil
+	}
+	err := f.errs[0]
+	f.errs = f.errs[1:]
+	return err
+}
+
+func TestEmailDelivery(t *testing.T) {
+	mockRepo := new(MockCommRepo)
+	users := &MockUserRepo{users: map[uint]*domain.User{
+		1: {ID: 1, Email: "genitore@example.com", SchoolID: 7},
+	}}
+	sender := &fakeSender{errs: []error{errors.New("connection refused")}}
+	svc := NewNotificationService(mockRepo, users, &MockSchoolSettings{}, sender)
+
+	mockRepo.On("GetNotificationSettings", uint(1)).Return(nil, nil)
+	mockRepo.On("GetPreferences", uint(1)).Return([]domain.NotificationPreference{
+		{UserID: 1, Type: domain.NotifTypeGrade, Channels: domain.JSONStringArray{"EMAIL"}},
+	}, nil)
+	mockRepo.On("CreateNotification", mock.Anything).Return(nil)
+	mockRepo.On("CreateDelivery", mock.MatchedBy(func(d *domain.NotificationDelivery) bool {
+		return d.Recipient == "genitore@example.com" && d.SchoolID == 7 && d.Status == domain.DeliveryPending
+	})).Return(nil)
+
+	// First attempt fails transiently: logged and scheduled for retry
+	mockRepo.On("CreateDeliveryAttempt", mock.MatchedBy(func(a *domain.DeliveryAttempt) bool {
+		return a.Attempt == 1 && a.Status == domain.DeliveryPending && a.Error == "connection refused"
+	})).Return(nil).Once()
+	updated := make(chan domain.NotificationDelivery, 1)
+	mockRepo.On("UpdateDelivery", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		updated <- *args.Get(0).(*domain.NotificationDelivery)
+	}).Once()
+
+	require.NoError(t, svc.TriggerNotification(1, domain.NotifTypeGrade, "Matematica", "8", nil))
+	var d domain.NotificationDelivery
+	select {
+	case d = <-updated:
+	case <-time.After(time.Second):
+		t.Fatal("first attempt not made")
+	}
+	assert.Equal(t, domain.DeliveryPending, d.Status)
+	require.NotNil(t, d.NextAttemptAt)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), *d.NextAttemptAt, 5*time.Second)
+
+	// The retry worker picks it up and succeeds
+	mockRepo.On("ClaimDueDeliveries", domain.DeliveryPending, mock.Anything, deliveryLease, deliveryBatchSize).Return([]domain.NotificationDelivery{d}, nil).Once()
+	mockRepo.On("GetNotificationByID", uint(0)).Return(&domain.Notification{UserID: 1, Type: domain.NotifTypeGrade}, nil)
+	mockRepo.On("CreateDeliveryAttempt", mock.MatchedBy(func(a *domain.DeliveryAttempt) bool {
+		return a.Attempt == 2 && a.Status == domain.DeliverySent
+	})).Return(nil).Once()
+	mockRepo.On("UpdateDelivery", mock.MatchedBy(func(d *domain.NotificationDelivery) bool {
+		return d.Status == domain.DeliverySent && d.SentAt != nil && d.NextAttemptAt == nil && d.LastError == ""
+	})).Return(nil).Once()
+
+	n, err := svc.RetryDeliveries()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Len(t, sender.sent, 2)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestDeliveryOutcomes(t *testing.T) {
+	user := &domain.User{ID: 1, Email: "docente@example.com"}
+	n := &domain.Notification{ID: 3, UserID: 1}
+
+	t.Run("Rejected recipient bounces without retry", func(t *testing.T) {
+		mockRepo := new(MockCommRepo)
+		svc := NewNotificationService(mockRepo, nil, nil)
+		sender := &fakeSender{errs: []error{fmt.Errorf("smtp rcpt: %w: 550 no such user", domain.ErrDeliveryRejected)}}
+
+		mockRepo.On("CreateDeliveryAttempt", mock.MatchedBy(func(a *domain.DeliveryAttempt) bool {
+			return a.Status == domain.DeliveryBounced
+		})).Return(nil)
+		mockRepo.On("UpdateDelivery", mock.MatchedBy(func(d *domain.NotificationDelivery) bool {
+			return d.Status == domain.DeliveryBounced && d.NextAttemptAt == nil && strings.Contains(d.LastError, "550")
+		})).Return(nil)
+
+		svc.attempt(&domain.NotificationDelivery{ID: 1, Recipient: user.Email}, n, user, sender)
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Gives up after the last attempt", func(t *testing.T) {
+		mockRepo := new(MockCommRepo)
+		svc := NewNotificationService(mockRepo, nil, nil)
+		sender := &fakeSender{errs: []error{errors.New("421 try again later")}}
+
+		mockRepo.On("CreateDeliveryAttempt", mock.MatchedBy(func(a *domain.DeliveryAttempt) bool {
+			return a.Attempt == maxDeliveryAttempts && a.Status == domain.DeliveryFailed
+		})).Return(nil)
+		mockRepo.On("UpdateDelivery", mock.Anything).Return(nil)
+
+		svc.attempt(&domain.NotificationDelivery{ID: 1, Recipient: user.Email, Attempts: maxDeliveryAttempts - 1}, n, user, sender)
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Channel without sender stays in-app", func(t *testing.T) {
+		mockRepo := new(MockCommRepo)
+		svc := NewNotificationService(mockRepo, &MockUserRepo{}, nil)
+
+		mockRepo.On("GetPreferences", uint(1)).Return([]domain.NotificationPreference{
+			{UserID: 1, Type: domain.NotifTypeAbsence, Channels: domain.JSONStringArray{"SMS"}},
+		}, nil)
+		mockRepo.On("CreateNotification", mock.Anything).Return(nil)
+
+		require.NoError(t, svc.TriggerNotification(1, domain.NotifTypeAbsence, "Assenza", "Oggi", nil))
+		mockRepo.AssertNotCalled(t, "CreateDelivery", mock.Anything)
+	})
+}
+
+func TestRetryBackoff(t *testing.T) {
+	assert.Equal(t, time.Minute, retryBackoff(1))
+	assert.Equal(t, 4*time.Minute, retryBackoff(2))
+	assert.Equal(t, 16*time.Minute, retryBackoff(3))
+	assert.Equal(t, deliveryRetryMax, retryBackoff(20))
+}
+
+func TestEmailTemplates(t *testing.T) {
+	templates, err := NewEmailTemplates("https://registro.example.it")
+	require.NoError(t, err)
+
+	n := &domain.Notification{Type: domain.NotifTypeGrade, Title: "Matematica\n<b>9</b>", Body: "Verifica <script>alert(1)</script>"}
+
+	// Italian by default
+	msg, err := templates.Render(n, &domain.User{Email: "genitore@example.com", FirstName: "Anna"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"genitore@example.com"}, msg.To)
+	assert.Equal(t, "Nuovo voto: Matematica <b>9</b>", msg.Subject)
+	assert.Contains(t, msg.TextBody, "Gentile Anna,")
+	assert.Contains(t, msg.TextBody, "https://registro.example.it")
+	assert.Contains(t, msg.HTMLBody, `lang="it"`)
+	assert.Contains(t, msg.HTMLBody, "&lt;script&gt;")
+	assert.NotContains(t, msg.HTMLBody, "<script>")
+
+	msg, err = templates.Render(n, &domain.User{Email: "parent@example.com", Locale: "en"})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(msg.Subject, "New grade: "))
+	assert.Contains(t, msg.TextBody, "Dear user,")
+	assert.Contains(t, msg.HTMLBody, `lang="en"`)
+
+	// Types without their own template use GENERAL, unknown languages Italian
+	msg, err = templates.Render(&domain.Notification{Type: "DOCUMENT_CREATED", Title: "Nuovo documento"}, &domain.User{Locale: "fr"})
+	require.NoError(t, err)
+	assert.Equal(t, "Nuovo documento", msg.Subject)
+	assert.Contains(t, msg.TextBody, "nuova comunicazione dalla scuola")
+}
@@ -0,0 +1,30 @@
+package communication
+
+import (
+	"context"
+
+	"github.com/k/iRegistro/internal/domain"
+)
+
+// EmailSender delivers notifications by email, rendered with EmailTemplates.
+type EmailSender struct {
+	mailer    domain.Mailer
+	templates *EmailTemplates
+}
+
+func NewEmailSender(mailer domain.Mailer, templates *EmailTemplates) *EmailSender {
+	return &EmailSender{mailer: mailer, templates: templates}
+}
+
+func (s *EmailSender) Channel() domain.NotificationChannel { return domain.ChannelEmail }
+
+func (s *EmailSender) Recipient(user *domain.User) string { return user.Email }
+
+func (s *EmailSender) Send(ctx context.Context, n *domain.Notification, user *domain.User, recipient string) error {
+	msg, err := s.templates.Render(n, user)
+	if err != nil {
+		return err
+	}
+	msg.To = []string{recipient}
+	return s.mailer.Send(ctx, msg)
+}
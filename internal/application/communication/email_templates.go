@@ -0,0 +1,129 @@
+package communication
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/k/iRegistro/internal/domain"
+)
+
+//go:embed templates
+var templateFS embed.FS
+
+const defaultLocale = "it"
+
+// digestType renders the daily digest: no title, the bundled notifications
+// listed in the body.
+const digestType domain.NotificationType = "DIGEST"
+
+// templatedTypes have their own subject and introduction; other notification
+// types use the GENERAL ones.
+var templatedTypes = map[domain.NotificationType]bool{
+	domain.NotifTypeGrade:        true,
+	domain.NotifTypeAbsence:      true,
+	domain.NotifTypeGeneral:      true,
+	domain.NotifTypeColloquium:   true,
+	domain.NotifTypeSystem:       true,
+	domain.NotifTypeAnnouncement: true,
+	digestType:                   true,
+}
+
+// EmailTemplates renders notifications as emails. Each language file
+// (templates/<locale>.tmpl) defines the subject and introduction of every
+// notification type plus the shared strings; the text and HTML layouts are
+// common to all languages.
+type EmailTemplates struct {
+	locales map[string]*texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+	appURL  string
+}
+
+type emailView struct {
+	Lang     string
+	Subject  string
+	Greeting string
+	Intro    string
+	Title    string
+	Body     string
+	Action   string
+	Footer   string
+	AppURL   string
+}
+
+func NewEmailTemplates(appURL string) (*EmailTemplates, error) {
+	t := &EmailTemplates{locales: make(map[string]*texttemplate.Template), appURL: appURL}
+	for _, locale := range []string{"it", "en"} {
+		tmpl, err := texttemplate.ParseFS(templateFS, "templates/"+locale+".tmpl")
+		if err != nil {
+			return nil, err
+		}
+		t.locales[locale] = tmpl
+	}
+
+	var err error
+	if t.text, err = texttemplate.ParseFS(templateFS, "templates/email.txt.tmpl"); err != nil {
+		return nil, err
+	}
+	if t.html, err = htmltemplate.ParseFS(templateFS, "templates/email.html.tmpl"); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Render builds the email for n in the user's language, falling back to Italian.
+func (t *EmailTemplates) Render(n *domain.Notification, user *domain.User) (domain.EmailMessage, error) {
+	lang := user.Locale
+	strs, ok := t.locales[lang]
+	if !ok {
+		lang = defaultLocale
+		strs = t.locales[lang]
+	}
+	notifType := n.Type
+	if !templatedTypes[notifType] {
+		notifType = domain.NotifTypeGeneral
+	}
+
+	data := struct {
+		Name  string
+		Title string
+	}{user.FirstName, n.Title}
+	view := emailView{Lang: lang, Title: n.Title, Body: n.Body, AppURL: t.appURL}
+	for _, s := range []struct {
+		name string
+		dst  *string
+	}{
+		{"subject." + string(notifType), &view.Subject},
+		{"intro." + string(notifType), &view.Intro},
+		{"greeting", &view.Greeting},
+		{"action", &view.Action},
+		{"footer", &view.Footer},
+	} {
+		var buf bytes.Buffer
+		if err := strs.ExecuteTemplate(&buf, s.name, data); err != nil {
+			return domain.EmailMessage{}, fmt.Errorf("email template %s/%s: %w", lang, s.name, err)
+		}
+		*s.dst = buf.String()
+	}
+	// Titles come from user input: keep the subject on one line
+	view.Subject = strings.Join(strings.Fields(view.Subject), " ")
+
+	var text, html bytes.Buffer
+	if err := t.text.Execute(&text, view); err != nil {
+		return domain.EmailMessage{}, err
+	}
+	if err := t.html.Execute(&html, view); err != nil {
+		return domain.EmailMessage{}, err
+	}
+
+	return domain.EmailMessage{
+		To:       []string{user.Email},
+		Subject:  view.Subject,
+		TextBody: text.String(),
+		HTMLBody: html.String(),
+	}, nil
+}
@@ -0,0 +1,487 @@
+package communication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+)
+
+// bookingAttempts is how many times a sequence is planned again when its
+// slots are taken meanwhile by other parents.
+const bookingAttempts = 3
+
+var (
+	ErrMeetingDayNotFound = errors.New("meeting day not found")
+	ErrInvalidMeetingDay  = errors.New("invalid meeting day")
+	// ErrNoItinerary is returned when the free slots of the teachers cannot
+	// be arranged in a sequence without overlaps.
+	ErrNoItinerary = errors.New("no compatible sequence of meetings")
+)
+
+type meetingDayDirectory interface {
+	GetStudentByID(ctx context.Context, id uint) (*domain.Student, error)
+	GetStudentClassIDs(studentID uint) ([]uint, error)
+	GetTeacherIDsForClasses(classIDs []uint) ([]uint, error)
+}
+
+type schedulePrinter interface {
+	GenerateMeetingSchedule(schedule *domain.MeetingSchedule) ([]byte, error)
+}
+
+// MeetingDayRequest defines a meeting day.
+type MeetingDayRequest struct {
+	Title         string                     `json:"title" binding:"required"`
+	Date          string                     `json:"date" binding:"required"` // 2006-01-02
+	StartTime     string                     `json:"start_time" binding:"required"`
+	EndTime       string                     `json:"end_time" binding:"required"`
+	SlotMinutes   int                        `json:"slot_minutes" binding:"required"`
+	BufferMinutes int                        `json:"buffer_minutes"`
+	Teachers      []domain.MeetingDayTeacher `json:"teachers" binding:"required"`
+}
+
+// ItineraryEntry is a meeting of a parent at a meeting day.
+type ItineraryEntry struct {
+	BookingID   uint   `json:"booking_id"`
+	SlotID      uint   `json:"slot_id"`
+	StudentID   uint   `json:"student_id"`
+	TeacherID   uint   `json:"teacher_id"`
+	TeacherName string `json:"teacher_name"`
+	Room        string `json:"room"`
+	StartTime   string `json:"start_time"`
+	EndTime     string `json:"end_time"`
+}
+
+// Itinerary is the personal schedule of a parent at a meeting day, in time
+// order.
+type Itinerary struct {
+	MeetingDay *domain.MeetingDay `json:"meeting_day"`
+	Entries    []ItineraryEntry   `json:"entries"`
+}
+
+// MeetingDayService plans the general parent-teacher meeting days: the
+// principal defines the day, slots are generated for the teachers present
+// and parents book all their meetings at once.
+type MeetingDayService struct {
+	repo      domain.CommunicationRepository
+	users     domain.UserRepository
+	directory meetingDayDirectory
+	printer   schedulePrinter
+}
+
+func NewMeetingDayService(repo domain.CommunicationRepository, users domain.UserRepository, directory meetingDayDirectory, printer schedulePrinter) *MeetingDayService {
+	return &MeetingDayService{repo: repo, users: users, directory: directory, printer: printer}
+}
+
+// CreateMeetingDay defines a meeting day of the school of actorID, a
+// principal or admin, generating the slots of each teacher.
+func (s *MeetingDayService) CreateMeetingDay(actorID uint, req MeetingDayRequest) (*domain.MeetingDay, error) {
+	actor, err := s.users.FindByID(actorID)
+	if err != nil {
+		return nil, err
+	}
+	if actor == nil || !canManageMeetingDays(actor.Role) {
+		return nil, ErrColloquiumNotAllowed
+	}
+
+	date, err := time.Parse("2006-01-02", req.Date)
+	if err != nil {
+		return nil, fmt.Errorf("%w: date must be YYYY-MM-DD", ErrInvalidMeetingDay)
+	}
+	start, err := parseClock(req.StartTime)
+	if err != nil {
+		return nil, fmt.Errorf("%w: start_time must be HH:MM", ErrInvalidMeetingDay)
+	}
+	end, err := parseClock(req.EndTime)
+	if err != nil {
+		return nil, fmt.Errorf("%w: end_time must be HH:MM", ErrInvalidMeetingDay)
+	}
+	switch {
+	case strings.TrimSpace(req.Title) == "":
+		return nil, fmt.Errorf("%w: title is required", ErrInvalidMeetingDay)
+	case req.SlotMinutes < 5 || req.SlotMinutes > 120:
+		return nil, fmt.Errorf("%w: slots last 5 to 120 minutes", ErrInvalidMeetingDay)
+	case req.BufferMinutes < 0 || req.BufferMinutes > 60:
+		return nil, fmt.Errorf("%w: the buffer is 0 to 60 minutes", ErrInvalidMeetingDay)
+	case end-start < req.SlotMinutes:
+		return nil, fmt.Errorf("%w: the day ends before its first slot", ErrInvalidMeetingDay)
+	case len(req.Teachers) == 0:
+		return nil, fmt.Errorf("%w: no teachers", ErrInvalidMeetingDay)
+	}
+
+	staff, err := schoolUsersByID(s.users, actor.SchoolID)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[uint]bool)
+	for _, t := range req.Teachers {
+		if u := staff[t.TeacherID]; u == nil || u.Role != domain.RoleTeacher {
+			return nil, fmt.Errorf("%w: user %d is not a teacher of the school", ErrInvalidMeetingDay, t.TeacherID)
+		}
+		if seen[t.TeacherID] {
+			return nil, fmt.Errorf("%w: teacher %d listed twice", ErrInvalidMeetingDay, t.TeacherID)
+		}
+		seen[t.TeacherID] = true
+	}
+
+	day := &domain.MeetingDay{
+		SchoolID:      actor.SchoolID,
+		Title:         strings.TrimSpace(req.Title),
+		Date:          date,
+		StartTime:     formatClock(start),
+		EndTime:       formatClock(end),
+		SlotMinutes:   req.SlotMinutes,
+		BufferMinutes: req.BufferMinutes,
+		CreatedBy:     actorID,
+		CreatedAt:     time.Now(),
+	}
+	var slots []domain.ColloquiumSlot
+	for _, t := range req.Teachers {
+		day.Teachers = append(day.Teachers, domain.MeetingDayTeacher{TeacherID: t.TeacherID, Room: strings.TrimSpace(t.Room)})
+		for from := start; from+req.SlotMinutes <= end; from += req.SlotMinutes {
+			slots = append(slots, domain.ColloquiumSlot{
+				TeacherID:       t.TeacherID,
+				Date:            date,
+				StartTime:       formatClock(from),
+				EndTime:         formatClock(from + req.SlotMinutes),
+				MaxParticipants: 1,
+				Type:            domain.ColloquiumGeneral,
+				IsAvailable:     true,
+				CreatedAt:       day.CreatedAt,
+			})
+		}
+	}
+	if err := s.repo.CreateMeetingDay(day, slots); err != nil {
+		return nil, err
+	}
+	return day, nil
+}
+
+// GetMeetingDay returns a meeting day of schoolID.
+func (s *MeetingDayService) GetMeetingDay(schoolID, id uint) (*domain.MeetingDay, error) {
+	day, err := s.meetingDay(id)
+	if err != nil {
+		return nil, err
+	}
+	if day.SchoolID != schoolID {
+		return nil, ErrMeetingDayNotFound
+	}
+	return day, nil
+}
+
+func (s *MeetingDayService) meetingDay(id uint) (*domain.MeetingDay, error) {
+	day, err := s.repo.GetMeetingDayByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if day == nil {
+		return nil, ErrMeetingDayNotFound
+	}
+	return day, nil
+}
+
+// BookItinerary books for parentID a meeting with each of teacherIDs, or with
+// every teacher of the student present if none are given, in slots that do
+// not overlap each other nor the parent's other meetings of the day. ctx
+// carries the tenant of the parent.
+func (s *MeetingDayService) BookItinerary(ctx context.Context, parentID, dayID, studentID uint, teacherIDs []uint) (*Itinerary, error) {
+	day, err := s.meetingDay(dayID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if day.Date.Before(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)) {
+		return nil, domain.ErrSlotUnavailable
+	}
+	wanted, err := s.studentTeachers(ctx, parentID, day, studentID, teacherIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; attempt < bookingAttempts; attempt++ {
+		slots, err := s.repo.GetMeetingDaySlots(dayID)
+		if err != nil {
+			return nil, err
+		}
+		free, busy, err := availability(slots, parentID, studentID, wanted)
+		if err != nil {
+			return nil, err
+		}
+		plan := planMeetings(free, busy, day.BufferMinutes)
+		if plan == nil {
+			return nil, ErrNoItinerary
+		}
+
+		bookings := make([]*domain.ColloquiumBooking, 0, len(plan))
+		for _, p := range plan {
+			bookings = append(bookings, &domain.ColloquiumBooking{SlotID: p.slotID, ParentID: parentID, StudentID: studentID, BookedAt: now})
+		}
+		err = s.repo.BookSlots(bookings)
+		if errors.Is(err, domain.ErrSlotUnavailable) {
+			continue // Taken meanwhile: plan again
+		}
+		if err != nil {
+			return nil, err
+		}
+		return s.Itinerary(parentID, dayID)
+	}
+	return nil, domain.ErrSlotUnavailable
+}
+
+// studentTeachers returns the teachers of the student present at the day,
+// restricted to teacherIDs if any.
+func (s *MeetingDayService) studentTeachers(ctx context.Context, parentID uint, day *domain.MeetingDay, studentID uint, teacherIDs []uint) ([]uint, error) {
+	student, err := s.directory.GetStudentByID(ctx, studentID)
+	if err != nil {
+		return nil, err
+	}
+	if student == nil || student.SchoolID != day.SchoolID || !isParentOf(student, parentID) {
+		return nil, ErrColloquiumNotAllowed
+	}
+	classIDs, err := s.directory.GetStudentClassIDs(studentID)
+	if err != nil {
+		return nil, err
+	}
+	teaching, err := s.directory.GetTeacherIDsForClasses(classIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var available []uint
+	for _, t := range day.Teachers {
+		if containsUint(teaching, t.TeacherID) {
+			available = append(available, t.TeacherID)
+		}
+	}
+	if len(teacherIDs) == 0 {
+		if len(available) == 0 {
+			return nil, fmt.Errorf("%w: none of the student's teachers is present", ErrInvalidMeetingDay)
+		}
+		return available, nil
+	}
+	var wanted []uint
+	for _, id := range teacherIDs {
+		if !containsUint(available, id) {
+			return nil, fmt.Errorf("%w: teacher %d does not teach the student or is not present", ErrInvalidMeetingDay, id)
+		}
+		if !containsUint(wanted, id) {
+			wanted = append(wanted, id)
+		}
+	}
+	return wanted, nil
+}
+
+// availability returns the free slots of the wanted teachers not yet met by
+// the student, and the meetings the parent already has that day.
+func availability(slots []domain.ColloquiumSlot, parentID, studentID uint, wanted []uint) (map[uint][]plannedSlot, []interval, error) {
+	free := make(map[uint][]plannedSlot)
+	var busy []interval
+	booked := make(map[uint]bool)
+	for _, slot := range slots {
+		span, err := slotInterval(slot)
+		if err != nil {
+			return nil, nil, err
+		}
+		confirmed := 0
+		for _, b := range slot.Bookings {
+			if b.Status != domain.BookingConfirmed {
+				continue
+			}
+			confirmed++
+			if b.ParentID == parentID {
+				busy = append(busy, span)
+			}
+			if b.StudentID == studentID {
+				booked[slot.TeacherID] = true
+			}
+		}
+		if slot.IsAvailable && confirmed < slot.MaxParticipants && containsUint(wanted, slot.TeacherID) {
+			free[slot.TeacherID] = append(free[slot.TeacherID], plannedSlot{slotID: slot.ID, interval: span})
+		}
+	}
+
+	options := make(map[uint][]plannedSlot)
+	for _, id := range wanted {
+		if !booked[id] {
+			options[id] = free[id] // Possibly none: then there is no plan
+		}
+	}
+	if len(options) == 0 {
+		return nil, nil, domain.ErrAlreadyBooked
+	}
+	return options, busy, nil
+}
+
+// Itinerary returns the meetings of parentID at the day, for all their
+// children.
+func (s *MeetingDayService) Itinerary(parentID, dayID uint) (*Itinerary, error) {
+	day, err := s.meetingDay(dayID)
+	if err != nil {
+		return nil, err
+	}
+	slots, err := s.repo.GetMeetingDaySlots(dayID)
+	if err != nil {
+		return nil, err
+	}
+	staff, err := schoolUsersByID(s.users, day.SchoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	itinerary := &Itinerary{MeetingDay: day, Entries: []ItineraryEntry{}}
+	for _, slot := range slots {
+		for _, b := range slot.Bookings {
+			if b.ParentID != parentID || b.Status != domain.BookingConfirmed {
+				continue
+			}
+			itinerary.Entries = append(itinerary.Entries, ItineraryEntry{
+				BookingID:   b.ID,
+				SlotID:      slot.ID,
+				StudentID:   b.StudentID,
+				TeacherID:   slot.TeacherID,
+				TeacherName: fullName(staff[slot.TeacherID]),
+				Room:        teacherRoom(day, slot.TeacherID),
+				StartTime:   slot.StartTime,
+				EndTime:     slot.EndTime,
+			})
+		}
+	}
+	sort.Slice(itinerary.Entries, func(i, j int) bool {
+		return itinerary.Entries[i].StartTime < itinerary.Entries[j].StartTime
+	})
+	return itinerary, nil
+}
+
+// TeacherSchedule returns the schedule of a teacher at the day, for the
+// teacher and for the principal and admins of the school. ctx carries the
+// tenant of the actor.
+func (s *MeetingDayService) TeacherSchedule(ctx context.Context, actorID, dayID, teacherID uint) (*domain.MeetingSchedule, error) {
+	day, err := s.meetingDay(dayID)
+	if err != nil {
+		return nil, err
+	}
+	if actorID != teacherID {
+		actor, err := s.users.FindByID(actorID)
+		if err != nil {
+			return nil, err
+		}
+		if actor == nil || actor.SchoolID != day.SchoolID || !canManageMeetingDays(actor.Role) {
+			return nil, ErrColloquiumNotAllowed
+		}
+	}
+	present := false
+	for _, t := range day.Teachers {
+		present = present || t.TeacherID == teacherID
+	}
+	if !present {
+		return nil, ErrMeetingDayNotFound
+	}
+
+	slots, err := s.repo.GetMeetingDaySlots(dayID)
+	if err != nil {
+		return nil, err
+	}
+	users, err := schoolUsersByID(s.users, day.SchoolID)
+	if err != nil {
+		return nil, err
+	}
+	schedule := &domain.MeetingSchedule{
+		Title:       day.Title,
+		Date:        day.Date,
+		TeacherID:   teacherID,
+		TeacherName: fullName(users[teacherID]),
+		Room:        teacherRoom(day, teacherID),
+		Entries:     []domain.MeetingScheduleEntry{},
+	}
+	students := make(map[uint]*domain.Student)
+	for _, slot := range slots {
+		if slot.TeacherID != teacherID {
+			continue
+		}
+		entry := domain.MeetingScheduleEntry{StartTime: slot.StartTime, EndTime: slot.EndTime}
+		for _, b := range slot.Bookings {
+			if b.Status != domain.BookingConfirmed {
+				continue
+			}
+			student, ok := students[b.StudentID]
+			if !ok {
+				if student, err = s.directory.GetStudentByID(ctx, b.StudentID); err != nil {
+					return nil, err
+				}
+				students[b.StudentID] = student
+			}
+			entry.BookingID = b.ID
+			entry.ParentName = fullName(users[b.ParentID])
+			if student != nil {
+				entry.StudentName = strings.TrimSpace(student.FirstName + " " + student.LastName)
+			}
+		}
+		schedule.Entries = append(schedule.Entries, entry)
+	}
+	sort.Slice(schedule.Entries, func(i, j int) bool {
+		return schedule.Entries[i].StartTime < schedule.Entries[j].StartTime
+	})
+	return schedule, nil
+}
+
+// PrintTeacherSchedule renders the schedule of TeacherSchedule as a PDF.
+func (s *MeetingDayService) PrintTeacherSchedule(ctx context.Context, actorID, dayID, teacherID uint) ([]byte, error) {
+	schedule, err := s.TeacherSchedule(ctx, actorID, dayID, teacherID)
+	if err != nil {
+		return nil, err
+	}
+	return s.printer.GenerateMeetingSchedule(schedule)
+}
+
+func canManageMeetingDays(role domain.Role) bool {
+	return role == domain.RolePrincipal || role == domain.RoleAdmin || role == domain.RoleSuperAdmin
+}
+
+func isParentOf(student *domain.Student, userID uint) bool {
+	return (student.Parent1ID != nil && *student.Parent1ID == userID) ||
+		(student.Parent2ID != nil && *student.Parent2ID == userID)
+}
+
+func slotInterval(slot domain.ColloquiumSlot) (interval, error) {
+	start, err := parseClock(slot.StartTime)
+	if err != nil {
+		return interval{}, err
+	}
+	end, err := parseClock(slot.EndTime)
+	if err != nil {
+		return interval{}, err
+	}
+	return interval{start: start, end: end}, nil
+}
+
+func teacherRoom(day *domain.MeetingDay, teacherID uint) string {
+	for _, t := range day.Teachers {
+		if t.TeacherID == teacherID {
+			return t.Room
+		}
+	}
+	return ""
+}
+
+func fullName(u *domain.User) string {
+	if u == nil {
+		return ""
+	}
+	return strings.TrimSpace(u.FirstName + " " + u.LastName)
+}
+
+func schoolUsersByID(users domain.UserRepository, schoolID uint) (map[uint]*domain.User, error) {
+	all, err := users.FindAll(schoolID)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]*domain.User, len(all))
+	for i := range all {
+		byID[all[i].ID] = &all[i]
+	}
+	return byID, nil
+}
@@ -0,0 +1,194 @@
+package communication
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/k/iRegistro/internal/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeMeetingDirectory struct {
+	students map[uint]*domain.Student
+	classes  map[uint][]uint // Student -> classes
+	teachers map[uint][]uint // Class -> teachers
+}
+
+func (f *fakeMeetingDirectory) GetStudentByID(ctx context.Context, id uint) (*domain.Student, error) {
+	t, ok := tenant.From(ctx)
+	if !ok {
+		return nil, tenant.ErrNoTenant
+	}
+	if student := f.students[id]; student != nil && student.SchoolID == t.SchoolID {
+		return student, nil
+	}
+	return nil, nil
+}
+func (f *fakeMeetingDirectory) GetStudentClassIDs(studentID uint) ([]uint, error) {
+	return f.classes[studentID], nil
+}
+func (f *fakeMeetingDirectory) GetTeacherIDsForClasses(classIDs []uint) ([]uint, error) {
+	var ids []uint
+	for _, id := range classIDs {
+		ids = append(ids, f.teachers[id]...)
+	}
+	return ids, nil
+}
+
+type fakeSchedulePrinter struct{ printed *domain.MeetingSchedule }
+
+func (p *fakeSchedulePrinter) GenerateMeetingSchedule(schedule *domain.MeetingSchedule) ([]byte, error) {
+	p.printed = schedule
+	return []byte("%PDF"), nil
+}
+
+func newMeetingDayService(repo *MockCommRepo, printer schedulePrinter) *MeetingDayService {
+	parent := uint(20)
+	users := &MockUserRepo{users: map[uint]*domain.User{
+		2:  {ID: 2, SchoolID: 7, Role: domain.RolePrincipal},
+		10: {ID: 10, SchoolID: 7, Role: domain.RoleTeacher, FirstName: "Maria", LastName: "Verdi"},
+		11: {ID: 11, SchoolID: 7, Role: domain.RoleTeacher, FirstName: "Paolo", LastName: "Neri"},
+		12: {ID: 12, SchoolID: 7, Role: domain.RoleTeacher},
+		20: {ID: 20, SchoolID: 7, Role: domain.RoleParent, FirstName: "Anna", LastName: "Rossi"},
+		21: {ID: 21, SchoolID: 7, Role: domain.RoleParent},
+		30: {ID: 30, SchoolID: 8, Role: domain.RoleTeacher},
+	}}
+	directory := &fakeMeetingDirectory{
+		students: map[uint]*domain.Student{40: {ID: 40, SchoolID: 7, FirstName: "Luca", LastName: "Rossi", Parent1ID: &parent}},
+		classes:  map[uint][]uint{40: {5}},
+		teachers: map[uint][]uint{5: {10, 11}},
+	}
+	return NewMeetingDayService(repo, users, directory, printer)
+}
+
+func TestCreateMeetingDay(t *testing.T) {
+	mockRepo := new(MockCommRepo)
+	svc := newMeetingDayService(mockRepo, nil)
+	req := MeetingDayRequest{
+		Title: "Colloqui generali", Date: "2026-12-10", StartTime: "16:00", EndTime: "17:00",
+		SlotMinutes: 15, BufferMinutes: 5,
+		Teachers: []domain.MeetingDayTeacher{{TeacherID: 10, Room: "A1"}, {TeacherID: 11, Room: "B2"}},
+	}
+	mockRepo.On("CreateMeetingDay", mock.Anything, mock.MatchedBy(func(slots []domain.ColloquiumSlot) bool {
+		return len(slots) == 8 && slots[0].StartTime == "16:00" && slots[3].EndTime == "17:00" &&
+			slots[4].TeacherID == 11 && slots[0].Type == domain.ColloquiumGeneral && slots[0].MaxParticipants == 1
+	})).Return(nil).Once()
+
+	day, err := svc.CreateMeetingDay(2, req)
+	require.NoError(t, err)
+	assert.Equal(t, uint(7), day.SchoolID)
+	assert.Len(t, day.Teachers, 2)
+	mockRepo.AssertExpectations(t)
+
+	_, err = svc.CreateMeetingDay(10, req)
+	assert.ErrorIs(t, err, ErrColloquiumNotAllowed, "teachers do not define meeting days")
+
+	bad := req
+	bad.Teachers = []domain.MeetingDayTeacher{{TeacherID: 30}}
+	_, err = svc.CreateMeetingDay(2, bad)
+	assert.ErrorIs(t, err, ErrInvalidMeetingDay, "teachers of another school")
+	bad = req
+	bad.EndTime = "16:10"
+	_, err = svc.CreateMeetingDay(2, bad)
+	assert.ErrorIs(t, err, ErrInvalidMeetingDay)
+}
+
+func TestBookItinerary(t *testing.T) {
+	mockRepo := new(MockCommRepo)
+	svc := newMeetingDayService(mockRepo, nil)
+	day := &domain.MeetingDay{
+		ID: 1, SchoolID: 7, Date: time.Now().AddDate(0, 0, 1), SlotMinutes: 15, BufferMinutes: 5,
+		Teachers: []domain.MeetingDayTeacher{{TeacherID: 10, Room: "A1"}, {TeacherID: 11, Room: "B2"}, {TeacherID: 12}},
+	}
+	mockRepo.On("GetMeetingDayByID", uint(1)).Return(day, nil)
+	slot := func(id, teacherID uint, start, end string, bookings ...domain.ColloquiumBooking) domain.ColloquiumSlot {
+		return domain.ColloquiumSlot{ID: id, TeacherID: teacherID, StartTime: start, EndTime: end, MaxParticipants: 1, IsAvailable: true, Bookings: bookings}
+	}
+	taken := domain.ColloquiumBooking{ID: 90, ParentID: 21, StudentID: 41, Status: domain.BookingConfirmed}
+	slots := []domain.ColloquiumSlot{
+		slot(100, 10, "16:00", "16:15", taken),
+		slot(101, 10, "16:15", "16:30"),
+		slot(110, 11, "16:00", "16:15"),
+		slot(111, 11, "16:40", "16:55"),
+	}
+	booked := []domain.ColloquiumSlot{
+		slot(101, 10, "16:15", "16:30", domain.ColloquiumBooking{ID: 1, ParentID: 20, StudentID: 40, Status: domain.BookingConfirmed}),
+		slot(111, 11, "16:40", "16:55", domain.ColloquiumBooking{ID: 2, ParentID: 20, StudentID: 40, Status: domain.BookingConfirmed}),
+	}
+	mockRepo.On("GetMeetingDaySlots", uint(1)).Return(slots, nil).Twice()
+	mockRepo.On("GetMeetingDaySlots", uint(1)).Return(booked, nil)
+	sequence := mock.MatchedBy(func(b []*domain.ColloquiumBooking) bool {
+		ids := map[uint]bool{}
+		for _, booking := range b {
+			ids[booking.SlotID] = booking.ParentID == 20 && booking.StudentID == 40
+		}
+		return len(b) == 2 && ids[101] && ids[111]
+	})
+	// Another parent takes a slot meanwhile: the sequence is planned again
+	mockRepo.On("BookSlots", sequence).Return(domain.ErrSlotUnavailable).Once()
+	mockRepo.On("BookSlots", sequence).Return(nil).Once()
+
+	ctx := tenant.With(context.Background(), tenant.Tenant{SchoolID: 7, UserID: 20, Role: domain.RoleParent})
+	itinerary, err := svc.BookItinerary(ctx, 20, 1, 40, nil)
+	require.NoError(t, err)
+	require.Len(t, itinerary.Entries, 2)
+	assert.Equal(t, ItineraryEntry{BookingID: 1, SlotID: 101, StudentID: 40, TeacherID: 10, TeacherName: "Maria Verdi", Room: "A1", StartTime: "16:15", EndTime: "16:30"}, itinerary.Entries[0])
+	assert.Equal(t, "16:40", itinerary.Entries[1].StartTime)
+	mockRepo.AssertExpectations(t)
+
+	_, err = svc.BookItinerary(ctx, 20, 1, 40, []uint{12})
+	assert.ErrorIs(t, err, ErrInvalidMeetingDay, "teacher 12 does not teach the student")
+	_, err = svc.BookItinerary(tenant.With(context.Background(), tenant.Tenant{SchoolID: 7, UserID: 21, Role: domain.RoleParent}), 21, 1, 40, nil)
+	assert.ErrorIs(t, err, ErrColloquiumNotAllowed, "not their child")
+	_, err = svc.BookItinerary(tenant.With(context.Background(), tenant.Tenant{SchoolID: 8, UserID: 20, Role: domain.RoleParent}), 20, 1, 40, nil)
+	assert.ErrorIs(t, err, ErrColloquiumNotAllowed, "read as a tenant of another school")
+	_, err = svc.BookItinerary(context.Background(), 20, 1, 40, nil)
+	assert.ErrorIs(t, err, tenant.ErrNoTenant)
+
+	_, err = svc.BookItinerary(ctx, 20, 1, 40, nil)
+	assert.ErrorIs(t, err, domain.ErrAlreadyBooked)
+
+	full := []domain.ColloquiumSlot{slot(100, 10, "16:00", "16:15", taken), slot(110, 11, "16:00", "16:15")}
+	repo := new(MockCommRepo)
+	repo.On("GetMeetingDayByID", uint(1)).Return(day, nil)
+	repo.On("GetMeetingDaySlots", uint(1)).Return(full, nil)
+	_, err = newMeetingDayService(repo, nil).BookItinerary(ctx, 20, 1, 40, nil)
+	assert.ErrorIs(t, err, ErrNoItinerary)
+}
+
+func TestTeacherSchedule(t *testing.T) {
+	mockRepo := new(MockCommRepo)
+	printer := &fakeSchedulePrinter{}
+	svc := newMeetingDayService(mockRepo, printer)
+	day := &domain.MeetingDay{ID: 1, SchoolID: 7, Title: "Colloqui generali", Teachers: []domain.MeetingDayTeacher{{TeacherID: 10, Room: "A1"}}}
+	mockRepo.On("GetMeetingDayByID", uint(1)).Return(day, nil)
+	mockRepo.On("GetMeetingDaySlots", uint(1)).Return([]domain.ColloquiumSlot{
+		{ID: 101, TeacherID: 10, StartTime: "16:15", EndTime: "16:30", Bookings: []domain.ColloquiumBooking{{ID: 1, ParentID: 20, StudentID: 40, Status: domain.BookingConfirmed}}},
+		{ID: 100, TeacherID: 10, StartTime: "16:00", EndTime: "16:15"},
+		{ID: 110, TeacherID: 11, StartTime: "16:00", EndTime: "16:15"},
+	}, nil)
+
+	ctx := tenant.With(context.Background(), tenant.Tenant{SchoolID: 7, UserID: 10, Role: domain.RoleTeacher})
+	schedule, err := svc.TeacherSchedule(ctx, 10, 1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, "Maria Verdi", schedule.TeacherName)
+	assert.Equal(t, "A1", schedule.Room)
+	assert.Equal(t, []domain.MeetingScheduleEntry{
+		{StartTime: "16:00", EndTime: "16:15"},
+		{StartTime: "16:15", EndTime: "16:30", BookingID: 1, StudentName: "Luca Rossi", ParentName: "Anna Rossi"},
+	}, schedule.Entries)
+
+	_, err = svc.TeacherSchedule(ctx, 20, 1, 10)
+	assert.ErrorIs(t, err, ErrColloquiumNotAllowed)
+	_, err = svc.TeacherSchedule(ctx, 2, 1, 11)
+	assert.ErrorIs(t, err, ErrMeetingDayNotFound, "teacher 11 is not present")
+
+	pdf, err := svc.PrintTeacherSchedule(ctx, 2, 1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("%PDF"), pdf)
+	assert.Equal(t, "Maria Verdi", printer.printed.TeacherName)
+}
@@ -0,0 +1,90 @@
+package communication
+
+import (
+	"fmt"
+	"sort"
+)
+
+// maxPlanSteps bounds the search of a meeting sequence, which is exponential
+// in the worst case.
+const maxPlanSteps = 100000
+
+// interval is a time span in minutes since midnight.
+type interval struct {
+	start, end int
+}
+
+// apart reports whether two intervals leave at least buffer minutes between
+// them.
+func (a interval) apart(b interval, buffer int) bool {
+	return a.end+buffer <= b.start || b.end+buffer <= a.start
+}
+
+type plannedSlot struct {
+	slotID uint
+	interval
+}
+
+// planMeetings picks a free slot for each teacher so that no two meetings,
+// nor a meeting and a busy interval, are closer than buffer minutes. The
+// teachers with fewer free slots are placed first and earlier slots are
+// preferred. It returns nil if there is no such sequence.
+func planMeetings(free map[uint][]plannedSlot, busy []interval, buffer int) map[uint]plannedSlot {
+	teachers := make([]uint, 0, len(free))
+	for id, slots := range free {
+		sort.Slice(slots, func(i, j int) bool { return slots[i].start < slots[j].start })
+		teachers = append(teachers, id)
+	}
+	sort.Slice(teachers, func(i, j int) bool {
+		a, b := len(free[teachers[i]]), len(free[teachers[j]])
+		if a != b {
+			return a < b
+		}
+		return teachers[i] < teachers[j]
+	})
+
+	chosen := make(map[uint]plannedSlot, len(teachers))
+	steps := 0
+	var place func(i int) bool
+	place = func(i int) bool {
+		if i == len(teachers) {
+			return true
+		}
+		for _, slot := range free[teachers[i]] {
+			if steps++; steps > maxPlanSteps {
+				return false
+			}
+			if !fits(slot.interval, chosen, busy, buffer) {
+				continue
+			}
+			chosen[teachers[i]] = slot
+			if place(i + 1) {
+				return true
+			}
+			delete(chosen, teachers[i])
+		}
+		return false
+	}
+	if !place(0) {
+		return nil
+	}
+	return chosen
+}
+
+func fits(slot interval, chosen map[uint]plannedSlot, busy []interval, buffer int) bool {
+	for _, c := range chosen {
+		if !slot.apart(c.interval, buffer) {
+			return false
+		}
+	}
+	for _, b := range busy {
+		if !slot.apart(b, buffer) {
+			return false
+		}
+	}
+	return true
+}
+
+func formatClock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
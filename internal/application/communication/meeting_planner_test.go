@@ -0,0 +1,67 @@
+package communication
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slotsFrom returns back to back slots of minutes from start, with ids from firstID.
+func slotsFrom(firstID uint, start, minutes, count int) []plannedSlot {
+	slots := make([]plannedSlot, count)
+	for i := range slots {
+		from := start + i*minutes
+		slots[i] = plannedSlot{slotID: firstID + uint(i), interval: interval{start: from, end: from + minutes}}
+	}
+	return slots
+}
+
+func TestPlanMeetings(t *testing.T) {
+	const h16 = 16 * 60
+
+	t.Run("meetings are spaced by the buffer", func(t *testing.T) {
+		free := map[uint][]plannedSlot{
+			1: slotsFrom(100, h16, 10, 6),
+			2: slotsFrom(200, h16, 10, 6),
+			3: slotsFrom(300, h16, 10, 6),
+		}
+		plan := planMeetings(free, nil, 5)
+		require.Len(t, plan, 3)
+		for a, sa := range plan {
+			for b, sb := range plan {
+				if a != b {
+					assert.True(t, sa.apart(sb.interval, 5), "%d and %d overlap", a, b)
+				}
+			}
+		}
+		assert.Equal(t, h16, plan[1].start, "earlier slots are preferred")
+	})
+
+	t.Run("the most constrained teacher is placed first", func(t *testing.T) {
+		free := map[uint][]plannedSlot{
+			1: slotsFrom(100, h16, 10, 3),                         // 16:00 to 16:30
+			2: {{slotID: 200, interval: interval{h16, h16 + 10}}}, // Only at 16:00
+		}
+		plan := planMeetings(free, nil, 0)
+		require.NotNil(t, plan)
+		assert.Equal(t, uint(200), plan[2].slotID)
+		assert.Equal(t, uint(101), plan[1].slotID)
+	})
+
+	t.Run("busy intervals are avoided", func(t *testing.T) {
+		free := map[uint][]plannedSlot{1: slotsFrom(100, h16, 10, 3)}
+		plan := planMeetings(free, []interval{{h16, h16 + 10}}, 5)
+		require.NotNil(t, plan)
+		assert.Equal(t, uint(102), plan[1].slotID, "16:10 is too close to the meeting ending at 16:10")
+	})
+
+	t.Run("no sequence", func(t *testing.T) {
+		free := map[uint][]plannedSlot{
+			1: {{slotID: 100, interval: interval{h16, h16 + 10}}},
+			2: {{slotID: 200, interval: interval{h16 + 5, h16 + 15}}},
+		}
+		assert.Nil(t, planMeetings(free, nil, 0))
+		assert.Nil(t, planMeetings(map[uint][]plannedSlot{1: nil}, nil, 0), "a teacher without free slots")
+	})
+}
@@ -0,0 +1,86 @@
+package communication
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/k/iRegistro/internal/domain"
+)
+
+// ErrMessagingNotAllowed is returned when the messaging policy forbids an
+// action; the wrapping error says which rule applied.
+var ErrMessagingNotAllowed = errors.New("not allowed by the messaging policy")
+
+// classDirectory resolves the classes and teachers families may reach.
+type classDirectory interface {
+	GetClassIDsForUser(userID uint, role domain.Role) ([]uint, error)
+	GetTeacherIDsForClasses(classIDs []uint) ([]uint, error)
+}
+
+// The messaging policy:
+//   - conversations never cross schools, and every participant is an
+//     active user;
+//   - only staff start class and staff conversations, and staff
+//     conversations only include staff;
+//   - parents and students only reach the teachers of their (children's)
+//     classes.
+
+func policyError(rule string) error {
+	return fmt.Errorf("%w: %s", ErrMessagingNotAllowed, rule)
+}
+
+// isFamily reports whether role is a parent or student, as opposed to the
+// school's staff.
+func isFamily(role domain.Role) bool {
+	return role == domain.RoleParent || role == domain.RoleStudent
+}
+
+func checkConversationType(initiator *domain.User, convType domain.ConversationType) error {
+	switch convType {
+	case domain.ConvTypeOneToOne:
+		return nil
+	case domain.ConvTypeClass, domain.ConvTypeStaff:
+		if isFamily(initiator.Role) {
+			return policyError(fmt.Sprintf("only staff may start %s conversations", convType))
+		}
+		return nil
+	default:
+		return policyError(fmt.Sprintf("unknown conversation type %q", convType))
+	}
+}
+
+// checkParticipants applies the policy to actor bringing userIDs into a
+// conversation of convType.
+func (s *MessagingService) checkParticipants(actor *domain.User, convType domain.ConversationType, userIDs []uint) error {
+	var reachable []uint
+	if isFamily(actor.Role) {
+		classIDs, err := s.classes.GetClassIDsForUser(actor.ID, actor.Role)
+		if err != nil {
+			return err
+		}
+		if reachable, err = s.classes.GetTeacherIDsForClasses(classIDs); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range userIDs {
+		if id == actor.ID {
+			continue
+		}
+		user, err := s.users.FindByID(id)
+		if err != nil {
+			return err
+		}
+		switch {
+		case user == nil || user.Status == "inactive":
+			return policyError(fmt.Sprintf("user %d not found", id))
+		case user.SchoolID != actor.SchoolID:
+			return policyError("conversations cannot include users of another school")
+		case convType == domain.ConvTypeStaff && isFamily(user.Role):
+			return policyError("staff conversations only include staff")
+		case isFamily(actor.Role) && !containsUint(reachable, id):
+			return policyError("families may only message the teachers of their classes")
+		}
+	}
+	return nil
+}
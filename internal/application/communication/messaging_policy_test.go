@@ -0,0 +1,115 @@
+package communication
+
+import (
+	"context"
+	"testing"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type fakeClasses struct {
+	classes  map[uint][]uint // User -> classes
+	teachers map[uint][]uint // Class -> teachers
+}
+
+func (f *fakeClasses) GetClassIDsForUser(userID uint, role domain.Role) ([]uint, error) {
+	return f.classes[userID], nil
+}
+func (f *fakeClasses) GetTeacherIDsForClasses(classIDs []uint) ([]uint, error) {
+	var ids []uint
+	for _, id := range classIDs {
+		ids = append(ids, f.teachers[id]...)
+	}
+	return ids, nil
+}
+
+func newPolicyService(repo *MockCommRepo) *MessagingService {
+	users := &MockUserRepo{users: map[uint]*domain.User{
+		1: {ID: 1, SchoolID: 7, Role: domain.RoleTeacher},
+		2: {ID: 2, SchoolID: 7, Role: domain.RoleTeacher},
+		3: {ID: 3, SchoolID: 7, Role: domain.RoleParent},
+		4: {ID: 4, SchoolID: 7, Role: domain.RoleStudent},
+		5: {ID: 5, SchoolID: 8, Role: domain.RoleTeacher},
+		6: {ID: 6, SchoolID: 7, Role: domain.RoleSecretary, Status: "inactive"},
+	}}
+	classes := &fakeClasses{
+		classes:  map[uint][]uint{3: {10}, 4: {10}},
+		teachers: map[uint][]uint{10: {1}},
+	}
+	return NewMessagingService(repo, users, classes, nil)
+}
+
+func TestCreateConversationPolicy(t *testing.T) {
+	mockRepo := new(MockCommRepo)
+	mockRepo.On("CreateConversation", mock.Anything).Return(nil)
+	svc := newPolicyService(mockRepo)
+
+	tests := []struct {
+		name      string
+		initiator uint
+		with      []uint
+		convType  domain.ConversationType
+		allowed   bool
+	}{
+		{"teachers talk to anyone in the school", 2, []uint{3}, "", true},
+		{"parents reach their children's teachers", 3, []uint{1}, "", true},
+		{"parents do not reach other teachers", 3, []uint{2}, "", false},
+		{"students reach their teachers", 4, []uint{1}, "", true},
+		{"students do not start staff conversations", 4, []uint{1, 2}, domain.ConvTypeStaff, false},
+		{"parents do not start class conversations", 3, []uint{1, 4}, domain.ConvTypeClass, false},
+		{"staff conversations only include staff", 1, []uint{2, 3}, domain.ConvTypeStaff, false},
+		{"staff conversations", 1, []uint{2}, domain.ConvTypeStaff, true},
+		{"no cross-school conversations", 1, []uint{5}, "", false},
+		{"inactive users are not reachable", 1, []uint{6}, "", false},
+		{"one-to-one means two participants", 1, []uint{2, 3}, domain.ConvTypeOneToOne, false},
+		{"unknown types", 1, []uint{2}, "BROADCAST", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := svc.CreateConversation(tt.initiator, tt.with, "Subject", tt.convType)
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrMessagingNotAllowed)
+			}
+		})
+	}
+}
+
+func TestConversationAccess(t *testing.T) {
+	mockRepo := new(MockCommRepo)
+	svc := newPolicyService(mockRepo)
+	group := &domain.Conversation{ID: 1, SchoolID: 7, CreatedBy: 1, Type: domain.ConvTypeClass, ParticipantIDs: domain.JSONUintArray{1, 3}}
+	mockRepo.On("GetConversationByID", uint(1)).Return(group, nil)
+	mockRepo.On("GetConversationByID", uint(2)).Return(nil, nil)
+	mockRepo.On("GetMessageByID", uint(9)).Return(&domain.Message{ID: 9, ConversationID: 1, SenderID: 3}, nil)
+	mockRepo.On("SoftDeleteMessage", uint(9)).Return(nil)
+	mockRepo.On("AddConversationParticipants", uint(1), []uint{2}).Return(nil)
+	mockRepo.On("RemoveConversationParticipant", uint(1), uint(3)).Return(nil)
+
+	_, err := svc.SendMessage(context.Background(), 2, 1, "Hi", nil)
+	assert.ErrorIs(t, err, ErrNotParticipant)
+	announcement := &domain.Conversation{ID: 3, CreatedBy: 1, ReadOnly: true, ParticipantIDs: domain.JSONUintArray{1, 3}}
+	mockRepo.On("GetConversationByID", uint(3)).Return(announcement, nil)
+	_, err = svc.SendMessage(context.Background(), 3, 3, "Grazie", nil)
+	assert.ErrorIs(t, err, ErrMessagingNotAllowed, "replies disabled")
+	_, err = svc.GetConversationMessages(context.Background(), 1, 4, 50, 0)
+	assert.ErrorIs(t, err, ErrNotParticipant)
+	_, err = svc.GetConversationMessages(context.Background(), 2, 1, 50, 0)
+	assert.ErrorIs(t, err, ErrConversationNotFound)
+
+	assert.ErrorIs(t, svc.SoftDeleteMessage(9, 1), ErrMessagingNotAllowed, "only the sender deletes")
+	assert.NoError(t, svc.SoftDeleteMessage(9, 3))
+
+	assert.ErrorIs(t, svc.AddParticipants(context.Background(), 1, 1, []uint{5}), ErrMessagingNotAllowed)
+	assert.ErrorIs(t, svc.AddParticipants(context.Background(), 3, 1, []uint{2}), ErrMessagingNotAllowed, "not a teacher of the children")
+	assert.NoError(t, svc.AddParticipants(context.Background(), 1, 1, []uint{2}))
+
+	assert.ErrorIs(t, svc.RemoveParticipant(context.Background(), 3, 1, 1), ErrMessagingNotAllowed, "only the creator removes others")
+	assert.NoError(t, svc.RemoveParticipant(context.Background(), 1, 1, 3))
+	assert.NoError(t, svc.LeaveConversation(context.Background(), 3, 1))
+	assert.ErrorIs(t, svc.LeaveConversation(context.Background(), 4, 1), ErrNotParticipant)
+	mockRepo.AssertExpectations(t)
+}
@@ -1,43 +1,69 @@
 package communication
 
 import (
+	"context"
+	"errors"
 	"time"
 
 	"github.com/k/iRegistro/internal/domain"
 )
 
+var (
+	// ErrNotParticipant is returned when a user acts on a conversation they
+	// are not part of.
+	ErrNotParticipant       = errors.New("not a participant of the conversation")
+	ErrConversationNotFound = errors.New("conversation not found")
+	ErrMessageNotFound      = errors.New("message not found")
+)
+
 type MessagingService struct {
-	repo domain.CommunicationRepository
-	// notifService *NotificationService // To notify on new message
+	repo    domain.CommunicationRepository
+	users   domain.UserRepository
+	classes classDirectory
+	// realtime pushes new messages and read receipts to connected clients; it may be nil
+	realtime domain.RealtimeNotifier
 }
 
-func NewMessagingService(repo domain.CommunicationRepository) *MessagingService {
-	return &MessagingService{repo: repo}
+// NewMessagingService creates the service. users and classes resolve the
+// participants allowed by the messaging policy.
+func NewMessagingService(repo domain.CommunicationRepository, users domain.UserRepository, classes classDirectory, realtime domain.RealtimeNotifier) *MessagingService {
+	return &MessagingService{repo: repo, users: users, classes: classes, realtime: realtime}
 }
 
-func (s *MessagingService) CreateConversation(initiatorID uint, participantIDs []uint, subject string, isGroup bool) (uint, error) {
-	// Validate participants?
+// CreateConversation starts a conversation of initiatorID with
+// participantIDs, who must all be allowed by the messaging policy.
+func (s *MessagingService) CreateConversation(initiatorID uint, participantIDs []uint, subject string, convType domain.ConversationType) (uint, error) {
+	initiator, err := s.findUser(initiatorID)
+	if err != nil {
+		return 0, err
+	}
+	if convType == "" {
+		convType = domain.ConvTypeOneToOne
+	}
+	if err := checkConversationType(initiator, convType); err != nil {
+		return 0, err
+	}
+
 	// Add initiator to participants if not present
-	found := false
+	participants := []uint{initiatorID}
 	for _, p := range participantIDs {
-		if p == initiatorID {
-			found = true
-			break
+		if !containsUint(participants, p) {
+			participants = append(participants, p)
 		}
 	}
-	if !found {
-		participantIDs = append(participantIDs, initiatorID)
+	if convType == domain.ConvTypeOneToOne && len(participants) != 2 {
+		return 0, policyError("one-to-one conversations have exactly two participants")
 	}
-
-	convType := domain.ConvTypeOneToOne
-	if isGroup {
-		convType = domain.ConvTypeClass // Simplification for now
+	if err := s.checkParticipants(initiator, convType, participants); err != nil {
+		return 0, err
 	}
 
 	conv := &domain.Conversation{
+		SchoolID:       initiator.SchoolID,
+		CreatedBy:      initiatorID,
 		Type:           convType,
 		Subject:        subject,
-		ParticipantIDs: domain.JSONUintArray(participantIDs),
+		ParticipantIDs: domain.JSONUintArray(participants),
 		CreatedAt:      time.Now(),
 		LastMessageAt:  time.Now(),
 	}
@@ -49,8 +75,16 @@ func (s *MessagingService) CreateConversation(initiatorID uint, participantIDs [
 	return conv.ID, nil
 }
 
-func (s *MessagingService) SendMessage(senderID, convID uint, body string, attachments []domain.MessageAttachment) (*domain.Message, error) {
-	// Verify sender is participant? (Requires GetConversationByID + logic)
+// SendMessage posts a message of senderID with the attachments they uploaded
+// and did not send yet.
+func (s *MessagingService) SendMessage(ctx context.Context, senderID, convID uint, body string, attachmentIDs []uint) (*domain.Message, error) {
+	conv, err := s.participantConversation(ctx, senderID, convID)
+	if err != nil {
+		return nil, err
+	}
+	if conv.ReadOnly && conv.CreatedBy != senderID {
+		return nil, policyError("replies are disabled in this conversation")
+	}
 
 	msg := &domain.Message{
 		ConversationID: convID,
@@ -60,14 +94,18 @@ func (s *MessagingService) SendMessage(senderID, convID uint, body string, attac
 		CreatedAt:      time.Now(),
 	}
 
-	// Convert attachments to JSONMapArray (map string interface)
-	if len(attachments) > 0 {
+	var attachments []domain.Attachment
+	if len(attachmentIDs) > 0 {
+		if attachments, err = messageAttachments(s.repo, senderID, attachmentIDs); err != nil {
+			return nil, err
+		}
 		var atts domain.JSONMapArray
 		for _, a := range attachments {
 			atts = append(atts, map[string]interface{}{
-				"file_path": a.FilePath,
-				"file_name": a.FileName,
-				"file_type": a.FileType,
+				"attachment_id": a.ID,
+				"file_name":     a.FileName,
+				"file_type":     a.MimeType,
+				"size":          a.Size,
 			})
 		}
 		msg.Attachments = atts
@@ -76,8 +114,19 @@ func (s *MessagingService) SendMessage(senderID, convID uint, body string, attac
 	if err := s.repo.CreateMessage(msg); err != nil {
 		return nil, err
 	}
+	if len(attachments) > 0 {
+		ids := make([]uint, len(attachments))
+		for i, a := range attachments {
+			ids[i] = a.ID
+		}
+		if err := s.repo.LinkAttachments(msg.ID, ids); err != nil {
+			return nil, err
+		}
+	}
 
-	// TODO: Trigger Notification to other participants
+	if s.realtime != nil {
+		s.realtime.NotifyNewMessage(conv, msg)
+	}
 	return msg, nil
 }
 
@@ -85,12 +134,153 @@ func (s *MessagingService) GetUserConversations(userID uint) ([]domain.Conversat
 	return s.repo.GetConversationsByUserID(userID)
 }
 
-func (s *MessagingService) GetConversationMessages(convID uint, userID uint, limit, offset int) ([]domain.Message, error) {
-	// Verify participation?
+func (s *MessagingService) GetConversationMessages(ctx context.Context, convID uint, userID uint, limit, offset int) ([]domain.Message, error) {
+	if _, err := s.participantConversation(ctx, userID, convID); err != nil {
+		return nil, err
+	}
 	return s.repo.GetMessagesByConversationID(convID, limit, offset)
 }
 
+// SoftDeleteMessage deletes a message of userID.
 func (s *MessagingService) SoftDeleteMessage(msgID uint, userID uint) error {
-	// Verify ownership?
+	msg, err := s.repo.GetMessageByID(msgID)
+	if err != nil {
+		return err
+	}
+	if msg == nil {
+		return ErrMessageNotFound
+	}
+	if msg.SenderID != userID {
+		return policyError("only the sender may delete a message")
+	}
 	return s.repo.SoftDeleteMessage(msgID)
 }
+
+// AddParticipants adds userIDs to a group conversation of actorID.
+func (s *MessagingService) AddParticipants(ctx context.Context, actorID, convID uint, userIDs []uint) error {
+	conv, err := s.participantConversation(ctx, actorID, convID)
+	if err != nil {
+		return err
+	}
+	if conv.Type == domain.ConvTypeOneToOne {
+		return policyError("one-to-one conversations have exactly two participants")
+	}
+	actor, err := s.findUser(actorID)
+	if err != nil {
+		return err
+	}
+	if actor.SchoolID != conv.SchoolID {
+		return policyError("the conversation belongs to another school")
+	}
+	if err := s.checkParticipants(actor, conv.Type, userIDs); err != nil {
+		return err
+	}
+	return s.repo.AddConversationParticipants(convID, userIDs)
+}
+
+// RemoveParticipant removes userID from a conversation started by actorID.
+func (s *MessagingService) RemoveParticipant(ctx context.Context, actorID, convID, userID uint) error {
+	if actorID == userID {
+		return s.LeaveConversation(ctx, userID, convID)
+	}
+	conv, err := s.participantConversation(ctx, actorID, convID)
+	if err != nil {
+		return err
+	}
+	if conv.CreatedBy != actorID {
+		return policyError("only the creator of the conversation may remove participants")
+	}
+	if !isParticipant(conv, userID) {
+		return ErrNotParticipant
+	}
+	return s.removeParticipant(convID, userID)
+}
+
+// LeaveConversation removes userID from a conversation.
+func (s *MessagingService) LeaveConversation(ctx context.Context, userID, convID uint) error {
+	if _, err := s.participantConversation(ctx, userID, convID); err != nil {
+		return err
+	}
+	return s.removeParticipant(convID, userID)
+}
+
+// removeParticipant removes userID from the conversation and from its live
+// subscribers.
+func (s *MessagingService) removeParticipant(convID, userID uint) error {
+	if err := s.repo.RemoveConversationParticipant(convID, userID); err != nil {
+		return err
+	}
+	if s.realtime != nil {
+		s.realtime.NotifyParticipantRemoved(convID, userID)
+	}
+	return nil
+}
+
+// CanAccessConversation reports whether userID takes part in the conversation.
+func (s *MessagingService) CanAccessConversation(ctx context.Context, userID, convID uint) (bool, error) {
+	conv, err := s.repo.GetConversationByID(ctx, convID)
+	if err != nil {
+		return false, err
+	}
+	return conv != nil && isParticipant(conv, userID), nil
+}
+
+// MarkRead records that userID read the conversation up to messageID and
+// tells the other participants.
+func (s *MessagingService) MarkRead(ctx context.Context, userID, convID, messageID uint) error {
+	if _, err := s.participantConversation(ctx, userID, convID); err != nil {
+		return err
+	}
+	read := &domain.ConversationRead{
+		ConversationID:    convID,
+		UserID:            userID,
+		LastReadMessageID: messageID,
+		ReadAt:            time.Now(),
+	}
+	if err := s.repo.SaveConversationRead(read); err != nil {
+		return err
+	}
+	if s.realtime != nil {
+		s.realtime.NotifyConversationRead(read)
+	}
+	return nil
+}
+
+// participantConversation returns the conversation if userID takes part in it.
+func (s *MessagingService) participantConversation(ctx context.Context, userID, convID uint) (*domain.Conversation, error) {
+	conv, err := s.repo.GetConversationByID(ctx, convID)
+	if err != nil {
+		return nil, err
+	}
+	if conv == nil {
+		return nil, ErrConversationNotFound
+	}
+	if !isParticipant(conv, userID) {
+		return nil, ErrNotParticipant
+	}
+	return conv, nil
+}
+
+func (s *MessagingService) findUser(id uint) (*domain.User, error) {
+	user, err := s.users.FindByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, policyError("unknown user")
+	}
+	return user, nil
+}
+
+func isParticipant(conv *domain.Conversation, userID uint) bool {
+	return containsUint(conv.ParticipantIDs, userID)
+}
+
+func containsUint(ids []uint, id uint) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
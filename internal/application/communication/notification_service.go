@@ -1,17 +1,38 @@
 package communication
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/k/iRegistro/internal/domain"
 )
 
 type NotificationService struct {
-	repo domain.CommunicationRepository
+	repo     domain.CommunicationRepository
+	users    domain.UserRepository
+	settings schoolSettingsReader
+	senders  map[domain.NotificationChannel]Sender
+	realtime domain.RealtimeNotifier
 }
 
-func NewNotificationService(repo domain.CommunicationRepository) *NotificationService {
-	return &NotificationService{repo: repo}
+// NewNotificationService creates the service. senders deliver the external
+// channels; notifications for a channel without a sender stay in-app only.
+func NewNotificationService(repo domain.CommunicationRepository, users domain.UserRepository, settings schoolSettingsReader, senders ...Sender) *NotificationService {
+	s := &NotificationService{
+		repo:     repo,
+		users:    users,
+		settings: settings,
+		senders:  make(map[domain.NotificationChannel]Sender),
+	}
+	for _, sender := range senders {
+		s.senders[sender.Channel()] = sender
+	}
+	return s
+}
+
+// SetRealtime pushes every new notification to the user's connected clients.
+func (s *NotificationService) SetRealtime(realtime domain.RealtimeNotifier) {
+	s.realtime = realtime
 }
 
 // TriggerNotification sends a notification based on user preferences.
@@ -22,26 +43,22 @@ func (s *NotificationService) TriggerNotification(userID uint, notifType domain.
 		return err
 	}
 
-	// 2. Determine Channel (Default to InApp if no pref)
-	channel := domain.ChannelInApp
-	for _, p := range prefs {
-		if p.Type == notifType && len(p.Channels) > 0 {
-			// For simplicity, pick the first configured channel.
-			// Real implementation might broadcast to all.
-			// TODO: Support multiple channels
-			channel = domain.NotificationChannel(p.Channels[0])
+	var pref *domain.NotificationPreference
+	for i := range prefs {
+		if prefs[i].Type == notifType {
+			pref = &prefs[i]
 			break
 		}
 	}
 
-	// 3. Create Notification Record
+	// 2. Create Notification Record (always visible in-app)
 	n := &domain.Notification{
 		UserID:    userID,
 		Type:      notifType,
 		Title:     title,
 		Body:      body,
 		Data:      data,
-		Channel:   channel,
+		Channel:   domain.ChannelInApp,
 		IsRead:    false,
 		CreatedAt: time.Now(),
 	}
@@ -49,17 +66,67 @@ func (s *NotificationService) TriggerNotification(userID uint, notifType domain.
 	if err := s.repo.CreateNotification(n); err != nil {
 		return err
 	}
+	s.pushRealtime(n)
 
-	// 4. Send to External Provider (Email/SMS/Push)
-	// TODO: Integrate actual providers.
-	go s.sendExternal(n)
+	// 3. Fan out to every external channel (Email/SMS/Push) in the preferences
+	if pref != nil {
+		s.fanOut(n, pref)
+	}
 
 	return nil
 }
 
-func (s *NotificationService) sendExternal(n *domain.Notification) {
-	// Stub for sending email/sms/push
-	// logger.Info("Sending notification", "channel", n.Channel, "user", n.UserID)
+// TriggerUrgentNotification notifies userID in-app and sends the
+// notification right away through channel, whatever the user's preferences
+// and quiet hours. It is meant for the alerts a school must deliver, such as
+// unexpected absences, and fails if the channel cannot reach the user.
+func (s *NotificationService) TriggerUrgentNotification(userID uint, notifType domain.NotificationType, title, body string, data domain.JSONMap, channel domain.NotificationChannel) error {
+	user, err := s.findUser(userID)
+	if err != nil {
+		return err
+	}
+	enabled, err := s.enabledChannels(user.SchoolID)
+	if err != nil {
+		return err
+	}
+	if !enabled[channel] {
+		return fmt.Errorf("%w: %s", ErrChannelNotEnabled, channel)
+	}
+	sender := s.senders[channel]
+	recipient := sender.Recipient(user)
+	if recipient == "" {
+		return fmt.Errorf("%w: user %d has no %s address", ErrChannelNotEnabled, userID, channel)
+	}
+
+	n := &domain.Notification{
+		UserID:    userID,
+		Type:      notifType,
+		Title:     title,
+		Body:      body,
+		Data:      data,
+		Channel:   domain.ChannelInApp,
+		CreatedAt: time.Now(),
+	}
+	if err := s.repo.CreateNotification(n); err != nil {
+		return err
+	}
+	s.pushRealtime(n)
+
+	next := time.Now().Add(deliveryLease)
+	d := &domain.NotificationDelivery{
+		NotificationID: n.ID,
+		UserID:         user.ID,
+		SchoolID:       user.SchoolID,
+		Channel:        channel,
+		Recipient:      recipient,
+		Status:         domain.DeliveryPending,
+		NextAttemptAt:  &next,
+	}
+	if err := s.repo.CreateDelivery(d); err != nil {
+		return err
+	}
+	go s.attempt(d, n, user, sender)
+	return nil
 }
 
 func (s *NotificationService) GetUserNotifications(userID uint, archived bool) ([]domain.Notification, error) {
@@ -70,11 +137,17 @@ func (s *NotificationService) ReadNotification(id uint) error {
 	return s.repo.MarkNotificationRead(id)
 }
 
-func (s *NotificationService) ArchiveNotification(id uint) error {
-	return s.repo.ArchiveNotification(id)
+// AckNotification records that a client of userID received the notification.
+func (s *NotificationService) AckNotification(userID, id uint) error {
+	return s.repo.MarkNotificationDelivered(id, userID, time.Now())
 }
 
-func (s *NotificationService) UpdatePreferences(userID uint, prefs []domain.NotificationPreference) error {
-	// Validate?
-	return s.repo.SavePreferences(prefs)
+func (s *NotificationService) pushRealtime(n *domain.Notification) {
+	if s.realtime != nil {
+		s.realtime.NotifyNotification(n)
+	}
+}
+
+func (s *NotificationService) ArchiveNotification(id uint) error {
+	return s.repo.ArchiveNotification(id)
 }
@@ -0,0 +1,308 @@
+package communication
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	_ "time/tzdata" // Quiet hours and digests follow Italian school time whatever the server's zone
+
+	"github.com/k/iRegistro/internal/domain"
+)
+
+// ChannelsSettingsKey is the SchoolSettings key listing the external channels
+// a school has enabled:
+//
+//	{"enabled": ["EMAIL", "PUSH"]}
+//
+// Schools without the setting allow every channel. In-app notifications are
+// always enabled.
+const ChannelsSettingsKey = "notification_channels"
+
+const defaultDigestTime = "18:00"
+
+var (
+	ErrInvalidPreferences = errors.New("invalid notification preferences")
+	ErrChannelNotEnabled  = errors.New("notification channel not enabled")
+)
+
+var externalChannels = []domain.NotificationChannel{domain.ChannelEmail, domain.ChannelSMS, domain.ChannelPush}
+
+// schoolLocation is the time zone of quiet hours and digest times.
+var schoolLocation = func() *time.Location {
+	loc, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}()
+
+type schoolSettingsReader interface {
+	GetSchoolSettings(schoolID uint) ([]domain.SchoolSettings, error)
+}
+
+// ParseChannelPolicy reads the enabled channels from a SchoolSettings value,
+// rejecting unknown channels.
+func ParseChannelPolicy(value domain.JSONMap) ([]domain.NotificationChannel, error) {
+	raw, ok := value["enabled"]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	var names []string
+	switch list := raw.(type) {
+	case []string:
+		names = list
+	case []interface{}:
+		for _, item := range list {
+			name, _ := item.(string)
+			names = append(names, name)
+		}
+	default:
+		return nil, fmt.Errorf("%w: enabled must be a list of channels", ErrInvalidPreferences)
+	}
+	channels := []domain.NotificationChannel{}
+	for _, name := range names {
+		channel := domain.NotificationChannel(name)
+		if !isExternalChannel(channel) {
+			return nil, fmt.Errorf("%w: unknown channel %q", ErrInvalidPreferences, name)
+		}
+		channels = append(channels, channel)
+	}
+	return channels, nil
+}
+
+func isExternalChannel(channel domain.NotificationChannel) bool {
+	for _, c := range externalChannels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// enabledChannels returns the external channels the school has enabled and
+// the service can deliver.
+func (s *NotificationService) enabledChannels(schoolID uint) (map[domain.NotificationChannel]bool, error) {
+	channels := externalChannels
+	if schoolID != 0 {
+		settings, err := s.settings.GetSchoolSettings(schoolID)
+		if err != nil {
+			return nil, err
+		}
+		for _, setting := range settings {
+			if setting.Key == ChannelsSettingsKey {
+				if channels, err = ParseChannelPolicy(setting.Value); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+	}
+
+	enabled := make(map[domain.NotificationChannel]bool)
+	for _, channel := range channels {
+		if _, ok := s.senders[channel]; ok {
+			enabled[channel] = true
+		}
+	}
+	return enabled, nil
+}
+
+// UserPreferences is everything a user can configure about notifications.
+type UserPreferences struct {
+	Preferences       []domain.NotificationPreference `json:"preferences"`
+	Settings          domain.NotificationSettings     `json:"settings"`
+	AvailableChannels []domain.NotificationChannel    `json:"available_channels"`
+}
+
+func (s *NotificationService) GetPreferences(userID uint) (*UserPreferences, error) {
+	user, err := s.findUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	enabled, err := s.enabledChannels(user.SchoolID)
+	if err != nil {
+		return nil, err
+	}
+	prefs, err := s.repo.GetPreferences(userID)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := s.repo.GetNotificationSettings(userID)
+	if err != nil {
+		return nil, err
+	}
+	if settings == nil {
+		settings = &domain.NotificationSettings{UserID: userID, DigestTime: defaultDigestTime}
+	}
+
+	available := []domain.NotificationChannel{domain.ChannelInApp}
+	for _, channel := range externalChannels {
+		if enabled[channel] {
+			available = append(available, channel)
+		}
+	}
+	return &UserPreferences{Preferences: prefs, Settings: *settings, AvailableChannels: available}, nil
+}
+
+// UpdatePreferences saves the channels of each notification type, which must
+// be enabled by the user's school. Digest mode requires the email channel.
+func (s *NotificationService) UpdatePreferences(userID uint, prefs []domain.NotificationPreference) error {
+	user, err := s.findUser(userID)
+	if err != nil {
+		return err
+	}
+	enabled, err := s.enabledChannels(user.SchoolID)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[domain.NotificationType]bool)
+	for i := range prefs {
+		p := &prefs[i]
+		p.UserID = userID
+		if p.Type == "" || seen[p.Type] {
+			return fmt.Errorf("%w: missing or repeated type %q", ErrInvalidPreferences, p.Type)
+		}
+		seen[p.Type] = true
+
+		channels := domain.JSONStringArray{}
+		email := false
+		for _, name := range p.Channels {
+			channel := domain.NotificationChannel(name)
+			switch {
+			case channel == domain.ChannelInApp:
+			case !isExternalChannel(channel):
+				return fmt.Errorf("%w: unknown channel %q", ErrInvalidPreferences, name)
+			case !enabled[channel]:
+				return fmt.Errorf("%w: %s", ErrChannelNotEnabled, name)
+			}
+			if containsString(channels, name) {
+				continue
+			}
+			channels = append(channels, name)
+			email = email || channel == domain.ChannelEmail
+		}
+		if p.Digest && !email {
+			return fmt.Errorf("%w: digest of %s requires the EMAIL channel", ErrInvalidPreferences, p.Type)
+		}
+		p.Channels = channels
+	}
+
+	if len(prefs) == 0 {
+		return nil
+	}
+	return s.repo.SavePreferences(prefs)
+}
+
+// UpdateSettings saves the user's quiet hours and digest time.
+func (s *NotificationService) UpdateSettings(userID uint, settings domain.NotificationSettings) error {
+	if (settings.QuietHoursStart == "") != (settings.QuietHoursEnd == "") {
+		return fmt.Errorf("%w: quiet hours need both start and end", ErrInvalidPreferences)
+	}
+	if settings.QuietHoursStart != "" {
+		start, err := parseClock(settings.QuietHoursStart)
+		if err != nil {
+			return fmt.Errorf("%w: quiet_hours_start must be HH:MM", ErrInvalidPreferences)
+		}
+		end, err := parseClock(settings.QuietHoursEnd)
+		if err != nil {
+			return fmt.Errorf("%w: quiet_hours_end must be HH:MM", ErrInvalidPreferences)
+		}
+		if start == end {
+			return fmt.Errorf("%w: quiet hours start and end must differ", ErrInvalidPreferences)
+		}
+	}
+	if settings.DigestTime == "" {
+		settings.DigestTime = defaultDigestTime
+	}
+	if _, err := parseClock(settings.DigestTime); err != nil {
+		return fmt.Errorf("%w: digest_time must be HH:MM", ErrInvalidPreferences)
+	}
+
+	settings.UserID = userID
+	return s.repo.SaveNotificationSettings(&settings)
+}
+
+func (s *NotificationService) findUser(userID uint) (*domain.User, error) {
+	user, err := s.users.FindByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("user %d not found", userID)
+	}
+	return user, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock parses "HH:MM" into minutes since midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// atClock returns the given minutes since midnight on day's date, in school time.
+func atClock(day time.Time, minutes int) time.Time {
+	y, m, d := day.Date()
+	return time.Date(y, m, d, minutes/60, minutes%60, 0, 0, schoolLocation)
+}
+
+// quietUntil reports whether t falls in the user's quiet hours and, if so,
+// when they end. Quiet hours may span midnight (e.g. 22:00-07:00).
+func quietUntil(settings *domain.NotificationSettings, t time.Time) (time.Time, bool) {
+	if settings == nil || settings.QuietHoursStart == "" || settings.QuietHoursEnd == "" {
+		return time.Time{}, false
+	}
+	start, err := parseClock(settings.QuietHoursStart)
+	if err != nil {
+		return time.Time{}, false
+	}
+	end, err := parseClock(settings.QuietHoursEnd)
+	if err != nil || start == end {
+		return time.Time{}, false
+	}
+
+	local := t.In(schoolLocation)
+	now := local.Hour()*60 + local.Minute()
+	switch {
+	case start < end && now >= start && now < end:
+		return atClock(local, end), true
+	case start > end && now >= start:
+		return atClock(local.AddDate(0, 0, 1), end), true
+	case start > end && now < end:
+		return atClock(local, end), true
+	}
+	return time.Time{}, false
+}
+
+// nextDigest returns when the digest including a notification created at t
+// is sent: the next digest time, postponed past quiet hours.
+func nextDigest(settings *domain.NotificationSettings, t time.Time) time.Time {
+	minutes, _ := parseClock(defaultDigestTime)
+	if settings != nil && settings.DigestTime != "" {
+		if m, err := parseClock(settings.DigestTime); err == nil {
+			minutes = m
+		}
+	}
+
+	local := t.In(schoolLocation)
+	at := atClock(local, minutes)
+	if !at.After(t) {
+		at = atClock(local.AddDate(0, 0, 1), minutes)
+	}
+	if end, quiet := quietUntil(settings, at); quiet {
+		at = end
+	}
+	return at
+}
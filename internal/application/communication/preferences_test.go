@@ -0,0 +1,251 @@
+package communication
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newFanOutService(t *testing.T, settings []domain.SchoolSettings) (*NotificationService, *MockCommRepo, *fakeSender, *fakeSender) {
+	mockRepo := new(MockCommRepo)
+	users := &MockUserRepo{users: map[uint]*domain.User{
+		1: {ID: 1, Email: "genitore@example.com", SchoolID: 7},
+	}}
+	email := &fakeSender{}
+	push := &fakeSender{channel: domain.ChannelPush}
+	svc := NewNotificationService(mockRepo, users, &MockSchoolSettings{settings: settings}, email, push)
+	return svc, mockRepo, email, push
+}
+
+func TestFanOut(t *testing.T) {
+	policy := []domain.SchoolSettings{{SchoolID: 7, Key: ChannelsSettingsKey, Value: domain.JSONMap{"enabled": []interface{}{"EMAIL", "PUSH"}}}}
+
+	t.Run("Every enabled channel gets its own delivery", func(t *testing.T) {
+		svc, mockRepo, email, push := newFanOutService(t, policy)
+		mockRepo.On("GetPreferences", uint(1)).Return([]domain.NotificationPreference{
+			{UserID: 1, Type: domain.NotifTypeGrade, Channels: domain.JSONStringArray{"IN_APP", "EMAIL", "PUSH", "EMAIL"}},
+		}, nil)
+		mockRepo.On("GetNotificationSettings", uint(1)).Return(nil, nil)
+		mockRepo.On("CreateNotification", mock.Anything).Return(nil)
+		mockRepo.On("CreateDelivery", mock.MatchedBy(func(d *domain.NotificationDelivery) bool {
+			return d.Channel == domain.ChannelEmail && d.Status == domain.DeliveryPending
+		})).Return(nil).Once()
+		mockRepo.On("CreateDelivery", mock.MatchedBy(func(d *domain.NotificationDelivery) bool {
+			return d.Channel == domain.ChannelPush && d.Status == domain.DeliveryPending
+		})).Return(nil).Once()
+		mockRepo.On("CreateDeliveryAttempt", mock.Anything).Return(nil)
+		updated := make(chan domain.NotificationChannel, 2)
+		mockRepo.On("UpdateDelivery", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+			updated <- args.Get(0).(*domain.NotificationDelivery).Channel
+		})
+
+		require.NoError(t, svc.TriggerNotification(1, domain.NotifTypeGrade, "Matematica", "8", nil))
+		var channels []domain.NotificationChannel
+		for i := 0; i < 2; i++ {
+			select {
+			case c := <-updated:
+				channels = append(channels, c)
+			case <-time.After(time.Second):
+				t.Fatal("delivery not attempted")
+			}
+		}
+		assert.ElementsMatch(t, []domain.NotificationChannel{domain.ChannelEmail, domain.ChannelPush}, channels)
+		assert.Len(t, email.sent, 1)
+		assert.Len(t, push.sent, 1)
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Channels disabled by the school are skipped", func(t *testing.T) {
+		emailOnly := []domain.SchoolSettings{{SchoolID: 7, Key: ChannelsSettingsKey, Value: domain.JSONMap{"enabled": []interface{}{"EMAIL"}}}}
+		svc, mockRepo, _, _ := newFanOutService(t, emailOnly)
+		mockRepo.On("GetPreferences", uint(1)).Return([]domain.NotificationPreference{
+			{UserID: 1, Type: domain.NotifTypeGrade, Channels: domain.JSONStringArray{"PUSH"}},
+		}, nil)
+		mockRepo.On("GetNotificationSettings", uint(1)).Return(nil, nil)
+		mockRepo.On("CreateNotification", mock.Anything).Return(nil)
+
+		require.NoError(t, svc.TriggerNotification(1, domain.NotifTypeGrade, "Matematica", "8", nil))
+		mockRepo.AssertNotCalled(t, "CreateDelivery", mock.Anything)
+	})
+
+	t.Run("Quiet hours postpone delivery", func(t *testing.T) {
+		svc, mockRepo, email, _ := newFanOutService(t, nil)
+		now := time.Now().In(schoolLocation)
+		settings := &domain.NotificationSettings{
+			UserID:          1,
+			QuietHoursStart: now.Add(-time.Hour).Format("15:04"),
+			QuietHoursEnd:   now.Add(time.Hour).Format("15:04"),
+		}
+		end, quiet := quietUntil(settings, now)
+		require.True(t, quiet)
+
+		mockRepo.On("GetPreferences", uint(1)).Return([]domain.NotificationPreference{
+			{UserID: 1, Type: domain.NotifTypeAbsence, Channels: domain.JSONStringArray{"EMAIL"}},
+		}, nil)
+		mockRepo.On("GetNotificationSettings", uint(1)).Return(settings, nil)
+		mockRepo.On("CreateNotification", mock.Anything).Return(nil)
+		mockRepo.On("CreateDelivery", mock.MatchedBy(func(d *domain.NotificationDelivery) bool {
+			return d.Status == domain.DeliveryPending && d.NextAttemptAt != nil && d.NextAttemptAt.Equal(end)
+		})).Return(nil)
+
+		require.NoError(t, svc.TriggerNotification(1, domain.NotifTypeAbsence, "Assenza", "Oggi", nil))
+		mockRepo.AssertExpectations(t)
+		assert.Empty(t, email.sent)
+	})
+}
+
+func TestDigest(t *testing.T) {
+	svc, mockRepo, email, _ := newFanOutService(t, nil)
+	settings := &domain.NotificationSettings{UserID: 1, DigestTime: "18:30"}
+	mockRepo.On("GetNotificationSettings", uint(1)).Return(settings, nil)
+
+	// Grades are queued for the digest instead of being sent
+	mockRepo.On("GetPreferences", uint(1)).Return([]domain.NotificationPreference{
+		{UserID: 1, Type: domain.NotifTypeGrade, Channels: domain.JSONStringArray{"EMAIL"}, Digest: true},
+	}, nil)
+	mockRepo.On("CreateNotification", mock.Anything).Return(nil)
+	mockRepo.On("CreateDelivery", mock.MatchedBy(func(d *domain.NotificationDelivery) bool {
+		return d.Status == domain.DeliveryDigest && d.NextAttemptAt != nil &&
+			d.NextAttemptAt.In(schoolLocation).Format("15:04") == "18:30"
+	})).Return(nil)
+
+	require.NoError(t, svc.TriggerNotification(1, domain.NotifTypeGrade, "Matematica", "8", nil))
+	assert.Empty(t, email.sent)
+
+	// At digest time they go out in a single email
+	mockRepo.On("ClaimDueDeliveries", domain.DeliveryDigest, mock.Anything, deliveryLease, deliveryBatchSize).Return([]domain.NotificationDelivery{
+		{ID: 1, NotificationID: 10, UserID: 1, Channel: domain.ChannelEmail, Recipient: "genitore@example.com", Status: domain.DeliveryDigest},
+		{ID: 2, NotificationID: 11, UserID: 1, Channel: domain.ChannelEmail, Recipient: "genitore@example.com", Status: domain.DeliveryDigest},
+	}, nil)
+	mockRepo.On("GetNotificationByID", uint(10)).Return(&domain.Notification{ID: 10, Title: "Matematica", Body: "8"}, nil)
+	mockRepo.On("GetNotificationByID", uint(11)).Return(&domain.Notification{ID: 11, Title: "Storia", Body: "7"}, nil)
+	mockRepo.On("CreateDeliveryAttempt", mock.MatchedBy(func(a *domain.DeliveryAttempt) bool {
+		return a.Status == domain.DeliverySent
+	})).Return(nil).Twice()
+	mockRepo.On("UpdateDelivery", mock.MatchedBy(func(d *domain.NotificationDelivery) bool {
+		return d.Status == domain.DeliverySent && d.SentAt != nil
+	})).Return(nil).Twice()
+
+	n, err := svc.SendDigests()
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	require.Len(t, email.sent, 1)
+	assert.Equal(t, digestType, email.last.Type)
+	assert.Equal(t, "- Matematica: 8\n- Storia: 7", email.last.Body)
+	mockRepo.AssertExpectations(t)
+
+	// The digest renders without a title
+	templates, err := NewEmailTemplates("https://registro.example.it")
+	require.NoError(t, err)
+	msg, err := templates.Render(email.last, &domain.User{Email: "genitore@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "Riepilogo delle notifiche di iRegistro", msg.Subject)
+	assert.Contains(t, msg.TextBody, "- Storia: 7")
+	assert.NotContains(t, msg.HTMLBody, "<h2")
+}
+
+func TestQuietHoursAndDigestTime(t *testing.T) {
+	at := func(day int, clock string) time.Time {
+		c, _ := time.Parse("15:04", clock)
+		return time.Date(2025, time.March, day, c.Hour(), c.Minute(), 0, 0, schoolLocation)
+	}
+	overnight := &domain.NotificationSettings{QuietHoursStart: "22:00", QuietHoursEnd: "07:00"}
+	lunch := &domain.NotificationSettings{QuietHoursStart: "13:00", QuietHoursEnd: "14:00", DigestTime: "13:30"}
+
+	tests := []struct {
+		name     string
+		settings *domain.NotificationSettings
+		t        time.Time
+		quiet    bool
+		until    time.Time
+	}{
+		{"Before midnight", overnight, at(10, "23:15"), true, at(11, "07:00")},
+		{"After midnight", overnight, at(11, "06:59"), true, at(11, "07:00")},
+		{"End is not quiet", overnight, at(11, "07:00"), false, time.Time{}},
+		{"Daytime", overnight, at(11, "12:00"), false, time.Time{}},
+		{"Same-day window", lunch, at(11, "13:30"), true, at(11, "14:00")},
+		{"No settings", nil, at(11, "23:00"), false, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			until, quiet := quietUntil(tt.settings, tt.t)
+			assert.Equal(t, tt.quiet, quiet)
+			assert.True(t, tt.until.Equal(until), "got %s", until)
+		})
+	}
+
+	assert.True(t, at(10, "18:00").Equal(nextDigest(nil, at(10, "09:00"))))
+	assert.True(t, at(11, "18:00").Equal(nextDigest(overnight, at(10, "18:00"))))
+	// A digest time inside quiet hours waits for their end
+	assert.True(t, at(10, "14:00").Equal(nextDigest(lunch, at(10, "09:00"))))
+}
+
+func TestUpdatePreferences(t *testing.T) {
+	emailOnly := []domain.SchoolSettings{{SchoolID: 7, Key: ChannelsSettingsKey, Value: domain.JSONMap{"enabled": []interface{}{"EMAIL"}}}}
+
+	t.Run("Rejects invalid preferences", func(t *testing.T) {
+		svc, mockRepo, _, _ := newFanOutService(t, emailOnly)
+		cases := []struct {
+			prefs []domain.NotificationPreference
+			err   error
+		}{
+			{[]domain.NotificationPreference{{Type: domain.NotifTypeGrade, Channels: domain.JSONStringArray{"PUSH"}}}, ErrChannelNotEnabled},
+			{[]domain.NotificationPreference{{Type: domain.NotifTypeGrade, Channels: domain.JSONStringArray{"FAX"}}}, ErrInvalidPreferences},
+			{[]domain.NotificationPreference{{Type: domain.NotifTypeGrade, Channels: domain.JSONStringArray{"IN_APP"}, Digest: true}}, ErrInvalidPreferences},
+			{[]domain.NotificationPreference{{Type: domain.NotifTypeGrade}, {Type: domain.NotifTypeGrade}}, ErrInvalidPreferences},
+		}
+		for _, c := range cases {
+			assert.ErrorIs(t, svc.UpdatePreferences(1, c.prefs), c.err)
+		}
+		mockRepo.AssertNotCalled(t, "SavePreferences", mock.Anything)
+	})
+
+	t.Run("Saves normalised preferences", func(t *testing.T) {
+		svc, mockRepo, _, _ := newFanOutService(t, emailOnly)
+		mockRepo.On("SavePreferences", []domain.NotificationPreference{
+			{UserID: 1, Type: domain.NotifTypeGrade, Channels: domain.JSONStringArray{"EMAIL", "IN_APP"}, Digest: true},
+		}).Return(nil)
+
+		err := svc.UpdatePreferences(1, []domain.NotificationPreference{
+			{UserID: 99, Type: domain.NotifTypeGrade, Channels: domain.JSONStringArray{"EMAIL", "IN_APP", "EMAIL"}, Digest: true},
+		})
+		require.NoError(t, err)
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Lists the available channels", func(t *testing.T) {
+		svc, mockRepo, _, _ := newFanOutService(t, emailOnly)
+		mockRepo.On("GetPreferences", uint(1)).Return([]domain.NotificationPreference{}, nil)
+		mockRepo.On("GetNotificationSettings", uint(1)).Return(nil, nil)
+
+		prefs, err := svc.GetPreferences(1)
+		require.NoError(t, err)
+		assert.Equal(t, []domain.NotificationChannel{domain.ChannelInApp, domain.ChannelEmail}, prefs.AvailableChannels)
+		assert.Equal(t, defaultDigestTime, prefs.Settings.DigestTime)
+	})
+
+	t.Run("Validates settings", func(t *testing.T) {
+		svc, mockRepo, _, _ := newFanOutService(t, nil)
+		assert.ErrorIs(t, svc.UpdateSettings(1, domain.NotificationSettings{QuietHoursStart: "22:00"}), ErrInvalidPreferences)
+		assert.ErrorIs(t, svc.UpdateSettings(1, domain.NotificationSettings{QuietHoursStart: "25:00", QuietHoursEnd: "07:00"}), ErrInvalidPreferences)
+		assert.ErrorIs(t, svc.UpdateSettings(1, domain.NotificationSettings{DigestTime: "6pm"}), ErrInvalidPreferences)
+
+		mockRepo.On("SaveNotificationSettings", &domain.NotificationSettings{
+			UserID: 1, QuietHoursStart: "22:00", QuietHoursEnd: "07:00", DigestTime: defaultDigestTime,
+		}).Return(nil)
+		require.NoError(t, svc.UpdateSettings(1, domain.NotificationSettings{QuietHoursStart: "22:00", QuietHoursEnd: "07:00"}))
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("School policy rejects unknown channels", func(t *testing.T) {
+		_, err := ParseChannelPolicy(domain.JSONMap{"enabled": []interface{}{"EMAIL", "PIGEON"}})
+		assert.True(t, errors.Is(err, ErrInvalidPreferences))
+		assert.True(t, strings.Contains(err.Error(), "PIGEON"))
+	})
+}
@@ -0,0 +1,156 @@
+package communication
+
+import (
+	"context"
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/k/iRegistro/internal/domain"
+	"go.uber.org/zap"
+)
+
+// maxPushBody keeps push payloads well below the 3993 byte Web Push limit;
+// the full text is in the app.
+const maxPushBody = 1000
+
+var ErrInvalidPushSubscription = errors.New("invalid push subscription")
+
+// pushPayload is the JSON the service worker receives.
+type pushPayload struct {
+	ID    uint                    `json:"id"`
+	Type  domain.NotificationType `json:"type"`
+	Title string                  `json:"title"`
+	Body  string                  `json:"body"`
+	URL   string                  `json:"url"`
+}
+
+// PushSender delivers notifications to every browser the user subscribed
+// with Web Push, dropping the subscriptions the push service reports as gone.
+type PushSender struct {
+	repo   domain.CommunicationRepository
+	pusher domain.WebPusher
+	appURL string
+}
+
+func NewPushSender(repo domain.CommunicationRepository, pusher domain.WebPusher, appURL string) *PushSender {
+	return &PushSender{repo: repo, pusher: pusher, appURL: appURL}
+}
+
+func (s *PushSender) Channel() domain.NotificationChannel { return domain.ChannelPush }
+
+func (s *PushSender) PublicKey() string { return s.pusher.PublicKey() }
+
+// Recipient describes the user's subscribed devices; users without any
+// cannot be reached by push.
+func (s *PushSender) Recipient(user *domain.User) string {
+	subs, err := s.repo.GetPushSubscriptions(user.ID)
+	if err != nil {
+		zap.L().Error("Failed to load push subscriptions", zap.Uint("user_id", user.ID), zap.Error(err))
+		return ""
+	}
+	if len(subs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d device(s)", len(subs))
+}
+
+// Send pushes n to all the user's devices. It succeeds if at least one
+// device received it; when none did, transient failures are returned for a
+// retry and permanent ones as a rejection.
+func (s *PushSender) Send(ctx context.Context, n *domain.Notification, user *domain.User, recipient string) error {
+	subs, err := s.repo.GetPushSubscriptions(user.ID)
+	if err != nil {
+		return err
+	}
+	if len(subs) == 0 {
+		return fmt.Errorf("%w: no push subscriptions", domain.ErrDeliveryRejected)
+	}
+
+	body := []rune(n.Body)
+	if len(body) > maxPushBody {
+		body = append(body[:maxPushBody-1], '…')
+	}
+	payload, err := json.Marshal(pushPayload{ID: n.ID, Type: n.Type, Title: n.Title, Body: string(body), URL: s.appURL})
+	if err != nil {
+		return err
+	}
+	urgency := domain.PushUrgencyNormal
+	if n.Type == domain.NotifTypeGrade || n.Type == domain.NotifTypeAbsence {
+		urgency = domain.PushUrgencyHigh
+	}
+
+	delivered := 0
+	var transient, rejected error
+	for i := range subs {
+		err := s.pusher.Push(ctx, &subs[i], payload, urgency)
+		switch {
+		case err == nil:
+			delivered++
+		case errors.Is(err, domain.ErrPushSubscriptionGone):
+			if err := s.repo.DeletePushSubscriptionByEndpoint(subs[i].Endpoint); err != nil {
+				zap.L().Error("Failed to remove expired push subscription", zap.Uint("user_id", user.ID), zap.Error(err))
+			}
+			rejected = err
+		case errors.Is(err, domain.ErrDeliveryRejected):
+			rejected = err
+		default:
+			transient = err
+		}
+	}
+
+	switch {
+	case delivered > 0:
+		return nil
+	case transient != nil:
+		return transient
+	default:
+		return fmt.Errorf("%w: %v", domain.ErrDeliveryRejected, rejected)
+	}
+}
+
+// PushPublicKey returns the VAPID key browsers subscribe with, or "" when
+// Web Push is not configured.
+func (s *NotificationService) PushPublicKey() string {
+	if push, ok := s.senders[domain.ChannelPush].(*PushSender); ok {
+		return push.PublicKey()
+	}
+	return ""
+}
+
+// SubscribePush registers a browser for Web Push. The keys come from
+// PushSubscription.toJSON() in the browser.
+func (s *NotificationService) SubscribePush(userID uint, sub *domain.PushSubscription) error {
+	if _, ok := s.senders[domain.ChannelPush]; !ok {
+		return fmt.Errorf("%w: %s", ErrChannelNotEnabled, domain.ChannelPush)
+	}
+	if u, err := url.Parse(sub.Endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%w: endpoint must be an https URL", ErrInvalidPushSubscription)
+	}
+	p256dh, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.P256dh, "="))
+	if err != nil {
+		return fmt.Errorf("%w: p256dh is not base64url", ErrInvalidPushSubscription)
+	}
+	if _, err := ecdh.P256().NewPublicKey(p256dh); err != nil {
+		return fmt.Errorf("%w: p256dh is not a P-256 public key", ErrInvalidPushSubscription)
+	}
+	auth, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Auth, "="))
+	if err != nil || len(auth) != 16 {
+		return fmt.Errorf("%w: auth must be 16 bytes of base64url", ErrInvalidPushSubscription)
+	}
+
+	sub.ID = 0
+	sub.UserID = userID
+	if len(sub.UserAgent) > 255 {
+		sub.UserAgent = sub.UserAgent[:255]
+	}
+	return s.repo.SavePushSubscription(sub)
+}
+
+func (s *NotificationService) UnsubscribePush(userID uint, endpoint string) error {
+	return s.repo.DeletePushSubscription(userID, endpoint)
+}
@@ -0,0 +1,120 @@
+package communication
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePusher replies to each endpoint with the configured error.
+type fakePusher struct {
+	errs     map[string]error
+	payloads [][]byte
+	urgency  domain.PushUrgency
+}
+
+func (f *fakePusher) PublicKey() string { return "BPublicKey" }
+func (f *fakePusher) Push(ctx context.Context, sub *domain.PushSubscription, payload []byte, urgency domain.PushUrgency) error {
+	f.payloads = append(f.payloads, payload)
+	f.urgency = urgency
+	return f.errs[sub.Endpoint]
+}
+
+func TestPushSender(t *testing.T) {
+	user := &domain.User{ID: 1}
+	n := &domain.Notification{ID: 5, Type: domain.NotifTypeAbsence, Title: "Assenza", Body: "Mario è assente oggi"}
+	subs := []domain.PushSubscription{
+		{UserID: 1, Endpoint: "https://push.example.com/phone"},
+		{UserID: 1, Endpoint: "https://push.example.com/laptop"},
+	}
+
+	t.Run("Delivered if any device receives it, gone subscriptions are removed", func(t *testing.T) {
+		mockRepo := new(MockCommRepo)
+		pusher := &fakePusher{errs: map[string]error{"https://push.example.com/laptop": domain.ErrPushSubscriptionGone}}
+		sender := NewPushSender(mockRepo, pusher, "https://registro.example.it")
+		mockRepo.On("GetPushSubscriptions", uint(1)).Return(subs, nil)
+		mockRepo.On("DeletePushSubscriptionByEndpoint", "https://push.example.com/laptop").Return(nil)
+
+		assert.Equal(t, "2 device(s)", sender.Recipient(user))
+		require.NoError(t, sender.Send(context.Background(), n, user, ""))
+		mockRepo.AssertExpectations(t)
+
+		var payload pushPayload
+		require.NoError(t, json.Unmarshal(pusher.payloads[0], &payload))
+		assert.Equal(t, pushPayload{ID: 5, Type: domain.NotifTypeAbsence, Title: "Assenza", Body: "Mario è assente oggi", URL: "https://registro.example.it"}, payload)
+		assert.Equal(t, domain.PushUrgencyHigh, pusher.urgency)
+	})
+
+	t.Run("Transient failures are retried", func(t *testing.T) {
+		mockRepo := new(MockCommRepo)
+		pusher := &fakePusher{errs: map[string]error{
+			"https://push.example.com/phone":  errors.New("push.example.com: 503 Service Unavailable"),
+			"https://push.example.com/laptop": domain.ErrPushSubscriptionGone,
+		}}
+		mockRepo.On("GetPushSubscriptions", uint(1)).Return(subs, nil)
+		mockRepo.On("DeletePushSubscriptionByEndpoint", mock.Anything).Return(nil)
+
+		err := NewPushSender(mockRepo, pusher, "").Send(context.Background(), n, user, "")
+		require.Error(t, err)
+		assert.False(t, errors.Is(err, domain.ErrDeliveryRejected))
+	})
+
+	t.Run("Bounces when every subscription is gone", func(t *testing.T) {
+		mockRepo := new(MockCommRepo)
+		pusher := &fakePusher{errs: map[string]error{
+			"https://push.example.com/phone":  domain.ErrPushSubscriptionGone,
+			"https://push.example.com/laptop": domain.ErrPushSubscriptionGone,
+		}}
+		mockRepo.On("GetPushSubscriptions", uint(1)).Return(subs, nil)
+		mockRepo.On("DeletePushSubscriptionByEndpoint", mock.Anything).Return(nil).Twice()
+
+		err := NewPushSender(mockRepo, pusher, "").Send(context.Background(), n, user, "")
+		assert.ErrorIs(t, err, domain.ErrDeliveryRejected)
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Users without subscriptions are not reachable", func(t *testing.T) {
+		mockRepo := new(MockCommRepo)
+		mockRepo.On("GetPushSubscriptions", uint(1)).Return([]domain.PushSubscription{}, nil)
+		assert.Equal(t, "", NewPushSender(mockRepo, &fakePusher{}, "").Recipient(user))
+	})
+}
+
+func TestSubscribePush(t *testing.T) {
+	mockRepo := new(MockCommRepo)
+	svc := NewNotificationService(mockRepo, nil, nil, NewPushSender(mockRepo, &fakePusher{}, ""))
+	assert.Equal(t, "BPublicKey", svc.PushPublicKey())
+
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	p256dh := base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes())
+	auth := base64.RawURLEncoding.EncodeToString(make([]byte, 16))
+
+	invalid := []domain.PushSubscription{
+		{Endpoint: "http://push.example.com/x", P256dh: p256dh, Auth: auth},
+		{Endpoint: "https://push.example.com/x", P256dh: "BAAAA", Auth: auth},
+		{Endpoint: "https://push.example.com/x", P256dh: p256dh, Auth: "c2hvcnQ"},
+	}
+	for _, sub := range invalid {
+		assert.ErrorIs(t, svc.SubscribePush(1, &sub), ErrInvalidPushSubscription)
+	}
+
+	mockRepo.On("SavePushSubscription", mock.MatchedBy(func(s *domain.PushSubscription) bool {
+		return s.UserID == 1 && s.ID == 0
+	})).Return(nil)
+	require.NoError(t, svc.SubscribePush(1, &domain.PushSubscription{ID: 9, UserID: 2, Endpoint: "https://push.example.com/x", P256dh: p256dh, Auth: auth}))
+	mockRepo.AssertExpectations(t)
+
+	// Without a push sender the channel is off
+	assert.Equal(t, "", NewNotificationService(mockRepo, nil, nil).PushPublicKey())
+	assert.ErrorIs(t, NewNotificationService(mockRepo, nil, nil).SubscribePush(1, &invalid[0]), ErrChannelNotEnabled)
+}
@@ -0,0 +1,342 @@
+package communication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/k/iRegistro/internal/domain"
+	"go.uber.org/zap"
+)
+
+// SMSSettingsKey is the SchoolSettings key holding the school's SMS gateway
+// (domain.SMSSettings). Schools without it cannot send SMS.
+const SMSSettingsKey = "sms"
+
+const (
+	defaultAbsenceAlertTime = "09:00"
+	// maxSMSSegments bounds the length of a message, and so its cost
+	maxSMSSegments = 3
+	// defaultCountryCode is assumed for numbers written without one
+	defaultCountryCode = "+39"
+)
+
+// ErrSMSQuotaExceeded is returned when the school used its monthly SMS quota.
+// It wraps domain.ErrDeliveryRejected, as retrying in the same month is useless.
+var ErrSMSQuotaExceeded = fmt.Errorf("%w: monthly SMS quota exceeded", domain.ErrDeliveryRejected)
+
+// SMSProviderFactory builds the gateway client for a school's settings.
+type SMSProviderFactory func(cfg domain.SMSSettings) (domain.SMSProvider, error)
+
+// ParseSMSSettings reads and validates the SMS settings of a school.
+func ParseSMSSettings(value domain.JSONMap) (*domain.SMSSettings, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPreferences, err)
+	}
+	var cfg domain.SMSSettings
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("%w: sms: %v", ErrInvalidPreferences, err)
+	}
+
+	if cfg.Provider != "http" {
+		return nil, fmt.Errorf("%w: sms: unknown provider %q", ErrInvalidPreferences, cfg.Provider)
+	}
+	if u, err := url.Parse(cfg.URL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("%w: sms: url must be an https URL", ErrInvalidPreferences)
+	}
+	if !validSender(cfg.Sender) {
+		return nil, fmt.Errorf("%w: sms: sender must be up to 11 letters and digits, or a phone number", ErrInvalidPreferences)
+	}
+	if cfg.MonthlyQuota < 0 || cfg.CostPerSegment < 0 {
+		return nil, fmt.Errorf("%w: sms: quota and cost cannot be negative", ErrInvalidPreferences)
+	}
+	if cfg.AbsenceAlertTime == "" {
+		cfg.AbsenceAlertTime = defaultAbsenceAlertTime
+	}
+	if _, err := parseClock(cfg.AbsenceAlertTime); err != nil {
+		return nil, fmt.Errorf("%w: sms: absence_alert_time must be HH:MM", ErrInvalidPreferences)
+	}
+	return &cfg, nil
+}
+
+// validSender accepts the alphanumeric sender IDs of the networks (at most
+// 11 characters) and phone numbers.
+func validSender(sender string) bool {
+	if sender == "" {
+		return false
+	}
+	if normalizePhone(sender) != "" {
+		return true
+	}
+	if len(sender) > 11 {
+		return false
+	}
+	for _, r := range sender {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == ' ') {
+			return false
+		}
+	}
+	return true
+}
+
+// redactedSecret replaces the gateway credentials in the redacted settings.
+const redactedSecret = "***"
+
+// smsSecrets are the keys of the gateway credentials in the settings.
+var smsSecrets = []string{"password", "api_key"}
+
+// RedactSMSSettings removes the gateway credentials from a settings value,
+// so that it can be written to the audit log or shown to the admins.
+func RedactSMSSettings(value domain.JSONMap) domain.JSONMap {
+	redacted := domain.JSONMap{}
+	for k, v := range value {
+		redacted[k] = v
+	}
+	for _, k := range smsSecrets {
+		if _, ok := redacted[k]; ok {
+			redacted[k] = redactedSecret
+		}
+	}
+	return redacted
+}
+
+// RestoreSMSSecrets puts back the stored credentials that value carries
+// redacted, as the settings read from the admin UI and saved unchanged do.
+func RestoreSMSSecrets(value, stored domain.JSONMap) domain.JSONMap {
+	restored := domain.JSONMap{}
+	for k, v := range value {
+		restored[k] = v
+	}
+	for _, k := range smsSecrets {
+		if restored[k] != redactedSecret {
+			continue
+		}
+		if v, ok := stored[k]; ok {
+			restored[k] = v
+		} else {
+			delete(restored, k)
+		}
+	}
+	return restored
+}
+
+// normalizePhone returns the number in E.164 format, assuming Italy when
+// there is no country code, or "" if it is not a phone number.
+func normalizePhone(phone string) string {
+	phone = strings.NewReplacer(" ", "", "-", "", ".", "", "/", "", "(", "", ")", "").Replace(phone)
+	if strings.HasPrefix(phone, "00") {
+		phone = "+" + phone[2:]
+	}
+	if !strings.HasPrefix(phone, "+") {
+		phone = defaultCountryCode + phone
+	}
+	digits := phone[1:]
+	if len(digits) < 8 || len(digits) > 15 {
+		return ""
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return ""
+		}
+	}
+	return phone
+}
+
+// gsm7 is the GSM 03.38 basic character set; gsm7Extended characters take
+// two septets.
+const (
+	gsm7         = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+	gsm7Extended = "^{}\\[~]|€\f"
+)
+
+// smsSegments returns how many segments text is billed as: 160 GSM-7
+// characters (153 when split), or 70 UCS-2 characters (67 when split) if
+// it contains anything else.
+func smsSegments(text string) int {
+	septets, ucs2 := 0, 0
+	gsm := true
+	for _, r := range text {
+		switch {
+		case strings.ContainsRune(gsm7, r):
+			septets++
+		case strings.ContainsRune(gsm7Extended, r):
+			septets += 2
+		default:
+			gsm = false
+		}
+		if r > 0xFFFF {
+			ucs2 += 2
+		} else {
+			ucs2++
+		}
+	}
+	length, single, multi := septets, 160, 153
+	if !gsm {
+		length, single, multi = ucs2, 70, 67
+	}
+	if length <= single {
+		return 1
+	}
+	return (length + multi - 1) / multi
+}
+
+// smsText is the message for n, shortened to maxSMSSegments.
+func smsText(n *domain.Notification) string {
+	text := strings.TrimSpace(n.Body)
+	if n.Title != "" {
+		text = n.Title + ": " + text
+	}
+	if smsSegments(text) <= maxSMSSegments {
+		return text
+	}
+	runes := []rune(text)
+	if len(runes) > maxSMSSegments*153 {
+		runes = runes[:maxSMSSegments*153]
+	}
+	for len(runes) > 0 && smsSegments(string(runes)+"...") > maxSMSSegments {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "..."
+}
+
+// SMSSender delivers notifications by SMS through the gateway of the user's
+// school, within the school's monthly quota.
+type SMSSender struct {
+	repo     domain.CommunicationRepository
+	settings schoolSettingsReader
+	provider SMSProviderFactory
+}
+
+func NewSMSSender(repo domain.CommunicationRepository, settings schoolSettingsReader, provider SMSProviderFactory) *SMSSender {
+	return &SMSSender{repo: repo, settings: settings, provider: provider}
+}
+
+func (s *SMSSender) Channel() domain.NotificationChannel { return domain.ChannelSMS }
+
+// Recipient is the user's mobile number, if their school has a gateway.
+func (s *SMSSender) Recipient(user *domain.User) string {
+	phone := normalizePhone(user.Phone)
+	if phone == "" {
+		return ""
+	}
+	cfg, err := s.schoolSettings(user.SchoolID)
+	if err != nil {
+		zap.L().Error("Failed to load SMS settings", zap.Uint("school_id", user.SchoolID), zap.Error(err))
+		return ""
+	}
+	if cfg == nil {
+		return ""
+	}
+	return phone
+}
+
+func (s *SMSSender) Send(ctx context.Context, n *domain.Notification, user *domain.User, recipient string) error {
+	cfg, err := s.schoolSettings(user.SchoolID)
+	if err != nil {
+		return err
+	}
+	if cfg == nil {
+		return fmt.Errorf("%w: the school has no SMS gateway", domain.ErrDeliveryRejected)
+	}
+	provider, err := s.provider(*cfg)
+	if err != nil {
+		return fmt.Errorf("%w: %v", domain.ErrDeliveryRejected, err)
+	}
+
+	text := smsText(n)
+	segments := smsSegments(text)
+	month := time.Now().In(schoolLocation).Format("2006-01")
+	ok, err := s.repo.ReserveSMSSegments(user.SchoolID, month, segments, cfg.MonthlyQuota)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w (%d segments)", ErrSMSQuotaExceeded, cfg.MonthlyQuota)
+	}
+
+	receipt, err := provider.Send(ctx, domain.SMSMessage{To: recipient, Sender: cfg.Sender, Text: text})
+	if err != nil {
+		if err := s.repo.AddSMSUsage(user.SchoolID, month, 0, -segments, 0); err != nil {
+			zap.L().Error("Failed to release SMS quota", zap.Uint("school_id", user.SchoolID), zap.Error(err))
+		}
+		return err
+	}
+
+	// The provider's count wins over our estimate
+	billed := segments
+	if receipt.Segments > 0 {
+		billed = receipt.Segments
+	}
+	cost := receipt.CostCents
+	if cost == 0 {
+		cost = billed * cfg.CostPerSegment
+	}
+	if err := s.repo.AddSMSUsage(user.SchoolID, month, 1, billed-segments, cost); err != nil {
+		zap.L().Error("Failed to record SMS usage", zap.Uint("school_id", user.SchoolID), zap.Error(err))
+	}
+	zap.L().Info("SMS sent", zap.Uint("notification_id", n.ID), zap.Uint("school_id", user.SchoolID),
+		zap.String("message_id", receipt.MessageID), zap.Int("segments", billed))
+	return nil
+}
+
+// schoolSettings returns the school's gateway, or nil if it has none.
+func (s *SMSSender) schoolSettings(schoolID uint) (*domain.SMSSettings, error) {
+	if schoolID == 0 {
+		return nil, nil
+	}
+	settings, err := s.settings.GetSchoolSettings(schoolID)
+	if err != nil {
+		return nil, err
+	}
+	for _, setting := range settings {
+		if setting.Key == SMSSettingsKey {
+			cfg, err := ParseSMSSettings(setting.Value)
+			if err != nil {
+				// Saved before validation existed, or edited in the database
+				return nil, fmt.Errorf("%w: %v", domain.ErrDeliveryRejected, err)
+			}
+			return cfg, nil
+		}
+	}
+	return nil, nil
+}
+
+// SMSUsage returns the SMS sent by the school in the month ("2006-01"),
+// with its quota.
+type SMSUsage struct {
+	domain.SMSUsage
+	MonthlyQuota int `json:"monthly_quota"`
+}
+
+func (s *NotificationService) SMSUsage(schoolID uint, month string) (*SMSUsage, error) {
+	if _, err := time.Parse("2006-01", month); err != nil {
+		return nil, fmt.Errorf("%w: month must be YYYY-MM", ErrInvalidPreferences)
+	}
+	sender, ok := s.senders[domain.ChannelSMS].(*SMSSender)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrChannelNotEnabled, domain.ChannelSMS)
+	}
+	cfg, err := sender.schoolSettings(schoolID)
+	if err != nil && !errors.Is(err, domain.ErrDeliveryRejected) {
+		return nil, err
+	}
+
+	usage := &SMSUsage{SMSUsage: domain.SMSUsage{SchoolID: schoolID, Month: month}}
+	if cfg != nil {
+		usage.MonthlyQuota = cfg.MonthlyQuota
+	}
+	stored, err := s.repo.GetSMSUsage(schoolID, month)
+	if err != nil {
+		return nil, err
+	}
+	if stored != nil {
+		usage.SMSUsage = *stored
+	}
+	return usage, nil
+}
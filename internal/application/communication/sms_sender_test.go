@@ -0,0 +1,222 @@
+package communication
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/k/iRegistro/internal/infrastructure/sms"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func smsSettings(extra domain.JSONMap) domain.SchoolSettings {
+	value := domain.JSONMap{
+		"provider":         "http",
+		"url":              "https://sms.example.com/send",
+		"api_key":          "secret",
+		"sender":           "Scuola",
+		"monthly_quota":    10,
+		"cost_per_segment": 5,
+	}
+	for k, v := range extra {
+		value[k] = v
+	}
+	return domain.SchoolSettings{SchoolID: 7, Key: SMSSettingsKey, Value: value}
+}
+
+func TestSMSSegments(t *testing.T) {
+	assert.Equal(t, 1, smsSegments(strings.Repeat("a", 160)))
+	assert.Equal(t, 2, smsSegments(strings.Repeat("a", 161)))
+	assert.Equal(t, 1, smsSegments("Mario è assente, perché?"), "accented Italian letters are in GSM-7")
+	assert.Equal(t, 2, smsSegments(strings.Repeat("€", 81)), "extended characters take two septets")
+	assert.Equal(t, 1, smsSegments(strings.Repeat("ó", 70)))
+	assert.Equal(t, 2, smsSegments(strings.Repeat("ó", 71)), "other characters switch to UCS-2")
+
+	long := &domain.Notification{Title: "Circolare", Body: strings.Repeat("parola ", 200)}
+	text := smsText(long)
+	assert.Equal(t, maxSMSSegments, smsSegments(text))
+	assert.True(t, strings.HasSuffix(text, "..."))
+}
+
+func TestNormalizePhone(t *testing.T) {
+	assert.Equal(t, "+393471234567", normalizePhone("347 123 4567"))
+	assert.Equal(t, "+393471234567", normalizePhone("+39 347-123-4567"))
+	assert.Equal(t, "+41791234567", normalizePhone("0041 79 123 45 67"))
+	assert.Equal(t, "", normalizePhone(""))
+	assert.Equal(t, "", normalizePhone("call me"))
+	assert.Equal(t, "", normalizePhone("123"))
+}
+
+func TestParseSMSSettings(t *testing.T) {
+	cfg, err := ParseSMSSettings(smsSettings(nil).Value)
+	require.NoError(t, err)
+	assert.Equal(t, 10, cfg.MonthlyQuota)
+	assert.Equal(t, defaultAbsenceAlertTime, cfg.AbsenceAlertTime)
+
+	for name, extra := range map[string]domain.JSONMap{
+		"unknown provider":  {"provider": "carrier-pigeon"},
+		"plain http":        {"url": "http://sms.example.com/send"},
+		"long sender":       {"sender": "IstitutoComprensivo"},
+		"negative quota":    {"monthly_quota": -1},
+		"invalid time":      {"absence_alert_time": "9am"},
+		"mistyped quota":    {"monthly_quota": "lots"},
+		"missing sender id": {"sender": ""},
+	} {
+		_, err := ParseSMSSettings(smsSettings(extra).Value)
+		assert.ErrorIs(t, err, ErrInvalidPreferences, name)
+	}
+
+	redacted := RedactSMSSettings(smsSettings(nil).Value)
+	assert.Equal(t, "***", redacted["api_key"])
+	assert.Equal(t, "secret", smsSettings(nil).Value["api_key"], "the original is left untouched")
+
+	restored := RestoreSMSSecrets(redacted, smsSettings(nil).Value)
+	assert.Equal(t, "secret", restored["api_key"], "saved back unchanged")
+	changed := RestoreSMSSecrets(domain.JSONMap{"api_key": "new"}, smsSettings(nil).Value)
+	assert.Equal(t, "new", changed["api_key"])
+	_, ok := RestoreSMSSecrets(redacted, nil)["api_key"]
+	assert.False(t, ok, "nothing stored to restore")
+}
+
+func TestSMSSender(t *testing.T) {
+	settings := &MockSchoolSettings{settings: []domain.SchoolSettings{smsSettings(nil)}}
+	gateway := sms.NewFake()
+	sender := NewSMSSender(nil, settings, func(domain.SMSSettings) (domain.SMSProvider, error) { return gateway, nil })
+	user := &domain.User{ID: 1, SchoolID: 7, Phone: "347 123 4567"}
+	n := &domain.Notification{ID: 5, Type: domain.NotifTypeAbsence, Title: "Assenza", Body: "Mario è assente oggi"}
+	month := time.Now().In(schoolLocation).Format("2006-01")
+
+	assert.Equal(t, "+393471234567", sender.Recipient(user))
+	assert.Equal(t, "", sender.Recipient(&domain.User{ID: 2, SchoolID: 7}), "users without a phone")
+	assert.Equal(t, "", NewSMSSender(nil, &MockSchoolSettings{}, nil).Recipient(user), "schools without a gateway")
+
+	t.Run("Sent and billed", func(t *testing.T) {
+		mockRepo := new(MockCommRepo)
+		sender.repo = mockRepo
+		mockRepo.On("ReserveSMSSegments", uint(7), month, 1, 10).Return(true, nil)
+		mockRepo.On("AddSMSUsage", uint(7), month, 1, 0, 5).Return(nil)
+
+		require.NoError(t, sender.Send(context.Background(), n, user, "+393471234567"))
+		mockRepo.AssertExpectations(t)
+		assert.Equal(t, []domain.SMSMessage{{To: "+393471234567", Sender: "Scuola", Text: "Assenza: Mario è assente oggi"}}, gateway.Messages())
+	})
+
+	t.Run("Quota exceeded", func(t *testing.T) {
+		mockRepo := new(MockCommRepo)
+		sender.repo = mockRepo
+		mockRepo.On("ReserveSMSSegments", uint(7), month, 1, 10).Return(false, nil)
+
+		err := sender.Send(context.Background(), n, user, "+393471234567")
+		assert.ErrorIs(t, err, ErrSMSQuotaExceeded)
+		assert.ErrorIs(t, err, domain.ErrDeliveryRejected, "not retried")
+		assert.Len(t, gateway.Messages(), 1)
+	})
+
+	t.Run("Failed sends release the reservation", func(t *testing.T) {
+		mockRepo := new(MockCommRepo)
+		sender.repo = mockRepo
+		gateway.Err = errors.New("sms.example.com: 503 Service Unavailable")
+		defer func() { gateway.Err = nil }()
+		mockRepo.On("ReserveSMSSegments", uint(7), month, 1, 10).Return(true, nil)
+		mockRepo.On("AddSMSUsage", uint(7), month, 0, -1, 0).Return(nil)
+
+		err := sender.Send(context.Background(), n, user, "+393471234567")
+		require.Error(t, err)
+		assert.False(t, errors.Is(err, domain.ErrDeliveryRejected))
+		mockRepo.AssertExpectations(t)
+	})
+}
+
+type fakeAbsences struct {
+	absences []domain.Absence
+	students map[uint]*domain.Student
+}
+
+func (f *fakeAbsences) GetAbsencesBySchoolID(schoolID uint, date time.Time) ([]domain.Absence, error) {
+	return f.absences, nil
+}
+func (f *fakeAbsences) GetStudentByID(ctx context.Context, id uint) (*domain.Student, error) {
+	return f.students[id], nil
+}
+
+func TestAbsenceAlerts(t *testing.T) {
+	mum, dad := uint(10), uint(11)
+	academic := &fakeAbsences{
+		absences: []domain.Absence{
+			{ID: 1, StudentID: 100, Hour: 1, Type: domain.AbsenceFull},
+			{ID: 2, StudentID: 101, Hour: 1, Type: domain.AbsenceFull},
+			{ID: 3, StudentID: 101, Hour: 2, Type: domain.AbsenceLate}, // Arrived at the second hour
+			{ID: 4, StudentID: 102, Hour: 3, Type: domain.AbsenceFull},
+			{ID: 5, StudentID: 103, Hour: 1, Type: domain.AbsenceFull, IsJustified: true},
+		},
+		students: map[uint]*domain.Student{
+			100: {ID: 100, FirstName: "Mario", LastName: "Rossi", Parent1ID: &mum, Parent2ID: &dad},
+			101: {ID: 101, FirstName: "Anna", LastName: "Bianchi", Parent1ID: &mum},
+		},
+	}
+	users := &MockUserRepo{users: map[uint]*domain.User{
+		mum: {ID: mum, SchoolID: 7, Phone: "3471234567", Locale: "it"},
+		dad: {ID: dad, SchoolID: 7}, // No phone: cannot be texted
+	}}
+	settings := &MockSchoolSettings{settings: []domain.SchoolSettings{
+		smsSettings(domain.JSONMap{"absence_alerts": true, "absence_alert_time": "08:30"}),
+	}}
+	gateway := sms.NewFake()
+	mockRepo := new(MockCommRepo)
+	notif := NewNotificationService(mockRepo, users, settings,
+		NewSMSSender(mockRepo, settings, func(domain.SMSSettings) (domain.SMSProvider, error) { return gateway, nil }))
+	alerts := NewAbsenceAlertService(mockRepo, academic, settings, users, notif)
+
+	day := time.Date(2026, 10, 19, 0, 0, 0, 0, schoolLocation)
+	at := func(h, m int) time.Time { return day.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute) }
+
+	n, err := alerts.SendDue(context.Background(), at(8, 29))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n, "before the alert time")
+	n, err = alerts.SendDue(context.Background(), at(12, 0))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n, "past the alert window")
+
+	mockRepo.On("CreateAbsenceAlert", mock.MatchedBy(func(a *domain.AbsenceAlert) bool {
+		return a.StudentID == 100 && a.SchoolID == 7 && a.Date.Equal(time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC))
+	})).Return(true, nil).Once()
+	mockRepo.On("CreateNotification", mock.MatchedBy(func(n *domain.Notification) bool {
+		return n.UserID == mum && n.Type == domain.NotifTypeAbsence && n.Channel == domain.ChannelInApp
+	})).Return(nil).Once()
+	mockRepo.On("CreateDelivery", mock.MatchedBy(func(d *domain.NotificationDelivery) bool {
+		return d.Channel == domain.ChannelSMS && d.Recipient == "+393471234567"
+	})).Return(nil).Once()
+	mockRepo.On("ReserveSMSSegments", uint(7), "2026-10", mock.Anything, 10).Return(true, nil)
+	mockRepo.On("AddSMSUsage", uint(7), "2026-10", 1, 0, mock.Anything).Return(nil)
+	mockRepo.On("CreateDeliveryAttempt", mock.Anything).Return(nil)
+	updated := make(chan domain.NotificationDelivery, 1)
+	mockRepo.On("UpdateDelivery", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		updated <- *args.Get(0).(*domain.NotificationDelivery)
+	})
+
+	n, err = alerts.SendDue(context.Background(), at(9, 5))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n, "only Mario was missing without notice")
+	select {
+	case d := <-updated:
+		assert.Equal(t, domain.DeliverySent, d.Status)
+	case <-time.After(time.Second):
+		t.Fatal("alert not sent")
+	}
+	messages := gateway.Messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "+393471234567", messages[0].To)
+	assert.Contains(t, messages[0].Text, "Mario Rossi risulta assente alla prima ora di oggi, 19/10/2026")
+
+	// The next run finds the alert already sent
+	mockRepo.On("CreateAbsenceAlert", mock.Anything).Return(false, nil).Once()
+	n, err = alerts.SendDue(context.Background(), at(9, 6))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	mockRepo.AssertExpectations(t)
+}
@@ -1,6 +1,7 @@
 package director
 
 import (
+	"context"
 	"time"
 
 	"github.com/k/iRegistro/internal/domain"
@@ -59,7 +60,7 @@ func (s *DirectorService) GetPendingDocuments(schoolID uint) ([]domain.Document,
 	// Let's assume Director sees specific status or Drafts for now.
 }
 
-func (s *DirectorService) SignDocument(docID uint, pin string) error {
+func (s *DirectorService) SignDocument(ctx context.Context, docID uint, pin string) error {
 	// Verify PIN (Mock logic)
 	if pin != "123456" {
 		return domain.ErrInvalidPIN // We'd need to define this
@@ -67,7 +68,7 @@ func (s *DirectorService) SignDocument(docID uint, pin string) error {
 
 	// Delegate to reporting repo/service logic
 	// Actually, signing might move status to SIGNED.
-	doc, err := s.reportingRepo.GetDocumentByID(docID)
+	doc, err := s.reportingRepo.GetDocumentByID(ctx, docID)
 	if err != nil {
 		return err
 	}
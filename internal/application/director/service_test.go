@@ -1,6 +1,7 @@
 package director
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -22,7 +23,7 @@ func (m *MockRepo) GetDocumentsByStatus(schoolID uint, status domain.DocumentSta
 	return args.Get(0).([]domain.Document), args.Error(1)
 }
 
-func (m *MockRepo) GetDocumentByID(id uint) (*domain.Document, error) {
+func (m *MockRepo) GetDocumentByID(ctx context.Context, id uint) (*domain.Document, error) {
 	args := m.Called(id)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -57,17 +58,21 @@ func (m *MockRepo) CreateCurriculum(curriculum *domain.Curriculum) error
 func (m *MockRepo) GetCurriculumsBySchoolID(schoolID uint) ([]domain.Curriculum, error) {
 	return nil, nil
 }
-func (m *MockRepo) CreateClass(class *domain.Class) error                      { return nil }
-func (m *MockRepo) GetClassByID(id uint) (*domain.Class, error)                { return nil, nil }
-func (m *MockRepo) GetClassesBySchoolID(schoolID uint) ([]domain.Class, error) { return nil, nil }
-func (m *MockRepo) CreateStudent(student *domain.Student) error                { return nil }
-func (m *MockRepo) GetStudentByID(id uint) (*domain.Student, error)            { return nil, nil }
-func (m *MockRepo) EnrollStudent(enrollment *domain.ClassEnrollment) error     { return nil }
-func (m *MockRepo) GetStudentsByClassID(classID uint, year string) ([]domain.Student, error) {
+func (m *MockRepo) CreateClass(class *domain.Class) error                            { return nil }
+func (m *MockRepo) GetClassByID(ctx context.Context, id uint) (*domain.Class, error) { return nil, nil }
+func (m *MockRepo) GetClassesBySchoolID(schoolID uint) ([]domain.Class, error)       { return nil, nil }
+func (m *MockRepo) CreateStudent(student *domain.Student) error                      { return nil }
+func (m *MockRepo) GetStudentByID(ctx context.Context, id uint) (*domain.Student, error) {
+	return nil, nil
+}
+func (m *MockRepo) EnrollStudent(enrollment *domain.ClassEnrollment) error { return nil }
+func (m *MockRepo) GetStudentsByClassID(ctx context.Context, classID uint, year string) ([]domain.Student, error) {
+	return nil, nil
+}
+func (m *MockRepo) CreateSubject(subject *domain.Subject) error { return nil }
+func (m *MockRepo) GetSubjectByID(ctx context.Context, id uint) (*domain.Subject, error) {
 	return nil, nil
 }
-func (m *MockRepo) CreateSubject(subject *domain.Subject) error                          { return nil }
-func (m *MockRepo) GetSubjectByID(id uint) (*domain.Subject, error)                      { return nil, nil }
 func (m *MockRepo) AssignSubjectToClass(assignment *domain.ClassSubjectAssignment) error { return nil }
 func (m *MockRepo) GetAssignmentsByTeacherID(teacherID uint) ([]domain.ClassSubjectAssignment, error) {
 	return nil, nil
@@ -85,6 +90,9 @@ func (m *MockRepo) GetAbsencesByStudentID(studentID uint, year string) ([]domain
 func (m *MockRepo) GetAbsencesByClassID(classID uint, date time.Time) ([]domain.Absence, error) {
 	return nil, nil
 }
+func (m *MockRepo) GetAbsencesBySchoolID(schoolID uint, date time.Time) ([]domain.Absence, error) {
+	return nil, nil
+}
 func (m *MockRepo) UpdateAbsence(absence *domain.Absence) error { return nil }
 
 // Reporting methods stubs
@@ -92,7 +100,7 @@ func (m *MockRepo) CreateDocument(doc *domain.Document) error { return nil }
 func (m *MockRepo) GetDocumentsBySchoolID(schoolID uint, docType domain.DocumentType) ([]domain.Document, error) {
 	return nil, nil
 }
-func (m *MockRepo) GetDocumentsByStudentID(studentID uint) ([]domain.Document, error) {
+func (m *MockRepo) GetDocumentsByStudentID(ctx context.Context, studentID uint) ([]domain.Document, error) {
 	return nil, nil
 }
 func (m *MockRepo) GetSignaturesByDocumentID(docID uint) ([]domain.DocumentSignature, error) {
@@ -151,7 +159,7 @@ func TestSignDocument(t *testing.T) {
 		return d.Status == domain.DocStatusSigned
 	})).Return(nil)
 
-	err := svc.SignDocument(10, "123456")
+	err := svc.SignDocument(context.Background(), 10, "123456")
 	assert.NoError(t, err)
 	mockRepo.AssertExpectations(t)
 }
@@ -0,0 +1,44 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronNext(t *testing.T) {
+	rome := defaultLocation
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, rome)
+		require.NoError(t, err)
+		return tm
+	}
+	cases := []struct {
+		expr, from, want string
+	}{
+		{"* * * * *", "2026-10-19 10:00", "2026-10-19 10:01"},
+		{"*/15 * * * *", "2026-10-19 10:07", "2026-10-19 10:15"},
+		{"0 17 * * *", "2026-10-19 17:00", "2026-10-20 17:00"},
+		{"@daily", "2026-10-19 10:00", "2026-10-20 00:00"},
+		{"30 8-18/2 * * 1-5", "2026-10-23 18:31", "2026-10-26 08:30"}, // Friday evening to Monday
+		{"0 0 1 * *", "2026-12-15 00:00", "2027-01-01 00:00"},
+		{"0 12 29 2 *", "2026-03-01 00:00", "2028-02-29 12:00"},
+		{"0 9 * * 7", "2026-10-19 10:00", "2026-10-25 09:00"}, // 7 is Sunday
+		// Either the day of month or of week when both are set
+		{"0 9 13 * 5", "2026-10-19 10:00", "2026-10-23 09:00"},
+		// 02:30 does not exist on the day summer time starts
+		{"30 2 * * *", "2027-03-27 03:00", "2027-03-29 02:30"},
+	}
+	for _, tc := range cases {
+		c, err := ParseCron(tc.expr, rome)
+		require.NoError(t, err, tc.expr)
+		assert.Equal(t, at(tc.want), c.Next(at(tc.from)), tc.expr)
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		_, err := ParseCron(expr, rome)
+		assert.ErrorIs(t, err, ErrInvalidCron, expr)
+	}
+}
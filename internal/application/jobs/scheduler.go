@@ -0,0 +1,375 @@
+// Package jobs runs background work from the jobs table: jobs enqueued on
+// demand and the runs of cron schedules. Every API replica runs a Scheduler;
+// a job is leased to one of them at a time, and jobs failed with an error are
+// retried with backoff.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrInvalidCron    = errors.New("invalid cron expression")
+	ErrUnknownJobType = errors.New("unknown job type")
+	// ErrDuplicateJob is returned when a job with the same idempotency key
+	// was already enqueued.
+	ErrDuplicateJob = errors.New("job already enqueued")
+)
+
+// CleanupJob deletes the finished jobs older than the retention.
+const CleanupJob = "jobs.cleanup"
+
+// Handler runs a job. When it returns an error the job is retried, per the
+// RetryPolicy of its type, unless the error is Permanent. Its context expires
+// with the lease of the job.
+type Handler func(ctx context.Context, job *domain.Job) error
+
+// RetryPolicy allows a job MaxAttempts runs in total. The first retry waits
+// Backoff, each later one twice as long as the previous, up to MaxBackoff.
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+var (
+	// NoRetry suits the frequent schedules, whose next run retries anyway.
+	NoRetry      = RetryPolicy{MaxAttempts: 1}
+	DefaultRetry = RetryPolicy{MaxAttempts: 5, Backoff: 30 * time.Second, MaxBackoff: time.Hour}
+)
+
+// delay is the wait after the attempt-th run failed.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && (p.MaxBackoff == 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying, e.g. an invalid payload.
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// Options tune a Scheduler; zero values take the defaults.
+type Options struct {
+	// Worker identifies the replica in the locks, the host name and a
+	// random suffix by default.
+	Worker       string
+	Concurrency  int           // Jobs run at the same time, 4
+	PollInterval time.Duration // 5s
+	// Lease is how long a worker holds a job, 10m. A job still running when
+	// its lease expires is cancelled and may be taken by another worker.
+	Lease     time.Duration
+	Retention time.Duration // Of finished jobs, 7 days
+	// Location evaluates the cron expressions, Europe/Rome by default.
+	Location *time.Location
+}
+
+type registration struct {
+	handler Handler
+	retry   RetryPolicy
+}
+
+type cronEntry struct {
+	jobType string
+	cron    *Cron
+	next    time.Time
+}
+
+type Scheduler struct {
+	repo   domain.JobRepository
+	opts   Options
+	logger *zap.Logger
+	now    func() time.Time
+
+	mu       sync.Mutex
+	handlers map[string]registration
+	crons    []*cronEntry
+
+	slots   chan struct{} // One per running job
+	running sync.WaitGroup
+}
+
+func NewScheduler(repo domain.JobRepository, opts Options, logger *zap.Logger) *Scheduler {
+	if opts.Worker == "" {
+		opts.Worker = workerID()
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 5 * time.Second
+	}
+	if opts.Lease <= 0 {
+		opts.Lease = 10 * time.Minute
+	}
+	if opts.Retention <= 0 {
+		opts.Retention = 7 * 24 * time.Hour
+	}
+	if opts.Location == nil {
+		opts.Location = defaultLocation
+	}
+	s := &Scheduler{
+		repo:     repo,
+		opts:     opts,
+		logger:   logger,
+		now:      time.Now,
+		handlers: make(map[string]registration),
+		slots:    make(chan struct{}, opts.Concurrency),
+	}
+	_ = s.Schedule(CleanupJob, "15 3 * * *", func(ctx context.Context, job *domain.Job) error {
+		n, err := repo.PurgeJobs(job.RunAt.Add(-s.opts.Retention))
+		if err == nil && n > 0 {
+			logger.Info("Purged finished jobs", zap.Int64("jobs", n))
+		}
+		return err
+	}, DefaultRetry)
+	return s
+}
+
+var defaultLocation = func() *time.Location {
+	loc, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		return time.FixedZone("CET", 3600)
+	}
+	return loc
+}()
+
+func workerID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return host + "-" + hex.EncodeToString(b)
+}
+
+// Register sets the handler of the jobs of jobType.
+func (s *Scheduler) Register(jobType string, h Handler, retry RetryPolicy) {
+	if retry.MaxAttempts < 1 {
+		retry.MaxAttempts = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[jobType] = registration{handler: h, retry: retry}
+}
+
+// Schedule registers h and enqueues a job of jobType at the times of the cron
+// expression. Every replica enqueues the same run under the same idempotency
+// key, so only one of them runs it. The RunAt of the job is the scheduled
+// time, which handlers should use instead of the clock. Runs missed while no
+// replica was up are skipped.
+func (s *Scheduler) Schedule(jobType, expr string, h Handler, retry RetryPolicy) error {
+	c, err := ParseCron(expr, s.opts.Location)
+	if err != nil {
+		return err
+	}
+	s.Register(jobType, h, retry)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.crons = append(s.crons, &cronEntry{jobType: jobType, cron: c, next: c.Next(s.now())})
+	return nil
+}
+
+// Enqueue adds a job of jobType to run as soon as possible. A non empty key
+// makes it idempotent: ErrDuplicateJob is returned if a job with the same key
+// exists.
+func (s *Scheduler) Enqueue(jobType string, payload domain.JSONMap, key string) (*domain.Job, error) {
+	return s.EnqueueAt(jobType, payload, key, s.now())
+}
+
+// EnqueueAt is Enqueue for a job due at runAt.
+func (s *Scheduler) EnqueueAt(jobType string, payload domain.JSONMap, key string, runAt time.Time) (*domain.Job, error) {
+	s.mu.Lock()
+	reg, ok := s.handlers[jobType]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownJobType, jobType)
+	}
+	if payload == nil {
+		payload = domain.JSONMap{}
+	}
+	job := &domain.Job{
+		Type:        jobType,
+		Payload:     payload,
+		Status:      domain.JobPending,
+		RunAt:       runAt,
+		MaxAttempts: reg.retry.MaxAttempts,
+	}
+	if key != "" {
+		job.IdempotencyKey = &key
+	}
+	created, err := s.repo.EnqueueJob(job)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, fmt.Errorf("%w: %s", ErrDuplicateJob, key)
+	}
+	return job, nil
+}
+
+// Run polls for due jobs until ctx is done, then waits for the running ones
+// to finish.
+func (s *Scheduler) Run(ctx context.Context) {
+	s.logger.Info("Job scheduler started", zap.String("worker", s.opts.Worker), zap.Int("concurrency", s.opts.Concurrency))
+	ticker := time.NewTicker(s.opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.tick(ctx); err != nil {
+			s.logger.Error("Failed to poll jobs", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			s.running.Wait()
+			s.logger.Info("Job scheduler stopped", zap.String("worker", s.opts.Worker))
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tick enqueues the due cron runs and starts as many due jobs as there are
+// free slots, returning how many it started.
+func (s *Scheduler) tick(ctx context.Context) (int, error) {
+	now := s.now()
+	s.enqueueCrons(now)
+
+	free := cap(s.slots) - len(s.slots)
+	if free == 0 || ctx.Err() != nil {
+		return 0, nil
+	}
+	claimed, err := s.repo.ClaimJobs(s.opts.Worker, s.jobTypes(), now, now.Add(s.opts.Lease), free)
+	if err != nil {
+		return 0, err
+	}
+	for i := range claimed {
+		job := claimed[i]
+		s.slots <- struct{}{}
+		s.running.Add(1)
+		go func() {
+			defer func() {
+				<-s.slots
+				s.running.Done()
+			}()
+			s.run(ctx, &job)
+		}()
+	}
+	return len(claimed), nil
+}
+
+func (s *Scheduler) enqueueCrons(now time.Time) {
+	s.mu.Lock()
+	var due []cronEntry
+	for _, e := range s.crons {
+		if !now.Before(e.next) {
+			due = append(due, *e)
+			e.next = e.cron.Next(now)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, e := range due {
+		key := e.jobType + "@" + e.next.UTC().Format(time.RFC3339)
+		_, err := s.EnqueueAt(e.jobType, nil, key, e.next)
+		if err != nil && !errors.Is(err, ErrDuplicateJob) {
+			s.logger.Error("Failed to enqueue scheduled job", zap.String("type", e.jobType), zap.Error(err))
+		}
+	}
+}
+
+func (s *Scheduler) jobTypes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	types := make([]string, 0, len(s.handlers))
+	for t := range s.handlers {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func (s *Scheduler) run(ctx context.Context, job *domain.Job) {
+	log := s.logger.With(zap.Uint("job_id", job.ID), zap.String("type", job.Type), zap.Int("attempt", job.Attempts))
+	s.mu.Lock()
+	reg, ok := s.handlers[job.Type]
+	s.mu.Unlock()
+
+	var err error
+	switch {
+	case !ok: // Claimed types are registered, unless the row was edited
+		err = Permanent(fmt.Errorf("%w: %s", ErrUnknownJobType, job.Type))
+	case job.Attempts > job.MaxAttempts:
+		// Its last worker stopped while running it
+		err = Permanent(errors.New("lease expired on the last attempt"))
+	default:
+		// Shutting down waits for the running jobs instead of cancelling them
+		jobCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.opts.Lease)
+		err = s.call(jobCtx, reg.handler, job)
+		cancel()
+	}
+
+	now := s.now()
+	var perm permanentError
+	switch {
+	case err == nil:
+		err = s.repo.CompleteJob(job.ID, s.opts.Worker, now)
+	case errors.As(err, &perm) || job.Attempts >= job.MaxAttempts:
+		log.Error("Job failed", zap.Error(err))
+		err = s.repo.FailJob(job.ID, s.opts.Worker, now, err.Error())
+	default:
+		retryAt := now.Add(reg.retry.delay(job.Attempts))
+		log.Warn("Job failed, retrying", zap.Time("retry_at", retryAt), zap.Error(err))
+		err = s.repo.RetryJob(job.ID, s.opts.Worker, retryAt, err.Error())
+	}
+	if err != nil {
+		log.Error("Failed to save the job outcome", zap.Error(err))
+	}
+}
+
+// call runs h, turning a panic into an error.
+func (s *Scheduler) call(ctx context.Context, h Handler, job *domain.Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return h(ctx, job)
+}
+
+// PayloadUint reads an id from the payload of job, which holds numbers as
+// float64 once read back from the database.
+func PayloadUint(job *domain.Job, key string) (uint, error) {
+	switch v := job.Payload[key].(type) {
+	case float64:
+		if v >= 0 && v == float64(uint(v)) {
+			return uint(v), nil
+		}
+	case uint:
+		return v, nil
+	case int:
+		if v >= 0 {
+			return uint(v), nil
+		}
+	}
+	return 0, Permanent(fmt.Errorf("job %d: invalid %s in payload", job.ID, key))
+}
@@ -0,0 +1,267 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// memoryJobs is a jobs table shared by the schedulers of a test, as by the
+// replicas.
+type memoryJobs struct {
+	mu   sync.Mutex
+	jobs []*domain.Job
+}
+
+func (m *memoryJobs) EnqueueJob(job *domain.Job) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, j := range m.jobs {
+		if job.IdempotencyKey != nil && j.IdempotencyKey != nil && *j.IdempotencyKey == *job.IdempotencyKey {
+			return false, nil
+		}
+	}
+	job.ID = uint(len(m.jobs) + 1)
+	stored := *job
+	m.jobs = append(m.jobs, &stored)
+	return true, nil
+}
+
+func (m *memoryJobs) GetJob(id uint) (*domain.Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, j := range m.jobs {
+		if j.ID == id {
+			job := *j
+			return &job, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memoryJobs) ClaimJobs(worker string, types []string, now, lockedUntil time.Time, limit int) ([]domain.Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	due := make([]*domain.Job, 0)
+	for _, j := range m.jobs {
+		expired := j.Status == domain.JobRunning && j.LockedUntil.Before(now)
+		if containsString(types, j.Type) && !j.RunAt.After(now) && (j.Status == domain.JobPending || expired) {
+			due = append(due, j)
+		}
+	}
+	sort.SliceStable(due, func(a, b int) bool { return due[a].RunAt.Before(due[b].RunAt) })
+	var claimed []domain.Job
+	for _, j := range due {
+		if len(claimed) == limit {
+			break
+		}
+		j.Status, j.LockedBy, j.LockedUntil = domain.JobRunning, worker, &lockedUntil
+		j.Attempts++
+		claimed = append(claimed, *j)
+	}
+	return claimed, nil
+}
+
+func (m *memoryJobs) update(id uint, worker string, f func(j *domain.Job)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, j := range m.jobs {
+		if j.ID == id && j.Status == domain.JobRunning && j.LockedBy == worker {
+			f(j)
+			j.LockedBy, j.LockedUntil = "", nil
+		}
+	}
+	return nil
+}
+
+func (m *memoryJobs) CompleteJob(id uint, worker string, at time.Time) error {
+	return m.update(id, worker, func(j *domain.Job) { j.Status, j.FinishedAt = domain.JobDone, &at })
+}
+
+func (m *memoryJobs) RetryJob(id uint, worker string, runAt time.Time, lastError string) error {
+	return m.update(id, worker, func(j *domain.Job) { j.Status, j.RunAt, j.LastError = domain.JobPending, runAt, lastError })
+}
+
+func (m *memoryJobs) FailJob(id uint, worker string, at time.Time, lastError string) error {
+	return m.update(id, worker, func(j *domain.Job) { j.Status, j.FinishedAt, j.LastError = domain.JobFailed, &at, lastError })
+}
+
+func (m *memoryJobs) PurgeJobs(before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.jobs[:0]
+	for _, j := range m.jobs {
+		if j.FinishedAt == nil || !j.FinishedAt.Before(before) {
+			kept = append(kept, j)
+		}
+	}
+	n := int64(len(m.jobs) - len(kept))
+	m.jobs = kept
+	return n, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// testScheduler returns a scheduler on repo whose clock is *now.
+func testScheduler(repo domain.JobRepository, worker string, now *time.Time) *Scheduler {
+	s := NewScheduler(repo, Options{Worker: worker, Concurrency: 2}, zap.NewNop())
+	s.now = func() time.Time { return *now }
+	return s
+}
+
+// step runs the due jobs of s and waits for them.
+func step(t *testing.T, s *Scheduler) int {
+	n, err := s.tick(context.Background())
+	require.NoError(t, err)
+	s.running.Wait()
+	return n
+}
+
+func TestEnqueueAndRetry(t *testing.T) {
+	repo := &memoryJobs{}
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	s := testScheduler(repo, "a", &now)
+
+	var ran []string
+	s.Register("ok", func(ctx context.Context, job *domain.Job) error {
+		ran = append(ran, job.Type)
+		return nil
+	}, DefaultRetry)
+	s.Register("flaky", func(ctx context.Context, job *domain.Job) error {
+		return errors.New("unavailable")
+	}, RetryPolicy{MaxAttempts: 3, Backoff: time.Minute, MaxBackoff: time.Hour})
+	s.Register("invalid", func(ctx context.Context, job *domain.Job) error {
+		_, err := PayloadUint(job, "export_id")
+		return err
+	}, DefaultRetry)
+	s.Register("panics", func(ctx context.Context, job *domain.Job) error {
+		panic("boom")
+	}, NoRetry)
+
+	ok, err := s.Enqueue("ok", domain.JSONMap{"export_id": float64(3)}, "ok:3")
+	require.NoError(t, err)
+	_, err = s.Enqueue("ok", nil, "ok:3")
+	assert.ErrorIs(t, err, ErrDuplicateJob)
+	_, err = s.Enqueue("unknown", nil, "")
+	assert.ErrorIs(t, err, ErrUnknownJobType)
+	flaky, _ := s.Enqueue("flaky", nil, "")
+	invalid, _ := s.Enqueue("invalid", domain.JSONMap{"export_id": "x"}, "")
+	panics, _ := s.Enqueue("panics", nil, "")
+
+	// Two slots: the jobs run two at a time
+	assert.Equal(t, 2, step(t, s))
+	assert.Equal(t, 2, step(t, s))
+	assert.Equal(t, 0, step(t, s), "the flaky job waits for its retry")
+
+	get := func(id uint) *domain.Job {
+		job, _ := repo.GetJob(id)
+		return job
+	}
+	assert.Equal(t, []string{"ok"}, ran)
+	assert.Equal(t, domain.JobDone, get(ok.ID).Status)
+	assert.Equal(t, domain.JobFailed, get(invalid.ID).Status, "permanent errors are not retried")
+	assert.Equal(t, domain.JobFailed, get(panics.ID).Status)
+	assert.Contains(t, get(panics.ID).LastError, "panic: boom")
+	assert.Equal(t, domain.JobPending, get(flaky.ID).Status)
+	assert.Equal(t, now.Add(time.Minute), get(flaky.ID).RunAt)
+
+	now = now.Add(time.Minute)
+	step(t, s)
+	assert.Equal(t, now.Add(2*time.Minute), get(flaky.ID).RunAt, "the backoff doubles")
+	now = now.Add(2 * time.Minute)
+	step(t, s)
+	assert.Equal(t, domain.JobFailed, get(flaky.ID).Status)
+	assert.Equal(t, 3, get(flaky.ID).Attempts)
+	assert.Equal(t, "unavailable", get(flaky.ID).LastError)
+}
+
+func TestScheduleRunsOnceAcrossReplicas(t *testing.T) {
+	repo := &memoryJobs{}
+	now := time.Date(2026, 10, 19, 16, 58, 30, 0, defaultLocation)
+	var mu sync.Mutex
+	var runs []time.Time
+	handler := func(ctx context.Context, job *domain.Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		runs = append(runs, job.RunAt)
+		return nil
+	}
+	replicas := []*Scheduler{testScheduler(repo, "a", &now), testScheduler(repo, "b", &now)}
+	for _, s := range replicas {
+		require.NoError(t, s.Schedule("reminders", "0 17 * * *", handler, DefaultRetry))
+	}
+	assert.ErrorIs(t, replicas[0].Schedule("bad", "0 25 * * *", handler, NoRetry), ErrInvalidCron)
+
+	for _, s := range replicas {
+		assert.Equal(t, 0, step(t, s), "not due yet")
+	}
+	now = now.Add(2 * time.Minute)
+	for _, s := range replicas {
+		step(t, s)
+	}
+	for _, s := range replicas {
+		step(t, s)
+	}
+	at17 := time.Date(2026, 10, 19, 17, 0, 0, 0, defaultLocation)
+	require.Len(t, runs, 1)
+	assert.True(t, at17.Equal(runs[0]), "run at the scheduled time")
+
+	now = now.Add(24 * time.Hour)
+	for _, s := range replicas {
+		step(t, s)
+	}
+	assert.Len(t, runs, 2)
+}
+
+func TestExpiredLease(t *testing.T) {
+	repo := &memoryJobs{}
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	ran := 0
+	handler := func(ctx context.Context, job *domain.Job) error {
+		ran++
+		return nil
+	}
+	dead := testScheduler(repo, "dead", &now)
+	alive := testScheduler(repo, "alive", &now)
+	for _, s := range []*Scheduler{dead, alive} {
+		s.Register("export", handler, RetryPolicy{MaxAttempts: 2})
+	}
+	first, _ := dead.Enqueue("export", nil, "")
+	second, _ := dead.Enqueue("export", nil, "")
+
+	// The dead worker took both and never finished them
+	claimed, err := repo.ClaimJobs("dead", []string{"export"}, now, now.Add(dead.opts.Lease), 2)
+	require.NoError(t, err)
+	require.Len(t, claimed, 2)
+	repo.jobs[1].Attempts = 2 // Already retried once
+
+	assert.Equal(t, 0, step(t, alive), "still leased")
+	now = now.Add(dead.opts.Lease + time.Second)
+	assert.Equal(t, 2, step(t, alive))
+
+	assert.Equal(t, 1, ran)
+	job, _ := repo.GetJob(first.ID)
+	assert.Equal(t, domain.JobDone, job.Status)
+	job, _ = repo.GetJob(second.ID)
+	assert.Equal(t, domain.JobFailed, job.Status, "no attempts left")
+
+	// The late outcome of the dead worker is dropped
+	require.NoError(t, repo.FailJob(first.ID, "dead", now, "late"))
+	job, _ = repo.GetJob(first.ID)
+	assert.Equal(t, domain.JobDone, job.Status)
+}
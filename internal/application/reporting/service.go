@@ -1,6 +1,7 @@
 package reporting
 
 import (
+	"context"
 	"errors"
 	"time"
 
@@ -49,8 +50,8 @@ func (s *ReportingService) CreateReportCard(schoolID, studentID, classID uint, a
 	return doc, nil
 }
 
-func (s *ReportingService) SignDocument(docID, signerID uint, ipAddress string) error {
-	doc, err := s.repo.GetDocumentByID(docID)
+func (s *ReportingService) SignDocument(ctx context.Context, docID, signerID uint, ipAddress string) error {
+	doc, err := s.repo.GetDocumentByID(ctx, docID)
 	if err != nil {
 		return err
 	}
@@ -79,8 +80,8 @@ func (s *ReportingService) SignDocument(docID, signerID uint, ipAddress string)
 	return nil
 }
 
-func (s *ReportingService) GetDocumentPDF(docID uint) ([]byte, error) {
-	doc, err := s.repo.GetDocumentByID(docID)
+func (s *ReportingService) GetDocumentPDF(ctx context.Context, docID uint) ([]byte, error) {
+	doc, err := s.repo.GetDocumentByID(ctx, docID)
 	if err != nil {
 		return nil, err
 	}
@@ -112,8 +113,8 @@ func (s *ReportingService) RegisterOrientation(participation *domain.Orientation
 }
 
 // Student Reporting
-func (s *ReportingService) GetDocumentsByStudentID(studentID uint) ([]domain.Document, error) {
-	return s.repo.GetDocumentsByStudentID(studentID)
+func (s *ReportingService) GetDocumentsByStudentID(ctx context.Context, studentID uint) ([]domain.Document, error) {
+	return s.repo.GetDocumentsByStudentID(ctx, studentID)
 }
 
 func (s *ReportingService) GetPCTOProgression(studentID uint) (int, []domain.PCTOProject, error) {
@@ -1,6 +1,7 @@
 package reporting
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -19,7 +20,7 @@ func (m *MockRepo) CreateDocument(doc *domain.Document) error {
 	args := m.Called(doc)
 	return args.Error(0)
 }
-func (m *MockRepo) GetDocumentByID(id uint) (*domain.Document, error) {
+func (m *MockRepo) GetDocumentByID(ctx context.Context, id uint) (*domain.Document, error) {
 	args := m.Called(id)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -39,7 +40,7 @@ func (m *MockRepo) AddSignature(sig *domain.DocumentSignature) error {
 func (m *MockRepo) GetDocumentsBySchoolID(schoolID uint, docType domain.DocumentType) ([]domain.Document, error) {
 	return nil, nil
 }
-func (m *MockRepo) GetDocumentsByStudentID(studentID uint) ([]domain.Document, error) {
+func (m *MockRepo) GetDocumentsByStudentID(ctx context.Context, studentID uint) ([]domain.Document, error) {
 	return nil, nil
 }
 func (m *MockRepo) GetDocumentsByStatus(schoolID uint, status domain.DocumentStatus) ([]domain.Document, error) {
@@ -118,7 +119,7 @@ func TestGetDocumentPDF(t *testing.T) {
 	mockPDF.On("GenerateReportCard", doc.Data).Return([]byte("%PDF..."), nil)
 
 	// Act
-	pdf, err := svc.GetDocumentPDF(1)
+	pdf, err := svc.GetDocumentPDF(context.Background(), 1)
 
 	// Assert
 	assert.NoError(t, err)
@@ -163,7 +164,7 @@ func TestSignDocument(t *testing.T) {
 	})).Return(nil)
 
 	// Act
-	err := svc.SignDocument(1, 99, "127.0.0.1")
+	err := svc.SignDocument(context.Background(), 1, 99, "127.0.0.1")
 
 	// Assert
 	assert.NoError(t, err)
@@ -1,6 +1,7 @@
 package secretary
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"time"
@@ -23,19 +24,29 @@ type Notifier interface {
 	TriggerNotification(userID uint, notifType domain.NotificationType, title, body string, data domain.JSONMap) error
 }
 
+// DeliveryStats reports notification deliveries that did not reach their recipient.
+type DeliveryStats interface {
+	CountDeliveryIssues(schoolID uint, since time.Time) (int64, error)
+}
+
+// deliveryIssuesWindow is how far back the dashboard looks for bounced and failed deliveries.
+const deliveryIssuesWindow = 7 * 24 * time.Hour
+
 type SecretaryService struct {
-	repo     domain.ReportingRepository
-	pdfGen   Generator
-	storage  Storage
-	notifier Notifier
+	repo       domain.ReportingRepository
+	pdfGen     Generator
+	storage    Storage
+	notifier   Notifier
+	deliveries DeliveryStats
 }
 
-func NewSecretaryService(repo domain.ReportingRepository, pdfGen Generator, storage Storage, notifier Notifier) *SecretaryService {
+func NewSecretaryService(repo domain.ReportingRepository, pdfGen Generator, storage Storage, notifier Notifier, deliveries DeliveryStats) *SecretaryService {
 	return &SecretaryService{
-		repo:     repo,
-		pdfGen:   pdfGen,
-		storage:  storage,
-		notifier: notifier,
+		repo:       repo,
+		pdfGen:     pdfGen,
+		storage:    storage,
+		notifier:   notifier,
+		deliveries: deliveries,
 	}
 }
 
@@ -53,8 +64,8 @@ func (s *SecretaryService) GetArchive(schoolID uint, filters map[string]interfac
 	return s.repo.GetDocumentsByStatus(schoolID, domain.DocStatusArchived)
 }
 
-func (s *SecretaryService) ApproveDocument(docID uint, approverID uint) error {
-	doc, err := s.repo.GetDocumentByID(docID)
+func (s *SecretaryService) ApproveDocument(ctx context.Context, docID uint, approverID uint) error {
+	doc, err := s.repo.GetDocumentByID(ctx, docID)
 	if err != nil {
 		return err
 	}
@@ -126,8 +137,8 @@ func (s *SecretaryService) ApproveDocument(docID uint, approverID uint) error {
 	return s.repo.UpdateDocument(doc)
 }
 
-func (s *SecretaryService) RejectDocument(docID uint, reason string) error {
-	_, err := s.repo.GetDocumentByID(docID)
+func (s *SecretaryService) RejectDocument(ctx context.Context, docID uint, reason string) error {
+	_, err := s.repo.GetDocumentByID(ctx, docID)
 	if err != nil {
 		return err
 	}
@@ -174,9 +185,11 @@ func (s *SecretaryService) GetDashboardStats(schoolID uint) (DashboardStats, err
 		return DashboardStats{}, err
 	}
 
-	// 3. Delivery issues = Mock logic or actual query if DeliveryReport repo existed
-	// For now, returning 0 as per requirement/capabilities
-	deliveryIssues := int64(0)
+	// 3. Delivery issues = Notifications bounced or failed in the last week
+	deliveryIssues, err := s.deliveries.CountDeliveryIssues(schoolID, time.Now().Add(-deliveryIssuesWindow))
+	if err != nil {
+		return DashboardStats{}, err
+	}
 
 	return DashboardStats{
 		NewDocuments:   newDocs,
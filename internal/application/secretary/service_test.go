@@ -1,6 +1,7 @@
 package secretary
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -24,7 +25,7 @@ func (m *MockRepo) GetDocumentsByStatus(schoolID uint, status domain.DocumentSta
 	return args.Get(0).([]domain.Document), args.Error(1)
 }
 
-func (m *MockRepo) GetDocumentByID(id uint) (*domain.Document, error) {
+func (m *MockRepo) GetDocumentByID(ctx context.Context, id uint) (*domain.Document, error) {
 	args := m.Called(id)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -52,7 +53,7 @@ func (m *MockRepo) CreateDocument(doc *domain.Document) error { return nil }
 func (m *MockRepo) GetDocumentsBySchoolID(schoolID uint, docType domain.DocumentType) ([]domain.Document, error) {
 	return nil, nil
 }
-func (m *MockRepo) GetDocumentsByStudentID(studentID uint) ([]domain.Document, error) {
+func (m *MockRepo) GetDocumentsByStudentID(ctx context.Context, studentID uint) ([]domain.Document, error) {
 	return nil, nil
 }
 func (m *MockRepo) GetSignaturesByDocumentID(docID uint) ([]domain.DocumentSignature, error) {
@@ -119,11 +120,20 @@ func (m *MockNotifier) TriggerNotification(userID uint, notifType domain.Notific
 	return args.Error(0)
 }
 
+type MockDeliveryStats struct {
+	mock.Mock
+}
+
+func (m *MockDeliveryStats) CountDeliveryIssues(schoolID uint, since time.Time) (int64, error) {
+	args := m.Called(schoolID, since)
+	return args.Get(0).(int64), args.Error(1)
+}
+
 // --- Tests ---
 
 func TestGetInbox(t *testing.T) {
 	mockRepo := new(MockRepo)
-	svc := NewSecretaryService(mockRepo, new(MockPDFGen), new(MockStorage), new(MockNotifier))
+	svc := NewSecretaryService(mockRepo, new(MockPDFGen), new(MockStorage), new(MockNotifier), new(MockDeliveryStats))
 
 	docs := []domain.Document{{ID: 1, Status: domain.DocStatusDraft}}
 
@@ -139,7 +149,7 @@ func TestApproveDocument(t *testing.T) {
 	mockRepo := new(MockRepo)
 	mockStorage := new(MockStorage)
 	mockNotifier := new(MockNotifier)
-	svc := NewSecretaryService(mockRepo, new(MockPDFGen), mockStorage, mockNotifier)
+	svc := NewSecretaryService(mockRepo, new(MockPDFGen), mockStorage, mockNotifier, new(MockDeliveryStats))
 
 	doc := &domain.Document{ID: 10, Status: domain.DocStatusDraft, Type: domain.DocReportCard, StudentID: new(uint)} // StudentID needed for notif
 	*doc.StudentID = 123
@@ -150,8 +160,24 @@ func TestApproveDocument(t *testing.T) {
 	mockRepo.On("UpdateDocument", mock.Anything).Return(nil)
 	mockNotifier.On("TriggerNotification", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
 
-	err := svc.ApproveDocument(10, 99)
+	err := svc.ApproveDocument(context.Background(), 10, 99)
 	assert.NoError(t, err)
 	mockRepo.AssertExpectations(t)
 	mockNotifier.AssertExpectations(t)
 }
+
+func TestGetDashboardStats(t *testing.T) {
+	mockRepo := new(MockRepo)
+	deliveries := new(MockDeliveryStats)
+	svc := NewSecretaryService(mockRepo, new(MockPDFGen), new(MockStorage), new(MockNotifier), deliveries)
+
+	mockRepo.On("CountDocumentsByStatus", uint(1), domain.DocStatusDraft).Return(4, nil)
+	mockRepo.On("CountDocumentsUpdatedSince", uint(1), mock.Anything, mock.Anything).Return(2, nil)
+	deliveries.On("CountDeliveryIssues", uint(1), mock.MatchedBy(func(since time.Time) bool {
+		return time.Since(since) > 6*24*time.Hour
+	})).Return(int64(3), nil)
+
+	stats, err := svc.GetDashboardStats(1)
+	assert.NoError(t, err)
+	assert.Equal(t, DashboardStats{NewDocuments: 4, ProcessedToday: 2, DeliveryIssues: 3}, stats)
+}
@@ -0,0 +1,344 @@
+package sidi
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// The flow files are text files of fixed length records separated by CRLF:
+// a header record, the detail records and a trailer counting them. Fields
+// are at fixed positions after the one character record type; the rest of
+// the record is filled with spaces. The layouts below follow the record
+// layouts (tracciati record) published for the student registry flows and
+// are the only place to change when the ministry revises them.
+const recordLength = 200
+
+// Record types, the first character of every record.
+const (
+	recordHeader  = '0'
+	recordDetail  = '1'
+	recordTrailer = '9'
+)
+
+type fieldKind int
+
+const (
+	alpha   fieldKind = iota // Left aligned and padded with spaces, uppercase ASCII
+	numeric                  // Right aligned and padded with zeros
+	date                     // DDMMYYYY
+	taxCode                  // Codice fiscale
+)
+
+type field struct {
+	name     string
+	kind     fieldKind
+	length   int
+	required bool
+}
+
+// layout is the list of fields of a record, after the record type.
+type layout []field
+
+func (l layout) width() int {
+	n := 1
+	for _, f := range l {
+		n += f.length
+	}
+	return n
+}
+
+// Codes of the flows, also written in their header and trailer.
+const (
+	FlowEnrollment = "ISC" // Iscrizioni
+	FlowFrequency  = "FRQ" // Frequenze
+	FlowOutcome    = "ESI" // Esiti degli scrutini
+	FlowReturn     = "RIT" // Ritorno: the ministry's answer to a flow
+)
+
+var (
+	headerLayout = layout{
+		{"flow", alpha, 3, true},
+		{"school_code", alpha, 10, true},  // Codice meccanografico
+		{"school_year", numeric, 4, true}, // First calendar year of the academic year
+		{"created", date, 8, true},
+		{"sequence", numeric, 3, true},
+	}
+	trailerLayout = layout{
+		{"flow", alpha, 3, true},
+		{"records", numeric, 7, true}, // Detail records
+	}
+
+	// detailLayouts are the detail records of each flow.
+	detailLayouts = map[string]layout{
+		FlowEnrollment: {
+			{"school_code", alpha, 10, true},
+			{"sidi_code", alpha, 20, false}, // Blank until assigned by the registry
+			{"tax_code", taxCode, 16, true},
+			{"last_name", alpha, 30, true},
+			{"first_name", alpha, 30, true},
+			{"gender", alpha, 1, true},
+			{"birth_date", date, 8, true},
+			{"birth_place", alpha, 30, false},
+			{"citizenship", alpha, 20, false},
+			{"grade", numeric, 1, true},
+			{"section", alpha, 5, true},
+			{"enrollment_date", date, 8, true},
+			{"status", alpha, 2, true},
+		},
+		FlowFrequency: {
+			{"school_code", alpha, 10, true},
+			{"sidi_code", alpha, 20, false},
+			{"tax_code", taxCode, 16, true},
+			{"grade", numeric, 1, true},
+			{"section", alpha, 5, true},
+			{"reference_date", date, 8, true},
+			{"absence_days", numeric, 3, true},
+			{"absence_hours", numeric, 4, true},
+			{"late_entries", numeric, 3, true},
+			{"status", alpha, 1, true},
+		},
+		FlowOutcome: {
+			{"school_code", alpha, 10, true},
+			{"sidi_code", alpha, 20, false},
+			{"tax_code", taxCode, 16, true},
+			{"grade", numeric, 1, true},
+			{"section", alpha, 5, true},
+			{"outcome", alpha, 2, true},
+			{"credits", numeric, 2, false},
+			{"final_score", numeric, 3, false},
+			{"decision_date", date, 8, true},
+		},
+		FlowReturn: {
+			{"school_code", alpha, 10, true},
+			{"tax_code", taxCode, 16, true},
+			{"sidi_code", alpha, 20, false}, // Assigned when accepted
+			{"result", numeric, 2, true},    // 00 when accepted
+			{"message", alpha, 80, false},
+			{"flow", alpha, 3, true}, // Of the record answered
+		},
+	}
+)
+
+var taxCodePattern = regexp.MustCompile(`^[A-Z]{6}[0-9LMNPQRSTUV]{2}[A-Z][0-9LMNPQRSTUV]{2}[A-Z][0-9LMNPQRSTUV]{3}[A-Z]$`)
+
+// FieldError is a value that does not fit its field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string { return e.Field + ": " + e.Message }
+
+// encode returns the record of type t with values, one per field of l.
+func encode(t byte, l layout, values []string) (string, error) {
+	var b strings.Builder
+	b.Grow(recordLength)
+	b.WriteByte(t)
+	for i, f := range l {
+		v, err := format(f, values[i])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(v)
+	}
+	for b.Len() < recordLength {
+		b.WriteByte(' ')
+	}
+	return b.String(), nil
+}
+
+// format pads a value to its field, checking it.
+func format(f field, v string) (string, error) {
+	invalid := func(format string, args ...interface{}) (string, error) {
+		return "", FieldError{f.name, fmt.Sprintf(format, args...)}
+	}
+	if f.kind == alpha {
+		v = toASCII(v)
+	}
+	v = strings.TrimSpace(v)
+	if v == "" {
+		if f.required {
+			return invalid("required")
+		}
+		if f.kind == numeric {
+			return strings.Repeat("0", f.length), nil
+		}
+		return strings.Repeat(" ", f.length), nil
+	}
+	if len(v) > f.length {
+		return invalid("%q is longer than %d characters", v, f.length)
+	}
+	if msg := check(f, v); msg != "" {
+		return invalid("%s", msg)
+	}
+	if f.kind == numeric {
+		return strings.Repeat("0", f.length-len(v)) + v, nil
+	}
+	return v + strings.Repeat(" ", f.length-len(v)), nil
+}
+
+// check returns why a trimmed, non-empty value is not valid for its field.
+func check(f field, v string) string {
+	switch f.kind {
+	case numeric:
+		if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+			return fmt.Sprintf("%q is not a number", v)
+		}
+	case date:
+		if _, err := time.Parse("02012006", v); err != nil {
+			return fmt.Sprintf("%q is not a DDMMYYYY date", v)
+		}
+	case taxCode:
+		if !taxCodePattern.MatchString(v) {
+			return fmt.Sprintf("%q is not a tax code", v)
+		}
+	case alpha:
+		for _, r := range v {
+			if r < ' ' || r > '~' || unicode.IsLower(r) {
+				return fmt.Sprintf("%q is not uppercase ASCII", v)
+			}
+		}
+	}
+	return ""
+}
+
+// decode splits a record into the values of l, trimmed, checking each.
+func decode(record string, l layout) (map[string]string, []FieldError) {
+	values := make(map[string]string, len(l))
+	var errs []FieldError
+	pos := 1
+	for _, f := range l {
+		v := strings.TrimSpace(record[pos : pos+f.length])
+		pos += f.length
+		if f.kind == numeric && strings.Trim(v, "0") == "" && !f.required {
+			v = ""
+		}
+		switch {
+		case v == "" && f.required:
+			errs = append(errs, FieldError{f.name, "required"})
+		case v != "":
+			if msg := check(f, v); msg != "" {
+				errs = append(errs, FieldError{f.name, msg})
+			}
+		}
+		values[f.name] = v
+	}
+	return values, errs
+}
+
+// toASCII uppercases a value and removes the accents, as the records only
+// hold ASCII: "Niccolò D'Amico" is "NICCOLO D'AMICO".
+func toASCII(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		switch {
+		case unicode.Is(unicode.Mn, r): // Combining accents
+		case r == '’' || r == '`':
+			b.WriteByte('\'')
+		case r < ' ' || r > '~':
+			b.WriteByte(' ')
+		default:
+			b.WriteRune(unicode.ToUpper(r))
+		}
+	}
+	return b.String()
+}
+
+// Record is a detail record of a flow file, by field name.
+type Record struct {
+	Line   int               `json:"line"`
+	Values map[string]string `json:"values"`
+}
+
+// LineError is a record that does not follow its layout.
+type LineError struct {
+	Line int `json:"line"`
+	FieldError
+}
+
+// Parse reads a flow file of the given flow, validating every record
+// against its layout. The records are returned even when some are invalid,
+// so that the valid ones can still be used.
+func Parse(flow string, data []byte) (header map[string]string, records []Record, errs []LineError) {
+	detail, ok := detailLayouts[flow]
+	if !ok {
+		return nil, nil, []LineError{{0, FieldError{"flow", fmt.Sprintf("unknown flow %q", flow)}}}
+	}
+	lines := strings.Split(strings.TrimRight(string(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))), "\r\n"), "\n")
+	fail := func(line int, name, format string, args ...interface{}) {
+		errs = append(errs, LineError{line, FieldError{name, fmt.Sprintf(format, args...)}})
+	}
+
+	var trailer map[string]string
+	trailerLine := 0
+	for i, line := range lines {
+		n := i + 1
+		line = strings.TrimSuffix(line, "\r")
+		if len(line) != recordLength {
+			fail(n, "record", "%d characters instead of %d", len(line), recordLength)
+			continue
+		}
+		var l layout
+		switch line[0] {
+		case recordHeader:
+			if n != 1 {
+				fail(n, "record", "header after the first line")
+				continue
+			}
+			l = headerLayout
+		case recordDetail:
+			l = detail
+		case recordTrailer:
+			l = trailerLayout
+		default:
+			fail(n, "record", "unknown record type %q", line[0])
+			continue
+		}
+		values, ferrs := decode(line, l)
+		for _, e := range ferrs {
+			errs = append(errs, LineError{n, e})
+		}
+		switch line[0] {
+		case recordHeader:
+			header = values
+		case recordDetail:
+			if header == nil || trailer != nil {
+				fail(n, "record", "detail outside of the header and trailer")
+			}
+			records = append(records, Record{Line: n, Values: values})
+		case recordTrailer:
+			trailer, trailerLine = values, n
+		}
+	}
+
+	switch {
+	case header == nil:
+		fail(1, "record", "missing header")
+	case header["flow"] != flow:
+		fail(1, "flow", "%q instead of %q", header["flow"], flow)
+	}
+	switch {
+	case trailer == nil:
+		fail(len(lines), "record", "missing trailer")
+	case trailerLine != len(lines):
+		fail(trailerLine, "record", "trailer before the last line")
+	case trailer["flow"] != flow:
+		fail(trailerLine, "flow", "%q instead of %q", trailer["flow"], flow)
+	case declared(trailer) != len(records):
+		fail(trailerLine, "records", "%d records declared, %d found", declared(trailer), len(records))
+	}
+	return header, records, errs
+}
+
+// declared returns the count of detail records of a trailer.
+func declared(trailer map[string]string) int {
+	n, _ := strconv.Atoi(trailer["records"])
+	return n
+}
@@ -0,0 +1,68 @@
+package sidi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayoutsFitRecord(t *testing.T) {
+	assert.LessOrEqual(t, headerLayout.width(), recordLength)
+	assert.LessOrEqual(t, trailerLayout.width(), recordLength)
+	for flow, l := range detailLayouts {
+		assert.LessOrEqual(t, l.width(), recordLength, flow)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	cases := []struct {
+		field field
+		value string
+		want  string
+		err   string
+	}{
+		{field{"name", alpha, 10, true}, "Niccolò", "NICCOLO   ", ""},
+		{field{"name", alpha, 10, true}, "D’Amico", "D'AMICO   ", ""},
+		{field{"name", alpha, 3, true}, "Rossi", "", "longer than 3"},
+		{field{"name", alpha, 3, true}, "  ", "", "required"},
+		{field{"code", alpha, 3, false}, "", "   ", ""},
+		{field{"days", numeric, 3, true}, "7", "007", ""},
+		{field{"days", numeric, 3, false}, "", "000", ""},
+		{field{"days", numeric, 3, true}, "-1", "", "not a number"},
+		{field{"born", date, 8, true}, "31022010", "", "not a DDMMYYYY date"},
+		{field{"born", date, 8, true}, "28022010", "28022010", ""},
+		{field{"tax_code", taxCode, 16, true}, "BNCGLI11B41H501X", "BNCGLI11B41H501X", ""},
+		{field{"tax_code", taxCode, 16, true}, "bncgli11b41h501x", "", "not a tax code"},
+	}
+	for _, c := range cases {
+		got, err := format(c.field, c.value)
+		if c.err != "" {
+			assert.ErrorContains(t, err, c.err, c.value)
+			continue
+		}
+		require.NoError(t, err, c.value)
+		assert.Equal(t, c.want, got)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	_, records, errs := Parse(FlowEnrollment, readTestdata(t, "enrollment_invalid.txt"))
+	assert.Len(t, records, 2)
+	got := make([]LineError, len(errs))
+	for i, e := range errs {
+		got[i] = LineError{Line: e.Line, FieldError: FieldError{Field: e.Field}}
+	}
+	assert.Equal(t, []LineError{
+		{2, FieldError{Field: "birth_date"}},
+		{3, FieldError{Field: "tax_code"}},
+		{3, FieldError{Field: "grade"}},
+		{4, FieldError{Field: "record"}}, // Too short
+		{5, FieldError{Field: "records"}},
+	}, got)
+
+	_, _, errs = Parse("XYZ", nil)
+	assert.Len(t, errs, 1)
+	_, _, errs = Parse(FlowEnrollment, []byte(""))
+	assert.NotEmpty(t, errs)
+}
@@ -0,0 +1,465 @@
+package sidi
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+)
+
+const (
+	// MaxFileSize is the largest flow file read, well above a large school.
+	MaxFileSize   = 10 << 20
+	maxCredits    = 15  // Crediti scolastici of a single year
+	maxFinalScore = 100 // Of the state exam
+	// resultAccepted is the result of a return record accepted by the registry.
+	resultAccepted = "00"
+)
+
+var (
+	ErrUnknownFlow    = errors.New("unknown SIDI flow")
+	ErrInvalidYear    = errors.New("invalid academic year")
+	ErrSchoolNotFound = errors.New("school not found")
+	ErrInvalidOutcome = errors.New("invalid outcome")
+	ErrInvalidFile    = errors.New("invalid SIDI file")
+)
+
+// Codes of the enrollment status, outcome and frequency status fields.
+var (
+	enrollmentStatusCodes = map[domain.EnrollmentStatus]string{
+		domain.EnrollmentActive:      "IS", // Iscritto
+		domain.EnrollmentTransferred: "TR", // Trasferito
+		domain.EnrollmentGraduated:   "CO", // Ciclo concluso
+	}
+	outcomeCodes = map[domain.ScrutinyOutcome]string{
+		domain.OutcomeAdmitted:     "AM",
+		domain.OutcomeNotAdmitted:  "NA",
+		domain.OutcomeSuspended:    "SG",
+		domain.OutcomeGraduated:    "DI",
+		domain.OutcomeNotGraduated: "ND",
+	}
+)
+
+var yearPattern = regexp.MustCompile(`^(\d{4})[-/](\d{2}|\d{4})$`)
+
+// academicYear parses a year as "2025-26", returning its first calendar year
+// and the days it runs, from the 1st of September to the 31st of August.
+func academicYear(year string) (start int, from, to time.Time, err error) {
+	m := yearPattern.FindStringSubmatch(strings.TrimSpace(year))
+	if m == nil {
+		return 0, from, to, fmt.Errorf("%w: %q", ErrInvalidYear, year)
+	}
+	start, _ = strconv.Atoi(m[1])
+	end, _ := strconv.Atoi(m[2])
+	if end%100 != (start+1)%100 || (len(m[2]) == 4 && end != start+1) {
+		return 0, from, to, fmt.Errorf("%w: %q", ErrInvalidYear, year)
+	}
+	from = time.Date(start, time.September, 1, 0, 0, 0, 0, time.UTC)
+	to = time.Date(start+1, time.August, 31, 0, 0, 0, 0, time.UTC)
+	return start, from, to, nil
+}
+
+// ValidateYear checks an academic year given as "2025-26".
+func ValidateYear(year string) error {
+	_, _, _, err := academicYear(year)
+	return err
+}
+
+// CurrentYear returns the academic year running at t.
+func CurrentYear(t time.Time) string {
+	start := t.Year()
+	if t.Month() < time.September {
+		start--
+	}
+	return fmt.Sprintf("%d-%02d", start, (start+1)%100)
+}
+
+// Flow is a flow file built for the registry.
+type Flow struct {
+	Name    string
+	Data    []byte
+	Records int
+	// Skipped are the students left out of the file, with the reason.
+	Skipped []Problem
+}
+
+// Problem is a student whose data does not fit a flow.
+type Problem struct {
+	StudentID uint   `json:"student_id"`
+	Student   string `json:"student"`
+	FieldError
+}
+
+// OutcomeInput is the outcome of a student's final scrutiny.
+type OutcomeInput struct {
+	StudentID  uint                   `json:"student_id" binding:"required"`
+	Outcome    domain.ScrutinyOutcome `json:"outcome" binding:"required"`
+	Credits    int                    `json:"credits"`
+	FinalScore int                    `json:"final_score"`
+	DecidedAt  time.Time              `json:"decided_at" binding:"required"`
+}
+
+// Validation is the result of checking a flow file against its layout.
+type Validation struct {
+	Flow    string      `json:"flow"`
+	Records int         `json:"records"`
+	Valid   bool        `json:"valid"`
+	Errors  []LineError `json:"errors"`
+}
+
+// Rejection is a record the registry refused, as told by a return file.
+type Rejection struct {
+	Line    int    `json:"line"`
+	TaxCode string `json:"tax_code"`
+	Flow    string `json:"flow"`
+	Result  string `json:"result"`
+	Message string `json:"message"`
+}
+
+// ReturnReport is what importing a return file changed.
+type ReturnReport struct {
+	Updated   int         `json:"updated"`
+	Unchanged int         `json:"unchanged"`
+	Rejected  []Rejection `json:"rejected"`
+	// Unknown are the accepted tax codes of no student of the school.
+	Unknown []string    `json:"unknown"`
+	Errors  []LineError `json:"errors"`
+}
+
+type SIDIService struct {
+	repo domain.SIDIRepository
+	now  func() time.Time
+}
+
+func NewSIDIService(repo domain.SIDIRepository) *SIDIService {
+	return &SIDIService{repo: repo, now: time.Now}
+}
+
+// BuildFlow writes the flow file of the school for an academic year.
+// Students whose data does not fit the layout are left out and reported,
+// so that the rest of the school can be sent while their data is fixed.
+func (s *SIDIService) BuildFlow(schoolID uint, flow, year string) (*Flow, error) {
+	if _, ok := detailLayouts[flow]; !ok || flow == FlowReturn {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownFlow, flow)
+	}
+	start, from, to, err := academicYear(year)
+	if err != nil {
+		return nil, err
+	}
+	school, err := s.repo.GetSchoolByID(schoolID)
+	if err != nil {
+		return nil, err
+	}
+	if school == nil {
+		return nil, ErrSchoolNotFound
+	}
+	enrollments, err := s.repo.GetEnrollments(schoolID, year)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	var details func(e domain.EnrolledStudent) ([]string, error)
+	switch flow {
+	case FlowEnrollment:
+		details = func(e domain.EnrolledStudent) ([]string, error) {
+			return enrollmentValues(school, e, from)
+		}
+	case FlowFrequency:
+		totals, err := s.repo.GetAbsenceTotals(schoolID, from, to)
+		if err != nil {
+			return nil, err
+		}
+		byStudent := make(map[uint]domain.AbsenceTotals, len(totals))
+		for _, t := range totals {
+			byStudent[t.StudentID] = t
+		}
+		// Attendance up to today while the year is running
+		reference := to
+		if now.Before(reference) {
+			reference = now
+		}
+		details = func(e domain.EnrolledStudent) ([]string, error) {
+			return frequencyValues(school, e, byStudent[e.Student.ID], reference), nil
+		}
+	case FlowOutcome:
+		outcomes, err := s.repo.GetOutcomes(schoolID, year)
+		if err != nil {
+			return nil, err
+		}
+		byStudent := make(map[uint]domain.StudentOutcome, len(outcomes))
+		for _, o := range outcomes {
+			byStudent[o.StudentID] = o
+		}
+		details = func(e domain.EnrolledStudent) ([]string, error) {
+			o, ok := byStudent[e.Student.ID]
+			if !ok || o.ClassID != e.Class.ID {
+				return nil, FieldError{"outcome", "no outcome recorded"}
+			}
+			return outcomeValues(school, e, o), nil
+		}
+	}
+
+	header, err := encode(recordHeader, headerLayout, []string{
+		flow, school.Code, strconv.Itoa(start), now.Format("02012006"), "1",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: school %s", ErrInvalidFile, err)
+	}
+	lines := []string{header}
+	result := &Flow{Name: fmt.Sprintf("%s_%s_%d_%s.txt", toASCII(school.Code), flow, start, now.Format("20060102"))}
+	for _, e := range enrollments {
+		// Outcomes are only due for the students still in the class
+		if flow == FlowOutcome && e.Enrollment.Status == domain.EnrollmentTransferred {
+			continue
+		}
+		values, err := details(e)
+		var record string
+		if err == nil {
+			record, err = encode(recordDetail, detailLayouts[flow], values)
+		}
+		if err != nil {
+			var fe FieldError
+			if !errors.As(err, &fe) {
+				return nil, err
+			}
+			result.Skipped = append(result.Skipped, Problem{e.Student.ID, e.Student.LastName + " " + e.Student.FirstName, fe})
+			continue
+		}
+		lines = append(lines, record)
+	}
+	result.Records = len(lines) - 1
+	trailer, err := encode(recordTrailer, trailerLayout, []string{flow, strconv.Itoa(result.Records)})
+	if err != nil {
+		return nil, err
+	}
+	lines = append(lines, trailer)
+	result.Data = []byte(strings.Join(lines, "\r\n") + "\r\n")
+	return result, nil
+}
+
+func enrollmentValues(school *domain.School, e domain.EnrolledStudent, yearStart time.Time) ([]string, error) {
+	status, ok := enrollmentStatusCodes[e.Enrollment.Status]
+	if !ok {
+		return nil, FieldError{"status", fmt.Sprintf("unknown enrollment status %q", e.Enrollment.Status)}
+	}
+	gender := strings.ToUpper(strings.TrimSpace(e.Student.Gender))
+	switch gender {
+	case "MALE", "MASCHIO":
+		gender = "M"
+	case "FEMALE", "FEMMINA":
+		gender = "F"
+	}
+	if gender != "" && gender != "M" && gender != "F" {
+		return nil, FieldError{"gender", fmt.Sprintf("%q is neither M nor F", e.Student.Gender)}
+	}
+	// Enrollments saved without a date count from the start of the year
+	enrolled := e.Enrollment.EnrollmentDate
+	if enrolled.IsZero() {
+		enrolled = yearStart
+	}
+	return []string{
+		school.Code,
+		e.Student.SIDICode,
+		strings.ToUpper(e.Student.TaxCode),
+		e.Student.LastName,
+		e.Student.FirstName,
+		gender,
+		formatDate(e.Student.DateOfBirth),
+		e.Student.PlaceOfBirth,
+		e.Student.Citizenship,
+		strconv.Itoa(e.Class.Grade),
+		e.Class.Section,
+		formatDate(enrolled),
+		status,
+	}, nil
+}
+
+func frequencyValues(school *domain.School, e domain.EnrolledStudent, t domain.AbsenceTotals, reference time.Time) []string {
+	status := "F" // Frequentante
+	if e.Enrollment.Status == domain.EnrollmentTransferred {
+		status = "T"
+	}
+	return []string{
+		school.Code,
+		e.Student.SIDICode,
+		strings.ToUpper(e.Student.TaxCode),
+		strconv.Itoa(e.Class.Grade),
+		e.Class.Section,
+		formatDate(reference),
+		strconv.Itoa(t.Days),
+		strconv.Itoa(t.Hours),
+		strconv.Itoa(t.Late),
+		status,
+	}
+}
+
+func outcomeValues(school *domain.School, e domain.EnrolledStudent, o domain.StudentOutcome) []string {
+	values := []string{
+		school.Code,
+		e.Student.SIDICode,
+		strings.ToUpper(e.Student.TaxCode),
+		strconv.Itoa(e.Class.Grade),
+		e.Class.Section,
+		outcomeCodes[o.Outcome],
+		"",
+		"",
+		formatDate(o.DecidedAt),
+	}
+	if o.Credits > 0 {
+		values[6] = strconv.Itoa(o.Credits)
+	}
+	if o.FinalScore > 0 {
+		values[7] = strconv.Itoa(o.FinalScore)
+	}
+	return values
+}
+
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("02012006")
+}
+
+// RecordOutcomes saves the outcomes of the final scrutiny of students
+// enrolled in the school in the academic year, replacing earlier ones.
+// Nothing is saved unless every outcome is valid.
+func (s *SIDIService) RecordOutcomes(schoolID, userID uint, year string, inputs []OutcomeInput) error {
+	if _, _, _, err := academicYear(year); err != nil {
+		return err
+	}
+	enrollments, err := s.repo.GetEnrollments(schoolID, year)
+	if err != nil {
+		return err
+	}
+	classOf := make(map[uint]uint, len(enrollments))
+	for _, e := range enrollments {
+		if e.Enrollment.Status != domain.EnrollmentTransferred {
+			classOf[e.Student.ID] = e.Class.ID
+		}
+	}
+
+	outcomes := make([]domain.StudentOutcome, len(inputs))
+	for i, in := range inputs {
+		classID, ok := classOf[in.StudentID]
+		switch {
+		case !ok:
+			return fmt.Errorf("%w: student %d is not enrolled in %s", ErrInvalidOutcome, in.StudentID, year)
+		case outcomeCodes[in.Outcome] == "":
+			return fmt.Errorf("%w: unknown outcome %q", ErrInvalidOutcome, in.Outcome)
+		case in.Credits < 0 || in.Credits > maxCredits:
+			return fmt.Errorf("%w: credits must be between 0 and %d", ErrInvalidOutcome, maxCredits)
+		case in.FinalScore < 0 || in.FinalScore > maxFinalScore:
+			return fmt.Errorf("%w: final score must be between 0 and %d", ErrInvalidOutcome, maxFinalScore)
+		case in.DecidedAt.IsZero():
+			return fmt.Errorf("%w: the scrutiny date is required", ErrInvalidOutcome)
+		}
+		outcomes[i] = domain.StudentOutcome{
+			SchoolID:     schoolID,
+			StudentID:    in.StudentID,
+			ClassID:      classID,
+			AcademicYear: year,
+			Outcome:      in.Outcome,
+			Credits:      in.Credits,
+			FinalScore:   in.FinalScore,
+			DecidedAt:    in.DecidedAt,
+			RecordedBy:   userID,
+		}
+	}
+	for i := range outcomes {
+		if err := s.repo.UpsertOutcome(&outcomes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks a flow file against the record layout of its flow.
+func (s *SIDIService) Validate(flow string, data []byte) (*Validation, error) {
+	if _, ok := detailLayouts[flow]; !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownFlow, flow)
+	}
+	_, records, errs := Parse(flow, data)
+	return &Validation{Flow: flow, Records: len(records), Valid: len(errs) == 0, Errors: errs}, nil
+}
+
+// ImportReturn reads a return file of the registry, saving the student
+// codes it assigned to the students of the school and reporting the records
+// it refused. Records that do not follow the layout are reported and left
+// out; a file of another school is refused as a whole.
+func (s *SIDIService) ImportReturn(schoolID uint, data []byte) (*ReturnReport, error) {
+	school, err := s.repo.GetSchoolByID(schoolID)
+	if err != nil {
+		return nil, err
+	}
+	if school == nil {
+		return nil, ErrSchoolNotFound
+	}
+	header, records, errs := Parse(FlowReturn, data)
+	if header == nil {
+		return nil, fmt.Errorf("%w: missing header", ErrInvalidFile)
+	}
+	if header["school_code"] != toASCII(school.Code) {
+		return nil, fmt.Errorf("%w: the file is for school %s", ErrInvalidFile, header["school_code"])
+	}
+
+	report := &ReturnReport{Rejected: []Rejection{}, Unknown: []string{}, Errors: errs}
+	invalid := make(map[int]bool, len(errs))
+	for _, e := range errs {
+		invalid[e.Line] = true
+	}
+	accepted := make(map[string]string) // SIDI code by tax code
+	for _, r := range records {
+		v := r.Values
+		switch {
+		case invalid[r.Line]:
+		case v["school_code"] != header["school_code"]:
+			report.Errors = append(report.Errors, LineError{r.Line, FieldError{"school_code", fmt.Sprintf("%q is not the school of the file", v["school_code"])}})
+		case v["result"] != resultAccepted:
+			report.Rejected = append(report.Rejected, Rejection{r.Line, v["tax_code"], v["flow"], v["result"], v["message"]})
+		case v["sidi_code"] == "":
+			report.Errors = append(report.Errors, LineError{r.Line, FieldError{"sidi_code", "required when accepted"}})
+		default:
+			accepted[v["tax_code"]] = v["sidi_code"]
+		}
+	}
+
+	taxCodes := make([]string, 0, len(accepted))
+	for tc := range accepted {
+		taxCodes = append(taxCodes, tc)
+	}
+	sort.Strings(taxCodes)
+	students, err := s.repo.GetStudentsByTaxCodes(schoolID, taxCodes)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool, len(students))
+	for _, st := range students {
+		tc := strings.ToUpper(st.TaxCode)
+		found[tc] = true
+		code := accepted[tc]
+		if code == "" {
+			continue
+		}
+		if st.SIDICode == code {
+			report.Unchanged++
+			continue
+		}
+		if err := s.repo.UpdateStudentSIDICode(st.ID, code); err != nil {
+			return nil, err
+		}
+		report.Updated++
+	}
+	for _, tc := range taxCodes {
+		if !found[tc] {
+			report.Unknown = append(report.Unknown, tc)
+		}
+	}
+	return report, nil
+}
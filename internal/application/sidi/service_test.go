@@ -0,0 +1,234 @@
+package sidi
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryRegistry holds a school of three students in 2025-26.
+type memoryRegistry struct {
+	students    []domain.Student
+	enrollments []domain.EnrolledStudent
+	outcomes    []domain.StudentOutcome
+	updated     map[uint]string
+}
+
+func newMemoryRegistry() *memoryRegistry {
+	classA := domain.Class{ID: 1, SchoolID: 1, Grade: 1, Section: "A", Year: "2025-26"}
+	classB := domain.Class{ID: 2, SchoolID: 1, Grade: 3, Section: "B", Year: "2025-26"}
+	r := &memoryRegistry{
+		students: []domain.Student{
+			{ID: 1, SchoolID: 1, FirstName: "Giulia", LastName: "Bianchi", TaxCode: "BNCGLI11B41H501X", Gender: "F",
+				DateOfBirth: time.Date(2011, 2, 1, 0, 0, 0, 0, time.UTC), PlaceOfBirth: "Roma", Citizenship: "Italiana"},
+			{ID: 2, SchoolID: 1, FirstName: "Niccolò", LastName: "D’Amico", TaxCode: "dmcncc10a01h501z", Gender: "M",
+				DateOfBirth: time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC), PlaceOfBirth: "Forlì", SIDICode: "ST0000000002"},
+			{ID: 3, SchoolID: 1, FirstName: "Marco", LastName: "Rossi", TaxCode: "RSSMRC10",
+				DateOfBirth: time.Date(2010, 7, 15, 0, 0, 0, 0, time.UTC)},
+		},
+		updated: map[uint]string{},
+	}
+	r.enrollments = []domain.EnrolledStudent{
+		{Student: r.students[0], Class: classA, Enrollment: domain.ClassEnrollment{ID: 1, StudentID: 1, ClassID: 1, Year: "2025-26",
+			Status: domain.EnrollmentActive, EnrollmentDate: time.Date(2025, 9, 15, 0, 0, 0, 0, time.UTC)}},
+		{Student: r.students[1], Class: classB, Enrollment: domain.ClassEnrollment{ID: 2, StudentID: 2, ClassID: 2, Year: "2025-26",
+			Status: domain.EnrollmentTransferred}},
+		{Student: r.students[2], Class: classB, Enrollment: domain.ClassEnrollment{ID: 3, StudentID: 3, ClassID: 2, Year: "2025-26",
+			Status: domain.EnrollmentActive}},
+	}
+	return r
+}
+
+func (r *memoryRegistry) GetSchoolByID(id uint) (*domain.School, error) {
+	if id != 1 {
+		return nil, nil
+	}
+	return &domain.School{ID: 1, Code: "RMIC81500X", Name: "IC Via Roma"}, nil
+}
+
+func (r *memoryRegistry) GetEnrollments(schoolID uint, academicYear string) ([]domain.EnrolledStudent, error) {
+	return r.enrollments, nil
+}
+
+func (r *memoryRegistry) GetAbsenceTotals(schoolID uint, from, to time.Time) ([]domain.AbsenceTotals, error) {
+	return []domain.AbsenceTotals{{StudentID: 1, Days: 12, Hours: 7, Late: 3}}, nil
+}
+
+func (r *memoryRegistry) GetOutcomes(schoolID uint, academicYear string) ([]domain.StudentOutcome, error) {
+	return r.outcomes, nil
+}
+
+func (r *memoryRegistry) UpsertOutcome(outcome *domain.StudentOutcome) error {
+	for i, o := range r.outcomes {
+		if o.StudentID == outcome.StudentID && o.AcademicYear == outcome.AcademicYear {
+			r.outcomes[i] = *outcome
+			return nil
+		}
+	}
+	r.outcomes = append(r.outcomes, *outcome)
+	return nil
+}
+
+func (r *memoryRegistry) GetStudentsByTaxCodes(schoolID uint, taxCodes []string) ([]domain.Student, error) {
+	var found []domain.Student
+	for _, s := range r.students {
+		for _, tc := range taxCodes {
+			if strings.EqualFold(s.TaxCode, tc) {
+				found = append(found, s)
+			}
+		}
+	}
+	return found, nil
+}
+
+func (r *memoryRegistry) UpdateStudentSIDICode(studentID uint, code string) error {
+	r.updated[studentID] = code
+	return nil
+}
+
+func newTestService(repo domain.SIDIRepository) *SIDIService {
+	s := NewSIDIService(repo)
+	s.now = func() time.Time { return time.Date(2025, 10, 20, 9, 0, 0, 0, time.UTC) }
+	return s
+}
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return data
+}
+
+func TestAcademicYear(t *testing.T) {
+	start, from, to, err := academicYear("2025-26")
+	require.NoError(t, err)
+	assert.Equal(t, 2025, start)
+	assert.Equal(t, time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC), from)
+	assert.Equal(t, time.Date(2026, 8, 31, 0, 0, 0, 0, time.UTC), to)
+	_, _, _, err = academicYear("2025/2026")
+	assert.NoError(t, err)
+	_, _, _, err = academicYear("1999-00")
+	assert.NoError(t, err)
+
+	for _, year := range []string{"", "2025", "2025-27", "2025-2027", "25-26"} {
+		_, _, _, err := academicYear(year)
+		assert.ErrorIs(t, err, ErrInvalidYear, year)
+	}
+
+	assert.Equal(t, "2025-26", CurrentYear(time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC)))
+	assert.Equal(t, "2025-26", CurrentYear(time.Date(2026, 8, 31, 0, 0, 0, 0, time.UTC)))
+	assert.Equal(t, "2099-00", CurrentYear(time.Date(2100, 1, 10, 0, 0, 0, 0, time.UTC)))
+	assert.NoError(t, ValidateYear(CurrentYear(time.Now())))
+}
+
+func TestBuildEnrollmentFlow(t *testing.T) {
+	service := newTestService(newMemoryRegistry())
+
+	flow, err := service.BuildFlow(1, FlowEnrollment, "2025-26")
+	require.NoError(t, err)
+	assert.Equal(t, "RMIC81500X_ISC_2025_20251020.txt", flow.Name)
+	assert.Equal(t, 2, flow.Records)
+	assert.Equal(t, string(readTestdata(t, "enrollment_2025.txt")), string(flow.Data))
+	require.Len(t, flow.Skipped, 1)
+	assert.Equal(t, uint(3), flow.Skipped[0].StudentID)
+	assert.Equal(t, "tax_code", flow.Skipped[0].Field)
+
+	// What is written follows the layout
+	validation, err := service.Validate(FlowEnrollment, flow.Data)
+	require.NoError(t, err)
+	assert.True(t, validation.Valid, validation.Errors)
+
+	_, err = service.BuildFlow(1, FlowReturn, "2025-26")
+	assert.ErrorIs(t, err, ErrUnknownFlow)
+	_, err = service.BuildFlow(1, FlowEnrollment, "2025")
+	assert.ErrorIs(t, err, ErrInvalidYear)
+	_, err = service.BuildFlow(2, FlowEnrollment, "2025-26")
+	assert.ErrorIs(t, err, ErrSchoolNotFound)
+}
+
+func TestBuildFrequencyFlow(t *testing.T) {
+	repo := newMemoryRegistry()
+	repo.students[2].TaxCode = "RSSMRC10L15F205Y"
+	repo.enrollments[2].Student = repo.students[2]
+	service := newTestService(repo)
+
+	flow, err := service.BuildFlow(1, FlowFrequency, "2025-26")
+	require.NoError(t, err)
+	assert.Empty(t, flow.Skipped)
+	_, records, errs := Parse(FlowFrequency, flow.Data)
+	require.Empty(t, errs)
+	require.Len(t, records, 3)
+	assert.Equal(t, map[string]string{
+		"school_code": "RMIC81500X", "sidi_code": "", "tax_code": "BNCGLI11B41H501X", "grade": "1", "section": "A",
+		"reference_date": "20102025", "absence_days": "012", "absence_hours": "0007", "late_entries": "003", "status": "F",
+	}, records[0].Values)
+	assert.Equal(t, "T", records[1].Values["status"])
+	assert.Equal(t, "000", records[2].Values["absence_days"])
+}
+
+func TestOutcomeFlow(t *testing.T) {
+	repo := newMemoryRegistry()
+	service := newTestService(repo)
+	decided := time.Date(2026, 6, 10, 0, 0, 0, 0, time.UTC)
+
+	err := service.RecordOutcomes(1, 9, "2025-26", []OutcomeInput{{StudentID: 2, Outcome: domain.OutcomeAdmitted, DecidedAt: decided}})
+	assert.ErrorIs(t, err, ErrInvalidOutcome, "transferred")
+	err = service.RecordOutcomes(1, 9, "2025-26", []OutcomeInput{{StudentID: 1, Outcome: "PROMOSSO", DecidedAt: decided}})
+	assert.ErrorIs(t, err, ErrInvalidOutcome)
+	err = service.RecordOutcomes(1, 9, "2025-26", []OutcomeInput{
+		{StudentID: 1, Outcome: domain.OutcomeAdmitted, DecidedAt: decided},
+		{StudentID: 3, Outcome: domain.OutcomeAdmitted, Credits: 16, DecidedAt: decided},
+	})
+	assert.ErrorIs(t, err, ErrInvalidOutcome)
+	assert.Empty(t, repo.outcomes, "nothing saved unless all are valid")
+
+	require.NoError(t, service.RecordOutcomes(1, 9, "2025-26", []OutcomeInput{
+		{StudentID: 1, Outcome: domain.OutcomeSuspended, DecidedAt: decided},
+	}))
+	require.NoError(t, service.RecordOutcomes(1, 9, "2025-26", []OutcomeInput{
+		{StudentID: 1, Outcome: domain.OutcomeAdmitted, Credits: 9, DecidedAt: decided},
+	}))
+	require.Len(t, repo.outcomes, 1)
+	assert.Equal(t, uint(1), repo.outcomes[0].ClassID)
+	assert.Equal(t, uint(9), repo.outcomes[0].RecordedBy)
+
+	flow, err := service.BuildFlow(1, FlowOutcome, "2025-26")
+	require.NoError(t, err)
+	_, records, errs := Parse(FlowOutcome, flow.Data)
+	require.Empty(t, errs)
+	require.Len(t, records, 1)
+	assert.Equal(t, "AM", records[0].Values["outcome"])
+	assert.Equal(t, "09", records[0].Values["credits"])
+	assert.Equal(t, "", records[0].Values["final_score"])
+	assert.Equal(t, "10062026", records[0].Values["decision_date"])
+	// The transferred student is left out, the one without an outcome reported
+	require.Len(t, flow.Skipped, 1)
+	assert.Equal(t, uint(3), flow.Skipped[0].StudentID)
+}
+
+func TestImportReturn(t *testing.T) {
+	repo := newMemoryRegistry()
+	service := newTestService(repo)
+
+	report, err := service.ImportReturn(1, readTestdata(t, "return_2025.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Updated)
+	assert.Equal(t, "ST0000000001", repo.updated[1])
+	assert.Equal(t, 1, report.Unchanged)
+	assert.Equal(t, []string{"VRDLCU10C50H501K"}, report.Unknown)
+	require.Len(t, report.Rejected, 1)
+	assert.Equal(t, Rejection{Line: 5, TaxCode: "RSSMRC10L15F205Y", Flow: "ISC", Result: "12", Message: "DATA DI NASCITA NON COERENTE CON IL CODICE FISCALE"}, report.Rejected[0])
+	assert.Empty(t, report.Errors)
+
+	_, err = service.ImportReturn(1, []byte("not a flow file"))
+	assert.ErrorIs(t, err, ErrInvalidFile)
+	other := strings.Replace(string(readTestdata(t, "return_2025.txt")), "RMIC81500X", "MIIC80000A", 1)
+	_, err = service.ImportReturn(1, []byte(other))
+	assert.ErrorIs(t, err, ErrInvalidFile)
+}
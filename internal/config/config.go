@@ -10,10 +10,73 @@ import (
 )
 
 type Config struct {
-	Server   ServerConfig
-	Database DatabaseConfig
-	Log      LogConfig
-	Auth     AuthConfig
+	Server      ServerConfig
+	Database    DatabaseConfig
+	Log         LogConfig
+	Auth        AuthConfig
+	WebAuthn    WebAuthnConfig
+	Frontend    FrontendConfig
+	Mail        MailConfig
+	SMTP        SMTPConfig
+	WebPush     WebPushConfig
+	WebSocket   WebSocketConfig
+	Attachments AttachmentsConfig
+	Meetings    MeetingsConfig
+	Jobs        JobsConfig
+}
+
+type FrontendConfig struct {
+	URL string `mapstructure:"url"` // Base URL of the web app, used in links sent by email
+}
+
+// MailConfig selects the mailer: "smtp", "file" (one .eml per message in Dir)
+// or "console" (logged). When Driver is empty, smtp is used if SMTP.Host is
+// set and console otherwise.
+type MailConfig struct {
+	Driver string `mapstructure:"driver"`
+	From   string `mapstructure:"from"`
+	Dir    string `mapstructure:"dir"`
+}
+
+type SMTPConfig struct {
+	Host     string `mapstructure:"host"`
+	Port     string `mapstructure:"port"`
+	User     string `mapstructure:"user"`
+	Password string `mapstructure:"password"`
+}
+
+// WebPushConfig holds the VAPID key pair identifying the server to push
+// services, base64url encoded (generate one with cmd/vapidkeys). Web Push is
+// disabled when PrivateKey is empty. Subject is a mailto: or https: contact
+// for the push service operators.
+type WebPushConfig struct {
+	PublicKey  string `mapstructure:"public_key"`
+	PrivateKey string `mapstructure:"private_key"`
+	Subject    string `mapstructure:"subject"`
+}
+
+// WebSocketConfig selects how WebSocket events reach the clients connected to
+// other API replicas: "postgres" relays them with LISTEN/NOTIFY on Channel,
+// "none" keeps them on the node that emitted them (single replica only).
+type WebSocketConfig struct {
+	Backplane string `mapstructure:"backplane"`
+	Channel   string `mapstructure:"channel"`
+}
+
+// AttachmentsConfig limits message attachments and selects the virus scanner:
+// "clamav" streams each upload to clamd at ClamAVAddress (tcp://host:port or
+// unix:///path/to/clamd.sock), "none" stores files unscanned.
+type AttachmentsConfig struct {
+	MaxSize       int64  `mapstructure:"max_size"` // Bytes
+	Scanner       string `mapstructure:"scanner"`
+	ClamAVAddress string `mapstructure:"clamav_address"`
+}
+
+// MeetingsConfig selects the provider of the video meetings of online
+// colloquiums: "jitsi" creates rooms on the Jitsi Meet server at JitsiURL.
+type MeetingsConfig struct {
+	Provider string `mapstructure:"provider"`
+	JitsiURL string `mapstructure:"jitsi_url"`
 }
 
 type AuthConfig struct {
@@ -22,6 +85,35 @@ type AuthConfig struct {
 	RefreshDuration time.Duration `mapstructure:"refresh_duration"`
 }
 
+// WebAuthnConfig identifies the relying party for passkeys. RPOrigins is a
+// comma separated list of the frontend origins.
+type WebAuthnConfig struct {
+	RPID          string `mapstructure:"rp_id"`
+	RPDisplayName string `mapstructure:"rp_display_name"`
+	RPOrigins     string `mapstructure:"rp_origins"`
+}
+
+// Origins returns RPOrigins as a list.
+func (c WebAuthnConfig) Origins() []string {
+	var origins []string
+	for _, o := range strings.Split(c.RPOrigins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return origins
+}
+
+// JobsConfig tunes the background job scheduler of each replica:
+// Concurrency jobs run at once, due jobs are polled every PollInterval and a
+// job is leased to its worker for Lease. Finished jobs are kept for Retention.
+type JobsConfig struct {
+	Concurrency  int           `mapstructure:"concurrency"`
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	Lease        time.Duration `mapstructure:"lease"`
+	Retention    time.Duration `mapstructure:"retention"`
+}
+
 type ServerConfig struct {
 	Port string `mapstructure:"port"`
 	Mode string `mapstructure:"mode"`
@@ -56,6 +148,31 @@ func Load() (*Config, error) {
 	viper.SetDefault("auth.jwt_secret", "your-secret-key")
 	viper.SetDefault("auth.access_duration", "15m")
 	viper.SetDefault("auth.refresh_duration", "168h") // 7 days
+	viper.SetDefault("webauthn.rp_id", "localhost")
+	viper.SetDefault("webauthn.rp_display_name", "iRegistro")
+	viper.SetDefault("webauthn.rp_origins", "http://localhost:3000")
+	viper.SetDefault("frontend.url", "http://localhost:3000")
+	viper.SetDefault("mail.driver", "")
+	viper.SetDefault("mail.from", "iRegistro <no-reply@localhost>")
+	viper.SetDefault("mail.dir", "./storage/mail")
+	viper.SetDefault("smtp.host", "")
+	viper.SetDefault("smtp.port", "587")
+	viper.SetDefault("smtp.user", "")
+	viper.SetDefault("smtp.password", "")
+	viper.SetDefault("webpush.public_key", "")
+	viper.SetDefault("webpush.private_key", "")
+	viper.SetDefault("webpush.subject", "mailto:no-reply@localhost")
+	viper.SetDefault("websocket.backplane", "postgres")
+	viper.SetDefault("websocket.channel", "iregistro_ws")
+	viper.SetDefault("attachments.max_size", 10<<20)
+	viper.SetDefault("attachments.scanner", "none")
+	viper.SetDefault("attachments.clamav_address", "tcp://localhost:3310")
+	viper.SetDefault("meetings.provider", "jitsi")
+	viper.SetDefault("meetings.jitsi_url", "https://meet.jit.si")
+	viper.SetDefault("jobs.concurrency", 4)
+	viper.SetDefault("jobs.poll_interval", "5s")
+	viper.SetDefault("jobs.lease", "10m")
+	viper.SetDefault("jobs.retention", "168h") // 7 days
 
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
@@ -163,6 +163,10 @@ type Student struct {
 	TaxCode      string    `gorm:"size:16;uniqueIndex" json:"tax_code"`
 	Gender       string    `gorm:"size:10" json:"gender"`
 	Citizenship  string    `gorm:"size:100" json:"citizenship"`
+	SIDICode     string    `gorm:"column:sidi_code;size:20;index" json:"sidi_code,omitempty"` // Assigned by the ministry's student registry
+	UserID       *uint     `gorm:"index" json:"user_id,omitempty"`                            // The student's own login, if any
+	Parent1ID    *uint     `gorm:"column:parent_1_id;index" json:"parent_1_id,omitempty"`     // Parent users, alerted of absences
+	Parent2ID    *uint     `gorm:"column:parent_2_id;index" json:"parent_2_id,omitempty"`
 	CreatedAt    time.Time
 	UpdatedAt    time.Time
 }
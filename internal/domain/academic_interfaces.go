@@ -1,6 +1,9 @@
 package domain
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type AcademicRepository interface {
 	// School/Campus
@@ -15,18 +18,18 @@ type AcademicRepository interface {
 	CreateCurriculum(curriculum *Curriculum) error
 	GetCurriculumsBySchoolID(schoolID uint) ([]Curriculum, error)
 	CreateClass(class *Class) error
-	GetClassByID(id uint) (*Class, error)
+	GetClassByID(ctx context.Context, id uint) (*Class, error)
 	GetClassesBySchoolID(schoolID uint) ([]Class, error)
 
 	// Student
 	CreateStudent(student *Student) error
-	GetStudentByID(id uint) (*Student, error)
+	GetStudentByID(ctx context.Context, id uint) (*Student, error)
 	EnrollStudent(enrollment *ClassEnrollment) error
-	GetStudentsByClassID(classID uint, year string) ([]Student, error)
+	GetStudentsByClassID(ctx context.Context, classID uint, year string) ([]Student, error)
 
 	// Subject
 	CreateSubject(subject *Subject) error
-	GetSubjectByID(id uint) (*Subject, error)
+	GetSubjectByID(ctx context.Context, id uint) (*Subject, error)
 	GetSubjectsByIDs(ids []uint) ([]Subject, error) // Added
 	GetSubjects(schoolID uint) ([]Subject, error)   // Get all subjects for a school
 	AssignSubjectToClass(assignment *ClassSubjectAssignment) error
@@ -42,6 +45,7 @@ type AcademicRepository interface {
 	CreateAbsence(absence *Absence) error
 	GetAbsencesByStudentID(studentID uint, year string) ([]Absence, error)
 	GetAbsencesByClassID(classID uint, date time.Time) ([]Absence, error)
+	GetAbsencesBySchoolID(schoolID uint, date time.Time) ([]Absence, error)
 	UpdateAbsence(absence *Absence) error
 }
 
@@ -1,6 +1,9 @@
 package domain
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"time"
 )
 
@@ -29,29 +32,147 @@ type SchoolSettings struct {
 
 // --- Imports ---
 
+// Statuses of a UserImport: the file is validated in the background, then
+// imported once confirmed from its preview.
+const (
+	ImportValidating          = "VALIDATING"
+	ImportValidated           = "VALIDATED" // Preview ready, waiting for confirmation
+	ImportProcessing          = "PROCESSING"
+	ImportCompleted           = "COMPLETED"
+	ImportCompletedWithErrors = "COMPLETED_WITH_ERRORS"
+	ImportFailed              = "FAILED" // The file could not be read
+)
+
 type UserImport struct {
-	ID             uint      `gorm:"primaryKey" json:"id"`
-	SchoolID       uint      `gorm:"index;not null" json:"school_id"`
-	ImportFilePath string    `gorm:"size:255" json:"file_path"`
-	TotalUsers     int       `json:"total_users"`
-	ImportedUsers  int       `json:"imported_users"`
-	FailedUsers    int       `json:"failed_users"`
-	ErrorDetails   JSONMap   `gorm:"type:jsonb" json:"error_details"`
-	Status         string    `gorm:"size:50" json:"status"` // PENDING, PROCESSING, COMPLETED, FAILED
-	ImportedAt     time.Time `json:"imported_at"`
+	ID             uint    `gorm:"primaryKey" json:"id"`
+	SchoolID       uint    `gorm:"index;not null" json:"school_id"`
+	CreatedBy      uint    `gorm:"index" json:"created_by"`
+	FileName       string  `gorm:"size:255" json:"file_name"` // As uploaded
+	ImportFilePath string  `gorm:"size:255" json:"-"`
+	Format         string  `gorm:"size:10" json:"format"`     // csv, xlsx
+	Mapping        JSONMap `gorm:"type:jsonb" json:"mapping"` // Column header -> field
+	TotalUsers     int     `json:"total_users"`
+	ImportedUsers  int     `json:"imported_users"` // Created
+	UpdatedUsers   int     `json:"updated_users"`
+	FailedUsers    int     `json:"failed_users"`
+	// ErrorDetails maps the row numbers to their errors, or fatal_error to
+	// the reason the file could not be read.
+	ErrorDetails JSONMap        `gorm:"type:jsonb" json:"error_details"`
+	Preview      UserImportRows `gorm:"type:jsonb" json:"preview,omitempty"`
+	Status       string         `gorm:"size:50" json:"status"`
+	CreatedAt    time.Time      `json:"created_at"`
+	ConfirmedAt  *time.Time     `json:"confirmed_at,omitempty"`
+	ImportedAt   *time.Time     `json:"imported_at,omitempty"`
+}
+
+// UserImportRow is a row of an import as validated: what importing it does,
+// or why it cannot be imported.
+type UserImportRow struct {
+	Row     int      `json:"row"`    // In the file, the header being row 1
+	Action  string   `json:"action"` // create, update or skip
+	Role    Role     `json:"role"`
+	Name    string   `json:"name"`
+	TaxCode string   `json:"tax_code,omitempty"`
+	Email   string   `json:"email,omitempty"`
+	Class   string   `json:"class,omitempty"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+type UserImportRows []UserImportRow
+
+func (r UserImportRows) Value() (driver.Value, error) {
+	return json.Marshal(r)
+}
+
+func (r *UserImportRows) Scan(value interface{}) error {
+	if value == nil {
+		*r = nil
+		return nil
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+	return json.Unmarshal(b, r)
 }
 
 // --- Exports ---
 
+// Statuses of a DataExport.
+const (
+	ExportPending    = "PENDING"
+	ExportProcessing = "PROCESSING"
+	ExportReady      = "READY"
+	ExportFailed     = "FAILED" // Retried until the job gives up
+	ExportExpired    = "EXPIRED"
+)
+
 type DataExport struct {
-	ID          uint      `gorm:"primaryKey" json:"id"`
-	SchoolID    uint      `gorm:"index;not null" json:"school_id"`
-	ExportType  string    `gorm:"size:10" json:"export_type"` // CSV, JSON
-	RequestedBy uint      `gorm:"index" json:"requested_by"`
-	FilePath    string    `gorm:"size:255" json:"file_path"`
-	Status      string    `gorm:"size:50" json:"status"` // PENDING, READY, FAILED
-	CreatedAt   time.Time `json:"created_at"`
-	ExpiryDate  time.Time `json:"expiry_date"`
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	SchoolID     uint       `gorm:"index;not null" json:"school_id"`
+	ExportType   string     `gorm:"size:10" json:"export_type"`            // CSV, JSON, SIDI
+	AcademicYear string     `gorm:"size:9" json:"academic_year,omitempty"` // Of a SIDI export
+	RequestedBy  uint       `gorm:"index" json:"requested_by"`
+	FilePath     string     `gorm:"size:255" json:"-"`
+	Status       string     `gorm:"size:50" json:"status"`
+	Progress     int        `json:"progress"` // Percent of the sections written
+	Records      int        `json:"records"`
+	Size         int64      `json:"size"` // Of the file, in bytes
+	Error        string     `gorm:"size:255" json:"error,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty"`
+	ExpiryDate   time.Time  `gorm:"index" json:"expiry_date"`
+}
+
+// --- Onboarding ---
+
+// Statuses of a SchoolOnboarding and of its steps.
+const (
+	OnboardingCompleted = "COMPLETED"
+	OnboardingFailed    = "FAILED" // Nothing was created
+	StepDone            = "DONE"
+	StepFailed          = "FAILED"
+	StepSkipped         = "SKIPPED"
+)
+
+// SchoolOnboarding records the creation of a school by the onboarding
+// wizard and the result of each of its steps.
+type SchoolOnboarding struct {
+	ID          uint            `gorm:"primaryKey" json:"id"`
+	SchoolID    *uint           `gorm:"index" json:"school_id,omitempty"` // Nil when it failed
+	SchoolCode  string          `gorm:"size:50" json:"school_code"`
+	Template    string          `gorm:"size:50" json:"template"`
+	Status      string          `gorm:"size:50" json:"status"`
+	Steps       OnboardingSteps `gorm:"type:jsonb" json:"steps"`
+	Error       string          `gorm:"size:255" json:"error,omitempty"`
+	CreatedBy   uint            `gorm:"index" json:"created_by"`
+	CreatedAt   time.Time       `json:"created_at"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+}
+
+type OnboardingStep struct {
+	Name   string `json:"name"` // school, campuses, curriculum, subjects, accounts, settings, invitations
+	Status string `json:"status"`
+	IDs    []uint `json:"ids,omitempty"` // Of the records created
+	Detail string `json:"detail,omitempty"`
+}
+
+type OnboardingSteps []OnboardingStep
+
+func (s OnboardingSteps) Value() (driver.Value, error) {
+	return json.Marshal(s)
+}
+
+func (s *OnboardingSteps) Scan(value interface{}) error {
+	if value == nil {
+		*s = nil
+		return nil
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+	return json.Unmarshal(b, s)
 }
 
 // --- Interfaces ---
@@ -63,6 +184,8 @@ type AdminRepository interface {
 
 	// Settings
 	GetSchoolSettings(schoolID uint) ([]SchoolSettings, error)
+	// GetSchoolSettingsByKey returns the setting of every school that has it.
+	GetSchoolSettingsByKey(key string) ([]SchoolSettings, error)
 	UpsertSchoolSetting(setting *SchoolSettings) error
 
 	// Imports
@@ -74,4 +197,43 @@ type AdminRepository interface {
 	CreateDataExport(exp *DataExport) error
 	GetDataExport(id uint) (*DataExport, error)
 	UpdateDataExport(exp *DataExport) error
+	// GetExpiredDataExports returns the exports expired before before and
+	// not purged yet.
+	GetExpiredDataExports(before time.Time) ([]DataExport, error)
+}
+
+// ExportRepository reads every record of a school for the data exports,
+// calling fn with batches ordered by id.
+type ExportRepository interface {
+	ExportUsers(schoolID uint, fn func([]User) error) error
+	ExportStudents(schoolID uint, fn func([]Student) error) error
+	ExportClasses(schoolID uint, fn func([]Class) error) error
+	ExportSubjects(schoolID uint, fn func([]Subject) error) error
+	ExportEnrollments(schoolID uint, fn func([]ClassEnrollment) error) error
+	ExportMarks(schoolID uint, fn func([]Mark) error) error
+	ExportAbsences(schoolID uint, fn func([]Absence) error) error
+	// ExportDocuments returns the documents without their data.
+	ExportDocuments(schoolID uint, fn func([]Document) error) error
+}
+
+// OnboardingStore writes the records of a new school.
+type OnboardingStore interface {
+	CreateSchool(school *School) error
+	CreateCampus(campus *Campus) error
+	CreateCurriculum(curriculum *Curriculum) error
+	CreateSubject(subject *Subject) error
+	CreateUser(user *User) error
+	UpsertSchoolSetting(setting *SchoolSettings) error
+	CreateOnboarding(o *SchoolOnboarding) error
+}
+
+type OnboardingRepository interface {
+	OnboardingStore
+	// Onboard runs fn in a transaction with a store writing in it: nothing
+	// is saved unless fn returns nil.
+	Onboard(fn func(store OnboardingStore) error) error
+	UpdateOnboarding(o *SchoolOnboarding) error
+	GetOnboarding(id uint) (*SchoolOnboarding, error)
+	GetOnboardings(limit, offset int) ([]SchoolOnboarding, error)
+	SchoolCodeExists(code string) (bool, error)
 }
@@ -0,0 +1,41 @@
+package domain
+
+import "time"
+
+// AnnouncementScope is the audience an announcement targets.
+type AnnouncementScope string
+
+const (
+	ScopeClass  AnnouncementScope = "CLASS"  // TargetID is a class
+	ScopeGrade  AnnouncementScope = "GRADE"  // TargetID is a grade, 1 to 5
+	ScopeCampus AnnouncementScope = "CAMPUS" // TargetID is a campus
+	ScopeSchool AnnouncementScope = "SCHOOL" // The whole school
+)
+
+// Announcement is a communication from the school to the families of a class,
+// grade, campus or of the whole school, whose reading each recipient
+// confirms. It is posted as the first message of a class conversation, where
+// recipients may reply unless replies are disabled.
+type Announcement struct {
+	ID              uint              `gorm:"primaryKey" json:"id"`
+	SchoolID        uint              `gorm:"index;not null" json:"school_id"`
+	AuthorID        uint              `gorm:"index;not null" json:"author_id"`
+	ConversationID  uint              `gorm:"index" json:"conversation_id"`
+	Scope           AnnouncementScope `gorm:"size:20;not null" json:"scope"`
+	TargetID        uint              `json:"target_id,omitempty"`
+	Title           string            `gorm:"size:255;not null" json:"title"`
+	Body            string            `gorm:"type:text;not null" json:"body"`
+	AllowReplies    bool              `gorm:"default:true" json:"allow_replies"`
+	IncludeStudents bool              `gorm:"default:false" json:"include_students"` // Students with an account receive it besides their parents
+	RecipientCount  int               `json:"recipient_count"`
+	LastReminderAt  *time.Time        `json:"last_reminder_at,omitempty"`
+	CreatedAt       time.Time         `json:"created_at"`
+}
+
+// AnnouncementRecipient tracks whether a recipient read an announcement.
+type AnnouncementRecipient struct {
+	AnnouncementID uint       `gorm:"primaryKey" json:"announcement_id"`
+	UserID         uint       `gorm:"primaryKey;index" json:"user_id"`
+	ReadAt         *time.Time `json:"read_at,omitempty"`
+	RemindedAt     *time.Time `json:"reminded_at,omitempty"`
+}
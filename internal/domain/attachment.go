@@ -0,0 +1,35 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+// Attachment is a file uploaded to be sent with a message. Files are stored
+// by content, so identical uploads share the same StoragePath. Until the
+// message is sent only the uploader can read it.
+type Attachment struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	SchoolID    uint      `gorm:"index" json:"school_id"`
+	UploaderID  uint      `gorm:"index;not null" json:"uploader_id"`
+	MessageID   *uint     `gorm:"index" json:"message_id,omitempty"` // Set when the message is sent
+	SHA256      string    `gorm:"size:64;index;not null" json:"sha256"`
+	FileName    string    `gorm:"size:255;not null" json:"file_name"`
+	MimeType    string    `gorm:"size:100;not null" json:"mime_type"`
+	Size        int64     `gorm:"not null" json:"size"`
+	StoragePath string    `gorm:"size:512;not null" json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ScanResult is the verdict of a virus scanner.
+type ScanResult struct {
+	Infected  bool
+	Signature string // Name of the threat found, if any
+}
+
+// VirusScanner checks uploaded files before they are stored. An error means
+// the file could not be scanned. Implementations live in
+// infrastructure/scanner.
+type VirusScanner interface {
+	Scan(ctx context.Context, data []byte) (*ScanResult, error)
+}
@@ -19,11 +19,42 @@ type Session struct {
 }
 
 type RefreshToken struct {
-	ID        uint       `gorm:"primaryKey" json:"id"`
-	UserID    uint       `gorm:"index;not null" json:"user_id"`
-	User      User       `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
-	TokenHash string     `gorm:"uniqueIndex;not null" json:"-"`
-	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
-	RevokedAt *time.Time `json:"revoked_at,omitempty"`
-	CreatedAt time.Time  `json:"created_at"`
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"index;not null" json:"user_id"`
+	User       User       `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+	TokenHash  string     `gorm:"uniqueIndex;not null" json:"-"`
+	AuthMethod string     `gorm:"size:20" json:"auth_method"`  // Method of the login the token descends from
+	AuthLevel  int        `gorm:"default:0" json:"auth_level"` // SPID level of that login
+	ExpiresAt  time.Time  `gorm:"not null" json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// PasswordResetToken is a single-use password reset link. The token sent by
+// email is "<selector>.<verifier>": the selector finds the row, the verifier is
+// only stored as a SHA-256 hash and compared in constant time.
+type PasswordResetToken struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	UserID       uint       `gorm:"index;not null" json:"user_id"`
+	User         User       `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+	Selector     string     `gorm:"size:32;uniqueIndex;not null" json:"-"`
+	VerifierHash string     `gorm:"size:64;not null" json:"-"`
+	IPAddress    string     `gorm:"size:45" json:"ip_address"` // Address that requested the reset
+	ExpiresAt    time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt       *time.Time `json:"used_at,omitempty"`
+	CreatedAt    time.Time  `gorm:"index" json:"created_at"`
+}
+
+// AuthAuditLog records every authentication attempt (GDPR accountability).
+// Backed by the auth_audit_logs table introduced with SPID/CIE support.
+type AuthAuditLog struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	UserID        *uint     `gorm:"index" json:"user_id,omitempty"`
+	AuthMethod    string    `gorm:"size:20;not null" json:"auth_method"`
+	Provider      string    `gorm:"size:50" json:"provider"`
+	IPAddress     string    `gorm:"size:45" json:"ip_address"`
+	UserAgent     string    `gorm:"type:text" json:"user_agent"`
+	Success       bool      `gorm:"not null" json:"success"`
+	FailureReason string    `gorm:"type:text" json:"failure_reason,omitempty"`
+	CreatedAt     time.Time `gorm:"index" json:"created_at"`
 }
@@ -0,0 +1,89 @@
+package domain
+
+import "time"
+
+// CalendarToken is a secret giving read access to the iCalendar feed of a
+// user, for calendar apps that cannot log in. Only its SHA-256 is stored.
+type CalendarToken struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"index;not null" json:"user_id"`
+	Name       string     `gorm:"size:100" json:"name"` // e.g. the device
+	TokenHash  string     `gorm:"size:64;uniqueIndex;not null" json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Homework is an assignment of a teacher to a class, due on DueDate.
+type Homework struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	SchoolID    uint      `gorm:"index;not null" json:"school_id"`
+	ClassID     uint      `gorm:"index;not null" json:"class_id"`
+	SubjectID   uint      `gorm:"index;not null" json:"subject_id"`
+	TeacherID   uint      `gorm:"index;not null" json:"teacher_id"`
+	Title       string    `gorm:"size:255;not null" json:"title"`
+	Description string    `gorm:"type:text" json:"description"`
+	DueDate     time.Time `gorm:"type:date;index;not null" json:"due_date"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// SchoolEvent is an entry of the school calendar: holidays, assemblies,
+// trips. A nil ClassID concerns the whole school.
+type SchoolEvent struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	SchoolID    uint      `gorm:"index;not null" json:"school_id"`
+	ClassID     *uint     `gorm:"index" json:"class_id,omitempty"`
+	Title       string    `gorm:"size:255;not null" json:"title"`
+	Description string    `gorm:"type:text" json:"description"`
+	Location    string    `gorm:"size:255" json:"location"`
+	StartsAt    time.Time `gorm:"index;not null" json:"starts_at"`
+	EndsAt      time.Time `gorm:"not null" json:"ends_at"`
+	AllDay      bool      `json:"all_day"` // Only the dates of StartsAt and EndsAt count
+	CreatedBy   uint      `gorm:"not null" json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// CalendarEvent is an event of an iCalendar feed.
+type CalendarEvent struct {
+	UID         string
+	Summary     string
+	Description string
+	Location    string
+	Start       time.Time
+	End         time.Time
+	AllDay      bool // End is the day after the last one
+	// Weekly repeats the event every week until Until, or forever when nil.
+	Weekly bool
+	Until  *time.Time
+}
+
+type CalendarRepository interface {
+	CreateCalendarToken(token *CalendarToken) error
+	// GetCalendarTokenByHash returns nil if there is no such token, revoked
+	// or not.
+	GetCalendarTokenByHash(hash string) (*CalendarToken, error)
+	GetCalendarTokensByUserID(userID uint) ([]CalendarToken, error)
+	// RevokeCalendarToken reports false if userID has no such active token.
+	RevokeCalendarToken(id, userID uint, at time.Time) (bool, error)
+	TouchCalendarToken(id uint, at time.Time) error
+
+	CreateHomework(homework *Homework) error
+	// GetHomework returns the homework due from..to for classIDs, or set by
+	// teacherID when it is not zero.
+	GetHomework(classIDs []uint, teacherID uint, from, to time.Time) ([]Homework, error)
+	CreateSchoolEvent(event *SchoolEvent) error
+	// GetSchoolEvents returns the events of the school overlapping from..to,
+	// school-wide or of classIDs.
+	GetSchoolEvents(schoolID uint, classIDs []uint, from, to time.Time) ([]SchoolEvent, error)
+	// GetSchedules returns the timetables of the school's classes still
+	// valid at at, including the ones starting later.
+	GetSchedules(schoolID uint, at time.Time) ([]Schedule, error)
+	// GetTeacherColloquiums returns the slots of teacherID dated from..to
+	// with confirmed bookings, which are preloaded.
+	GetTeacherColloquiums(teacherID uint, from, to time.Time) ([]ColloquiumSlot, error)
+	// GetParentColloquiums returns the confirmed bookings of parentID in
+	// slots dated from..to, with their slot.
+	GetParentColloquiums(parentID uint, from, to time.Time) ([]ColloquiumBooking, error)
+}
@@ -1,6 +1,7 @@
 package domain
 
 import (
+	"context"
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
@@ -13,11 +14,12 @@ type NotificationType string
 type NotificationChannel string
 
 const (
-	NotifTypeGrade      NotificationType = "GRADE"
-	NotifTypeAbsence    NotificationType = "ABSENCE"
-	NotifTypeGeneral    NotificationType = "GENERAL"
-	NotifTypeColloquium NotificationType = "COLLOQUIUM"
-	NotifTypeSystem     NotificationType = "SYSTEM"
+	NotifTypeGrade        NotificationType = "GRADE"
+	NotifTypeAbsence      NotificationType = "ABSENCE"
+	NotifTypeGeneral      NotificationType = "GENERAL"
+	NotifTypeColloquium   NotificationType = "COLLOQUIUM"
+	NotifTypeSystem       NotificationType = "SYSTEM"
+	NotifTypeAnnouncement NotificationType = "ANNOUNCEMENT"
 
 	ChannelEmail NotificationChannel = "EMAIL"
 	ChannelSMS   NotificationChannel = "SMS"
@@ -26,22 +28,80 @@ const (
 )
 
 type Notification struct {
-	ID         uint                `gorm:"primaryKey" json:"id"`
-	UserID     uint                `gorm:"index;not null" json:"user_id"`
-	Type       NotificationType    `gorm:"size:50;not null" json:"type"`
-	Title      string              `gorm:"size:255;not null" json:"title"`
-	Body       string              `gorm:"type:text;not null" json:"body"`
-	Data       JSONMap             `gorm:"type:jsonb" json:"data"` // e.g., {"grade_id": 123}
-	Channel    NotificationChannel `gorm:"size:50" json:"channel"`
-	IsRead     bool                `gorm:"default:false" json:"is_read"`
-	IsArchived bool                `gorm:"default:false" json:"is_archived"`
-	CreatedAt  time.Time           `json:"created_at"`
+	ID          uint                `gorm:"primaryKey" json:"id"`
+	UserID      uint                `gorm:"index;not null" json:"user_id"`
+	Type        NotificationType    `gorm:"size:50;not null" json:"type"`
+	Title       string              `gorm:"size:255;not null" json:"title"`
+	Body        string              `gorm:"type:text;not null" json:"body"`
+	Data        JSONMap             `gorm:"type:jsonb" json:"data"` // e.g., {"grade_id": 123}
+	Channel     NotificationChannel `gorm:"size:50" json:"channel"`
+	IsRead      bool                `gorm:"default:false" json:"is_read"`
+	IsArchived  bool                `gorm:"default:false" json:"is_archived"`
+	DeliveredAt *time.Time          `json:"delivered_at,omitempty"` // Acknowledged by a connected client
+	CreatedAt   time.Time           `json:"created_at"`
+
+	// Deliveries holds the status of each external channel the notification was sent to
+	Deliveries []NotificationDelivery `gorm:"foreignKey:NotificationID" json:"deliveries,omitempty"`
 }
 
 type NotificationPreference struct {
 	UserID   uint             `gorm:"primaryKey" json:"user_id"`
 	Type     NotificationType `gorm:"primaryKey;size:50" json:"type"`
-	Channels JSONStringArray  `gorm:"type:jsonb" json:"channels"` // e.g. ["EMAIL", "PUSH"]
+	Channels JSONStringArray  `gorm:"type:jsonb" json:"channels"`  // e.g. ["EMAIL", "PUSH"]
+	Digest   bool             `gorm:"default:false" json:"digest"` // Bundle the emails of this type into one daily digest
+}
+
+// NotificationSettings are the per-user delivery options shared by all
+// notification types. Times are "HH:MM" in the school's time zone.
+type NotificationSettings struct {
+	UserID          uint      `gorm:"primaryKey" json:"user_id"`
+	QuietHoursStart string    `gorm:"size:5" json:"quiet_hours_start"` // Empty = no quiet hours
+	QuietHoursEnd   string    `gorm:"size:5" json:"quiet_hours_end"`
+	DigestTime      string    `gorm:"size:5;default:'18:00'" json:"digest_time"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// DeliveryStatus is the state of a notification sent through an external channel.
+type DeliveryStatus string
+
+const (
+	DeliveryPending DeliveryStatus = "PENDING" // Waiting for the first attempt or a retry
+	DeliverySent    DeliveryStatus = "SENT"
+	DeliveryBounced DeliveryStatus = "BOUNCED" // Rejected by the recipient's server, not retried
+	DeliveryFailed  DeliveryStatus = "FAILED"  // Retries exhausted
+	DeliveryDigest  DeliveryStatus = "DIGEST"  // Waiting for the user's daily digest
+)
+
+// ErrDeliveryRejected is wrapped by senders when the recipient is permanently
+// rejected (e.g. SMTP 5xx): the delivery is marked as bounced, not retried.
+var ErrDeliveryRejected = errors.New("delivery rejected")
+
+// NotificationDelivery tracks a notification sent through an external channel
+// (email, SMS, push) to one recipient, including its retries.
+type NotificationDelivery struct {
+	ID             uint                `gorm:"primaryKey" json:"id"`
+	NotificationID uint                `gorm:"index;not null" json:"notification_id"`
+	UserID         uint                `gorm:"index;not null" json:"user_id"`
+	SchoolID       uint                `gorm:"index" json:"school_id"`
+	Channel        NotificationChannel `gorm:"size:50;not null" json:"channel"`
+	Recipient      string              `gorm:"size:255" json:"recipient"` // Email address, phone number...
+	Status         DeliveryStatus      `gorm:"size:20;not null;index" json:"status"`
+	Attempts       int                 `gorm:"default:0" json:"attempts"`
+	LastError      string              `gorm:"type:text" json:"last_error,omitempty"`
+	NextAttemptAt  *time.Time          `gorm:"index" json:"next_attempt_at,omitempty"`
+	SentAt         *time.Time          `json:"sent_at,omitempty"`
+	CreatedAt      time.Time           `json:"created_at"`
+	UpdatedAt      time.Time           `gorm:"index" json:"updated_at"`
+}
+
+// DeliveryAttempt is the delivery log: one row per send attempt.
+type DeliveryAttempt struct {
+	ID         uint           `gorm:"primaryKey" json:"id"`
+	DeliveryID uint           `gorm:"index;not null" json:"delivery_id"`
+	Attempt    int            `gorm:"not null" json:"attempt"`
+	Status     DeliveryStatus `gorm:"size:20;not null" json:"status"` // Outcome: SENT, PENDING (will retry), BOUNCED, FAILED
+	Error      string         `gorm:"type:text" json:"error,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
 }
 
 // --- Messaging ---
@@ -56,10 +116,13 @@ const (
 
 type Conversation struct {
 	ID             uint             `gorm:"primaryKey" json:"id"`
+	SchoolID       uint             `gorm:"index" json:"school_id"` // Every participant belongs to it
+	CreatedBy      uint             `json:"created_by"`
 	Type           ConversationType `gorm:"size:50;default:'ONE_TO_ONE'" json:"type"`
 	Subject        string           `gorm:"size:255" json:"subject"`         // For class comms
 	ClassID        *uint            `gorm:"index" json:"class_id,omitempty"` // Optional link to class
 	ParticipantIDs JSONUintArray    `gorm:"type:jsonb" json:"participant_ids"`
+	ReadOnly       bool             `gorm:"default:false" json:"read_only"` // Only the creator posts, e.g. announcements without replies
 	LastMessageAt  time.Time        `json:"last_message_at"`
 	CreatedAt      time.Time        `json:"created_at"`
 
@@ -71,17 +134,18 @@ type Message struct {
 	ConversationID uint         `gorm:"index;not null" json:"conversation_id"`
 	SenderID       uint         `gorm:"index;not null" json:"sender_id"`
 	Body           string       `gorm:"type:text;not null" json:"body"`
-	Attachments    JSONMapArray `gorm:"type:jsonb" json:"attachments"` // Array of {file_path, file_name, file_type}
+	Attachments    JSONMapArray `gorm:"type:jsonb" json:"attachments"` // Array of {attachment_id, file_name, file_type, size}
 	IsDeleted      bool         `gorm:"default:false" json:"is_deleted"`
 	EditedAt       *time.Time   `json:"edited_at,omitempty"`
 	CreatedAt      time.Time    `json:"created_at"`
 }
 
-// MessageAttachment helper struct for JSONB
-type MessageAttachment struct {
-	FilePath string `json:"file_path"`
-	FileName string `json:"file_name"`
-	FileType string `json:"file_type"`
+// ConversationRead is how far a participant has read a conversation.
+type ConversationRead struct {
+	ConversationID    uint      `gorm:"primaryKey" json:"conversation_id"`
+	UserID            uint      `gorm:"primaryKey" json:"user_id"`
+	LastReadMessageID uint      `gorm:"not null" json:"last_read_message_id"`
+	ReadAt            time.Time `json:"read_at"`
 }
 
 // --- Colloquiums ---
@@ -93,35 +157,84 @@ const (
 	ColloquiumGeneral    ColloquiumType = "GENERALE"
 )
 
+// ColloquiumMode is how a colloquium takes place.
+type ColloquiumMode string
+
+const (
+	ColloquiumInPerson ColloquiumMode = "PRESENZA"
+	ColloquiumOnline   ColloquiumMode = "ONLINE"   // Video meeting at MeetingURL
+	ColloquiumPhone    ColloquiumMode = "TELEFONO" // The teacher calls the parent
+)
+
 type ColloquiumSlot struct {
 	ID              uint           `gorm:"primaryKey" json:"id"`
 	TeacherID       uint           `gorm:"index;not null" json:"teacher_id"`
-	ClassID         *uint          `gorm:"index" json:"class_id,omitempty"` // Optional hint
+	ClassID         *uint          `gorm:"index" json:"class_id,omitempty"`       // Optional hint
+	MeetingDayID    *uint          `gorm:"index" json:"meeting_day_id,omitempty"` // Set for the slots of a general meeting day
 	Date            time.Time      `gorm:"type:date;not null" json:"date"`
 	StartTime       string         `gorm:"Type:varchar(5);not null" json:"start_time"` // HH:MM
 	EndTime         string         `gorm:"Type:varchar(5);not null" json:"end_time"`   // HH:MM
 	MaxParticipants int            `gorm:"default:1" json:"max_participants"`
 	Type            ColloquiumType `gorm:"default:'INDIVIDUA'" json:"type"`
-	IsAvailable     bool           `gorm:"default:true" json:"is_available"`
-	CreatedAt       time.Time      `json:"created_at"`
+	Mode            ColloquiumMode `gorm:"size:20;default:'PRESENZA'" json:"mode"`
+	// MeetingURL is the video meeting of online slots, shown only to the
+	// teacher and the parents booked.
+	MeetingURL  string     `gorm:"size:512" json:"-"`
+	IsAvailable bool       `gorm:"default:true" json:"is_available"`
+	CheckedInAt *time.Time `json:"checked_in_at,omitempty"` // When the teacher entered the waiting room
+	LateSentAt  *time.Time `json:"-"`                       // When the parents were told the teacher is late
+	// FollowUpSentAt is when, after the slot ended, the teacher was asked
+	// for the notes and the parents for feedback.
+	FollowUpSentAt *time.Time `json:"-"`
+	CreatedAt      time.Time  `json:"created_at"`
 
 	Bookings []ColloquiumBooking `gorm:"foreignKey:SlotID" json:"bookings,omitempty"`
 }
 
+// BookingStatus is the state of a colloquium booking. Bookings beyond the
+// capacity of a slot wait, in booking order, for a confirmed one to be
+// cancelled.
+type BookingStatus string
+
+const (
+	BookingConfirmed  BookingStatus = "CONFIRMED"
+	BookingWaitlisted BookingStatus = "WAITLISTED"
+	BookingCancelled  BookingStatus = "CANCELLED"
+)
+
+var (
+	// ErrSlotUnavailable is returned when booking a slot that is cancelled or past.
+	ErrSlotUnavailable = errors.New("slot is not available")
+	// ErrAlreadyBooked is returned when a parent books a slot twice for the same student.
+	ErrAlreadyBooked = errors.New("slot already booked for this student")
+)
+
 type ColloquiumBooking struct {
-	ID             uint      `gorm:"primaryKey" json:"id"`
-	SlotID         uint      `gorm:"index;not null" json:"slot_id"`
-	ParentID       uint      `gorm:"index;not null" json:"parent_id"`
-	StudentID      uint      `gorm:"index;not null" json:"student_id"`
-	BookedAt       time.Time `json:"booked_at"`
-	NotesBefore    string    `gorm:"type:text" json:"notes_before"`
-	NotesAfter     string    `gorm:"type:text" json:"notes_after"`
-	FeedbackRating *int      `json:"feedback_rating"` // 1-5
-	FeedbackText   string    `gorm:"type:text" json:"feedback_text"`
+	ID             uint          `gorm:"primaryKey" json:"id"`
+	SlotID         uint          `gorm:"index;not null" json:"slot_id"`
+	ParentID       uint          `gorm:"index;not null" json:"parent_id"`
+	StudentID      uint          `gorm:"index;not null" json:"student_id"`
+	Status         BookingStatus `gorm:"size:20;default:'CONFIRMED';index" json:"status"`
+	BookedAt       time.Time     `json:"booked_at"`
+	CancelledAt    *time.Time    `json:"cancelled_at,omitempty"`
+	NotesBefore    string        `gorm:"type:text" json:"notes_before"`
+	NotesAfter     string        `gorm:"type:text" json:"notes_after"`
+	FeedbackRating *int          `json:"feedback_rating"` // 1-5
+	FeedbackText   string        `gorm:"type:text" json:"feedback_text"`
+	ReminderSentAt *time.Time    `json:"-"`
+	// WaitlistPosition is the place in the waiting list, starting at 1, when
+	// the booking was made.
+	WaitlistPosition int `gorm:"-" json:"waitlist_position,omitempty"`
 
 	Slot ColloquiumSlot `gorm:"foreignKey:SlotID" json:"slot,omitempty"`
 }
 
+// MeetingLinkProvider creates the video meeting of an online colloquium
+// slot. Implementations live in infrastructure/meeting.
+type MeetingLinkProvider interface {
+	MeetingLink(ctx context.Context, slot *ColloquiumSlot) (string, error)
+}
+
 // --- Interfaces ---
 
 type CommunicationRepository interface {
@@ -129,17 +242,84 @@ type CommunicationRepository interface {
 	CreateNotification(n *Notification) error
 	GetNotificationsByUserID(userID uint, archived bool) ([]Notification, error)
 	MarkNotificationRead(id uint) error
+	// MarkNotificationDelivered sets DeliveredAt on a notification of userID
+	// that was not delivered yet.
+	MarkNotificationDelivered(id, userID uint, at time.Time) error
 	ArchiveNotification(id uint) error
 	GetPreferences(userID uint) ([]NotificationPreference, error)
 	SavePreferences(prefs []NotificationPreference) error
+	// GetNotificationSettings returns nil if the user never saved any.
+	GetNotificationSettings(userID uint) (*NotificationSettings, error)
+	SaveNotificationSettings(settings *NotificationSettings) error
+
+	// Deliveries
+	CreateDelivery(d *NotificationDelivery) error
+	UpdateDelivery(d *NotificationDelivery) error
+	CreateDeliveryAttempt(a *DeliveryAttempt) error
+	// ClaimDueDeliveries returns up to limit deliveries in the given status
+	// whose next attempt is due, postponing them by lease so other workers
+	// skip them.
+	ClaimDueDeliveries(status DeliveryStatus, now time.Time, lease time.Duration, limit int) ([]NotificationDelivery, error)
+	GetNotificationByID(id uint) (*Notification, error)
+	// CountDeliveryIssues counts bounced and failed deliveries of a school updated since the given time.
+	CountDeliveryIssues(schoolID uint, since time.Time) (int64, error)
+
+	// Push subscriptions
+	// SavePushSubscription stores sub, replacing any subscription with the same endpoint.
+	SavePushSubscription(sub *PushSubscription) error
+	GetPushSubscriptions(userID uint) ([]PushSubscription, error)
+	DeletePushSubscription(userID uint, endpoint string) error
+	DeletePushSubscriptionByEndpoint(endpoint string) error
+
+	// SMS
+	// ReserveSMSSegments adds segments to the school's usage for the month
+	// unless that would exceed quota (0 = unlimited). It reports whether they
+	// were reserved.
+	ReserveSMSSegments(schoolID uint, month string, segments, quota int) (bool, error)
+	// AddSMSUsage adds to the school's usage for the month. Negative segments
+	// release a reservation.
+	AddSMSUsage(schoolID uint, month string, messages, segments, costCents int) error
+	// GetSMSUsage returns nil if the school sent no SMS in the month.
+	GetSMSUsage(schoolID uint, month string) (*SMSUsage, error)
+	// CreateAbsenceAlert records an alert, reporting false if the student
+	// was already alerted that day.
+	CreateAbsenceAlert(alert *AbsenceAlert) (bool, error)
 
 	// Messaging
 	CreateConversation(c *Conversation) error
 	GetConversationsByUserID(userID uint) ([]Conversation, error)
-	GetConversationByID(id uint) (*Conversation, error)
+	GetConversationByID(ctx context.Context, id uint) (*Conversation, error)
+	// AddConversationParticipants adds userIDs not yet in the conversation.
+	AddConversationParticipants(convID uint, userIDs []uint) error
+	RemoveConversationParticipant(convID, userID uint) error
+	GetMessageByID(id uint) (*Message, error)
 	CreateMessage(m *Message) error
 	GetMessagesByConversationID(convID uint, limit, offset int) ([]Message, error)
 	SoftDeleteMessage(id uint) error
+	// SaveConversationRead records a read receipt; it never moves a
+	// participant's position back.
+	SaveConversationRead(r *ConversationRead) error
+
+	// Attachments
+	CreateAttachment(a *Attachment) error
+	GetAttachmentByID(id uint) (*Attachment, error)
+	GetAttachmentsByIDs(ids []uint) ([]Attachment, error)
+	// LinkAttachments marks the attachments as sent with messageID.
+	LinkAttachments(messageID uint, ids []uint) error
+
+	// Announcements
+	// CreateAnnouncement stores the announcement, its conversation and first
+	// message, and its recipients.
+	CreateAnnouncement(a *Announcement, conv *Conversation, msg *Message, recipients []uint) error
+	GetAnnouncementByID(id uint) (*Announcement, error)
+	// GetAnnouncementsByUserID returns the announcements written or received by userID, newest first.
+	GetAnnouncementsByUserID(userID uint) ([]Announcement, error)
+	GetAnnouncementRecipients(announcementID uint) ([]AnnouncementRecipient, error)
+	// MarkAnnouncementRead records the first reading by userID, reporting
+	// false if they are not a recipient.
+	MarkAnnouncementRead(announcementID, userID uint, at time.Time) (bool, error)
+	// RecordAnnouncementReminder records a reminder sent at to userIDs.
+	RecordAnnouncementReminder(announcementID uint, userIDs []uint, at time.Time) error
 
 	// Colloquiums
 	CreateColloquiumSlot(slot *ColloquiumSlot) error
@@ -149,10 +329,49 @@ type CommunicationRepository interface {
 	UpdateSlot(slot *ColloquiumSlot) error
 	DeleteSlot(id uint) error
 
-	CreateBooking(booking *ColloquiumBooking) error
+	// BookSlot stores booking, confirmed if the slot has room and waitlisted
+	// otherwise. The slot is locked meanwhile, so concurrent bookings never
+	// exceed its capacity. It fails with ErrSlotUnavailable or
+	// ErrAlreadyBooked.
+	BookSlot(booking *ColloquiumBooking) error
+	// GetBookingByID returns the booking with its slot.
+	GetBookingByID(ctx context.Context, id uint) (*ColloquiumBooking, error)
+	// CancelBooking cancels an active booking. If it was confirmed, the first
+	// waitlisted booking of the slot is confirmed and returned.
+	CancelBooking(id uint, at time.Time) (promoted *ColloquiumBooking, err error)
+	// CancelSlot makes the slot unavailable and cancels its active bookings,
+	// which it returns.
+	CancelSlot(slotID uint, at time.Time) ([]ColloquiumBooking, error)
+	// CheckInSlot records the teacher entering the waiting room, once.
+	CheckInSlot(slotID uint, at time.Time) error
+	// GetFollowUpSlots returns the available slots dated from..to whose
+	// follow-up was not sent, with their confirmed bookings.
+	GetFollowUpSlots(from, to time.Time) ([]ColloquiumSlot, error)
+	// MarkSlotLateSent and MarkSlotFollowUpSent set the time of a notice,
+	// reporting false if it was already set: a notice is sent once even with
+	// several schedulers.
+	MarkSlotLateSent(slotID uint, at time.Time) (bool, error)
+	MarkSlotFollowUpSent(slotID uint, at time.Time) (bool, error)
+
+	// Meeting days
+	// CreateMeetingDay stores the day, its teachers and their slots.
+	CreateMeetingDay(day *MeetingDay, slots []ColloquiumSlot) error
+	// GetMeetingDayByID returns the day with its teachers.
+	GetMeetingDayByID(id uint) (*MeetingDay, error)
+	// GetMeetingDaySlots returns the slots of the day with their active
+	// bookings, ordered by teacher and time.
+	GetMeetingDaySlots(dayID uint) ([]ColloquiumSlot, error)
+	// BookSlots confirms all the bookings or none of them, failing with
+	// ErrSlotUnavailable when a slot is full or withdrawn.
+	BookSlots(bookings []*ColloquiumBooking) error
 	GetBookingsBySlotID(slotID uint) ([]ColloquiumBooking, error)
 	GetBookingsByParentID(parentID uint) ([]ColloquiumBooking, error)
+	// GetBookingsByDateRange returns the confirmed bookings of the slots dated
+	// from up to to, excluded, with their slot.
 	GetBookingsByDateRange(from, to time.Time) ([]ColloquiumBooking, error)
+	// MarkBookingReminderSent reports false if the reminder of the booking was
+	// already sent.
+	MarkBookingReminderSent(bookingID uint, at time.Time) (bool, error)
 	UpdateBooking(booking *ColloquiumBooking) error
 	DeleteBooking(id uint) error
 }
@@ -0,0 +1,51 @@
+package domain
+
+import "time"
+
+type IdentityStatus string
+
+const (
+	// IdentityAwaitingConfirmation: an email account with the same address exists,
+	// its owner must log in and confirm the link.
+	IdentityAwaitingConfirmation IdentityStatus = "AWAITING_CONFIRMATION"
+	// IdentityPendingApproval: nobody matches, the school secretary must approve it.
+	IdentityPendingApproval IdentityStatus = "PENDING_APPROVAL"
+	IdentityLinked          IdentityStatus = "LINKED"
+	IdentityRejected        IdentityStatus = "REJECTED"
+)
+
+// PendingIdentity is a SPID/CIE identity that could not be matched to a user
+// automatically. It is either waiting for the owner of an existing email account
+// to confirm the link, or queued for approval by the school secretary.
+type PendingIdentity struct {
+	ID               uint           `gorm:"primaryKey" json:"id"`
+	SchoolID         uint           `gorm:"index;not null" json:"school_id"`
+	AuthMethod       string         `gorm:"size:20;not null" json:"auth_method"` // spid, cie
+	ExternalID       string         `gorm:"size:255;index;not null" json:"-"`
+	Provider         string         `gorm:"size:255" json:"provider"`
+	TaxCode          string         `gorm:"size:16;index" json:"tax_code"`
+	FirstName        string         `gorm:"size:100" json:"first_name"`
+	LastName         string         `gorm:"size:100" json:"last_name"`
+	Email            string         `gorm:"size:255" json:"email"`
+	CIESerialNumber  string         `gorm:"size:50" json:"-"`
+	Status           IdentityStatus `gorm:"size:30;index;not null" json:"status"`
+	MatchedUserID    *uint          `gorm:"index" json:"matched_user_id,omitempty"` // Email account awaiting confirmation
+	ConfirmTokenHash string         `gorm:"size:64;index" json:"-"`
+	ConfirmTokenExp  *time.Time     `json:"-"`
+	LinkedUserID     *uint          `json:"linked_user_id,omitempty"`
+	ReviewedBy       *uint          `json:"reviewed_by,omitempty"`
+	ReviewedAt       *time.Time     `json:"reviewed_at,omitempty"`
+	RejectionReason  string         `gorm:"type:text" json:"rejection_reason,omitempty"`
+	CreatedAt        time.Time      `json:"created_at"`
+	UpdatedAt        time.Time      `json:"updated_at"`
+}
+
+type IdentityRepository interface {
+	FindUsersByTaxCode(taxCode string) ([]User, error)
+	CreatePendingIdentity(p *PendingIdentity) error
+	GetPendingIdentityByID(id uint) (*PendingIdentity, error)
+	GetOpenPendingIdentityByExternalID(externalID string) (*PendingIdentity, error)
+	GetPendingIdentityByTokenHash(tokenHash string) (*PendingIdentity, error)
+	ListPendingIdentities(schoolID uint, status IdentityStatus) ([]PendingIdentity, error)
+	UpdatePendingIdentity(p *PendingIdentity) error
+}
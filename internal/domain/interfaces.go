@@ -1,6 +1,9 @@
 package domain
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type UserRepository interface {
 	Create(user *User) error
@@ -19,4 +22,15 @@ type AuthRepository interface {
 	StoreRefreshToken(token *RefreshToken) error
 	RevokeRefreshToken(tokenHash string) error
 	GetRefreshToken(tokenHash string) (*RefreshToken, error)
+	CreateAuthAuditLog(log *AuthAuditLog) error
+	// RevokeUserSessions revokes every refresh token and session of the user.
+	RevokeUserSessions(userID uint) error
+
+	// Password reset
+	// CreatePasswordResetToken stores a new token and invalidates the user's previous unused ones.
+	CreatePasswordResetToken(token *PasswordResetToken) error
+	GetPasswordResetToken(selector string) (*PasswordResetToken, error)
+	// UsePasswordResetToken marks the token as used, returning false if it already was.
+	UsePasswordResetToken(id uint) (bool, error)
+	CountPasswordResetTokens(userID uint, since time.Time) (int64, error)
 }
@@ -0,0 +1,53 @@
+package domain
+
+import "time"
+
+type JobStatus string
+
+const (
+	JobPending JobStatus = "PENDING"
+	JobRunning JobStatus = "RUNNING"
+	JobDone    JobStatus = "DONE"
+	JobFailed  JobStatus = "FAILED" // No attempts left
+)
+
+// Job is a unit of background work, run once by one of the API replicas.
+// While RUNNING it is leased to LockedBy until LockedUntil; a job whose lease
+// expired, because its worker died, is taken again by another one.
+type Job struct {
+	ID      uint    `gorm:"primaryKey" json:"id"`
+	Type    string  `gorm:"size:100;index;not null" json:"type"`
+	Payload JSONMap `gorm:"type:jsonb;not null;default:'{}'" json:"payload"`
+	// IdempotencyKey, when set, makes enqueueing the same work twice a no-op,
+	// e.g. the runs of a cron schedule enqueued by every replica.
+	IdempotencyKey *string    `gorm:"size:255;uniqueIndex" json:"idempotency_key,omitempty"`
+	Status         JobStatus  `gorm:"size:20;default:'PENDING';index:idx_jobs_due,priority:1;not null" json:"status"`
+	RunAt          time.Time  `gorm:"index:idx_jobs_due,priority:2;not null" json:"run_at"`
+	Attempts       int        `gorm:"not null;default:0" json:"attempts"`
+	MaxAttempts    int        `gorm:"not null;default:1" json:"max_attempts"`
+	LockedBy       string     `gorm:"size:100" json:"locked_by,omitempty"`
+	LockedUntil    *time.Time `json:"locked_until,omitempty"`
+	LastError      string     `gorm:"type:text" json:"last_error,omitempty"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+type JobRepository interface {
+	// EnqueueJob reports false, without error, if a job with the same
+	// idempotency key exists.
+	EnqueueJob(job *Job) (bool, error)
+	// GetJob returns nil if there is no such job.
+	GetJob(id uint) (*Job, error)
+	// ClaimJobs leases to worker until lockedUntil up to limit jobs of types
+	// due at now, pending or with an expired lease, counting an attempt for
+	// each. Jobs locked by other workers are skipped, not waited for.
+	ClaimJobs(worker string, types []string, now, lockedUntil time.Time, limit int) ([]Job, error)
+	// The following change a job only while worker holds its lease.
+	CompleteJob(id uint, worker string, at time.Time) error
+	// RetryJob puts a failed job back in the queue, due at runAt.
+	RetryJob(id uint, worker string, runAt time.Time, lastError string) error
+	FailJob(id uint, worker string, at time.Time, lastError string) error
+	// PurgeJobs deletes the jobs finished before before.
+	PurgeJobs(before time.Time) (int64, error)
+}
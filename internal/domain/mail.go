@@ -0,0 +1,18 @@
+package domain
+
+import "context"
+
+// EmailMessage is a transactional email. HTMLBody is optional; TextBody is
+// always sent as the plain text alternative.
+type EmailMessage struct {
+	To       []string
+	Subject  string
+	TextBody string
+	HTMLBody string
+}
+
+// Mailer delivers emails. Implementations live in infrastructure/mail (SMTP
+// for production, console and file for development).
+type Mailer interface {
+	Send(ctx context.Context, msg EmailMessage) error
+}
@@ -0,0 +1,49 @@
+package domain
+
+import "time"
+
+// MeetingDay is a general parent-teacher meeting day (ColloquiumGeneral).
+// Each teacher present receives back to back slots of SlotMinutes between
+// StartTime and EndTime, and parents book a sequence of meetings with the
+// teachers of their child, BufferMinutes apart to move between rooms.
+type MeetingDay struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	SchoolID      uint      `gorm:"index;not null" json:"school_id"`
+	Title         string    `gorm:"size:255;not null" json:"title"`
+	Date          time.Time `gorm:"type:date;not null" json:"date"`
+	StartTime     string    `gorm:"type:varchar(5);not null" json:"start_time"` // HH:MM
+	EndTime       string    `gorm:"type:varchar(5);not null" json:"end_time"`   // HH:MM
+	SlotMinutes   int       `gorm:"not null" json:"slot_minutes"`
+	BufferMinutes int       `gorm:"default:0" json:"buffer_minutes"`
+	CreatedBy     uint      `gorm:"not null" json:"created_by"`
+	CreatedAt     time.Time `json:"created_at"`
+
+	Teachers []MeetingDayTeacher `gorm:"foreignKey:MeetingDayID" json:"teachers,omitempty"`
+}
+
+// MeetingDayTeacher is a teacher present at a meeting day.
+type MeetingDayTeacher struct {
+	MeetingDayID uint   `gorm:"primaryKey" json:"meeting_day_id"`
+	TeacherID    uint   `gorm:"primaryKey" json:"teacher_id"`
+	Room         string `gorm:"size:50" json:"room"`
+}
+
+// MeetingSchedule is the printable schedule of a teacher at a meeting day.
+type MeetingSchedule struct {
+	Title       string                 `json:"title"`
+	Date        time.Time              `json:"date"`
+	TeacherID   uint                   `json:"teacher_id"`
+	TeacherName string                 `json:"teacher_name"`
+	Room        string                 `json:"room"`
+	Entries     []MeetingScheduleEntry `json:"entries"`
+}
+
+// MeetingScheduleEntry is a slot of a schedule; the names are empty when it
+// is free.
+type MeetingScheduleEntry struct {
+	StartTime   string `json:"start_time"`
+	EndTime     string `json:"end_time"`
+	BookingID   uint   `json:"booking_id,omitempty"`
+	StudentName string `json:"student_name,omitempty"`
+	ParentName  string `json:"parent_name,omitempty"`
+}
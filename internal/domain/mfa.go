@@ -0,0 +1,72 @@
+package domain
+
+import "time"
+
+// WebAuthnCredential is a passkey or security key registered by a user. A user
+// may register several devices; each one can be used as a second factor and,
+// for staff, to log in without a password.
+type WebAuthnCredential struct {
+	ID              uint       `gorm:"primaryKey" json:"id"`
+	UserID          uint       `gorm:"index;not null" json:"user_id"`
+	User            User       `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+	CredentialID    []byte     `gorm:"uniqueIndex;not null" json:"-"`
+	PublicKey       []byte     `gorm:"not null" json:"-"` // COSE encoded
+	AttestationType string     `gorm:"size:32" json:"attestation_type"`
+	AAGUID          []byte     `json:"-"`
+	SignCount       uint32     `gorm:"default:0" json:"-"`
+	Transports      string     `gorm:"size:100" json:"transports"` // Comma separated: internal, usb, nfc, ble, hybrid
+	BackupEligible  bool       `gorm:"default:false" json:"backup_eligible"`
+	BackupState     bool       `gorm:"default:false" json:"backup_state"` // Synced passkey
+	Name            string     `gorm:"size:100" json:"name"`
+	LastUsedAt      *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// RecoveryCode is a single-use code that replaces the second factor when the
+// user has lost their authenticator. Only the SHA-256 hash is stored.
+type RecoveryCode struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"index;not null" json:"user_id"`
+	User      User       `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+	CodeHash  string     `gorm:"size:64;not null" json:"-"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// WebAuthn ceremony purposes.
+const (
+	CeremonyRegistration = "registration"
+	CeremonySecondFactor = "second_factor"
+	CeremonyPasskeyLogin = "passkey_login"
+)
+
+// WebAuthnCeremony keeps the server side state of a registration or assertion
+// between the begin and finish calls. It is consumed by the finish call.
+type WebAuthnCeremony struct {
+	ID          string    `gorm:"primaryKey;size:128" json:"id"`  // The challenge
+	UserID      *uint     `gorm:"index" json:"user_id,omitempty"` // Nil for passkey logins, the user is not known yet
+	Purpose     string    `gorm:"size:20;not null" json:"purpose"`
+	SessionData string    `gorm:"type:text;not null" json:"-"` // JSON encoded webauthn.SessionData
+	ExpiresAt   time.Time `gorm:"index;not null" json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type MFARepository interface {
+	// WebAuthn credentials
+	CreateWebAuthnCredential(cred *WebAuthnCredential) error
+	ListWebAuthnCredentials(userID uint) ([]WebAuthnCredential, error)
+	UpdateWebAuthnCredential(cred *WebAuthnCredential) error
+	// DeleteWebAuthnCredential returns ErrNotFound if the credential does not belong to the user.
+	DeleteWebAuthnCredential(userID, id uint) error
+
+	// Recovery codes
+	ReplaceRecoveryCodes(userID uint, codes []RecoveryCode) error
+	CountUnusedRecoveryCodes(userID uint) (int64, error)
+	// UseRecoveryCode marks an unused code as used, returning false if there is none.
+	UseRecoveryCode(userID uint, codeHash string) (bool, error)
+
+	// Ceremonies
+	SaveCeremony(c *WebAuthnCeremony) error
+	// ConsumeCeremony deletes and returns the ceremony, or nil if it is unknown or expired.
+	ConsumeCeremony(id string) (*WebAuthnCeremony, error)
+}
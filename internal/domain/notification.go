@@ -4,3 +4,12 @@ type NotificationService interface {
 	NotifyMarkAdded(mark *Mark)
 	// Add other notifications as needed
 }
+
+// RealtimeNotifier pushes communication events to the connected clients.
+type RealtimeNotifier interface {
+	NotifyNotification(n *Notification)
+	NotifyNewMessage(conv *Conversation, msg *Message)
+	NotifyConversationRead(read *ConversationRead)
+	// NotifyParticipantRemoved stops pushing a conversation to a user removed from it
+	NotifyParticipantRemoved(convID, userID uint)
+}
@@ -0,0 +1,40 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// PushSubscription is a browser registered for Web Push, as returned by
+// PushManager.subscribe(). P256dh and Auth are base64url encoded.
+type PushSubscription struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"index;not null" json:"user_id"`
+	Endpoint  string    `gorm:"type:text;uniqueIndex;not null" json:"endpoint"`
+	P256dh    string    `gorm:"column:p256dh;size:100;not null" json:"-"`
+	Auth      string    `gorm:"size:50;not null" json:"-"`
+	UserAgent string    `gorm:"size:255" json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// PushUrgency tells the push service how quickly to wake the device (RFC 8030).
+type PushUrgency string
+
+const (
+	PushUrgencyNormal PushUrgency = "normal"
+	PushUrgencyHigh   PushUrgency = "high"
+)
+
+// ErrPushSubscriptionGone is returned when the push service no longer knows
+// the subscription (the user unsubscribed or the browser dropped it).
+var ErrPushSubscriptionGone = errors.New("push subscription gone")
+
+// WebPusher sends encrypted Web Push messages. The implementation lives in
+// infrastructure/webpush.
+type WebPusher interface {
+	// PublicKey is the VAPID application server key browsers subscribe with.
+	PublicKey() string
+	Push(ctx context.Context, sub *PushSubscription, payload []byte, urgency PushUrgency) error
+}
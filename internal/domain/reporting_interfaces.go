@@ -1,14 +1,17 @@
 package domain
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type ReportingRepository interface {
 	// Documents
 	CreateDocument(doc *Document) error
-	GetDocumentByID(id uint) (*Document, error)
+	GetDocumentByID(ctx context.Context, id uint) (*Document, error)
 	GetDocumentsBySchoolID(schoolID uint, docType DocumentType) ([]Document, error)
 	GetDocumentsByStatus(schoolID uint, status DocumentStatus) ([]Document, error)
-	GetDocumentsByStudentID(studentID uint) ([]Document, error)
+	GetDocumentsByStudentID(ctx context.Context, studentID uint) ([]Document, error)
 	UpdateDocument(doc *Document) error
 	DeleteDocument(id uint) error
 
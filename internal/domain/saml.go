@@ -0,0 +1,34 @@
+package domain
+
+import "time"
+
+// SAMLRequest is an AuthnRequest sent to a SPID identity provider. The callback
+// only accepts responses whose InResponseTo matches an unconsumed request.
+type SAMLRequest struct {
+	ID          string     `gorm:"primaryKey;size:64" json:"id"` // AuthnRequest ID, also used as RelayState
+	SchoolID    uint       `gorm:"not null" json:"school_id"`
+	RedirectURI string     `gorm:"type:text" json:"redirect_uri"`
+	Level       int        `gorm:"not null" json:"level"` // Minimum SPID level requested
+	ExpiresAt   time.Time  `gorm:"index;not null" json:"expires_at"`
+	ConsumedAt  *time.Time `json:"consumed_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// SAMLAssertionUse records an assertion ID already accepted, until the assertion
+// expires, so the same assertion cannot be replayed.
+type SAMLAssertionUse struct {
+	ID        string    `gorm:"primaryKey;size:255" json:"id"`
+	Issuer    string    `gorm:"size:255" json:"issuer"`
+	ExpiresAt time.Time `gorm:"index;not null" json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type SAMLRepository interface {
+	SaveRequest(req *SAMLRequest) error
+	// ConsumeRequest marks the request as used and returns it, or nil if it is
+	// unknown, expired or already consumed.
+	ConsumeRequest(id string) (*SAMLRequest, error)
+	// MarkAssertionUsed returns false if the assertion ID was already recorded.
+	MarkAssertionUsed(use *SAMLAssertionUse) (bool, error)
+	PurgeExpired(before time.Time) error
+}
@@ -0,0 +1,61 @@
+package domain
+
+import "time"
+
+// ScrutinyOutcome is the result of the final scrutiny (scrutinio finale) of
+// a student, sent to the ministry's SIDI system.
+type ScrutinyOutcome string
+
+const (
+	OutcomeAdmitted     ScrutinyOutcome = "ADMITTED"     // Ammesso alla classe successiva
+	OutcomeNotAdmitted  ScrutinyOutcome = "NOT_ADMITTED" // Non ammesso
+	OutcomeSuspended    ScrutinyOutcome = "SUSPENDED"    // Giudizio sospeso
+	OutcomeGraduated    ScrutinyOutcome = "GRADUATED"    // Diplomato, licenziato
+	OutcomeNotGraduated ScrutinyOutcome = "NOT_GRADUATED"
+)
+
+// StudentOutcome is the outcome of a student's final scrutiny in a year.
+type StudentOutcome struct {
+	ID           uint            `gorm:"primaryKey" json:"id"`
+	SchoolID     uint            `gorm:"index;not null" json:"school_id"`
+	StudentID    uint            `gorm:"uniqueIndex:idx_outcome_student_year;not null" json:"student_id"`
+	ClassID      uint            `gorm:"index;not null" json:"class_id"`
+	AcademicYear string          `gorm:"size:20;uniqueIndex:idx_outcome_student_year;not null" json:"academic_year"`
+	Outcome      ScrutinyOutcome `gorm:"type:varchar(20);not null" json:"outcome"`
+	Credits      int             `json:"credits,omitempty"`     // Crediti scolastici, upper secondary only
+	FinalScore   int             `json:"final_score,omitempty"` // Of the final exam
+	DecidedAt    time.Time       `json:"decided_at"`            // Day of the scrutiny
+	RecordedBy   uint            `json:"recorded_by"`
+	CreatedAt    time.Time       `json:"created_at"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+}
+
+// EnrolledStudent is an enrollment of a year with its student and class.
+type EnrolledStudent struct {
+	Student    Student
+	Class      Class
+	Enrollment ClassEnrollment
+}
+
+// AbsenceTotals counts the absences of a student for the frequency flow.
+type AbsenceTotals struct {
+	StudentID uint
+	Days      int // Full days absent
+	Hours     int // Single hours absent
+	Late      int // Late entries
+}
+
+type SIDIRepository interface {
+	GetSchoolByID(id uint) (*School, error)
+	// GetEnrollments returns the enrollments of the school's classes in the
+	// academic year, ordered by class and student name.
+	GetEnrollments(schoolID uint, academicYear string) ([]EnrolledStudent, error)
+	// GetAbsenceTotals counts the absences in the school's classes between
+	// from and to, both included.
+	GetAbsenceTotals(schoolID uint, from, to time.Time) ([]AbsenceTotals, error)
+	GetOutcomes(schoolID uint, academicYear string) ([]StudentOutcome, error)
+	// UpsertOutcome saves the outcome of the student in its year.
+	UpsertOutcome(outcome *StudentOutcome) error
+	GetStudentsByTaxCodes(schoolID uint, taxCodes []string) ([]Student, error)
+	UpdateStudentSIDICode(studentID uint, code string) error
+}
@@ -0,0 +1,68 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+// SMSSettings is the SMS gateway a school has configured, stored in
+// SchoolSettings under the "sms" key. Schools pay for their own messages, so
+// the credentials are per school.
+type SMSSettings struct {
+	Provider string `json:"provider"` // "http"
+	URL      string `json:"url"`
+	Username string `json:"username,omitempty"` // HTTP basic auth
+	Password string `json:"password,omitempty"`
+	APIKey   string `json:"api_key,omitempty"` // Sent as a bearer token
+	Sender   string `json:"sender"`            // Alphanumeric sender ID or phone number
+	// MonthlyQuota caps the segments sent per calendar month, 0 = unlimited
+	MonthlyQuota int `json:"monthly_quota"`
+	// CostPerSegment in euro cents, used when the provider does not report the cost
+	CostPerSegment int `json:"cost_per_segment"`
+	// AbsenceAlerts texts the parents of students absent at the first hour
+	// without prior notice, at AbsenceAlertTime ("HH:MM", default 09:00).
+	AbsenceAlerts    bool   `json:"absence_alerts"`
+	AbsenceAlertTime string `json:"absence_alert_time,omitempty"`
+}
+
+type SMSMessage struct {
+	To     string // E.164, e.g. +393471234567
+	Sender string
+	Text   string
+}
+
+// SMSReceipt is what the provider reported for an accepted message. Zero
+// Segments or CostCents mean the provider did not say.
+type SMSReceipt struct {
+	MessageID string
+	Segments  int
+	CostCents int
+}
+
+// SMSProvider sends text messages through a gateway. Permanent failures wrap
+// ErrDeliveryRejected; other errors are retried. Implementations live in
+// infrastructure/sms.
+type SMSProvider interface {
+	Send(ctx context.Context, msg SMSMessage) (*SMSReceipt, error)
+}
+
+// SMSUsage is the SMS traffic of a school in a month ("2006-01"), used for
+// the quota and to bill the cost back.
+type SMSUsage struct {
+	SchoolID  uint      `gorm:"primaryKey" json:"school_id"`
+	Month     string    `gorm:"primaryKey;size:7" json:"month"`
+	Messages  int       `gorm:"not null;default:0" json:"messages"`
+	Segments  int       `gorm:"not null;default:0" json:"segments"`
+	CostCents int       `gorm:"not null;default:0" json:"cost_cents"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// AbsenceAlert records that the parents of a student were alerted of an
+// absence, so that each student triggers at most one alert a day.
+type AbsenceAlert struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	SchoolID  uint      `gorm:"index;not null" json:"school_id"`
+	StudentID uint      `gorm:"not null;uniqueIndex:idx_absence_alert_day" json:"student_id"`
+	Date      time.Time `gorm:"type:date;not null;uniqueIndex:idx_absence_alert_day" json:"date"`
+	CreatedAt time.Time `json:"created_at"`
+}
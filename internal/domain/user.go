@@ -18,23 +18,32 @@ const (
 	RoleSecretary  Role = "Secretary"
 )
 
+// Authentication methods stored in User.AuthMethod and AuthAuditLog.AuthMethod.
+const (
+	AuthMethodEmail   = "email"
+	AuthMethodSPID    = "spid"
+	AuthMethodCIE     = "cie"
+	AuthMethodPasskey = "passkey" // Passwordless WebAuthn login, staff only
+)
+
 type User struct {
-	ID             uint       `gorm:"primaryKey" json:"id"`
-	Email          string     `gorm:"uniqueIndex;not null" json:"email"`
-	PasswordHash   string     `gorm:"not null" json:"-"`
-	SchoolID       uint       `gorm:"index" json:"schoolId"` // 0 for SuperAdmin
-	School         *School    `json:"school,omitempty"`      // Added association
-	Role           Role       `gorm:"type:varchar(50);not null" json:"role"`
-	Subjects       []Subject  `gorm:"many2many:user_subjects;" json:"subjects,omitempty"`
-	Status         string     `gorm:"type:varchar(20);default:'active'" json:"status"` // active, inactive
-	FirstName      string     `gorm:"size:100" json:"firstName"`
-	LastName       string     `gorm:"size:100" json:"lastName"`
-	TwoFAEnabled   bool       `gorm:"default:false" json:"twoFaEnabled"`
-	TwoFASecret    string     `gorm:"size:100" json:"-"`
-	FailedLogins   int        `gorm:"default:0" json:"-"`
-	LockedUntil    *time.Time `json:"lockedUntil,omitempty"`
-	ResetTokenHash string     `gorm:"size:255" json:"-"`
-	ResetTokenExp  *time.Time `json:"-"`
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	Email        string     `gorm:"uniqueIndex;not null" json:"email"`
+	PasswordHash string     `gorm:"not null" json:"-"`
+	SchoolID     uint       `gorm:"index" json:"schoolId"` // 0 for SuperAdmin
+	School       *School    `json:"school,omitempty"`      // Added association
+	Role         Role       `gorm:"type:varchar(50);not null" json:"role"`
+	Subjects     []Subject  `gorm:"many2many:user_subjects;" json:"subjects,omitempty"`
+	Status       string     `gorm:"type:varchar(20);default:'active'" json:"status"` // active, inactive
+	FirstName    string     `gorm:"size:100" json:"firstName"`
+	LastName     string     `gorm:"size:100" json:"lastName"`
+	Locale       string     `gorm:"size:5;default:'it'" json:"locale"`      // Language of emails and notifications: it, en
+	Phone        string     `gorm:"size:50" json:"phone,omitempty"`         // Mobile number for SMS alerts
+	TaxCode      *string    `gorm:"size:16;index" json:"taxCode,omitempty"` // Codice Fiscale, used to link SPID/CIE identities
+	TwoFAEnabled bool       `gorm:"default:false" json:"twoFaEnabled"`
+	TwoFASecret  string     `gorm:"size:100" json:"-"`
+	FailedLogins int        `gorm:"default:0" json:"-"`
+	LockedUntil  *time.Time `json:"lockedUntil,omitempty"`
 	// SPID/CIE Authentication
 	AuthMethod      string         `gorm:"type:varchar(20);default:'email'" json:"authMethod"` // email, spid, cie
 	SPIDProvider    *string        `gorm:"size:50" json:"spidProvider,omitempty"`
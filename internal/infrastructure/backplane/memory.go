@@ -0,0 +1,46 @@
+package backplane
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory connects hubs living in the same process, for tests.
+type Memory struct {
+	mu          sync.Mutex
+	subscribers map[int]func([]byte)
+	next        int
+}
+
+func NewMemory() *Memory {
+	return &Memory{subscribers: make(map[int]func([]byte))}
+}
+
+func (m *Memory) Publish(ctx context.Context, payload []byte) error {
+	m.mu.Lock()
+	handlers := make([]func([]byte), 0, len(m.subscribers))
+	for _, handler := range m.subscribers {
+		handlers = append(handlers, handler)
+	}
+	m.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(append([]byte(nil), payload...))
+	}
+	return nil
+}
+
+func (m *Memory) Subscribe(ctx context.Context, handler func([]byte)) error {
+	m.mu.Lock()
+	id := m.next
+	m.next++
+	m.subscribers[id] = handler
+	m.mu.Unlock()
+
+	<-ctx.Done()
+
+	m.mu.Lock()
+	delete(m.subscribers, id)
+	m.mu.Unlock()
+	return ctx.Err()
+}
@@ -0,0 +1,134 @@
+package backplane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	// maxNotifyPayload keeps NOTIFY payloads under the 8000 byte limit of
+	// Postgres; larger events are stored in relay_messages and notified by
+	// reference.
+	maxNotifyPayload = 7900
+	refPrefix        = "ref:"
+	// relayRetention is how long stored events stay readable by the nodes.
+	relayRetention = 5 * time.Minute
+
+	reconnectMin = time.Second
+	reconnectMax = 30 * time.Second
+)
+
+// RelayMessage is an event too large for a NOTIFY payload.
+type RelayMessage struct {
+	ID        uint      `gorm:"primaryKey"`
+	Payload   []byte    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// Postgres relays events with LISTEN/NOTIFY, so replicas sharing the database
+// need no other infrastructure. Events published while a node is
+// reconnecting are lost for that node.
+type Postgres struct {
+	db      *gorm.DB
+	dsn     string
+	channel string
+}
+
+// NewPostgres publishes through db and listens on a dedicated connection
+// opened with dsn.
+func NewPostgres(db *gorm.DB, dsn, channel string) (*Postgres, error) {
+	if channel == "" {
+		return nil, errors.New("backplane channel is required")
+	}
+	if err := db.AutoMigrate(&RelayMessage{}); err != nil {
+		return nil, err
+	}
+	return &Postgres{db: db, dsn: dsn, channel: channel}, nil
+}
+
+func (p *Postgres) Publish(ctx context.Context, payload []byte) error {
+	db := p.db.WithContext(ctx)
+	if len(payload) <= maxNotifyPayload {
+		return db.Exec("SELECT pg_notify(?, ?)", p.channel, string(payload)).Error
+	}
+
+	msg := &RelayMessage{Payload: payload}
+	if err := db.Create(msg).Error; err != nil {
+		return err
+	}
+	if err := db.Where("created_at < ?", time.Now().Add(-relayRetention)).Delete(&RelayMessage{}).Error; err != nil {
+		zap.L().Warn("Failed to prune relayed WebSocket events", zap.Error(err))
+	}
+	return db.Exec("SELECT pg_notify(?, ?)", p.channel, refPrefix+strconv.FormatUint(uint64(msg.ID), 10)).Error
+}
+
+// Subscribe listens until ctx is done, reconnecting with a backoff when the
+// connection drops.
+func (p *Postgres) Subscribe(ctx context.Context, handler func([]byte)) error {
+	wait := reconnectMin
+	for {
+		err := p.listen(ctx, handler, func() { wait = reconnectMin })
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		zap.L().Warn("WebSocket backplane connection lost, reconnecting", zap.Duration("in", wait), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > reconnectMax {
+			wait = reconnectMax
+		}
+	}
+}
+
+func (p *Postgres) listen(ctx context.Context, handler func([]byte), connected func()) error {
+	conn, err := pgx.Connect(ctx, p.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{p.channel}.Sanitize()); err != nil {
+		return err
+	}
+	connected()
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		payload, err := p.resolve(ctx, n.Payload)
+		if err != nil {
+			zap.L().Error("Failed to read relayed WebSocket event", zap.String("payload", n.Payload), zap.Error(err))
+			continue
+		}
+		handler(payload)
+	}
+}
+
+// resolve returns the event a notification carries or references.
+func (p *Postgres) resolve(ctx context.Context, payload string) ([]byte, error) {
+	if !strings.HasPrefix(payload, refPrefix) {
+		return []byte(payload), nil
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(payload, refPrefix), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reference: %w", err)
+	}
+	var msg RelayMessage
+	if err := p.db.WithContext(ctx).First(&msg, id).Error; err != nil {
+		return nil, err
+	}
+	return msg.Payload, nil
+}
@@ -0,0 +1,145 @@
+// Package ical writes iCalendar (RFC 5545) feeds that calendar apps can
+// subscribe to.
+package ical
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/k/iRegistro/internal/domain"
+)
+
+// TimeZone is the zone of the times written. Its definition is embedded in
+// the feed, as RFC 5545 requires for every TZID used.
+const TimeZone = "Europe/Rome"
+
+// romeTimeZone follows the EU daylight saving rules since 1996.
+const romeTimeZone = `BEGIN:VTIMEZONE
+TZID:Europe/Rome
+BEGIN:DAYLIGHT
+TZOFFSETFROM:+0100
+TZOFFSETTO:+0200
+TZNAME:CEST
+DTSTART:19700329T020000
+RRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=-1SU
+END:DAYLIGHT
+BEGIN:STANDARD
+TZOFFSETFROM:+0200
+TZOFFSETTO:+0100
+TZNAME:CET
+DTSTART:19701025T030000
+RRULE:FREQ=YEARLY;BYMONTH=10;BYDAY=-1SU
+END:STANDARD
+END:VTIMEZONE`
+
+const maxLineOctets = 75
+
+var location = func() *time.Location {
+	loc, err := time.LoadLocation(TimeZone)
+	if err != nil {
+		return time.FixedZone("CET", 3600)
+	}
+	return loc
+}()
+
+// Encode writes a calendar named name with events. stamp is the DTSTAMP of
+// every event, the time the feed was generated.
+func Encode(w io.Writer, name string, events []domain.CalendarEvent, stamp time.Time) error {
+	bw := bufio.NewWriter(w)
+	e := &encoder{w: bw}
+	e.line("BEGIN:VCALENDAR")
+	e.line("VERSION:2.0")
+	e.line("PRODID:-//iRegistro//Calendar//IT")
+	e.line("CALSCALE:GREGORIAN")
+	e.line("METHOD:PUBLISH")
+	e.line("X-WR-CALNAME:" + escape(name))
+	e.line("X-WR-TIMEZONE:" + TimeZone)
+	// Suggested refresh interval for subscriptions
+	e.line("REFRESH-INTERVAL;VALUE=DURATION:PT1H")
+	e.line("X-PUBLISHED-TTL:PT1H")
+	for _, l := range strings.Split(romeTimeZone, "\n") {
+		e.line(l)
+	}
+	for _, ev := range events {
+		e.event(ev, stamp)
+	}
+	e.line("END:VCALENDAR")
+	if e.err != nil {
+		return e.err
+	}
+	return bw.Flush()
+}
+
+type encoder struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (e *encoder) event(ev domain.CalendarEvent, stamp time.Time) {
+	e.line("BEGIN:VEVENT")
+	e.line("UID:" + ev.UID)
+	e.line("DTSTAMP:" + stamp.UTC().Format("20060102T150405Z"))
+	if ev.AllDay {
+		e.line("DTSTART;VALUE=DATE:" + ev.Start.Format("20060102"))
+		e.line("DTEND;VALUE=DATE:" + ev.End.Format("20060102"))
+	} else {
+		e.line("DTSTART;TZID=" + TimeZone + ":" + localTime(ev.Start))
+		e.line("DTEND;TZID=" + TimeZone + ":" + localTime(ev.End))
+	}
+	if ev.Weekly {
+		rule := "RRULE:FREQ=WEEKLY"
+		if ev.Until != nil {
+			// UNTIL is in UTC when DTSTART has a time zone
+			rule += ";UNTIL=" + ev.Until.UTC().Format("20060102T150405Z")
+		}
+		e.line(rule)
+	}
+	e.line("SUMMARY:" + escape(ev.Summary))
+	if ev.Location != "" {
+		e.line("LOCATION:" + escape(ev.Location))
+	}
+	if ev.Description != "" {
+		e.line("DESCRIPTION:" + escape(ev.Description))
+	}
+	if ev.AllDay {
+		e.line("TRANSP:TRANSPARENT")
+	}
+	e.line("END:VEVENT")
+}
+
+func localTime(t time.Time) string {
+	return t.In(location).Format("20060102T150405")
+}
+
+// line writes a content line, folded at 75 octets without splitting UTF-8
+// sequences.
+func (e *encoder) line(s string) {
+	if e.err != nil {
+		return
+	}
+	var b strings.Builder
+	limit := maxLineOctets
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		b.WriteString(s[:cut])
+		b.WriteString("\r\n ")
+		s = s[cut:]
+		limit = maxLineOctets - 1 // The leading space counts
+	}
+	b.WriteString(s)
+	b.WriteString("\r\n")
+	_, e.err = e.w.WriteString(b.String())
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`)
+
+// escape escapes a TEXT value.
+func escape(s string) string {
+	return escaper.Replace(s)
+}
@@ -0,0 +1,64 @@
+package ical
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncode(t *testing.T) {
+	until := time.Date(2027, 6, 10, 0, 0, 0, 0, location)
+	events := []domain.CalendarEvent{
+		{
+			UID: "timetable-1-MONDAY-1@iregistro", Summary: "Matematica, 3A", Location: "Aula 12",
+			Start: time.Date(2026, 9, 14, 8, 0, 0, 0, location), End: time.Date(2026, 9, 14, 9, 0, 0, 0, location),
+			Weekly: true, Until: &until,
+		},
+		{
+			UID: "event-3@iregistro", Summary: "Vacanze di Natale", AllDay: true,
+			Start: time.Date(2026, 12, 23, 0, 0, 0, 0, time.UTC), End: time.Date(2027, 1, 7, 0, 0, 0, 0, time.UTC),
+			Description: "Rientro il 7; portare il diario\nBuone feste",
+		},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, Encode(&buf, "iRegistro - Maria Verdi", events, time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)))
+	out := buf.String()
+
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n") {
+		assert.LessOrEqual(t, len(line), 75, line)
+	}
+	assert.True(t, strings.HasPrefix(out, "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n"))
+	assert.Contains(t, out, "BEGIN:VTIMEZONE\r\nTZID:Europe/Rome\r\n")
+	assert.Contains(t, out, "DTSTART;TZID=Europe/Rome:20260914T080000\r\n")
+	assert.Contains(t, out, "RRULE:FREQ=WEEKLY;UNTIL=20270609T220000Z\r\n")
+	assert.Contains(t, out, "DTSTAMP:20261019T100000Z\r\n")
+	assert.Contains(t, out, "DTSTART;VALUE=DATE:20261223\r\nDTEND;VALUE=DATE:20270107\r\n")
+	assert.Contains(t, out, `DESCRIPTION:Rientro il 7\; portare il diario\nBuone feste`)
+	assert.Contains(t, out, `SUMMARY:Matematica\, 3A`)
+	assert.Equal(t, 2, strings.Count(out, "BEGIN:VEVENT"))
+	assert.True(t, strings.HasSuffix(out, "END:VCALENDAR\r\n"))
+}
+
+func TestLineFolding(t *testing.T) {
+	var buf bytes.Buffer
+	e := &encoder{w: bufio.NewWriter(&buf)}
+	long := "SUMMARY:" + strings.Repeat("è", 60) // 2 octets each
+	e.line(long)
+	require.NoError(t, e.w.Flush())
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n")
+	require.Greater(t, len(lines), 1)
+	unfolded := lines[0]
+	for _, l := range lines[1:] {
+		assert.True(t, strings.HasPrefix(l, " "))
+		assert.LessOrEqual(t, len(l), 75)
+		unfolded += l[1:]
+	}
+	assert.Equal(t, long, unfolded, "no UTF-8 sequence is split")
+}
@@ -0,0 +1,65 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"go.uber.org/zap"
+)
+
+// ConsoleMailer logs emails instead of sending them. For development only:
+// the log contains the full body, reset links included.
+type ConsoleMailer struct {
+	logger *zap.Logger
+	from   string
+}
+
+func NewConsoleMailer(l *zap.Logger, from string) *ConsoleMailer {
+	return &ConsoleMailer{logger: l, from: from}
+}
+
+func (m *ConsoleMailer) Send(ctx context.Context, msg domain.EmailMessage) error {
+	m.logger.Info("Email (console mailer)",
+		zap.String("from", m.from),
+		zap.Strings("to", msg.To),
+		zap.String("subject", msg.Subject),
+		zap.String("body", msg.TextBody))
+	return nil
+}
+
+// FileMailer writes each email as an .eml file that can be opened with a mail client.
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func NewFileMailer(dir, from string) *FileMailer {
+	return &FileMailer{dir: dir, from: from}
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg domain.EmailMessage) error {
+	body, err := buildMessage(m.from, msg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.dir, 0o700); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000000000"), sanitize(msg.To[0]))
+	return os.WriteFile(filepath.Join(m.dir, name), body, 0o600)
+}
+
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '@' || r == '.' || r == '-' || r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, s)
+}
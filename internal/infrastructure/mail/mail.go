@@ -0,0 +1,118 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/k/iRegistro/internal/config"
+	"github.com/k/iRegistro/internal/domain"
+	"go.uber.org/zap"
+)
+
+// New returns the mailer selected by the configuration.
+func New(cfg config.MailConfig, smtpCfg config.SMTPConfig, l *zap.Logger) (domain.Mailer, error) {
+	if _, err := mail.ParseAddress(cfg.From); err != nil {
+		return nil, fmt.Errorf("invalid MAIL_FROM %q: %w", cfg.From, err)
+	}
+
+	driver := cfg.Driver
+	if driver == "" {
+		driver = "console"
+		if smtpCfg.Host != "" {
+			driver = "smtp"
+		}
+	}
+
+	switch driver {
+	case "smtp":
+		if smtpCfg.Host == "" {
+			return nil, fmt.Errorf("mail driver smtp requires SMTP_HOST")
+		}
+		return NewSMTPMailer(smtpCfg, cfg.From), nil
+	case "file":
+		return NewFileMailer(cfg.Dir, cfg.From), nil
+	case "console":
+		return NewConsoleMailer(l, cfg.From), nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", driver)
+	}
+}
+
+// buildMessage renders msg as an RFC 5322 message: plain text only, or
+// multipart/alternative when an HTML body is present.
+func buildMessage(from string, msg domain.EmailMessage) ([]byte, error) {
+	if len(msg.To) == 0 {
+		return nil, fmt.Errorf("email without recipients")
+	}
+
+	var buf bytes.Buffer
+	header := func(k, v string) { fmt.Fprintf(&buf, "%s: %s\r\n", k, v) }
+	header("From", from)
+	header("To", strings.Join(msg.To, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", messageID(from))
+	header("MIME-Version", "1.0")
+
+	if msg.HTMLBody == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, msg.TextBody); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	parts := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	buf.WriteString("\r\n")
+	for _, p := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.TextBody},
+		{"text/html; charset=utf-8", msg.HTMLBody},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, p.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w interface{ Write([]byte) (int, error) }, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func messageID(from string) string {
+	domainPart := "localhost"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if at := strings.LastIndex(addr.Address, "@"); at >= 0 {
+			domainPart = addr.Address[at+1:]
+		}
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "<" + hex.EncodeToString(b) + "@" + domainPart + ">"
+}
@@ -0,0 +1,168 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/k/iRegistro/internal/config"
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const from = "iRegistro <no-reply@scuola.it>"
+
+func TestBuildMessage(t *testing.T) {
+	raw, err := buildMessage(from, domain.EmailMessage{
+		To:       []string{"genitore@example.com"},
+		Subject:  "Assenza di Mario – oggi",
+		TextBody: "Testo con à è ì",
+		HTMLBody: "<p>Testo con à è ì</p>",
+	})
+	require.NoError(t, err)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	require.NoError(t, err)
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, "Assenza di Mario – oggi", subject)
+	assert.Contains(t, msg.Header.Get("Message-ID"), "@scuola.it>")
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/alternative", mediaType)
+
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	var bodies []string
+	for {
+		p, err := parts.NextPart() // Decodes quoted-printable
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, _ := io.ReadAll(p)
+		bodies = append(bodies, string(b))
+	}
+	assert.Equal(t, []string{"Testo con à è ì", "<p>Testo con à è ì</p>"}, bodies)
+
+	_, err = buildMessage(from, domain.EmailMessage{Subject: "nobody"})
+	assert.Error(t, err)
+}
+
+func TestNew(t *testing.T) {
+	m, err := New(config.MailConfig{From: from}, config.SMTPConfig{}, zap.NewNop())
+	require.NoError(t, err)
+	assert.IsType(t, &ConsoleMailer{}, m)
+
+	m, err = New(config.MailConfig{From: from}, config.SMTPConfig{Host: "smtp.example.com", Port: "587"}, zap.NewNop())
+	require.NoError(t, err)
+	assert.IsType(t, &SMTPMailer{}, m)
+
+	_, err = New(config.MailConfig{From: from, Driver: "smtp"}, config.SMTPConfig{}, zap.NewNop())
+	assert.Error(t, err)
+	_, err = New(config.MailConfig{From: from, Driver: "pigeon"}, config.SMTPConfig{}, zap.NewNop())
+	assert.Error(t, err)
+	_, err = New(config.MailConfig{From: "not an address"}, config.SMTPConfig{}, zap.NewNop())
+	assert.Error(t, err)
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m, err := New(config.MailConfig{From: from, Driver: "file", Dir: dir}, config.SMTPConfig{}, zap.NewNop())
+	require.NoError(t, err)
+
+	require.NoError(t, m.Send(context.Background(), domain.EmailMessage{
+		To:       []string{"docente@example.com"},
+		Subject:  "Reset",
+		TextBody: "link",
+	}))
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	require.Len(t, files, 1)
+	raw, _ := os.ReadFile(files[0])
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	require.NoError(t, err)
+	assert.Equal(t, "docente@example.com", msg.Header.Get("To"))
+}
+
+// smtpSink is a minimal SMTP server that rejects RCPT for unknown@ and
+// collects the DATA of accepted messages.
+func smtpSink(t *testing.T) (host, port string, received chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	received = make(chan string, 4)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				tp := textproto.NewConn(c)
+				tp.PrintfLine("220 sink ESMTP")
+				for {
+					line, err := tp.ReadLine()
+					if err != nil {
+						return
+					}
+					cmd := strings.ToUpper(line)
+					switch {
+					case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+						tp.PrintfLine("250 sink")
+					case strings.HasPrefix(cmd, "RCPT") && strings.Contains(line, "unknown@"):
+						tp.PrintfLine("550 5.1.1 no such user")
+					case cmd == "DATA":
+						tp.PrintfLine("354 go ahead")
+						data, _ := tp.ReadDotBytes()
+						received <- string(data)
+						tp.PrintfLine("250 queued")
+					case cmd == "QUIT":
+						tp.PrintfLine("221 bye")
+						return
+					default:
+						tp.PrintfLine("250 ok")
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	host, port, _ = net.SplitHostPort(ln.Addr().String())
+	return host, port, received
+}
+
+func TestSMTPMailer(t *testing.T) {
+	host, port, received := smtpSink(t)
+	m := NewSMTPMailer(config.SMTPConfig{Host: host, Port: port}, from)
+
+	err := m.Send(context.Background(), domain.EmailMessage{
+		To:       []string{"docente@example.com"},
+		Subject:  "Nuovo voto",
+		TextBody: "Matematica: 8",
+	})
+	require.NoError(t, err)
+	assert.Contains(t, <-received, "Subject: Nuovo voto")
+
+	// A 5xx reply is a permanent rejection, not a transient failure
+	err = m.Send(context.Background(), domain.EmailMessage{
+		To:       []string{"unknown@example.com"},
+		Subject:  "Nuovo voto",
+		TextBody: "Matematica: 8",
+	})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, domain.ErrDeliveryRejected)
+}
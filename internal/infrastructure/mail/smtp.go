@@ -0,0 +1,100 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+
+	"github.com/k/iRegistro/internal/config"
+	"github.com/k/iRegistro/internal/domain"
+)
+
+// SMTPMailer delivers through an SMTP relay. Port 465 uses implicit TLS, any
+// other port upgrades with STARTTLS when the server offers it.
+type SMTPMailer struct {
+	cfg  config.SMTPConfig
+	from string
+}
+
+func NewSMTPMailer(cfg config.SMTPConfig, from string) *SMTPMailer {
+	return &SMTPMailer{cfg: cfg, from: from}
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg domain.EmailMessage) error {
+	body, err := buildMessage(m.from, msg)
+	if err != nil {
+		return err
+	}
+	sender, err := mail.ParseAddress(m.from)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(m.cfg.Host, m.cfg.Port)
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("smtp dial %s: %w", addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	tlsConfig := &tls.Config{ServerName: m.cfg.Host}
+	if m.cfg.Port == "465" {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	c, err := smtp.NewClient(conn, m.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok && m.cfg.Port != "465" {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("smtp starttls: %w", err)
+		}
+	}
+	if m.cfg.User != "" {
+		// PlainAuth refuses to send credentials over an unencrypted connection
+		if err := c.Auth(smtp.PlainAuth("", m.cfg.User, m.cfg.Password, m.cfg.Host)); err != nil {
+			return fmt.Errorf("smtp auth: %w", err)
+		}
+	}
+
+	if err := c.Mail(sender.Address); err != nil {
+		return classify(err)
+	}
+	for _, to := range msg.To {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("smtp rcpt %s: %w", to, classify(err))
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return classify(err)
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return classify(err)
+	}
+	return c.Quit()
+}
+
+// classify marks permanent SMTP failures (5xx replies) as rejections, which
+// are not retried. Everything else, 4xx replies included, is transient.
+func classify(err error) error {
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return fmt.Errorf("%w: %v", domain.ErrDeliveryRejected, err)
+	}
+	return err
+}
@@ -0,0 +1,35 @@
+package meeting
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/k/iRegistro/internal/domain"
+)
+
+// Jitsi links colloquiums to rooms of a Jitsi Meet server. Jitsi creates a
+// room when the first participant joins, so links are generated offline; the
+// room name is random, as anyone knowing it can join.
+type Jitsi struct {
+	baseURL string
+}
+
+func NewJitsi(baseURL string) (*Jitsi, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid Jitsi URL %q", baseURL)
+	}
+	return &Jitsi{baseURL: strings.TrimRight(baseURL, "/")}, nil
+}
+
+func (j *Jitsi) MeetingLink(ctx context.Context, slot *domain.ColloquiumSlot) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return j.baseURL + "/iRegistro-" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,36 @@
+package meeting
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/k/iRegistro/internal/config"
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJitsiMeetingLink(t *testing.T) {
+	j, err := NewJitsi("https://meet.example.org/")
+	require.NoError(t, err)
+
+	slot := &domain.ColloquiumSlot{ID: 1, TeacherID: 2}
+	first, err := j.MeetingLink(context.Background(), slot)
+	require.NoError(t, err)
+	second, err := j.MeetingLink(context.Background(), slot)
+	require.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(first, "https://meet.example.org/iRegistro-"), first)
+	assert.Len(t, strings.TrimPrefix(first, "https://meet.example.org/iRegistro-"), 32)
+	assert.NotEqual(t, first, second, "room names are not guessable")
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(config.MeetingsConfig{Provider: "jitsi", JitsiURL: "https://meet.jit.si"})
+	assert.NoError(t, err)
+	_, err = New(config.MeetingsConfig{Provider: "jitsi", JitsiURL: "meet.jit.si"})
+	assert.Error(t, err, "the scheme is required")
+	_, err = New(config.MeetingsConfig{Provider: "zoom"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,18 @@
+package meeting
+
+import (
+	"fmt"
+
+	"github.com/k/iRegistro/internal/config"
+	"github.com/k/iRegistro/internal/domain"
+)
+
+// New returns the provider selected by cfg.Provider; only "jitsi" for now.
+func New(cfg config.MeetingsConfig) (domain.MeetingLinkProvider, error) {
+	switch cfg.Provider {
+	case "jitsi", "":
+		return NewJitsi(cfg.JitsiURL)
+	default:
+		return nil, fmt.Errorf("unknown meeting provider %q", cfg.Provider)
+	}
+}
@@ -85,6 +85,46 @@ func (g *MarotoGenerator) GenerateCertificate(data domain.JSONMap) ([]byte, erro
 	return buff.Bytes(), nil
 }
 
+// GenerateMeetingSchedule prints the schedule of a teacher at a meeting day,
+// one row per slot.
+func (g *MarotoGenerator) GenerateMeetingSchedule(schedule *domain.MeetingSchedule) ([]byte, error) {
+	m := pdf.NewMaroto(consts.Portrait, consts.A4)
+	m.SetPageMargins(20, 10, 20)
+
+	g.addHeader(m, schedule.Title)
+
+	m.Row(10, func() {
+		m.Col(8, func() {
+			m.Text(schedule.TeacherName, props.Text{Size: 14, Style: consts.Bold})
+		})
+		m.Col(4, func() {
+			text := schedule.Date.Format("02/01/2006")
+			if schedule.Room != "" {
+				text += " - Room " + schedule.Room
+			}
+			m.Text(text, props.Text{Align: consts.Right})
+		})
+	})
+
+	rows := make([][]string, 0, len(schedule.Entries))
+	for _, e := range schedule.Entries {
+		rows = append(rows, []string{e.StartTime + " - " + e.EndTime, e.StudentName, e.ParentName})
+	}
+	m.TableList([]string{"Time", "Student", "Parent"}, rows, props.TableList{
+		HeaderProp:         props.TableListContent{Style: consts.Bold, GridSizes: []uint{3, 5, 4}},
+		ContentProp:        props.TableListContent{GridSizes: []uint{3, 5, 4}},
+		HeaderContentSpace: 2,
+		Line:               true,
+	})
+	g.addFooter(m)
+
+	buff, err := m.Output()
+	if err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
 // --- Helpers ---
 
 func (g *MarotoGenerator) addHeader(m pdf.Maroto, title string) {
@@ -23,3 +23,19 @@ func TestGenerateReportCard(t *testing.T) {
 	assert.NotEmpty(t, pdfBytes)
 	assert.Contains(t, string(pdfBytes), "%PDF")
 }
+
+func TestGenerateMeetingSchedule(t *testing.T) {
+	gen := pdf.NewMarotoGenerator()
+
+	pdfBytes, err := gen.GenerateMeetingSchedule(&domain.MeetingSchedule{
+		Title:       "Colloqui generali",
+		TeacherName: "Maria Verdi",
+		Room:        "A1",
+		Entries: []domain.MeetingScheduleEntry{
+			{StartTime: "16:00", EndTime: "16:15", StudentName: "Luca Rossi", ParentName: "Anna Rossi"},
+			{StartTime: "16:15", EndTime: "16:30"},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, string(pdfBytes), "%PDF")
+}
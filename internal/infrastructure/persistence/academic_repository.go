@@ -1,6 +1,9 @@
 package persistence
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/k/iRegistro/internal/domain"
@@ -67,9 +70,12 @@ func (r *AcademicRepository) CreateClass(class *domain.Class) error {
 	return r.db.Create(class).Error
 }
 
-func (r *AcademicRepository) GetClassByID(id uint) (*domain.Class, error) {
+func (r *AcademicRepository) GetClassByID(ctx context.Context, id uint) (*domain.Class, error) {
 	var class domain.Class
-	if err := r.db.First(&class, id).Error; err != nil {
+	err := inTenant(ctx, r.db, func(tx *gorm.DB) error {
+		return tx.First(&class, id).Error
+	})
+	if err != nil {
 		return nil, err
 	}
 	return &class, nil
@@ -87,23 +93,46 @@ func (r *AcademicRepository) CreateStudent(student *domain.Student) error {
 	return r.db.Create(student).Error
 }
 
-func (r *AcademicRepository) GetStudentByID(id uint) (*domain.Student, error) {
+func (r *AcademicRepository) GetStudentByID(ctx context.Context, id uint) (*domain.Student, error) {
 	var student domain.Student
-	if err := r.db.First(&student, id).Error; err != nil {
+	err := inTenant(ctx, r.db, func(tx *gorm.DB) error {
+		return tx.First(&student, id).Error
+	})
+	if err != nil {
 		return nil, err
 	}
 	return &student, nil
 }
 
+// GetStudentByTaxCode returns the student of a tax code, in any school, or
+// nil.
+func (r *AcademicRepository) GetStudentByTaxCode(taxCode string) (*domain.Student, error) {
+	var student domain.Student
+	err := r.db.Where("tax_code = ?", taxCode).First(&student).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &student, nil
+}
+
+func (r *AcademicRepository) UpdateStudent(student *domain.Student) error {
+	return r.db.Save(student).Error
+}
+
 func (r *AcademicRepository) EnrollStudent(enrollment *domain.ClassEnrollment) error {
 	return r.db.Create(enrollment).Error
 }
 
-func (r *AcademicRepository) GetStudentsByClassID(classID uint, year string) ([]domain.Student, error) {
+func (r *AcademicRepository) GetStudentsByClassID(ctx context.Context, classID uint, year string) ([]domain.Student, error) {
 	var students []domain.Student
-	err := r.db.Joins("JOIN class_enrollments ON class_enrollments.student_id = students.id").
-		Where("class_enrollments.class_id = ? AND class_enrollments.year = ? AND class_enrollments.status = ?", classID, year, domain.EnrollmentActive).
-		Find(&students).Error
+	err := inTenant(ctx, r.db, func(tx *gorm.DB) error {
+		return tx.Joins("JOIN class_enrollments ON class_enrollments.student_id = students.id").
+			Where("class_enrollments.class_id = ? AND class_enrollments.year = ? AND class_enrollments.status = ?", classID, year, domain.EnrollmentActive).
+			Find(&students).Error
+	})
 	return students, err
 }
 
@@ -113,9 +142,12 @@ func (r *AcademicRepository) CreateSubject(subject *domain.Subject) error {
 	return r.db.Create(subject).Error
 }
 
-func (r *AcademicRepository) GetSubjectByID(id uint) (*domain.Subject, error) {
+func (r *AcademicRepository) GetSubjectByID(ctx context.Context, id uint) (*domain.Subject, error) {
 	var subject domain.Subject
-	if err := r.db.First(&subject, id).Error; err != nil {
+	err := inTenant(ctx, r.db, func(tx *gorm.DB) error {
+		return tx.First(&subject, id).Error
+	})
+	if err != nil {
 		return nil, err
 	}
 	return &subject, nil
@@ -196,6 +228,145 @@ func (r *AcademicRepository) GetAbsencesByClassID(classID uint, date time.Time)
 	return absences, err
 }
 
+func (r *AcademicRepository) GetAbsencesBySchoolID(schoolID uint, date time.Time) ([]domain.Absence, error) {
+	startOfDay := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+	endOfDay := startOfDay.Add(24 * time.Hour)
+
+	var absences []domain.Absence
+	err := r.db.Joins("JOIN classes ON classes.id = absences.class_id").
+		Where("classes.school_id = ? AND absences.date >= ? AND absences.date < ?", schoolID, startOfDay, endOfDay).
+		Find(&absences).Error
+	return absences, err
+}
+
 func (r *AcademicRepository) UpdateAbsence(absence *domain.Absence) error {
 	return r.db.Save(absence).Error
 }
+
+// --- Realtime audience ---
+
+// GetClassIDsForUser returns the classes a user belongs to: those a teacher
+// teaches or coordinates, a student's own and a parent's children's.
+func (r *AcademicRepository) GetClassIDsForUser(userID uint, role domain.Role) ([]uint, error) {
+	var ids []uint
+	var err error
+	switch role {
+	case domain.RoleTeacher:
+		err = r.db.Raw(`SELECT class_id FROM class_subject_assignments WHERE teacher_id = ? AND (end_date IS NULL OR end_date > NOW())
+			UNION SELECT id FROM classes WHERE coordinator_id = ?`, userID, userID).Scan(&ids).Error
+	case domain.RoleStudent, domain.RoleParent:
+		err = r.db.Model(&domain.ClassEnrollment{}).Distinct("class_enrollments.class_id").
+			Joins("JOIN students ON students.id = class_enrollments.student_id").
+			Where("class_enrollments.status = ?", domain.EnrollmentActive).
+			Where("students.user_id = ? OR students.parent_1_id = ? OR students.parent_2_id = ?", userID, userID, userID).
+			Pluck("class_enrollments.class_id", &ids).Error
+	}
+	return ids, err
+}
+
+// GetStudentClassIDs returns the classes a student is actively enrolled in.
+func (r *AcademicRepository) GetStudentClassIDs(studentID uint) ([]uint, error) {
+	var ids []uint
+	err := r.db.Model(&domain.ClassEnrollment{}).
+		Where("student_id = ? AND status = ?", studentID, domain.EnrollmentActive).
+		Pluck("class_id", &ids).Error
+	return ids, err
+}
+
+// GetStudentsByParentID returns the students whose parent 1 or 2 is
+// parentID.
+func (r *AcademicRepository) GetStudentsByParentID(parentID uint) ([]domain.Student, error) {
+	var students []domain.Student
+	err := r.db.Where("parent_1_id = ? OR parent_2_id = ?", parentID, parentID).Order("last_name, first_name").Find(&students).Error
+	return students, err
+}
+
+// GetStudentByUserID returns the student logging in as userID, or nil.
+func (r *AcademicRepository) GetStudentByUserID(userID uint) (*domain.Student, error) {
+	var student domain.Student
+	err := r.db.Where("user_id = ?", userID).First(&student).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &student, nil
+}
+
+// GetTeacherIDsForClasses returns the teachers currently teaching or
+// coordinating any of the classes.
+func (r *AcademicRepository) GetTeacherIDsForClasses(classIDs []uint) ([]uint, error) {
+	if len(classIDs) == 0 {
+		return nil, nil
+	}
+	var ids []uint
+	err := r.db.Raw(`SELECT teacher_id FROM class_subject_assignments WHERE class_id IN ? AND (end_date IS NULL OR end_date > NOW())
+		UNION SELECT coordinator_id FROM classes WHERE id IN ? AND coordinator_id IS NOT NULL`, classIDs, classIDs).Scan(&ids).Error
+	return ids, err
+}
+
+// GetAnnouncementAudience returns the parents, and optionally the
+// students, of the students actively enrolled in the classes of a school
+// matching scope and targetID.
+func (r *AcademicRepository) GetAnnouncementAudience(schoolID uint, scope domain.AnnouncementScope, targetID uint, includeStudents bool) ([]uint, error) {
+	q := r.db.Model(&domain.Student{}).
+		Select("students.user_id, students.parent_1_id, students.parent_2_id").
+		Joins("JOIN class_enrollments ON class_enrollments.student_id = students.id AND class_enrollments.status = ?", domain.EnrollmentActive).
+		Joins("JOIN classes ON classes.id = class_enrollments.class_id").
+		Where("classes.school_id = ?", schoolID)
+	switch scope {
+	case domain.ScopeClass:
+		q = q.Where("classes.id = ?", targetID)
+	case domain.ScopeGrade:
+		q = q.Where("classes.year = ?", targetID)
+	case domain.ScopeCampus:
+		q = q.Where("classes.campus_id = ?", targetID)
+	case domain.ScopeSchool:
+	default:
+		return nil, fmt.Errorf("unknown announcement scope %q", scope)
+	}
+
+	var rows []struct {
+		UserID    *uint
+		Parent1ID *uint `gorm:"column:parent_1_id"`
+		Parent2ID *uint `gorm:"column:parent_2_id"`
+	}
+	if err := q.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	seen := make(map[uint]bool)
+	var ids []uint
+	for _, row := range rows {
+		candidates := []*uint{row.Parent1ID, row.Parent2ID}
+		if includeStudents {
+			candidates = append(candidates, row.UserID)
+		}
+		for _, id := range candidates {
+			if id != nil && *id != 0 && !seen[*id] {
+				seen[*id] = true
+				ids = append(ids, *id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// GetStudentAudience returns the users allowed to see a student's records:
+// the student and their parents.
+func (r *AcademicRepository) GetStudentAudience(studentID uint) ([]uint, error) {
+	var student domain.Student
+	if err := r.db.Select("id", "user_id", "parent_1_id", "parent_2_id").First(&student, studentID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []uint
+	for _, id := range []*uint{student.UserID, student.Parent1ID, student.Parent2ID} {
+		if id != nil && *id != 0 {
+			ids = append(ids, *id)
+		}
+	}
+	return ids, nil
+}
@@ -1,6 +1,9 @@
 package persistence
 
 import (
+	"errors"
+	"time"
+
 	"github.com/k/iRegistro/internal/domain"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -42,6 +45,12 @@ func (r *AdminRepository) GetSchoolSettings(schoolID uint) ([]domain.SchoolSetti
 	return settings, err
 }
 
+func (r *AdminRepository) GetSchoolSettingsByKey(key string) ([]domain.SchoolSettings, error) {
+	var settings []domain.SchoolSettings
+	err := r.db.Where("key = ?", key).Find(&settings).Error
+	return settings, err
+}
+
 func (r *AdminRepository) UpsertSchoolSetting(setting *domain.SchoolSettings) error {
 	return r.db.Clauses(clause.OnConflict{
 		Columns:   []clause.Column{{Name: "school_id"}, {Name: "key"}},
@@ -58,6 +67,9 @@ func (r *AdminRepository) CreateUserImport(imp *domain.UserImport) error {
 func (r *AdminRepository) GetUserImport(id uint) (*domain.UserImport, error) {
 	var imp domain.UserImport
 	if err := r.db.First(&imp, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
 		return nil, err
 	}
 	return &imp, nil
@@ -76,6 +88,9 @@ func (r *AdminRepository) CreateDataExport(exp *domain.DataExport) error {
 func (r *AdminRepository) GetDataExport(id uint) (*domain.DataExport, error) {
 	var exp domain.DataExport
 	if err := r.db.First(&exp, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
 		return nil, err
 	}
 	return &exp, nil
@@ -84,3 +99,9 @@ func (r *AdminRepository) GetDataExport(id uint) (*domain.DataExport, error) {
 func (r *AdminRepository) UpdateDataExport(exp *domain.DataExport) error {
 	return r.db.Save(exp).Error
 }
+
+func (r *AdminRepository) GetExpiredDataExports(before time.Time) ([]domain.DataExport, error) {
+	var exports []domain.DataExport
+	err := r.db.Where("expiry_date < ? AND status <> ?", before, domain.ExportExpired).Find(&exports).Error
+	return exports, err
+}
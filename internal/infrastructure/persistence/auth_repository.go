@@ -40,3 +40,56 @@ func (r *AuthRepository) GetRefreshToken(tokenHash string) (*domain.RefreshToken
 	}
 	return &token, nil
 }
+
+func (r *AuthRepository) CreateAuthAuditLog(log *domain.AuthAuditLog) error {
+	return r.db.Create(log).Error
+}
+
+func (r *AuthRepository) RevokeUserSessions(userID uint) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&domain.RefreshToken{}).
+			Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&domain.Session{}).Error
+	})
+}
+
+func (r *AuthRepository) CreatePasswordResetToken(token *domain.PasswordResetToken) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		// Only the most recent link works
+		if err := tx.Model(&domain.PasswordResetToken{}).
+			Where("user_id = ? AND used_at IS NULL", token.UserID).
+			Update("used_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return tx.Create(token).Error
+	})
+}
+
+func (r *AuthRepository) GetPasswordResetToken(selector string) (*domain.PasswordResetToken, error) {
+	var token domain.PasswordResetToken
+	if err := r.db.Where("selector = ?", selector).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (r *AuthRepository) UsePasswordResetToken(id uint) (bool, error) {
+	res := r.db.Model(&domain.PasswordResetToken{}).
+		Where("id = ? AND used_at IS NULL", id).
+		Update("used_at", time.Now())
+	return res.RowsAffected == 1, res.Error
+}
+
+func (r *AuthRepository) CountPasswordResetTokens(userID uint, since time.Time) (int64, error) {
+	var count int64
+	err := r.db.Model(&domain.PasswordResetToken{}).
+		Where("user_id = ? AND created_at >= ?", userID, since).
+		Count(&count).Error
+	return count, err
+}
@@ -0,0 +1,120 @@
+package persistence
+
+import (
+	"errors"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"gorm.io/gorm"
+)
+
+type CalendarRepository struct {
+	db *gorm.DB
+}
+
+func NewCalendarRepository(db *gorm.DB) *CalendarRepository {
+	return &CalendarRepository{db: db}
+}
+
+// --- Tokens ---
+
+func (r *CalendarRepository) CreateCalendarToken(token *domain.CalendarToken) error {
+	return r.db.Create(token).Error
+}
+
+func (r *CalendarRepository) GetCalendarTokenByHash(hash string) (*domain.CalendarToken, error) {
+	var token domain.CalendarToken
+	err := r.db.Where("token_hash = ?", hash).First(&token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (r *CalendarRepository) GetCalendarTokensByUserID(userID uint) ([]domain.CalendarToken, error) {
+	var tokens []domain.CalendarToken
+	err := r.db.Where("user_id = ? AND revoked_at IS NULL", userID).Order("created_at").Find(&tokens).Error
+	return tokens, err
+}
+
+func (r *CalendarRepository) RevokeCalendarToken(id, userID uint, at time.Time) (bool, error) {
+	res := r.db.Model(&domain.CalendarToken{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, userID).
+		Update("revoked_at", at)
+	return res.RowsAffected == 1, res.Error
+}
+
+func (r *CalendarRepository) TouchCalendarToken(id uint, at time.Time) error {
+	return r.db.Model(&domain.CalendarToken{}).Where("id = ?", id).Update("last_used_at", at).Error
+}
+
+// --- Homework and events ---
+
+func (r *CalendarRepository) CreateHomework(homework *domain.Homework) error {
+	return r.db.Create(homework).Error
+}
+
+func (r *CalendarRepository) GetHomework(classIDs []uint, teacherID uint, from, to time.Time) ([]domain.Homework, error) {
+	var homework []domain.Homework
+	q := r.db.Where("due_date >= ? AND due_date <= ?", from, to)
+	if teacherID != 0 {
+		q = q.Where("class_id IN ? OR teacher_id = ?", nonEmpty(classIDs), teacherID)
+	} else {
+		q = q.Where("class_id IN ?", nonEmpty(classIDs))
+	}
+	err := q.Order("due_date, id").Find(&homework).Error
+	return homework, err
+}
+
+func (r *CalendarRepository) CreateSchoolEvent(event *domain.SchoolEvent) error {
+	return r.db.Create(event).Error
+}
+
+func (r *CalendarRepository) GetSchoolEvents(schoolID uint, classIDs []uint, from, to time.Time) ([]domain.SchoolEvent, error) {
+	var events []domain.SchoolEvent
+	err := r.db.Where("school_id = ? AND (class_id IS NULL OR class_id IN ?) AND ends_at >= ? AND starts_at <= ?", schoolID, nonEmpty(classIDs), from, to).
+		Order("starts_at, id").
+		Find(&events).Error
+	return events, err
+}
+
+// --- Timetables and colloquiums ---
+
+func (r *CalendarRepository) GetSchedules(schoolID uint, at time.Time) ([]domain.Schedule, error) {
+	var schedules []domain.Schedule
+	err := r.db.Joins("JOIN classes ON classes.id = schedules.class_id").
+		Where("classes.school_id = ? AND (schedules.valid_to IS NULL OR schedules.valid_to >= ?)", schoolID, at).
+		Order("schedules.class_id, schedules.version").
+		Find(&schedules).Error
+	return schedules, err
+}
+
+func (r *CalendarRepository) GetTeacherColloquiums(teacherID uint, from, to time.Time) ([]domain.ColloquiumSlot, error) {
+	var slots []domain.ColloquiumSlot
+	err := r.db.Preload("Bookings", "status = ?", domain.BookingConfirmed).
+		Where("teacher_id = ? AND date >= ? AND date <= ? AND is_available = ?", teacherID, from, to, true).
+		Where("EXISTS (SELECT 1 FROM colloquium_bookings b WHERE b.slot_id = colloquium_slots.id AND b.status = ?)", domain.BookingConfirmed).
+		Order("date, start_time").
+		Find(&slots).Error
+	return slots, err
+}
+
+func (r *CalendarRepository) GetParentColloquiums(parentID uint, from, to time.Time) ([]domain.ColloquiumBooking, error) {
+	var bookings []domain.ColloquiumBooking
+	err := r.db.Joins("Slot").
+		Where("colloquium_bookings.parent_id = ? AND colloquium_bookings.status = ? AND \"Slot\".date >= ? AND \"Slot\".date <= ?", parentID, domain.BookingConfirmed, from, to).
+		Order("\"Slot\".date, \"Slot\".start_time").
+		Find(&bookings).Error
+	return bookings, err
+}
+
+// nonEmpty avoids "IN ()", a syntax error, for an empty list of ids.
+func nonEmpty(ids []uint) []uint {
+	if len(ids) == 0 {
+		return []uint{0}
+	}
+	return ids
+}
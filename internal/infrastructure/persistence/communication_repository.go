@@ -1,10 +1,17 @@
 package persistence
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/k/iRegistro/internal/domain"
+	"github.com/k/iRegistro/internal/tenant"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type CommunicationRepository struct {
@@ -23,7 +30,8 @@ func (r *CommunicationRepository) CreateNotification(n *domain.Notification) err
 
 func (r *CommunicationRepository) GetNotificationsByUserID(userID uint, archived bool) ([]domain.Notification, error) {
 	var notifs []domain.Notification
-	err := r.db.Where("user_id = ? AND is_archived = ?", userID, archived).
+	err := r.db.Preload("Deliveries").
+		Where("user_id = ? AND is_archived = ?", userID, archived).
 		Order("created_at desc").
 		Find(&notifs).Error
 	return notifs, err
@@ -33,6 +41,12 @@ func (r *CommunicationRepository) MarkNotificationRead(id uint) error {
 	return r.db.Model(&domain.Notification{}).Where("id = ?", id).Update("is_read", true).Error
 }
 
+func (r *CommunicationRepository) MarkNotificationDelivered(id, userID uint, at time.Time) error {
+	return r.db.Model(&domain.Notification{}).
+		Where("id = ? AND user_id = ? AND delivered_at IS NULL", id, userID).
+		Update("delivered_at", at).Error
+}
+
 func (r *CommunicationRepository) ArchiveNotification(id uint) error {
 	return r.db.Model(&domain.Notification{}).Where("id = ?", id).Update("is_archived", true).Error
 }
@@ -47,6 +61,152 @@ func (r *CommunicationRepository) SavePreferences(prefs []domain.NotificationPre
 	return r.db.Save(prefs).Error
 }
 
+func (r *CommunicationRepository) GetNotificationSettings(userID uint) (*domain.NotificationSettings, error) {
+	var settings domain.NotificationSettings
+	if err := r.db.First(&settings, "user_id = ?", userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &settings, nil
+}
+
+func (r *CommunicationRepository) SaveNotificationSettings(settings *domain.NotificationSettings) error {
+	return r.db.Save(settings).Error
+}
+
+func (r *CommunicationRepository) GetNotificationByID(id uint) (*domain.Notification, error) {
+	var n domain.Notification
+	if err := r.db.First(&n, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &n, nil
+}
+
+// --- Deliveries ---
+
+func (r *CommunicationRepository) CreateDelivery(d *domain.NotificationDelivery) error {
+	return r.db.Create(d).Error
+}
+
+func (r *CommunicationRepository) UpdateDelivery(d *domain.NotificationDelivery) error {
+	return r.db.Save(d).Error
+}
+
+func (r *CommunicationRepository) CreateDeliveryAttempt(a *domain.DeliveryAttempt) error {
+	return r.db.Create(a).Error
+}
+
+func (r *CommunicationRepository) ClaimDueDeliveries(status domain.DeliveryStatus, now time.Time, lease time.Duration, limit int) ([]domain.NotificationDelivery, error) {
+	var deliveries []domain.NotificationDelivery
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", status, now).
+			Order("next_attempt_at").
+			Limit(limit).
+			Find(&deliveries).Error; err != nil {
+			return err
+		}
+		if len(deliveries) == 0 {
+			return nil
+		}
+		ids := make([]uint, len(deliveries))
+		for i, d := range deliveries {
+			ids[i] = d.ID
+		}
+		return tx.Model(&domain.NotificationDelivery{}).
+			Where("id IN ?", ids).
+			Update("next_attempt_at", now.Add(lease)).Error
+	})
+	return deliveries, err
+}
+
+func (r *CommunicationRepository) CountDeliveryIssues(schoolID uint, since time.Time) (int64, error) {
+	var count int64
+	err := r.db.Model(&domain.NotificationDelivery{}).
+		Where("school_id = ? AND status IN ? AND updated_at >= ?",
+			schoolID, []domain.DeliveryStatus{domain.DeliveryBounced, domain.DeliveryFailed}, since).
+		Count(&count).Error
+	return count, err
+}
+
+// --- Push subscriptions ---
+
+func (r *CommunicationRepository) SavePushSubscription(sub *domain.PushSubscription) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "endpoint"}},
+		DoUpdates: clause.AssignmentColumns([]string{"user_id", "p256dh", "auth", "user_agent", "updated_at"}),
+	}).Create(sub).Error
+}
+
+func (r *CommunicationRepository) GetPushSubscriptions(userID uint) ([]domain.PushSubscription, error) {
+	var subs []domain.PushSubscription
+	err := r.db.Where("user_id = ?", userID).Find(&subs).Error
+	return subs, err
+}
+
+func (r *CommunicationRepository) DeletePushSubscription(userID uint, endpoint string) error {
+	return r.db.Where("user_id = ? AND endpoint = ?", userID, endpoint).Delete(&domain.PushSubscription{}).Error
+}
+
+func (r *CommunicationRepository) DeletePushSubscriptionByEndpoint(endpoint string) error {
+	return r.db.Where("endpoint = ?", endpoint).Delete(&domain.PushSubscription{}).Error
+}
+
+// --- SMS ---
+
+func (r *CommunicationRepository) ReserveSMSSegments(schoolID uint, month string, segments, quota int) (bool, error) {
+	if err := r.db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&domain.SMSUsage{SchoolID: schoolID, Month: month}).Error; err != nil {
+		return false, err
+	}
+	// The quota check and the increment are a single statement, so concurrent
+	// senders cannot overrun it.
+	query := r.db.Model(&domain.SMSUsage{}).Where("school_id = ? AND month = ?", schoolID, month)
+	if quota > 0 {
+		query = query.Where("segments + ? <= ?", segments, quota)
+	}
+	res := query.Updates(map[string]interface{}{
+		"segments":   gorm.Expr("segments + ?", segments),
+		"updated_at": time.Now(),
+	})
+	return res.RowsAffected == 1, res.Error
+}
+
+func (r *CommunicationRepository) AddSMSUsage(schoolID uint, month string, messages, segments, costCents int) error {
+	return r.db.Model(&domain.SMSUsage{}).Where("school_id = ? AND month = ?", schoolID, month).
+		Updates(map[string]interface{}{
+			"messages":   gorm.Expr("messages + ?", messages),
+			"segments":   gorm.Expr("GREATEST(segments + ?, 0)", segments),
+			"cost_cents": gorm.Expr("cost_cents + ?", costCents),
+			"updated_at": time.Now(),
+		}).Error
+}
+
+func (r *CommunicationRepository) GetSMSUsage(schoolID uint, month string) (*domain.SMSUsage, error) {
+	var usage domain.SMSUsage
+	err := r.db.Where("school_id = ? AND month = ?", schoolID, month).First(&usage).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func (r *CommunicationRepository) CreateAbsenceAlert(alert *domain.AbsenceAlert) (bool, error) {
+	res := r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "student_id"}, {Name: "date"}},
+		DoNothing: true,
+	}).Create(alert)
+	return res.RowsAffected == 1, res.Error
+}
+
 // --- Messaging ---
 
 func (r *CommunicationRepository) CreateConversation(c *domain.Conversation) error {
@@ -72,14 +232,50 @@ func (r *CommunicationRepository) GetConversationsByUserID(userID uint) ([]domai
 	return convs, err
 }
 
-func (r *CommunicationRepository) GetConversationByID(id uint) (*domain.Conversation, error) {
+func (r *CommunicationRepository) GetConversationByID(ctx context.Context, id uint) (*domain.Conversation, error) {
 	var c domain.Conversation
-	if err := r.db.Preload("Messages").First(&c, id).Error; err != nil {
+	err := inTenant(ctx, r.db, func(tx *gorm.DB) error {
+		return tx.First(&c, id).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
 		return nil, err
 	}
 	return &c, nil
 }
 
+// AddConversationParticipants updates the array in SQL, like
+// RemoveConversationParticipant, so that concurrent changes do not overwrite
+// each other.
+func (r *CommunicationRepository) AddConversationParticipants(convID uint, userIDs []uint) error {
+	ids, err := json.Marshal(userIDs)
+	if err != nil {
+		return err
+	}
+	return r.db.Exec(`UPDATE conversations SET participant_ids = (
+			SELECT jsonb_agg(DISTINCT e) FROM jsonb_array_elements(COALESCE(participant_ids, '[]'::jsonb) || ?::jsonb) e)
+		WHERE id = ?`, string(ids), convID).Error
+}
+
+func (r *CommunicationRepository) RemoveConversationParticipant(convID, userID uint) error {
+	return r.db.Exec(`UPDATE conversations SET participant_ids = COALESCE((
+			SELECT jsonb_agg(e) FROM jsonb_array_elements(participant_ids) e WHERE e <> ?::jsonb), '[]'::jsonb)
+		WHERE id = ?`, strconv.FormatUint(uint64(userID), 10), convID).Error
+}
+
+func (r *CommunicationRepository) GetMessageByID(id uint) (*domain.Message, error) {
+	var m domain.Message
+	if err := r.db.First(&m, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &m, nil
+}
+
 func (r *CommunicationRepository) CreateMessage(m *domain.Message) error {
 	return r.db.Transaction(func(tx *gorm.DB) error {
 		if err := tx.Create(m).Error; err != nil {
@@ -105,6 +301,117 @@ func (r *CommunicationRepository) SoftDeleteMessage(id uint) error {
 	return r.db.Model(&domain.Message{}).Where("id = ?", id).Update("is_deleted", true).Error
 }
 
+func (r *CommunicationRepository) SaveConversationRead(read *domain.ConversationRead) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "conversation_id"}, {Name: "user_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"last_read_message_id": gorm.Expr("GREATEST(conversation_reads.last_read_message_id, EXCLUDED.last_read_message_id)"),
+			"read_at":              gorm.Expr("EXCLUDED.read_at"),
+		}),
+	}).Create(read).Error
+}
+
+// --- Attachments ---
+
+func (r *CommunicationRepository) CreateAttachment(a *domain.Attachment) error {
+	return r.db.Create(a).Error
+}
+
+func (r *CommunicationRepository) GetAttachmentByID(id uint) (*domain.Attachment, error) {
+	var a domain.Attachment
+	if err := r.db.First(&a, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (r *CommunicationRepository) GetAttachmentsByIDs(ids []uint) ([]domain.Attachment, error) {
+	var atts []domain.Attachment
+	err := r.db.Where("id IN ?", ids).Order("id").Find(&atts).Error
+	return atts, err
+}
+
+func (r *CommunicationRepository) LinkAttachments(messageID uint, ids []uint) error {
+	return r.db.Model(&domain.Attachment{}).
+		Where("id IN ? AND message_id IS NULL", ids).
+		Update("message_id", messageID).Error
+}
+
+// --- Announcements ---
+
+func (r *CommunicationRepository) CreateAnnouncement(a *domain.Announcement, conv *domain.Conversation, msg *domain.Message, recipients []uint) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(conv).Error; err != nil {
+			return err
+		}
+		msg.ConversationID = conv.ID
+		if err := tx.Create(msg).Error; err != nil {
+			return err
+		}
+		a.ConversationID = conv.ID
+		if err := tx.Create(a).Error; err != nil {
+			return err
+		}
+		rows := make([]domain.AnnouncementRecipient, len(recipients))
+		for i, id := range recipients {
+			rows[i] = domain.AnnouncementRecipient{AnnouncementID: a.ID, UserID: id}
+		}
+		return tx.CreateInBatches(rows, 500).Error
+	})
+}
+
+func (r *CommunicationRepository) GetAnnouncementByID(id uint) (*domain.Announcement, error) {
+	var a domain.Announcement
+	if err := r.db.First(&a, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (r *CommunicationRepository) GetAnnouncementsByUserID(userID uint) ([]domain.Announcement, error) {
+	var announcements []domain.Announcement
+	err := r.db.Where("author_id = ? OR id IN (?)", userID,
+		r.db.Model(&domain.AnnouncementRecipient{}).Select("announcement_id").Where("user_id = ?", userID)).
+		Order("created_at desc").
+		Find(&announcements).Error
+	return announcements, err
+}
+
+func (r *CommunicationRepository) GetAnnouncementRecipients(announcementID uint) ([]domain.AnnouncementRecipient, error) {
+	var recipients []domain.AnnouncementRecipient
+	err := r.db.Where("announcement_id = ?", announcementID).Order("user_id").Find(&recipients).Error
+	return recipients, err
+}
+
+func (r *CommunicationRepository) MarkAnnouncementRead(announcementID, userID uint, at time.Time) (bool, error) {
+	// Keeps the first reading
+	res := r.db.Model(&domain.AnnouncementRecipient{}).
+		Where("announcement_id = ? AND user_id = ?", announcementID, userID).
+		Update("read_at", gorm.Expr("COALESCE(read_at, ?)", at))
+	return res.RowsAffected == 1, res.Error
+}
+
+func (r *CommunicationRepository) RecordAnnouncementReminder(announcementID uint, userIDs []uint, at time.Time) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&domain.Announcement{}).Where("id = ?", announcementID).
+			Update("last_reminder_at", at).Error; err != nil {
+			return err
+		}
+		if len(userIDs) == 0 {
+			return nil
+		}
+		return tx.Model(&domain.AnnouncementRecipient{}).
+			Where("announcement_id = ? AND user_id IN ?", announcementID, userIDs).
+			Update("reminded_at", at).Error
+	})
+}
+
 // --- Colloquiums ---
 
 func (r *CommunicationRepository) CreateColloquiumSlot(slot *domain.ColloquiumSlot) error {
@@ -130,6 +437,9 @@ func (r *CommunicationRepository) GetSlotsByTeacherID(teacherID uint) ([]domain.
 func (r *CommunicationRepository) GetSlotByID(id uint) (*domain.ColloquiumSlot, error) {
 	var slot domain.ColloquiumSlot
 	if err := r.db.First(&slot, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
 		return nil, err
 	}
 	return &slot, nil
@@ -143,9 +453,224 @@ func (r *CommunicationRepository) DeleteSlot(id uint) error {
 	return r.db.Delete(&domain.ColloquiumSlot{}, id).Error
 }
 
-func (r *CommunicationRepository) CreateBooking(booking *domain.ColloquiumBooking) error {
-	// Transaction to check availability? Service layer might handle it, but DB constraints help.
-	return r.db.Create(booking).Error
+func (r *CommunicationRepository) BookSlot(booking *domain.ColloquiumBooking) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		slot, err := lockSlot(tx, booking.SlotID)
+		if err != nil {
+			return err
+		}
+		if !slot.IsAvailable {
+			return domain.ErrSlotUnavailable
+		}
+
+		var active []domain.ColloquiumBooking
+		if err := tx.Where("slot_id = ? AND status <> ?", slot.ID, domain.BookingCancelled).Find(&active).Error; err != nil {
+			return err
+		}
+		confirmed, waiting := 0, 0
+		for _, b := range active {
+			if b.ParentID == booking.ParentID && b.StudentID == booking.StudentID {
+				return domain.ErrAlreadyBooked
+			}
+			if b.Status == domain.BookingConfirmed {
+				confirmed++
+			} else {
+				waiting++
+			}
+		}
+
+		booking.Status = domain.BookingConfirmed
+		if confirmed >= slot.MaxParticipants {
+			booking.Status = domain.BookingWaitlisted
+			booking.WaitlistPosition = waiting + 1
+		}
+		return tx.Create(booking).Error
+	})
+}
+
+func (r *CommunicationRepository) GetBookingByID(ctx context.Context, id uint) (*domain.ColloquiumBooking, error) {
+	var booking domain.ColloquiumBooking
+	err := withTenant(ctx, r.db, func(tx *gorm.DB, t tenant.Tenant) error {
+		if !t.AllSchools() {
+			// Bookings belong to the school of the teacher of their slot
+			tx = tx.Where("slot_id IN (SELECT s.id FROM colloquium_slots s JOIN users u ON u.id = s.teacher_id WHERE u.school_id = ?)", t.SchoolID)
+		}
+		return tx.Preload("Slot").First(&booking, id).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &booking, nil
+}
+
+func (r *CommunicationRepository) CancelBooking(id uint, at time.Time) (*domain.ColloquiumBooking, error) {
+	var promoted *domain.ColloquiumBooking
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var booking domain.ColloquiumBooking
+		if err := tx.First(&booking, id).Error; err != nil {
+			return err
+		}
+		// Bookings and promotions of the slot wait for us; read the booking
+		// again as one of them may have confirmed it
+		if _, err := lockSlot(tx, booking.SlotID); err != nil {
+			return err
+		}
+		if err := tx.First(&booking, id).Error; err != nil {
+			return err
+		}
+		res := tx.Model(&domain.ColloquiumBooking{}).
+			Where("id = ? AND status <> ?", id, domain.BookingCancelled).
+			Updates(map[string]interface{}{"status": domain.BookingCancelled, "cancelled_at": at})
+		if res.Error != nil || res.RowsAffected == 0 || booking.Status != domain.BookingConfirmed {
+			return res.Error
+		}
+
+		var next domain.ColloquiumBooking
+		err := tx.Where("slot_id = ? AND status = ?", booking.SlotID, domain.BookingWaitlisted).
+			Order("booked_at, id").
+			First(&next).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		next.Status = domain.BookingConfirmed
+		if err := tx.Model(&next).Update("status", domain.BookingConfirmed).Error; err != nil {
+			return err
+		}
+		promoted = &next
+		return nil
+	})
+	return promoted, err
+}
+
+func (r *CommunicationRepository) CancelSlot(slotID uint, at time.Time) ([]domain.ColloquiumBooking, error) {
+	var cancelled []domain.ColloquiumBooking
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if _, err := lockSlot(tx, slotID); err != nil {
+			return err
+		}
+		if err := tx.Model(&domain.ColloquiumSlot{}).Where("id = ?", slotID).Update("is_available", false).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("slot_id = ? AND status <> ?", slotID, domain.BookingCancelled).Find(&cancelled).Error; err != nil {
+			return err
+		}
+		return tx.Model(&domain.ColloquiumBooking{}).
+			Where("slot_id = ? AND status <> ?", slotID, domain.BookingCancelled).
+			Updates(map[string]interface{}{"status": domain.BookingCancelled, "cancelled_at": at}).Error
+	})
+	return cancelled, err
+}
+
+func (r *CommunicationRepository) CheckInSlot(slotID uint, at time.Time) error {
+	return r.db.Model(&domain.ColloquiumSlot{}).
+		Where("id = ? AND checked_in_at IS NULL", slotID).
+		Update("checked_in_at", at).Error
+}
+
+func (r *CommunicationRepository) GetFollowUpSlots(from, to time.Time) ([]domain.ColloquiumSlot, error) {
+	var slots []domain.ColloquiumSlot
+	err := r.db.Preload("Bookings", "status = ?", domain.BookingConfirmed).
+		Where("date >= ? AND date <= ? AND is_available = ? AND follow_up_sent_at IS NULL", from, to, true).
+		Order("date, start_time").
+		Find(&slots).Error
+	return slots, err
+}
+
+func (r *CommunicationRepository) MarkSlotLateSent(slotID uint, at time.Time) (bool, error) {
+	return r.markSlotNotice(slotID, "late_sent_at", at)
+}
+
+func (r *CommunicationRepository) MarkSlotFollowUpSent(slotID uint, at time.Time) (bool, error) {
+	return r.markSlotNotice(slotID, "follow_up_sent_at", at)
+}
+
+// markSlotNotice sets column, a notice time, if it is still null.
+func (r *CommunicationRepository) markSlotNotice(slotID uint, column string, at time.Time) (bool, error) {
+	res := r.db.Model(&domain.ColloquiumSlot{}).
+		Where("id = ? AND "+column+" IS NULL", slotID).
+		Update(column, at)
+	return res.RowsAffected == 1, res.Error
+}
+
+// --- Meeting days ---
+
+func (r *CommunicationRepository) CreateMeetingDay(day *domain.MeetingDay, slots []domain.ColloquiumSlot) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(day).Error; err != nil {
+			return err
+		}
+		if len(slots) == 0 {
+			return nil
+		}
+		for i := range slots {
+			slots[i].MeetingDayID = &day.ID
+		}
+		return tx.CreateInBatches(slots, 500).Error
+	})
+}
+
+func (r *CommunicationRepository) GetMeetingDayByID(id uint) (*domain.MeetingDay, error) {
+	var day domain.MeetingDay
+	if err := r.db.Preload("Teachers").First(&day, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &day, nil
+}
+
+func (r *CommunicationRepository) GetMeetingDaySlots(dayID uint) ([]domain.ColloquiumSlot, error) {
+	var slots []domain.ColloquiumSlot
+	err := r.db.Preload("Bookings", "status <> ?", domain.BookingCancelled).
+		Where("meeting_day_id = ?", dayID).
+		Order("teacher_id, start_time").
+		Find(&slots).Error
+	return slots, err
+}
+
+func (r *CommunicationRepository) BookSlots(bookings []*domain.ColloquiumBooking) error {
+	// Lock in a fixed order, so that parents booking overlapping sequences
+	// do not deadlock
+	sorted := append([]*domain.ColloquiumBooking(nil), bookings...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].SlotID < sorted[j].SlotID })
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		for _, b := range sorted {
+			slot, err := lockSlot(tx, b.SlotID)
+			if err != nil {
+				return err
+			}
+			var confirmed int64
+			if err := tx.Model(&domain.ColloquiumBooking{}).
+				Where("slot_id = ? AND status = ?", slot.ID, domain.BookingConfirmed).
+				Count(&confirmed).Error; err != nil {
+				return err
+			}
+			if !slot.IsAvailable || confirmed >= int64(slot.MaxParticipants) {
+				return domain.ErrSlotUnavailable
+			}
+			b.Status = domain.BookingConfirmed
+			if err := tx.Create(b).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// lockSlot reads a slot, locking it until the end of the transaction.
+func lockSlot(tx *gorm.DB, id uint) (*domain.ColloquiumSlot, error) {
+	var slot domain.ColloquiumSlot
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&slot, id).Error; err != nil {
+		return nil, err
+	}
+	return &slot, nil
 }
 
 func (r *CommunicationRepository) GetBookingsBySlotID(slotID uint) ([]domain.ColloquiumBooking, error) {
@@ -161,17 +686,22 @@ func (r *CommunicationRepository) GetBookingsByParentID(parentID uint) ([]domain
 }
 
 func (r *CommunicationRepository) GetBookingsByDateRange(from, to time.Time) ([]domain.ColloquiumBooking, error) {
-	// Join with Slot to check Date? Or just check if booking has date?
-	// Bookings don't have date, Slots have date.
 	var bookings []domain.ColloquiumBooking
 	err := r.db.Joins("Slot").
-		Where("Slot.date >= ? AND Slot.date <= ?", from, to).
+		Where(`"Slot".date >= ? AND "Slot".date < ? AND colloquium_bookings.status = ?`, from, to, domain.BookingConfirmed).
 		Find(&bookings).Error
 	return bookings, err
 }
 
+func (r *CommunicationRepository) MarkBookingReminderSent(bookingID uint, at time.Time) (bool, error) {
+	res := r.db.Model(&domain.ColloquiumBooking{}).
+		Where("id = ? AND reminder_sent_at IS NULL", bookingID).
+		Update("reminder_sent_at", at)
+	return res.RowsAffected == 1, res.Error
+}
+
 func (r *CommunicationRepository) UpdateBooking(booking *domain.ColloquiumBooking) error {
-	return r.db.Save(booking).Error
+	return r.db.Omit(clause.Associations).Save(booking).Error
 }
 
 func (r *CommunicationRepository) DeleteBooking(id uint) error {
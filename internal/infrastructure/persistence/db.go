@@ -10,11 +10,14 @@ import (
 	"gorm.io/gorm/logger"
 )
 
-func NewDB(cfg config.DatabaseConfig) (*gorm.DB, error) {
-	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=%s",
+// DSN is the connection string for cfg.
+func DSN(cfg config.DatabaseConfig) string {
+	return fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=%s",
 		cfg.Host, cfg.User, cfg.Password, cfg.Name, cfg.Port, cfg.SSLMode)
+}
 
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+func NewDB(cfg config.DatabaseConfig) (*gorm.DB, error) {
+	db, err := gorm.Open(postgres.Open(DSN(cfg)), &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Info),
 	})
 	if err != nil {
@@ -30,6 +33,27 @@ func NewDB(cfg config.DatabaseConfig) (*gorm.DB, error) {
 		&domain.User{},
 		&domain.Session{},
 		&domain.RefreshToken{},
+		&domain.AuthAuditLog{},
+		&domain.PendingIdentity{},
+		&domain.SAMLRequest{},
+		&domain.SAMLAssertionUse{},
+		&domain.WebAuthnCredential{},
+		&domain.RecoveryCode{},
+		&domain.WebAuthnCeremony{},
+		&domain.PasswordResetToken{},
+		&domain.NotificationDelivery{},
+		&domain.DeliveryAttempt{},
+		&domain.NotificationSettings{},
+		&domain.PushSubscription{},
+		&domain.SMSUsage{},
+		&domain.AbsenceAlert{},
+		&domain.ConversationRead{},
+		&domain.Announcement{},
+		&domain.AnnouncementRecipient{},
+		&domain.Attachment{},
+		&domain.MeetingDay{}, &domain.MeetingDayTeacher{},
+		&domain.CalendarToken{}, &domain.Homework{}, &domain.SchoolEvent{},
+		&domain.Job{},
 		&domain.School{},
 		&domain.Campus{},
 		&domain.Curriculum{},
@@ -39,6 +63,7 @@ func NewDB(cfg config.DatabaseConfig) (*gorm.DB, error) {
 		&domain.ClassSubjectAssignment{},
 		&domain.Student{},
 		&domain.ClassEnrollment{},
+		&domain.StudentOutcome{},
 		&domain.Mark{},
 		&domain.Absence{},
 		&domain.Schedule{},
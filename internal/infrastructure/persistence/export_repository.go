@@ -0,0 +1,65 @@
+package persistence
+
+import (
+	"github.com/k/iRegistro/internal/domain"
+	"gorm.io/gorm"
+)
+
+// exportBatchSize is the number of rows read at a time by the export
+// queries, so that exports of large schools do not load whole tables.
+const exportBatchSize = 500
+
+// ExportRepository reads every record of a school, in batches ordered by id.
+type ExportRepository struct {
+	db *gorm.DB
+}
+
+func NewExportRepository(db *gorm.DB) *ExportRepository {
+	return &ExportRepository{db: db}
+}
+
+// inBatches calls fn with the rows of q, exportBatchSize at a time.
+func inBatches[T any](q *gorm.DB, fn func([]T) error) error {
+	var batch []T
+	return q.FindInBatches(&batch, exportBatchSize, func(tx *gorm.DB, _ int) error {
+		return fn(batch)
+	}).Error
+}
+
+// schoolClasses selects the ids of the classes of the school, for the
+// records that only reference their class.
+func (r *ExportRepository) schoolClasses(schoolID uint) *gorm.DB {
+	return r.db.Model(&domain.Class{}).Select("id").Where("school_id = ?", schoolID)
+}
+
+func (r *ExportRepository) ExportUsers(schoolID uint, fn func([]domain.User) error) error {
+	return inBatches(r.db.Where("school_id = ?", schoolID), fn)
+}
+
+func (r *ExportRepository) ExportStudents(schoolID uint, fn func([]domain.Student) error) error {
+	return inBatches(r.db.Where("school_id = ?", schoolID), fn)
+}
+
+func (r *ExportRepository) ExportClasses(schoolID uint, fn func([]domain.Class) error) error {
+	return inBatches(r.db.Where("school_id = ?", schoolID), fn)
+}
+
+func (r *ExportRepository) ExportSubjects(schoolID uint, fn func([]domain.Subject) error) error {
+	return inBatches(r.db.Where("school_id = ?", schoolID), fn)
+}
+
+func (r *ExportRepository) ExportEnrollments(schoolID uint, fn func([]domain.ClassEnrollment) error) error {
+	return inBatches(r.db.Where("class_id IN (?)", r.schoolClasses(schoolID)), fn)
+}
+
+func (r *ExportRepository) ExportMarks(schoolID uint, fn func([]domain.Mark) error) error {
+	return inBatches(r.db.Where("class_id IN (?)", r.schoolClasses(schoolID)), fn)
+}
+
+func (r *ExportRepository) ExportAbsences(schoolID uint, fn func([]domain.Absence) error) error {
+	return inBatches(r.db.Where("class_id IN (?)", r.schoolClasses(schoolID)), fn)
+}
+
+func (r *ExportRepository) ExportDocuments(schoolID uint, fn func([]domain.Document) error) error {
+	return inBatches(r.db.Omit("data").Where("school_id = ?", schoolID), fn)
+}
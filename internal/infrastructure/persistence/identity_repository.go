@@ -0,0 +1,78 @@
+package persistence
+
+import (
+	"errors"
+
+	"github.com/k/iRegistro/internal/domain"
+	"gorm.io/gorm"
+)
+
+type IdentityRepository struct {
+	db *gorm.DB
+}
+
+func NewIdentityRepository(db *gorm.DB) *IdentityRepository {
+	return &IdentityRepository{db: db}
+}
+
+func (r *IdentityRepository) FindUsersByTaxCode(taxCode string) ([]domain.User, error) {
+	var users []domain.User
+	if taxCode == "" {
+		return users, nil
+	}
+	err := r.db.Where("UPPER(tax_code) = ?", taxCode).Find(&users).Error
+	return users, err
+}
+
+func (r *IdentityRepository) CreatePendingIdentity(p *domain.PendingIdentity) error {
+	return r.db.Create(p).Error
+}
+
+func (r *IdentityRepository) GetPendingIdentityByID(id uint) (*domain.PendingIdentity, error) {
+	var p domain.PendingIdentity
+	if err := r.db.First(&p, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &p, nil
+}
+
+// GetOpenPendingIdentityByExternalID returns the identity record still awaiting
+// confirmation or approval, if any.
+func (r *IdentityRepository) GetOpenPendingIdentityByExternalID(externalID string) (*domain.PendingIdentity, error) {
+	var p domain.PendingIdentity
+	err := r.db.Where("external_id = ? AND status IN ?", externalID,
+		[]domain.IdentityStatus{domain.IdentityAwaitingConfirmation, domain.IdentityPendingApproval}).
+		Order("created_at DESC").First(&p).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (r *IdentityRepository) GetPendingIdentityByTokenHash(tokenHash string) (*domain.PendingIdentity, error) {
+	var p domain.PendingIdentity
+	if err := r.db.Where("confirm_token_hash = ?", tokenHash).First(&p).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (r *IdentityRepository) ListPendingIdentities(schoolID uint, status domain.IdentityStatus) ([]domain.PendingIdentity, error) {
+	var list []domain.PendingIdentity
+	err := r.db.Where("school_id = ? AND status = ?", schoolID, status).
+		Order("created_at ASC").Find(&list).Error
+	return list, err
+}
+
+func (r *IdentityRepository) UpdatePendingIdentity(p *domain.PendingIdentity) error {
+	return r.db.Save(p).Error
+}
@@ -0,0 +1,115 @@
+package persistence
+
+import (
+	"errors"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type JobRepository struct {
+	db *gorm.DB
+}
+
+func NewJobRepository(db *gorm.DB) *JobRepository {
+	return &JobRepository{db: db}
+}
+
+func (r *JobRepository) EnqueueJob(job *domain.Job) (bool, error) {
+	res := r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "idempotency_key"}},
+		DoNothing: true,
+	}).Create(job)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+func (r *JobRepository) GetJob(id uint) (*domain.Job, error) {
+	var job domain.Job
+	if err := r.db.First(&job, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// claimJobsSQL locks the due rows with SKIP LOCKED, so that concurrent
+// workers each take different jobs without blocking one another.
+const claimJobsSQL = `
+UPDATE jobs SET status = @running, attempts = attempts + 1, locked_by = @worker,
+	locked_until = @locked_until, updated_at = @now
+WHERE id IN (
+	SELECT id FROM jobs
+	WHERE type IN @types AND run_at <= @now
+		AND (status = @pending OR (status = @running AND locked_until < @now))
+	ORDER BY run_at, id
+	LIMIT @limit
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING *`
+
+func (r *JobRepository) ClaimJobs(worker string, types []string, now, lockedUntil time.Time, limit int) ([]domain.Job, error) {
+	var jobs []domain.Job
+	if len(types) == 0 {
+		return jobs, nil
+	}
+	err := r.db.Raw(claimJobsSQL, map[string]interface{}{
+		"running":      domain.JobRunning,
+		"pending":      domain.JobPending,
+		"worker":       worker,
+		"locked_until": lockedUntil,
+		"now":          now,
+		"types":        types,
+		"limit":        limit,
+	}).Scan(&jobs).Error
+	return jobs, err
+}
+
+func (r *JobRepository) CompleteJob(id uint, worker string, at time.Time) error {
+	return r.leased(id, worker).Updates(map[string]interface{}{
+		"status":       domain.JobDone,
+		"locked_by":    "",
+		"locked_until": nil,
+		"finished_at":  at,
+		"last_error":   "",
+	}).Error
+}
+
+func (r *JobRepository) RetryJob(id uint, worker string, runAt time.Time, lastError string) error {
+	return r.leased(id, worker).Updates(map[string]interface{}{
+		"status":       domain.JobPending,
+		"locked_by":    "",
+		"locked_until": nil,
+		"run_at":       runAt,
+		"last_error":   lastError,
+	}).Error
+}
+
+func (r *JobRepository) FailJob(id uint, worker string, at time.Time, lastError string) error {
+	return r.leased(id, worker).Updates(map[string]interface{}{
+		"status":       domain.JobFailed,
+		"locked_by":    "",
+		"locked_until": nil,
+		"finished_at":  at,
+		"last_error":   lastError,
+	}).Error
+}
+
+// leased selects the job while worker holds it: once its lease expired and
+// another worker took it, the late outcome is dropped.
+func (r *JobRepository) leased(id uint, worker string) *gorm.DB {
+	return r.db.Model(&domain.Job{}).
+		Where("id = ? AND status = ? AND locked_by = ?", id, domain.JobRunning, worker)
+}
+
+func (r *JobRepository) PurgeJobs(before time.Time) (int64, error) {
+	res := r.db.Where("status IN ? AND finished_at < ?", []domain.JobStatus{domain.JobDone, domain.JobFailed}, before).
+		Delete(&domain.Job{})
+	return res.RowsAffected, res.Error
+}
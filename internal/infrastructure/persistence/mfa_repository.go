@@ -0,0 +1,96 @@
+package persistence
+
+import (
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type MFARepository struct {
+	db *gorm.DB
+}
+
+func NewMFARepository(db *gorm.DB) *MFARepository {
+	return &MFARepository{db: db}
+}
+
+// --- WebAuthn Credentials ---
+
+func (r *MFARepository) CreateWebAuthnCredential(cred *domain.WebAuthnCredential) error {
+	return r.db.Create(cred).Error
+}
+
+func (r *MFARepository) ListWebAuthnCredentials(userID uint) ([]domain.WebAuthnCredential, error) {
+	var creds []domain.WebAuthnCredential
+	err := r.db.Where("user_id = ?", userID).Order("created_at").Find(&creds).Error
+	return creds, err
+}
+
+func (r *MFARepository) UpdateWebAuthnCredential(cred *domain.WebAuthnCredential) error {
+	return r.db.Save(cred).Error
+}
+
+func (r *MFARepository) DeleteWebAuthnCredential(userID, id uint) error {
+	res := r.db.Where("id = ? AND user_id = ?", id, userID).Delete(&domain.WebAuthnCredential{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+// --- Recovery Codes ---
+
+func (r *MFARepository) ReplaceRecoveryCodes(userID uint, codes []domain.RecoveryCode) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&domain.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		if len(codes) == 0 {
+			return nil
+		}
+		return tx.Create(&codes).Error
+	})
+}
+
+func (r *MFARepository) CountUnusedRecoveryCodes(userID uint) (int64, error) {
+	var count int64
+	err := r.db.Model(&domain.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
+
+// UseRecoveryCode burns the code with a conditional UPDATE, so the same code
+// cannot be accepted twice by concurrent logins.
+func (r *MFARepository) UseRecoveryCode(userID uint, codeHash string) (bool, error) {
+	res := r.db.Model(&domain.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash).
+		Update("used_at", time.Now())
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected > 0, nil
+}
+
+// --- Ceremonies ---
+
+func (r *MFARepository) SaveCeremony(c *domain.WebAuthnCeremony) error {
+	return r.db.Create(c).Error
+}
+
+func (r *MFARepository) ConsumeCeremony(id string) (*domain.WebAuthnCeremony, error) {
+	var c domain.WebAuthnCeremony
+	res := r.db.Clauses(clause.Returning{}).
+		Where("id = ? AND expires_at > ?", id, time.Now()).
+		Delete(&c)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &c, nil
+}
@@ -0,0 +1,82 @@
+package persistence
+
+import (
+	"errors"
+
+	"github.com/k/iRegistro/internal/domain"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type OnboardingRepository struct {
+	db *gorm.DB
+}
+
+func NewOnboardingRepository(db *gorm.DB) *OnboardingRepository {
+	return &OnboardingRepository{db: db}
+}
+
+func (r *OnboardingRepository) Onboard(fn func(store domain.OnboardingStore) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&OnboardingRepository{db: tx})
+	})
+}
+
+func (r *OnboardingRepository) CreateSchool(school *domain.School) error {
+	return r.db.Create(school).Error
+}
+
+func (r *OnboardingRepository) CreateCampus(campus *domain.Campus) error {
+	return r.db.Create(campus).Error
+}
+
+func (r *OnboardingRepository) CreateCurriculum(curriculum *domain.Curriculum) error {
+	return r.db.Create(curriculum).Error
+}
+
+func (r *OnboardingRepository) CreateSubject(subject *domain.Subject) error {
+	return r.db.Create(subject).Error
+}
+
+func (r *OnboardingRepository) CreateUser(user *domain.User) error {
+	return r.db.Create(user).Error
+}
+
+func (r *OnboardingRepository) UpsertSchoolSetting(setting *domain.SchoolSettings) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "school_id"}, {Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value"}),
+	}).Create(setting).Error
+}
+
+func (r *OnboardingRepository) CreateOnboarding(o *domain.SchoolOnboarding) error {
+	return r.db.Create(o).Error
+}
+
+func (r *OnboardingRepository) UpdateOnboarding(o *domain.SchoolOnboarding) error {
+	return r.db.Save(o).Error
+}
+
+func (r *OnboardingRepository) GetOnboarding(id uint) (*domain.SchoolOnboarding, error) {
+	var o domain.SchoolOnboarding
+	err := r.db.First(&o, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+func (r *OnboardingRepository) GetOnboardings(limit, offset int) ([]domain.SchoolOnboarding, error) {
+	var onboardings []domain.SchoolOnboarding
+	err := r.db.Order("created_at DESC, id DESC").Limit(limit).Offset(offset).Find(&onboardings).Error
+	return onboardings, err
+}
+
+func (r *OnboardingRepository) SchoolCodeExists(code string) (bool, error) {
+	var count int64
+	err := r.db.Model(&domain.School{}).Where("UPPER(code) = UPPER(?)", code).Count(&count).Error
+	return count > 0, err
+}
@@ -1,6 +1,7 @@
 package persistence
 
 import (
+	"context"
 	"time"
 
 	"github.com/k/iRegistro/internal/domain"
@@ -21,9 +22,12 @@ func (r *ReportingRepository) CreateDocument(doc *domain.Document) error {
 	return r.db.Create(doc).Error
 }
 
-func (r *ReportingRepository) GetDocumentByID(id uint) (*domain.Document, error) {
+func (r *ReportingRepository) GetDocumentByID(ctx context.Context, id uint) (*domain.Document, error) {
 	var doc domain.Document
-	if err := r.db.Preload("Signatures").First(&doc, id).Error; err != nil {
+	err := inTenant(ctx, r.db, func(tx *gorm.DB) error {
+		return tx.Preload("Signatures").First(&doc, id).Error
+	})
+	if err != nil {
 		return nil, err
 	}
 	return &doc, nil
@@ -45,9 +49,11 @@ func (r *ReportingRepository) GetDocumentsByStatus(schoolID uint, status domain.
 	return docs, err
 }
 
-func (r *ReportingRepository) GetDocumentsByStudentID(studentID uint) ([]domain.Document, error) {
+func (r *ReportingRepository) GetDocumentsByStudentID(ctx context.Context, studentID uint) ([]domain.Document, error) {
 	var docs []domain.Document
-	err := r.db.Where("student_id = ?", studentID).Find(&docs).Error
+	err := inTenant(ctx, r.db, func(tx *gorm.DB) error {
+		return tx.Where("student_id = ?", studentID).Find(&docs).Error
+	})
 	return docs, err
 }
 
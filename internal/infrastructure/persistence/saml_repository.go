@@ -0,0 +1,57 @@
+package persistence
+
+import (
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type SAMLRepository struct {
+	db *gorm.DB
+}
+
+func NewSAMLRepository(db *gorm.DB) *SAMLRepository {
+	return &SAMLRepository{db: db}
+}
+
+func (r *SAMLRepository) SaveRequest(req *domain.SAMLRequest) error {
+	return r.db.Create(req).Error
+}
+
+// ConsumeRequest flips consumed_at in a single conditional UPDATE, so two
+// responses racing for the same request cannot both succeed.
+func (r *SAMLRepository) ConsumeRequest(id string) (*domain.SAMLRequest, error) {
+	now := time.Now()
+	res := r.db.Model(&domain.SAMLRequest{}).
+		Where("id = ? AND consumed_at IS NULL AND expires_at > ?", id, now).
+		Update("consumed_at", now)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	var req domain.SAMLRequest
+	if err := r.db.First(&req, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (r *SAMLRepository) MarkAssertionUsed(use *domain.SAMLAssertionUse) (bool, error) {
+	res := r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(use)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+func (r *SAMLRepository) PurgeExpired(before time.Time) error {
+	if err := r.db.Where("expires_at < ?", before).Delete(&domain.SAMLRequest{}).Error; err != nil {
+		return err
+	}
+	return r.db.Where("expires_at < ?", before).Delete(&domain.SAMLAssertionUse{}).Error
+}
@@ -0,0 +1,110 @@
+package persistence
+
+import (
+	"errors"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type SIDIRepository struct {
+	db *gorm.DB
+}
+
+func NewSIDIRepository(db *gorm.DB) *SIDIRepository {
+	return &SIDIRepository{db: db}
+}
+
+func (r *SIDIRepository) GetSchoolByID(id uint) (*domain.School, error) {
+	var school domain.School
+	err := r.db.First(&school, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &school, nil
+}
+
+func (r *SIDIRepository) GetEnrollments(schoolID uint, academicYear string) ([]domain.EnrolledStudent, error) {
+	var enrollments []domain.ClassEnrollment
+	err := r.db.Joins("JOIN classes ON classes.id = class_enrollments.class_id").
+		Joins("JOIN students ON students.id = class_enrollments.student_id").
+		Where("classes.school_id = ? AND class_enrollments.year = ?", schoolID, academicYear).
+		Order("classes.year, classes.section, students.last_name, students.first_name, class_enrollments.id").
+		Find(&enrollments).Error
+	if err != nil || len(enrollments) == 0 {
+		return nil, err
+	}
+
+	studentIDs := make([]uint, len(enrollments))
+	classIDs := make([]uint, len(enrollments))
+	for i, e := range enrollments {
+		studentIDs[i], classIDs[i] = e.StudentID, e.ClassID
+	}
+	var students []domain.Student
+	if err := r.db.Where("id IN ?", studentIDs).Find(&students).Error; err != nil {
+		return nil, err
+	}
+	var classes []domain.Class
+	if err := r.db.Where("id IN ?", classIDs).Find(&classes).Error; err != nil {
+		return nil, err
+	}
+	studentByID := make(map[uint]domain.Student, len(students))
+	for _, s := range students {
+		studentByID[s.ID] = s
+	}
+	classByID := make(map[uint]domain.Class, len(classes))
+	for _, c := range classes {
+		classByID[c.ID] = c
+	}
+
+	rows := make([]domain.EnrolledStudent, len(enrollments))
+	for i, e := range enrollments {
+		rows[i] = domain.EnrolledStudent{Student: studentByID[e.StudentID], Class: classByID[e.ClassID], Enrollment: e}
+	}
+	return rows, nil
+}
+
+func (r *SIDIRepository) GetAbsenceTotals(schoolID uint, from, to time.Time) ([]domain.AbsenceTotals, error) {
+	var totals []domain.AbsenceTotals
+	err := r.db.Model(&domain.Absence{}).
+		Select(`student_id,
+			COUNT(DISTINCT date) FILTER (WHERE type = ? AND hour = 0) AS days,
+			COUNT(*) FILTER (WHERE type = ? AND hour > 0) AS hours,
+			COUNT(*) FILTER (WHERE type = ?) AS late`, domain.AbsenceFull, domain.AbsenceFull, domain.AbsenceLate).
+		Where("class_id IN (?)", r.db.Model(&domain.Class{}).Select("id").Where("school_id = ?", schoolID)).
+		Where("date >= ? AND date < ?", from, to.AddDate(0, 0, 1)).
+		Group("student_id").
+		Scan(&totals).Error
+	return totals, err
+}
+
+func (r *SIDIRepository) GetOutcomes(schoolID uint, academicYear string) ([]domain.StudentOutcome, error) {
+	var outcomes []domain.StudentOutcome
+	err := r.db.Where("school_id = ? AND academic_year = ?", schoolID, academicYear).Order("id").Find(&outcomes).Error
+	return outcomes, err
+}
+
+func (r *SIDIRepository) UpsertOutcome(outcome *domain.StudentOutcome) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "student_id"}, {Name: "academic_year"}},
+		DoUpdates: clause.AssignmentColumns([]string{"class_id", "outcome", "credits", "final_score", "decided_at", "recorded_by", "updated_at"}),
+	}).Create(outcome).Error
+}
+
+func (r *SIDIRepository) GetStudentsByTaxCodes(schoolID uint, taxCodes []string) ([]domain.Student, error) {
+	var students []domain.Student
+	if len(taxCodes) == 0 {
+		return students, nil
+	}
+	err := r.db.Where("school_id = ? AND tax_code IN ?", schoolID, taxCodes).Find(&students).Error
+	return students, err
+}
+
+func (r *SIDIRepository) UpdateStudentSIDICode(studentID uint, code string) error {
+	return r.db.Model(&domain.Student{}).Where("id = ?", studentID).Update("sidi_code", code).Error
+}
@@ -0,0 +1,60 @@
+package persistence
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/k/iRegistro/internal/tenant"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// inTenant runs fn in a transaction acting as the tenant of ctx, failing
+// closed with tenant.ErrNoTenant when ctx carries none. The settings read by
+// the row level security policies are local to the transaction (SET LOCAL),
+// so they never outlive it on the pooled connection.
+func inTenant(ctx context.Context, db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	return withTenant(ctx, db, func(tx *gorm.DB, t tenant.Tenant) error {
+		// A new session, so that fn can run several queries on it
+		return fn(ofTenant(t)(tx).Session(&gorm.Session{}))
+	})
+}
+
+// withTenant is inTenant for the tables without a school_id column, whose
+// queries fn restricts to the school of t itself.
+func withTenant(ctx context.Context, db *gorm.DB, fn func(tx *gorm.DB, t tenant.Tenant) error) error {
+	t, ok := tenant.From(ctx)
+	if !ok {
+		return tenant.ErrNoTenant
+	}
+	schoolID := t.SchoolID
+	if t.AllSchools() {
+		schoolID = 0
+	}
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT set_config('app.current_school_id', ?, true), set_config('app.current_user_id', ?, true), set_config('app.current_user_role', ?, true)",
+			settingID(schoolID), settingID(t.UserID), string(t.Role)).Error; err != nil {
+			return err
+		}
+		return fn(tx, t)
+	})
+}
+
+// ofTenant restricts a query to the rows of the school of the tenant.
+func ofTenant(t tenant.Tenant) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if t.AllSchools() {
+			return db
+		}
+		return db.Where(clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: "school_id"}, Value: t.SchoolID})
+	}
+}
+
+// settingID formats an ID for the settings, leaving them empty (NULL for the
+// policies) when there is none.
+func settingID(id uint) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(id), 10)
+}
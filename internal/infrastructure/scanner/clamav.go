@@ -0,0 +1,104 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+)
+
+// chunkSize stays well below the StreamMaxLength default of clamd.
+const chunkSize = 64 * 1024
+
+// ClamAV scans files with a clamd daemon through its INSTREAM command:
+//
+//	zINSTREAM\0 <len><chunk> ... <0000>
+//
+// where each length is a 4 byte big endian integer. clamd replies
+// "stream: OK", "stream: <signature> FOUND" or "<reason> ERROR".
+type ClamAV struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// NewClamAV connects to clamd at address, tcp://host:port or
+// unix:///path/to/clamd.sock. A zero timeout means 30 seconds.
+func NewClamAV(address string, timeout time.Duration) (*ClamAV, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clamd address %q: %w", address, err)
+	}
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	switch u.Scheme {
+	case "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid clamd address %q", address)
+		}
+		return &ClamAV{network: "tcp", address: u.Host, timeout: timeout}, nil
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid clamd address %q", address)
+		}
+		return &ClamAV{network: "unix", address: u.Path, timeout: timeout}, nil
+	default:
+		return nil, fmt.Errorf("invalid clamd address %q: use tcp:// or unix://", address)
+	}
+}
+
+func (s *ClamAV) Scan(ctx context.Context, data []byte) (*domain.ScanResult, error) {
+	dialer := net.Dialer{Timeout: s.timeout}
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return nil, fmt.Errorf("clamd: %w", err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	var size [4]byte
+	for len(data) > 0 {
+		n := min(len(data), chunkSize)
+		binary.BigEndian.PutUint32(size[:], uint32(n))
+		w.Write(size[:])
+		w.Write(data[:n])
+		data = data[n:]
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	w.Write(size[:])
+	if err := w.Flush(); err != nil {
+		return nil, fmt.Errorf("clamd: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && len(reply) == 0 {
+		return nil, fmt.Errorf("clamd: %w", err)
+	}
+	return parseReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+func parseReply(reply string) (*domain.ScanResult, error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return &domain.ScanResult{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return &domain.ScanResult{Infected: true, Signature: strings.TrimSuffix(result, " FOUND")}, nil
+	default:
+		return nil, fmt.Errorf("clamd: %s", reply)
+	}
+}
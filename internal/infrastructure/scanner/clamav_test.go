@@ -0,0 +1,113 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/k/iRegistro/internal/config"
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClamd reads one INSTREAM request per connection and answers with
+// reply(stream).
+func fakeClamd(t *testing.T, reply func(stream []byte) string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				cmd, err := r.ReadString(0)
+				if err != nil || cmd != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var stream bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&stream, r, int64(size)); err != nil {
+						return
+					}
+				}
+				conn.Write([]byte(reply(stream.Bytes()) + "\x00"))
+			}()
+		}
+	}()
+	return "tcp://" + ln.Addr().String()
+}
+
+func TestClamAV(t *testing.T) {
+	var scanned []byte
+	address := fakeClamd(t, func(stream []byte) string {
+		scanned = stream
+		if bytes.Contains(stream, []byte("EICAR")) {
+			return "stream: Eicar-Test-Signature FOUND"
+		}
+		if len(stream) == 0 {
+			return "INSTREAM size limit exceeded. ERROR"
+		}
+		return "stream: OK"
+	})
+	s, err := NewClamAV(address, 0)
+	require.NoError(t, err)
+
+	// Larger than a chunk, to exercise the framing
+	clean := bytes.Repeat([]byte("a"), chunkSize*2+10)
+	result, err := s.Scan(context.Background(), clean)
+	require.NoError(t, err)
+	assert.False(t, result.Infected)
+	assert.Equal(t, clean, scanned)
+
+	result, err = s.Scan(context.Background(), []byte("X5O!P%@AP EICAR"))
+	require.NoError(t, err)
+	assert.Equal(t, &domain.ScanResult{Infected: true, Signature: "Eicar-Test-Signature"}, result)
+
+	_, err = s.Scan(context.Background(), nil)
+	assert.ErrorContains(t, err, "ERROR")
+}
+
+func TestClamAVUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := "tcp://" + ln.Addr().String()
+	ln.Close()
+
+	s, err := NewClamAV(address, 0)
+	require.NoError(t, err)
+	_, err = s.Scan(context.Background(), []byte("data"))
+	assert.Error(t, err)
+}
+
+func TestNew(t *testing.T) {
+	s, err := New(config.AttachmentsConfig{Scanner: "none"})
+	require.NoError(t, err)
+	assert.IsType(t, Noop{}, s)
+
+	s, err = New(config.AttachmentsConfig{Scanner: "clamav", ClamAVAddress: "unix:///var/run/clamav/clamd.ctl"})
+	require.NoError(t, err)
+	assert.Equal(t, "unix", s.(*ClamAV).network)
+
+	_, err = New(config.AttachmentsConfig{Scanner: "clamav", ClamAVAddress: "localhost:3310"})
+	assert.Error(t, err)
+	_, err = New(config.AttachmentsConfig{Scanner: "other"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,28 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/k/iRegistro/internal/config"
+	"github.com/k/iRegistro/internal/domain"
+)
+
+// New returns the scanner selected by cfg.Scanner: "clamav" or "none".
+func New(cfg config.AttachmentsConfig) (domain.VirusScanner, error) {
+	switch cfg.Scanner {
+	case "clamav":
+		return NewClamAV(cfg.ClamAVAddress, 0)
+	case "none", "":
+		return Noop{}, nil
+	default:
+		return nil, fmt.Errorf("unknown virus scanner %q", cfg.Scanner)
+	}
+}
+
+// Noop accepts every file, for installations without a scanner.
+type Noop struct{}
+
+func (Noop) Scan(ctx context.Context, data []byte) (*domain.ScanResult, error) {
+	return &domain.ScanResult{}, nil
+}
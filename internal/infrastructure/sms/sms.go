@@ -0,0 +1,139 @@
+package sms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+)
+
+var ErrUnknownProvider = errors.New("unknown SMS provider")
+
+// NewProvider returns the gateway client for a school's settings.
+func NewProvider(cfg domain.SMSSettings) (domain.SMSProvider, error) {
+	switch cfg.Provider {
+	case "http":
+		return NewHTTPProvider(cfg, nil)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownProvider, cfg.Provider)
+	}
+}
+
+// HTTPProvider works with the many gateways accepting a JSON POST:
+//
+//	{"to": "+393471234567", "from": "SCUOLA", "text": "..."}
+//
+// authenticated with a bearer API key or HTTP basic auth. The reply may carry
+// "id" (or "message_id"), "segments" and "cost" (euro cents).
+type HTTPProvider struct {
+	http *http.Client
+	cfg  domain.SMSSettings
+}
+
+// NewHTTPProvider creates the provider. httpClient may be nil.
+func NewHTTPProvider(cfg domain.SMSSettings, httpClient *http.Client) (*HTTPProvider, error) {
+	if u, err := url.Parse(cfg.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid SMS gateway URL %q", cfg.URL)
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &HTTPProvider{http: httpClient, cfg: cfg}, nil
+}
+
+type httpRequest struct {
+	To   string `json:"to"`
+	From string `json:"from,omitempty"`
+	Text string `json:"text"`
+}
+
+type httpReply struct {
+	ID        string `json:"id"`
+	MessageID string `json:"message_id"`
+	Segments  int    `json:"segments"`
+	Cost      int    `json:"cost"`
+}
+
+func (p *HTTPProvider) Send(ctx context.Context, msg domain.SMSMessage) (*domain.SMSReceipt, error) {
+	body, err := json.Marshal(httpRequest{To: msg.To, From: msg.Sender, Text: msg.Text})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", domain.ErrDeliveryRejected, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.cfg.APIKey)
+	} else if p.cfg.Username != "" {
+		req.SetBasicAuth(p.cfg.Username, p.cfg.Password)
+	}
+
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sms %s: %w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, fmt.Errorf("sms %s: %s", req.URL.Host, resp.Status)
+	default:
+		return nil, fmt.Errorf("%w: sms %s: %s %s", domain.ErrDeliveryRejected, req.URL.Host, resp.Status, bytes.TrimSpace(raw))
+	}
+
+	var reply httpReply
+	// Gateways replying with something else than JSON still accepted the message
+	_ = json.Unmarshal(raw, &reply)
+	id := reply.ID
+	if id == "" {
+		id = reply.MessageID
+	}
+	return &domain.SMSReceipt{MessageID: id, Segments: reply.Segments, CostCents: reply.Cost}, nil
+}
+
+// Fake records the messages instead of sending them, for tests and local
+// development. Numbers in Reject are refused as invalid.
+type Fake struct {
+	mu       sync.Mutex
+	messages []domain.SMSMessage
+	Reject   map[string]bool
+	// Err, when set, is returned for every message (e.g. a transient outage)
+	Err error
+}
+
+func NewFake() *Fake {
+	return &Fake{Reject: make(map[string]bool)}
+}
+
+func (f *Fake) Send(ctx context.Context, msg domain.SMSMessage) (*domain.SMSReceipt, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	if f.Reject[msg.To] {
+		return nil, fmt.Errorf("%w: invalid number %s", domain.ErrDeliveryRejected, msg.To)
+	}
+	f.messages = append(f.messages, msg)
+	return &domain.SMSReceipt{MessageID: fmt.Sprintf("fake-%d", len(f.messages))}, nil
+}
+
+// Messages returns the messages sent so far.
+func (f *Fake) Messages() []domain.SMSMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]domain.SMSMessage(nil), f.messages...)
+}
@@ -0,0 +1,78 @@
+package sms
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPProvider(t *testing.T) {
+	var received httpRequest
+	var auth string
+	status, reply := http.StatusOK, `{"message_id":"abc123","segments":2,"cost":12}`
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(status)
+		w.Write([]byte(reply))
+	}))
+	defer gateway.Close()
+
+	provider, err := NewHTTPProvider(domain.SMSSettings{Provider: "http", URL: gateway.URL, APIKey: "key"}, gateway.Client())
+	require.NoError(t, err)
+	msg := domain.SMSMessage{To: "+393471234567", Sender: "Scuola", Text: "Assenza"}
+
+	receipt, err := provider.Send(context.Background(), msg)
+	require.NoError(t, err)
+	assert.Equal(t, &domain.SMSReceipt{MessageID: "abc123", Segments: 2, CostCents: 12}, receipt)
+	assert.Equal(t, httpRequest{To: "+393471234567", From: "Scuola", Text: "Assenza"}, received)
+	assert.Equal(t, "Bearer key", auth)
+
+	reply = "OK"
+	receipt, err = provider.Send(context.Background(), msg)
+	require.NoError(t, err, "replies other than JSON are accepted")
+	assert.Equal(t, &domain.SMSReceipt{}, receipt)
+
+	status, reply = http.StatusBadRequest, `{"error":"invalid number"}`
+	_, err = provider.Send(context.Background(), msg)
+	assert.ErrorIs(t, err, domain.ErrDeliveryRejected)
+
+	status = http.StatusServiceUnavailable
+	_, err = provider.Send(context.Background(), msg)
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, domain.ErrDeliveryRejected), "5xx replies are retried")
+
+	basic, err := NewHTTPProvider(domain.SMSSettings{Provider: "http", URL: gateway.URL, Username: "scuola", Password: "pw"}, gateway.Client())
+	require.NoError(t, err)
+	status, reply = http.StatusOK, "{}"
+	_, err = basic.Send(context.Background(), msg)
+	require.NoError(t, err)
+	assert.Equal(t, "Basic c2N1b2xhOnB3", auth)
+}
+
+func TestNewProvider(t *testing.T) {
+	_, err := NewProvider(domain.SMSSettings{Provider: "http", URL: "https://sms.example.com/send"})
+	assert.NoError(t, err)
+	_, err = NewProvider(domain.SMSSettings{Provider: "http", URL: "ftp://sms.example.com"})
+	assert.Error(t, err)
+	_, err = NewProvider(domain.SMSSettings{Provider: "smoke-signals"})
+	assert.ErrorIs(t, err, ErrUnknownProvider)
+}
+
+func TestFake(t *testing.T) {
+	fake := NewFake()
+	fake.Reject["+390000000000"] = true
+
+	_, err := fake.Send(context.Background(), domain.SMSMessage{To: "+393471234567", Text: "Ciao"})
+	require.NoError(t, err)
+	_, err = fake.Send(context.Background(), domain.SMSMessage{To: "+390000000000", Text: "Ciao"})
+	assert.ErrorIs(t, err, domain.ErrDeliveryRejected)
+	assert.Len(t, fake.Messages(), 1)
+}
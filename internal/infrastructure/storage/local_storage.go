@@ -1,10 +1,16 @@
 package storage
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+// ErrOutsideStorage is returned for paths that do not resolve inside the
+// storage directory.
+var ErrOutsideStorage = errors.New("path outside storage")
+
 type FileStorage interface {
 	Save(filename string, data []byte) (string, error)
 	Get(filename string) ([]byte, error)
@@ -28,6 +34,9 @@ func (s *LocalStorage) Save(filename string, data []byte) (string, error) {
 	safeName := filepath.Clean(filename)
 	// e.g. /uploads/report_123.pdf
 	fullPath := filepath.Join(s.BaseDir, safeName)
+	if _, err := s.Rel(fullPath); err != nil {
+		return "", err
+	}
 
 	// Ensure dir exists
 	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
@@ -41,7 +50,29 @@ func (s *LocalStorage) Save(filename string, data []byte) (string, error) {
 	return fullPath, nil
 }
 
+// Get reads a file by the path Save returned.
 func (s *LocalStorage) Get(filepathStr string) ([]byte, error) {
-	// simplistic implementation
+	if _, err := s.Rel(filepathStr); err != nil {
+		return nil, err
+	}
 	return os.ReadFile(filepathStr)
 }
+
+// Rel returns the path of a file below BaseDir, such as one returned by Save,
+// relative to BaseDir. It fails with ErrOutsideStorage when the path escapes
+// it.
+func (s *LocalStorage) Rel(path string) (string, error) {
+	base, err := filepath.Abs(s.BaseDir)
+	if err != nil {
+		return "", err
+	}
+	full, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(base, full)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrOutsideStorage
+	}
+	return rel, nil
+}
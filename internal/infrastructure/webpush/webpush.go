@@ -0,0 +1,240 @@
+package webpush
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/k/iRegistro/internal/config"
+	"github.com/k/iRegistro/internal/domain"
+)
+
+const (
+	// messageTTL is how long the push service keeps a message for an offline device.
+	messageTTL  = 24 * time.Hour
+	vapidExpiry = 12 * time.Hour
+	recordSize  = 4096
+	// MaxPayloadSize is the largest payload fitting in one record (RFC 8291
+	// section 4): 4096 bytes minus the header, the AEAD tag and the delimiter.
+	MaxPayloadSize = recordSize - 86 - 16 - 1
+)
+
+var ErrInvalidVAPIDKey = errors.New("invalid VAPID key")
+
+// Client sends Web Push messages. Payloads are encrypted for the subscription
+// with aes128gcm (RFC 8291) and requests are signed with VAPID (RFC 8292).
+type Client struct {
+	http      *http.Client
+	key       *ecdsa.PrivateKey
+	publicKey string
+	subject   string
+}
+
+// New creates a client from the configured VAPID keys. httpClient may be nil.
+func New(cfg config.WebPushConfig, httpClient *http.Client) (*Client, error) {
+	d, err := decodeBase64(cfg.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidVAPIDKey, err)
+	}
+	priv, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidVAPIDKey, err)
+	}
+	pub := priv.PublicKey().Bytes()
+	publicKey := base64.RawURLEncoding.EncodeToString(pub)
+	if cfg.PublicKey != "" && strings.TrimRight(cfg.PublicKey, "=") != publicKey {
+		return nil, fmt.Errorf("%w: public key does not match the private key", ErrInvalidVAPIDKey)
+	}
+	if !strings.HasPrefix(cfg.Subject, "mailto:") && !strings.HasPrefix(cfg.Subject, "https:") {
+		return nil, fmt.Errorf("%w: subject must be a mailto: or https: URL", ErrInvalidVAPIDKey)
+	}
+
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &Client{
+		http: httpClient,
+		key: &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(pub[1:33]),
+				Y:     new(big.Int).SetBytes(pub[33:]),
+			},
+			D: new(big.Int).SetBytes(d),
+		},
+		publicKey: publicKey,
+		subject:   cfg.Subject,
+	}, nil
+}
+
+// GenerateKeys returns a new base64url encoded VAPID key pair.
+func GenerateKeys() (publicKey, privateKey string, err error) {
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(priv.PublicKey().Bytes()),
+		base64.RawURLEncoding.EncodeToString(priv.Bytes()), nil
+}
+
+func (c *Client) PublicKey() string {
+	return c.publicKey
+}
+
+// Push delivers payload to the subscription. It returns
+// domain.ErrPushSubscriptionGone when the push service reports the
+// subscription as expired, and wraps domain.ErrDeliveryRejected for other
+// permanent failures.
+func (c *Client) Push(ctx context.Context, sub *domain.PushSubscription, payload []byte, urgency domain.PushUrgency) error {
+	body, err := encrypt(sub, payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", domain.ErrDeliveryRejected, err)
+	}
+	auth, err := c.vapid(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", domain.ErrDeliveryRejected, err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(messageTTL.Seconds())))
+	req.Header.Set("Urgency", string(urgency))
+	req.Header.Set("Authorization", auth)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("push %s: %w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return domain.ErrPushSubscriptionGone
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("push %s: %s", req.URL.Host, resp.Status)
+	default:
+		return fmt.Errorf("%w: push %s: %s", domain.ErrDeliveryRejected, req.URL.Host, resp.Status)
+	}
+}
+
+// vapid returns the Authorization header for a push service endpoint.
+func (c *Client) vapid(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", domain.ErrDeliveryRejected, err)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(vapidExpiry).Unix(),
+		"sub": c.subject,
+	})
+	signed, err := token.SignedString(c.key)
+	if err != nil {
+		return "", err
+	}
+	return "vapid t=" + signed + ", k=" + c.publicKey, nil
+}
+
+// encrypt encrypts payload for the subscription with a fresh key and salt.
+func encrypt(sub *domain.PushSubscription, payload []byte) ([]byte, error) {
+	if len(payload) > MaxPayloadSize {
+		return nil, fmt.Errorf("payload of %d bytes exceeds %d", len(payload), MaxPayloadSize)
+	}
+	uaBytes, err := decodeBase64(sub.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("p256dh: %v", err)
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaBytes)
+	if err != nil {
+		return nil, fmt.Errorf("p256dh: %v", err)
+	}
+	authSecret, err := decodeBase64(sub.Auth)
+	if err != nil || len(authSecret) != 16 {
+		return nil, errors.New("auth secret must be 16 bytes")
+	}
+
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return seal(payload, uaPublic, authSecret, asKey, salt)
+}
+
+// seal builds the aes128gcm body of RFC 8291: a header carrying the salt and
+// the application server public key, followed by a single encrypted record.
+func seal(payload []byte, uaPublic *ecdh.PublicKey, authSecret []byte, asKey *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	shared, err := asKey.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asKey.PublicKey().Bytes()
+
+	keyInfo := "WebPush: info\x00" + string(uaPublic.Bytes()) + string(asPublic)
+	ikm, err := hkdf.Key(sha256.New, shared, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, 21+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, recordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+
+	// 0x02 marks the last (and only) record, no padding
+	record := append(append(make([]byte, 0, len(payload)+1), payload...), 0x02)
+	return gcm.Seal(header, nonce, record, nil), nil
+}
+
+// decodeBase64 accepts base64url with or without padding, as browsers and
+// key generators differ.
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
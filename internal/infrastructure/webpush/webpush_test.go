@@ -0,0 +1,161 @@
+package webpush
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/k/iRegistro/internal/config"
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func b64(t *testing.T, s string) []byte {
+	b, err := decodeBase64(s)
+	require.NoError(t, err)
+	return b
+}
+
+// RFC 8291 Appendix A
+func TestSealTestVector(t *testing.T) {
+	uaPublic, err := ecdh.P256().NewPublicKey(b64(t, "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"))
+	require.NoError(t, err)
+	asKey, err := ecdh.P256().NewPrivateKey(b64(t, "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	require.NoError(t, err)
+
+	body, err := seal([]byte("When I grow up, I want to be a watermelon"), uaPublic,
+		b64(t, "BTBZMqHH6r4Tts7J_aSIgg"), asKey, b64(t, "DGv6ra1nlYgDCS1FRnbzlw"))
+	require.NoError(t, err)
+	assert.Equal(t, "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN",
+		base64.RawURLEncoding.EncodeToString(body))
+}
+
+// decrypt is the user agent side of RFC 8291.
+func decrypt(t *testing.T, body []byte, uaKey *ecdh.PrivateKey, authSecret []byte) []byte {
+	require.Greater(t, len(body), 86)
+	salt := body[:16]
+	assert.Equal(t, uint32(recordSize), binary.BigEndian.Uint32(body[16:20]))
+	idLen := int(body[20])
+	asPublic, err := ecdh.P256().NewPublicKey(body[21 : 21+idLen])
+	require.NoError(t, err)
+
+	shared, err := uaKey.ECDH(asPublic)
+	require.NoError(t, err)
+	ikm, _ := hkdf.Key(sha256.New, shared, authSecret, "WebPush: info\x00"+string(uaKey.PublicKey().Bytes())+string(asPublic.Bytes()), 32)
+	cek, _ := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	nonce, _ := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	plain, err := gcm.Open(nil, nonce, body[21+idLen:], nil)
+	require.NoError(t, err)
+	require.Equal(t, byte(0x02), plain[len(plain)-1])
+	return plain[:len(plain)-1]
+}
+
+type fakePushService struct {
+	*httptest.Server
+	status  int
+	payload []byte
+	headers http.Header
+}
+
+// newFakePushService starts a push service that decrypts what it receives
+// with the subscription keys and checks the VAPID signature.
+func newFakePushService(t *testing.T, vapidKey string, uaKey *ecdh.PrivateKey, authSecret []byte) *fakePushService {
+	f := &fakePushService{status: http.StatusCreated}
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.headers = r.Header.Clone()
+		auth := r.Header.Get("Authorization")
+		require.True(t, strings.HasPrefix(auth, "vapid t="))
+		parts := strings.SplitN(strings.TrimPrefix(auth, "vapid t="), ", k=", 2)
+		require.Len(t, parts, 2)
+		assert.Equal(t, vapidKey, parts[1])
+
+		pub := b64(t, parts[1])
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(pub[1:33]), Y: new(big.Int).SetBytes(pub[33:])}
+		claims := jwt.MapClaims{}
+		_, err := jwt.ParseWithClaims(parts[0], claims, func(*jwt.Token) (interface{}, error) { return key, nil },
+			jwt.WithValidMethods([]string{"ES256"}), jwt.WithExpirationRequired())
+		require.NoError(t, err)
+		assert.Equal(t, "https://"+r.Host, claims["aud"])
+		assert.Equal(t, "mailto:segreteria@scuola.it", claims["sub"])
+
+		body, _ := io.ReadAll(r.Body)
+		f.payload = decrypt(t, body, uaKey, authSecret)
+		w.WriteHeader(f.status)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestPush(t *testing.T) {
+	public, private, err := GenerateKeys()
+	require.NoError(t, err)
+
+	uaKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+
+	service := newFakePushService(t, public, uaKey, authSecret)
+	client, err := New(config.WebPushConfig{PublicKey: public, PrivateKey: private, Subject: "mailto:segreteria@scuola.it"}, service.Client())
+	require.NoError(t, err)
+	assert.Equal(t, public, client.PublicKey())
+
+	sub := &domain.PushSubscription{
+		Endpoint: service.URL + "/push/abc",
+		P256dh:   base64.RawURLEncoding.EncodeToString(uaKey.PublicKey().Bytes()),
+		Auth:     base64.URLEncoding.EncodeToString(authSecret), // Padded encodings are accepted too
+	}
+
+	require.NoError(t, client.Push(context.Background(), sub, []byte(`{"title":"Nuovo voto"}`), domain.PushUrgencyHigh))
+	assert.Equal(t, `{"title":"Nuovo voto"}`, string(service.payload))
+	assert.Equal(t, "aes128gcm", service.headers.Get("Content-Encoding"))
+	assert.Equal(t, "high", service.headers.Get("Urgency"))
+	assert.Equal(t, "86400", service.headers.Get("TTL"))
+
+	service.status = http.StatusGone
+	assert.ErrorIs(t, client.Push(context.Background(), sub, []byte("{}"), domain.PushUrgencyNormal), domain.ErrPushSubscriptionGone)
+
+	service.status = http.StatusServiceUnavailable
+	err = client.Push(context.Background(), sub, []byte("{}"), domain.PushUrgencyNormal)
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, domain.ErrDeliveryRejected), "5xx replies are retried")
+
+	service.status = http.StatusBadRequest
+	assert.ErrorIs(t, client.Push(context.Background(), sub, []byte("{}"), domain.PushUrgencyNormal), domain.ErrDeliveryRejected)
+
+	assert.ErrorIs(t, client.Push(context.Background(), sub, make([]byte, MaxPayloadSize+1), domain.PushUrgencyNormal), domain.ErrDeliveryRejected)
+}
+
+func TestNew(t *testing.T) {
+	public, private, err := GenerateKeys()
+	require.NoError(t, err)
+	other, _, _ := GenerateKeys()
+
+	_, err = New(config.WebPushConfig{PrivateKey: private, Subject: "mailto:a@b.it"}, nil)
+	assert.NoError(t, err, "the public key is derived when not configured")
+	_, err = New(config.WebPushConfig{PublicKey: other, PrivateKey: private, Subject: "mailto:a@b.it"}, nil)
+	assert.ErrorIs(t, err, ErrInvalidVAPIDKey)
+	_, err = New(config.WebPushConfig{PublicKey: public, PrivateKey: "not-a-key", Subject: "mailto:a@b.it"}, nil)
+	assert.ErrorIs(t, err, ErrInvalidVAPIDKey)
+	_, err = New(config.WebPushConfig{PublicKey: public, PrivateKey: private, Subject: "a@b.it"}, nil)
+	assert.ErrorIs(t, err, ErrInvalidVAPIDKey)
+}
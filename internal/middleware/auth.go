@@ -9,6 +9,7 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/k/iRegistro/internal/application/auth"
 	"github.com/k/iRegistro/internal/domain"
+	"github.com/k/iRegistro/internal/tenant"
 )
 
 func AuthMiddleware(secret string) gin.HandlerFunc {
@@ -50,6 +51,14 @@ func AuthMiddleware(secret string) gin.HandlerFunc {
 		c.Set("userID", claims.UserID)
 		c.Set("schoolID", claims.SchoolID)
 		c.Set("role", claims.Role)
+		c.Set("authMethod", claims.AuthMethod)
+		c.Set("authLevel", claims.AuthLevel)
+		// The repositories read the tenant from the request context
+		c.Request = c.Request.WithContext(tenant.With(c.Request.Context(), tenant.Tenant{
+			SchoolID: claims.SchoolID,
+			UserID:   claims.UserID,
+			Role:     claims.Role,
+		}))
 		c.Next()
 	}
 }
@@ -81,3 +90,49 @@ func RBACMiddleware(requiredRoles ...domain.Role) gin.HandlerFunc {
 		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions", "your_role": userRole, "required_roles": requiredRoles})
 	}
 }
+
+// RequireSPIDLevel protects sensitive routes: sessions opened with SPID must have
+// been authenticated at least at the given level, otherwise the client is told to
+// log in again asking for that level (step-up). Other login methods are not
+// affected. Must run after AuthMiddleware.
+func RequireSPIDLevel(min auth.SPIDLevel) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("authMethod") != domain.AuthMethodSPID {
+			c.Next()
+			return
+		}
+
+		levelVal, _ := c.Get("authLevel")
+		level, _ := levelVal.(auth.SPIDLevel)
+		if level < min {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error":            "Higher SPID level required",
+				"step_up_required": true,
+				"required_level":   min,
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// EnrollmentAuthMiddleware guards the routes used to enroll a second factor.
+// Besides regular access tokens it accepts the enrollment token returned by a
+// login that the school policy blocked until a second factor is registered.
+func EnrollmentAuthMiddleware(secret string) gin.HandlerFunc {
+	full := AuthMiddleware(secret)
+	return func(c *gin.Context) {
+		tokenString := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		claims, err := auth.ParseChallengeToken(tokenString, auth.ChallengeEnrollment, secret)
+		if err != nil {
+			full(c)
+			return
+		}
+
+		c.Set("userID", claims.UserID)
+		c.Set("schoolID", claims.SchoolID)
+		c.Set("role", claims.Role)
+		c.Set("authMethod", auth.ChallengeEnrollment)
+		c.Next()
+	}
+}
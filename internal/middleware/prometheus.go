@@ -87,6 +87,51 @@ var (
 		},
 	)
 
+	WebSocketRooms = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "websocket_rooms",
+			Help: "Number of WebSocket rooms with at least one client on this node",
+		},
+	)
+
+	WebSocketEventsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "websocket_events_total",
+			Help: "Total number of WebSocket events routed to this node's clients, by origin (local, remote)",
+		},
+		[]string{"origin"},
+	)
+
+	WebSocketSlowClientsDropped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "websocket_slow_clients_dropped_total",
+			Help: "Total number of WebSocket clients disconnected for not keeping up",
+		},
+	)
+
+	WebSocketBackplaneDuplicates = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "websocket_backplane_duplicates_total",
+			Help: "Total number of WebSocket events received twice from the backplane",
+		},
+	)
+
+	WebSocketBackplaneErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "websocket_backplane_errors_total",
+			Help: "Total number of WebSocket backplane failures, by operation (publish, overflow, decode)",
+		},
+		[]string{"operation"},
+	)
+
+	WebSocketResumes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "websocket_resumes_total",
+			Help: "Total number of WebSocket reconnections with a resume cursor, by result (resumed, resync)",
+		},
+		[]string{"result"},
+	)
+
 	// Database Metrics
 	DBQueryDuration = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
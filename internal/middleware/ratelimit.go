@@ -48,7 +48,13 @@ func (i *IPRateLimiter) GetLimiter(ip string) *rate.Limiter {
 }
 
 func RateLimitMiddleware() gin.HandlerFunc {
-	limiter := NewIPRateLimiter(1, 5) // 1 request per second, burst of 5
+	return IPRateLimitMiddleware(1, 5) // 1 request per second, burst of 5
+}
+
+// IPRateLimitMiddleware limits each client IP to r requests per second with
+// bursts of b. Used on sensitive routes with tighter limits than the global one.
+func IPRateLimitMiddleware(r rate.Limit, b int) gin.HandlerFunc {
+	limiter := NewIPRateLimiter(r, b)
 
 	return func(c *gin.Context) {
 		if !limiter.GetLimiter(c.ClientIP()).Allow() {
@@ -95,13 +95,13 @@ func (r *queryResolver) Class(ctx context.Context, id string) (*model.Class, err
 	if err != nil {
 		return nil, fmt.Errorf("invalid id")
 	}
-	c, err := r.AcademicService.GetClassByID(uint(classID))
+	c, err := r.AcademicService.GetClassByID(ctx, uint(classID))
 	if err != nil {
 		return nil, err
 	}
 
 	// Fetch Students
-	studentsData, err := r.AcademicService.GetStudentsByClassID(c.ID, c.Year)
+	studentsData, err := r.AcademicService.GetStudentsByClassID(ctx, c.ID, c.Year)
 	if err != nil {
 		return nil, err
 	}
@@ -130,7 +130,7 @@ func (r *queryResolver) Student(ctx context.Context, id string) (*model.Student,
 	if err != nil {
 		return nil, fmt.Errorf("invalid id")
 	}
-	s, err := r.AcademicService.GetStudentByID(uint(studentID))
+	s, err := r.AcademicService.GetStudentByID(ctx, uint(studentID))
 	if err != nil {
 		return nil, err
 	}
@@ -211,7 +211,7 @@ func (r *studentResolver) ReportCards(ctx context.Context, obj *model.Student, y
 	if err != nil {
 		return nil, fmt.Errorf("invalid student id")
 	}
-	docs, err := r.ReportingService.GetDocumentsByStudentID(uint(studentID))
+	docs, err := r.ReportingService.GetDocumentsByStudentID(ctx, uint(studentID))
 	if err != nil {
 		return nil, err
 	}
@@ -273,7 +273,7 @@ func (r *studentResolver) Documents(ctx context.Context, obj *model.Student) ([]
 	if err != nil {
 		return nil, fmt.Errorf("invalid student id")
 	}
-	docs, err := r.ReportingService.GetDocumentsByStudentID(uint(studentID))
+	docs, err := r.ReportingService.GetDocumentsByStudentID(ctx, uint(studentID))
 	if err != nil {
 		return nil, err
 	}
@@ -294,7 +294,7 @@ func (r *studentResolver) Pdp(ctx context.Context, obj *model.Student) (*model.P
 	if err != nil {
 		return nil, fmt.Errorf("invalid student id")
 	}
-	docs, err := r.ReportingService.GetDocumentsByStudentID(uint(studentID))
+	docs, err := r.ReportingService.GetDocumentsByStudentID(ctx, uint(studentID))
 	if err != nil {
 		return nil, err
 	}
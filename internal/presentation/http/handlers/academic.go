@@ -182,7 +182,7 @@ func (h *AcademicHandler) GetClassDetails(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid class id"})
 		return
 	}
-	class, err := h.service.GetClassByID(uint(classID))
+	class, err := h.service.GetClassByID(c.Request.Context(), uint(classID))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
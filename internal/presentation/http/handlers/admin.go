@@ -1,12 +1,18 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/k/iRegistro/internal/application/admin"
+	"github.com/k/iRegistro/internal/application/auth"
+	"github.com/k/iRegistro/internal/application/communication"
 	"github.com/k/iRegistro/internal/domain"
 )
 
@@ -15,16 +21,17 @@ type AdminHandler struct {
 	auditService  *admin.AuditService
 	importService *admin.UserImportService
 	exportService *admin.DataExportService
+	onboarding    *admin.OnboardingService
 }
 
-func NewAdminHandler(adm *admin.AdminService, audit *admin.AuditService, imp *admin.UserImportService, exp *admin.DataExportService) *AdminHandler {
-	return &AdminHandler{adminService: adm, auditService: audit, importService: imp, exportService: exp}
+func NewAdminHandler(adm *admin.AdminService, audit *admin.AuditService, imp *admin.UserImportService, exp *admin.DataExportService, onboarding *admin.OnboardingService) *AdminHandler {
+	return &AdminHandler{adminService: adm, auditService: audit, importService: imp, exportService: exp, onboarding: onboarding}
 }
 
 // --- SuperAdmin ---
 
 func (h *AdminHandler) CreateSchool(c *gin.Context) {
-	var req map[string]interface{}
+	var req admin.SchoolInput
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -32,6 +39,10 @@ func (h *AdminHandler) CreateSchool(c *gin.Context) {
 
 	school, err := h.adminService.CreateSchool(req)
 	if err != nil {
+		if errors.Is(err, admin.ErrInvalidSchool) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create school"})
 		return
 	}
@@ -42,6 +53,69 @@ func (h *AdminHandler) CreateSchool(c *gin.Context) {
 	})
 }
 
+func (h *AdminHandler) GetSchoolTemplates(c *gin.Context) {
+	c.JSON(http.StatusOK, admin.Templates())
+}
+
+// OnboardSchool creates a school with its campuses, curriculum, staff
+// accounts and settings. When saving fails the recorded onboarding, with
+// the step that failed, is returned with the error.
+func (h *AdminHandler) OnboardSchool(c *gin.Context) {
+	var req admin.OnboardingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	onboarding, err := h.onboarding.Onboard(c.Request.Context(), c.GetUint("userID"), req)
+	if err != nil {
+		if onboarding != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "onboarding": onboarding})
+			return
+		}
+		respondOnboardingError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, onboarding)
+}
+
+func (h *AdminHandler) GetOnboardings(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	onboardings, err := h.onboarding.GetOnboardings(limit, offset)
+	if err != nil {
+		respondOnboardingError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, onboardings)
+}
+
+func (h *AdminHandler) GetOnboarding(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	onboarding, err := h.onboarding.GetOnboarding(uint(id))
+	if err != nil {
+		respondOnboardingError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, onboarding)
+}
+
+func respondOnboardingError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, admin.ErrInvalidSchool):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, admin.ErrOnboardingNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, admin.ErrSchoolCodeTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
 // --- School Admin ---
 
 func (h *AdminHandler) GetSettings(c *gin.Context) {
@@ -97,15 +171,22 @@ func (h *AdminHandler) UpdateSetting(c *gin.Context) {
 	userIDVal, _ := c.Get("userID")
 
 	if err := h.adminService.UpdateSchoolSetting(schoolIDVal.(uint), userIDVal.(uint), req.Key, req.Value); err != nil {
+		if errors.Is(err, auth.ErrSecurityPolicyInvalid) || errors.Is(err, communication.ErrInvalidPreferences) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	c.Status(http.StatusOK)
 }
 
+// RequestExport queues an export of every record of the school, as a ZIP
+// of CSV files or a JSON document, or of the SIDI flow files of a year.
 func (h *AdminHandler) RequestExport(c *gin.Context) {
 	var req struct {
 		Format string `json:"format"`
+		Year   string `json:"year"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -115,14 +196,149 @@ func (h *AdminHandler) RequestExport(c *gin.Context) {
 	schoolIDVal, _ := c.Get("schoolID")
 	userIDVal, _ := c.Get("userID")
 
-	id, err := h.exportService.RequestExport(schoolIDVal.(uint), userIDVal.(uint), req.Format)
+	role, _ := c.Get("role")
+	id, err := h.exportService.RequestExport(schoolIDVal.(uint), userIDVal.(uint), role.(domain.Role), req.Format, req.Year)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondExportError(c, err)
 		return
 	}
 	c.JSON(http.StatusAccepted, gin.H{"export_id": id})
 }
 
+// GetExport returns the status and progress of an export of the user.
+func (h *AdminHandler) GetExport(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	exp, err := h.exportService.GetExport(c.GetUint("schoolID"), c.GetUint("userID"), uint(id))
+	if err != nil {
+		respondExportError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, exp)
+}
+
+// DownloadExport sends the file of a ready export to the user who
+// requested it.
+func (h *AdminHandler) DownloadExport(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	exp, name, err := h.exportService.Download(c.GetUint("schoolID"), c.GetUint("userID"), uint(id), time.Now())
+	if err != nil {
+		respondExportError(c, err)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.FileAttachment(exp.FilePath, name)
+}
+
+func respondExportError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, admin.ErrInvalidExport):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, admin.ErrExportNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, admin.ErrExportNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, admin.ErrExportNotReady):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, admin.ErrExportExpired):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// UploadImport takes a CSV or XLSX file of users and an optional mapping
+// form field, a JSON object of column headers to fields. The validation
+// preview is then available from GetImport.
+func (h *AdminHandler) UploadImport(c *gin.Context) {
+	// Leave room for the multipart envelope
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.importService.MaxSize()+1<<20)
+	header, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file too large"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	var mapping map[string]string
+	if m := c.PostForm("mapping"); m != "" {
+		if err := json.Unmarshal([]byte(m), &mapping); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "mapping must be a JSON object of column headers to fields"})
+			return
+		}
+	}
+	f, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	imp, err := h.importService.Upload(c.GetUint("schoolID"), c.GetUint("userID"), header.Filename, data, mapping)
+	if err != nil {
+		respondImportError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, imp)
+}
+
+func (h *AdminHandler) GetImport(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	imp, err := h.importService.GetImport(c.GetUint("schoolID"), uint(id))
+	if err != nil {
+		respondImportError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, imp)
+}
+
+// ConfirmImport imports the rows of a validated import.
+func (h *AdminHandler) ConfirmImport(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	imp, err := h.importService.Confirm(c.GetUint("schoolID"), c.GetUint("userID"), uint(id))
+	if err != nil {
+		respondImportError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, imp)
+}
+
+func respondImportError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, admin.ErrInvalidImport):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, admin.ErrImportNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, admin.ErrImportState):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
 func (h *AdminHandler) GetAuditLogs(c *gin.Context) {
 	schoolIDVal, _ := c.Get("schoolID")
 
@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/k/iRegistro/internal/application/admin"
 	"github.com/k/iRegistro/internal/domain"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -32,8 +33,8 @@ func (m *MockAdminService) UpdateUser(id uint, updates map[string]interface{}) e
 	return args.Error(0)
 }
 
-func (m *MockAdminService) CreateSchool(data map[string]interface{}) (*domain.School, error) {
-	args := m.Called(data)
+func (m *MockAdminService) CreateSchool(input admin.SchoolInput) (*domain.School, error) {
+	args := m.Called(input)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
 	}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -12,10 +13,12 @@ import (
 
 type AuthHandler struct {
 	service *auth.AuthService
+	mfa     *auth.MFAService
+	resets  *auth.PasswordResetService
 }
 
-func NewAuthHandler(s *auth.AuthService) *AuthHandler {
-	return &AuthHandler{service: s}
+func NewAuthHandler(s *auth.AuthService, mfa *auth.MFAService, resets *auth.PasswordResetService) *AuthHandler {
+	return &AuthHandler{service: s, mfa: mfa, resets: resets}
 }
 
 type RegisterRequest struct {
@@ -63,32 +66,49 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	user, token, refreshToken, err := h.service.Login(req.Email, req.Password, req.OTPCode, c.ClientIP(), c.Request.UserAgent())
+	user, pair, err := h.service.Login(req.Email, req.Password, req.OTPCode, c.ClientIP(), c.Request.UserAgent())
 	if err != nil {
 		if err == domain.ErrInvalidCredentials {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
 			return
 		}
+		if writeSecondFactorError(c, err) {
+			return
+		}
 		// Log the actual error for debugging
 		fmt.Printf("Login error: %v\n", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "login failed"})
 		return
 	}
 
-	// Set Refresh Token in HttpOnly Cookie
-	http.SetCookie(c.Writer, &http.Cookie{
-		Name:     "refresh_token",
-		Value:    refreshToken,
-		Expires:  time.Now().Add(7 * 24 * time.Hour),
-		HttpOnly: true,
-		Secure:   true, // Should be true in production
-		Path:     "/auth/refresh",
-		SameSite: http.SameSiteStrictMode,
-	})
+	respondWithTokens(c, user, pair)
+}
+
+// Refresh rotates the refresh token stored in the HttpOnly cookie and returns a new access token.
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	refreshToken, err := c.Cookie(refreshTokenCookie)
+	if err != nil || refreshToken == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token required"})
+		return
+	}
+
+	user, pair, err := h.service.Refresh(refreshToken, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		clearRefreshTokenCookie(c)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+		return
+	}
+
+	respondWithTokens(c, user, pair)
+}
+
+// respondWithTokens sets the refresh token cookie and returns the access token.
+func respondWithTokens(c *gin.Context, user *domain.User, pair *auth.TokenPair) {
+	setRefreshTokenCookie(c, pair)
 
 	c.JSON(http.StatusOK, gin.H{
-		"access_token": token,
-		"expires_in":   900, // 15 minutes
+		"access_token": pair.AccessToken,
+		"expires_in":   int(time.Until(pair.AccessExpiresAt).Seconds()),
 		"role":         user.Role,
 	})
 }
@@ -131,12 +151,17 @@ func (h *AuthHandler) Verify2FA(c *gin.Context) {
 		return
 	}
 
-	if err := h.service.VerifyAndEnable2FA(userID.(uint), req.Code); err != nil {
+	recoveryCodes, err := h.service.VerifyAndEnable2FA(userID.(uint), req.Code)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "2fa enabled successfully"})
+	resp := gin.H{"message": "2fa enabled successfully"}
+	if len(recoveryCodes) > 0 {
+		resp["recovery_codes"] = recoveryCodes
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
 // Password Reset Handlers
@@ -152,9 +177,8 @@ func (h *AuthHandler) RequestPasswordReset(c *gin.Context) {
 		return
 	}
 
-	if err := h.service.RequestPasswordReset(req.Email); err != nil {
-		// Log error but return success to avoid enumeration?
-		// For dev, return error maybe.
+	// Unknown emails get the same answer, to avoid account enumeration
+	if err := h.resets.RequestReset(req.Email, c.ClientIP()); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to process request"})
 		return
 	}
@@ -175,11 +199,17 @@ func (h *AuthHandler) ResetPassword(c *gin.Context) {
 		return
 	}
 
-	if err := h.service.ResetPassword(req.Email, req.Token, req.NewPassword); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}) // Could be invalid token
+	if err := h.resets.Reset(req.Email, req.Token, req.NewPassword); err != nil {
+		if errors.Is(err, auth.ErrResetTokenInvalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset password"})
 		return
 	}
 
+	// Every session was revoked: the client must log in again
+	clearRefreshTokenCookie(c)
 	c.JSON(http.StatusOK, gin.H{"message": "password reset successfully"})
 }
 
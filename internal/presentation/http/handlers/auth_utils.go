@@ -3,6 +3,20 @@ package handlers
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/k/iRegistro/internal/application/auth"
+)
+
+const (
+	refreshTokenCookie     = "refresh_token"
+	refreshTokenCookiePath = "/api/auth"
 )
 
 // generateRandomState generates a cryptographically secure random state for OAuth2/SAML
@@ -11,3 +25,103 @@ func generateRandomState() string {
 	rand.Read(b)
 	return base64.URLEncoding.EncodeToString(b)
 }
+
+// setRefreshTokenCookie stores the refresh token in an HttpOnly cookie scoped to the auth routes.
+func setRefreshTokenCookie(c *gin.Context, pair *auth.TokenPair) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    pair.RefreshToken,
+		Expires:  pair.RefreshExpiresAt,
+		HttpOnly: true,
+		Secure:   true,
+		Path:     refreshTokenCookiePath,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func clearRefreshTokenCookie(c *gin.Context) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    "",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		Path:     refreshTokenCookiePath,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// loginContext extracts the request metadata recorded in the auth audit log.
+func loginContext(c *gin.Context) auth.LoginContext {
+	return auth.LoginContext{
+		IPAddress: c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
+}
+
+// parseSchoolID validates the school_id query/state value (schools use numeric IDs).
+func parseSchoolID(raw string) (uint, error) {
+	id, err := strconv.ParseUint(raw, 10, 32)
+	if err != nil || id == 0 {
+		return 0, errors.New("invalid school_id")
+	}
+	return uint(id), nil
+}
+
+// splitLoginState splits a "a|b|...|redirect_uri" state value into n parts; the
+// redirect URI is always last so it may itself contain separators.
+func splitLoginState(state string, n int) ([]string, bool) {
+	parts := strings.SplitN(state, "|", n)
+	return parts, len(parts) == n
+}
+
+// loginRedirect validates the redirect_uri of a SPID/CIE login, defaulting
+// to the auth callback of the frontend. The browser is only sent back to
+// the origin of FRONTEND_URL or to one of LOGIN_REDIRECT_ORIGINS (comma
+// separated), as the redirect may carry a link token.
+func loginRedirect(raw string) (string, bool) {
+	frontend := os.Getenv("FRONTEND_URL")
+	if raw == "" {
+		return frontend + "/auth-callback", true
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.User != nil {
+		return "", false
+	}
+	origins := append([]string{frontend}, strings.Split(os.Getenv("LOGIN_REDIRECT_ORIGINS"), ",")...)
+	for _, origin := range origins {
+		o, err := url.Parse(strings.TrimSpace(origin))
+		if err == nil && o.Host != "" && strings.EqualFold(o.Scheme, u.Scheme) && strings.EqualFold(o.Host, u.Host) {
+			return raw, true
+		}
+	}
+	return "", false
+}
+
+// redirectLoggedIn sends the browser back to the frontend after a SPID/CIE
+// login. No credential travels in the URL: the frontend gets its access
+// token from /auth/refresh, with the refresh token cookie just set.
+func redirectLoggedIn(c *gin.Context, redirectURI string) {
+	q := url.Values{}
+	q.Set("status", "logged_in")
+	c.Redirect(http.StatusFound, redirectURI+"?"+q.Encode())
+}
+
+// redirectIdentityPending sends the browser back to the frontend when a SPID/CIE
+// identity is not linked yet. The link token is only present when an existing
+// account has to confirm the link after logging in with its password, and
+// is never sent outside the allowed origins of loginRedirect.
+func redirectIdentityPending(c *gin.Context, redirectURI string, pendErr *auth.IdentityPendingError) {
+	if _, ok := loginRedirect(redirectURI); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "redirect_uri not allowed"})
+		return
+	}
+	q := url.Values{}
+	if pendErr.ConfirmToken != "" {
+		q.Set("status", "link_required")
+		q.Set("link_token", pendErr.ConfirmToken)
+	} else {
+		q.Set("status", "pending_approval")
+	}
+	c.Redirect(http.StatusFound, redirectURI+"?"+q.Encode())
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/k/iRegistro/internal/application/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginRedirect(t *testing.T) {
+	t.Setenv("FRONTEND_URL", "https://registro.example.it")
+	t.Setenv("LOGIN_REDIRECT_ORIGINS", "https://app.example.it, http://localhost:3000")
+
+	allowed := map[string]string{
+		"": "https://registro.example.it/auth-callback",
+		"https://registro.example.it/auth-callback": "https://registro.example.it/auth-callback",
+		"https://APP.example.it/auth-callback":      "https://APP.example.it/auth-callback",
+		"http://localhost:3000/auth-callback":       "http://localhost:3000/auth-callback",
+	}
+	for raw, want := range allowed {
+		got, ok := loginRedirect(raw)
+		assert.True(t, ok, raw)
+		assert.Equal(t, want, got, raw)
+	}
+
+	for _, raw := range []string{
+		"https://evil.example.com/auth-callback",
+		"http://registro.example.it/auth-callback", // Other scheme
+		"https://registro.example.it.evil.com/",
+		"https://registro.example.it@evil.com/",
+		"https://user@registro.example.it/",
+		"//evil.example.com/auth-callback",
+		"javascript:alert(1)",
+		"/auth-callback",
+	} {
+		_, ok := loginRedirect(raw)
+		assert.False(t, ok, raw)
+	}
+}
+
+func TestRedirectIdentityPending(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("FRONTEND_URL", "https://registro.example.it")
+	pending := &auth.IdentityPendingError{ConfirmToken: "link-secret"}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/auth/cie/callback", nil)
+	redirectIdentityPending(c, "https://registro.example.it/auth-callback", pending)
+	require.Equal(t, http.StatusFound, w.Code)
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "registro.example.it", location.Host)
+	assert.Equal(t, "link-secret", location.Query().Get("link_token"))
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/auth/cie/callback", nil)
+	redirectIdentityPending(c, "https://evil.example.com/auth-callback", pending)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.NotContains(t, w.Header().Get("Location")+w.Body.String(), "link-secret")
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/k/iRegistro/internal/application/calendar"
+	"github.com/k/iRegistro/internal/infrastructure/ical"
+)
+
+// feedPath is where the iCalendar feeds are served, followed by the secret.
+const feedPath = "/api/calendar/feed/"
+
+type CalendarHandler struct {
+	service *calendar.CalendarService
+}
+
+func NewCalendarHandler(service *calendar.CalendarService) *CalendarHandler {
+	return &CalendarHandler{service: service}
+}
+
+// CreateToken returns a new feed URL of the user. The secret it contains is
+// not shown again.
+func (h *CalendarHandler) CreateToken(c *gin.Context) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userIDVal, _ := c.Get("userID")
+	token, secret, err := h.service.CreateToken(userIDVal.(uint), req.Name)
+	if err != nil {
+		respondCalendarError(c, err)
+		return
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	path := c.Request.Host + feedPath + secret + ".ics"
+	c.JSON(http.StatusCreated, gin.H{
+		"token":      token,
+		"url":        scheme + "://" + path,
+		"webcal_url": "webcal://" + path, // Opens the subscription in calendar apps
+	})
+}
+
+func (h *CalendarHandler) GetTokens(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	tokens, err := h.service.Tokens(userIDVal.(uint))
+	if err != nil {
+		respondCalendarError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+func (h *CalendarHandler) RevokeToken(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	userIDVal, _ := c.Get("userID")
+	if err := h.service.RevokeToken(userIDVal.(uint), uint(id)); err != nil {
+		respondCalendarError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetFeed serves the iCalendar feed of a token, without login. ?include=
+// limits it to some feeds, e.g. "timetable,homework".
+func (h *CalendarHandler) GetFeed(c *gin.Context) {
+	feeds, err := calendar.ParseFeeds(c.Query("include"))
+	if err != nil {
+		respondCalendarError(c, err)
+		return
+	}
+	now := time.Now()
+	secret := strings.TrimSuffix(c.Param("token"), ".ics")
+	name, events, err := h.service.Feed(secret, feeds, now)
+	if err != nil {
+		respondCalendarError(c, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := ical.Encode(&buf, name, events, now); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Cache-Control", "private, max-age=900")
+	c.Header("Content-Disposition", `inline; filename="iregistro.ics"`)
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", buf.Bytes())
+}
+
+func (h *CalendarHandler) AssignHomework(c *gin.Context) {
+	var req calendar.HomeworkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userIDVal, _ := c.Get("userID")
+	homework, err := h.service.AssignHomework(userIDVal.(uint), req)
+	if err != nil {
+		respondCalendarError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, homework)
+}
+
+func (h *CalendarHandler) CreateEvent(c *gin.Context) {
+	var req calendar.EventRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userIDVal, _ := c.Get("userID")
+	event, err := h.service.CreateEvent(userIDVal.(uint), req)
+	if err != nil {
+		respondCalendarError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, event)
+}
+
+func respondCalendarError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, calendar.ErrUnknownFeed), errors.Is(err, calendar.ErrInvalidHomework), errors.Is(err, calendar.ErrInvalidEvent):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, calendar.ErrNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, calendar.ErrTokenNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, calendar.ErrTooManyTokens):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -1,13 +1,12 @@
 package handlers
 
 import (
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
-	"strconv"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"github.com/k/iRegistro/internal/application/auth"
 )
 
@@ -22,22 +21,17 @@ func NewCIEHandler(cieService *auth.CIEService) *CIEHandler {
 }
 
 // Login initiates CIE authentication flow
-// GET /auth/cie/login?redirect_uri=<url>&school_id=<uuid>
+// GET /auth/cie/login?redirect_uri=<url>&school_id=<id>
 func (h *CIEHandler) Login(c *gin.Context) {
-	redirectURI := c.Query("redirect_uri")
-	if redirectURI == "" {
-		redirectURI = os.Getenv("FRONTEND_URL") + "/auth-callback"
-	}
-
-	schoolID := c.Query("school_id")
-	if schoolID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "school_id required"})
+	redirectURI, ok := loginRedirect(c.Query("redirect_uri"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "redirect_uri not allowed"})
 		return
 	}
 
-	// Validate school_id is UUID
-	if _, err := uuid.Parse(schoolID); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid school_id"})
+	schoolID, err := parseSchoolID(c.Query("school_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "valid school_id required"})
 		return
 	}
 
@@ -45,7 +39,7 @@ func (h *CIEHandler) Login(c *gin.Context) {
 	state := generateRandomState()
 
 	// Store state in secure cookie with redirect_uri and school_id
-	stateData := fmt.Sprintf("%s|%s|%s", state, redirectURI, schoolID)
+	stateData := fmt.Sprintf("%s|%d|%s", state, schoolID, redirectURI)
 	c.SetCookie(
 		"oauth_state",
 		stateData,
@@ -65,9 +59,12 @@ func (h *CIEHandler) Login(c *gin.Context) {
 // Callback handles CIE OIDC callback
 // GET /auth/cie/callback?code=<code>&state=<state>
 func (h *CIEHandler) Callback(c *gin.Context) {
+	lc := loginContext(c)
+
 	// Verify state to prevent CSRF
 	stateCookie, err := c.Cookie("oauth_state")
 	if err != nil {
+		h.cieService.RecordFailure(lc, "missing state cookie")
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing state cookie"})
 		return
 	}
@@ -77,31 +74,38 @@ func (h *CIEHandler) Callback(c *gin.Context) {
 
 	stateQuery := c.Query("state")
 	if stateQuery == "" {
+		h.cieService.RecordFailure(lc, "missing state parameter")
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing state parameter"})
 		return
 	}
 
-	// Parse state cookie: "state|redirect_uri|school_id"
-	var state, redirectURI, schoolIDStr string
-	fmt.Sscanf(stateCookie, "%s|%s|%s", &state, &redirectURI, &schoolIDStr)
+	// Parse state cookie: "state|school_id|redirect_uri"
+	parts, ok := splitLoginState(stateCookie, 3)
 
 	// Verify state matches
-	if state != stateQuery {
+	if !ok || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(stateQuery)) != 1 {
+		h.cieService.RecordFailure(lc, "state mismatch")
 		c.JSON(http.StatusBadRequest, gin.H{"error": "State mismatch - possible CSRF attack"})
 		return
 	}
 
-	// Parse school_id as uint
-	id, err := strconv.ParseUint(schoolIDStr, 10, 32)
+	schoolID, err := parseSchoolID(parts[1])
 	if err != nil {
+		h.cieService.RecordFailure(lc, "invalid school_id")
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid school_id"})
 		return
 	}
-	schoolID := uint(id)
+	redirectURI, ok := loginRedirect(parts[2])
+	if !ok {
+		h.cieService.RecordFailure(lc, "redirect_uri not allowed")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "redirect_uri not allowed"})
+		return
+	}
 
 	// Get authorization code
 	code := c.Query("code")
 	if code == "" {
+		h.cieService.RecordFailure(lc, "missing authorization code")
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing authorization code"})
 		return
 	}
@@ -109,6 +113,7 @@ func (h *CIEHandler) Callback(c *gin.Context) {
 	// Exchange code for token
 	token, err := h.cieService.ExchangeCodeForToken(c.Request.Context(), code)
 	if err != nil {
+		h.cieService.RecordFailure(lc, "token exchange failed: "+err.Error())
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token exchange failed", "details": err.Error()})
 		return
 	}
@@ -116,6 +121,7 @@ func (h *CIEHandler) Callback(c *gin.Context) {
 	// Extract and validate ID token
 	rawIDToken, ok := token.Extra("id_token").(string)
 	if !ok {
+		h.cieService.RecordFailure(lc, "no id_token in response")
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "No ID token in response"})
 		return
 	}
@@ -123,29 +129,32 @@ func (h *CIEHandler) Callback(c *gin.Context) {
 	// Validate and extract CIE claims
 	claims, err := h.cieService.ValidateAndExtractClaims(c.Request.Context(), rawIDToken)
 	if err != nil {
+		h.cieService.RecordFailure(lc, "id_token validation failed: "+err.Error())
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token validation failed", "details": err.Error()})
 		return
 	}
 
-	// Get or create user
-	user, err := h.cieService.GetOrCreateUserByCIE(c.Request.Context(), claims, schoolID)
+	// Resolve the linked user; unknown identities are queued, never auto-created
+	user, err := h.cieService.ResolveUserByCIE(c.Request.Context(), claims, schoolID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "User creation failed", "details": err.Error()})
+		var pendErr *auth.IdentityPendingError
+		if errors.As(err, &pendErr) {
+			h.cieService.RecordFailure(lc, pendErr.Error())
+			redirectIdentityPending(c, redirectURI, pendErr)
+			return
+		}
+		h.cieService.RecordFailure(lc, "user resolution failed: "+err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User resolution failed"})
 		return
 	}
 
-	// Generate JWT token
-	jwtToken, err := h.cieService.GenerateTokenForUser(user)
+	// Issue access/refresh tokens through the shared token service
+	pair, err := h.cieService.IssueTokens(user, lc)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "JWT generation failed"})
 		return
 	}
+	setRefreshTokenCookie(c, pair)
 
-	// Redirect to frontend with JWT token
-	if redirectURI == "" {
-		redirectURI = os.Getenv("FRONTEND_URL") + "/auth-callback"
-	}
-
-	finalURL := fmt.Sprintf("%s?token=%s", redirectURI, jwtToken)
-	c.Redirect(http.StatusFound, finalURL)
+	redirectLoggedIn(c, redirectURI)
 }
@@ -1,6 +1,9 @@
 package handlers
 
 import (
+	"errors"
+	"io"
+	"mime"
 	"net/http"
 	"strconv"
 	"time"
@@ -14,10 +17,12 @@ type CommunicationHandler struct {
 	notifService *communication.NotificationService
 	msgService   *communication.MessagingService
 	colService   *communication.ColloquiumService
+	annService   *communication.AnnouncementService
+	attService   *communication.AttachmentService
 }
 
-func NewCommunicationHandler(n *communication.NotificationService, m *communication.MessagingService, c *communication.ColloquiumService) *CommunicationHandler {
-	return &CommunicationHandler{notifService: n, msgService: m, colService: c}
+func NewCommunicationHandler(n *communication.NotificationService, m *communication.MessagingService, c *communication.ColloquiumService, a *communication.AnnouncementService, att *communication.AttachmentService) *CommunicationHandler {
+	return &CommunicationHandler{notifService: n, msgService: m, colService: c, annService: a, attService: att}
 }
 
 // --- Notifications ---
@@ -46,25 +51,148 @@ func (h *CommunicationHandler) ReadNotification(c *gin.Context) {
 	c.Status(http.StatusOK)
 }
 
+func (h *CommunicationHandler) GetNotificationPreferences(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	prefs, err := h.notifService.GetPreferences(userIDVal.(uint))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, prefs)
+}
+
+func (h *CommunicationHandler) UpdateNotificationPreferences(c *gin.Context) {
+	var req []domain.NotificationPreference
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userIDVal, _ := c.Get("userID")
+	if err := h.notifService.UpdatePreferences(userIDVal.(uint), req); err != nil {
+		respondPreferencesError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func (h *CommunicationHandler) UpdateNotificationSettings(c *gin.Context) {
+	var req domain.NotificationSettings
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userIDVal, _ := c.Get("userID")
+	if err := h.notifService.UpdateSettings(userIDVal.(uint), req); err != nil {
+		respondPreferencesError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func (h *CommunicationHandler) GetPushPublicKey(c *gin.Context) {
+	key := h.notifService.PushPublicKey()
+	if key == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "web push is not configured"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"public_key": key})
+}
+
+func (h *CommunicationHandler) SubscribePush(c *gin.Context) {
+	// Same shape as PushSubscription.toJSON() in the browser
+	var req struct {
+		Endpoint string `json:"endpoint" binding:"required"`
+		Keys     struct {
+			P256dh string `json:"p256dh" binding:"required"`
+			Auth   string `json:"auth" binding:"required"`
+		} `json:"keys"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userIDVal, _ := c.Get("userID")
+	sub := &domain.PushSubscription{
+		Endpoint:  req.Endpoint,
+		P256dh:    req.Keys.P256dh,
+		Auth:      req.Keys.Auth,
+		UserAgent: c.Request.UserAgent(),
+	}
+	if err := h.notifService.SubscribePush(userIDVal.(uint), sub); err != nil {
+		if errors.Is(err, communication.ErrInvalidPushSubscription) || errors.Is(err, communication.ErrChannelNotEnabled) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusCreated)
+}
+
+func (h *CommunicationHandler) UnsubscribePush(c *gin.Context) {
+	var req struct {
+		Endpoint string `json:"endpoint" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userIDVal, _ := c.Get("userID")
+	if err := h.notifService.UnsubscribePush(userIDVal.(uint), req.Endpoint); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// GetSMSUsage returns the school's SMS traffic and cost in ?month=YYYY-MM,
+// the current month by default.
+func (h *CommunicationHandler) GetSMSUsage(c *gin.Context) {
+	month := c.DefaultQuery("month", time.Now().Format("2006-01"))
+	schoolIDVal, _ := c.Get("schoolID")
+	usage, err := h.notifService.SMSUsage(schoolIDVal.(uint), month)
+	if err != nil {
+		respondPreferencesError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, usage)
+}
+
+func respondPreferencesError(c *gin.Context, err error) {
+	if errors.Is(err, communication.ErrInvalidPreferences) || errors.Is(err, communication.ErrChannelNotEnabled) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
 // --- Messaging ---
 
 func (h *CommunicationHandler) CreateConversation(c *gin.Context) {
 	var req struct {
-		ParticipantIDs []uint `json:"participant_ids"`
-		Subject        string `json:"subject"`
-		IsGroup        bool   `json:"is_group"`
+		ParticipantIDs []uint                  `json:"participant_ids"`
+		Subject        string                  `json:"subject"`
+		Type           domain.ConversationType `json:"type"`
+		IsGroup        bool                    `json:"is_group"` // Same as type CLASS
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if req.Type == "" && req.IsGroup {
+		req.Type = domain.ConvTypeClass
+	}
 
 	userIDVal, _ := c.Get("userID")
 	initiatorID := userIDVal.(uint)
 
-	id, err := h.msgService.CreateConversation(initiatorID, req.ParticipantIDs, req.Subject, req.IsGroup)
+	id, err := h.msgService.CreateConversation(initiatorID, req.ParticipantIDs, req.Subject, req.Type)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondMessagingError(c, err)
 		return
 	}
 	c.JSON(http.StatusCreated, gin.H{"id": id})
@@ -83,12 +211,8 @@ func (h *CommunicationHandler) GetConversations(c *gin.Context) {
 func (h *CommunicationHandler) SendMessage(c *gin.Context) {
 	convID, _ := strconv.Atoi(c.Param("id"))
 	var req struct {
-		Body        string `json:"body"`
-		Attachments []struct {
-			FilePath string `json:"file_path"`
-			FileName string `json:"file_name"`
-			FileType string `json:"file_type"`
-		} `json:"attachments"`
+		Body          string `json:"body"`
+		AttachmentIDs []uint `json:"attachment_ids"` // Uploaded with POST /attachments
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -97,19 +221,9 @@ func (h *CommunicationHandler) SendMessage(c *gin.Context) {
 
 	userIDVal, _ := c.Get("userID")
 
-	// Convert attachments
-	var atts []domain.MessageAttachment
-	for _, a := range req.Attachments {
-		atts = append(atts, domain.MessageAttachment{
-			FilePath: a.FilePath,
-			FileName: a.FileName,
-			FileType: a.FileType,
-		})
-	}
-
-	msg, err := h.msgService.SendMessage(userIDVal.(uint), uint(convID), req.Body, atts)
+	msg, err := h.msgService.SendMessage(c.Request.Context(), userIDVal.(uint), uint(convID), req.Body, req.AttachmentIDs)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondMessagingError(c, err)
 		return
 	}
 	c.JSON(http.StatusCreated, msg)
@@ -117,16 +231,215 @@ func (h *CommunicationHandler) SendMessage(c *gin.Context) {
 
 func (h *CommunicationHandler) GetMessages(c *gin.Context) {
 	convID, _ := strconv.Atoi(c.Param("id"))
-	userIDVal, _ := c.Get("userID") // unused in basic impl, but good for validation
+	userIDVal, _ := c.Get("userID")
 
-	msgs, err := h.msgService.GetConversationMessages(uint(convID), userIDVal.(uint), 50, 0)
+	msgs, err := h.msgService.GetConversationMessages(c.Request.Context(), uint(convID), userIDVal.(uint), 50, 0)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondMessagingError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, msgs)
 }
 
+func (h *CommunicationHandler) DeleteMessage(c *gin.Context) {
+	msgID, _ := strconv.Atoi(c.Param("id"))
+	userIDVal, _ := c.Get("userID")
+	if err := h.msgService.SoftDeleteMessage(uint(msgID), userIDVal.(uint)); err != nil {
+		respondMessagingError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (h *CommunicationHandler) AddParticipants(c *gin.Context) {
+	convID, _ := strconv.Atoi(c.Param("id"))
+	var req struct {
+		UserIDs []uint `json:"user_ids" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userIDVal, _ := c.Get("userID")
+	if err := h.msgService.AddParticipants(c.Request.Context(), userIDVal.(uint), uint(convID), req.UserIDs); err != nil {
+		respondMessagingError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (h *CommunicationHandler) RemoveParticipant(c *gin.Context) {
+	convID, _ := strconv.Atoi(c.Param("id"))
+	userID, _ := strconv.Atoi(c.Param("userId"))
+	actorIDVal, _ := c.Get("userID")
+	if err := h.msgService.RemoveParticipant(c.Request.Context(), actorIDVal.(uint), uint(convID), uint(userID)); err != nil {
+		respondMessagingError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (h *CommunicationHandler) LeaveConversation(c *gin.Context) {
+	convID, _ := strconv.Atoi(c.Param("id"))
+	userIDVal, _ := c.Get("userID")
+	if err := h.msgService.LeaveConversation(c.Request.Context(), userIDVal.(uint), uint(convID)); err != nil {
+		respondMessagingError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// --- Attachments ---
+
+// UploadAttachment stores the multipart "file" field, to be sent with a
+// message by its id.
+func (h *CommunicationHandler) UploadAttachment(c *gin.Context) {
+	// Leave room for the multipart envelope
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.attService.MaxSize()+1<<20)
+	header, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondMessagingError(c, communication.ErrAttachmentTooLarge)
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	if header.Size > h.attService.MaxSize() {
+		respondMessagingError(c, communication.ErrAttachmentTooLarge)
+		return
+	}
+	f, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	userIDVal, _ := c.Get("userID")
+	schoolIDVal, _ := c.Get("schoolID")
+	schoolID, _ := schoolIDVal.(uint)
+	att, err := h.attService.Upload(c.Request.Context(), userIDVal.(uint), schoolID, header.Filename, data)
+	if err != nil {
+		respondMessagingError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, att)
+}
+
+func (h *CommunicationHandler) DownloadAttachment(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	userIDVal, _ := c.Get("userID")
+	att, data, err := h.attService.Open(c.Request.Context(), userIDVal.(uint), uint(id))
+	if err != nil {
+		respondMessagingError(c, err)
+		return
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": att.FileName}))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, att.MimeType, data)
+}
+
+func respondMessagingError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, communication.ErrInvalidAttachment):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, communication.ErrAttachmentTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case errors.Is(err, communication.ErrAttachmentType):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	case errors.Is(err, communication.ErrAttachmentInfected):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, communication.ErrScanUnavailable):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": communication.ErrScanUnavailable.Error()})
+	case errors.Is(err, communication.ErrConversationNotFound), errors.Is(err, communication.ErrMessageNotFound),
+		errors.Is(err, communication.ErrAttachmentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, communication.ErrNotParticipant), errors.Is(err, communication.ErrMessagingNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// --- Announcements ---
+
+func (h *CommunicationHandler) PublishAnnouncement(c *gin.Context) {
+	var req communication.AnnouncementRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userIDVal, _ := c.Get("userID")
+	a, err := h.annService.Publish(userIDVal.(uint), req)
+	if err != nil {
+		respondAnnouncementError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, a)
+}
+
+func (h *CommunicationHandler) GetAnnouncements(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	announcements, err := h.annService.GetUserAnnouncements(userIDVal.(uint))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, announcements)
+}
+
+func (h *CommunicationHandler) ReadAnnouncement(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	userIDVal, _ := c.Get("userID")
+	if err := h.annService.MarkRead(userIDVal.(uint), uint(id)); err != nil {
+		respondAnnouncementError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (h *CommunicationHandler) GetAnnouncementReads(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	userIDVal, _ := c.Get("userID")
+	status, err := h.annService.ReadStatus(userIDVal.(uint), uint(id))
+	if err != nil {
+		respondAnnouncementError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+func (h *CommunicationHandler) RemindAnnouncement(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	userIDVal, _ := c.Get("userID")
+	reminded, err := h.annService.RemindUnread(userIDVal.(uint), uint(id), time.Now())
+	if err != nil {
+		respondAnnouncementError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"reminded": reminded})
+}
+
+func respondAnnouncementError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, communication.ErrInvalidAnnouncement):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, communication.ErrAnnouncementNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, communication.ErrReminderTooSoon):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	default:
+		respondMessagingError(c, err)
+	}
+}
+
 // --- Colloquiums ---
 
 func (h *CommunicationHandler) CreateSlot(c *gin.Context) {
@@ -136,6 +449,7 @@ func (h *CommunicationHandler) CreateSlot(c *gin.Context) {
 		EndTime         string    `json:"end_time"`
 		MaxParticipants int       `json:"max_participants"`
 		Type            string    `json:"type"`
+		Mode            string    `json:"mode"` // PRESENZA (default), ONLINE or TELEFONO
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -144,12 +458,12 @@ func (h *CommunicationHandler) CreateSlot(c *gin.Context) {
 
 	userIDVal, _ := c.Get("userID") // Teacher ID
 
-	err := h.colService.CreateSlot(userIDVal.(uint), req.Date, req.StartTime, req.EndTime, req.MaxParticipants, domain.ColloquiumType(req.Type))
+	slot, err := h.colService.CreateSlot(c.Request.Context(), userIDVal.(uint), req.Date, req.StartTime, req.EndTime, req.MaxParticipants, domain.ColloquiumType(req.Type), domain.ColloquiumMode(req.Mode))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondColloquiumError(c, err)
 		return
 	}
-	c.Status(http.StatusCreated)
+	c.JSON(http.StatusCreated, slot)
 }
 
 func (h *CommunicationHandler) GetAvailableSlots(c *gin.Context) {
@@ -175,10 +489,114 @@ func (h *CommunicationHandler) BookSlot(c *gin.Context) {
 
 	userIDVal, _ := c.Get("userID") // Parent ID
 
-	err := h.colService.BookSlot(req.SlotID, userIDVal.(uint), req.StudentID, req.Notes)
+	booking, err := h.colService.BookSlot(req.SlotID, userIDVal.(uint), req.StudentID, req.Notes)
+	if err != nil {
+		respondColloquiumError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, booking)
+}
+
+func (h *CommunicationHandler) GetBookings(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	bookings, err := h.colService.GetParentBookings(userIDVal.(uint))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.Status(http.StatusCreated)
+	c.JSON(http.StatusOK, bookings)
+}
+
+// CancelBooking is used by the parent who booked and by the teacher.
+func (h *CommunicationHandler) CancelBooking(c *gin.Context) {
+	bookingID, _ := strconv.Atoi(c.Param("id"))
+	userIDVal, _ := c.Get("userID")
+	if err := h.colService.CancelBooking(c.Request.Context(), userIDVal.(uint), uint(bookingID)); err != nil {
+		respondColloquiumError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (h *CommunicationHandler) CancelSlot(c *gin.Context) {
+	slotID, _ := strconv.Atoi(c.Param("id"))
+	userIDVal, _ := c.Get("userID")
+	if err := h.colService.CancelSlot(userIDVal.(uint), uint(slotID)); err != nil {
+		respondColloquiumError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// CheckIn lets the teacher enter the waiting room of their slot.
+func (h *CommunicationHandler) CheckIn(c *gin.Context) {
+	slotID, _ := strconv.Atoi(c.Param("id"))
+	userIDVal, _ := c.Get("userID")
+	room, err := h.colService.CheckIn(userIDVal.(uint), uint(slotID), time.Now())
+	if err != nil {
+		respondColloquiumError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, room)
+}
+
+func (h *CommunicationHandler) GetWaitingRoom(c *gin.Context) {
+	slotID, _ := strconv.Atoi(c.Param("id"))
+	userIDVal, _ := c.Get("userID")
+	room, err := h.colService.WaitingRoom(userIDVal.(uint), uint(slotID), time.Now())
+	if err != nil {
+		respondColloquiumError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, room)
+}
+
+func (h *CommunicationHandler) AddBookingNotes(c *gin.Context) {
+	var req struct {
+		Notes string `json:"notes"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	bookingID, _ := strconv.Atoi(c.Param("id"))
+	userIDVal, _ := c.Get("userID")
+	if err := h.colService.AddNotes(c.Request.Context(), userIDVal.(uint), uint(bookingID), req.Notes); err != nil {
+		respondColloquiumError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (h *CommunicationHandler) AddBookingFeedback(c *gin.Context) {
+	var req struct {
+		Rating int    `json:"rating" binding:"required"`
+		Text   string `json:"text"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	bookingID, _ := strconv.Atoi(c.Param("id"))
+	userIDVal, _ := c.Get("userID")
+	if err := h.colService.AddFeedback(c.Request.Context(), userIDVal.(uint), uint(bookingID), req.Rating, req.Text); err != nil {
+		respondColloquiumError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func respondColloquiumError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, communication.ErrInvalidSlot), errors.Is(err, communication.ErrInvalidFeedback):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, communication.ErrSlotNotFound), errors.Is(err, communication.ErrBookingNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, communication.ErrColloquiumNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, domain.ErrSlotUnavailable), errors.Is(err, domain.ErrAlreadyBooked), errors.Is(err, communication.ErrColloquiumNotEnded):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
 }
@@ -45,7 +45,7 @@ func (h *DirectorHandler) SignDocument(c *gin.Context) {
 		return
 	}
 
-	if err := h.service.SignDocument(uint(id), req.PIN); err != nil {
+	if err := h.service.SignDocument(c.Request.Context(), uint(id), req.PIN); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -9,6 +9,10 @@ import (
 	"github.com/k/iRegistro/internal/infrastructure/storage"
 )
 
+// attachmentsDir holds the message attachments, which are only served through
+// the access-checked attachment endpoint.
+const attachmentsDir = "attachments"
+
 type FileHandler struct {
 	storage *storage.LocalStorage
 }
@@ -17,11 +21,11 @@ func NewFileHandler(storage *storage.LocalStorage) *FileHandler {
 	return &FileHandler{storage: storage}
 }
 
+// DownloadFile serves a stored file by the path LocalStorage.Save returned.
+// Paths resolving outside the storage directory are rejected.
 func (h *FileHandler) DownloadFile(c *gin.Context) {
-	// Query param: path
 	// Security: In real app, verify user has access to this specific file (via relation check)
-	// For now, relies on Authentication Middleware already verifying user is logged in
-	// and simple path traversal check.
+	// For now, relies on Authentication Middleware already verifying user is logged in.
 
 	relPath := c.Query("path")
 	if relPath == "" {
@@ -29,23 +33,15 @@ func (h *FileHandler) DownloadFile(c *gin.Context) {
 		return
 	}
 
-	// Basic path traversal prevention (though LocalStorage.Save likely put it in safe place)
-	// Clean path
 	safePath := filepath.Clean(relPath)
-	if strings.Contains(safePath, "..") {
+	rel, err := h.storage.Rel(safePath)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid path"})
 		return
 	}
-
-	// In a real scenario, we might want to check DB if this user owns this document
-	// file, err := h.storage.Get(safePath) ...
-	// But `gin.File` serves from disk.
-	// Assuming `relPath` is absolute or relative to where CWD is, or we prepend storage BaseDir.
-	// Since LocalStorage returns full path on Save, we assume `relPath` is that Full Path.
-
-	// Check if file exists in our storage directory to prevent arbitrary read
-	if !strings.HasPrefix(safePath, h.storage.BaseDir) {
-		// If the stored path doesn't start with base dir (unlikely if strictly controlled), reject or handle
+	if rel == attachmentsDir || strings.HasPrefix(rel, attachmentsDir+string(filepath.Separator)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "attachments are downloaded from /communication/attachments"})
+		return
 	}
 
 	c.File(safePath)
@@ -3,11 +3,13 @@ package handlers
 import (
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/gin-gonic/gin"
 	"github.com/k/iRegistro/internal/infrastructure/storage"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDownloadFile_BadRequest_NoPath(t *testing.T) {
@@ -37,3 +39,43 @@ func TestDownloadFile_BadRequest_PathTraversal(t *testing.T) {
 
 	assert.Equal(t, http.StatusBadRequest, w.Code)
 }
+
+func TestDownloadFile_OutsideStorage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	base := t.TempDir()
+	localStorage, _ := storage.NewLocalStorage(base)
+	h := NewFileHandler(localStorage)
+
+	for _, path := range []string{"/etc/passwd", base + "-other/file.pdf", base} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request, _ = http.NewRequest("GET", "/files/download?path="+url.QueryEscape(path), nil)
+
+		h.DownloadFile(c)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+	}
+}
+
+func TestDownloadFile_Stored(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	localStorage, _ := storage.NewLocalStorage(t.TempDir())
+	h := NewFileHandler(localStorage)
+	report, err := localStorage.Save("report.pdf", []byte("%PDF-1.4"))
+	require.NoError(t, err)
+	attachment, err := localStorage.Save("attachments/ab/abcdef", []byte("secret"))
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest("GET", "/files/download?path="+url.QueryEscape(report), nil)
+	h.DownloadFile(c)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "%PDF-1.4", w.Body.String())
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest("GET", "/files/download?path="+url.QueryEscape(attachment), nil)
+	h.DownloadFile(c)
+	assert.Equal(t, http.StatusForbidden, w.Code, "attachments need the access check")
+}
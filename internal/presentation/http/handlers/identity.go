@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/k/iRegistro/internal/application/auth"
+	"github.com/k/iRegistro/internal/domain"
+)
+
+// IdentityHandler exposes SPID/CIE account linking: confirmation by the owner of
+// an existing account and the secretary approval queue.
+type IdentityHandler struct {
+	service *auth.IdentityLinkService
+}
+
+func NewIdentityHandler(service *auth.IdentityLinkService) *IdentityHandler {
+	return &IdentityHandler{service: service}
+}
+
+// ConfirmLink links a SPID/CIE identity to the logged-in account.
+// POST /auth/identity-links/confirm
+func (h *IdentityHandler) ConfirmLink(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userIDVal, _ := c.Get("userID")
+	user, err := h.service.ConfirmLink(userIDVal.(uint), req.Token)
+	if err != nil {
+		h.writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Identity linked", "user": user})
+}
+
+// ListPending returns the identities waiting for approval in the secretary's school.
+// GET /secretary/identities/pending
+func (h *IdentityHandler) ListPending(c *gin.Context) {
+	schoolIDVal, _ := c.Get("schoolID")
+	list, err := h.service.ListPending(schoolIDVal.(uint))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// Approve links the identity to an existing user or creates the account with a role.
+// POST /secretary/identities/:id/approve
+func (h *IdentityHandler) Approve(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var req struct {
+		UserID *uint       `json:"user_id"`
+		Role   domain.Role `json:"role"`
+		Email  string      `json:"email"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	schoolIDVal, _ := c.Get("schoolID")
+	userIDVal, _ := c.Get("userID")
+
+	user, err := h.service.Approve(schoolIDVal.(uint), uint(id), userIDVal.(uint), auth.ApprovalRequest{
+		UserID: req.UserID,
+		Role:   req.Role,
+		Email:  req.Email,
+	})
+	if err != nil {
+		h.writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// Reject closes the request without creating an account.
+// POST /secretary/identities/:id/reject
+func (h *IdentityHandler) Reject(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	c.ShouldBindJSON(&req)
+
+	schoolIDVal, _ := c.Get("schoolID")
+	userIDVal, _ := c.Get("userID")
+
+	if err := h.service.Reject(schoolIDVal.(uint), uint(id), userIDVal.(uint), req.Reason); err != nil {
+		h.writeError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func (h *IdentityHandler) writeError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, auth.ErrIdentityLinkTokenInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, auth.ErrIdentityNotPending):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, auth.ErrIdentityForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, auth.ErrIdentityRoleNotAllowed), errors.Is(err, auth.ErrIdentityEmailRequired):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/k/iRegistro/internal/application/communication"
+	"github.com/k/iRegistro/internal/domain"
+)
+
+type MeetingDayHandler struct {
+	service *communication.MeetingDayService
+}
+
+func NewMeetingDayHandler(service *communication.MeetingDayService) *MeetingDayHandler {
+	return &MeetingDayHandler{service: service}
+}
+
+func (h *MeetingDayHandler) CreateMeetingDay(c *gin.Context) {
+	var req communication.MeetingDayRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userIDVal, _ := c.Get("userID")
+	day, err := h.service.CreateMeetingDay(userIDVal.(uint), req)
+	if err != nil {
+		respondMeetingDayError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, day)
+}
+
+func (h *MeetingDayHandler) GetMeetingDay(c *gin.Context) {
+	dayID, _ := strconv.Atoi(c.Param("id"))
+	schoolIDVal, _ := c.Get("schoolID")
+	schoolID, _ := schoolIDVal.(uint)
+	day, err := h.service.GetMeetingDay(schoolID, uint(dayID))
+	if err != nil {
+		respondMeetingDayError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, day)
+}
+
+// BookItinerary books the meetings of a parent with the teachers of a
+// student; with no teacher_ids, with all the teachers present.
+func (h *MeetingDayHandler) BookItinerary(c *gin.Context) {
+	var req struct {
+		StudentID  uint   `json:"student_id" binding:"required"`
+		TeacherIDs []uint `json:"teacher_ids"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dayID, _ := strconv.Atoi(c.Param("id"))
+	userIDVal, _ := c.Get("userID")
+	itinerary, err := h.service.BookItinerary(c.Request.Context(), userIDVal.(uint), uint(dayID), req.StudentID, req.TeacherIDs)
+	if err != nil {
+		respondMeetingDayError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, itinerary)
+}
+
+func (h *MeetingDayHandler) GetItinerary(c *gin.Context) {
+	dayID, _ := strconv.Atoi(c.Param("id"))
+	userIDVal, _ := c.Get("userID")
+	itinerary, err := h.service.Itinerary(userIDVal.(uint), uint(dayID))
+	if err != nil {
+		respondMeetingDayError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, itinerary)
+}
+
+// GetTeacherSchedule returns the schedule of a teacher, as a PDF to print
+// with ?format=pdf.
+func (h *MeetingDayHandler) GetTeacherSchedule(c *gin.Context) {
+	dayID, _ := strconv.Atoi(c.Param("id"))
+	teacherID, _ := strconv.Atoi(c.Param("teacherId"))
+	userIDVal, _ := c.Get("userID")
+
+	if c.Query("format") == "pdf" {
+		data, err := h.service.PrintTeacherSchedule(c.Request.Context(), userIDVal.(uint), uint(dayID), uint(teacherID))
+		if err != nil {
+			respondMeetingDayError(c, err)
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="schedule-%d-%d.pdf"`, dayID, teacherID))
+		c.Data(http.StatusOK, "application/pdf", data)
+		return
+	}
+
+	schedule, err := h.service.TeacherSchedule(c.Request.Context(), userIDVal.(uint), uint(dayID), uint(teacherID))
+	if err != nil {
+		respondMeetingDayError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, schedule)
+}
+
+func respondMeetingDayError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, communication.ErrInvalidMeetingDay):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, communication.ErrMeetingDayNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, communication.ErrNoItinerary), errors.Is(err, domain.ErrSlotUnavailable), errors.Is(err, domain.ErrAlreadyBooked):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		respondColloquiumError(c, err)
+	}
+}
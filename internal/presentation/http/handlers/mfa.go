@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/k/iRegistro/internal/application/auth"
+	"github.com/k/iRegistro/internal/domain"
+)
+
+// writeSecondFactorError maps second factor errors to responses. It returns
+// false if err is not one of them.
+func writeSecondFactorError(c *gin.Context, err error) bool {
+	var challenge *auth.SecondFactorChallenge
+	switch {
+	case errors.As(err, &challenge) && errors.Is(err, auth.ErrSecondFactorEnrollmentRequired):
+		// The school requires a second factor and the user has none: the
+		// enrollment token only grants access to the enrollment routes
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":            "second factor enrollment required",
+			"enrollment_token": challenge.Token,
+		})
+	case errors.As(err, &challenge):
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":           "second factor required",
+			"challenge_token": challenge.Token,
+			"methods":         challenge.Methods,
+		})
+	case errors.Is(err, auth.ErrSecondFactorInvalid):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid second factor"})
+	case errors.Is(err, auth.ErrChallengeTokenInvalid):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "login expired, please start again"})
+	case errors.Is(err, auth.ErrWebAuthnCeremonyInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "webauthn session expired, please retry"})
+	case errors.Is(err, auth.ErrWebAuthnRegistration):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, auth.ErrPasskeyLoginNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, auth.ErrWebAuthnNotConfigured):
+		c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+	default:
+		return false
+	}
+	return true
+}
+
+type SecondFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+// LoginSecondFactor completes a login with a TOTP code or a recovery code.
+func (h *AuthHandler) LoginSecondFactor(c *gin.Context) {
+	var req SecondFactorLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, pair, err := h.service.CompleteSecondFactor(req.ChallengeToken, req.Code, req.RecoveryCode, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		if !writeSecondFactorError(c, err) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	respondWithTokens(c, user, pair)
+}
+
+type WebAuthnLoginBeginRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+}
+
+// BeginLoginWebAuthn returns the options for navigator.credentials.get().
+func (h *AuthHandler) BeginLoginWebAuthn(c *gin.Context) {
+	var req WebAuthnLoginBeginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	opts, err := h.service.BeginSecondFactorWebAuthn(req.ChallengeToken)
+	if err != nil {
+		if !writeSecondFactorError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start webauthn login"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, opts)
+}
+
+type WebAuthnFinishRequest struct {
+	ChallengeToken string          `json:"challenge_token"`
+	SessionID      string          `json:"session_id" binding:"required"`
+	Name           string          `json:"name"`                          // Registration only
+	Credential     json.RawMessage `json:"credential" binding:"required"` // PublicKeyCredential as JSON
+}
+
+// FinishLoginWebAuthn completes a login with a security key or passkey as second factor.
+func (h *AuthHandler) FinishLoginWebAuthn(c *gin.Context) {
+	var req WebAuthnFinishRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, pair, err := h.service.CompleteSecondFactorWebAuthn(req.ChallengeToken, req.SessionID, req.Credential, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		if !writeSecondFactorError(c, err) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	respondWithTokens(c, user, pair)
+}
+
+// BeginPasskeyLogin starts a passwordless login (staff only).
+func (h *AuthHandler) BeginPasskeyLogin(c *gin.Context) {
+	opts, err := h.service.BeginPasskeyLogin()
+	if err != nil {
+		if !writeSecondFactorError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start passkey login"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, opts)
+}
+
+func (h *AuthHandler) FinishPasskeyLogin(c *gin.Context) {
+	var req WebAuthnFinishRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, pair, err := h.service.PasskeyLogin(req.SessionID, req.Credential, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		if !writeSecondFactorError(c, err) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	respondWithTokens(c, user, pair)
+}
+
+// BeginWebAuthnRegistration returns the options for navigator.credentials.create().
+func (h *AuthHandler) BeginWebAuthnRegistration(c *gin.Context) {
+	opts, err := h.mfa.BeginRegistration(c.GetUint("userID"))
+	if err != nil {
+		if !writeSecondFactorError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start registration"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, opts)
+}
+
+func (h *AuthHandler) FinishWebAuthnRegistration(c *gin.Context) {
+	var req WebAuthnFinishRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cred, recoveryCodes, err := h.mfa.FinishRegistration(c.GetUint("userID"), req.SessionID, req.Name, req.Credential)
+	if err != nil {
+		if !writeSecondFactorError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to register credential"})
+		}
+		return
+	}
+
+	resp := gin.H{"credential": cred}
+	if len(recoveryCodes) > 0 {
+		resp["recovery_codes"] = recoveryCodes
+	}
+	c.JSON(http.StatusCreated, resp)
+}
+
+func (h *AuthHandler) ListWebAuthnCredentials(c *gin.Context) {
+	creds, err := h.mfa.ListCredentials(c.GetUint("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch credentials"})
+		return
+	}
+
+	c.JSON(http.StatusOK, creds)
+}
+
+func (h *AuthHandler) DeleteWebAuthnCredential(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	if err := h.mfa.DeleteCredential(c.GetUint("userID"), uint(id)); err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "credential not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete credential"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes; the old ones stop working.
+func (h *AuthHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	codes, err := h.service.RegenerateRecoveryCodes(c.GetUint("userID"))
+	if err != nil {
+		if errors.Is(err, auth.ErrSecondFactorRequired) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "enable a second factor first"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
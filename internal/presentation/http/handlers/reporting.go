@@ -70,7 +70,7 @@ func (h *ReportingHandler) SignDocument(c *gin.Context) {
 	// Get UserID from Context (AuthMiddleware)
 	userID := 1 // Stub
 
-	if err := h.service.SignDocument(uint(docID), uint(userID), c.ClientIP()); err != nil {
+	if err := h.service.SignDocument(c.Request.Context(), uint(docID), uint(userID), c.ClientIP()); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -81,7 +81,7 @@ func (h *ReportingHandler) GetDocumentPDF(c *gin.Context) {
 	docIDStr := c.Param("documentId")
 	docID, _ := strconv.Atoi(docIDStr)
 
-	pdfBytes, err := h.service.GetDocumentPDF(uint(docID))
+	pdfBytes, err := h.service.GetDocumentPDF(c.Request.Context(), uint(docID))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
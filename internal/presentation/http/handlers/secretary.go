@@ -44,7 +44,7 @@ func (h *SecretaryHandler) ApproveDocument(c *gin.Context) {
 	id, _ := strconv.Atoi(c.Param("id"))
 	userID := c.GetUint("userID")
 
-	if err := h.service.ApproveDocument(uint(id), userID); err != nil {
+	if err := h.service.ApproveDocument(c.Request.Context(), uint(id), userID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -58,7 +58,7 @@ func (h *SecretaryHandler) RejectDocument(c *gin.Context) {
 	}
 	c.BindJSON(&req)
 
-	if err := h.service.RejectDocument(uint(id), req.Reason); err != nil {
+	if err := h.service.RejectDocument(c.Request.Context(), uint(id), req.Reason); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
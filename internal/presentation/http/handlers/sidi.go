@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/k/iRegistro/internal/application/sidi"
+)
+
+type SIDIHandler struct {
+	service *sidi.SIDIService
+}
+
+func NewSIDIHandler(service *sidi.SIDIService) *SIDIHandler {
+	return &SIDIHandler{service: service}
+}
+
+// GetFlow downloads the flow file of the school for the year query
+// parameter. The students left out are counted in X-Sidi-Skipped; the
+// reasons are returned as JSON when asked with ?report=1.
+func (h *SIDIHandler) GetFlow(c *gin.Context) {
+	flow, err := h.service.BuildFlow(c.GetUint("schoolID"), strings.ToUpper(c.Param("flow")), c.Query("year"))
+	if err != nil {
+		respondSIDIError(c, err)
+		return
+	}
+	if c.Query("report") == "1" {
+		c.JSON(http.StatusOK, gin.H{"name": flow.Name, "records": flow.Records, "skipped": flow.Skipped})
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+flow.Name+`"`)
+	c.Header("X-Sidi-Skipped", strconv.Itoa(len(flow.Skipped)))
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "text/plain; charset=us-ascii", flow.Data)
+}
+
+// ValidateFlow checks an uploaded flow file against its record layout.
+func (h *SIDIHandler) ValidateFlow(c *gin.Context) {
+	data, ok := readSIDIFile(c)
+	if !ok {
+		return
+	}
+	validation, err := h.service.Validate(strings.ToUpper(c.Param("flow")), data)
+	if err != nil {
+		respondSIDIError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, validation)
+}
+
+func (h *SIDIHandler) RecordOutcomes(c *gin.Context) {
+	var req struct {
+		Year     string              `json:"year" binding:"required"`
+		Outcomes []sidi.OutcomeInput `json:"outcomes" binding:"required,dive"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.service.RecordOutcomes(c.GetUint("schoolID"), c.GetUint("userID"), req.Year, req.Outcomes); err != nil {
+		respondSIDIError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recorded": len(req.Outcomes)})
+}
+
+// ImportReturn reads a return file of the registry, saving the student
+// codes it assigned.
+func (h *SIDIHandler) ImportReturn(c *gin.Context) {
+	data, ok := readSIDIFile(c)
+	if !ok {
+		return
+	}
+	report, err := h.service.ImportReturn(c.GetUint("schoolID"), data)
+	if err != nil {
+		respondSIDIError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// readSIDIFile reads the file form field, answering the request if it
+// cannot.
+func readSIDIFile(c *gin.Context) ([]byte, bool) {
+	// Leave room for the multipart envelope
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, sidi.MaxFileSize+1<<20)
+	header, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file too large"})
+			return nil, false
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return nil, false
+	}
+	f, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return data, true
+}
+
+func respondSIDIError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, sidi.ErrUnknownFlow), errors.Is(err, sidi.ErrInvalidYear),
+		errors.Is(err, sidi.ErrInvalidOutcome), errors.Is(err, sidi.ErrInvalidFile):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, sidi.ErrSchoolNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -2,142 +2,128 @@ package handlers
 
 import (
 	"encoding/xml"
-	"fmt"
+	"errors"
 	"net/http"
-	"os"
-	"strconv"
 
 	"github.com/crewjam/saml"
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"github.com/k/iRegistro/internal/application/auth"
 )
 
 type SPIDHandler struct {
 	spidService     *auth.SPIDService
 	serviceProvider *saml.ServiceProvider
+	defaultLevel    auth.SPIDLevel
 }
 
-func NewSPIDHandler(spidService *auth.SPIDService, sp *saml.ServiceProvider) *SPIDHandler {
+// NewSPIDHandler creates the handler; defaultLevel is requested when the
+// client does not ask for a higher one.
+func NewSPIDHandler(spidService *auth.SPIDService, sp *saml.ServiceProvider, defaultLevel auth.SPIDLevel) *SPIDHandler {
 	return &SPIDHandler{
 		spidService:     spidService,
 		serviceProvider: sp,
+		defaultLevel:    defaultLevel,
 	}
 }
 
-// Login initiates SPID authentication flow
-// GET /auth/spid/login?redirect_uri=<url>&school_id=<uuid>
+// Login initiates SPID authentication flow. level (1-3) is raised by the
+// frontend when a sensitive route answered with step_up_required.
+// GET /auth/spid/login?redirect_uri=<url>&school_id=<id>&level=<1-3>&binding=<redirect|post>
 func (h *SPIDHandler) Login(c *gin.Context) {
-	redirectURI := c.Query("redirect_uri")
-	if redirectURI == "" {
-		redirectURI = os.Getenv("FRONTEND_URL") + "/auth-callback"
-	}
-
-	schoolID := c.Query("school_id")
-	if schoolID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "school_id required"})
+	redirectURI, ok := loginRedirect(c.Query("redirect_uri"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "redirect_uri not allowed"})
 		return
 	}
 
-	// Validate school_id is UUID
-	if _, err := uuid.Parse(schoolID); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid school_id"})
+	schoolID, err := parseSchoolID(c.Query("school_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "valid school_id required"})
 		return
 	}
 
-	// Store school_id in relay state for callback
-	relayState := fmt.Sprintf("%s|%s", redirectURI, schoolID)
+	level := h.defaultLevel
+	if raw := c.Query("level"); raw != "" {
+		requested, err := auth.ParseSPIDLevel(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// Clients may ask for more assurance, never less than the default
+		if requested > level {
+			level = requested
+		}
+	}
 
-	// Create SAML authentication request
 	binding := saml.HTTPRedirectBinding
-	bindingLocation := h.serviceProvider.GetSSOBindingLocation(binding)
+	if c.Query("binding") == "post" {
+		binding = saml.HTTPPostBinding
+	}
 
-	req, err := h.serviceProvider.MakeAuthenticationRequest(bindingLocation, binding, saml.HTTPPostBinding)
+	req, err := h.spidService.BeginLogin(schoolID, redirectURI, level, binding)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create SAML request"})
 		return
 	}
 
-	// Build redirect URL with SAML request and relay state
-	redirectURL := h.serviceProvider.GetSSOBindingLocation(binding) + "?SAMLRequest=" + req.ID
-	if relayState != "" {
-		redirectURL += "&RelayState=" + relayState
+	if req.Binding == saml.HTTPPostBinding {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", req.PostForm)
+		return
 	}
-
-	c.Redirect(http.StatusFound, redirectURL)
+	c.Redirect(http.StatusFound, req.RedirectURL)
 }
 
 // Callback handles SPID SAML assertion callback
 // POST /auth/spid/callback
 func (h *SPIDHandler) Callback(c *gin.Context) {
-	// Parse SAML response
-	err := c.Request.ParseForm()
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid form data"})
-		return
-	}
+	lc := loginContext(c)
 
-	// Get relay state (contains redirect_uri and school_id)
-	relayState := c.Request.Form.Get("RelayState")
-
-	// Parse SAML response
-	assertion, err := h.serviceProvider.ParseResponse(c.Request, []string{})
+	// Validate the response against the pending request (InResponseTo, replay, level)
+	login, err := h.spidService.CompleteLogin(c.Request)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "SAML validation failed", "details": err.Error()})
+		h.spidService.RecordFailure("", lc, err.Error())
+		switch {
+		case errors.Is(err, auth.ErrSPIDLevelInsufficient):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "SPID level lower than requested"})
+		case errors.Is(err, auth.ErrSAMLUnknownRequest), errors.Is(err, auth.ErrSAMLReplay):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "SAML validation failed"})
+		}
 		return
 	}
+	provider := login.Attributes.Provider
 
-	// Validate and extract SPID attributes
-	spidAttrs, err := h.spidService.ValidateSAMLAssertion(c.Request.Context(), assertion)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "SPID attribute extraction failed", "details": err.Error()})
+	redirectURI, ok := loginRedirect(login.RedirectURI)
+	if !ok {
+		h.spidService.RecordFailure(provider, lc, "redirect_uri not allowed")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "redirect_uri not allowed"})
 		return
 	}
 
-	// Parse relay state to get school_id
-	var redirectURI string
-	var schoolID uint
-
-	if relayState != "" {
-		// Format: "redirect_uri|school_id"
-		var schoolIDStr string
-		fmt.Sscanf(relayState, "%s|%s", &redirectURI, &schoolIDStr)
-
-		// Parse school_id as uint
-		var err error
-		var id uint64
-		id, err = strconv.ParseUint(schoolIDStr, 10, 32)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid school_id in relay state"})
+	// Resolve the linked user; unknown identities are queued, never auto-created
+	user, err := h.spidService.ResolveUserBySPID(c.Request.Context(), login.Attributes, login.SchoolID)
+	if err != nil {
+		var pendErr *auth.IdentityPendingError
+		if errors.As(err, &pendErr) {
+			h.spidService.RecordFailure(provider, lc, pendErr.Error())
+			redirectIdentityPending(c, redirectURI, pendErr)
 			return
 		}
-		schoolID = uint(id)
-	} else {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing relay state"})
+		h.spidService.RecordFailure(provider, lc, "user resolution failed: "+err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User resolution failed"})
 		return
 	}
 
-	// Get or create user
-	user, err := h.spidService.GetOrCreateUserBySPID(c.Request.Context(), spidAttrs, schoolID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "User creation failed", "details": err.Error()})
-		return
-	}
-
-	// Generate JWT token
-	token, err := h.spidService.GenerateTokenForUser(user)
+	// Issue access/refresh tokens through the shared token service
+	pair, err := h.spidService.IssueTokens(user, login.Level, lc)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token generation failed"})
 		return
 	}
+	setRefreshTokenCookie(c, pair)
 
-	// Redirect to frontend with token
-	if redirectURI == "" {
-		redirectURI = os.Getenv("FRONTEND_URL") + "/auth-callback"
-	}
-
-	finalURL := fmt.Sprintf("%s?token=%s", redirectURI, token)
-	c.Redirect(http.StatusFound, finalURL)
+	redirectLoggedIn(c, redirectURI)
 }
 
 // Metadata returns SPID service provider metadata
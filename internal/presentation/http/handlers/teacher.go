@@ -39,7 +39,7 @@ func (h *TeacherHandler) GetStudents(c *gin.Context) {
 	// TODO: Verify teacher has access to this class (security)
 
 	// Assuming 2024-25 is current year, should be dynamic
-	students, err := h.service.GetStudentsByClassID(uint(classID), "2024-25")
+	students, err := h.service.GetStudentsByClassID(c.Request.Context(), uint(classID), "2024-25")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
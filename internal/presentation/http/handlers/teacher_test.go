@@ -37,7 +37,9 @@ type MockAcademicRepo struct {
 // Stub methods...
 func (m *MockAcademicRepo) CreateClass(c *domain.Class) error                    { return nil }
 func (m *MockAcademicRepo) GetClassesBySchoolID(id uint) ([]domain.Class, error) { return nil, nil }
-func (m *MockAcademicRepo) GetClassByID(id uint) (*domain.Class, error)          { return nil, nil }
+func (m *MockAcademicRepo) GetClassByID(ctx context.Context, id uint) (*domain.Class, error) {
+	return nil, nil
+}
 
 // ... (Add others as needed or use interface)
 // The interface is domain.AcademicRepository.
@@ -70,24 +72,30 @@ func (m *MockRepoForTeacher) CreateCurriculum(curriculum *domain.Curriculum) err
 func (m *MockRepoForTeacher) GetCurriculumsBySchoolID(schoolID uint) ([]domain.Curriculum, error) {
 	return nil, nil
 }
-func (m *MockRepoForTeacher) CreateClass(class *domain.Class) error       { return nil }
-func (m *MockRepoForTeacher) GetClassByID(id uint) (*domain.Class, error) { return nil, nil }
+func (m *MockRepoForTeacher) CreateClass(class *domain.Class) error { return nil }
+func (m *MockRepoForTeacher) GetClassByID(ctx context.Context, id uint) (*domain.Class, error) {
+	return nil, nil
+}
 func (m *MockRepoForTeacher) GetClassesBySchoolID(schoolID uint) ([]domain.Class, error) {
 	return nil, nil
 }
 
 // Student
-func (m *MockRepoForTeacher) CreateStudent(student *domain.Student) error            { return nil }
-func (m *MockRepoForTeacher) GetStudentByID(id uint) (*domain.Student, error)        { return nil, nil }
+func (m *MockRepoForTeacher) CreateStudent(student *domain.Student) error { return nil }
+func (m *MockRepoForTeacher) GetStudentByID(ctx context.Context, id uint) (*domain.Student, error) {
+	return nil, nil
+}
 func (m *MockRepoForTeacher) EnrollStudent(enrollment *domain.ClassEnrollment) error { return nil }
-func (m *MockRepoForTeacher) GetStudentsByClassID(classID uint, year string) ([]domain.Student, error) {
+func (m *MockRepoForTeacher) GetStudentsByClassID(ctx context.Context, classID uint, year string) ([]domain.Student, error) {
 	args := m.Called(classID, year)
 	return args.Get(0).([]domain.Student), args.Error(1)
 }
 
 // Subject
-func (m *MockRepoForTeacher) CreateSubject(subject *domain.Subject) error     { return nil }
-func (m *MockRepoForTeacher) GetSubjectByID(id uint) (*domain.Subject, error) { return nil, nil }
+func (m *MockRepoForTeacher) CreateSubject(subject *domain.Subject) error { return nil }
+func (m *MockRepoForTeacher) GetSubjectByID(ctx context.Context, id uint) (*domain.Subject, error) {
+	return nil, nil
+}
 func (m *MockRepoForTeacher) AssignSubjectToClass(assignment *domain.ClassSubjectAssignment) error {
 	return nil
 }
@@ -116,6 +124,9 @@ func (m *MockRepoForTeacher) GetAbsencesByStudentID(studentID uint, year string)
 func (m *MockRepoForTeacher) GetAbsencesByClassID(classID uint, date time.Time) ([]domain.Absence, error) {
 	return nil, nil
 }
+func (m *MockRepoForTeacher) GetAbsencesBySchoolID(schoolID uint, date time.Time) ([]domain.Absence, error) {
+	return nil, nil
+}
 func (m *MockRepoForTeacher) UpdateAbsence(absence *domain.Absence) error { return nil }
 
 type MockUserRepoForTeacher struct {
@@ -0,0 +1,96 @@
+package http
+
+import (
+	"context"
+
+	"github.com/k/iRegistro/internal/application/admin"
+	"github.com/k/iRegistro/internal/application/communication"
+	"github.com/k/iRegistro/internal/application/jobs"
+	"github.com/k/iRegistro/internal/domain"
+	"go.uber.org/zap"
+)
+
+// Types of the scheduled jobs.
+const (
+	jobNotificationDeliveries = "communication.deliveries"
+	jobAbsenceAlerts          = "communication.absence_alerts"
+	jobColloquiumFollowUps    = "communication.colloquium_follow_ups"
+	jobColloquiumReminders    = "communication.colloquium_reminders"
+	jobGDPRPurge              = "gdpr.purge"
+)
+
+// jobServices are the services running background work.
+type jobServices struct {
+	notifications *communication.NotificationService
+	absenceAlerts *communication.AbsenceAlertService
+	colloquiums   *communication.ColloquiumService
+	exports       *admin.DataExportService
+	imports       *admin.UserImportService
+	saml          domain.SAMLRepository
+}
+
+// registerJobs schedules the periodic work of the services and registers
+// the handlers of the jobs they enqueue. Every schedule is in school time.
+func registerJobs(s *jobs.Scheduler, svc jobServices, logger *zap.Logger) {
+	schedule := func(jobType, expr string, h jobs.Handler, retry jobs.RetryPolicy) {
+		if err := s.Schedule(jobType, expr, h, retry); err != nil {
+			logger.Fatal("Invalid job schedule", zap.String("type", jobType), zap.Error(err))
+		}
+	}
+
+	// Failed deliveries and due digests
+	schedule(jobNotificationDeliveries, "* * * * *", func(ctx context.Context, job *domain.Job) error {
+		if _, err := svc.notifications.RetryDeliveries(); err != nil {
+			return err
+		}
+		_, err := svc.notifications.SendDigests()
+		return err
+	}, jobs.NoRetry)
+	schedule(jobAbsenceAlerts, "* * * * *", func(ctx context.Context, job *domain.Job) error {
+		_, err := svc.absenceAlerts.SendDue(ctx, job.RunAt)
+		return err
+	}, jobs.NoRetry)
+	schedule(jobColloquiumFollowUps, "* * * * *", func(ctx context.Context, job *domain.Job) error {
+		_, err := svc.colloquiums.SendDue(job.RunAt)
+		return err
+	}, jobs.NoRetry)
+	// Each booking is reminded once, so retries do not repeat the reminders
+	schedule(jobColloquiumReminders, "0 17 * * *", func(ctx context.Context, job *domain.Job) error {
+		_, err := svc.colloquiums.SendReminders(job.RunAt)
+		return err
+	}, jobs.DefaultRetry)
+
+	// Personal data past its retention: expired exports and SPID requests
+	schedule(jobGDPRPurge, "0 3 * * *", func(ctx context.Context, job *domain.Job) error {
+		n, err := svc.exports.PurgeExpired(job.RunAt)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			logger.Info("Purged expired data exports", zap.Int("exports", n))
+		}
+		return svc.saml.PurgeExpired(job.RunAt)
+	}, jobs.DefaultRetry)
+
+	s.Register(admin.DataExportJob, func(ctx context.Context, job *domain.Job) error {
+		id, err := jobs.PayloadUint(job, "export_id")
+		if err != nil {
+			return err
+		}
+		return svc.exports.GenerateExport(id)
+	}, jobs.DefaultRetry)
+	s.Register(admin.UserImportValidateJob, func(ctx context.Context, job *domain.Job) error {
+		id, err := jobs.PayloadUint(job, "import_id")
+		if err != nil {
+			return err
+		}
+		return svc.imports.Validate(id)
+	}, jobs.DefaultRetry)
+	s.Register(admin.UserImportJob, func(ctx context.Context, job *domain.Job) error {
+		id, err := jobs.PayloadUint(job, "import_id")
+		if err != nil {
+			return err
+		}
+		return svc.imports.ProcessImport(ctx, id)
+	}, jobs.DefaultRetry)
+}
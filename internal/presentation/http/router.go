@@ -1,13 +1,19 @@
 package http
 
 import (
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"github.com/k/iRegistro/internal/application/academic"
 	"github.com/k/iRegistro/internal/application/admin"
+	authapp "github.com/k/iRegistro/internal/application/auth"
+	calendarapp "github.com/k/iRegistro/internal/application/calendar"
 	"github.com/k/iRegistro/internal/application/communication"
 	"github.com/k/iRegistro/internal/application/director"
+	"github.com/k/iRegistro/internal/application/jobs"
 	"github.com/k/iRegistro/internal/application/reporting"
 	"github.com/k/iRegistro/internal/application/secretary"
+	"github.com/k/iRegistro/internal/application/sidi"
 	"github.com/k/iRegistro/internal/domain"
 	"github.com/k/iRegistro/internal/infrastructure/pdf"
 	"github.com/k/iRegistro/internal/infrastructure/persistence"
@@ -17,10 +23,15 @@ import (
 	"github.com/k/iRegistro/internal/presentation/ws"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 	"gorm.io/gorm"
 )
 
-func NewRouter(authHandler *handlers.AuthHandler, wsHandler *ws.Handler, db *gorm.DB, hub *ws.Hub, logger *zap.Logger, secret string) *gin.Engine {
+// NewRouter wires the services and routes. notifSenders deliver notifications
+// through external channels (email, ...); attachments limits and scans the
+// files sent with messages. The background work of the services is registered
+// on jobScheduler, which the caller runs.
+func NewRouter(authHandler *handlers.AuthHandler, wsHandler *ws.Handler, db *gorm.DB, hub *ws.Hub, logger *zap.Logger, secret string, notifSenders []communication.Sender, attachments communication.AttachmentPolicy, meetingLinks domain.MeetingLinkProvider, jobScheduler *jobs.Scheduler, invites *authapp.PasswordResetService) *gin.Engine {
 	r := gin.Default()
 
 	r.Use(middleware.CORSMiddleware())
@@ -41,16 +52,37 @@ func NewRouter(authHandler *handlers.AuthHandler, wsHandler *ws.Handler, db *gor
 		{
 			auth.POST("/register", authHandler.Register)
 			auth.POST("/login", authHandler.Login)
-			auth.POST("/password-reset", authHandler.RequestPasswordReset)
-			auth.POST("/password-reset/confirm", authHandler.ResetPassword)
+			auth.POST("/refresh", authHandler.Refresh)
+			auth.POST("/password-reset", middleware.IPRateLimitMiddleware(rate.Every(12*time.Minute), 5), authHandler.RequestPasswordReset)
+			auth.POST("/password-reset/confirm", middleware.IPRateLimitMiddleware(rate.Every(time.Minute), 10), authHandler.ResetPassword)
+
+			// Second factor, after a login answered with a challenge token
+			auth.POST("/login/2fa", authHandler.LoginSecondFactor)
+			auth.POST("/login/webauthn/begin", authHandler.BeginLoginWebAuthn)
+			auth.POST("/login/webauthn/finish", authHandler.FinishLoginWebAuthn)
+
+			// Passwordless login (staff)
+			auth.POST("/passkey/begin", authHandler.BeginPasskeyLogin)
+			auth.POST("/passkey/finish", authHandler.FinishPasskeyLogin)
 
 			// Protected routes
 			protected := auth.Group("/")
 			protected.Use(middleware.AuthMiddleware(secret)) // Should inject config
 			{
 				protected.GET("/me", authHandler.GetMe)
-				protected.POST("/2fa/enable", authHandler.Enable2FA)
-				protected.POST("/2fa/verify", authHandler.Verify2FA)
+				protected.POST("/2fa/recovery-codes", authHandler.RegenerateRecoveryCodes)
+				protected.GET("/webauthn/credentials", authHandler.ListWebAuthnCredentials)
+				protected.DELETE("/webauthn/credentials/:id", authHandler.DeleteWebAuthnCredential)
+			}
+
+			// Enrollment also accepts the token of a login blocked by the school 2FA policy
+			enroll := auth.Group("/")
+			enroll.Use(middleware.EnrollmentAuthMiddleware(secret))
+			{
+				enroll.POST("/2fa/enable", authHandler.Enable2FA)
+				enroll.POST("/2fa/verify", authHandler.Verify2FA)
+				enroll.POST("/webauthn/register/begin", authHandler.BeginWebAuthnRegistration)
+				enroll.POST("/webauthn/register/finish", authHandler.FinishWebAuthnRegistration)
 			}
 		}
 
@@ -63,7 +95,7 @@ func NewRouter(authHandler *handlers.AuthHandler, wsHandler *ws.Handler, db *gor
 		if db != nil {
 			userRepo := persistence.NewUserRepository(db) // Reuse or create new
 			academicRepo := persistence.NewAcademicRepository(db)
-			broadcaster := ws.NewBroadcaster(hub) // hub is argument to NewRouter
+			broadcaster := ws.NewBroadcaster(hub, academicRepo) // hub is argument to NewRouter
 			academicService := academic.NewAcademicService(academicRepo, userRepo, broadcaster)
 			academicHandler := handlers.NewAcademicHandler(academicService)
 
@@ -89,7 +121,9 @@ func NewRouter(authHandler *handlers.AuthHandler, wsHandler *ws.Handler, db *gor
 			// --- Service Initialization ---
 			// 1. Communication (Core for others)
 			commRepo := persistence.NewCommunicationRepository(db)
-			notifService := communication.NewNotificationService(commRepo)
+			notifService := communication.NewNotificationService(commRepo, userRepo, persistence.NewAdminRepository(db), notifSenders...)
+			notifService.SetRealtime(broadcaster)
+			absenceAlerts := communication.NewAbsenceAlertService(commRepo, academicRepo, persistence.NewAdminRepository(db), userRepo, notifService)
 
 			// 2. Reporting (Uses Notification)
 			reportingRepo := persistence.NewReportingRepository(db)
@@ -98,9 +132,16 @@ func NewRouter(authHandler *handlers.AuthHandler, wsHandler *ws.Handler, db *gor
 			reportingHandler := handlers.NewReportingHandler(reportingService)
 
 			// --- Communication Module Setup ---
-			msgService := communication.NewMessagingService(commRepo)
-			colService := communication.NewColloquiumService(commRepo, notifService)
-			commHandler := handlers.NewCommunicationHandler(notifService, msgService, colService)
+			msgService := communication.NewMessagingService(commRepo, userRepo, academicRepo, broadcaster)
+			colService := communication.NewColloquiumService(commRepo, userRepo, notifService, meetingLinks)
+			annService := communication.NewAnnouncementService(commRepo, userRepo, academicRepo, notifService)
+			localStorage, _ := storage.NewLocalStorage("./uploads") // Simple local dir
+			attService := communication.NewAttachmentService(commRepo, localStorage, attachments)
+			commHandler := handlers.NewCommunicationHandler(notifService, msgService, colService, annService, attService)
+			meetingDayHandler := handlers.NewMeetingDayHandler(communication.NewMeetingDayService(commRepo, userRepo, academicRepo, pdfGen))
+			if wsHandler != nil {
+				wsHandler.SetServices(msgService, notifService)
+			}
 
 			// Communication Routes
 			comm := api.Group("/communication")
@@ -109,39 +150,118 @@ func NewRouter(authHandler *handlers.AuthHandler, wsHandler *ws.Handler, db *gor
 				// Notifications
 				comm.GET("/notifications", commHandler.GetNotifications)
 				comm.POST("/notifications/:id/read", commHandler.ReadNotification)
+				comm.GET("/notifications/preferences", commHandler.GetNotificationPreferences)
+				comm.PUT("/notifications/preferences", commHandler.UpdateNotificationPreferences)
+				comm.PUT("/notifications/settings", commHandler.UpdateNotificationSettings)
+
+				// Web Push
+				comm.GET("/push/key", commHandler.GetPushPublicKey)
+				comm.POST("/push/subscriptions", commHandler.SubscribePush)
+				comm.DELETE("/push/subscriptions", commHandler.UnsubscribePush)
 
 				// Messaging
 				comm.POST("/conversations", commHandler.CreateConversation)
 				comm.GET("/conversations", commHandler.GetConversations)
 				comm.GET("/conversations/:id/messages", commHandler.GetMessages)
 				comm.POST("/conversations/:id/messages", commHandler.SendMessage)
+				comm.POST("/conversations/:id/participants", commHandler.AddParticipants)
+				comm.DELETE("/conversations/:id/participants/:userId", commHandler.RemoveParticipant)
+				comm.POST("/conversations/:id/leave", commHandler.LeaveConversation)
+				comm.DELETE("/messages/:id", commHandler.DeleteMessage)
+				comm.POST("/attachments", commHandler.UploadAttachment)
+				comm.GET("/attachments/:id", commHandler.DownloadAttachment)
+
+				// Announcements
+				comm.POST("/announcements", commHandler.PublishAnnouncement)
+				comm.GET("/announcements", commHandler.GetAnnouncements)
+				comm.POST("/announcements/:id/read", commHandler.ReadAnnouncement)
+				comm.GET("/announcements/:id/reads", commHandler.GetAnnouncementReads)
+				comm.POST("/announcements/:id/remind", commHandler.RemindAnnouncement)
 
 				// Colloquiums
 				comm.POST("/slots", commHandler.CreateSlot) // Start simple, refine path usually /teachers/:id/slots
 				comm.GET("/slots/available", commHandler.GetAvailableSlots)
+				comm.POST("/slots/:id/cancel", commHandler.CancelSlot)
+				comm.POST("/slots/:id/check-in", commHandler.CheckIn)
+				comm.GET("/slots/:id/waiting-room", commHandler.GetWaitingRoom)
 				comm.POST("/bookings", commHandler.BookSlot)
+				comm.GET("/bookings", commHandler.GetBookings)
+				comm.POST("/bookings/:id/cancel", commHandler.CancelBooking)
+				comm.PUT("/bookings/:id/notes", commHandler.AddBookingNotes)
+				comm.POST("/bookings/:id/feedback", commHandler.AddBookingFeedback)
+
+				// General meeting days
+				comm.POST("/meeting-days", meetingDayHandler.CreateMeetingDay)
+				comm.GET("/meeting-days/:id", meetingDayHandler.GetMeetingDay)
+				comm.POST("/meeting-days/:id/bookings", meetingDayHandler.BookItinerary)
+				comm.GET("/meeting-days/:id/itinerary", meetingDayHandler.GetItinerary)
+				comm.GET("/meeting-days/:id/teachers/:teacherId/schedule", meetingDayHandler.GetTeacherSchedule)
+			}
+
+			// --- Calendar feeds ---
+			calendarService := calendarapp.NewCalendarService(persistence.NewCalendarRepository(db), userRepo, academicRepo, persistence.NewAdminRepository(db))
+			calendarHandler := handlers.NewCalendarHandler(calendarService)
+			// Read by calendar apps, authenticated by the secret in the URL
+			api.GET("/calendar/feed/:token", calendarHandler.GetFeed)
+			cal := api.Group("/calendar")
+			cal.Use(middleware.AuthMiddleware(secret))
+			{
+				cal.POST("/tokens", calendarHandler.CreateToken)
+				cal.GET("/tokens", calendarHandler.GetTokens)
+				cal.DELETE("/tokens/:id", calendarHandler.RevokeToken)
+				cal.POST("/homework", middleware.RBACMiddleware(domain.RoleTeacher), calendarHandler.AssignHomework)
+				cal.POST("/events", middleware.RBACMiddleware(domain.RolePrincipal, domain.RoleAdmin, domain.RoleSecretary), calendarHandler.CreateEvent)
+			}
+
+			// --- SIDI flows ---
+			sidiService := sidi.NewSIDIService(persistence.NewSIDIRepository(db))
+			sidiHandler := handlers.NewSIDIHandler(sidiService)
+			sidiGroup := api.Group("/sidi")
+			sidiGroup.Use(middleware.AuthMiddleware(secret), middleware.RBACMiddleware(domain.RoleSecretary, domain.RolePrincipal, domain.RoleAdmin))
+			{
+				sidiGroup.GET("/flows/:flow", sidiHandler.GetFlow)
+				sidiGroup.POST("/flows/:flow/validate", sidiHandler.ValidateFlow)
+				sidiGroup.PUT("/outcomes", sidiHandler.RecordOutcomes)
+				sidiGroup.POST("/returns", sidiHandler.ImportReturn)
 			}
 
 			// --- Admin Module Setup ---
 			adminRepo := persistence.NewAdminRepository(db)
 			auditService := admin.NewAuditService(adminRepo)
 			adminService := admin.NewAdminService(adminRepo, userRepo, academicRepo, auditService) // Reuse academicRepo defined above
-			importService := admin.NewUserImportService(adminRepo, userRepo, logger)
-			exportService := admin.NewDataExportService(adminRepo)
-			adminHandler := handlers.NewAdminHandler(adminService, auditService, importService, exportService)
+			importService := admin.NewUserImportService(adminRepo, userRepo, persistence.NewIdentityRepository(db), academicRepo, localStorage, jobScheduler, invites, logger)
+			exportService := admin.NewDataExportService(adminRepo, persistence.NewExportRepository(db), sidiService, jobScheduler, "./exports")
+			onboardingService := admin.NewOnboardingService(persistence.NewOnboardingRepository(db), userRepo, invites, auditService, logger)
+			adminHandler := handlers.NewAdminHandler(adminService, auditService, importService, exportService, onboardingService)
+
+			registerJobs(jobScheduler, jobServices{
+				notifications: notifService,
+				absenceAlerts: absenceAlerts,
+				colloquiums:   colService,
+				exports:       exportService,
+				imports:       importService,
+				saml:          persistence.NewSAMLRepository(db),
+			}, logger)
 
 			// Admin Routes
 			// SuperAdmin
 			sa := api.Group("/superadmin")
-			sa.Use(middleware.AuthMiddleware(secret)) // Add Role check middleware
+			sa.Use(middleware.AuthMiddleware(secret), middleware.RequireSPIDLevel(authapp.SpidL2)) // Add Role check middleware
 			{
 				sa.POST("/schools", adminHandler.CreateSchool)
 				sa.PUT("/schools/:id", adminHandler.UpdateSchool)
+
+				// Onboarding wizard
+				onboard := sa.Group("", middleware.RBACMiddleware(domain.RoleSuperAdmin))
+				onboard.GET("/school-templates", adminHandler.GetSchoolTemplates)
+				onboard.POST("/onboardings", adminHandler.OnboardSchool)
+				onboard.GET("/onboardings", adminHandler.GetOnboardings)
+				onboard.GET("/onboardings/:id", adminHandler.GetOnboarding)
 			}
 
 			// School Admin
 			adm := api.Group("/admin")
-			adm.Use(middleware.AuthMiddleware(secret)) // Add Role check middleware
+			adm.Use(middleware.AuthMiddleware(secret), middleware.RequireSPIDLevel(authapp.SpidL2)) // Add Role check middleware
 			{
 				// Specific fix for frontend requests: /admin/kpis was requested but not defined.
 				// Assuming GetKPIs exists on adminHandler or we map GetSettings/etc?
@@ -175,15 +295,28 @@ func NewRouter(authHandler *handlers.AuthHandler, wsHandler *ws.Handler, db *gor
 				adm.GET("/kpis", adminHandler.GetKPIs)
 				adm.GET("/schools", adminHandler.GetSchools)
 
-				adm.GET("/settings", adminHandler.GetSettings)
-				adm.PUT("/settings", adminHandler.UpdateSetting)
+				// The settings hold the SMS gateway of the school
+				settings := adm.Group("", middleware.RBACMiddleware(domain.RoleAdmin, domain.RolePrincipal))
+				settings.GET("/settings", adminHandler.GetSettings)
+				settings.PUT("/settings", adminHandler.UpdateSetting)
+				settings.GET("/sms/usage", commHandler.GetSMSUsage)
 				adm.GET("/users", adminHandler.GetUsers)
 				adm.POST("/users", adminHandler.CreateUser) // Frontend calls createUser
 				adm.PUT("/users/:id", adminHandler.UpdateUser)
 				adm.DELETE("/users/:id", adminHandler.DeleteUser)
 
 				adm.GET("/audit-logs", adminHandler.GetAuditLogs)
-				adm.POST("/data-export", adminHandler.RequestExport)
+
+				// The exports hold every record of the school
+				exports := adm.Group("/data-export", middleware.RBACMiddleware(domain.RoleAdmin, domain.RolePrincipal))
+				exports.POST("", adminHandler.RequestExport)
+				exports.GET("/:id", adminHandler.GetExport)
+				exports.GET("/:id/download", adminHandler.DownloadExport)
+
+				imports := adm.Group("/imports", middleware.RBACMiddleware(domain.RoleAdmin, domain.RolePrincipal, domain.RoleSecretary))
+				imports.POST("", adminHandler.UploadImport)
+				imports.GET("/:id", adminHandler.GetImport)
+				imports.POST("/:id/confirm", adminHandler.ConfirmImport)
 			}
 
 			// Teacher Module
@@ -219,10 +352,13 @@ func NewRouter(authHandler *handlers.AuthHandler, wsHandler *ws.Handler, db *gor
 			}
 
 			// --- Secretary Module Setup ---
-			localStorage, _ := storage.NewLocalStorage("./uploads") // Simple local dir
-			secService := secretary.NewSecretaryService(reportingRepo, pdfGen, localStorage, notifService)
+			secService := secretary.NewSecretaryService(reportingRepo, pdfGen, localStorage, notifService, commRepo)
 			secHandler := handlers.NewSecretaryHandler(secService)
 
+			identityLinks := authapp.NewIdentityLinkService(userRepo, persistence.NewIdentityRepository(db))
+			identityHandler := handlers.NewIdentityHandler(identityLinks)
+			api.POST("/auth/identity-links/confirm", middleware.AuthMiddleware(secret), identityHandler.ConfirmLink)
+
 			directorService := director.NewDirectorService(academicRepo, reportingRepo)
 			directorHandler := handlers.NewDirectorHandler(directorService)
 
@@ -235,6 +371,15 @@ func NewRouter(authHandler *handlers.AuthHandler, wsHandler *ws.Handler, db *gor
 				sec.POST("/documents/:id/reject", secHandler.RejectDocument)
 				sec.POST("/documents/:id/print-batch", secHandler.BatchPrint)
 				sec.GET("/stats", secHandler.GetDashboardStats)
+
+				// SPID/CIE identities awaiting approval
+				identities := sec.Group("/identities")
+				identities.Use(middleware.RBACMiddleware(domain.RoleSecretary, domain.RoleAdmin), middleware.RequireSPIDLevel(authapp.SpidL2))
+				{
+					identities.GET("/pending", identityHandler.ListPending)
+					identities.POST("/:id/approve", identityHandler.Approve)
+					identities.POST("/:id/reject", identityHandler.Reject)
+				}
 			}
 
 			// --- Secretary Academic Management ---
@@ -260,7 +405,7 @@ func NewRouter(authHandler *handlers.AuthHandler, wsHandler *ws.Handler, db *gor
 
 			// Director routes
 			directorRoutes := api.Group("/director")
-			directorRoutes.Use(middleware.AuthMiddleware(secret), middleware.RBACMiddleware(domain.RolePrincipal))
+			directorRoutes.Use(middleware.AuthMiddleware(secret), middleware.RBACMiddleware(domain.RolePrincipal), middleware.RequireSPIDLevel(authapp.SpidL2))
 			{
 				directorRoutes.GET("/kpi", directorHandler.GetKPIs)
 				directorRoutes.GET("/documents/sign", directorHandler.GetDocumentsToSign)
@@ -268,7 +413,8 @@ func NewRouter(authHandler *handlers.AuthHandler, wsHandler *ws.Handler, db *gor
 			}
 
 			// GraphQL - needs academicService and reportingService, so inside db block
-			r.POST("/query", handlers.GraphQLHandler(academicService, reportingService))
+			// The resolvers read classes and students of the tenant of the token
+			r.POST("/query", middleware.AuthMiddleware(secret), handlers.GraphQLHandler(academicService, reportingService))
 			r.GET("/playground", handlers.PlaygroundHandler())
 		} // End of db check
 	} // End of api group
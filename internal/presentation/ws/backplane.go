@@ -0,0 +1,117 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/k/iRegistro/internal/middleware"
+	"go.uber.org/zap"
+)
+
+const (
+	// outboxSize bounds the events waiting to be published; beyond it events
+	// only reach this node's clients.
+	outboxSize = 1024
+	// seenSize is how many remote event IDs are remembered to drop duplicates.
+	seenSize = 4096
+)
+
+// Backplane relays hub events between API nodes, so that clients connected
+// to any replica receive them. Implementations live in
+// infrastructure/backplane.
+type Backplane interface {
+	Publish(ctx context.Context, payload []byte) error
+	// Subscribe calls handler with every payload published by any node,
+	// this one included, until ctx is done.
+	Subscribe(ctx context.Context, handler func(payload []byte)) error
+}
+
+// envelope is an event as it travels on the backplane.
+type envelope struct {
+	ID      string   `json:"id"`
+	Node    string   `json:"node"`
+	Rooms   []string `json:"rooms"`
+	Message []byte   `json:"message"`
+	// Transient events are not kept for resuming clients
+	Transient bool `json:"transient,omitempty"`
+	// Evict is the user whose clients leave the rooms, for evictions
+	Evict uint `json:"evict,omitempty"`
+}
+
+// SetBackplane relays the hub's events to the other nodes and delivers
+// theirs. It must be called before Run.
+func (h *Hub) SetBackplane(bp Backplane) {
+	h.backplane = bp
+	h.outbox = make(chan envelope, outboxSize)
+}
+
+// relay publishes this node's events and feeds the other nodes' ones to Run.
+func (h *Hub) relay(ctx context.Context) {
+	go func() {
+		for env := range h.outbox {
+			payload, err := json.Marshal(env)
+			if err == nil {
+				err = h.backplane.Publish(ctx, payload)
+			}
+			if err != nil {
+				middleware.WebSocketBackplaneErrors.WithLabelValues("publish").Inc()
+				zap.L().Error("Failed to publish WebSocket event", zap.String("event_id", env.ID), zap.Error(err))
+			}
+		}
+	}()
+	go func() {
+		err := h.backplane.Subscribe(ctx, func(payload []byte) {
+			var env envelope
+			if err := json.Unmarshal(payload, &env); err != nil {
+				middleware.WebSocketBackplaneErrors.WithLabelValues("decode").Inc()
+				zap.L().Warn("Dropping malformed WebSocket event", zap.Error(err))
+				return
+			}
+			if env.Node == h.nodeID {
+				return // Already delivered when sent
+			}
+			h.remote <- env
+		})
+		if err != nil && ctx.Err() == nil {
+			zap.L().Error("WebSocket backplane subscription ended", zap.Error(err))
+		}
+	}()
+}
+
+// publish queues an event for the other nodes without blocking the sender.
+func (h *Hub) publish(env envelope) {
+	if h.backplane == nil {
+		return
+	}
+	select {
+	case h.outbox <- env:
+	default:
+		middleware.WebSocketBackplaneErrors.WithLabelValues("overflow").Inc()
+		zap.L().Warn("WebSocket backplane outbox full, event not relayed", zap.String("event_id", env.ID))
+	}
+}
+
+// seenIDs remembers the last seenSize event IDs.
+type seenIDs struct {
+	ids  map[string]bool
+	ring []string
+	next int
+}
+
+func newSeenIDs(size int) *seenIDs {
+	return &seenIDs{ids: make(map[string]bool, size), ring: make([]string, size)}
+}
+
+// add reports whether id is new, remembering it.
+func (s *seenIDs) add(id string) bool {
+	if s.ids[id] {
+		return false
+	}
+	if old := s.ring[s.next]; old != "" {
+		delete(s.ids, old)
+	}
+	s.ring[s.next] = id
+	s.next = (s.next + 1) % len(s.ring)
+	s.ids[id] = true
+	return true
+}
@@ -1,38 +1,80 @@
 package ws
 
 import (
-	"encoding/json"
-	"fmt"
-
+	"github.com/google/uuid"
 	"github.com/k/iRegistro/internal/domain"
+	"go.uber.org/zap"
+)
+
+// Event frame types pushed by the Broadcaster.
+const (
+	EventMarkAdded        = "MARK_ADDED"
+	EventNotification     = "NOTIFICATION"
+	EventMessageNew       = "MESSAGE_NEW"
+	EventConversationRead = "CONVERSATION_READ"
 )
 
+// Broadcaster pushes domain events to the clients allowed to see them.
 type Broadcaster struct {
-	hub *Hub
+	hub      *Hub
+	audience Audience
 }
 
-func NewBroadcaster(hub *Hub) *Broadcaster {
-	return &Broadcaster{hub: hub}
+func NewBroadcaster(hub *Hub, audience Audience) *Broadcaster {
+	return &Broadcaster{hub: hub, audience: audience}
 }
 
-type NotificationMessage struct {
-	Type    string      `json:"type"`
-	Payload interface{} `json:"payload"`
+// NotifyMarkAdded sends a new mark to the student and their parents only.
+func (b *Broadcaster) NotifyMarkAdded(mark *domain.Mark) {
+	users, err := b.audience.GetStudentAudience(mark.StudentID)
+	if err != nil {
+		zap.L().Error("Failed to resolve mark recipients", zap.Uint("student_id", mark.StudentID), zap.Error(err))
+		return
+	}
+	rooms := make([]string, 0, len(users))
+	for _, id := range users {
+		rooms = append(rooms, UserRoom(id))
+	}
+	b.send(EventMarkAdded, mark, rooms...)
 }
 
-func (b *Broadcaster) NotifyMarkAdded(mark *domain.Mark) {
-	msg := NotificationMessage{
-		Type:    "MARK_ADDED",
-		Payload: mark,
+// NotifyNotification sends an in-app notification to its user, whose
+// clients acknowledge it with an ACK frame.
+func (b *Broadcaster) NotifyNotification(n *domain.Notification) {
+	b.send(EventNotification, n, UserRoom(n.UserID))
+}
+
+// NotifyNewMessage sends a message to every participant, subscribed to the
+// conversation or not.
+func (b *Broadcaster) NotifyNewMessage(conv *domain.Conversation, msg *domain.Message) {
+	rooms := []string{ConversationRoom(conv.ID)}
+	for _, id := range conv.ParticipantIDs {
+		rooms = append(rooms, UserRoom(id))
 	}
+	b.send(EventMessageNew, msg, rooms...)
+}
 
-	bytes, err := json.Marshal(msg)
+// NotifyConversationRead sends a read receipt to the conversation's
+// subscribers.
+func (b *Broadcaster) NotifyConversationRead(read *domain.ConversationRead) {
+	b.send(EventConversationRead, read, ConversationRoom(read.ConversationID))
+}
+
+// NotifyParticipantRemoved unsubscribes the clients of a user removed from a
+// conversation, so that they stop receiving its events.
+func (b *Broadcaster) NotifyParticipantRemoved(convID, userID uint) {
+	b.hub.Evict(userID, ConversationRoom(convID))
+}
+
+func (b *Broadcaster) send(eventType string, payload interface{}, rooms ...string) {
+	if len(rooms) == 0 {
+		return
+	}
+	id := uuid.NewString()
+	frame, err := encodeFrame(eventType, id, payload)
 	if err != nil {
-		fmt.Printf("Error marshaling notification: %v\n", err)
+		zap.L().Error("Failed to marshal WebSocket event", zap.String("type", eventType), zap.Error(err))
 		return
 	}
-
-	// Broadcast to all connected clients (Simple approach)
-	// In a real app, we would filter by ClassID or UserID logic in Hub
-	b.hub.Broadcast <- bytes
+	b.hub.send(id, frame, false, rooms...)
 }
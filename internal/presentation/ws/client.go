@@ -1,17 +1,31 @@
 package ws
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/k/iRegistro/internal/application/communication"
+	"github.com/k/iRegistro/internal/domain"
+	"go.uber.org/zap"
 )
 
 const (
 	writeWait      = 10 * time.Second
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512
+	maxMessageSize = 8192
+)
+
+var (
+	errInvalidFrame  = errors.New("invalid frame")
+	errUnavailable   = errors.New("not available")
+	errNotSubscribed = errors.New("not subscribed to the conversation")
+	errInternal      = errors.New("internal error")
 )
 
 type Client struct {
@@ -20,7 +34,18 @@ type Client struct {
 	Send     chan []byte
 	UserID   uint
 	SchoolID uint
-	Rooms    map[string]bool
+	Role     domain.Role
+	// Rooms are the rooms to join on registration. Once registered, only
+	// the hub's Run goroutine touches them.
+	Rooms map[string]bool
+	// Cursor is the last event received before reconnecting, if any.
+	Cursor string
+
+	handler *Handler
+	// ctx carries the tenant of the user, for the services serving frames
+	ctx context.Context
+	// subscriptions are the conversations joined, owned by ReadPump
+	subscriptions map[uint]bool
 }
 
 func (c *Client) ReadPump() {
@@ -32,16 +57,119 @@ func (c *Client) ReadPump() {
 	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.Conn.SetPongHandler(func(string) error { c.Conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
-		_, _, err := c.Conn.ReadMessage()
+		_, data, err := c.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("error: %v", err)
 			}
 			break
 		}
-		// Currently we don't handle incoming messages from clients, only broadcasts to them.
-		// If needed, we can push to Hub.Broadcast
+		c.handleFrame(data)
+	}
+}
+
+// handleFrame serves a frame sent by the client. Frames carrying an ID are
+// answered with OK; failures are always answered with ERROR.
+func (c *Client) handleFrame(data []byte) {
+	var f Frame
+	err := json.Unmarshal(data, &f)
+	if err != nil {
+		err = errInvalidFrame
+	} else if f.V != ProtocolVersion {
+		err = fmt.Errorf("unsupported protocol version %d", f.V)
+	} else {
+		err = c.handle(f)
+	}
+
+	var reply []byte
+	switch {
+	case err != nil:
+		reply, _ = encodeFrame(FrameError, f.ID, errorData{Message: err.Error()})
+	case f.ID != "":
+		reply, _ = encodeFrame(FrameOK, f.ID, nil)
+	default:
+		return
+	}
+	c.Hub.sendDirect(c, reply)
+}
+
+func (c *Client) handle(f Frame) error {
+	switch f.Type {
+	case FrameAck:
+		var data ackData
+		if err := json.Unmarshal(f.Data, &data); err != nil || data.NotificationID == 0 {
+			return errInvalidFrame
+		}
+		if c.handler == nil || c.handler.notifications == nil {
+			return errUnavailable
+		}
+		return c.internal(c.handler.notifications.AckNotification(c.UserID, data.NotificationID))
+	case FrameSubscribe, FrameUnsubscribe, FrameRead, FrameTyping:
+		var data conversationData
+		if err := json.Unmarshal(f.Data, &data); err != nil || data.ConversationID == 0 {
+			return errInvalidFrame
+		}
+		return c.handleConversation(f.Type, data)
+	default:
+		return fmt.Errorf("unknown frame type %q", f.Type)
+	}
+}
+
+func (c *Client) handleConversation(frameType string, data conversationData) error {
+	room := ConversationRoom(data.ConversationID)
+	switch frameType {
+	case FrameUnsubscribe:
+		delete(c.subscriptions, data.ConversationID)
+		c.Hub.Leave(c, room)
+		return nil
+	case FrameTyping:
+		if !c.subscriptions[data.ConversationID] {
+			return errNotSubscribed
+		}
+		frame, err := encodeFrame(FrameTyping, "", conversationData{ConversationID: data.ConversationID, UserID: c.UserID})
+		if err != nil {
+			return c.internal(err)
+		}
+		c.Hub.sendFrom(c, frame, room)
+		return nil
+	}
+
+	if c.handler == nil || c.handler.messaging == nil {
+		return errUnavailable
+	}
+	if frameType == FrameRead {
+		if data.MessageID == 0 {
+			return errInvalidFrame
+		}
+		err := c.handler.messaging.MarkRead(c.ctx, c.UserID, data.ConversationID, data.MessageID)
+		if errors.Is(err, communication.ErrNotParticipant) || errors.Is(err, communication.ErrConversationNotFound) {
+			return err
+		}
+		return c.internal(err)
+	}
+
+	ok, err := c.handler.messaging.CanAccessConversation(c.ctx, c.UserID, data.ConversationID)
+	if err != nil {
+		return c.internal(err)
+	}
+	if !ok {
+		return communication.ErrNotParticipant
+	}
+	if c.subscriptions == nil {
+		c.subscriptions = make(map[uint]bool)
+	}
+	c.subscriptions[data.ConversationID] = true
+	c.Hub.Join(c, room)
+	return nil
+}
+
+// internal logs err and hides its details from the client.
+func (c *Client) internal(err error) error {
+	if err == nil {
+		return nil
 	}
+	zap.L().Error("Failed to serve WebSocket frame", zap.Uint("user_id", c.UserID), zap.Error(err))
+	return errInternal
 }
 
 func (c *Client) WritePump() {
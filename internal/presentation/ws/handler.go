@@ -1,6 +1,7 @@
 package ws
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 
@@ -8,6 +9,9 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/websocket"
 	"github.com/k/iRegistro/internal/application/auth"
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/k/iRegistro/internal/tenant"
+	"go.uber.org/zap"
 )
 
 var upgrader = websocket.Upgrader{
@@ -18,18 +22,50 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// Audience resolves who may receive realtime events.
+type Audience interface {
+	GetClassIDsForUser(userID uint, role domain.Role) ([]uint, error)
+	// GetStudentAudience returns the users allowed to see a student's records.
+	GetStudentAudience(studentID uint) ([]uint, error)
+}
+
+// Messaging serves the conversation frames of the protocol.
+type Messaging interface {
+	CanAccessConversation(ctx context.Context, userID, convID uint) (bool, error)
+	MarkRead(ctx context.Context, userID, convID, messageID uint) error
+}
+
+// Notifications records the notifications acknowledged by clients.
+type Notifications interface {
+	AckNotification(userID, id uint) error
+}
+
 type Handler struct {
-	hub       *Hub
-	jwtSecret string
+	hub           *Hub
+	jwtSecret     string
+	audience      Audience
+	messaging     Messaging
+	notifications Notifications
 }
 
-func NewHandler(hub *Hub, secret string) *Handler {
+func NewHandler(hub *Hub, secret string, audience Audience) *Handler {
 	return &Handler{
 		hub:       hub,
 		jwtSecret: secret,
+		audience:  audience,
 	}
 }
 
+// SetServices enables the client frames acting on conversations and
+// notifications. It must be called before serving connections.
+func (h *Handler) SetServices(messaging Messaging, notifications Notifications) {
+	h.messaging = messaging
+	h.notifications = notifications
+}
+
+// ServeWS upgrades an authenticated request to a socket speaking the protocol
+// of protocol.go. Clients reconnecting pass the ID of the last event they
+// received as the cursor query parameter.
 func (h *Handler) ServeWS(c *gin.Context) {
 	tokenString := c.Query("token")
 	if tokenString == "" {
@@ -60,6 +96,13 @@ func (h *Handler) ServeWS(c *gin.Context) {
 		return
 	}
 
+	rooms, err := h.rooms(claims)
+	if err != nil {
+		zap.L().Error("Failed to resolve WebSocket rooms", zap.Uint("user_id", claims.UserID), zap.Error(err))
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to join rooms"})
+		return
+	}
+
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		return
@@ -71,7 +114,13 @@ func (h *Handler) ServeWS(c *gin.Context) {
 		Send:     make(chan []byte, 256),
 		UserID:   claims.UserID,
 		SchoolID: claims.SchoolID,
-		Rooms:    make(map[string]bool),
+		Role:     claims.Role,
+		Rooms:    rooms,
+		Cursor:   c.Query("cursor"),
+		handler:  h,
+		// The connection outlives the request: its frames are served with
+		// a context of their own
+		ctx: tenant.With(context.Background(), tenant.Tenant{SchoolID: claims.SchoolID, UserID: claims.UserID, Role: claims.Role}),
 	}
 
 	client.Hub.Register <- client
@@ -81,3 +130,22 @@ func (h *Handler) ServeWS(c *gin.Context) {
 	go client.WritePump()
 	go client.ReadPump()
 }
+
+// rooms returns the rooms a user joins on connection: their own, their
+// school's and their classes'.
+func (h *Handler) rooms(claims *auth.CustomClaims) (map[string]bool, error) {
+	rooms := map[string]bool{UserRoom(claims.UserID): true}
+	if claims.SchoolID != 0 {
+		rooms[SchoolRoom(claims.SchoolID)] = true
+	}
+	if h.audience != nil {
+		classIDs, err := h.audience.GetClassIDsForUser(claims.UserID, claims.Role)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range classIDs {
+			rooms[ClassRoom(id)] = true
+		}
+	}
+	return rooms, nil
+}
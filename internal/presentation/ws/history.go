@@ -0,0 +1,55 @@
+package ws
+
+import "time"
+
+const (
+	// historySize and historyTTL bound the events kept for clients resuming
+	// after a short disconnection.
+	historySize = 1024
+	historyTTL  = 2 * time.Minute
+)
+
+type historyEvent struct {
+	id      string
+	rooms   []string
+	message []byte
+	at      time.Time
+}
+
+// history is a ring of the last events delivered by a hub, local and remote.
+type history struct {
+	events []historyEvent
+	next   int
+	full   bool
+}
+
+func newHistory(size int) *history {
+	return &history{events: make([]historyEvent, size)}
+}
+
+func (h *history) add(e historyEvent) {
+	h.events[h.next] = e
+	h.next = (h.next + 1) % len(h.events)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// since returns the events that followed the one with id, oldest first. It
+// reports false if that event is unknown or older than historyTTL, in which
+// case events may have been missed.
+func (h *history) since(id string, now time.Time) ([]historyEvent, bool) {
+	ordered := h.events[:h.next]
+	if h.full {
+		ordered = append(append([]historyEvent(nil), h.events[h.next:]...), h.events[:h.next]...)
+	}
+	for i, e := range ordered {
+		if e.id == id {
+			if now.Sub(e.at) > historyTTL {
+				return nil, false
+			}
+			return ordered[i+1:], true
+		}
+	}
+	return nil, false
+}
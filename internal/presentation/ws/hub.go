@@ -1,75 +1,286 @@
 package ws
 
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/k/iRegistro/internal/middleware"
+)
+
+// Room names. Every client joins its user and school rooms, plus the rooms of
+// the classes it belongs to.
+func UserRoom(userID uint) string     { return fmt.Sprintf("user:%d", userID) }
+func SchoolRoom(schoolID uint) string { return fmt.Sprintf("school:%d", schoolID) }
+func ClassRoom(classID uint) string   { return fmt.Sprintf("class:%d", classID) }
+
+type roomChange struct {
+	client *Client
+	rooms  []string
+}
+
+type roomMessage struct {
+	id      string
+	rooms   []string
+	message []byte
+	origin  string // local or remote, for the metrics
+	// transient events, such as typing indicators, are not replayed on resume
+	transient bool
+	// evict, when set, makes the clients of that user leave rooms instead
+	evict uint
+	// sender, when set, is the client the event comes from, which must
+	// still be in the room for it to be sent
+	sender *Client
+}
+
+type directMessage struct {
+	client  *Client
+	message []byte
+}
+
+// Hub tracks the connected clients and their rooms. All its state is owned by
+// the Run goroutine: other goroutines go through Register, Unregister and the
+// Join, Leave and SendToRooms methods. With a backplane, events are also
+// relayed to and from the hubs of the other API nodes. The recent events are
+// kept so that clients reconnecting with a cursor receive those they missed.
 type Hub struct {
-	Clients    map[*Client]bool
-	Broadcast  chan []byte
 	Register   chan *Client
 	Unregister chan *Client
-	Rooms      map[string]map[*Client]bool // RoomID -> Set of Clients
+
+	clients  map[*Client]bool
+	rooms    map[string]map[*Client]bool // Room -> set of clients
+	joins    chan roomChange
+	leaves   chan roomChange
+	messages chan roomMessage
+	direct   chan directMessage
+	history  *history
+
+	nodeID    string
+	backplane Backplane
+	outbox    chan envelope
+	remote    chan envelope
+	seen      *seenIDs
 }
 
 func NewHub() *Hub {
 	return &Hub{
-		Broadcast:  make(chan []byte),
 		Register:   make(chan *Client),
 		Unregister: make(chan *Client),
-		Clients:    make(map[*Client]bool),
-		Rooms:      make(map[string]map[*Client]bool),
+		clients:    make(map[*Client]bool),
+		rooms:      make(map[string]map[*Client]bool),
+		joins:      make(chan roomChange),
+		leaves:     make(chan roomChange),
+		messages:   make(chan roomMessage, 256),
+		direct:     make(chan directMessage, 256),
+		history:    newHistory(historySize),
+		nodeID:     uuid.NewString(),
+		remote:     make(chan envelope, 256),
+		seen:       newSeenIDs(seenSize),
 	}
 }
 
 func (h *Hub) Run() {
+	if h.backplane != nil {
+		h.relay(context.Background())
+	}
 	for {
 		select {
 		case client := <-h.Register:
-			h.Clients[client] = true
+			h.clients[client] = true
+			middleware.ActiveWebSocketConnections.Inc()
+			// The rooms set by the handler before registering
+			for room := range client.Rooms {
+				h.join(client, room)
+			}
+			if client.Cursor != "" {
+				h.resume(client)
+			}
 		case client := <-h.Unregister:
-			if _, ok := h.Clients[client]; ok {
-				delete(h.Clients, client)
-				close(client.Send)
-				h.removeClientFromRooms(client)
+			h.remove(client)
+		case change := <-h.joins:
+			if h.clients[change.client] {
+				for _, room := range change.rooms {
+					h.join(change.client, room)
+				}
+			}
+		case change := <-h.leaves:
+			for _, room := range change.rooms {
+				h.leave(change.client, room)
 			}
-		case message := <-h.Broadcast:
-			for client := range h.Clients {
-				select {
-				case client.Send <- message:
-				default:
-					close(client.Send)
-					delete(h.Clients, client)
+		case msg := <-h.messages:
+			if msg.sender != nil {
+				if !h.rooms[msg.rooms[0]][msg.sender] {
+					continue // Left or evicted meanwhile
 				}
+				h.publish(envelope{ID: msg.id, Node: h.nodeID, Rooms: msg.rooms, Message: msg.message, Transient: msg.transient})
+			}
+			h.deliver(msg)
+		case msg := <-h.direct:
+			if h.clients[msg.client] {
+				h.sendTo(msg.client, msg.message)
+			}
+		case env := <-h.remote:
+			if !h.seen.add(env.ID) {
+				middleware.WebSocketBackplaneDuplicates.Inc()
+				continue
 			}
+			h.deliver(roomMessage{id: env.ID, rooms: env.Rooms, message: env.Message, origin: "remote", transient: env.Transient, evict: env.Evict})
 		}
 	}
 }
 
-func (h *Hub) JoinRoom(room string, client *Client) {
-	if h.Rooms[room] == nil {
-		h.Rooms[room] = make(map[*Client]bool)
+// Join adds a registered client to rooms.
+func (h *Hub) Join(client *Client, rooms ...string) {
+	h.joins <- roomChange{client: client, rooms: rooms}
+}
+
+func (h *Hub) Leave(client *Client, rooms ...string) {
+	h.leaves <- roomChange{client: client, rooms: rooms}
+}
+
+// SendToRooms queues message for the clients in any of rooms, on every
+// node. A client in several of them receives it once.
+func (h *Hub) SendToRooms(message []byte, rooms ...string) {
+	h.send(uuid.NewString(), message, false, rooms...)
+}
+
+// Evict makes every client of userID leave rooms, on every node, such as a
+// participant removed from a conversation.
+func (h *Hub) Evict(userID uint, rooms ...string) {
+	if len(rooms) == 0 {
+		return
+	}
+	id := uuid.NewString()
+	h.messages <- roomMessage{id: id, rooms: rooms, origin: "local", evict: userID}
+	h.publish(envelope{ID: id, Node: h.nodeID, Rooms: rooms, Evict: userID})
+}
+
+// send queues the event id for rooms; transient events are not kept for
+// resuming clients.
+func (h *Hub) send(id string, message []byte, transient bool, rooms ...string) {
+	if len(rooms) == 0 {
+		return
+	}
+	h.messages <- roomMessage{id: id, rooms: rooms, message: message, origin: "local", transient: transient}
+	h.publish(envelope{ID: id, Node: h.nodeID, Rooms: rooms, Message: message, Transient: transient})
+}
+
+// sendFrom queues a transient event of client for its room, dropped unless
+// the client is still in it.
+func (h *Hub) sendFrom(client *Client, message []byte, room string) {
+	h.messages <- roomMessage{id: uuid.NewString(), rooms: []string{room}, message: message, origin: "local", transient: true, sender: client}
+}
+
+// sendDirect queues message for a single client, such as the reply to one of
+// its frames. It is dropped if the client is gone.
+func (h *Hub) sendDirect(client *Client, message []byte) {
+	h.direct <- directMessage{client: client, message: message}
+}
+
+func (h *Hub) join(client *Client, room string) {
+	if h.rooms[room] == nil {
+		h.rooms[room] = make(map[*Client]bool)
+		middleware.WebSocketRooms.Inc()
 	}
-	h.Rooms[room][client] = true
+	h.rooms[room][client] = true
 	client.Rooms[room] = true
 }
 
-func (h *Hub) removeClientFromRooms(client *Client) {
+func (h *Hub) leave(client *Client, room string) {
+	if clients, ok := h.rooms[room]; ok {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(h.rooms, room)
+			middleware.WebSocketRooms.Dec()
+		}
+	}
+	delete(client.Rooms, room)
+}
+
+// remove forgets a client and closes its Send channel, which ends its
+// write pump.
+func (h *Hub) remove(client *Client) {
+	if !h.clients[client] {
+		return
+	}
 	for room := range client.Rooms {
-		if clients, ok := h.Rooms[room]; ok {
-			delete(clients, client)
-			if len(clients) == 0 {
-				delete(h.Rooms, room)
+		h.leave(client, room)
+	}
+	delete(h.clients, client)
+	close(client.Send)
+	middleware.ActiveWebSocketConnections.Dec()
+}
+
+func (h *Hub) deliver(msg roomMessage) {
+	if msg.evict != 0 {
+		h.evict(msg.evict, msg.rooms)
+		return
+	}
+	middleware.WebSocketEventsTotal.WithLabelValues(msg.origin).Inc()
+	if !msg.transient {
+		h.history.add(historyEvent{id: msg.id, rooms: msg.rooms, message: msg.message, at: time.Now()})
+	}
+	sent := make(map[*Client]bool)
+	for _, room := range msg.rooms {
+		for client := range h.rooms[room] {
+			if sent[client] {
+				continue
+			}
+			sent[client] = true
+			h.sendTo(client, msg.message)
+		}
+	}
+}
+
+// evict makes the clients of userID leave rooms.
+func (h *Hub) evict(userID uint, rooms []string) {
+	for _, room := range rooms {
+		for client := range h.rooms[room] {
+			if client.UserID == userID {
+				h.leave(client, room)
 			}
 		}
 	}
 }
 
-func (h *Hub) BroadcastToRoom(room string, message []byte) {
-	if clients, ok := h.Rooms[room]; ok {
-		for client := range clients {
-			select {
-			case client.Send <- message:
-			default:
-				close(client.Send)
-				delete(h.Clients, client)
+func (h *Hub) sendTo(client *Client, message []byte) {
+	select {
+	case client.Send <- message:
+	default:
+		// Too slow to keep up: drop the connection
+		middleware.WebSocketSlowClientsDropped.Inc()
+		h.remove(client)
+	}
+}
+
+// resume replays to a reconnecting client the events of its rooms that
+// followed its cursor, or asks it to resync when they are not all available.
+func (h *Hub) resume(client *Client) {
+	events, ok := h.history.since(client.Cursor, time.Now())
+	var missed [][]byte
+	for _, e := range events {
+		for _, room := range e.rooms {
+			if client.Rooms[room] {
+				missed = append(missed, e.message)
+				break
 			}
 		}
 	}
+	// Keep room in Send for the RESUMED frame
+	if !ok || len(missed) >= cap(client.Send) {
+		middleware.WebSocketResumes.WithLabelValues("resync").Inc()
+		h.sendFrame(client, FrameResync, client.Cursor)
+		return
+	}
+	middleware.WebSocketResumes.WithLabelValues("resumed").Inc()
+	for _, message := range missed {
+		h.sendTo(client, message)
+	}
+	h.sendFrame(client, FrameResumed, client.Cursor)
+}
+
+func (h *Hub) sendFrame(client *Client, frameType, id string) {
+	frame, _ := encodeFrame(frameType, id, nil)
+	h.sendTo(client, frame)
 }
@@ -0,0 +1,346 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/k/iRegistro/internal/application/auth"
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/k/iRegistro/internal/infrastructure/backplane"
+	"github.com/k/iRegistro/internal/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeMessaging struct {
+	participants map[uint][]uint // Conversation -> users
+	reads        []uint
+}
+
+func (f *fakeMessaging) CanAccessConversation(ctx context.Context, userID, convID uint) (bool, error) {
+	if _, ok := tenant.From(ctx); !ok {
+		return false, tenant.ErrNoTenant
+	}
+	for _, id := range f.participants[convID] {
+		if id == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+func (f *fakeMessaging) MarkRead(ctx context.Context, userID, convID, messageID uint) error {
+	f.reads = append(f.reads, messageID)
+	return nil
+}
+
+type fakeNotifications struct{ acked []uint }
+
+func (f *fakeNotifications) AckNotification(userID, id uint) error {
+	f.acked = append(f.acked, id)
+	return nil
+}
+
+type fakeAudience struct {
+	classes  map[uint][]uint
+	students map[uint][]uint
+}
+
+func (f *fakeAudience) GetClassIDsForUser(userID uint, role domain.Role) ([]uint, error) {
+	return f.classes[userID], nil
+}
+func (f *fakeAudience) GetStudentAudience(studentID uint) ([]uint, error) {
+	return f.students[studentID], nil
+}
+
+func newClient(hub *Hub, userID uint, rooms ...string) *Client {
+	c := &Client{Hub: hub, Send: make(chan []byte, 4), UserID: userID, Rooms: make(map[string]bool)}
+	for _, room := range rooms {
+		c.Rooms[room] = true
+	}
+	hub.Register <- c
+	return c
+}
+
+func receive(t *testing.T, c *Client) string {
+	t.Helper()
+	select {
+	case msg := <-c.Send:
+		return string(msg)
+	case <-time.After(time.Second):
+		t.Fatalf("client %d received nothing", c.UserID)
+		return ""
+	}
+}
+
+func TestHubRooms(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	mario := newClient(hub, 1, UserRoom(1), SchoolRoom(7), ClassRoom(3))
+	anna := newClient(hub, 2, UserRoom(2), SchoolRoom(7))
+	other := newClient(hub, 3, UserRoom(3), SchoolRoom(8))
+
+	hub.SendToRooms([]byte("grade"), UserRoom(1))
+	hub.SendToRooms([]byte("school"), SchoolRoom(7), ClassRoom(3))
+	assert.Equal(t, "grade", receive(t, mario))
+	assert.Equal(t, "school", receive(t, mario), "sent once to clients in several rooms")
+	assert.Equal(t, "school", receive(t, anna), "messages are delivered in order, so anna never got the grade")
+
+	hub.Join(anna, ClassRoom(3))
+	hub.Leave(mario, ClassRoom(3))
+	hub.SendToRooms([]byte("class"), ClassRoom(3))
+	hub.SendToRooms([]byte("everyone"), SchoolRoom(7), SchoolRoom(8))
+	assert.Equal(t, "class", receive(t, anna))
+	assert.Equal(t, "everyone", receive(t, anna))
+	assert.Equal(t, "everyone", receive(t, mario))
+	assert.Equal(t, "everyone", receive(t, other))
+
+	// Unregistered and slow clients are dropped and their Send closed
+	hub.Unregister <- other
+	for i := 0; i < cap(anna.Send)+1; i++ {
+		hub.SendToRooms([]byte("flood"), UserRoom(2))
+	}
+	hub.SendToRooms([]byte("after"), SchoolRoom(8), UserRoom(2), UserRoom(1))
+	assert.Equal(t, "after", receive(t, mario))
+	_, open := <-other.Send
+	assert.False(t, open)
+	for range anna.Send {
+	}
+}
+
+func TestHubEvict(t *testing.T) {
+	bp := backplane.NewMemory()
+	nodeA, nodeB := NewHub(), NewHub()
+	nodeA.SetBackplane(bp)
+	nodeB.SetBackplane(bp)
+	go nodeA.Run()
+	go nodeB.Run()
+
+	mario := newClient(nodeA, 1, UserRoom(1), ConversationRoom(4))
+	anna := newClient(nodeA, 2, UserRoom(2), ConversationRoom(4))
+	// The same user connected to the other node
+	annaOnB := newClient(nodeB, 2, UserRoom(2), ConversationRoom(4))
+	require.Eventually(t, func() bool {
+		nodeA.SendToRooms([]byte("warm"), UserRoom(2))
+		select {
+		case <-annaOnB.Send:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+	for len(anna.Send) > 0 {
+		<-anna.Send
+	}
+
+	NewBroadcaster(nodeA, nil).NotifyParticipantRemoved(4, 2)
+	nodeA.SendToRooms([]byte("message"), ConversationRoom(4))
+	nodeA.SendToRooms([]byte("after"), UserRoom(2))
+	assert.Equal(t, "message", receive(t, mario))
+	assert.Equal(t, "after", receive(t, anna), "no longer in the conversation")
+	got := receive(t, annaOnB)
+	for got == "warm" {
+		got = receive(t, annaOnB)
+	}
+	assert.Equal(t, "after", got, "evicted on every node")
+}
+
+func TestHandlerRooms(t *testing.T) {
+	h := NewHandler(NewHub(), "secret", &fakeAudience{classes: map[uint][]uint{5: {3, 4}}})
+	rooms, err := h.rooms(&auth.CustomClaims{UserID: 5, SchoolID: 7, Role: domain.RoleTeacher})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"user:5": true, "school:7": true, "class:3": true, "class:4": true}, rooms)
+
+	rooms, err = h.rooms(&auth.CustomClaims{UserID: 1, Role: domain.RoleSuperAdmin})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"user:1": true}, rooms)
+}
+
+func TestNotifyMarkAdded(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	parent := newClient(hub, 10, UserRoom(10), SchoolRoom(7), ClassRoom(3))
+	classmateParent := newClient(hub, 11, UserRoom(11), SchoolRoom(7), ClassRoom(3))
+
+	b := NewBroadcaster(hub, &fakeAudience{students: map[uint][]uint{100: {10}}})
+	b.NotifyMarkAdded(&domain.Mark{ID: 1, StudentID: 100, ClassID: 3, Value: 8})
+	hub.SendToRooms([]byte("marker"), ClassRoom(3))
+
+	var msg Frame
+	require.NoError(t, json.Unmarshal([]byte(receive(t, parent)), &msg))
+	assert.Equal(t, ProtocolVersion, msg.V)
+	assert.Equal(t, EventMarkAdded, msg.Type)
+	assert.NotEmpty(t, msg.ID)
+	assert.Equal(t, "marker", receive(t, classmateParent), "marks only reach the student's family")
+}
+
+func TestBackplaneRelay(t *testing.T) {
+	bp := backplane.NewMemory()
+	nodeA, nodeB := NewHub(), NewHub()
+	nodeA.SetBackplane(bp)
+	nodeB.SetBackplane(bp)
+	go nodeA.Run()
+	go nodeB.Run()
+
+	onA := newClient(nodeA, 1, UserRoom(1), SchoolRoom(7))
+	onB := newClient(nodeB, 2, UserRoom(2), SchoolRoom(7))
+
+	// Both hubs must be subscribed before publishing
+	warmUp := func(message string) []byte {
+		return []byte(`{"id":"` + uuid.NewString() + `","node":"warm-up","rooms":["user:1","user:2"],"message":"` + message + `"}`)
+	}
+	require.Eventually(t, func() bool {
+		bp.Publish(context.Background(), warmUp("Indhcm0i")) // "warm"
+		for _, c := range []*Client{onA, onB} {
+			select {
+			case <-c.Send:
+			case <-time.After(100 * time.Millisecond):
+				return false
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond)
+	// Events are relayed in order: skip the warm-up copies up to a marker
+	bp.Publish(context.Background(), warmUp("InJlYWR5Ig==")) // "ready"
+	for _, c := range []*Client{onA, onB} {
+		for receive(t, c) != `"ready"` {
+		}
+	}
+
+	nodeA.SendToRooms([]byte("school"), SchoolRoom(7))
+	assert.Equal(t, "school", receive(t, onA))
+	assert.Equal(t, "school", receive(t, onB), "relayed to the other node")
+
+	nodeB.SendToRooms([]byte("private"), UserRoom(2))
+	nodeB.SendToRooms([]byte("next"), UserRoom(1))
+	assert.Equal(t, "private", receive(t, onB))
+	assert.Equal(t, "next", receive(t, onA), "events only reach their rooms on other nodes too")
+
+	// The same event received twice is delivered once
+	event := []byte(`{"id":"dup","node":"other","rooms":["user:1"],"message":"ImR1cCI="}`)
+	bp.Publish(context.Background(), event)
+	bp.Publish(context.Background(), event)
+	nodeB.SendToRooms([]byte("last"), UserRoom(1))
+	assert.Equal(t, `"dup"`, receive(t, onA))
+	assert.Equal(t, "last", receive(t, onA))
+}
+
+func TestSeenIDs(t *testing.T) {
+	seen := newSeenIDs(2)
+	assert.True(t, seen.add("a"))
+	assert.False(t, seen.add("a"))
+	assert.True(t, seen.add("b"))
+	assert.True(t, seen.add("c"))
+	assert.True(t, seen.add("a"), "forgotten once out of the window")
+}
+
+func frame(t *testing.T, c *Client) Frame {
+	t.Helper()
+	var f Frame
+	require.NoError(t, json.Unmarshal([]byte(receive(t, c)), &f))
+	return f
+}
+
+func TestClientFrames(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	messaging := &fakeMessaging{participants: map[uint][]uint{4: {1, 2}}}
+	notifications := &fakeNotifications{}
+	h := NewHandler(hub, "secret", nil)
+	h.SetServices(messaging, notifications)
+
+	mario := newClient(hub, 1, UserRoom(1))
+	anna := newClient(hub, 2, UserRoom(2))
+	other := newClient(hub, 3, UserRoom(3))
+	for _, c := range []*Client{mario, anna, other} {
+		c.handler = h
+		c.ctx = tenant.With(context.Background(), tenant.Tenant{SchoolID: 7, UserID: c.UserID, Role: domain.RoleParent})
+	}
+
+	mario.handleFrame([]byte(`{"v":1,"type":"SUBSCRIBE","id":"r1","data":{"conversation_id":4}}`))
+	assert.Equal(t, Frame{V: 1, Type: FrameOK, ID: "r1"}, frame(t, mario))
+	anna.handleFrame([]byte(`{"v":1,"type":"SUBSCRIBE","data":{"conversation_id":4}}`))
+	other.handleFrame([]byte(`{"v":1,"type":"SUBSCRIBE","id":"r2","data":{"conversation_id":4}}`))
+	f := frame(t, other)
+	assert.Equal(t, FrameError, f.Type)
+	assert.JSONEq(t, `{"message":"not a participant of the conversation"}`, string(f.Data))
+
+	anna.handleFrame([]byte(`{"v":1,"type":"TYPING","data":{"conversation_id":4}}`))
+	f = frame(t, mario)
+	assert.Equal(t, FrameTyping, f.Type)
+	assert.JSONEq(t, `{"conversation_id":4,"user_id":2}`, string(f.Data))
+	assert.Equal(t, FrameTyping, frame(t, anna).Type)
+
+	other.handleFrame([]byte(`{"v":1,"type":"TYPING","data":{"conversation_id":4}}`))
+	assert.Equal(t, FrameError, frame(t, other).Type, "typing requires a subscription")
+
+	mario.handleFrame([]byte(`{"v":1,"type":"READ","id":"r3","data":{"conversation_id":4,"message_id":7}}`))
+	mario.handleFrame([]byte(`{"v":1,"type":"ACK","id":"r4","data":{"notification_id":9}}`))
+	assert.Equal(t, "r3", frame(t, mario).ID)
+	assert.Equal(t, "r4", frame(t, mario).ID)
+	assert.Equal(t, []uint{7}, messaging.reads)
+	assert.Equal(t, []uint{9}, notifications.acked)
+
+	for _, data := range []string{`nonsense`, `{"v":2,"type":"ACK"}`, `{"v":1,"type":"DANCE"}`, `{"v":1,"type":"ACK","data":{}}`} {
+		mario.handleFrame([]byte(data))
+		assert.Equal(t, FrameError, frame(t, mario).Type, data)
+	}
+
+	mario.handleFrame([]byte(`{"v":1,"type":"UNSUBSCRIBE","data":{"conversation_id":4}}`))
+	anna.handleFrame([]byte(`{"v":1,"type":"TYPING","data":{"conversation_id":4}}`))
+	hub.SendToRooms([]byte("marker"), UserRoom(1))
+	assert.Equal(t, "marker", receive(t, mario), "no more typing after unsubscribing")
+
+	assert.Equal(t, FrameTyping, frame(t, anna).Type)
+	hub.Evict(2, ConversationRoom(4))
+	anna.handleFrame([]byte(`{"v":1,"type":"TYPING","data":{"conversation_id":4}}`))
+	hub.SendToRooms([]byte("marker"), UserRoom(2))
+	assert.Equal(t, "marker", receive(t, anna), "no more typing once evicted")
+}
+
+func TestResume(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	b := NewBroadcaster(hub, nil)
+	first := newClient(hub, 1, UserRoom(1))
+	anna := newClient(hub, 2, UserRoom(2))
+
+	b.NotifyNotification(&domain.Notification{ID: 1, UserID: 1})
+	cursor := frame(t, first).ID
+	hub.Unregister <- first
+	b.NotifyNotification(&domain.Notification{ID: 2, UserID: 1})
+	b.NotifyNotification(&domain.Notification{ID: 3, UserID: 2})
+	b.NotifyNotification(&domain.Notification{ID: 4, UserID: 1})
+	b.NotifyNotification(&domain.Notification{ID: 5, UserID: 2})
+	frame(t, anna)
+	frame(t, anna) // Every event was delivered
+
+	// Reconnecting replays the missed events of the client's rooms only
+	resumed := &Client{Hub: hub, Send: make(chan []byte, 4), UserID: 1, Rooms: map[string]bool{UserRoom(1): true}, Cursor: cursor}
+	hub.Register <- resumed
+	assert.Contains(t, string(frame(t, resumed).Data), `"id":2,`)
+	assert.Contains(t, string(frame(t, resumed).Data), `"id":4,`)
+	assert.Equal(t, Frame{V: 1, Type: FrameResumed, ID: cursor}, frame(t, resumed))
+
+	unknown := &Client{Hub: hub, Send: make(chan []byte, 4), UserID: 1, Rooms: map[string]bool{UserRoom(1): true}, Cursor: "gone"}
+	hub.Register <- unknown
+	assert.Equal(t, FrameResync, frame(t, unknown).Type)
+}
+
+func TestHistory(t *testing.T) {
+	h := newHistory(3)
+	now := time.Now()
+	for _, id := range []string{"a", "b", "c", "d"} {
+		h.add(historyEvent{id: id, at: now})
+	}
+	events, ok := h.since("b", now)
+	require.True(t, ok)
+	assert.Equal(t, []string{"c", "d"}, []string{events[0].id, events[1].id})
+	_, ok = h.since("a", now)
+	assert.False(t, ok, "evicted")
+	_, ok = h.since("d", now.Add(historyTTL+time.Second))
+	assert.False(t, ok, "expired")
+}
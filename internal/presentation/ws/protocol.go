@@ -0,0 +1,72 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ProtocolVersion is the version of the frames exchanged on the socket.
+// Frames with another version are rejected.
+const ProtocolVersion = 1
+
+// Frame types sent by clients.
+const (
+	FrameSubscribe   = "SUBSCRIBE"   // Join a conversation's room: {conversation_id}
+	FrameUnsubscribe = "UNSUBSCRIBE" // {conversation_id}
+	FrameAck         = "ACK"         // A notification was received: {notification_id}
+	FrameRead        = "READ"        // Read receipt: {conversation_id, message_id}
+	FrameTyping      = "TYPING"      // {conversation_id}; relayed to the subscribers with the user_id
+)
+
+// Frame types sent by the server, besides the events of the Broadcaster.
+const (
+	FrameOK    = "OK"    // A client frame with an ID succeeded
+	FrameError = "ERROR" // A client frame failed: {message}
+	// FrameResumed follows the events replayed after a reconnection with a
+	// cursor.
+	FrameResumed = "RESUMED"
+	// FrameResync tells a client the events since its cursor are no longer
+	// available: it must reload its state through the REST API.
+	FrameResync = "RESYNC"
+)
+
+// Frame is the envelope of every message on the socket, in both directions.
+type Frame struct {
+	V    int    `json:"v"`
+	Type string `json:"type"`
+	// ID identifies a server event, which clients pass back as the cursor
+	// query parameter when reconnecting, or a client request, echoed in the
+	// reply.
+	ID   string          `json:"id,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type conversationData struct {
+	ConversationID uint `json:"conversation_id"`
+	MessageID      uint `json:"message_id,omitempty"`
+	UserID         uint `json:"user_id,omitempty"`
+}
+
+type ackData struct {
+	NotificationID uint `json:"notification_id"`
+}
+
+type errorData struct {
+	Message string `json:"message"`
+}
+
+// ConversationRoom is joined by the clients subscribed to a conversation.
+func ConversationRoom(convID uint) string { return fmt.Sprintf("conversation:%d", convID) }
+
+// encodeFrame marshals a frame carrying data, which may be nil.
+func encodeFrame(frameType, id string, data interface{}) ([]byte, error) {
+	f := Frame{V: ProtocolVersion, Type: frameType, ID: id}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		f.Data = raw
+	}
+	return json.Marshal(f)
+}
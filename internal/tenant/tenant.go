@@ -0,0 +1,52 @@
+// Package tenant carries the school a request acts on, and the user acting,
+// through the context down to the repositories, which refuse to read the
+// data of a school without it.
+package tenant
+
+import (
+	"context"
+	"errors"
+
+	"github.com/k/iRegistro/internal/domain"
+)
+
+// ErrNoTenant is returned by the tenant scoped repository methods called
+// with a context that carries no tenant.
+var ErrNoTenant = errors.New("no tenant in context")
+
+// Tenant is the school a request acts on and the user acting. The
+// background jobs act on a school without a user.
+type Tenant struct {
+	SchoolID uint
+	UserID   uint
+	Role     domain.Role
+}
+
+// AllSchools reports whether the tenant can read the data of every school:
+// only the platform administrators can.
+func (t Tenant) AllSchools() bool {
+	return t.Role == domain.RoleSuperAdmin
+}
+
+type contextKey struct{}
+
+// With returns a copy of ctx carrying t.
+func With(ctx context.Context, t Tenant) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// School returns a copy of ctx acting on a school on behalf of the system,
+// for the jobs going through the schools one by one.
+func School(ctx context.Context, schoolID uint) context.Context {
+	return With(ctx, Tenant{SchoolID: schoolID})
+}
+
+// From returns the tenant of ctx. A tenant without a school, other than a
+// platform administrator, is no tenant.
+func From(ctx context.Context) (Tenant, bool) {
+	t, ok := ctx.Value(contextKey{}).(Tenant)
+	if !ok || (t.SchoolID == 0 && !t.AllSchools()) {
+		return Tenant{}, false
+	}
+	return t, true
+}
@@ -0,0 +1,34 @@
+package tenant
+
+import (
+	"context"
+	"testing"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrom(t *testing.T) {
+	ctx := context.Background()
+
+	_, ok := From(ctx)
+	assert.False(t, ok, "no tenant")
+
+	teacher := Tenant{SchoolID: 3, UserID: 7, Role: domain.RoleTeacher}
+	got, ok := From(With(ctx, teacher))
+	assert.True(t, ok)
+	assert.Equal(t, teacher, got)
+
+	_, ok = From(With(ctx, Tenant{UserID: 7, Role: domain.RoleTeacher}))
+	assert.False(t, ok, "a user without a school is no tenant")
+
+	admin, ok := From(With(ctx, Tenant{UserID: 1, Role: domain.RoleSuperAdmin}))
+	assert.True(t, ok)
+	assert.True(t, admin.AllSchools())
+	assert.False(t, teacher.AllSchools())
+
+	job, ok := From(School(ctx, 3))
+	assert.True(t, ok)
+	assert.Equal(t, Tenant{SchoolID: 3}, job)
+	assert.False(t, job.AllSchools())
+}
@@ -0,0 +1,18 @@
+-- Restore the original (UUID based) auth_audit_logs definition from 011
+
+DROP TABLE IF EXISTS auth_audit_logs CASCADE;
+
+CREATE TABLE IF NOT EXISTS auth_audit_logs (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID,
+    auth_method VARCHAR(20) NOT NULL,
+    provider VARCHAR(50),
+    ip_address INET,
+    user_agent TEXT,
+    success BOOLEAN NOT NULL,
+    failure_reason TEXT,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_auth_audit_user_id ON auth_audit_logs(user_id);
+CREATE INDEX IF NOT EXISTS idx_auth_audit_created_at ON auth_audit_logs(created_at);
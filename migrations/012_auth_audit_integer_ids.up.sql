@@ -0,0 +1,21 @@
+-- auth_audit_logs (011) referenced users(id) as UUID, but users.id is SERIAL.
+-- Recreate the table with integer keys so federated logins can be audited.
+
+DROP TABLE IF EXISTS auth_audit_logs CASCADE;
+
+CREATE TABLE auth_audit_logs (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE, -- NULL when the identity could not be resolved
+    auth_method VARCHAR(20) NOT NULL,
+    provider VARCHAR(50),
+    ip_address VARCHAR(45),
+    user_agent TEXT,
+    success BOOLEAN NOT NULL,
+    failure_reason TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_auth_audit_user_id ON auth_audit_logs(user_id);
+CREATE INDEX IF NOT EXISTS idx_auth_audit_created_at ON auth_audit_logs(created_at);
+
+COMMENT ON TABLE auth_audit_logs IS 'Audit log for authentication attempts (GDPR compliance)';
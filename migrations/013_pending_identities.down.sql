@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS pending_identities;
+DROP INDEX IF EXISTS idx_users_tax_code;
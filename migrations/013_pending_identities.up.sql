@@ -0,0 +1,33 @@
+-- SPID/CIE identities that could not be linked to a user automatically.
+-- They wait for the owner of an existing email account to confirm the link,
+-- or for the school secretary to approve them.
+
+CREATE INDEX IF NOT EXISTS idx_users_tax_code ON users(UPPER(tax_code));
+
+CREATE TABLE IF NOT EXISTS pending_identities (
+    id SERIAL PRIMARY KEY,
+    school_id INTEGER NOT NULL REFERENCES schools(id) ON DELETE CASCADE,
+    auth_method VARCHAR(20) NOT NULL CHECK (auth_method IN ('spid', 'cie')),
+    external_id VARCHAR(255) NOT NULL,
+    provider VARCHAR(255),
+    tax_code VARCHAR(16),
+    first_name VARCHAR(100),
+    last_name VARCHAR(100),
+    email VARCHAR(255),
+    cie_serial_number VARCHAR(50),
+    status VARCHAR(30) NOT NULL
+        CHECK (status IN ('AWAITING_CONFIRMATION', 'PENDING_APPROVAL', 'LINKED', 'REJECTED')),
+    matched_user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    confirm_token_hash VARCHAR(64),
+    confirm_token_exp TIMESTAMP WITH TIME ZONE,
+    linked_user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    reviewed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    reviewed_at TIMESTAMP WITH TIME ZONE,
+    rejection_reason TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_pending_identities_school_status ON pending_identities(school_id, status);
+CREATE INDEX IF NOT EXISTS idx_pending_identities_external_id ON pending_identities(external_id);
+CREATE INDEX IF NOT EXISTS idx_pending_identities_token ON pending_identities(confirm_token_hash);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS saml_assertion_uses;
+DROP TABLE IF EXISTS saml_requests;
@@ -0,0 +1,23 @@
+-- SPID AuthnRequests awaiting a response (InResponseTo validation) and
+-- assertion IDs already accepted (replay detection). Rows are purged once expired.
+
+CREATE TABLE IF NOT EXISTS saml_requests (
+    id VARCHAR(64) PRIMARY KEY,
+    school_id INTEGER NOT NULL REFERENCES schools(id) ON DELETE CASCADE,
+    redirect_uri TEXT,
+    level INTEGER NOT NULL CHECK (level BETWEEN 1 AND 3),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    consumed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_saml_requests_expires_at ON saml_requests(expires_at);
+
+CREATE TABLE IF NOT EXISTS saml_assertion_uses (
+    id VARCHAR(255) PRIMARY KEY,
+    issuer VARCHAR(255),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_saml_assertion_uses_expires_at ON saml_assertion_uses(expires_at);
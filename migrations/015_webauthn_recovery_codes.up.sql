@@ -0,0 +1,41 @@
+-- WebAuthn credentials (passkeys, security keys), second factor recovery codes
+-- and the server side state of WebAuthn ceremonies.
+
+CREATE TABLE IF NOT EXISTS web_authn_credentials (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    credential_id BYTEA NOT NULL UNIQUE,
+    public_key BYTEA NOT NULL,
+    attestation_type VARCHAR(32),
+    aaguid BYTEA,
+    sign_count BIGINT DEFAULT 0,
+    transports VARCHAR(100),
+    backup_eligible BOOLEAN DEFAULT FALSE,
+    backup_state BOOLEAN DEFAULT FALSE,
+    name VARCHAR(100),
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_web_authn_credentials_user_id ON web_authn_credentials(user_id);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes(user_id);
+
+CREATE TABLE IF NOT EXISTS web_authn_ceremonies (
+    id VARCHAR(128) PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(20) NOT NULL,
+    session_data TEXT NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_web_authn_ceremonies_expires_at ON web_authn_ceremonies(expires_at);
@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS reset_token_hash VARCHAR(255);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS reset_token_exp TIMESTAMP WITH TIME ZONE;
+
+DROP TABLE IF EXISTS password_reset_tokens;
@@ -0,0 +1,18 @@
+-- Single-use password reset tokens, replacing the token hash stored on users.
+
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    selector VARCHAR(32) NOT NULL UNIQUE,
+    verifier_hash VARCHAR(64) NOT NULL,
+    ip_address VARCHAR(45),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_user_id ON password_reset_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_created_at ON password_reset_tokens(created_at);
+
+ALTER TABLE users DROP COLUMN IF EXISTS reset_token_hash;
+ALTER TABLE users DROP COLUMN IF EXISTS reset_token_exp;
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS delivery_attempts;
+DROP TABLE IF EXISTS notification_deliveries;
+
+ALTER TABLE users DROP COLUMN IF EXISTS locale;
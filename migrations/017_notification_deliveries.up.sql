@@ -0,0 +1,38 @@
+-- Delivery tracking for notifications sent through external channels (email,
+-- SMS, push) and the language used to render them.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locale VARCHAR(5) DEFAULT 'it';
+
+CREATE TABLE IF NOT EXISTS notification_deliveries (
+    id SERIAL PRIMARY KEY,
+    notification_id INTEGER NOT NULL REFERENCES notifications(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    school_id INTEGER,
+    channel VARCHAR(50) NOT NULL,
+    recipient VARCHAR(255),
+    status VARCHAR(20) NOT NULL,
+    attempts INTEGER DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP WITH TIME ZONE,
+    sent_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_notification_deliveries_notification_id ON notification_deliveries(notification_id);
+CREATE INDEX IF NOT EXISTS idx_notification_deliveries_user_id ON notification_deliveries(user_id);
+CREATE INDEX IF NOT EXISTS idx_notification_deliveries_school_id ON notification_deliveries(school_id);
+CREATE INDEX IF NOT EXISTS idx_notification_deliveries_status ON notification_deliveries(status);
+CREATE INDEX IF NOT EXISTS idx_notification_deliveries_next_attempt_at ON notification_deliveries(next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_notification_deliveries_updated_at ON notification_deliveries(updated_at);
+
+CREATE TABLE IF NOT EXISTS delivery_attempts (
+    id SERIAL PRIMARY KEY,
+    delivery_id INTEGER NOT NULL REFERENCES notification_deliveries(id) ON DELETE CASCADE,
+    attempt INTEGER NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_delivery_attempts_delivery_id ON delivery_attempts(delivery_id);
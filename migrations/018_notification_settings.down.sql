@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS notification_settings;
+
+ALTER TABLE IF EXISTS notification_preferences DROP COLUMN IF EXISTS digest;
@@ -0,0 +1,12 @@
+-- Per-user quiet hours and daily digest for notifications sent through
+-- external channels.
+
+ALTER TABLE IF EXISTS notification_preferences ADD COLUMN IF NOT EXISTS digest BOOLEAN DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS notification_settings (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    quiet_hours_start VARCHAR(5),
+    quiet_hours_end VARCHAR(5),
+    digest_time VARCHAR(5) DEFAULT '18:00',
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
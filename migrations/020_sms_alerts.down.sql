@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS absence_alerts;
+DROP TABLE IF EXISTS sms_usages;
+DROP INDEX IF EXISTS idx_students_parent_2_id;
+DROP INDEX IF EXISTS idx_students_parent_1_id;
+-- users.phone and students.parent_*_id predate this migration in the base schema
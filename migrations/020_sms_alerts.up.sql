@@ -0,0 +1,29 @@
+-- SMS channel: parents' mobile numbers, per-school monthly usage and the
+-- absence alerts already sent.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS phone VARCHAR(50);
+ALTER TABLE students ADD COLUMN IF NOT EXISTS parent_1_id INTEGER REFERENCES users(id) ON DELETE SET NULL;
+ALTER TABLE students ADD COLUMN IF NOT EXISTS parent_2_id INTEGER REFERENCES users(id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS idx_students_parent_1_id ON students(parent_1_id);
+CREATE INDEX IF NOT EXISTS idx_students_parent_2_id ON students(parent_2_id);
+
+CREATE TABLE IF NOT EXISTS sms_usages (
+    school_id INTEGER NOT NULL REFERENCES schools(id) ON DELETE CASCADE,
+    month VARCHAR(7) NOT NULL, -- YYYY-MM
+    messages INTEGER NOT NULL DEFAULT 0,
+    segments INTEGER NOT NULL DEFAULT 0,
+    cost_cents INTEGER NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (school_id, month)
+);
+
+CREATE TABLE IF NOT EXISTS absence_alerts (
+    id SERIAL PRIMARY KEY,
+    school_id INTEGER NOT NULL REFERENCES schools(id) ON DELETE CASCADE,
+    student_id INTEGER NOT NULL,
+    date DATE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_absence_alert_day ON absence_alerts(student_id, date);
+CREATE INDEX IF NOT EXISTS idx_absence_alerts_school_id ON absence_alerts(school_id);
@@ -0,0 +1,10 @@
+-- WebSocket events too large for a NOTIFY payload, read by the other API
+-- nodes and pruned after a few minutes.
+
+CREATE TABLE IF NOT EXISTS relay_messages (
+    id SERIAL PRIMARY KEY,
+    payload BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_relay_messages_created_at ON relay_messages(created_at);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS conversation_reads;
+ALTER TABLE notifications DROP COLUMN IF EXISTS delivered_at;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_conversations_school_id;
+ALTER TABLE conversations DROP COLUMN IF EXISTS created_by;
+-- conversations.school_id predates this migration in the base schema
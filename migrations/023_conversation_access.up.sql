@@ -0,0 +1,6 @@
+-- Conversations belong to one school and remember who started them, for the
+-- messaging policy.
+
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS school_id INTEGER REFERENCES schools(id);
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS created_by INTEGER;
+CREATE INDEX IF NOT EXISTS idx_conversations_school_id ON conversations(school_id);
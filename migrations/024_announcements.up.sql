@@ -0,0 +1,33 @@
+-- Class, grade, campus and school announcements with read confirmations.
+
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS read_only BOOLEAN DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS announcements (
+    id SERIAL PRIMARY KEY,
+    school_id INTEGER NOT NULL REFERENCES schools(id) ON DELETE CASCADE,
+    author_id INTEGER NOT NULL REFERENCES users(id),
+    conversation_id INTEGER NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    scope VARCHAR(20) NOT NULL, -- CLASS, GRADE, CAMPUS, SCHOOL
+    target_id INTEGER,
+    title VARCHAR(255) NOT NULL,
+    body TEXT NOT NULL,
+    allow_replies BOOLEAN DEFAULT TRUE,
+    include_students BOOLEAN DEFAULT FALSE,
+    recipient_count INTEGER,
+    last_reminder_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_announcements_school_id ON announcements(school_id);
+CREATE INDEX IF NOT EXISTS idx_announcements_author_id ON announcements(author_id);
+CREATE INDEX IF NOT EXISTS idx_announcements_conversation_id ON announcements(conversation_id);
+
+CREATE TABLE IF NOT EXISTS announcement_recipients (
+    announcement_id INTEGER NOT NULL REFERENCES announcements(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    read_at TIMESTAMP WITH TIME ZONE,
+    reminded_at TIMESTAMP WITH TIME ZONE,
+    PRIMARY KEY (announcement_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_announcement_recipients_user_id ON announcement_recipients(user_id);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_colloquium_bookings_active;
+DROP INDEX IF EXISTS idx_colloquium_bookings_status;
+ALTER TABLE colloquium_bookings DROP COLUMN IF EXISTS cancelled_at;
+ALTER TABLE colloquium_bookings DROP COLUMN IF EXISTS status;
@@ -0,0 +1,10 @@
+-- Colloquium waiting lists and cancellations.
+
+ALTER TABLE colloquium_bookings ADD COLUMN IF NOT EXISTS status VARCHAR(20) DEFAULT 'CONFIRMED';
+ALTER TABLE colloquium_bookings ADD COLUMN IF NOT EXISTS cancelled_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_colloquium_bookings_status ON colloquium_bookings(status);
+
+-- A student is booked at most once per slot, besides cancelled bookings
+CREATE UNIQUE INDEX IF NOT EXISTS idx_colloquium_bookings_active
+    ON colloquium_bookings(slot_id, parent_id, student_id) WHERE status <> 'CANCELLED';
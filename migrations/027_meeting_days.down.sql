@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_colloquium_slots_meeting_day_id;
+ALTER TABLE colloquium_slots DROP COLUMN IF EXISTS meeting_day_id;
+DROP TABLE IF EXISTS meeting_day_teachers;
+DROP TABLE IF EXISTS meeting_days;
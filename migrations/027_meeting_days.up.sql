@@ -0,0 +1,27 @@
+-- General parent-teacher meeting days (ColloquiumGeneral).
+
+CREATE TABLE IF NOT EXISTS meeting_days (
+    id SERIAL PRIMARY KEY,
+    school_id INTEGER NOT NULL REFERENCES schools(id) ON DELETE CASCADE,
+    title VARCHAR(255) NOT NULL,
+    date DATE NOT NULL,
+    start_time VARCHAR(5) NOT NULL,
+    end_time VARCHAR(5) NOT NULL,
+    slot_minutes INTEGER NOT NULL,
+    buffer_minutes INTEGER DEFAULT 0,
+    created_by INTEGER NOT NULL REFERENCES users(id),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_meeting_days_school_id ON meeting_days(school_id);
+
+CREATE TABLE IF NOT EXISTS meeting_day_teachers (
+    meeting_day_id INTEGER NOT NULL REFERENCES meeting_days(id) ON DELETE CASCADE,
+    teacher_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    room VARCHAR(50),
+    PRIMARY KEY (meeting_day_id, teacher_id)
+);
+
+-- Slots generated for a meeting day
+ALTER TABLE colloquium_slots ADD COLUMN IF NOT EXISTS meeting_day_id INTEGER REFERENCES meeting_days(id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS idx_colloquium_slots_meeting_day_id ON colloquium_slots(meeting_day_id);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_colloquium_slots_follow_up;
+ALTER TABLE colloquium_slots DROP COLUMN IF EXISTS follow_up_sent_at;
+ALTER TABLE colloquium_slots DROP COLUMN IF EXISTS late_sent_at;
+ALTER TABLE colloquium_slots DROP COLUMN IF EXISTS checked_in_at;
+ALTER TABLE colloquium_slots DROP COLUMN IF EXISTS meeting_url;
+ALTER TABLE colloquium_slots DROP COLUMN IF EXISTS mode;
@@ -0,0 +1,10 @@
+-- Online and phone colloquiums, teacher check-in and follow-ups.
+
+ALTER TABLE colloquium_slots ADD COLUMN IF NOT EXISTS mode VARCHAR(20) DEFAULT 'PRESENZA';
+ALTER TABLE colloquium_slots ADD COLUMN IF NOT EXISTS meeting_url VARCHAR(512);
+ALTER TABLE colloquium_slots ADD COLUMN IF NOT EXISTS checked_in_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE colloquium_slots ADD COLUMN IF NOT EXISTS late_sent_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE colloquium_slots ADD COLUMN IF NOT EXISTS follow_up_sent_at TIMESTAMP WITH TIME ZONE;
+
+-- Slots still waiting for their follow-up, scanned every minute
+CREATE INDEX IF NOT EXISTS idx_colloquium_slots_follow_up ON colloquium_slots(date) WHERE follow_up_sent_at IS NULL;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS school_events;
+DROP TABLE IF EXISTS homeworks;
+DROP TABLE IF EXISTS calendar_tokens;
@@ -0,0 +1,2 @@
+ALTER TABLE colloquium_bookings DROP COLUMN IF EXISTS reminder_sent_at;
+DROP TABLE IF EXISTS jobs;
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_user_imports_created_by;
+ALTER TABLE user_imports
+    DROP COLUMN IF EXISTS created_by,
+    DROP COLUMN IF EXISTS file_name,
+    DROP COLUMN IF EXISTS format,
+    DROP COLUMN IF EXISTS mapping,
+    DROP COLUMN IF EXISTS updated_users,
+    DROP COLUMN IF EXISTS preview,
+    DROP COLUMN IF EXISTS confirmed_at;
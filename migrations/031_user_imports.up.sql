@@ -0,0 +1,22 @@
+-- User imports: validation previews, column mappings and confirmation.
+-- The columns of the model not created by 007 are added here.
+
+ALTER TABLE user_imports ALTER COLUMN requester_id DROP NOT NULL;
+
+ALTER TABLE user_imports
+    ADD COLUMN IF NOT EXISTS created_by INTEGER REFERENCES users(id),
+    ADD COLUMN IF NOT EXISTS file_name VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS import_file_path VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS format VARCHAR(10),
+    ADD COLUMN IF NOT EXISTS mapping JSONB,
+    ADD COLUMN IF NOT EXISTS total_users INTEGER DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS imported_users INTEGER DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS updated_users INTEGER DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS failed_users INTEGER DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS error_details JSONB,
+    ADD COLUMN IF NOT EXISTS preview JSONB,
+    ADD COLUMN IF NOT EXISTS confirmed_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS imported_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_user_imports_school_id ON user_imports(school_id);
+CREATE INDEX IF NOT EXISTS idx_user_imports_created_by ON user_imports(created_by);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_data_exports_expiry_date;
+ALTER TABLE data_exports
+    DROP COLUMN IF EXISTS progress,
+    DROP COLUMN IF EXISTS records,
+    DROP COLUMN IF EXISTS size,
+    DROP COLUMN IF EXISTS error;
@@ -0,0 +1,18 @@
+-- School data exports: progress of the generation and the columns of the
+-- model not created by 007.
+
+ALTER TABLE data_exports ALTER COLUMN requester_id DROP NOT NULL;
+
+ALTER TABLE data_exports
+    ADD COLUMN IF NOT EXISTS export_type VARCHAR(10),
+    ADD COLUMN IF NOT EXISTS requested_by INTEGER REFERENCES users(id),
+    ADD COLUMN IF NOT EXISTS file_path VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS expiry_date TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS progress INTEGER DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS records INTEGER DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS size BIGINT DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS error VARCHAR(255);
+
+CREATE INDEX IF NOT EXISTS idx_data_exports_school_id ON data_exports(school_id);
+CREATE INDEX IF NOT EXISTS idx_data_exports_requested_by ON data_exports(requested_by);
+CREATE INDEX IF NOT EXISTS idx_data_exports_expiry_date ON data_exports(expiry_date);
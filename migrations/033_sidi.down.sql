@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS student_outcomes;
+DROP INDEX IF EXISTS idx_students_sidi_code;
+ALTER TABLE students DROP COLUMN IF EXISTS sidi_code;
@@ -0,0 +1,24 @@
+-- SIDI flows: the student codes assigned by the ministry's registry and
+-- the outcomes of the final scrutiny sent with the outcome flow.
+
+ALTER TABLE students ADD COLUMN IF NOT EXISTS sidi_code VARCHAR(20);
+CREATE INDEX IF NOT EXISTS idx_students_sidi_code ON students(sidi_code);
+
+CREATE TABLE IF NOT EXISTS student_outcomes (
+    id SERIAL PRIMARY KEY,
+    school_id INTEGER NOT NULL REFERENCES schools(id),
+    student_id INTEGER NOT NULL REFERENCES students(id) ON DELETE CASCADE,
+    class_id INTEGER NOT NULL REFERENCES classes(id),
+    academic_year VARCHAR(20) NOT NULL,
+    outcome VARCHAR(20) NOT NULL,
+    credits INTEGER DEFAULT 0,
+    final_score INTEGER DEFAULT 0,
+    decided_at TIMESTAMP WITH TIME ZONE,
+    recorded_by INTEGER REFERENCES users(id),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_outcome_student_year ON student_outcomes(student_id, academic_year);
+CREATE INDEX IF NOT EXISTS idx_student_outcomes_school_id ON student_outcomes(school_id);
+CREATE INDEX IF NOT EXISTS idx_student_outcomes_class_id ON student_outcomes(class_id);
@@ -0,0 +1,18 @@
+-- School onboardings: the schools created by the onboarding wizard and the
+-- result of each of its steps. Failed onboardings are kept, without a school.
+
+CREATE TABLE IF NOT EXISTS school_onboardings (
+    id SERIAL PRIMARY KEY,
+    school_id INTEGER REFERENCES schools(id) ON DELETE SET NULL,
+    school_code VARCHAR(50),
+    template VARCHAR(50),
+    status VARCHAR(50),
+    steps JSONB,
+    error VARCHAR(255),
+    created_by INTEGER,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_school_onboardings_school_id ON school_onboardings(school_id);
+CREATE INDEX IF NOT EXISTS idx_school_onboardings_created_by ON school_onboardings(created_by);
@@ -0,0 +1,28 @@
+DROP POLICY IF EXISTS "Tenant isolation" ON documents;
+DROP POLICY IF EXISTS "Tenant isolation" ON students;
+DROP POLICY IF EXISTS "Tenant isolation" ON subjects;
+DROP POLICY IF EXISTS "Tenant isolation" ON classes;
+
+DROP POLICY IF EXISTS "Students see themselves" ON students;
+CREATE POLICY "Students see themselves" ON students FOR SELECT USING (id = (SELECT id FROM students WHERE user_id = current_user_id()));
+
+DROP POLICY IF EXISTS "School members see subjects" ON subjects;
+DROP POLICY IF EXISTS "School members see classes" ON classes;
+
+DROP POLICY IF EXISTS "Platform administrators" ON documents;
+DROP POLICY IF EXISTS "Platform administrators" ON students;
+DROP POLICY IF EXISTS "Platform administrators" ON subjects;
+DROP POLICY IF EXISTS "Platform administrators" ON classes;
+
+DROP POLICY IF EXISTS "Sessions without a user" ON documents;
+DROP POLICY IF EXISTS "Sessions without a user" ON students;
+DROP POLICY IF EXISTS "Sessions without a user" ON subjects;
+DROP POLICY IF EXISTS "Sessions without a user" ON classes;
+
+ALTER TABLE documents NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE students NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE subjects NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE classes NO FORCE ROW LEVEL SECURITY;
+
+ALTER TABLE subjects DISABLE ROW LEVEL SECURITY;
+ALTER TABLE classes DISABLE ROW LEVEL SECURITY;
@@ -0,0 +1,45 @@
+-- Tenant isolation: make the row level security policies of 009 effective
+-- for the tenant scoped repository methods. These set app.current_school_id,
+-- app.current_user_id and app.current_user_role for their transaction (SET
+-- LOCAL); the policies apply to the owner of the tables too once it is
+-- forced. Superusers and BYPASSRLS roles are still not subject to them.
+
+ALTER TABLE classes ENABLE ROW LEVEL SECURITY;
+ALTER TABLE subjects ENABLE ROW LEVEL SECURITY;
+
+ALTER TABLE classes FORCE ROW LEVEL SECURITY;
+ALTER TABLE subjects FORCE ROW LEVEL SECURITY;
+ALTER TABLE students FORCE ROW LEVEL SECURITY;
+ALTER TABLE documents FORCE ROW LEVEL SECURITY;
+
+-- Sessions without a user are those of the migrations, of the background
+-- jobs acting on a school, which the tenant isolation policy restricts to
+-- it, and of the repository methods not tenant scoped yet. This policy lets
+-- the latter through: they only see the rows of a school by the filters of
+-- their own queries, and only the methods taking a tenant context are bound
+-- by the policies below
+CREATE POLICY "Sessions without a user" ON classes FOR ALL USING (current_user_id() IS NULL);
+CREATE POLICY "Sessions without a user" ON subjects FOR ALL USING (current_user_id() IS NULL);
+CREATE POLICY "Sessions without a user" ON students FOR ALL USING (current_user_id() IS NULL);
+CREATE POLICY "Sessions without a user" ON documents FOR ALL USING (current_user_id() IS NULL);
+
+CREATE POLICY "Platform administrators" ON classes FOR ALL USING (current_user_role() = 'SuperAdmin');
+CREATE POLICY "Platform administrators" ON subjects FOR ALL USING (current_user_role() = 'SuperAdmin');
+CREATE POLICY "Platform administrators" ON students FOR ALL USING (current_user_role() = 'SuperAdmin');
+CREATE POLICY "Platform administrators" ON documents FOR ALL USING (current_user_role() = 'SuperAdmin');
+
+-- The whole school sees its classes and subjects
+CREATE POLICY "School members see classes" ON classes FOR SELECT USING (school_id = current_school_id());
+CREATE POLICY "School members see subjects" ON subjects FOR SELECT USING (school_id = current_school_id());
+
+-- The policy of 009 read students from a policy on students, which
+-- Postgres rejects as infinite recursion once it applies
+DROP POLICY IF EXISTS "Students see themselves" ON students;
+CREATE POLICY "Students see themselves" ON students FOR SELECT USING (user_id = current_user_id());
+
+-- Whatever the other policies allow, a session acting on a school never
+-- sees the rows of another one
+CREATE POLICY "Tenant isolation" ON classes AS RESTRICTIVE FOR ALL USING (current_school_id() IS NULL OR school_id = current_school_id());
+CREATE POLICY "Tenant isolation" ON subjects AS RESTRICTIVE FOR ALL USING (current_school_id() IS NULL OR school_id = current_school_id());
+CREATE POLICY "Tenant isolation" ON students AS RESTRICTIVE FOR ALL USING (current_school_id() IS NULL OR school_id = current_school_id());
+CREATE POLICY "Tenant isolation" ON documents AS RESTRICTIVE FOR ALL USING (current_school_id() IS NULL OR school_id = current_school_id());
@@ -0,0 +1,3 @@
+-- The school year of the SIDI data exports.
+
+ALTER TABLE data_exports ADD COLUMN IF NOT EXISTS academic_year VARCHAR(9);
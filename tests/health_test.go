@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/k/iRegistro/internal/application/communication"
 	httpPresentation "github.com/k/iRegistro/internal/presentation/http"
 	"github.com/k/iRegistro/internal/presentation/http/handlers"
 	"github.com/stretchr/testify/assert"
@@ -17,8 +18,8 @@ func TestHealthCheck(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	// Use the actual router implementation
 	// For health check test, we don't need a real auth service
-	authHandler := handlers.NewAuthHandler(nil)
-	r := httpPresentation.NewRouter(authHandler, nil, nil, nil, zap.NewNop(), "test-secret")
+	authHandler := handlers.NewAuthHandler(nil, nil, nil)
+	r := httpPresentation.NewRouter(authHandler, nil, nil, nil, zap.NewNop(), "test-secret", nil, communication.AttachmentPolicy{}, nil, nil, nil)
 
 	// Perform Request
 	w := httptest.NewRecorder()
@@ -7,6 +7,7 @@ import (
 
 	"github.com/k/iRegistro/internal/domain"
 	"github.com/k/iRegistro/internal/infrastructure/persistence"
+	"github.com/k/iRegistro/internal/tenant"
 	"github.com/stretchr/testify/assert"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/modules/postgres"
@@ -79,15 +80,16 @@ func TestAcademicRepository_CreateAndGet(t *testing.T) {
 
 	t.Run("Create and Get Class", func(t *testing.T) {
 		class := domain.Class{
-			Grade:   1,
-			Section: "A",
-			Year:    "2024/2025",
+			SchoolID: school.ID,
+			Grade:    1,
+			Section:  "A",
+			Year:     "2024/2025",
 		}
 		err := repo.CreateClass(&class)
 		assert.NoError(t, err)
 		assert.NotZero(t, class.ID)
 
-		fetched, err := repo.GetClassByID(class.ID)
+		fetched, err := repo.GetClassByID(tenant.School(context.Background(), school.ID), class.ID)
 		assert.NoError(t, err)
 		assert.Equal(t, "A", fetched.Section)
 	})
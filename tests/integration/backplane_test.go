@@ -0,0 +1,78 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/k/iRegistro/internal/infrastructure/backplane"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/wait"
+	gormPG "gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestPostgresBackplane(t *testing.T) {
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pgContainer, err := postgres.RunContainer(ctx,
+		testcontainers.WithImage("postgres:15-alpine"),
+		postgres.WithDatabase("testdb"),
+		postgres.WithUsername("postgres"),
+		postgres.WithPassword("test"),
+		testcontainers.WithWaitStrategy(
+			wait.ForLog("database system is ready to accept connections").
+				WithOccurrence(2).
+				WithStartupTimeout(30*time.Second)),
+	)
+	require.NoError(t, err)
+	defer pgContainer.Terminate(context.Background())
+	dsn, err := pgContainer.ConnectionString(ctx, "sslmode=disable")
+	require.NoError(t, err)
+	db, err := gorm.Open(gormPG.Open(dsn), &gorm.Config{})
+	require.NoError(t, err)
+
+	// Two nodes sharing the database
+	nodeA, err := backplane.NewPostgres(db, dsn, "ws_test")
+	require.NoError(t, err)
+	nodeB, err := backplane.NewPostgres(db, dsn, "ws_test")
+	require.NoError(t, err)
+
+	received := make(chan []byte, 16)
+	go nodeB.Subscribe(ctx, func(payload []byte) { received <- payload })
+
+	small := []byte(`{"id":"1","message":"small"}`)
+	large := bytes.Repeat([]byte("x"), 20000) // Over the NOTIFY limit
+	// The listener may not be connected yet: publish until it is
+	require.Eventually(t, func() bool {
+		if err := nodeA.Publish(ctx, small); err != nil {
+			return false
+		}
+		select {
+		case payload := <-received:
+			return bytes.Equal(small, payload)
+		case <-time.After(200 * time.Millisecond):
+			return false
+		}
+	}, 10*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, nodeA.Publish(ctx, large))
+	for {
+		select {
+		case payload := <-received:
+			if bytes.Equal(payload, small) {
+				continue // A late copy of the warm-up event
+			}
+			assert.Equal(t, large, payload)
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("large event not relayed")
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package integration
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/k/iRegistro/internal/infrastructure/persistence"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+)
+
+func TestColloquiumBookingConcurrency(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	db, cleanup := SetupTestDB(t)
+	defer cleanup()
+	require.NoError(t, db.AutoMigrate(&domain.ColloquiumSlot{}, &domain.ColloquiumBooking{}))
+	repo := persistence.NewCommunicationRepository(db)
+
+	slot := &domain.ColloquiumSlot{TeacherID: 1, Date: time.Now().AddDate(0, 0, 1), StartTime: "15:00", EndTime: "15:10", MaxParticipants: 3, IsAvailable: true}
+	require.NoError(t, repo.CreateColloquiumSlot(slot))
+
+	// Many parents booking at the same time
+	const parents = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, parents)
+	for i := 0; i < parents; i++ {
+		wg.Add(1)
+		go func(parentID uint) {
+			defer wg.Done()
+			errs <- repo.BookSlot(&domain.ColloquiumBooking{SlotID: slot.ID, ParentID: parentID, StudentID: parentID + 100, BookedAt: time.Now()})
+		}(uint(i + 1))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	var bookings []domain.ColloquiumBooking
+	require.NoError(t, db.Where("slot_id = ?", slot.ID).Order("id").Find(&bookings).Error)
+	require.Len(t, bookings, parents)
+	counts := map[domain.BookingStatus]int{}
+	for _, b := range bookings {
+		counts[b.Status]++
+	}
+	assert.Equal(t, 3, counts[domain.BookingConfirmed], "never overbooked")
+	assert.Equal(t, parents-3, counts[domain.BookingWaitlisted])
+
+	err := repo.BookSlot(&domain.ColloquiumBooking{SlotID: slot.ID, ParentID: 1, StudentID: 101, BookedAt: time.Now()})
+	assert.ErrorIs(t, err, domain.ErrAlreadyBooked)
+
+	// Cancelling a confirmed booking promotes the first in the waiting list
+	var confirmed, first domain.ColloquiumBooking
+	require.NoError(t, db.Where("slot_id = ? AND status = ?", slot.ID, domain.BookingConfirmed).First(&confirmed).Error)
+	require.NoError(t, db.Where("slot_id = ? AND status = ?", slot.ID, domain.BookingWaitlisted).Order("booked_at, id").First(&first).Error)
+	promoted, err := repo.CancelBooking(confirmed.ID, time.Now())
+	require.NoError(t, err)
+	require.NotNil(t, promoted)
+	assert.Equal(t, first.ID, promoted.ID)
+	promoted, err = repo.CancelBooking(confirmed.ID, time.Now())
+	require.NoError(t, err)
+	assert.Nil(t, promoted, "cancelling twice promotes nobody")
+
+	// Concurrent cancellations keep the slot full
+	var active []domain.ColloquiumBooking
+	require.NoError(t, db.Where("slot_id = ? AND status = ?", slot.ID, domain.BookingConfirmed).Find(&active).Error)
+	for _, b := range active {
+		wg.Add(1)
+		go func(id uint) {
+			defer wg.Done()
+			_, err := repo.CancelBooking(id, time.Now())
+			assert.NoError(t, err)
+		}(b.ID)
+	}
+	wg.Wait()
+	var count int64
+	require.NoError(t, db.Model(&domain.ColloquiumBooking{}).Where("slot_id = ? AND status = ?", slot.ID, domain.BookingConfirmed).Count(&count).Error)
+	assert.Equal(t, int64(3), count)
+
+	cancelled, err := repo.CancelSlot(slot.ID, time.Now())
+	require.NoError(t, err)
+	assert.Len(t, cancelled, parents-4)
+	err = repo.BookSlot(&domain.ColloquiumBooking{SlotID: slot.ID, ParentID: 50, StudentID: 150, BookedAt: time.Now()})
+	assert.ErrorIs(t, err, domain.ErrSlotUnavailable)
+}
@@ -0,0 +1,207 @@
+package integration
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/k/iRegistro/internal/application/auth"
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// MockIdentityRepository for testing, backed by the users of a MockUserRepository
+type MockIdentityRepository struct {
+	users   *MockUserRepository
+	pending []*domain.PendingIdentity
+}
+
+func NewMockIdentityRepository(users *MockUserRepository) *MockIdentityRepository {
+	return &MockIdentityRepository{users: users}
+}
+
+func (m *MockIdentityRepository) FindUsersByTaxCode(taxCode string) ([]domain.User, error) {
+	var result []domain.User
+	for _, u := range m.users.users {
+		if u.TaxCode != nil && *u.TaxCode == taxCode {
+			result = append(result, *u)
+		}
+	}
+	return result, nil
+}
+
+func (m *MockIdentityRepository) CreatePendingIdentity(p *domain.PendingIdentity) error {
+	p.ID = uint(len(m.pending) + 1)
+	p.CreatedAt = time.Now()
+	m.pending = append(m.pending, p)
+	return nil
+}
+
+func (m *MockIdentityRepository) GetPendingIdentityByID(id uint) (*domain.PendingIdentity, error) {
+	for _, p := range m.pending {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MockIdentityRepository) GetOpenPendingIdentityByExternalID(externalID string) (*domain.PendingIdentity, error) {
+	for _, p := range m.pending {
+		if p.ExternalID == externalID &&
+			(p.Status == domain.IdentityAwaitingConfirmation || p.Status == domain.IdentityPendingApproval) {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MockIdentityRepository) GetPendingIdentityByTokenHash(tokenHash string) (*domain.PendingIdentity, error) {
+	for _, p := range m.pending {
+		if p.ConfirmTokenHash != "" && p.ConfirmTokenHash == tokenHash {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MockIdentityRepository) ListPendingIdentities(schoolID uint, status domain.IdentityStatus) ([]domain.PendingIdentity, error) {
+	var result []domain.PendingIdentity
+	for _, p := range m.pending {
+		if p.SchoolID == schoolID && p.Status == status {
+			result = append(result, *p)
+		}
+	}
+	return result, nil
+}
+
+func (m *MockIdentityRepository) UpdatePendingIdentity(p *domain.PendingIdentity) error {
+	return nil // Records are shared by pointer
+}
+
+func spidAttrs(taxCode, email string) *auth.SPIDAttributes {
+	return &auth.SPIDAttributes{
+		TaxCode:    taxCode,
+		Name:       "Anna",
+		FamilyName: "Neri",
+		Email:      email,
+		Provider:   "https://posteid.poste.it",
+	}
+}
+
+func TestSPIDAccountLinking(t *testing.T) {
+	newServices := func() (*MockUserRepository, *MockIdentityRepository, *auth.IdentityLinkService, *auth.SPIDService, *auth.CIEService) {
+		users := NewMockUserRepository()
+		identities := NewMockIdentityRepository(users)
+		authRepo := NewMockAuthRepository()
+		tokens := auth.NewTokenService(authRepo, "secret", 15*time.Minute, time.Hour)
+		links := auth.NewIdentityLinkService(users, identities)
+		return users, identities, links,
+			auth.NewSPIDService(authRepo, NewMockSAMLRepository(), tokens, links, nil),
+			auth.NewCIEService(authRepo, tokens, links, nil, nil)
+	}
+	ctx := context.Background()
+
+	t.Run("Pre-registered tax code is linked with its role", func(t *testing.T) {
+		users, _, _, spidService, cieService := newServices()
+		taxCode := "NRENNA80A41H501X"
+		users.Create(&domain.User{ID: 5, Email: "anna.neri@scuola.it", Role: domain.RoleTeacher, SchoolID: 2, TaxCode: &taxCode})
+
+		// SPID sends the fiscalNumber with the TINIT- prefix
+		user, err := spidService.ResolveUserBySPID(ctx, spidAttrs("TINIT-"+taxCode, "anna.personal@example.com"), 2)
+		require.NoError(t, err)
+		assert.Equal(t, uint(5), user.ID)
+		assert.Equal(t, domain.RoleTeacher, user.Role)
+		require.NotNil(t, user.ExternalID)
+		assert.Equal(t, "spid:"+taxCode, *user.ExternalID)
+		assert.NotNil(t, user.SPIDProvider)
+
+		// The same person logging in with CIE reaches the same account
+		cieUser, err := cieService.ResolveUserByCIE(ctx, &auth.CIEClaims{
+			FiscalNumber: taxCode, GivenName: "Anna", FamilyName: "Neri", SerialNumber: "CA12345AA",
+		}, 2)
+		require.NoError(t, err)
+		assert.Equal(t, uint(5), cieUser.ID)
+		assert.Equal(t, "spid:"+taxCode, *cieUser.ExternalID)
+		assert.Equal(t, "CA12345AA", *cieUser.CIESerialNumber)
+	})
+
+	t.Run("Existing email account must confirm the link", func(t *testing.T) {
+		users, _, links, spidService, _ := newServices()
+		users.Create(&domain.User{ID: 8, Email: "anna@example.com", Role: domain.RoleParent, SchoolID: 1})
+
+		_, err := spidService.ResolveUserBySPID(ctx, spidAttrs("NRENNA80A41H501X", "anna@example.com"), 1)
+		var pendErr *auth.IdentityPendingError
+		require.ErrorAs(t, err, &pendErr)
+		assert.ErrorIs(t, err, auth.ErrIdentityLinkRequired)
+		require.NotEmpty(t, pendErr.ConfirmToken)
+		assert.Nil(t, users.users["anna@example.com"].ExternalID)
+
+		// Another account cannot use the token
+		_, err = links.ConfirmLink(99, pendErr.ConfirmToken)
+		assert.ErrorIs(t, err, auth.ErrIdentityLinkTokenInvalid)
+
+		user, err := links.ConfirmLink(8, pendErr.ConfirmToken)
+		require.NoError(t, err)
+		require.NotNil(t, user.TaxCode)
+		assert.Equal(t, "NRENNA80A41H501X", *user.TaxCode)
+
+		// Tokens are single use
+		_, err = links.ConfirmLink(8, pendErr.ConfirmToken)
+		assert.ErrorIs(t, err, auth.ErrIdentityLinkTokenInvalid)
+
+		// Next login goes straight through
+		linked, err := spidService.ResolveUserBySPID(ctx, spidAttrs("NRENNA80A41H501X", "anna@example.com"), 1)
+		require.NoError(t, err)
+		assert.Equal(t, uint(8), linked.ID)
+	})
+
+	t.Run("Secretary approves with a role", func(t *testing.T) {
+		users, _, links, spidService, _ := newServices()
+
+		_, err := spidService.ResolveUserBySPID(ctx, spidAttrs("NRENNA80A41H501X", "anna@example.com"), 3)
+		require.ErrorIs(t, err, auth.ErrIdentityPendingApproval)
+
+		pending, err := links.ListPending(3)
+		require.NoError(t, err)
+		require.Len(t, pending, 1)
+
+		// Other schools cannot see or act on the request
+		_, err = links.Approve(4, pending[0].ID, 50, auth.ApprovalRequest{Role: domain.RoleParent})
+		assert.ErrorIs(t, err, auth.ErrIdentityForbidden)
+
+		// Staff roles are not granted through the queue
+		_, err = links.Approve(3, pending[0].ID, 50, auth.ApprovalRequest{Role: domain.RolePrincipal})
+		assert.ErrorIs(t, err, auth.ErrIdentityRoleNotAllowed)
+
+		user, err := links.Approve(3, pending[0].ID, 50, auth.ApprovalRequest{Role: domain.RoleParent})
+		require.NoError(t, err)
+		assert.Equal(t, domain.RoleParent, user.Role)
+		assert.Equal(t, uint(3), user.SchoolID)
+		assert.Equal(t, domain.AuthMethodSPID, user.AuthMethod)
+		assert.Empty(t, user.PasswordHash)
+		assert.Contains(t, users.users, "anna@example.com")
+
+		pending, _ = links.ListPending(3)
+		assert.Empty(t, pending)
+
+		linked, err := spidService.ResolveUserBySPID(ctx, spidAttrs("NRENNA80A41H501X", "anna@example.com"), 3)
+		require.NoError(t, err)
+		assert.Equal(t, user.ID, linked.ID)
+	})
+
+	t.Run("Secretary rejects", func(t *testing.T) {
+		users, identities, links, spidService, _ := newServices()
+
+		_, err := spidService.ResolveUserBySPID(ctx, spidAttrs("NRENNA80A41H501X", ""), 3)
+		require.ErrorIs(t, err, auth.ErrIdentityPendingApproval)
+
+		require.NoError(t, links.Reject(3, 1, 50, "unknown person"))
+		assert.Equal(t, domain.IdentityRejected, identities.pending[0].Status)
+		assert.Empty(t, users.users)
+
+		_, err = links.Approve(3, 1, 50, auth.ApprovalRequest{Role: domain.RoleParent})
+		assert.ErrorIs(t, err, auth.ErrIdentityNotPending)
+	})
+}
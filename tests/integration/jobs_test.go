@@ -0,0 +1,95 @@
+package integration
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/k/iRegistro/internal/infrastructure/persistence"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+)
+
+func TestJobRepositoryClaims(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	db, cleanup := SetupTestDB(t)
+	defer cleanup()
+	require.NoError(t, db.AutoMigrate(&domain.Job{}))
+	repo := persistence.NewJobRepository(db)
+
+	now := time.Now()
+	key := "reminders@2026-10-19T15:00:00Z"
+	for i := 0; i < 30; i++ {
+		job := &domain.Job{Type: "export", Payload: domain.JSONMap{"n": i}, Status: domain.JobPending, RunAt: now, MaxAttempts: 3}
+		created, err := repo.EnqueueJob(job)
+		require.NoError(t, err)
+		require.True(t, created)
+	}
+	created, err := repo.EnqueueJob(&domain.Job{Type: "reminders", IdempotencyKey: &key, Status: domain.JobPending, RunAt: now, MaxAttempts: 1})
+	require.NoError(t, err)
+	assert.True(t, created)
+	created, err = repo.EnqueueJob(&domain.Job{Type: "reminders", IdempotencyKey: &key, Status: domain.JobPending, RunAt: now, MaxAttempts: 1})
+	require.NoError(t, err)
+	assert.False(t, created, "same idempotency key")
+	_, err = repo.EnqueueJob(&domain.Job{Type: "export", Status: domain.JobPending, RunAt: now.Add(time.Hour), MaxAttempts: 3})
+	require.NoError(t, err)
+
+	// Workers claiming at the same time never share a job
+	const workers = 6
+	var wg sync.WaitGroup
+	claims := make(chan domain.Job, 100)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(worker string) {
+			defer wg.Done()
+			jobs, err := repo.ClaimJobs(worker, []string{"export"}, now, now.Add(time.Minute), 10)
+			assert.NoError(t, err)
+			for _, j := range jobs {
+				claims <- j
+			}
+		}(fmt.Sprintf("w%d", w))
+	}
+	wg.Wait()
+	close(claims)
+	seen := map[uint]string{}
+	for j := range claims {
+		assert.Empty(t, seen[j.ID], "job %d claimed twice", j.ID)
+		seen[j.ID] = j.LockedBy
+		assert.Equal(t, domain.JobRunning, j.Status)
+		assert.Equal(t, 1, j.Attempts)
+	}
+	assert.Len(t, seen, 30, "the future job is not due")
+
+	// Outcomes only apply while the lease is held
+	var first uint
+	for id := range seen {
+		first = id
+		break
+	}
+	require.NoError(t, repo.CompleteJob(first, "intruder", now))
+	job, err := repo.GetJob(first)
+	require.NoError(t, err)
+	assert.Equal(t, domain.JobRunning, job.Status)
+	require.NoError(t, repo.RetryJob(first, seen[first], now, "timeout"))
+	job, _ = repo.GetJob(first)
+	assert.Equal(t, domain.JobPending, job.Status)
+	assert.Equal(t, "timeout", job.LastError)
+
+	// Expired leases are claimed again
+	later := now.Add(2 * time.Minute)
+	jobs, err := repo.ClaimJobs("w9", []string{"export"}, later, later.Add(time.Minute), 100)
+	require.NoError(t, err)
+	assert.Len(t, jobs, 30)
+	for _, j := range jobs {
+		require.NoError(t, repo.CompleteJob(j.ID, "w9", later))
+	}
+	n, err := repo.PurgeJobs(later.Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, int64(30), n)
+}
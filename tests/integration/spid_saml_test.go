@@ -0,0 +1,405 @@
+package integration
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"html"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/logger"
+	"github.com/k/iRegistro/internal/application/auth"
+	"github.com/k/iRegistro/internal/domain"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testSPEntityID = "https://registro.test/auth/spid/metadata"
+	testACSURL     = "https://registro.test/auth/spid/callback"
+)
+
+// MockSAMLRepository for testing
+type MockSAMLRepository struct {
+	requests   map[string]*domain.SAMLRequest
+	assertions map[string]*domain.SAMLAssertionUse
+}
+
+func NewMockSAMLRepository() *MockSAMLRepository {
+	return &MockSAMLRepository{
+		requests:   make(map[string]*domain.SAMLRequest),
+		assertions: make(map[string]*domain.SAMLAssertionUse),
+	}
+}
+
+func (m *MockSAMLRepository) SaveRequest(req *domain.SAMLRequest) error {
+	m.requests[req.ID] = req
+	return nil
+}
+
+func (m *MockSAMLRepository) ConsumeRequest(id string) (*domain.SAMLRequest, error) {
+	req, ok := m.requests[id]
+	if !ok || req.ConsumedAt != nil || time.Now().After(req.ExpiresAt) {
+		return nil, nil
+	}
+	now := time.Now()
+	req.ConsumedAt = &now
+	return req, nil
+}
+
+func (m *MockSAMLRepository) MarkAssertionUsed(use *domain.SAMLAssertionUse) (bool, error) {
+	if _, ok := m.assertions[use.ID]; ok {
+		return false, nil
+	}
+	m.assertions[use.ID] = use
+	return true, nil
+}
+
+func (m *MockSAMLRepository) PurgeExpired(before time.Time) error {
+	return nil
+}
+
+// fakeSPIDIdP is a local SPID identity provider built on crewjam/saml. It
+// answers every AuthnRequest for the same citizen with the configured level.
+type fakeSPIDIdP struct {
+	idp         *saml.IdentityProvider
+	sp          *saml.ServiceProvider
+	assertLevel string
+	lastRequest *saml.AuthnRequest
+}
+
+func (f *fakeSPIDIdP) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	return f.sp.Metadata(), nil
+}
+
+func (f *fakeSPIDIdP) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
+	return &saml.Session{
+		ID:         "session-1",
+		CreateTime: time.Now(),
+		ExpireTime: time.Now().Add(time.Hour),
+		Index:      "1",
+		NameID:     "SPID-0001",
+	}
+}
+
+func (f *fakeSPIDIdP) MakeAssertion(req *saml.IdpAuthnRequest, session *saml.Session) error {
+	if err := (saml.DefaultAssertionMaker{}).MakeAssertion(req, session); err != nil {
+		return err
+	}
+	f.lastRequest = &req.Request
+
+	req.Assertion.AuthnStatements[0].AuthnContext.AuthnContextClassRef.Value = f.assertLevel
+	req.Assertion.AttributeStatements = []saml.AttributeStatement{{
+		Attributes: []saml.Attribute{
+			spidAttribute("fiscalNumber", "TINIT-RSSMRA80A01H501U"),
+			spidAttribute("name", "Mario"),
+			spidAttribute("familyName", "Rossi"),
+			spidAttribute("email", "mario.rossi@example.com"),
+		},
+	}}
+	return nil
+}
+
+func spidAttribute(name, value string) saml.Attribute {
+	return saml.Attribute{
+		Name:       name,
+		NameFormat: "urn:oasis:names:tc:SAML:2.0:attrname-format:basic",
+		Values:     []saml.AttributeValue{{Type: "xs:string", Value: value}},
+	}
+}
+
+func newTestKeyPair(t *testing.T, cn string) (*rsa.PrivateKey, *x509.Certificate, []byte, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return key, cert, certPEM, keyPEM
+}
+
+func mustURL(t *testing.T, raw string) url.URL {
+	u, err := url.Parse(raw)
+	require.NoError(t, err)
+	return *u
+}
+
+var formFieldRe = regexp.MustCompile(`name="(\w+)" value="([^"]*)"`)
+
+// formFields extracts the hidden inputs of a SAML auto-submit form.
+func formFields(body string) url.Values {
+	v := url.Values{}
+	for _, m := range formFieldRe.FindAllStringSubmatch(body, -1) {
+		v.Set(m[1], html.UnescapeString(m[2]))
+	}
+	return v
+}
+
+type spidHarness struct {
+	idp     *fakeSPIDIdP
+	spCert  *x509.Certificate
+	samlRep *MockSAMLRepository
+	service *auth.SPIDService
+}
+
+func newSPIDHarness(t *testing.T) *spidHarness {
+	idpKey, idpCert, _, _ := newTestKeyPair(t, "idp.test")
+	_, spCert, spCertPEM, spKeyPEM := newTestKeyPair(t, "registro.test")
+
+	fake := &fakeSPIDIdP{assertLevel: auth.SpidL2.ClassRef()}
+	fake.idp = &saml.IdentityProvider{
+		Key:                     idpKey,
+		Certificate:             idpCert,
+		Logger:                  logger.DefaultLogger,
+		MetadataURL:             mustURL(t, "https://idp.test/metadata"),
+		SSOURL:                  mustURL(t, "https://idp.test/sso"),
+		ServiceProviderProvider: fake,
+		SessionProvider:         fake,
+		AssertionMaker:          fake,
+		SignatureMethod:         dsig.RSASHA256SignatureMethod,
+	}
+
+	sp, err := auth.NewSPIDServiceProvider(auth.SPIDProviderConfig{
+		EntityID:       testSPEntityID,
+		ACSURL:         testACSURL,
+		MetadataURL:    testSPEntityID,
+		CertificatePEM: spCertPEM,
+		PrivateKeyPEM:  spKeyPEM,
+		IDPMetadata:    fake.idp.Metadata(),
+	})
+	require.NoError(t, err)
+	fake.sp = sp
+
+	users := NewMockUserRepository()
+	authRepo := NewMockAuthRepository()
+	samlRepo := NewMockSAMLRepository()
+	tokens := auth.NewTokenService(authRepo, "secret", 15*time.Minute, time.Hour)
+	links := auth.NewIdentityLinkService(users, NewMockIdentityRepository(users))
+
+	return &spidHarness{
+		idp:     fake,
+		spCert:  spCert,
+		samlRep: samlRepo,
+		service: auth.NewSPIDService(authRepo, samlRepo, tokens, links, sp),
+	}
+}
+
+// sendToIdP delivers the AuthnRequest to the fake IdP, checking its signature
+// as a real SPID IdP would, and returns the response form posted to the ACS.
+func (h *spidHarness) sendToIdP(t *testing.T, req *auth.SPIDAuthnRequest) url.Values {
+	t.Helper()
+	var idpReq *http.Request
+
+	switch req.Binding {
+	case saml.HTTPRedirectBinding:
+		u, err := url.Parse(req.RedirectURL)
+		require.NoError(t, err)
+
+		// The signature covers the raw query up to &Signature=
+		signed, sigParam, found := strings.Cut(u.RawQuery, "&Signature=")
+		require.True(t, found, "redirect binding must be signed")
+		assert.Contains(t, signed, "SigAlg="+url.QueryEscape(dsig.RSASHA256SignatureMethod))
+		sigB64, err := url.QueryUnescape(sigParam)
+		require.NoError(t, err)
+		sig, err := base64.StdEncoding.DecodeString(sigB64)
+		require.NoError(t, err)
+		digest := sha256.Sum256([]byte(signed))
+		require.NoError(t, rsa.VerifyPKCS1v15(h.spCert.PublicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], sig))
+
+		idpReq = httptest.NewRequest(http.MethodGet, req.RedirectURL, nil)
+
+	case saml.HTTPPostBinding:
+		fields := formFields(string(req.PostForm))
+		raw, err := base64.StdEncoding.DecodeString(fields.Get("SAMLRequest"))
+		require.NoError(t, err)
+
+		// The enveloped XML signature must verify against the SP certificate
+		doc := etree.NewDocument()
+		require.NoError(t, doc.ReadFromBytes(raw))
+		vctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: []*x509.Certificate{h.spCert}})
+		_, err = vctx.Validate(doc.Root())
+		require.NoError(t, err, "POST binding must carry a valid XML signature")
+
+		idpReq = httptest.NewRequest(http.MethodPost, "https://idp.test/sso", strings.NewReader(fields.Encode()))
+		idpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	w := httptest.NewRecorder()
+	h.idp.idp.ServeSSO(w, idpReq)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	fields := formFields(w.Body.String())
+	require.NotEmpty(t, fields.Get("SAMLResponse"))
+	return fields
+}
+
+func postToACS(form url.Values) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, testACSURL, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestSPIDSAMLBindings(t *testing.T) {
+	for _, binding := range []string{saml.HTTPRedirectBinding, saml.HTTPPostBinding} {
+		t.Run(binding, func(t *testing.T) {
+			h := newSPIDHarness(t)
+
+			req, err := h.service.BeginLogin(7, "https://app.test/callback", auth.SpidL2, binding)
+			require.NoError(t, err)
+			assert.Contains(t, h.samlRep.requests, req.ID)
+
+			form := h.sendToIdP(t, req)
+
+			// The IdP received the requested level and ForceAuthn
+			require.NotNil(t, h.idp.lastRequest.RequestedAuthnContext)
+			assert.Equal(t, "https://www.spid.gov.it/SpidL2", h.idp.lastRequest.RequestedAuthnContext.AuthnContextClassRef)
+			assert.Equal(t, "minimum", h.idp.lastRequest.RequestedAuthnContext.Comparison)
+			require.NotNil(t, h.idp.lastRequest.ForceAuthn)
+			assert.True(t, *h.idp.lastRequest.ForceAuthn)
+
+			login, err := h.service.CompleteLogin(postToACS(form))
+			require.NoError(t, err)
+			assert.Equal(t, auth.SpidL2, login.Level)
+			assert.Equal(t, uint(7), login.SchoolID)
+			assert.Equal(t, "https://app.test/callback", login.RedirectURI)
+			assert.Equal(t, "TINIT-RSSMRA80A01H501U", login.Attributes.TaxCode)
+			assert.Equal(t, "https://idp.test/metadata", login.Attributes.Provider)
+		})
+	}
+}
+
+func TestSPIDSAMLProtections(t *testing.T) {
+	t.Run("Response cannot be posted twice", func(t *testing.T) {
+		h := newSPIDHarness(t)
+		req, err := h.service.BeginLogin(1, "", auth.SpidL2, saml.HTTPRedirectBinding)
+		require.NoError(t, err)
+		form := h.sendToIdP(t, req)
+
+		_, err = h.service.CompleteLogin(postToACS(form))
+		require.NoError(t, err)
+
+		_, err = h.service.CompleteLogin(postToACS(form))
+		assert.ErrorIs(t, err, auth.ErrSAMLUnknownRequest)
+	})
+
+	t.Run("Assertion ID replay is detected", func(t *testing.T) {
+		h := newSPIDHarness(t)
+		req, err := h.service.BeginLogin(1, "", auth.SpidL2, saml.HTTPRedirectBinding)
+		require.NoError(t, err)
+		form := h.sendToIdP(t, req)
+
+		_, err = h.service.CompleteLogin(postToACS(form))
+		require.NoError(t, err)
+
+		// Even if the request were still open, the assertion is refused
+		h.samlRep.requests[req.ID].ConsumedAt = nil
+		_, err = h.service.CompleteLogin(postToACS(form))
+		assert.ErrorIs(t, err, auth.ErrSAMLReplay)
+	})
+
+	t.Run("InResponseTo must match the stored request", func(t *testing.T) {
+		h := newSPIDHarness(t)
+		first, err := h.service.BeginLogin(1, "", auth.SpidL2, saml.HTTPRedirectBinding)
+		require.NoError(t, err)
+		second, err := h.service.BeginLogin(1, "", auth.SpidL2, saml.HTTPRedirectBinding)
+		require.NoError(t, err)
+
+		// Response to the first request presented as the answer to the second
+		form := h.sendToIdP(t, first)
+		form.Set("RelayState", second.ID)
+		_, err = h.service.CompleteLogin(postToACS(form))
+		assert.ErrorIs(t, err, auth.ErrSAMLValidationFailed)
+	})
+
+	t.Run("Unknown or expired requests are rejected", func(t *testing.T) {
+		h := newSPIDHarness(t)
+		req, err := h.service.BeginLogin(1, "", auth.SpidL2, saml.HTTPRedirectBinding)
+		require.NoError(t, err)
+		form := h.sendToIdP(t, req)
+
+		form.Set("RelayState", "id-unknown")
+		_, err = h.service.CompleteLogin(postToACS(form))
+		assert.ErrorIs(t, err, auth.ErrSAMLUnknownRequest)
+
+		form.Set("RelayState", req.ID)
+		h.samlRep.requests[req.ID].ExpiresAt = time.Now().Add(-time.Minute)
+		_, err = h.service.CompleteLogin(postToACS(form))
+		assert.ErrorIs(t, err, auth.ErrSAMLUnknownRequest)
+	})
+
+	t.Run("Lower SPID level than requested", func(t *testing.T) {
+		h := newSPIDHarness(t)
+		h.idp.assertLevel = auth.SpidL1.ClassRef()
+
+		req, err := h.service.BeginLogin(1, "", auth.SpidL2, saml.HTTPRedirectBinding)
+		require.NoError(t, err)
+		_, err = h.service.CompleteLogin(postToACS(h.sendToIdP(t, req)))
+		assert.ErrorIs(t, err, auth.ErrSPIDLevelInsufficient)
+	})
+
+	t.Run("Higher level satisfies the request", func(t *testing.T) {
+		h := newSPIDHarness(t)
+		h.idp.assertLevel = auth.SpidL3.ClassRef()
+
+		req, err := h.service.BeginLogin(1, "", auth.SpidL1, saml.HTTPRedirectBinding)
+		require.NoError(t, err)
+		login, err := h.service.CompleteLogin(postToACS(h.sendToIdP(t, req)))
+		require.NoError(t, err)
+		assert.Equal(t, auth.SpidL3, login.Level)
+
+		// Level 1 requests do not force re-authentication
+		assert.Nil(t, h.idp.lastRequest.ForceAuthn)
+	})
+
+	t.Run("Non-SPID authentication context", func(t *testing.T) {
+		h := newSPIDHarness(t)
+		h.idp.assertLevel = "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+
+		req, err := h.service.BeginLogin(1, "", auth.SpidL1, saml.HTTPRedirectBinding)
+		require.NoError(t, err)
+		_, err = h.service.CompleteLogin(postToACS(h.sendToIdP(t, req)))
+		assert.ErrorIs(t, err, auth.ErrSAMLValidationFailed)
+	})
+}
+
+func TestParseSPIDLevel(t *testing.T) {
+	for input, want := range map[string]auth.SPIDLevel{
+		"1": auth.SpidL1, "L2": auth.SpidL2, "SpidL3": auth.SpidL3,
+		"https://www.spid.gov.it/SpidL2": auth.SpidL2,
+	} {
+		got, err := auth.ParseSPIDLevel(input)
+		require.NoError(t, err, input)
+		assert.Equal(t, want, got, input)
+	}
+
+	for _, input := range []string{"", "0", "4", "high"} {
+		_, err := auth.ParseSPIDLevel(input)
+		assert.ErrorIs(t, err, auth.ErrSPIDLevelInvalid, input)
+	}
+}
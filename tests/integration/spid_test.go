@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/crewjam/saml"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/k/iRegistro/internal/application/auth"
 	"github.com/k/iRegistro/internal/domain"
@@ -25,6 +26,9 @@ func NewMockUserRepository() *MockUserRepository {
 }
 
 func (m *MockUserRepository) Create(user *domain.User) error {
+	if user.ID == 0 {
+		user.ID = uint(len(m.users) + 100)
+	}
 	m.users[user.Email] = user
 	return nil
 }
@@ -33,7 +37,7 @@ func (m *MockUserRepository) FindByEmail(email string) (*domain.User, error) {
 	if user, ok := m.users[email]; ok {
 		return user, nil
 	}
-	return nil, domain.ErrUserNotFound
+	return nil, nil
 }
 
 func (m *MockUserRepository) FindByID(id uint) (*domain.User, error) {
@@ -51,7 +55,7 @@ func (m *MockUserRepository) GetByExternalID(ctx context.Context, externalID str
 			return user, nil
 		}
 	}
-	return nil, domain.ErrUserNotFound
+	return nil, nil
 }
 
 func (m *MockUserRepository) Update(user *domain.User) error {
@@ -63,10 +67,23 @@ func (m *MockUserRepository) FindAll(schoolID uint) ([]domain.User, error) {
 	return nil, nil
 }
 
+func (m *MockUserRepository) Delete(id uint) error {
+	return nil
+}
+
+func (m *MockUserRepository) CountAll() (int64, error) {
+	return int64(len(m.users)), nil
+}
+
+func (m *MockUserRepository) CountBySchoolAndRole(schoolID uint, role domain.Role) (int64, error) {
+	return 0, nil
+}
+
 // MockAuthRepository for testing
 type MockAuthRepository struct {
 	sessions      map[string]*domain.Session
 	refreshTokens map[string]*domain.RefreshToken
+	auditLogs     []*domain.AuthAuditLog
 }
 
 func NewMockAuthRepository() *MockAuthRepository {
@@ -101,6 +118,23 @@ func (m *MockAuthRepository) GetRefreshToken(tokenHash string) (*domain.RefreshT
 	return nil, domain.ErrUserNotFound
 }
 
+func (m *MockAuthRepository) CreateAuthAuditLog(log *domain.AuthAuditLog) error {
+	m.auditLogs = append(m.auditLogs, log)
+	return nil
+}
+
+func (m *MockAuthRepository) RevokeUserSessions(userID uint) error { return nil }
+func (m *MockAuthRepository) CreatePasswordResetToken(token *domain.PasswordResetToken) error {
+	return nil
+}
+func (m *MockAuthRepository) GetPasswordResetToken(selector string) (*domain.PasswordResetToken, error) {
+	return nil, nil
+}
+func (m *MockAuthRepository) UsePasswordResetToken(id uint) (bool, error) { return false, nil }
+func (m *MockAuthRepository) CountPasswordResetTokens(userID uint, since time.Time) (int64, error) {
+	return 0, nil
+}
+
 // createMockSAMLAssertion creates a mock SAML assertion for testing
 func createMockSAMLAssertion(taxCode, name, familyName, email, provider string) *saml.Assertion {
 	now := time.Now()
@@ -166,9 +200,13 @@ func TestSPIDAuthenticationFlow(t *testing.T) {
 		EntityID: "https://test.esempio.it",
 	}
 
-	spidService := auth.NewSPIDService(mockUserRepo, jwtSecret, sp)
+	mockAuthRepo := NewMockAuthRepository()
+	tokens := auth.NewTokenService(mockAuthRepo, jwtSecret, 15*time.Minute, 7*24*time.Hour)
+	identityRepo := NewMockIdentityRepository(mockUserRepo)
+	links := auth.NewIdentityLinkService(mockUserRepo, identityRepo)
+	spidService := auth.NewSPIDService(mockAuthRepo, NewMockSAMLRepository(), tokens, links, sp)
 
-	t.Run("Successful SPID Authentication - New User", func(t *testing.T) {
+	t.Run("Unknown SPID identity is queued for approval", func(t *testing.T) {
 		// Create mock SAML assertion
 		assertion := createMockSAMLAssertion(
 			"RSSMRA80A01H501U", // Tax code
@@ -189,18 +227,27 @@ func TestSPIDAuthenticationFlow(t *testing.T) {
 		assert.Equal(t, "mario.rossi@example.com", attrs.Email)
 		assert.Contains(t, attrs.Provider, "poste")
 
-		// Create or get user
+		// No account is created: the identity waits for the secretary
 		schoolID := uint(1)
-		user, err := spidService.GetOrCreateUserBySPID(context.Background(), attrs, schoolID)
-		require.NoError(t, err)
-
-		// Verify user was created
-		assert.NotNil(t, user)
-		assert.Equal(t, "mario.rossi@example.com", user.Email)
-		assert.Equal(t, "spid", user.AuthMethod)
-		assert.NotNil(t, user.SPIDProvider)
-		assert.NotNil(t, user.ExternalID)
-		assert.Contains(t, *user.ExternalID, "spid:")
+		user, err := spidService.ResolveUserBySPID(context.Background(), attrs, schoolID)
+		assert.Nil(t, user)
+		assert.ErrorIs(t, err, auth.ErrIdentityPendingApproval)
+
+		var pendErr *auth.IdentityPendingError
+		require.ErrorAs(t, err, &pendErr)
+		assert.Empty(t, pendErr.ConfirmToken)
+		assert.Equal(t, domain.IdentityPendingApproval, pendErr.Pending.Status)
+		assert.Equal(t, "RSSMRA80A01H501U", pendErr.Pending.TaxCode)
+		assert.Equal(t, schoolID, pendErr.Pending.SchoolID)
+
+		_, exists := mockUserRepo.users["mario.rossi@example.com"]
+		assert.False(t, exists)
+
+		// Logging in again does not duplicate the request
+		_, err = spidService.ResolveUserBySPID(context.Background(), attrs, schoolID)
+		assert.ErrorIs(t, err, auth.ErrIdentityPendingApproval)
+		pending, _ := links.ListPending(schoolID)
+		assert.Len(t, pending, 1)
 	})
 
 	t.Run("Successful SPID Authentication - Existing User", func(t *testing.T) {
@@ -228,7 +275,7 @@ func TestSPIDAuthenticationFlow(t *testing.T) {
 		require.NoError(t, err)
 
 		schoolID := uint(1)
-		user, err := spidService.GetOrCreateUserBySPID(context.Background(), attrs, schoolID)
+		user, err := spidService.ResolveUserBySPID(context.Background(), attrs, schoolID)
 		require.NoError(t, err)
 
 		// Should return existing user
@@ -236,6 +283,53 @@ func TestSPIDAuthenticationFlow(t *testing.T) {
 		assert.NotNil(t, user.LastAuthAt)
 	})
 
+	t.Run("Issued tokens are valid JWTs with session and audit entry", func(t *testing.T) {
+		externalID := "spid:VRDLGU70C10F205X"
+		provider := "https://posteid.poste.it"
+		user := &domain.User{
+			ID:           42,
+			Email:        "luigi.verdi@example.com",
+			AuthMethod:   domain.AuthMethodSPID,
+			ExternalID:   &externalID,
+			SPIDProvider: &provider,
+			SchoolID:     3,
+			Role:         domain.RoleTeacher,
+		}
+
+		pair, err := spidService.IssueTokens(user, auth.SpidL2, auth.LoginContext{IPAddress: "10.0.0.1", UserAgent: "test"})
+		require.NoError(t, err)
+
+		parsed, err := jwt.ParseWithClaims(pair.AccessToken, &auth.CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
+			return []byte(jwtSecret), nil
+		})
+		require.NoError(t, err)
+		claims := parsed.Claims.(*auth.CustomClaims)
+		assert.Equal(t, uint(42), claims.UserID)
+		assert.Equal(t, uint(3), claims.SchoolID)
+		assert.Equal(t, domain.RoleTeacher, claims.Role)
+		assert.Equal(t, string(domain.AuthMethodSPID), claims.AuthMethod)
+		assert.Equal(t, auth.SpidL2, claims.AuthLevel)
+
+		assert.Contains(t, mockAuthRepo.sessions, auth.HashToken(pair.AccessToken))
+		assert.Contains(t, mockAuthRepo.refreshTokens, auth.HashToken(pair.RefreshToken))
+
+		last := mockAuthRepo.auditLogs[len(mockAuthRepo.auditLogs)-1]
+		assert.True(t, last.Success)
+		assert.Equal(t, domain.AuthMethodSPID, last.AuthMethod)
+		assert.Equal(t, provider, last.Provider)
+		assert.Equal(t, "10.0.0.1", last.IPAddress)
+	})
+
+	t.Run("Failed attempts are audited with reason", func(t *testing.T) {
+		spidService.RecordFailure("https://login.aruba.it", auth.LoginContext{IPAddress: "10.0.0.2"}, "assertion expired")
+
+		last := mockAuthRepo.auditLogs[len(mockAuthRepo.auditLogs)-1]
+		assert.False(t, last.Success)
+		assert.Nil(t, last.UserID)
+		assert.Equal(t, "https://login.aruba.it", last.Provider)
+		assert.Equal(t, "assertion expired", last.FailureReason)
+	})
+
 	t.Run("Invalid SAML Assertion - Missing Tax Code", func(t *testing.T) {
 		assertion := createMockSAMLAssertion(
 			"", // Missing tax code
@@ -0,0 +1,183 @@
+package integration
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k/iRegistro/internal/domain"
+	"github.com/k/iRegistro/internal/infrastructure/persistence"
+	"github.com/k/iRegistro/internal/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+	"gorm.io/gorm"
+)
+
+// tenantSchool is a school with one row of each tenant scoped table.
+type tenantSchool struct {
+	id, class, student, subject, document, conversation, booking uint
+	year                                                         string
+}
+
+func seedTenantSchool(t *testing.T, db *gorm.DB, code, taxCode string, userID uint) tenantSchool {
+	school := domain.School{Name: "Istituto " + code, Code: code, City: "Roma", Region: "Lazio"}
+	require.NoError(t, db.Create(&school).Error)
+	class := domain.Class{SchoolID: school.ID, Grade: 1, Section: "A", Year: "2025/2026"}
+	require.NoError(t, db.Create(&class).Error)
+	student := domain.Student{SchoolID: school.ID, FirstName: "Mario", LastName: "Rossi", TaxCode: taxCode, UserID: &userID}
+	require.NoError(t, db.Create(&student).Error)
+	enrollment := domain.ClassEnrollment{StudentID: student.ID, ClassID: class.ID, Year: class.Year, Status: domain.EnrollmentActive, EnrollmentDate: time.Now()}
+	require.NoError(t, db.Create(&enrollment).Error)
+	subject := domain.Subject{SchoolID: school.ID, Code: "MAT", Name: "Matematica"}
+	require.NoError(t, db.Create(&subject).Error)
+	document := domain.Document{SchoolID: school.ID, Type: domain.DocReportCard, Title: "Pagella", StudentID: &student.ID}
+	require.NoError(t, db.Create(&document).Error)
+
+	teacher := domain.User{Email: "docente@" + strings.ToLower(code) + ".it", Role: domain.RoleTeacher, SchoolID: school.ID}
+	require.NoError(t, db.Create(&teacher).Error)
+	conversation := domain.Conversation{SchoolID: school.ID, CreatedBy: teacher.ID, ParticipantIDs: domain.JSONUintArray{teacher.ID, userID}}
+	require.NoError(t, db.Create(&conversation).Error)
+	slot := domain.ColloquiumSlot{TeacherID: teacher.ID, Date: time.Now().AddDate(0, 0, 1), StartTime: "15:00", EndTime: "15:10", IsAvailable: true}
+	require.NoError(t, db.Create(&slot).Error)
+	booking := domain.ColloquiumBooking{SlotID: slot.ID, ParentID: userID, StudentID: student.ID, BookedAt: time.Now()}
+	require.NoError(t, db.Create(&booking).Error)
+	return tenantSchool{id: school.ID, class: class.ID, student: student.ID, subject: subject.ID, document: document.ID,
+		conversation: conversation.ID, booking: booking.ID, year: class.Year}
+}
+
+// found reports the reads of lists, and those returning nil for a missing
+// row, finding nothing as gorm.ErrRecordNotFound.
+func found(ok bool, err error) error {
+	if err == nil && !ok {
+		return gorm.ErrRecordNotFound
+	}
+	return err
+}
+
+func TestTenantIsolation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	db, cleanup := SetupTestDB(t)
+	defer cleanup()
+	require.NoError(t, db.AutoMigrate(&domain.Subject{}, &domain.Document{}, &domain.DocumentSignature{},
+		&domain.Conversation{}, &domain.ColloquiumSlot{}, &domain.ColloquiumBooking{}))
+
+	rome := seedTenantSchool(t, db, "RMIC81500X", "RSSMRA10A01H501A", 1001)
+	milan := seedTenantSchool(t, db, "MIIC81500X", "RSSMRA10A01F205B", 1002)
+
+	academic := persistence.NewAcademicRepository(db)
+	reporting := persistence.NewReportingRepository(db)
+	communication := persistence.NewCommunicationRepository(db)
+	// Every tenant scoped read, of the rows of a school
+	reads := map[string]func(ctx context.Context, s tenantSchool) error{
+		"AcademicRepository.GetClassByID": func(ctx context.Context, s tenantSchool) error {
+			_, err := academic.GetClassByID(ctx, s.class)
+			return err
+		},
+		"AcademicRepository.GetStudentByID": func(ctx context.Context, s tenantSchool) error {
+			_, err := academic.GetStudentByID(ctx, s.student)
+			return err
+		},
+		"AcademicRepository.GetSubjectByID": func(ctx context.Context, s tenantSchool) error {
+			_, err := academic.GetSubjectByID(ctx, s.subject)
+			return err
+		},
+		"AcademicRepository.GetStudentsByClassID": func(ctx context.Context, s tenantSchool) error {
+			students, err := academic.GetStudentsByClassID(ctx, s.class, s.year)
+			return found(len(students) > 0, err)
+		},
+		"ReportingRepository.GetDocumentByID": func(ctx context.Context, s tenantSchool) error {
+			_, err := reporting.GetDocumentByID(ctx, s.document)
+			return err
+		},
+		"ReportingRepository.GetDocumentsByStudentID": func(ctx context.Context, s tenantSchool) error {
+			docs, err := reporting.GetDocumentsByStudentID(ctx, s.student)
+			return found(len(docs) > 0, err)
+		},
+		"CommunicationRepository.GetConversationByID": func(ctx context.Context, s tenantSchool) error {
+			conv, err := communication.GetConversationByID(ctx, s.conversation)
+			return found(conv != nil, err)
+		},
+		"CommunicationRepository.GetBookingByID": func(ctx context.Context, s tenantSchool) error {
+			booking, err := communication.GetBookingByID(ctx, s.booking)
+			return found(booking != nil, err)
+		},
+	}
+
+	ctx := context.Background()
+	teacher := func(schoolID uint) context.Context {
+		return tenant.With(ctx, tenant.Tenant{SchoolID: schoolID, UserID: 7, Role: domain.RoleTeacher})
+	}
+	for name, read := range reads {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, read(teacher(rome.id), rome))
+			assert.NoError(t, read(tenant.School(ctx, milan.id), milan))
+
+			assert.ErrorIs(t, read(teacher(milan.id), rome), gorm.ErrRecordNotFound, "read across schools")
+			assert.ErrorIs(t, read(tenant.School(ctx, rome.id), milan), gorm.ErrRecordNotFound, "read across schools")
+
+			assert.ErrorIs(t, read(ctx, rome), tenant.ErrNoTenant, "fails closed without a tenant")
+			assert.ErrorIs(t, read(teacher(0), rome), tenant.ErrNoTenant, "fails closed without a school")
+
+			admin := tenant.With(ctx, tenant.Tenant{SchoolID: milan.id, UserID: 1, Role: domain.RoleSuperAdmin})
+			assert.NoError(t, read(admin, rome), "platform administrators read every school")
+		})
+	}
+}
+
+// TestTenantIsolationPolicies checks the row level security policies the
+// tenant settings make effective, as a role that is not a superuser.
+func TestTenantIsolationPolicies(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	db, cleanup := SetupTestDB(t)
+	defer cleanup()
+	require.NoError(t, db.AutoMigrate(&domain.Subject{}, &domain.Document{}, &domain.DocumentSignature{}, &domain.Mark{}, &domain.Absence{},
+		&domain.Conversation{}, &domain.ColloquiumSlot{}, &domain.ColloquiumBooking{}))
+
+	rome := seedTenantSchool(t, db, "RMIC81500X", "RSSMRA10A01H501A", 1001)
+	seedTenantSchool(t, db, "MIIC81500X", "RSSMRA10A01F205B", 1002)
+
+	// The functions of 009, without its policies on tables this schema
+	// lacks the columns of
+	rls, err := os.ReadFile("../../migrations/009_rls_policies.up.sql")
+	require.NoError(t, err)
+	require.NoError(t, db.Exec(strings.SplitN(string(rls), "-- --- POLICIES ---", 2)[0]).Error)
+	isolation, err := os.ReadFile("../../migrations/035_tenant_isolation.up.sql")
+	require.NoError(t, err)
+	require.NoError(t, db.Exec(string(isolation)).Error)
+	require.NoError(t, db.Exec("CREATE ROLE tenant_app NOLOGIN").Error)
+	require.NoError(t, db.Exec("GRANT SELECT ON ALL TABLES IN SCHEMA public TO tenant_app").Error)
+
+	count := func(table, schoolID, userID, role string) int64 {
+		var n int64
+		require.NoError(t, db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec("SET LOCAL ROLE tenant_app").Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("SELECT set_config('app.current_school_id', ?, true), set_config('app.current_user_id', ?, true), set_config('app.current_user_role', ?, true)", schoolID, userID, role).Error; err != nil {
+				return err
+			}
+			return tx.Table(table).Count(&n).Error
+		}))
+		return n
+	}
+
+	school := func(id uint) string { return strconv.FormatUint(uint64(id), 10) }
+	for _, table := range []string{"classes", "subjects", "students", "documents"} {
+		assert.EqualValues(t, 2, count(table, "", "", ""), "%s: sessions without a tenant are not restricted", table)
+		assert.EqualValues(t, 1, count(table, school(rome.id), "", ""), "%s: a job acting on a school sees it only", table)
+		assert.EqualValues(t, 2, count(table, "", "1", string(domain.RoleSuperAdmin)), "%s: platform administrators see every school", table)
+	}
+	assert.EqualValues(t, 1, count("students", school(rome.id), "1001", string(domain.RoleStudent)), "students see themselves")
+	assert.EqualValues(t, 0, count("students", school(rome.id), "1002", string(domain.RoleStudent)), "never the students of another school")
+	assert.EqualValues(t, 1, count("classes", school(rome.id), "1001", string(domain.RoleStudent)), "the school sees its classes")
+}